@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/kubevirt/kubevirt-imds/internal/kube"
+	"github.com/kubevirt/kubevirt-imds/internal/operator"
+)
+
+func main() {
+	var (
+		webhookImage   string
+		imdsImage      string
+		pullPolicy     string
+		resyncInterval time.Duration
+	)
+
+	flag.StringVar(&webhookImage, "webhook-image", "", "Webhook image, unless IMDSConfig spec.install.webhookImage is set (required)")
+	flag.StringVar(&imdsImage, "imds-image", "", "IMDS sidecar image the webhook injects (required)")
+	flag.StringVar(&pullPolicy, "image-pull-policy", string(corev1.PullIfNotPresent), "Pull policy of the webhook image")
+	flag.DurationVar(&resyncInterval, "resync-interval", 30*time.Second, "How often the webhook objects are reconciled besides IMDSConfig changes")
+	flag.Parse()
+
+	// Allow overriding from environment
+	if v := os.Getenv("IMDS_WEBHOOK_IMAGE"); v != "" {
+		webhookImage = v
+	}
+	if v := os.Getenv("IMDS_IMAGE"); v != "" {
+		imdsImage = v
+	}
+	if webhookImage == "" || imdsImage == "" {
+		log.Fatal("--webhook-image (IMDS_WEBHOOK_IMAGE) and --imds-image (IMDS_IMAGE) are required")
+	}
+	switch corev1.PullPolicy(pullPolicy) {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		log.Fatalf("Invalid --image-pull-policy %q: must be Always, IfNotPresent or Never", pullPolicy)
+	}
+
+	// The webhook is installed next to the operator
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = "kubevirt-imds"
+	}
+
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		log.Fatalf("Failed to load in-cluster config: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		log.Fatalf("Failed to create kubernetes client: %v", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		log.Fatalf("Failed to create dynamic client: %v", err)
+	}
+
+	// Set up signal handling
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigCh
+		log.Printf("Received signal %v, shutting down...", sig)
+		cancel()
+	}()
+
+	reconciler := &operator.Reconciler{
+		Client:  client,
+		Dynamic: dynamicClient,
+		Options: operator.Options{
+			Namespace:       namespace,
+			WebhookImage:    webhookImage,
+			IMDSImage:       imdsImage,
+			ImagePullPolicy: corev1.PullPolicy(pullPolicy),
+		},
+	}
+
+	// Reconcile on every IMDSConfig change, and periodically to repair
+	// drift, renew certificates and pick up the webhook's availability
+	changed := make(chan struct{}, 1)
+	go kube.WatchIMDSConfig(ctx, dynamicClient, func(*kube.IMDSConfigSpec) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	log.Printf("Managing the IMDS webhook in namespace %s", namespace)
+	ticker := time.NewTicker(resyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+		if err := reconciler.Reconcile(ctx); err != nil {
+			log.Printf("Reconcile failed: %v", err)
+		}
+	}
+}
@@ -1,18 +1,55 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/kubevirt/kubevirt-imds/internal/imds"
+	"github.com/kubevirt/kubevirt-imds/internal/kube"
 	"github.com/kubevirt/kubevirt-imds/internal/network"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 )
 
+const (
+	defaultAdminSocket = "/var/run/imds/admin.sock"
+
+	// defaultGARPInterval is how often the IMDS address is re-announced
+	defaultGARPInterval = "60s"
+	// defaultSelfTestInterval is how often the IMDS data path is self-tested
+	defaultSelfTestInterval = "30s"
+	// defaultReconcileInterval is how often the IMDS network is re-checked
+	// in addition to reacting to link events
+	defaultReconcileInterval = "30s"
+)
+
+// networkDiagnostics is the admin GET /debug/network response.
+type networkDiagnostics struct {
+	*network.Diagnostics
+	GuestInterfaces []kube.VMIInterface `json:"guestInterfaces,omitempty"`
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Fprintf(os.Stderr, "Usage: %s <command>\n", os.Args[0])
@@ -20,22 +57,54 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  init   - Set up veth pair and attach to bridge\n")
 		fmt.Fprintf(os.Stderr, "  serve  - Start IMDS HTTP server\n")
 		fmt.Fprintf(os.Stderr, "  run    - Wait for bridge, set up veth, then serve (for sidecar use)\n")
+		fmt.Fprintf(os.Stderr, "  cleanup - Remove the interfaces and nftables rules set up by init\n")
+		fmt.Fprintf(os.Stderr, "  stop   - Drain the running server, then clean up (for preStop hooks)\n")
+		fmt.Fprintf(os.Stderr, "  admin  - Query the admin API of a running server (status, config, stats, network, healthz, readyz, metrics, shutdown, pcap [duration], log-level [level])\n")
 		os.Exit(1)
 	}
 
+	// Move IMDS off 169.254.169.254:80, e.g. when something else owns it
+	if addr := os.Getenv("IMDS_LISTEN_ADDR"); addr != "" {
+		if err := network.SetEndpoint(addr); err != nil {
+			log.Fatalf("Invalid IMDS_LISTEN_ADDR: %v", err)
+		}
+	}
+
 	switch os.Args[1] {
 	case "init":
-		if err := runInit(); err != nil {
+		if err := inTargetNetNS(runInit); err != nil {
 			log.Fatalf("Init failed: %v", err)
 		}
 	case "serve":
-		if err := runServe(); err != nil {
+		if err := rejectTargetNetNS(); err != nil {
+			log.Fatalf("Server failed: %v", err)
+		}
+		iface, err := imdsInterface()
+		if err != nil {
+			log.Fatalf("Server failed: %v", err)
+		}
+		if err := runServe(imdsListenAddr(), iface, nil); err != nil {
 			log.Fatalf("Server failed: %v", err)
 		}
 	case "run":
+		if err := rejectTargetNetNS(); err != nil {
+			log.Fatalf("Run failed: %v", err)
+		}
 		if err := runAll(); err != nil {
 			log.Fatalf("Run failed: %v", err)
 		}
+	case "cleanup":
+		if err := inTargetNetNS(runCleanup); err != nil {
+			log.Fatalf("Cleanup failed: %v", err)
+		}
+	case "stop":
+		if err := runStop(); err != nil {
+			log.Fatalf("Stop failed: %v", err)
+		}
+	case "admin":
+		if err := runAdmin(os.Args[2:]); err != nil {
+			log.Fatalf("Admin command failed: %v", err)
+		}
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", os.Args[1])
 		os.Exit(1)
@@ -44,6 +113,14 @@ func main() {
 
 // runInit sets up the veth pair and attaches it to the VM bridge.
 func runInit() error {
+	switch os.Getenv("IMDS_NETWORK_MODE") {
+	case "passt":
+		return setupPasst()
+	case "macvtap":
+		_, err := setupMacvtap(0)
+		return err
+	}
+
 	// Get bridge name from env or auto-detect
 	bridgeName := os.Getenv("IMDS_BRIDGE_NAME")
 	if bridgeName == "" {
@@ -57,35 +134,615 @@ func runInit() error {
 		log.Printf("Using configured bridge: %s", bridgeName)
 	}
 
+	logDetectedBinding(bridgeName)
+
+	if os.Getenv("IMDS_NETWORK_MODE") == "masquerade" {
+		listenAddr, err := network.EnsureMasqueradeDNAT(bridgeName)
+		if err != nil {
+			return fmt.Errorf("failed to install DNAT rule: %w", err)
+		}
+		log.Printf("Redirecting %s:%d on %s to %s", network.IMDSAddress, network.IMDSPort, bridgeName, listenAddr)
+		return nil
+	}
+
 	// Ensure veth pair exists and is configured correctly
-	if err := network.EnsureVeth(bridgeName); err != nil {
+	pair, err := vethPair(bridgeName)
+	if err != nil {
+		return err
+	}
+	if err := ensureVeth(pair, bridgeName); err != nil {
 		return fmt.Errorf("failed to ensure veth: %w", err)
 	}
 
-	log.Printf("Successfully ensured veth pair attached to bridge %s", bridgeName)
-	log.Printf("IMDS will be available at %s", network.IMDSAddress)
+	log.Printf("Successfully ensured veth pair %s/%s attached to bridge %s", pair.IMDS, pair.Bridge, bridgeName)
+	log.Printf("IMDS will be available at %s", imdsListenAddr())
 	return nil
 }
 
-// runServe starts the IMDS HTTP server.
-func runServe() error {
+// imdsListenAddr is the address guests connect to, set with IMDS_LISTEN_ADDR.
+func imdsListenAddr() string {
+	return net.JoinHostPort(network.IMDSAddress, strconv.Itoa(int(network.IMDSPort)))
+}
+
+// runServe starts the IMDS HTTP server. iface is the interface the IMDS
+// address lives on. If setup is given, it is re-run whenever links change so
+// that the IMDS network is repaired after the bridge or veth is recreated.
+func runServe(listenAddr, iface string, setup func() error) error {
 	// Read configuration from environment
 	tokenPath := getEnvOrDefault("IMDS_TOKEN_PATH", "/var/run/secrets/tokens/token")
 	namespace := os.Getenv("IMDS_NAMESPACE")
 	vmName := os.Getenv("IMDS_VM_NAME")
 	saName := os.Getenv("IMDS_SA_NAME")
-	listenAddr := getEnvOrDefault("IMDS_LISTEN_ADDR", "169.254.169.254:80")
 
 	if namespace == "" {
 		return fmt.Errorf("IMDS_NAMESPACE is required")
 	}
 
 	server := imds.NewServer(tokenPath, namespace, vmName, saName, listenAddr)
+	server.APIServerURL = getAPIServerURL()
+	server.PodName = os.Getenv("IMDS_POD_NAME")
+	server.PodUID = os.Getenv("IMDS_POD_UID")
+	server.NodeName = os.Getenv("IMDS_NODE_NAME")
+
+	// Custom metadata is passed as a JSON object by the webhook
+	if v := os.Getenv("IMDS_METADATA"); v != "" {
+		if err := json.Unmarshal([]byte(v), &server.Metadata); err != nil {
+			return fmt.Errorf("invalid IMDS_METADATA: %w", err)
+		}
+	}
+	server.CAPath = getEnvOrDefault("IMDS_CA_PATH", "/var/run/secrets/tokens/ca.crt")
+
+	// The features that read from the API server share its clients
+	clients := newSidecarClients(server.APIServerURL, tokenPath, server.CAPath)
+
+	// Let a replacement server bind while this one drains, for in-place upgrades
+	server.ReusePort = os.Getenv("IMDS_REUSEPORT") == "true"
+
+	// Give open requests longer to finish, e.g. within a pod's grace period
+	if v := os.Getenv("IMDS_SHUTDOWN_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid IMDS_SHUTDOWN_TIMEOUT %q: must be a positive duration", v)
+		}
+		server.ShutdownTimeout = timeout
+	}
+
+	// Per-VM request rate limit, e.g. higher for image-build VMs
+	if limit, burst, err := rateLimit(); err != nil {
+		return err
+	} else {
+		server.SetRateLimit(limit, burst)
+	}
+
+	// Apply the cluster IMDSConfig: features it turns off are dropped before
+	// anything reads their environment
+	policy := clusterPolicy(clients, namespace)
+	if policy != nil {
+		disableGatedFeatures(*policy)
+	}
+
+	// Serve the audience tokens the kubelet projects, mapped by the webhook
+	if v := os.Getenv("IMDS_AUDIENCE_TOKENS"); v != "" {
+		if err := json.Unmarshal([]byte(v), &server.AudienceTokenPaths); err != nil {
+			return fmt.Errorf("invalid IMDS_AUDIENCE_TOKENS: %w", err)
+		}
+		log.Printf("Serving projected tokens for %d audiences", len(server.AudienceTokenPaths))
+	}
+	if v := os.Getenv("IMDS_TOKEN_NAMES"); v != "" {
+		if err := json.Unmarshal([]byte(v), &server.TokenNames); err != nil {
+			return fmt.Errorf("invalid IMDS_TOKEN_NAMES: %w", err)
+		}
+	}
+
+	// Mint tokens for custom audiences via TokenRequest, restricted to the allowlist
+	audiences := splitList(os.Getenv("IMDS_ALLOWED_AUDIENCES"))
+	if policy != nil && policy.FeatureEnabled(kube.FeatureTokenAudiences) {
+		audiences = append(audiences, policy.AllowedAudiences...)
+	}
+	if len(audiences) > 0 {
+		server.AllowedAudiences = audiences
+		client, err := clients.clientset()
+		if err != nil {
+			return fmt.Errorf("failed to set up TokenRequest client: %w", err)
+		}
+		server.TokenMinter = imds.NewTokenRequestMinter(client, namespace, saName, 3600)
+		log.Printf("Minting tokens for audiences: %v", server.AllowedAudiences)
+	}
+
+	// Serve /v1/token from somewhere other than the projected file, if asked to
+	if source, err := tokenSource(clients, namespace, saName); err != nil {
+		return err
+	} else if source != nil {
+		server.TokenSource = source
+		log.Printf("Serving the ServiceAccount token from %v", source)
+	}
+
+	// Sign the VM's certificate requests through the CSR API, if a signer is configured
+	if issuer, err := certificateIssuer(clients, namespace, vmName); err != nil {
+		return err
+	} else if issuer != nil {
+		server.CertificateIssuer = issuer
+		log.Printf("Issuing certificates through signer %s", os.Getenv("IMDS_CERTIFICATE_SIGNER"))
+	}
+
+	// Serve the Secrets exposed to the VM, read with its own ServiceAccount
+	if v := os.Getenv("IMDS_EXPOSE_SECRETS"); v != "" {
+		if err := json.Unmarshal([]byte(v), &server.ExposedSecrets); err != nil {
+			return fmt.Errorf("invalid IMDS_EXPOSE_SECRETS: %w", err)
+		}
+		client, err := clients.clientset()
+		if err != nil {
+			return fmt.Errorf("failed to set up Secret client: %w", err)
+		}
+		server.SecretReader = imds.NewSecretReader(client, namespace)
+		log.Printf("Exposing %d Secrets at /v1/secrets", len(server.ExposedSecrets))
+	}
+
+	// Serve the ConfigMaps exposed to the VM, read with its own ServiceAccount
+	if v := os.Getenv("IMDS_EXPOSE_CONFIGMAPS"); v != "" {
+		if err := json.Unmarshal([]byte(v), &server.ExposedConfigMaps); err != nil {
+			return fmt.Errorf("invalid IMDS_EXPOSE_CONFIGMAPS: %w", err)
+		}
+		client, err := clients.clientset()
+		if err != nil {
+			return fmt.Errorf("failed to set up ConfigMap client: %w", err)
+		}
+		server.ConfigMapReader = imds.NewConfigMapReader(client, namespace)
+		log.Printf("Exposing %d ConfigMaps at /v1/configs", len(server.ExposedConfigMaps))
+	}
+
+	// Sign the VM's SSH keys, if a signer is configured
+	if ssh, err := sshCertificates(imds.NewFileTokenSource(tokenPath), namespace, vmName); err != nil {
+		return err
+	} else if ssh != nil {
+		server.SSHCertificates = ssh
+		log.Printf("Signing SSH keys with %s for host principals %v and user principals %v", os.Getenv("IMDS_SSH_SIGNER"), ssh.HostPrincipals, ssh.UserPrincipals)
+	}
+
+	// Exchange the VM's token with an external STS, if one is configured
+	if err := configureTokenExchange(server); err != nil {
+		return err
+	}
+	if server.TokenExchanger != nil {
+		log.Printf("Exchanging tokens with %s for targets %v", os.Getenv("IMDS_TOKEN_EXCHANGE_URL"), server.TokenExchangeTargets)
+	}
+
+	// Hold credentials back until the guest attests with its vTPM, if a policy is mounted
+	if attestation, err := tpmAttestation(); err != nil {
+		return err
+	} else if attestation != nil {
+		server.Attestation = attestation
+		log.Printf("Serving credentials only after TPM attestation against %s", attestation.PolicyPath)
+	}
+
+	// Or gate credentials on the guest's state in a Keylime verifier
+	if keylime, err := keylimeVerifier(); err != nil {
+		return err
+	} else if keylime != nil {
+		if server.Attestation != nil {
+			return fmt.Errorf("IMDS_ATTESTATION_POLICY and IMDS_KEYLIME_VERIFIER_URL are mutually exclusive")
+		}
+		server.AttestationVerifier = keylime
+		log.Printf("Serving credentials only while Keylime verifier %s attests agent %s", keylime.URL, keylime.AgentID)
+	}
+
+	// Serve user-data mounted from a ConfigMap or Secret
+	server.UserDataPath = os.Getenv("IMDS_USER_DATA_PATH")
+
+	// Serve the pod's labels and annotations from a downward API volume
+	server.PodInfoDir = os.Getenv("IMDS_POD_INFO_DIR")
+
+	// Serve details of the node the VM runs on
+	if os.Getenv("IMDS_NODE_INFO") == "true" {
+		if server.NodeName == "" {
+			return fmt.Errorf("IMDS_NODE_INFO requires IMDS_NODE_NAME")
+		}
+		client, err := clients.clientset()
+		if err != nil {
+			return fmt.Errorf("failed to set up Node client: %w", err)
+		}
+		server.NodeReader = imds.NewNodeReader(client, server.NodeName)
+	}
+
+	// Proxy read-only API paths, authenticated as the VM's ServiceAccount
+	if paths := splitList(os.Getenv("IMDS_KUBERNETES_PROXY_PATHS")); len(paths) > 0 {
+		transport, err := kube.NewSidecarTransport(server.APIServerURL, tokenPath, server.CAPath)
+		if err != nil {
+			return fmt.Errorf("failed to set up Kubernetes API proxy: %w", err)
+		}
+		proxy, err := imds.NewKubernetesProxy(server.APIServerURL, transport, paths)
+		if err != nil {
+			return fmt.Errorf("invalid IMDS_KUBERNETES_PROXY_PATHS: %w", err)
+		}
+		server.KubernetesProxy = proxy
+	}
+
+	// Proxy the ServiceAccount issuer's OIDC discovery document and JWKS
+	if os.Getenv("IMDS_OIDC") == "true" {
+		client, err := clients.clientset()
+		if err != nil {
+			return fmt.Errorf("failed to set up OIDC client: %w", err)
+		}
+		server.OIDCSource = imds.NewOIDCSource(client.Discovery().RESTClient())
+	}
+
+	// Serve an EC2-compatible instance identity document, filled in from the VMI
+	if identity, err := ec2Identity(namespace); err != nil {
+		return err
+	} else if identity != nil {
+		server.EC2Identity = identity
+		log.Printf("Serving EC2 instance identity documents for account %s in %s", identity.AccountID, identity.AvailabilityZone)
+	}
+
+	// Relay SPIFFE SVIDs if a SPIRE agent socket is mounted
+	if socketPath := os.Getenv("IMDS_SPIFFE_SOCKET"); socketPath != "" {
+		log.Printf("Relaying SPIFFE SVIDs from %s", socketPath)
+		server.SVIDSource = imds.NewWorkloadAPISource(socketPath)
+	}
+
+	if v := os.Getenv("IMDS_LOG_LEVEL"); v != "" {
+		level, err := imds.ParseLogLevel(v)
+		if err != nil {
+			return err
+		}
+		server.SetLogLevel(level)
+	}
 
 	// Set up signal handling for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// VM interfaces last reported in the VMI status, if the VMI is watched
+	var (
+		guestInterfacesMu sync.Mutex
+		guestInterfaces   []kube.VMIInterface
+	)
+
+	// Serve the admin API on a unix socket, separate from the guest-facing listener
+	admin := imds.NewAdminServer(server, getEnvOrDefault("IMDS_ADMIN_SOCKET", defaultAdminSocket))
+	admin.NetworkStats = func() (interface{}, error) { return network.Statistics(iface) }
+	admin.NetworkDiagnostics = func() (interface{}, error) {
+		diag, err := network.CollectDiagnostics(iface)
+		if err != nil {
+			return nil, err
+		}
+		guestInterfacesMu.Lock()
+		defer guestInterfacesMu.Unlock()
+		return networkDiagnostics{Diagnostics: diag, GuestInterfaces: guestInterfaces}, nil
+	}
+	admin.PacketCapture = func(ctx context.Context, w io.Writer) error { return network.Capture(ctx, iface, w) }
+	admin.Liveness = imds.CheckListener(server.ListenAddr)
+
+	// Let a preStop hook stop the server and wait for it to drain
+	stopped := make(chan struct{})
+	admin.Shutdown = func(shutdownCtx context.Context) error {
+		cancel()
+		select {
+		case <-stopped:
+			return nil
+		case <-shutdownCtx.Done():
+			return shutdownCtx.Err()
+		}
+	}
+
+	// Readiness checks, all of which must pass
+	var readiness []func() error
+
+	// Periodically check that the IMDS veth still answers from the bridge side
+	if mode := os.Getenv("IMDS_NETWORK_MODE"); mode == "" || mode == "bridge" {
+		interval, err := time.ParseDuration(getEnvOrDefault("IMDS_SELFTEST_INTERVAL", defaultSelfTestInterval))
+		if err != nil {
+			return fmt.Errorf("invalid IMDS_SELFTEST_INTERVAL: %w", err)
+		}
+		if interval > 0 {
+			tester := network.NewSelfTester(iface, interval)
+			readiness = append(readiness, tester.Ready)
+			go tester.Run(ctx)
+		}
+	}
+
+	// Renew the ServiceAccount token ahead of its expiry and report when it goes stale
+	refreshInterval, parseErr := time.ParseDuration(getEnvOrDefault("IMDS_TOKEN_REFRESH_INTERVAL", imds.DefaultTokenRefreshInterval.String()))
+	if parseErr != nil {
+		return fmt.Errorf("invalid IMDS_TOKEN_REFRESH_INTERVAL: %w", parseErr)
+	}
+	if refreshInterval > 0 {
+		source := server.TokenSource
+		if source == nil {
+			source = imds.NewFileTokenSource(tokenPath)
+		}
+		refresher := imds.NewTokenRefresher(source, refreshInterval)
+		server.TokenSource = refresher
+		admin.Metrics = refresher
+		readiness = append(readiness, refresher.Ready)
+		go refresher.Run(ctx)
+	}
+	admin.Readiness = allChecks(readiness)
+
+	// The admin API outlives the server, so a shutdown request gets its answer
+	adminCtx, stopAdmin := context.WithCancel(context.Background())
+	defer stopAdmin()
+	go func() {
+		if err := admin.Run(adminCtx); err != nil {
+			log.Printf("Admin API stopped: %v", err)
+		}
+	}()
+
+	// Answer kubelet probes on the pod network, if asked to
+	if addr := os.Getenv("IMDS_HEALTH_ADDR"); addr != "" {
+		health := imds.NewHealthServer(addr)
+		health.Liveness = admin.Liveness
+		health.Readiness = admin.Readiness
+		health.Metrics = admin.Metrics
+		go func() {
+			if err := health.Run(ctx); err != nil {
+				log.Printf("Health checks stopped: %v", err)
+			}
+		}()
+	}
+
+	// Keep metadata polling out of the node's conntrack table
+	if os.Getenv("IMDS_NOTRACK") == "true" {
+		if os.Getenv("IMDS_NETWORK_MODE") == "masquerade" {
+			log.Println("Ignoring IMDS_NOTRACK: masquerade DNAT needs connection tracking")
+		} else if err := network.EnsureNotrack(iface); err != nil {
+			return fmt.Errorf("failed to install notrack rules: %w", err)
+		}
+	}
+
+	// Cap guest traffic to IMDS in the kernel, ahead of the HTTP rate limiter
+	if limits, err := shapingLimits(); err != nil {
+		return err
+	} else if limits != (network.ShapingLimits{}) {
+		switch os.Getenv("IMDS_NETWORK_MODE") {
+		case "", "bridge", "macvtap":
+			if err := network.EnsureShaping(iface, limits); err != nil {
+				return fmt.Errorf("failed to install shaping rules: %w", err)
+			}
+			log.Printf("Limiting traffic on %s to %d packets/s, %d bytes/s (0 is unlimited)", iface, limits.PacketsPerSecond, limits.BytesPerSecond)
+		default:
+			log.Println("Ignoring IMDS_MAX_PPS/IMDS_MAX_BANDWIDTH: only supported in bridge and macvtap modes")
+		}
+	}
+
+	// Follow the VMI status to learn the guest's MACs and IPs
+	var onInterfaces []func([]kube.VMIInterface)
+
+	// Only let the VM's own interfaces reach IMDS
+	if os.Getenv("IMDS_FIREWALL") == "true" {
+		onInterfaces = append(onInterfaces, firewallUpdater(iface))
+
+		// Only answer ARP coming from the VM's tap ports, re-applied as taps come and go
+		if mode := os.Getenv("IMDS_NETWORK_MODE"); mode == "" || mode == "bridge" {
+			if err := network.EnsureARPGuard(iface); err != nil {
+				return fmt.Errorf("failed to install ARP guard: %w", err)
+			}
+			if setup != nil {
+				setupVeth := setup
+				setup = func() error {
+					if err := setupVeth(); err != nil {
+						return err
+					}
+					return network.EnsureARPGuard(iface)
+				}
+			}
+		}
+	}
+
+	// Only serve credentials to the VM's own IPs
+	if os.Getenv("IMDS_SOURCE_ALLOWLIST") == "true" {
+		allowlist := imds.NewSourceAllowlist()
+		server.SourceAllowlist = allowlist
+		onInterfaces = append(onInterfaces, func(interfaces []kube.VMIInterface) {
+			allowlist.Set(guestIPs(interfaces))
+		})
+	}
+
+	// Report suspicious requests as Events on the VMI
+	var events *kube.VMIEventRecorder
+	if os.Getenv("IMDS_EVENTS") == "true" {
+		client, err := clients.clientset()
+		if err != nil {
+			return fmt.Errorf("failed to set up Event client: %w", err)
+		}
+		events = kube.NewVMIEventRecorder(client, namespace, vmName, server.NodeName)
+		server.Events = events
+	}
+
+	// Restrict endpoint groups per the cluster IMDSConfig and the VM's policy file
+	if rules, err := endpointPolicy(policy); err != nil {
+		return err
+	} else if len(rules) > 0 {
+		server.EndpointPolicy = rules
+		for group, rule := range rules {
+			log.Printf("Endpoint group %s: disabled=%t requireSource=%t", group, rule.Disabled, rule.RequireSource)
+			if rule.RequireSource && server.SourceAllowlist == nil {
+				log.Printf("Refusing endpoint group %s: its policy requires the source allowlist, which is off", group)
+			}
+		}
+	}
+
+	// Serve each token only to the interface that first received it
+	if os.Getenv("IMDS_TOKEN_BINDING") == "true" {
+		link := guestLink(iface)
+		log.Printf("Binding tokens to guest MACs learned on %s", link)
+		server.TokenBinding = imds.NewTokenBinding(func(ip net.IP) (net.HardwareAddr, error) {
+			return network.NeighborMAC(link, ip)
+		})
+	}
+
+	// Route replies to the guest's IPv6 addresses back through the IMDS
+	// interface, since the pod has no route to addresses it handed to the guest
+	var ipv6Routes bool
+	switch os.Getenv("IMDS_NETWORK_MODE") {
+	case "", "bridge", "macvtap":
+		ipv6Routes = os.Getenv("IMDS_IPV6_ENABLED") == "true"
+	}
+	if ipv6Routes {
+		onInterfaces = append(onInterfaces, func(interfaces []kube.VMIInterface) {
+			if err := network.SyncGuestRoutesV6(iface, guestIPs(interfaces)); err != nil {
+				log.Printf("Failed to sync guest IPv6 routes: %v", err)
+			}
+		})
+	}
+
+	if len(onInterfaces) > 0 {
+		// Keep the latest interfaces for GET /debug/network
+		onInterfaces = append(onInterfaces, func(interfaces []kube.VMIInterface) {
+			guestInterfacesMu.Lock()
+			defer guestInterfacesMu.Unlock()
+			guestInterfaces = interfaces
+		})
+	}
+
+	// Stop serving tokens while the VMI is annotated token-enabled=false. The
+	// switch needs the same VMI RBAC as the features above; without it, and
+	// without those features, the VMI isn't watched. IMDS_TOKEN_SWITCH=true
+	// makes the switch required rather than best effort.
+	tokenSwitch := os.Getenv("IMDS_TOKEN_SWITCH") != "false"
+	requireSwitch := os.Getenv("IMDS_TOKEN_SWITCH") == "true"
+	needVMI := len(onInterfaces) > 0 || server.EC2Identity != nil
+	if needVMI || tokenSwitch {
+		client, err := clients.dynamic()
+		if err != nil {
+			if needVMI || requireSwitch {
+				return fmt.Errorf("failed to set up VMI client: %w", err)
+			}
+			log.Printf("Token kill switch unavailable: %v", err)
+		}
+		watchVMI := err == nil && (needVMI || vmiReadable(ctx, client, namespace, vmName))
+		if err == nil && !watchVMI {
+			if requireSwitch {
+				return fmt.Errorf("IMDS_TOKEN_SWITCH=true requires get and watch on VMI %s/%s", namespace, vmName)
+			}
+			log.Printf("Token kill switch unavailable: the ServiceAccount can't read VMI %s/%s", namespace, vmName)
+		}
+		if watchVMI {
+			go kube.WatchVMI(ctx, client, namespace, vmName, func(vmi *unstructured.Unstructured) {
+				if tokenSwitch {
+					server.SetTokensEnabled(kube.TokensEnabled(vmi))
+				}
+				if server.EC2Identity != nil {
+					server.EC2Identity.SetInstance(ec2Instance(vmi))
+				}
+				if events != nil {
+					events.SetUID(vmi.GetUID())
+				}
+				if len(onInterfaces) == 0 {
+					return
+				}
+				interfaces, err := kube.ParseVMIInterfaces(vmi)
+				if err != nil {
+					log.Printf("Ignoring interfaces of VMI %s/%s: %v", namespace, vmName, err)
+					return
+				}
+				for _, update := range onInterfaces {
+					update(interfaces)
+				}
+			})
+		}
+	}
+
+	// Advertise a route to the IMDS address to guests that send DHCPINFORM
+	if os.Getenv("IMDS_DHCP_ROUTES") == "true" {
+		responder := network.NewDHCPResponder(iface)
+		go func() {
+			if err := responder.Run(ctx); err != nil {
+				log.Printf("DHCP responder stopped: %v", err)
+			}
+		}()
+	}
+
+	// Serve IMDS over IPv6 and advertise its prefix to guests via Router Advertisements
+	if os.Getenv("IMDS_IPV6_ENABLED") == "true" {
+		if err := network.EnsureIPv6Address(iface); err != nil {
+			return fmt.Errorf("failed to configure IPv6 address: %w", err)
+		}
+		if setup != nil {
+			setupV4 := setup
+			setup = func() error {
+				if err := setupV4(); err != nil {
+					return err
+				}
+				if err := network.EnsureIPv6Address(iface); err != nil {
+					return err
+				}
+				if !ipv6Routes {
+					return nil
+				}
+				// Routes go away with a recreated interface
+				guestInterfacesMu.Lock()
+				interfaces := guestInterfaces
+				guestInterfacesMu.Unlock()
+				return network.SyncGuestRoutesV6(iface, guestIPs(interfaces))
+			}
+		}
+		server.ListenAddrV6 = net.JoinHostPort(network.IMDSAddressV6, strconv.Itoa(int(network.IMDSPort)))
+		advertiser := network.NewRouterAdvertiser(iface)
+		go func() {
+			if err := advertiser.Run(ctx); err != nil {
+				log.Printf("Router advertiser stopped: %v", err)
+			}
+		}()
+	}
+
+	// Resolve metadata hostnames to the IMDS address
+	if os.Getenv("IMDS_DNS_ENABLED") == "true" {
+		if os.Getenv("IMDS_NETWORK_MODE") == "masquerade" {
+			log.Println("Ignoring IMDS_DNS_ENABLED: masquerade mode only redirects the IMDS port")
+		} else {
+			names := append([]string{}, network.DefaultDNSNames...)
+			if name := os.Getenv("IMDS_DNS_NAME"); name != "" {
+				names = append(names, name)
+			}
+			responder := network.NewDNSResponder(names, os.Getenv("IMDS_IPV6_ENABLED") == "true")
+			go func() {
+				if err := responder.Run(ctx); err != nil {
+					log.Printf("DNS responder stopped: %v", err)
+				}
+			}()
+		}
+	}
+
+	// Also serve HTTPS with the certificate cert-manager keeps renewed
+	if dir := os.Getenv("IMDS_TLS_DIR"); dir != "" {
+		if os.Getenv("IMDS_NETWORK_MODE") == "masquerade" {
+			log.Println("Ignoring IMDS_TLS_DIR: masquerade mode only redirects the IMDS port")
+		} else {
+			cert, err := imds.NewServingCert(dir)
+			if err != nil {
+				return err
+			}
+			server.TLSCert = cert
+		}
+	}
+
+	// Repair the IMDS network if links are deleted or recreated under us
+	if setup != nil {
+		interval, err := time.ParseDuration(getEnvOrDefault("IMDS_RECONCILE_INTERVAL", defaultReconcileInterval))
+		if err != nil {
+			return fmt.Errorf("invalid IMDS_RECONCILE_INTERVAL: %w", err)
+		}
+		if interval > 0 {
+			go network.NewReconciler(setup, interval).Run(ctx)
+		}
+	}
+
+	// Announce the IMDS address so guests drop MACs cached from a previous sidecar
+	switch os.Getenv("IMDS_NETWORK_MODE") {
+	case "", "bridge", "macvtap":
+		interval, err := time.ParseDuration(getEnvOrDefault("IMDS_GARP_INTERVAL", defaultGARPInterval))
+		if err != nil {
+			return fmt.Errorf("invalid IMDS_GARP_INTERVAL: %w", err)
+		}
+		announcer := network.NewARPAnnouncer(iface, interval)
+		go func() {
+			if err := announcer.Run(ctx); err != nil {
+				log.Printf("ARP announcer stopped: %v", err)
+			}
+		}()
+	}
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
@@ -95,12 +752,102 @@ func runServe() error {
 		cancel()
 	}()
 
-	return server.Run(ctx)
+	err := server.Run(ctx)
+	close(stopped)
+
+	// Optionally leave no network residue behind. This is off by default since
+	// a restarted sidecar would come back with a new veth MAC.
+	if os.Getenv("IMDS_TEARDOWN_ON_EXIT") == "true" {
+		if cleanupErr := runCleanup(); cleanupErr != nil {
+			log.Printf("Teardown failed: %v", cleanupErr)
+		} else {
+			log.Println("Removed IMDS network configuration")
+		}
+	}
+
+	return err
+}
+
+// runCleanup removes the interfaces and nftables rules set up for the
+// configured network mode, so draining or disabling IMDS on a running pod
+// leaves nothing behind. Addresses and routes go away with their interfaces.
+func runCleanup() error {
+	var errs []error
+
+	switch os.Getenv("IMDS_NETWORK_MODE") {
+	case "passt":
+		errs = append(errs, network.CleanupDummy())
+	case "macvtap":
+		errs = append(errs, network.CleanupMacvlan())
+	case "masquerade":
+		// Only nftables rules, removed below
+	default:
+		if pair, err := configuredVethPair(); err != nil {
+			errs = append(errs, err)
+		} else {
+			errs = append(errs, network.CleanupVeth(pair))
+		}
+	}
+
+	errs = append(errs, network.CleanupNftables())
+	return errors.Join(errs...)
+}
+
+// runStop is the preStop hook of the sidecar. It has the running server drain
+// and stop, so its reconciler can't recreate what is removed, then cleans up
+// before the pod's network namespace is torn down.
+func runStop() error {
+	if err := runAdmin([]string{"shutdown"}); err != nil {
+		// The server may already have exited; cleaning up is still worthwhile
+		log.Printf("Failed to stop the server: %v", err)
+	}
+	if err := runCleanup(); err != nil {
+		return err
+	}
+	log.Println("Removed IMDS network configuration")
+	return nil
+}
+
+// inTargetNetNS runs fn in the network namespace given by IMDS_NETNS (a path
+// or the PID of a process in it), or in the current one if it isn't set.
+// This lets init and cleanup manage a virt-launcher's namespace from outside
+// the pod.
+func inTargetNetNS(fn func() error) error {
+	return network.InNetNS(network.NetNSPath(os.Getenv("IMDS_NETNS")), fn)
+}
+
+// rejectTargetNetNS fails for commands that serve IMDS. The listeners and
+// responders run on many threads, so they can't follow a per-thread namespace
+// switch and have to be started inside the namespace instead.
+func rejectTargetNetNS() error {
+	if os.Getenv("IMDS_NETNS") != "" {
+		return fmt.Errorf("IMDS_NETNS is only supported by the init and cleanup commands")
+	}
+	return nil
 }
 
 // runAll waits for the bridge to be created, sets up veth, then runs the server.
 // This is the main entry point for the sidecar container.
 func runAll() error {
+	// passt has no VM bridge to wait for
+	if os.Getenv("IMDS_NETWORK_MODE") == "passt" {
+		log.Println("Starting IMDS sidecar (passt binding)")
+		if err := setupPasst(); err != nil {
+			return err
+		}
+		return runServe(imdsListenAddr(), network.DummyIMDS, network.EnsureDummy)
+	}
+	if os.Getenv("IMDS_NETWORK_MODE") == "macvtap" {
+		log.Println("Starting IMDS sidecar (waiting for VM macvtap...)")
+		macvtapName, err := setupMacvtap(5 * time.Minute)
+		if err != nil {
+			return err
+		}
+		return runServe(imdsListenAddr(), network.MacvlanIMDS, func() error {
+			return network.EnsureMacvlan(macvtapName)
+		})
+	}
+
 	log.Println("Starting IMDS sidecar (waiting for VM bridge...)")
 
 	// Wait for the bridge to be created (with timeout)
@@ -134,15 +881,811 @@ func runAll() error {
 		return fmt.Errorf("timed out waiting for VM bridge after %v", timeout)
 	}
 
+	logDetectedBinding(bridgeName)
+
+	pair, err := vethPair(bridgeName)
+	if err != nil {
+		return err
+	}
+
+	// Masquerade guests route IMDS traffic through the bridge gateway, so a
+	// DNAT rule replaces the veth
+	if os.Getenv("IMDS_NETWORK_MODE") == "masquerade" {
+		listenAddr, err := network.EnsureMasqueradeDNAT(bridgeName)
+		if err != nil {
+			return fmt.Errorf("failed to install DNAT rule: %w", err)
+		}
+		log.Printf("Redirecting %s:%d on %s to %s", network.IMDSAddress, network.IMDSPort, bridgeName, listenAddr)
+		return runServe(listenAddr, pair.IMDS, func() error {
+			_, err := network.EnsureMasqueradeDNAT(bridgeName)
+			return err
+		})
+	}
+
 	// Ensure veth pair exists and is configured correctly
-	if err := network.EnsureVeth(bridgeName); err != nil {
+	if err := ensureVeth(pair, bridgeName); err != nil {
 		return fmt.Errorf("failed to ensure veth: %w", err)
 	}
 
-	log.Printf("Successfully ensured veth pair attached to bridge %s", bridgeName)
+	log.Printf("Successfully ensured veth pair %s/%s attached to bridge %s", pair.IMDS, pair.Bridge, bridgeName)
 
 	// Now run the server
-	return runServe()
+	return runServe(imdsListenAddr(), pair.IMDS, func() error {
+		return ensureVeth(pair, bridgeName)
+	})
+}
+
+// firewallUpdater returns a VMI interface handler that keeps the IMDS
+// firewall in sync with the guest's MACs and IPs. Guest IPs only show up once
+// the guest agent reports them, so the rules are rebuilt as the status changes.
+func firewallUpdater(iface string) func([]kube.VMIInterface) {
+	var applied []network.FirewallPeer
+	first := true
+	return func(interfaces []kube.VMIInterface) {
+		peers := firewallPeers(interfaces)
+		if !first && reflect.DeepEqual(peers, applied) {
+			return
+		}
+		if err := network.ApplyFirewall(iface, peers); err != nil {
+			log.Printf("Failed to apply firewall: %v", err)
+			return
+		}
+		log.Printf("Firewall on %s allows %d guest interface(s)", iface, len(peers))
+		applied, first = peers, false
+	}
+}
+
+// firewallPeers converts VMI interfaces into firewall peers, skipping
+// interfaces without a usable MAC.
+func firewallPeers(interfaces []kube.VMIInterface) []network.FirewallPeer {
+	var peers []network.FirewallPeer
+	for _, iface := range interfaces {
+		mac, err := net.ParseMAC(iface.MAC)
+		if err != nil {
+			continue
+		}
+		peer := network.FirewallPeer{MAC: mac}
+		for _, s := range iface.IPs {
+			if ip := net.ParseIP(s); ip != nil {
+				peer.IPs = append(peer.IPs, ip)
+			}
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// guestIPs collects all IPs reported for the VMI's interfaces.
+func guestIPs(interfaces []kube.VMIInterface) []net.IP {
+	var ips []net.IP
+	for _, iface := range interfaces {
+		for _, s := range iface.IPs {
+			if ip := net.ParseIP(s); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+// ec2Instance describes the VMI for the EC2 instance identity document. The
+// private IP is the guest's first IPv4 address.
+func ec2Instance(vmi *unstructured.Unstructured) imds.EC2Instance {
+	vm := kube.ParseVMIInstance(vmi)
+	instance := imds.EC2Instance{
+		UID:          vm.UID,
+		Created:      vm.Created,
+		Architecture: vm.Architecture,
+		InstanceType: vm.InstanceType,
+		Image:        vm.Image,
+	}
+	interfaces, err := kube.ParseVMIInterfaces(vmi)
+	if err != nil {
+		log.Printf("Ignoring interfaces of VMI %s/%s: %v", vmi.GetNamespace(), vmi.GetName(), err)
+	}
+	for _, ip := range guestIPs(interfaces) {
+		if ip.To4() != nil {
+			instance.PrivateIP = ip.String()
+			break
+		}
+	}
+	return instance
+}
+
+// setupPasst puts the IMDS address on a dummy interface in the pod network.
+// passt forwards guest connections from the pod namespace, so they reach the
+// server directly.
+func setupPasst() error {
+	if err := network.EnsureDummy(); err != nil {
+		return fmt.Errorf("failed to ensure %s: %w", network.DummyIMDS, err)
+	}
+	log.Printf("IMDS address %s configured on %s for passt", network.IMDSAddress, network.DummyIMDS)
+	return nil
+}
+
+// setupMacvtap waits up to timeout for the VM's macvtap interface, then
+// attaches the IMDS macvlan next to it. It returns the macvtap's name.
+func setupMacvtap(timeout time.Duration) (string, error) {
+	macvtapName := os.Getenv("IMDS_MACVTAP_NAME")
+	deadline := time.Now().Add(timeout)
+	for macvtapName == "" {
+		var err error
+		macvtapName, err = network.DiscoverMacvtap()
+		if err == nil {
+			log.Printf("Found macvtap: %s", macvtapName)
+			break
+		}
+		if !time.Now().Before(deadline) {
+			return "", fmt.Errorf("failed to discover macvtap: %w", err)
+		}
+		log.Printf("Waiting for macvtap... (%v)", err)
+		time.Sleep(2 * time.Second)
+	}
+
+	if err := network.EnsureMacvlan(macvtapName); err != nil {
+		return "", fmt.Errorf("failed to ensure macvlan: %w", err)
+	}
+	log.Printf("Successfully ensured %s next to macvtap %s", network.MacvlanIMDS, macvtapName)
+	return macvtapName, nil
+}
+
+// imdsInterface returns the interface the IMDS address lives on for the
+// configured network mode. It is used by the serve command, which runs after
+// init has already set up the network.
+func imdsInterface() (string, error) {
+	switch os.Getenv("IMDS_NETWORK_MODE") {
+	case "passt":
+		return network.DummyIMDS, nil
+	case "macvtap":
+		return network.MacvlanIMDS, nil
+	}
+
+	pair, err := configuredVethPair()
+	if err != nil {
+		return "", err
+	}
+	return pair.IMDS, nil
+}
+
+// logDetectedBinding reports which binding created the k6t bridge if
+// IMDS_NETWORK_MODE isn't set. It only logs: both bindings get the veth by
+// default, and the binding only changes which link MACs are learned from.
+// The veth also works for masquerade guests and keeps IMDS reachable from inside the pod,
+// which the DNAT rule doesn't, so masquerade mode has to be requested.
+func logDetectedBinding(bridgeName string) {
+	if os.Getenv("IMDS_NETWORK_MODE") != "" {
+		return
+	}
+
+	binding, err := bridgeBinding(bridgeName)
+	if err != nil {
+		log.Printf("Failed to detect binding of %s: %v", bridgeName, err)
+		return
+	}
+	if binding == network.BindingMasquerade {
+		log.Printf("Detected masquerade binding on %s; using the veth (set IMDS_NETWORK_MODE=masquerade for the DNAT rule instead)", bridgeName)
+		return
+	}
+	log.Printf("Detected %s binding on %s", binding, bridgeName)
+}
+
+// bridgeBinding returns the binding that created the k6t bridge: masquerade
+// in masquerade mode, otherwise the binding the webhook read from the VMI,
+// IMDS_BINDING_MODE, or the one detected from the bridge.
+func bridgeBinding(bridgeName string) (string, error) {
+	if os.Getenv("IMDS_NETWORK_MODE") == "masquerade" {
+		return network.BindingMasquerade, nil
+	}
+	if binding := os.Getenv("IMDS_BINDING_MODE"); binding == network.BindingBridge || binding == network.BindingMasquerade {
+		return binding, nil
+	}
+	return network.DetectBridgeBinding(bridgeName)
+}
+
+// guestLink returns the interface the guest's MACs are learned on, which for
+// VMs on a k6t bridge depends on the binding.
+func guestLink(iface string) string {
+	switch os.Getenv("IMDS_NETWORK_MODE") {
+	case "passt", "macvtap":
+		return iface
+	}
+
+	bridgeName, err := configuredBridgeName()
+	if err != nil {
+		log.Printf("Learning guest MACs on %s: %v", iface, err)
+		return iface
+	}
+	binding, err := bridgeBinding(bridgeName)
+	if err != nil {
+		log.Printf("Learning guest MACs on %s: failed to detect binding of %s: %v", iface, bridgeName, err)
+		return iface
+	}
+	return network.GuestLink(binding, bridgeName, iface)
+}
+
+// configuredVethPair returns the veth names for IMDS_BRIDGE_NAME, or for the
+// auto-detected bridge if it isn't set.
+func configuredVethPair() (network.VethPair, error) {
+	bridgeName, err := configuredBridgeName()
+	if err != nil {
+		return network.VethPair{}, err
+	}
+	return vethPair(bridgeName)
+}
+
+// configuredBridgeName returns IMDS_BRIDGE_NAME, or the auto-detected bridge
+// if it isn't set.
+func configuredBridgeName() (string, error) {
+	if bridgeName := os.Getenv("IMDS_BRIDGE_NAME"); bridgeName != "" {
+		return bridgeName, nil
+	}
+	bridgeName, err := network.DiscoverBridge()
+	if err != nil {
+		return "", fmt.Errorf("failed to discover bridge: %w", err)
+	}
+	return bridgeName, nil
+}
+
+// vethPair returns the IMDS veth for the bridge, honoring IMDS_VETH_PREFIX
+// and IMDS_MTU (which forces the MTU when matching the bridge is wrong).
+func vethPair(bridgeName string) (network.VethPair, error) {
+	pair, err := network.NewVethPair(os.Getenv("IMDS_VETH_PREFIX"), bridgeName)
+	if err != nil {
+		return pair, err
+	}
+
+	if v := os.Getenv("IMDS_MTU"); v != "" {
+		mtu, err := strconv.Atoi(v)
+		if err != nil || mtu < 68 || mtu > 65535 {
+			return pair, fmt.Errorf("invalid IMDS_MTU %q: must be between 68 and 65535", v)
+		}
+		pair.MTU = mtu
+	}
+	return pair, nil
+}
+
+// vmiReadable reports whether the VM's ServiceAccount may read its VMI.
+// Errors other than being forbidden count as readable, so the watch retries.
+func vmiReadable(ctx context.Context, client dynamic.Interface, namespace, vmName string) bool {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	_, err := client.Resource(kube.VMIResource).Namespace(namespace).Get(ctx, vmName, metav1.GetOptions{})
+	return !apierrors.IsForbidden(err)
+}
+
+// allChecks combines checks into one that returns the first failure, or nil
+// if there are none.
+func allChecks(checks []func() error) func() error {
+	if len(checks) == 0 {
+		return nil
+	}
+	return func() error {
+		for _, check := range checks {
+			if err := check(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// getAPIServerURL returns the API server URL advertised to the VM.
+// IMDS_API_SERVER takes precedence over the in-cluster service environment.
+func getAPIServerURL() string {
+	if v := os.Getenv("IMDS_API_SERVER"); v != "" {
+		return v
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return ""
+	}
+	return "https://" + net.JoinHostPort(host, port)
+}
+
+// runAdmin queries the admin API of a running server over its unix socket.
+// This lets operators inspect the sidecar with kubectl exec, since the image has no shell tools.
+func runAdmin(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: admin <status|config|stats|network|healthz|readyz|metrics|shutdown|pcap [duration]|log-level [level]>")
+	}
+
+	socketPath := getEnvOrDefault("IMDS_ADMIN_SOCKET", defaultAdminSocket)
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+
+	var req *http.Request
+	var err error
+	switch args[0] {
+	case "status":
+		req, err = http.NewRequest(http.MethodGet, "http://admin/status", nil)
+	case "config":
+		req, err = http.NewRequest(http.MethodGet, "http://admin/config", nil)
+	case "stats":
+		req, err = http.NewRequest(http.MethodGet, "http://admin/stats/network", nil)
+	case "network":
+		req, err = http.NewRequest(http.MethodGet, "http://admin/debug/network", nil)
+	case "healthz":
+		req, err = http.NewRequest(http.MethodGet, "http://admin/healthz", nil)
+	case "readyz":
+		req, err = http.NewRequest(http.MethodGet, "http://admin/readyz", nil)
+	case "metrics":
+		req, err = http.NewRequest(http.MethodGet, "http://admin/metrics", nil)
+	case "shutdown":
+		// The server answers once it has drained, bounded by its shutdown timeout
+		client.Timeout = 0
+		req, err = http.NewRequest(http.MethodPost, "http://admin/shutdown", nil)
+	case "pcap":
+		// Captures stream for as long as requested
+		client.Timeout = 0
+		url := "http://admin/debug/pcap"
+		if len(args) > 1 {
+			url += "?duration=" + args[1]
+		}
+		req, err = http.NewRequest(http.MethodGet, url, nil)
+	case "log-level":
+		if len(args) > 1 {
+			req, err = http.NewRequest(http.MethodPut, "http://admin/loglevel", strings.NewReader(args[1]))
+		} else {
+			req, err = http.NewRequest(http.MethodGet, "http://admin/loglevel", nil)
+		}
+	default:
+		return fmt.Errorf("unknown admin command: %s", args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach admin API at %s: %w", socketPath, err)
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin API returned %s", resp.Status)
+	}
+	return nil
+}
+
+// rateLimit reads the HTTP request rate limit from IMDS_RATE_LIMIT (requests
+// per second) and IMDS_RATE_BURST, defaulting to imds.DefaultRateLimit and
+// imds.DefaultRateBurst.
+func rateLimit() (float64, int, error) {
+	limit, burst := float64(imds.DefaultRateLimit), imds.DefaultRateBurst
+	if v := os.Getenv("IMDS_RATE_LIMIT"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || n == 0 {
+			return 0, 0, fmt.Errorf("invalid IMDS_RATE_LIMIT %q: must be a positive integer", v)
+		}
+		limit = float64(n)
+	}
+	if v := os.Getenv("IMDS_RATE_BURST"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || n == 0 {
+			return 0, 0, fmt.Errorf("invalid IMDS_RATE_BURST %q: must be a positive integer", v)
+		}
+		burst = int(n)
+	}
+	return limit, burst, nil
+}
+
+// shapingLimits reads the kernel-level traffic limits from IMDS_MAX_PPS and
+// IMDS_MAX_BANDWIDTH (bytes per second).
+func shapingLimits() (network.ShapingLimits, error) {
+	var limits network.ShapingLimits
+	for _, limit := range []struct {
+		env   string
+		value *uint64
+	}{
+		{"IMDS_MAX_PPS", &limits.PacketsPerSecond},
+		{"IMDS_MAX_BANDWIDTH", &limits.BytesPerSecond},
+	} {
+		v := os.Getenv(limit.env)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return limits, fmt.Errorf("invalid %s: %w", limit.env, err)
+		}
+		*limit.value = n
+	}
+	return limits, nil
+}
+
+// ensureVeth creates or repairs the veth pair on the bridge and, if
+// IMDS_VLAN is set, puts its bridge side on the VM's VLAN.
+func ensureVeth(pair network.VethPair, bridgeName string) error {
+	if err := network.EnsureVeth(pair, bridgeName); err != nil {
+		return err
+	}
+
+	v := os.Getenv("IMDS_VLAN")
+	if v == "" {
+		return nil
+	}
+	vid, err := strconv.ParseUint(v, 10, 16)
+	if err != nil || vid < 1 || vid > network.MaxVLAN {
+		return fmt.Errorf("invalid IMDS_VLAN %q: must be between 1 and %d", v, network.MaxVLAN)
+	}
+	return network.EnsureVethVLAN(pair, bridgeName, uint16(vid))
+}
+
+// tokenSource returns the TokenSource selected by IMDS_TOKEN_SOURCE, or nil
+// for the projected token file:
+//   - "tokenrequest" requests tokens for IMDS_TOKEN_SOURCE_AUDIENCE, or the
+//     API server's default audiences, through the TokenRequest API
+//   - "exec" runs IMDS_TOKEN_COMMAND, a JSON array or split on spaces. The
+//     TokenCommand feature gate turns it off.
+func tokenSource(clients sidecarClients, namespace, saName string) (imds.TokenSource, error) {
+	switch kind := os.Getenv("IMDS_TOKEN_SOURCE"); kind {
+	case "", "file":
+		return nil, nil
+	case "tokenrequest":
+		client, err := clients.clientset()
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up TokenRequest client: %w", err)
+		}
+		minter := imds.NewTokenRequestMinter(client, namespace, saName, 3600)
+		return imds.NewTokenRequestSource(minter, os.Getenv("IMDS_TOKEN_SOURCE_AUDIENCE")), nil
+	case "exec":
+		command, err := imds.ParseCommand(os.Getenv("IMDS_TOKEN_COMMAND"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid IMDS_TOKEN_COMMAND: %w", err)
+		}
+		source, err := imds.NewExecTokenSource(command)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IMDS_TOKEN_COMMAND: %w", err)
+		}
+		return source, nil
+	default:
+		return nil, fmt.Errorf("invalid IMDS_TOKEN_SOURCE %q: must be file, tokenrequest or exec", kind)
+	}
+}
+
+// certificateIssuer returns an issuer for /v1/certificates when
+// IMDS_CERTIFICATE_SIGNER names a signer, or nil otherwise.
+// IMDS_CERTIFICATE_APPROVAL is "external" (default) to wait for an approver,
+// or "auto" to approve the requests with the VM's ServiceAccount.
+// IMDS_CERTIFICATE_EXPIRATION is the requested lifetime.
+func certificateIssuer(clients sidecarClients, namespace, vmName string) (imds.CertificateIssuer, error) {
+	signer := os.Getenv("IMDS_CERTIFICATE_SIGNER")
+	if signer == "" {
+		return nil, nil
+	}
+
+	var approve bool
+	switch v := os.Getenv("IMDS_CERTIFICATE_APPROVAL"); v {
+	case "", "external":
+	case "auto":
+		approve = true
+	default:
+		return nil, fmt.Errorf("invalid IMDS_CERTIFICATE_APPROVAL %q: must be external or auto", v)
+	}
+
+	expiration, err := time.ParseDuration(getEnvOrDefault("IMDS_CERTIFICATE_EXPIRATION", imds.DefaultCertificateExpiration.String()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid IMDS_CERTIFICATE_EXPIRATION: %w", err)
+	}
+	if expiration < imds.MinCertificateExpiration {
+		return nil, fmt.Errorf("invalid IMDS_CERTIFICATE_EXPIRATION %v: must be at least %v", expiration, imds.MinCertificateExpiration)
+	}
+
+	client, err := clients.clientset()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up CertificateSigningRequest client: %w", err)
+	}
+	return imds.NewCSRIssuer(client, signer, expiration, approve, namespace, vmName), nil
+}
+
+// sshCertificates configures SSH key signing from IMDS_SSH_SIGNER, or
+// returns nil if it isn't set:
+//   - "file" signs with the CA private key at IMDS_SSH_CA_KEY
+//   - "vault" calls the Vault SSH engine's IMDS_SSH_VAULT_PATH at
+//     IMDS_SSH_VAULT_ADDR, logging in as IMDS_SSH_VAULT_ROLE with the VM's token
+//   - "exec" runs IMDS_SSH_SIGN_COMMAND, a JSON array or split on spaces
+//
+// IMDS_SSH_HOST_PRINCIPALS and IMDS_SSH_USER_PRINCIPALS are comma-separated;
+// host principals default to the VM's names and user certificates are off
+// unless principals are set. IMDS_SSH_CERT_TTL is the certificate lifetime.
+func sshCertificates(tokens imds.TokenSource, namespace, vmName string) (*imds.SSHCertificates, error) {
+	var signer imds.SSHSigner
+	switch kind := os.Getenv("IMDS_SSH_SIGNER"); kind {
+	case "":
+		return nil, nil
+	case "file":
+		path := os.Getenv("IMDS_SSH_CA_KEY")
+		if path == "" {
+			return nil, fmt.Errorf("IMDS_SSH_SIGNER=file requires IMDS_SSH_CA_KEY")
+		}
+		signer = imds.NewFileSSHSigner(path)
+	case "vault":
+		addr, path, role := os.Getenv("IMDS_SSH_VAULT_ADDR"), os.Getenv("IMDS_SSH_VAULT_PATH"), os.Getenv("IMDS_SSH_VAULT_ROLE")
+		if addr == "" || path == "" || role == "" {
+			return nil, fmt.Errorf("IMDS_SSH_SIGNER=vault requires IMDS_SSH_VAULT_ADDR, IMDS_SSH_VAULT_PATH and IMDS_SSH_VAULT_ROLE")
+		}
+		signer = imds.NewVaultSSHSigner(addr, path, getEnvOrDefault("IMDS_SSH_VAULT_AUTH_MOUNT", "kubernetes"), role, tokens, nil)
+	case "exec":
+		command, err := imds.ParseCommand(os.Getenv("IMDS_SSH_SIGN_COMMAND"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid IMDS_SSH_SIGN_COMMAND: %w", err)
+		}
+		if signer, err = imds.NewExecSSHSigner(command); err != nil {
+			return nil, fmt.Errorf("invalid IMDS_SSH_SIGN_COMMAND: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid IMDS_SSH_SIGNER %q: must be file, vault or exec", kind)
+	}
+
+	ttl, err := time.ParseDuration(getEnvOrDefault("IMDS_SSH_CERT_TTL", imds.DefaultSSHCertificateTTL.String()))
+	if err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("invalid IMDS_SSH_CERT_TTL %q: must be a positive duration", os.Getenv("IMDS_SSH_CERT_TTL"))
+	}
+
+	hostPrincipals := imds.DefaultSSHHostPrincipals(namespace, vmName)
+	if v := os.Getenv("IMDS_SSH_HOST_PRINCIPALS"); v != "" {
+		hostPrincipals = splitList(v)
+	}
+	return &imds.SSHCertificates{
+		Signer:         signer,
+		HostPrincipals: hostPrincipals,
+		UserPrincipals: splitList(os.Getenv("IMDS_SSH_USER_PRINCIPALS")),
+		TTL:            ttl,
+	}, nil
+}
+
+// configureTokenExchange enables /v1/token/exchange when
+// IMDS_TOKEN_EXCHANGE_URL names an STS token endpoint. The guest may only
+// ask for the comma-separated audiences and resources in
+// IMDS_TOKEN_EXCHANGE_TARGETS. The subject token is the projected token for
+// IMDS_TOKEN_EXCHANGE_SUBJECT_AUDIENCE if set, or the ServiceAccount token.
+// IMDS_TOKEN_EXCHANGE_CLIENT_ID identifies the sidecar to the STS.
+func configureTokenExchange(server *imds.Server) error {
+	stsURL := os.Getenv("IMDS_TOKEN_EXCHANGE_URL")
+	if stsURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(stsURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid IMDS_TOKEN_EXCHANGE_URL %q: must be an https URL", stsURL)
+	}
+	targets := splitList(os.Getenv("IMDS_TOKEN_EXCHANGE_TARGETS"))
+	if len(targets) == 0 {
+		return fmt.Errorf("IMDS_TOKEN_EXCHANGE_URL requires IMDS_TOKEN_EXCHANGE_TARGETS")
+	}
+	if audience := os.Getenv("IMDS_TOKEN_EXCHANGE_SUBJECT_AUDIENCE"); audience != "" {
+		path, ok := server.AudienceTokenPaths[audience]
+		if !ok {
+			return fmt.Errorf("IMDS_TOKEN_EXCHANGE_SUBJECT_AUDIENCE %q has no projected token", audience)
+		}
+		server.TokenExchangeSubject = imds.NewFileTokenSource(path)
+	}
+
+	server.TokenExchanger = imds.NewSTSExchanger(stsURL, os.Getenv("IMDS_TOKEN_EXCHANGE_CLIENT_ID"), nil)
+	server.TokenExchangeTargets = targets
+	return nil
+}
+
+// tpmAttestation returns the TPM attestation gate for the policy file at
+// IMDS_ATTESTATION_POLICY, or nil if it isn't set. IMDS_ATTESTATION_TTL is
+// how long a successful attestation releases tokens.
+func tpmAttestation() (*imds.Attestation, error) {
+	policyPath := os.Getenv("IMDS_ATTESTATION_POLICY")
+	if policyPath == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(policyPath); err != nil {
+		return nil, fmt.Errorf("invalid IMDS_ATTESTATION_POLICY: %w", err)
+	}
+	ttl, err := time.ParseDuration(getEnvOrDefault("IMDS_ATTESTATION_TTL", imds.DefaultAttestationTTL.String()))
+	if err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("invalid IMDS_ATTESTATION_TTL %q: must be a positive duration", os.Getenv("IMDS_ATTESTATION_TTL"))
+	}
+	return imds.NewAttestation(policyPath, ttl), nil
+}
+
+// keylimeVerifier returns the Keylime verifier at IMDS_KEYLIME_VERIFIER_URL
+// for the agent IMDS_KEYLIME_AGENT_ID, or nil if the URL isn't set. The
+// verifier requires mutual TLS: IMDS_KEYLIME_CA verifies the verifier, and
+// IMDS_KEYLIME_CLIENT_CERT and IMDS_KEYLIME_CLIENT_KEY authenticate the
+// sidecar. IMDS_KEYLIME_MAX_AGE optionally bounds the age of the verifier's
+// last successful attestation.
+func keylimeVerifier() (*imds.KeylimeVerifier, error) {
+	verifierURL := os.Getenv("IMDS_KEYLIME_VERIFIER_URL")
+	if verifierURL == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(verifierURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid IMDS_KEYLIME_VERIFIER_URL %q: must be an https URL", verifierURL)
+	}
+	agentID := os.Getenv("IMDS_KEYLIME_AGENT_ID")
+	if agentID == "" {
+		return nil, fmt.Errorf("IMDS_KEYLIME_VERIFIER_URL requires IMDS_KEYLIME_AGENT_ID")
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caPath := os.Getenv("IMDS_KEYLIME_CA"); caPath != "" {
+		ca, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read IMDS_KEYLIME_CA: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("IMDS_KEYLIME_CA %s has no PEM certificates", caPath)
+		}
+	}
+	if certPath := os.Getenv("IMDS_KEYLIME_CLIENT_CERT"); certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, os.Getenv("IMDS_KEYLIME_CLIENT_KEY"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the Keylime client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	verifier := imds.NewKeylimeVerifier(verifierURL, agentID, &http.Client{Transport: transport})
+	if v := os.Getenv("IMDS_KEYLIME_API_VERSION"); v != "" {
+		verifier.APIVersion = v
+	}
+	if v := os.Getenv("IMDS_KEYLIME_MAX_AGE"); v != "" {
+		maxAge, err := time.ParseDuration(v)
+		if err != nil || maxAge <= 0 {
+			return nil, fmt.Errorf("invalid IMDS_KEYLIME_MAX_AGE %q: must be a positive duration", v)
+		}
+		verifier.MaxAge = maxAge
+	}
+	return verifier, nil
+}
+
+// ec2Identity returns the EC2 instance identity signer for the key pair in
+// IMDS_EC2_IDENTITY_CERT and IMDS_EC2_IDENTITY_KEY, or nil if no certificate
+// is set. IMDS_EC2_ACCOUNT_ID, IMDS_EC2_REGION and
+// IMDS_EC2_AVAILABILITY_ZONE override what the document reports.
+func ec2Identity(namespace string) (*imds.EC2Identity, error) {
+	certPath := os.Getenv("IMDS_EC2_IDENTITY_CERT")
+	if certPath == "" {
+		return nil, nil
+	}
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IMDS_EC2_IDENTITY_CERT: %w", err)
+	}
+	keyPEM, err := os.ReadFile(os.Getenv("IMDS_EC2_IDENTITY_KEY"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read IMDS_EC2_IDENTITY_KEY: %w", err)
+	}
+	identity, err := imds.NewEC2Identity(namespace, certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	if v := os.Getenv("IMDS_EC2_ACCOUNT_ID"); v != "" {
+		if len(v) != 12 || strings.Trim(v, "0123456789") != "" {
+			return nil, fmt.Errorf("invalid IMDS_EC2_ACCOUNT_ID %q: must be 12 digits", v)
+		}
+		identity.AccountID = v
+	}
+	if v := os.Getenv("IMDS_EC2_REGION"); v != "" {
+		identity.Region = v
+		identity.AvailabilityZone = v + "a"
+	}
+	if v := os.Getenv("IMDS_EC2_AVAILABILITY_ZONE"); v != "" {
+		identity.AvailabilityZone = v
+	}
+	return identity, nil
+}
+
+// endpointPolicy returns the endpoint rules of the cluster policy combined
+// with the VM's policy file at IMDS_ENDPOINT_POLICY, if set. The file can
+// only add restrictions: a group is served if both allow it, and requires
+// the source allowlist if either does.
+func endpointPolicy(cluster *kube.IMDSPolicy) (map[string]imds.EndpointRule, error) {
+	sources := map[string]map[string]kube.EndpointAccess{}
+	if cluster != nil && len(cluster.Endpoints) > 0 {
+		sources["IMDSConfig "+kube.IMDSConfigName] = cluster.Endpoints
+	}
+	if path := os.Getenv("IMDS_ENDPOINT_POLICY"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read IMDS_ENDPOINT_POLICY: %w", err)
+		}
+		var endpoints map[string]kube.EndpointAccess
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&endpoints); err != nil {
+			return nil, fmt.Errorf("invalid IMDS_ENDPOINT_POLICY %s: %w", path, err)
+		}
+		sources[path] = endpoints
+	}
+
+	rules := make(map[string]imds.EndpointRule)
+	for source, endpoints := range sources {
+		for group, access := range endpoints {
+			if !imds.ValidEndpointGroup(group) {
+				return nil, fmt.Errorf("invalid endpoint group %q in %s: must be one of %s", group, source, strings.Join(imds.EndpointGroups, ", "))
+			}
+			rule := rules[group]
+			rule.Disabled = rule.Disabled || (access.Enabled != nil && !*access.Enabled)
+			rule.RequireSource = rule.RequireSource || access.RequireSource
+			rules[group] = rule
+		}
+	}
+	return rules, nil
+}
+
+// sidecarClients are the API server clients, authenticated as the VM's
+// ServiceAccount. Each is created when a feature first needs it and then
+// shared, so sidecars that don't talk to the API server need no address.
+type sidecarClients struct {
+	clientset func() (kubernetes.Interface, error)
+	dynamic   func() (dynamic.Interface, error)
+}
+
+func newSidecarClients(apiServerURL, tokenPath, caPath string) sidecarClients {
+	return sidecarClients{
+		clientset: sync.OnceValues(func() (kubernetes.Interface, error) {
+			return kube.NewSidecarClient(apiServerURL, tokenPath, caPath)
+		}),
+		dynamic: sync.OnceValues(func() (dynamic.Interface, error) {
+			return kube.NewSidecarDynamicClient(apiServerURL, tokenPath, caPath)
+		}),
+	}
+}
+
+// clusterPolicy returns the namespace's policy from the cluster IMDSConfig,
+// or nil if there is none or the VM's ServiceAccount may not read it.
+func clusterPolicy(clients sidecarClients, namespace string) *kube.IMDSPolicy {
+	client, err := clients.dynamic()
+	if err != nil {
+		log.Printf("Not applying cluster IMDSConfig: %v", err)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	spec, err := kube.GetIMDSConfig(ctx, client)
+	if err != nil {
+		log.Printf("Not applying cluster IMDSConfig: %v", err)
+		return nil
+	}
+	policy := spec.PolicyFor(namespace)
+	return &policy
+}
+
+// disableGatedFeatures unsets the environment of features the policy turns off.
+func disableGatedFeatures(policy kube.IMDSPolicy) {
+	for gate, envs := range kube.GatedEnv {
+		if policy.FeatureEnabled(gate) {
+			continue
+		}
+		for _, env := range envs {
+			if os.Getenv(env) != "" {
+				log.Printf("Ignoring %s: feature gate %s is off in IMDSConfig %s", env, gate, kube.IMDSConfigName)
+				os.Unsetenv(env)
+			}
+		}
+	}
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func getEnvOrDefault(key, defaultValue string) string {
@@ -2,49 +2,176 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 
+	"github.com/kubevirt/kubevirt-imds/internal/kube"
 	"github.com/kubevirt/kubevirt-imds/internal/webhook"
 )
 
 func main() {
 	var (
-		listenAddr string
-		certFile   string
-		keyFile    string
-		imdsImage  string
+		listenAddr     string
+		certFile       string
+		keyFile        string
+		imdsImage      string
+		spiffeDir      string
+		defaultEnabled bool
+		configMap      string
+		nativeSidecar  string
+		selfSigned     bool
+		tlsSecret      string
+		serviceName    string
+		webhookConfig  string
+		dryRun         bool
+		excludedNS     string
+		excludedNSSel  string
+		proxy          webhook.ProxyConfig
+		probes         string
+		pullSecrets    string
+		vmNameLabels   string
+		leaderElect    bool
+		leaseName      string
+		certManager    string
+		podSecurity    string
 	)
 
 	flag.StringVar(&listenAddr, "listen-addr", ":8443", "Address to listen on")
 	flag.StringVar(&certFile, "cert-file", "/etc/webhook/certs/tls.crt", "Path to TLS certificate")
 	flag.StringVar(&keyFile, "key-file", "/etc/webhook/certs/tls.key", "Path to TLS key")
 	flag.StringVar(&imdsImage, "imds-image", "", "IMDS sidecar image (required)")
+	flag.StringVar(&spiffeDir, "spiffe-socket-dir", "", "Host directory containing the SPIRE agent socket (enables imds.kubevirt.io/spiffe-enabled)")
+	flag.BoolVar(&defaultEnabled, "default-enabled", false, "Inject IMDS into every VM pod unless imds.kubevirt.io/enabled is \"false\"")
+	flag.StringVar(&configMap, "config-map", "imds-webhook-config", "ConfigMap in the webhook's namespace holding sidecar defaults (empty disables)")
+	flag.StringVar(&nativeSidecar, "native-sidecar", webhook.NativeSidecarAuto, "Inject the sidecar as a native sidecar init container: auto (Kubernetes 1.29+), true or false")
+	flag.BoolVar(&selfSigned, "self-signed-certs", false, "Generate and renew a self-signed CA and serving certificate, and patch the webhook caBundle, instead of reading --cert-file and --key-file")
+	flag.StringVar(&tlsSecret, "tls-secret", "imds-webhook-tls", "Secret in the webhook's namespace storing the self-signed or cert-manager certificates")
+	flag.StringVar(&serviceName, "service-name", "imds-webhook", "Service the self-signed or cert-manager serving certificate is issued for")
+	flag.StringVar(&webhookConfig, "webhook-configuration", "imds-webhook", "MutatingWebhookConfiguration whose caBundle is patched with the self-signed CA or injected by cert-manager")
+	flag.StringVar(&certManager, "cert-manager-issuer", "", "Have cert-manager issue the serving certificate into --tls-secret from this Issuer, written <name>, Issuer/<name> or ClusterIssuer/<name>, and inject its CA into the webhook caBundle")
+	flag.BoolVar(&leaderElect, "leader-elect", false, "With --self-signed-certs, elect one replica through a Lease to renew the certificates and patch the caBundle; the others load them from the Secret")
+	flag.StringVar(&leaseName, "leader-election-lease", "imds-webhook", "Lease in the webhook's namespace used by --leader-elect")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log and audit the patches the webhook would apply without injecting anything")
+	flag.StringVar(&excludedNS, "excluded-namespaces", "kube-system,kube-public,kube-node-lease", "Comma-separated namespaces (or patterns like openshift-*) that are never mutated")
+	flag.StringVar(&excludedNSSel, "excluded-namespace-selector", "", "Label selector of namespaces that are never mutated")
+	flag.StringVar(&proxy.HTTPProxy, "http-proxy", "", "HTTP_PROXY for the sidecar")
+	flag.StringVar(&proxy.HTTPSProxy, "https-proxy", "", "HTTPS_PROXY for the sidecar")
+	flag.StringVar(&proxy.NoProxy, "no-proxy", "", "NO_PROXY for the sidecar")
+	flag.StringVar(&pullSecrets, "image-pull-secrets", "", "Comma-separated Secrets added to the imagePullSecrets of injected pods, for a sidecar image in a private registry")
+	flag.StringVar(&vmNameLabels, "vm-name-labels", webhook.DomainLabel, "Comma-separated pod labels holding the VM name, tried in order before the owning VMI")
+	flag.StringVar(&probes, "probes", "", "Probes to put on the sidecar: exec, httpGet or none (empty is none)")
+	flag.StringVar(&podSecurity, "pod-security", webhook.PodSecurityDeny, "When the sidecar would violate the namespace's enforced Pod Security Standard: deny the pod, skip injection, or ignore the standard")
 	flag.Parse()
 
 	// Allow overriding from environment
 	if v := os.Getenv("IMDS_IMAGE"); v != "" {
 		imdsImage = v
 	}
+	if v := os.Getenv("IMDS_SPIFFE_SOCKET_DIR"); v != "" {
+		spiffeDir = v
+	}
 
-	if imdsImage == "" {
-		log.Fatal("--imds-image or IMDS_IMAGE is required")
+	if v := os.Getenv("IMDS_DEFAULT_ENABLED"); v != "" {
+		defaultEnabled = v == "true"
+	}
+	if v, ok := os.LookupEnv("IMDS_EXCLUDED_NAMESPACES"); ok {
+		excludedNS = v
+	}
+	if v := os.Getenv("IMDS_EXCLUDED_NAMESPACE_SELECTOR"); v != "" {
+		excludedNSSel = v
+	}
+	excludedSelector, err := labels.Parse(excludedNSSel)
+	if err != nil {
+		log.Fatalf("Invalid --excluded-namespace-selector: %v", err)
+	}
+	// Not HTTP_PROXY and friends, which would apply to the webhook itself
+	if v := os.Getenv("IMDS_HTTP_PROXY"); v != "" {
+		proxy.HTTPProxy = v
+	}
+	if v := os.Getenv("IMDS_HTTPS_PROXY"); v != "" {
+		proxy.HTTPSProxy = v
+	}
+	if v := os.Getenv("IMDS_NO_PROXY"); v != "" {
+		proxy.NoProxy = v
+	}
+	if v := os.Getenv("IMDS_DRY_RUN"); v != "" {
+		dryRun = v == "true"
+	}
+	if v := os.Getenv("IMDS_SELF_SIGNED_CERTS"); v != "" {
+		selfSigned = v == "true"
+	}
+	if v := os.Getenv("IMDS_CERT_MANAGER_ISSUER"); v != "" {
+		certManager = v
+	}
+	if selfSigned && certManager != "" {
+		log.Fatal("--self-signed-certs and --cert-manager-issuer are mutually exclusive")
+	}
+	if v := os.Getenv("IMDS_LEADER_ELECT"); v != "" {
+		leaderElect = v == "true"
+	}
+	if v := os.Getenv("IMDS_NATIVE_SIDECAR"); v != "" {
+		nativeSidecar = v
+	}
+	if v := os.Getenv("IMDS_IMAGE_PULL_SECRETS"); v != "" {
+		pullSecrets = v
+	}
+	imagePullSecrets, err := webhook.PullSecretReferences(splitList(pullSecrets))
+	if err != nil {
+		log.Fatalf("Invalid --image-pull-secrets: %v", err)
+	}
+	if v := os.Getenv("IMDS_VM_NAME_LABELS"); v != "" {
+		vmNameLabels = v
+	}
+	for _, label := range splitList(vmNameLabels) {
+		if errs := validation.IsQualifiedName(label); len(errs) > 0 {
+			log.Fatalf("Invalid --vm-name-labels entry %q: %s", label, strings.Join(errs, "; "))
+		}
+	}
+	if v := os.Getenv("IMDS_PROBES"); v != "" {
+		probes = v
+	}
+	switch probes {
+	case "", webhook.ProbesNone, webhook.ProbesExec, webhook.ProbesHTTPGet:
+	default:
+		log.Fatalf("Invalid --probes %q: must be exec, httpGet or none", probes)
+	}
+	if v := os.Getenv("IMDS_POD_SECURITY"); v != "" {
+		podSecurity = v
+	}
+	switch podSecurity {
+	case webhook.PodSecurityDeny, webhook.PodSecuritySkip, webhook.PodSecurityIgnore:
+	default:
+		log.Fatalf("Invalid --pod-security %q: must be deny, skip or ignore", podSecurity)
+	}
+	switch nativeSidecar {
+	case webhook.NativeSidecarAuto, webhook.NativeSidecarEnabled, webhook.NativeSidecarDisabled:
+	default:
+		log.Fatalf("Invalid --native-sidecar %q: must be auto, true or false", nativeSidecar)
 	}
 
-	// Create mutator
-	config := webhook.Config{
-		IMDSImage:       imdsImage,
-		ImagePullPolicy: corev1.PullIfNotPresent,
+	// The ConfigMap and TLS Secret live in the webhook's own namespace
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = "kubevirt-imds"
 	}
-	mutator := webhook.NewMutator(config)
 
-	// Create server
-	server := webhook.NewServer(mutator, listenAddr, certFile, keyFile)
+	if imdsImage == "" {
+		log.Fatal("--imds-image or IMDS_IMAGE is required")
+	}
 
 	// Set up signal handling
 	ctx, cancel := context.WithCancel(context.Background())
@@ -59,8 +186,292 @@ func main() {
 		cancel()
 	}()
 
+	client, dynamicClient := inClusterClients()
+
+	// Follow the cluster IMDSConfig policy, if one exists
+	var clusterConfig atomic.Pointer[kube.IMDSConfigSpec]
+	if dynamicClient != nil {
+		go kube.WatchIMDSConfig(ctx, dynamicClient, func(spec *kube.IMDSConfigSpec) {
+			clusterConfig.Store(spec)
+			if spec != nil {
+				log.Printf("Loaded IMDSConfig %s", kube.IMDSConfigName)
+			}
+		})
+	}
+
+	// Create mutator
+	config := webhook.Config{
+		IMDSImage:                 imdsImage,
+		ImagePullPolicy:           corev1.PullIfNotPresent,
+		ImagePullSecrets:          imagePullSecrets,
+		SPIFFESocketDir:           spiffeDir,
+		Resources:                 webhook.DefaultResources(),
+		ClusterConfig:             clusterConfig.Load,
+		DefaultEnabled:            defaultEnabled,
+		NativeSidecar:             useNativeSidecar(nativeSidecar, client),
+		DryRun:                    dryRun,
+		ExcludedNamespaces:        splitList(excludedNS),
+		ExcludedNamespaceSelector: excludedSelector,
+		Proxy:                     proxy,
+		Probes:                    probes,
+		PodSecurity:               podSecurity,
+		VMNameLabels:              splitList(vmNameLabels),
+	}
+	if client != nil {
+		lookup, err := webhook.NamespaceLabelLookup(ctx, client)
+		if err != nil {
+			log.Fatalf("Failed to watch namespaces: %v", err)
+		}
+		config.NamespaceLabels = lookup
+	}
+	if dynamicClient != nil {
+		// Match launcher pods by their owning VMI and read its annotations
+		// and network binding
+		config.VMI = webhook.VMILookup(ctx, dynamicClient)
+	}
+	mutator := webhook.NewMutator(config)
+
+	// Create server
+	server := webhook.NewServer(mutator, listenAddr, certFile, keyFile)
+	// Export admission traces if the standard OTEL_* environment asks for it
+	if webhook.TracingEnabled() {
+		provider, err := webhook.NewTracerProvider(ctx)
+		if err != nil {
+			log.Fatalf("Failed to set up tracing: %v", err)
+		}
+		server.SetTracerProvider(provider)
+		defer func() {
+			// Flush the spans still queued
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := provider.Shutdown(shutdownCtx); err != nil {
+				log.Printf("Failed to flush traces: %v", err)
+			}
+		}()
+		log.Println("Exporting admission traces over OTLP/HTTP")
+	}
+
+	if selfSigned {
+		if client == nil {
+			log.Fatal("--self-signed-certs requires running in a cluster")
+		}
+		certs := webhook.SelfSignedCerts{
+			Namespace:            namespace,
+			Service:              serviceName,
+			SecretName:           tlsSecret,
+			WebhookConfiguration: webhookConfig,
+		}
+		if leaderElect {
+			// Only the leader writes the Secret and caBundle; every replica
+			// serves what is stored in the Secret
+			identity, err := os.Hostname()
+			if err != nil {
+				log.Fatalf("Failed to get leader election identity: %v", err)
+			}
+			election := webhook.LeaderElection{Namespace: namespace, LeaseName: leaseName, Identity: identity}
+			go func() {
+				lead := func(ctx context.Context) {
+					reconcileCertificates(ctx, client, certs, server)
+					renewCertificates(ctx, client, certs, server)
+				}
+				if err := election.Run(ctx, client, lead); err != nil {
+					log.Fatalf("Leader election failed: %v", err)
+				}
+			}()
+			cert, err := waitForCertificates(ctx, client, certs)
+			if err != nil {
+				log.Fatalf("Failed to load self-signed certificates: %v", err)
+			}
+			server.SetCertificate(cert)
+			go syncCertificates(ctx, client, certs, server)
+		} else {
+			cert, err := certs.Reconcile(ctx, client)
+			if err != nil {
+				log.Fatalf("Failed to set up self-signed certificates: %v", err)
+			}
+			server.SetCertificate(cert)
+			go renewCertificates(ctx, client, certs, server)
+		}
+	} else if leaderElect {
+		log.Printf("Ignoring --leader-elect without --self-signed-certs")
+	}
+
+	if certManager != "" {
+		if client == nil {
+			log.Fatal("--cert-manager-issuer requires running in a cluster")
+		}
+		issuerKind, issuerName, err := webhook.ParseIssuer(certManager)
+		if err != nil {
+			log.Fatalf("Invalid --cert-manager-issuer: %v", err)
+		}
+		certs := webhook.CertManagerCerts{
+			Namespace:            namespace,
+			Service:              serviceName,
+			CertificateName:      serviceName,
+			SecretName:           tlsSecret,
+			IssuerKind:           issuerKind,
+			IssuerName:           issuerName,
+			WebhookConfiguration: webhookConfig,
+		}
+		if err := certs.Ensure(ctx, client, dynamicClient); err != nil {
+			log.Fatalf("Failed to request a certificate from cert-manager: %v", err)
+		}
+		cert, err := waitForCertificates(ctx, client, certs)
+		if err != nil {
+			log.Fatalf("Failed to load the cert-manager certificate: %v", err)
+		}
+		server.SetCertificate(cert)
+		// cert-manager renews the Secret in place
+		go syncCertificates(ctx, client, certs, server)
+	}
+
+	// Reload sidecar defaults whenever the ConfigMap changes. An invalid
+	// ConfigMap is logged and the previous defaults stay in effect.
+	if client != nil && configMap != "" {
+		onChange := func(data map[string]string) {
+			updated, err := webhook.ApplyConfigMap(config, data)
+			if err != nil {
+				log.Printf("Ignoring ConfigMap %s/%s: %v", namespace, configMap, err)
+				return
+			}
+			server.SetMutator(webhook.NewMutator(updated))
+			log.Printf("Loaded sidecar defaults from ConfigMap %s/%s", namespace, configMap)
+		}
+		if err := webhook.WatchConfigMap(ctx, client, namespace, configMap, onChange); err != nil {
+			log.Fatalf("Failed to watch ConfigMap: %v", err)
+		}
+	}
+
 	// Run server
 	if err := server.Run(ctx); err != nil {
 		log.Fatalf("Server failed: %v", err)
 	}
 }
+
+// certRenewInterval is how often self-signed certificates are checked for
+// renewal and the caBundle is re-patched
+const certRenewInterval = 12 * time.Hour
+
+// certSyncInterval is how often a serving certificate renewed by someone
+// else, the leader or cert-manager, is reloaded from the Secret
+const certSyncInterval = time.Minute
+
+// certLoader reads a serving certificate from its Secret
+type certLoader interface {
+	Load(ctx context.Context, client kubernetes.Interface) (tls.Certificate, error)
+}
+
+// renewCertificates keeps the self-signed certificates valid and the caBundle
+// in place until the context is canceled.
+func renewCertificates(ctx context.Context, client kubernetes.Interface, certs webhook.SelfSignedCerts, server *webhook.Server) {
+	ticker := time.NewTicker(certRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reconcileCertificates(ctx, client, certs, server)
+		}
+	}
+}
+
+// reconcileCertificates renews the self-signed certificates if needed and
+// serves the result.
+func reconcileCertificates(ctx context.Context, client kubernetes.Interface, certs webhook.SelfSignedCerts, server *webhook.Server) {
+	cert, err := certs.Reconcile(ctx, client)
+	if err != nil {
+		log.Printf("Failed to renew self-signed certificates: %v", err)
+		return
+	}
+	server.SetCertificate(cert)
+}
+
+// waitForCertificates loads the serving certificate from the Secret, waiting
+// for the leader or cert-manager to issue it on a fresh install.
+func waitForCertificates(ctx context.Context, client kubernetes.Interface, certs certLoader) (tls.Certificate, error) {
+	for {
+		cert, err := certs.Load(ctx, client)
+		if err == nil {
+			return cert, nil
+		}
+		log.Printf("Waiting for certificates to be issued: %v", err)
+		select {
+		case <-ctx.Done():
+			return tls.Certificate{}, ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// syncCertificates reloads the renewed serving certificate until the context
+// is canceled.
+func syncCertificates(ctx context.Context, client kubernetes.Interface, certs certLoader, server *webhook.Server) {
+	ticker := time.NewTicker(certSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cert, err := certs.Load(ctx, client)
+			if err != nil {
+				log.Printf("Failed to reload certificates: %v", err)
+				continue
+			}
+			server.SetCertificate(cert)
+		}
+	}
+}
+
+// useNativeSidecar resolves the --native-sidecar mode. In auto mode native
+// sidecars are used when the API server is new enough; without a client, or
+// when the version can't be read, the sidecar is a regular container.
+func useNativeSidecar(mode string, client kubernetes.Interface) bool {
+	if mode != webhook.NativeSidecarAuto {
+		return mode == webhook.NativeSidecarEnabled
+	}
+	if client == nil {
+		return false
+	}
+	supported, err := webhook.NativeSidecarSupported(client.Discovery())
+	if err != nil {
+		log.Printf("Injecting a regular sidecar container: %v", err)
+		return false
+	}
+	if supported {
+		log.Printf("Injecting IMDS as a native sidecar")
+	}
+	return supported
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// inClusterClients returns clients for the cluster the webhook runs in, or
+// nils when it runs outside a cluster. Namespace opt-in, ConfigMap reloads
+// and the IMDSConfig policy are disabled without them.
+func inClusterClients() (kubernetes.Interface, dynamic.Interface) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		log.Printf("Not running in a cluster, namespace opt-in, ConfigMap reloads and IMDSConfig disabled: %v", err)
+		return nil, nil
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		log.Fatalf("Failed to create kubernetes client: %v", err)
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		log.Fatalf("Failed to create dynamic client: %v", err)
+	}
+	return client, dynamicClient
+}
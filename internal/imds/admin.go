@@ -0,0 +1,421 @@
+package imds
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultCaptureDuration is how long GET /debug/pcap captures by default
+	defaultCaptureDuration = 30 * time.Second
+	// maxCaptureDuration bounds GET /debug/pcap?duration=
+	maxCaptureDuration = 10 * time.Minute
+)
+
+// LogLevel controls the verbosity of per-request logging.
+type LogLevel int32
+
+const (
+	// LogLevelInfo logs one line per request (default)
+	LogLevelInfo LogLevel = iota
+	// LogLevelDebug additionally logs the client address and user agent
+	LogLevelDebug
+	// LogLevelError only logs errors
+	LogLevelError
+)
+
+// String returns the name of the log level.
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "debug"
+	case LogLevelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// ParseLogLevel parses a log level name.
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "info":
+		return LogLevelInfo, nil
+	case "debug":
+		return LogLevelDebug, nil
+	case "error":
+		return LogLevelError, nil
+	default:
+		return LogLevelInfo, fmt.Errorf("unknown log level %q (want info, debug or error)", s)
+	}
+}
+
+// StatusResponse is the response for GET /status on the admin socket
+type StatusResponse struct {
+	StartedAt     time.Time `json:"startedAt"`
+	Uptime        string    `json:"uptime"`
+	LogLevel      string    `json:"logLevel"`
+	TokensEnabled bool      `json:"tokensEnabled"`
+}
+
+// ConfigResponse is the response for GET /config on the admin socket
+type ConfigResponse struct {
+	TokenPath          string            `json:"tokenPath"`
+	Namespace          string            `json:"namespace"`
+	VMName             string            `json:"vmName"`
+	ServiceAccountName string            `json:"serviceAccountName"`
+	ListenAddr         string            `json:"listenAddr"`
+	ListenAddrV6       string            `json:"listenAddrV6,omitempty"`
+	APIServerURL       string            `json:"apiServerURL,omitempty"`
+	CAPath             string            `json:"caPath,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	AllowedAudiences   []string          `json:"allowedAudiences,omitempty"`
+	ProjectedAudiences []string          `json:"projectedAudiences,omitempty"`
+	SPIFFEEnabled      bool              `json:"spiffeEnabled"`
+	SourceAllowlist    bool              `json:"sourceAllowlistEnabled"`
+	Endpoints          []string          `json:"endpoints"`
+}
+
+// AdminServer serves the operator-facing admin API on a unix socket.
+// It is never reachable from the guest; operators use it via kubectl exec.
+type AdminServer struct {
+	server     *Server
+	socketPath string
+	startedAt  time.Time
+
+	// NetworkStats returns veth/ARP statistics (optional)
+	NetworkStats func() (interface{}, error)
+	// NetworkDiagnostics returns a dump of the pod network state (optional)
+	NetworkDiagnostics func() (interface{}, error)
+	// Liveness reports whether IMDS still answers (optional, nil is always live)
+	Liveness func() error
+	// Readiness reports whether guests can reach IMDS (optional, nil is always ready)
+	Readiness func() error
+	// PacketCapture streams IMDS traffic in pcap format to w until ctx is done (optional)
+	PacketCapture func(ctx context.Context, w io.Writer) error
+	// Metrics serves /metrics in the Prometheus text format (optional)
+	Metrics http.Handler
+	// Shutdown stops the IMDS server and waits until it has drained or ctx
+	// is done (optional)
+	Shutdown func(ctx context.Context) error
+}
+
+// NewAdminServer creates an admin server for the given IMDS server.
+func NewAdminServer(server *Server, socketPath string) *AdminServer {
+	return &AdminServer{
+		server:     server,
+		socketPath: socketPath,
+		startedAt:  time.Now(),
+	}
+}
+
+// Handler returns the admin API router.
+func (a *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.handleStatus)
+	mux.HandleFunc("/config", a.handleConfig)
+	mux.HandleFunc("/loglevel", a.handleLogLevel)
+	mux.HandleFunc("/stats/network", a.handleNetworkStats)
+	mux.HandleFunc("/debug/network", a.handleNetworkDiagnostics)
+	mux.HandleFunc("/healthz", a.handleHealthz)
+	mux.HandleFunc("/readyz", a.handleReadyz)
+	mux.HandleFunc("/debug/pcap", a.handlePacketCapture)
+	mux.HandleFunc("/shutdown", a.handleShutdown)
+	mux.HandleFunc("/metrics", a.handleMetrics)
+	return mux
+}
+
+// Run serves the admin API until the context is canceled.
+func (a *AdminServer) Run(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(a.socketPath), 0700); err != nil {
+		return fmt.Errorf("failed to create admin socket directory: %w", err)
+	}
+	// Remove a stale socket left by a previous incarnation
+	if err := os.Remove(a.socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale admin socket: %w", err)
+	}
+
+	listener, err := net.Listen("unix", a.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", a.socketPath, err)
+	}
+	if err := os.Chmod(a.socketPath, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict admin socket permissions: %w", err)
+	}
+
+	srv := &http.Server{
+		Handler:     a.Handler(),
+		ReadTimeout: 5 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("Starting admin API on unix://%s", a.socketPath)
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+		close(errCh)
+	}()
+
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	case err := <-errCh:
+		return fmt.Errorf("admin server error: %w", err)
+	}
+}
+
+// handleStatus handles GET /status
+func (a *AdminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.server.writeJSON(w, http.StatusOK, StatusResponse{
+		StartedAt:     a.startedAt,
+		Uptime:        time.Since(a.startedAt).Round(time.Second).String(),
+		LogLevel:      a.server.LogLevel().String(),
+		TokensEnabled: a.server.TokensEnabled(),
+	})
+}
+
+// handleConfig handles GET /config
+func (a *AdminServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s := a.server
+	resp := ConfigResponse{
+		TokenPath:          s.TokenPath,
+		Namespace:          s.Namespace,
+		VMName:             s.VMName,
+		ServiceAccountName: s.ServiceAccountName,
+		ListenAddr:         s.ListenAddr,
+		ListenAddrV6:       s.ListenAddrV6,
+		APIServerURL:       s.APIServerURL,
+		CAPath:             s.CAPath,
+		Metadata:           s.Metadata,
+		AllowedAudiences:   s.AllowedAudiences,
+		ProjectedAudiences: projectedAudiences(s.AudienceTokenPaths),
+		SPIFFEEnabled:      s.SVIDSource != nil,
+		SourceAllowlist:    s.SourceAllowlist != nil,
+	}
+	routes := s.routes()
+	for _, version := range apiVersions {
+		for _, rt := range routes {
+			resp.Endpoints = append(resp.Endpoints, version.prefix()+rt.path)
+		}
+	}
+
+	s.writeJSON(w, http.StatusOK, resp)
+}
+
+// projectedAudiences returns the audiences served from projected tokens, sorted.
+func projectedAudiences(paths map[string]string) []string {
+	var audiences []string
+	for audience := range paths {
+		audiences = append(audiences, audience)
+	}
+	sort.Strings(audiences)
+	return audiences
+}
+
+// handleLogLevel handles GET and PUT /loglevel
+// PUT takes the level name as the request body.
+func (a *AdminServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+		if err != nil {
+			a.server.writeError(w, http.StatusBadRequest, "invalid_request", "Failed to read request body")
+			return
+		}
+		level, err := ParseLogLevel(string(body))
+		if err != nil {
+			a.server.writeError(w, http.StatusBadRequest, "invalid_log_level", err.Error())
+			return
+		}
+		a.server.SetLogLevel(level)
+		log.Printf("Log level changed to %s", level)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.server.writeJSON(w, http.StatusOK, map[string]string{"logLevel": a.server.LogLevel().String()})
+}
+
+// handleNetworkStats handles GET /stats/network
+func (a *AdminServer) handleNetworkStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.NetworkStats == nil {
+		a.server.writeError(w, http.StatusNotFound, "not_found", "Network statistics are not available")
+		return
+	}
+
+	stats, err := a.NetworkStats()
+	if err != nil {
+		log.Printf("Failed to collect network statistics: %v", err)
+		a.server.writeError(w, http.StatusInternalServerError, "stats_unavailable", err.Error())
+		return
+	}
+
+	a.server.writeJSON(w, http.StatusOK, stats)
+}
+
+// handleNetworkDiagnostics handles GET /debug/network
+func (a *AdminServer) handleNetworkDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.NetworkDiagnostics == nil {
+		a.server.writeError(w, http.StatusNotFound, "not_found", "Network diagnostics are not available")
+		return
+	}
+
+	diag, err := a.NetworkDiagnostics()
+	if err != nil {
+		log.Printf("Failed to collect network diagnostics: %v", err)
+		a.server.writeError(w, http.StatusInternalServerError, "diagnostics_unavailable", err.Error())
+		return
+	}
+
+	a.server.writeJSON(w, http.StatusOK, diag)
+}
+
+// handleHealthz handles GET /healthz
+func (a *AdminServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Liveness != nil {
+		if err := a.Liveness(); err != nil {
+			a.server.writeError(w, http.StatusServiceUnavailable, "not_live", err.Error())
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// handleReadyz handles GET /readyz
+func (a *AdminServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Readiness != nil {
+		if err := a.Readiness(); err != nil {
+			a.server.writeError(w, http.StatusServiceUnavailable, "not_ready", err.Error())
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// handleMetrics handles GET /metrics
+func (a *AdminServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Metrics == nil {
+		a.server.writeError(w, http.StatusNotFound, "not_found", "Metrics are not available")
+		return
+	}
+	a.Metrics.ServeHTTP(w, r)
+}
+
+// handleShutdown handles POST /shutdown
+// It answers once the IMDS server has stopped, so the caller can remove the
+// network configuration without racing the server's reconciler.
+func (a *AdminServer) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Shutdown == nil {
+		a.server.writeError(w, http.StatusNotFound, "not_found", "Shutdown is not available")
+		return
+	}
+
+	log.Println("Shutdown requested via admin API")
+	if err := a.Shutdown(r.Context()); err != nil {
+		a.server.writeError(w, http.StatusServiceUnavailable, "shutdown_failed", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// handlePacketCapture handles GET /debug/pcap[?duration=30s]
+func (a *AdminServer) handlePacketCapture(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.PacketCapture == nil {
+		a.server.writeError(w, http.StatusNotFound, "not_found", "Packet capture is not available")
+		return
+	}
+
+	duration := defaultCaptureDuration
+	if v := r.URL.Query().Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > maxCaptureDuration {
+			a.server.writeError(w, http.StatusBadRequest, "invalid_duration", fmt.Sprintf("duration must be between 0 and %v", maxCaptureDuration))
+			return
+		}
+		duration = d
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), duration)
+	defer cancel()
+
+	log.Printf("Capturing IMDS traffic for %v", duration)
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	fw := &flushWriter{w: w}
+	if err := a.PacketCapture(ctx, fw); err != nil {
+		log.Printf("Packet capture failed: %v", err)
+		if !fw.written {
+			a.server.writeError(w, http.StatusInternalServerError, "capture_failed", err.Error())
+		}
+	}
+}
+
+// flushWriter flushes every write to the client, so captures stream.
+type flushWriter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.written = true
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,413 @@
+package imds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    LogLevel
+		wantErr bool
+	}{
+		{input: "info", want: LogLevelInfo},
+		{input: "DEBUG", want: LogLevelDebug},
+		{input: " error\n", want: LogLevelError},
+		{input: "verbose", wantErr: true},
+		{input: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseLogLevel(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseLogLevel(%q) expected error, got nil", tt.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseLogLevel(%q) unexpected error: %v", tt.input, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseLogLevel(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	server := &Server{}
+	handler := NewAdminServer(server, "").Handler()
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+		wantLevel  LogLevel
+	}{
+		{
+			name:       "GET returns default level",
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantLevel:  LogLevelInfo,
+		},
+		{
+			name:       "PUT changes level",
+			method:     http.MethodPut,
+			body:       "debug",
+			wantStatus: http.StatusOK,
+			wantLevel:  LogLevelDebug,
+		},
+		{
+			name:       "PUT with invalid level is rejected",
+			method:     http.MethodPut,
+			body:       "trace",
+			wantStatus: http.StatusBadRequest,
+			wantLevel:  LogLevelDebug,
+		},
+		{
+			name:       "DELETE returns method not allowed",
+			method:     http.MethodDelete,
+			wantStatus: http.StatusMethodNotAllowed,
+			wantLevel:  LogLevelDebug,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/loglevel", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := server.LogLevel(); got != tt.wantLevel {
+				t.Errorf("log level = %v, want %v", got, tt.wantLevel)
+			}
+		})
+	}
+}
+
+func TestAdminConfigAndStatus(t *testing.T) {
+	server := NewServer("/tmp/token", "test-ns", "test-vm", "test-sa", "")
+	server.AllowedAudiences = []string{"vault"}
+	handler := NewAdminServer(server, "").Handler()
+
+	req := httptest.NewRequest(http.MethodGet, "/config", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /config status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var config ConfigResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	if config.VMName != "test-vm" || config.ListenAddr != "169.254.169.254:80" {
+		t.Errorf("config = %+v, want vmName test-vm and default listen address", config)
+	}
+	if len(config.AllowedAudiences) != 1 || config.AllowedAudiences[0] != "vault" {
+		t.Errorf("allowedAudiences = %v, want [vault]", config.AllowedAudiences)
+	}
+	if len(config.Endpoints) == 0 {
+		t.Error("expected endpoints in config dump")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/status", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	var status StatusResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("failed to parse status: %v", err)
+	}
+	if status.LogLevel != "info" || status.StartedAt.IsZero() || !status.TokensEnabled {
+		t.Errorf("status = %+v, want logLevel info, startedAt set and tokens enabled", status)
+	}
+}
+
+func TestAdminNetworkStats(t *testing.T) {
+	tests := []struct {
+		name       string
+		stats      func() (interface{}, error)
+		wantStatus int
+	}{
+		{
+			name:       "stats not wired returns 404",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "stats returned",
+			stats:      func() (interface{}, error) { return map[string]int{"rxPackets": 1}, nil },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "stats failure returns 500",
+			stats:      func() (interface{}, error) { return nil, fmt.Errorf("veth-imds not found") },
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin := NewAdminServer(&Server{}, "")
+			admin.NetworkStats = tt.stats
+
+			req := httptest.NewRequest(http.MethodGet, "/stats/network", nil)
+			w := httptest.NewRecorder()
+			admin.Handler().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAdminHealthz(t *testing.T) {
+	tests := []struct {
+		name       string
+		liveness   func() error
+		wantStatus int
+	}{
+		{name: "no liveness check is live", wantStatus: http.StatusOK},
+		{name: "check passes", liveness: func() error { return nil }, wantStatus: http.StatusOK},
+		{name: "check fails", liveness: func() error { return fmt.Errorf("connection refused") }, wantStatus: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin := NewAdminServer(&Server{}, "")
+			admin.Liveness = tt.liveness
+
+			req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+			w := httptest.NewRecorder()
+			admin.Handler().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAdminShutdown(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		shutdown   func(ctx context.Context) error
+		wantStatus int
+		wantCalled bool
+	}{
+		{name: "not available", method: http.MethodPost, wantStatus: http.StatusNotFound},
+		{name: "GET not allowed", method: http.MethodGet, shutdown: func(ctx context.Context) error { return nil }, wantStatus: http.StatusMethodNotAllowed},
+		{name: "stopped", method: http.MethodPost, shutdown: func(ctx context.Context) error { return nil }, wantStatus: http.StatusOK, wantCalled: true},
+		{name: "drain timed out", method: http.MethodPost, shutdown: func(ctx context.Context) error { return context.DeadlineExceeded }, wantStatus: http.StatusServiceUnavailable, wantCalled: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			admin := NewAdminServer(&Server{}, "")
+			if tt.shutdown != nil {
+				admin.Shutdown = func(ctx context.Context) error {
+					called = true
+					return tt.shutdown(ctx)
+				}
+			}
+
+			req := httptest.NewRequest(tt.method, "/shutdown", nil)
+			w := httptest.NewRecorder()
+			admin.Handler().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("shutdown called = %v, want %v", called, tt.wantCalled)
+			}
+		})
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		metrics    http.Handler
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "not available", method: http.MethodGet, wantStatus: http.StatusNotFound},
+		{name: "POST not allowed", method: http.MethodPost, metrics: NewTokenRefresher(staticTokenSource{}, time.Minute), wantStatus: http.StatusMethodNotAllowed},
+		{name: "token metrics", method: http.MethodGet, metrics: NewTokenRefresher(staticTokenSource{}, time.Minute), wantStatus: http.StatusOK, wantBody: "imds_token_refresh_errors_total 0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin := NewAdminServer(&Server{}, "")
+			admin.Metrics = tt.metrics
+
+			w := httptest.NewRecorder()
+			admin.Handler().ServeHTTP(w, httptest.NewRequest(tt.method, "/metrics", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAdminReadyz(t *testing.T) {
+	tests := []struct {
+		name       string
+		readiness  func() error
+		wantStatus int
+	}{
+		{
+			name:       "no readiness check is ready",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "check passes",
+			readiness:  func() error { return nil },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "check fails",
+			readiness:  func() error { return fmt.Errorf("no ARP reply") },
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin := NewAdminServer(&Server{}, "")
+			admin.Readiness = tt.readiness
+
+			req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+			w := httptest.NewRecorder()
+			admin.Handler().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAdminPacketCapture(t *testing.T) {
+	tests := []struct {
+		name       string
+		capture    func(ctx context.Context, w io.Writer) error
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "capture not wired returns 404",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name: "capture streamed",
+			capture: func(ctx context.Context, w io.Writer) error {
+				w.Write([]byte("pcap"))
+				return nil
+			},
+			query:      "?duration=1s",
+			wantStatus: http.StatusOK,
+			wantBody:   "pcap",
+		},
+		{
+			name: "capture stops at the deadline",
+			capture: func(ctx context.Context, w io.Writer) error {
+				<-ctx.Done()
+				return nil
+			},
+			query:      "?duration=10ms",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "invalid duration",
+			capture:    func(ctx context.Context, w io.Writer) error { return nil },
+			query:      "?duration=1h",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "failure before any data returns 500",
+			capture:    func(ctx context.Context, w io.Writer) error { return fmt.Errorf("no such interface") },
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin := NewAdminServer(&Server{}, "")
+			admin.PacketCapture = tt.capture
+
+			req := httptest.NewRequest(http.MethodGet, "/debug/pcap"+tt.query, nil)
+			w := httptest.NewRecorder()
+			admin.Handler().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAdminNetworkDiagnostics(t *testing.T) {
+	tests := []struct {
+		name       string
+		diag       func() (interface{}, error)
+		wantStatus int
+	}{
+		{
+			name:       "diagnostics not wired returns 404",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "diagnostics returned",
+			diag:       func() (interface{}, error) { return map[string]string{"imdsInterface": "imds-3f2a1c"}, nil },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "diagnostics failure returns 500",
+			diag:       func() (interface{}, error) { return nil, fmt.Errorf("netlink unavailable") },
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin := NewAdminServer(&Server{}, "")
+			admin.NetworkDiagnostics = tt.diag
+
+			req := httptest.NewRequest(http.MethodGet, "/debug/network", nil)
+			w := httptest.NewRecorder()
+			admin.Handler().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package imds
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+const (
+	// DefaultAttestationTTL is how long a successful attestation releases tokens
+	DefaultAttestationTTL = time.Hour
+	// attestChallengeTTL is how long a challenge nonce may be answered
+	attestChallengeTTL = time.Minute
+	// maxAttestChallenges bounds the outstanding challenges
+	maxAttestChallenges = 64
+	// maxAttestBytes bounds the request body of POST /v1/attest/verify
+	maxAttestBytes = 64 << 10
+)
+
+var (
+	// errAttestationFailed is returned when a quote doesn't satisfy the policy
+	errAttestationFailed = errors.New("attestation failed")
+	// errTooManyChallenges is returned while maxAttestChallenges are outstanding
+	errTooManyChallenges = errors.New("too many outstanding challenges")
+)
+
+// AttestationVerifier reports whether the VM is in an attested state.
+type AttestationVerifier interface {
+	Attested(ctx context.Context) (bool, error)
+}
+
+// AttestationPolicy is the expected state of the VM's vTPM.
+type AttestationPolicy struct {
+	// AKPublicKeys are the PEM public keys of the attestation keys whose
+	// quotes are trusted
+	AKPublicKeys []string `json:"akPublicKeys"`
+	// PCRs maps SHA-256 PCR indexes to the hex values each may have
+	PCRs map[int][]string `json:"pcrs"`
+}
+
+// AttestChallengeResponse is the response for GET /v1/attest/challenge
+type AttestChallengeResponse struct {
+	Nonce     string    `json:"nonce"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// AttestVerifyRequest is the request body of POST /v1/attest/verify
+type AttestVerifyRequest struct {
+	// Nonce is the hex nonce from the challenge, quoted as qualifying data
+	Nonce string `json:"nonce"`
+	// Quote is the TPMS_ATTEST structure the TPM signed
+	Quote []byte `json:"quote"`
+	// Signature is the TPMT_SIGNATURE over Quote
+	Signature []byte `json:"signature"`
+	// PCRs maps the quoted SHA-256 PCR indexes to their hex values
+	PCRs map[int]string `json:"pcrs"`
+}
+
+// AttestVerifyResponse is the response for POST /v1/attest/verify
+type AttestVerifyResponse struct {
+	AttestedUntil time.Time `json:"attestedUntil"`
+}
+
+// Attestation gates token release on a TPM quote from the VM's vTPM that
+// matches the policy in PolicyPath.
+type Attestation struct {
+	// PolicyPath is the JSON AttestationPolicy, read for every verification
+	PolicyPath string
+	// TTL is how long a successful attestation releases tokens
+	TTL time.Duration
+
+	now           func() time.Time
+	mu            sync.Mutex
+	nonces        map[string]time.Time
+	attestedUntil time.Time
+}
+
+// NewAttestation creates an Attestation with the policy at policyPath.
+func NewAttestation(policyPath string, ttl time.Duration) *Attestation {
+	return &Attestation{
+		PolicyPath: policyPath,
+		TTL:        ttl,
+		now:        time.Now,
+		nonces:     make(map[string]time.Time),
+	}
+}
+
+// Challenge returns a new single-use nonce and when it expires.
+func (a *Attestation) Challenge() (string, time.Time, error) {
+	var nonce [32]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	for n, expires := range a.nonces {
+		if !now.Before(expires) {
+			delete(a.nonces, n)
+		}
+	}
+	if len(a.nonces) >= maxAttestChallenges {
+		return "", time.Time{}, errTooManyChallenges
+	}
+	encoded, expires := hex.EncodeToString(nonce[:]), now.Add(attestChallengeTTL)
+	a.nonces[encoded] = expires
+	return encoded, expires, nil
+}
+
+// Verify checks a quote against the policy and, if it passes, releases
+// tokens until the returned time.
+func (a *Attestation) Verify(req AttestVerifyRequest) (time.Time, error) {
+	a.mu.Lock()
+	expires, ok := a.nonces[req.Nonce]
+	delete(a.nonces, req.Nonce)
+	a.mu.Unlock()
+	if !ok || !a.now().Before(expires) {
+		return time.Time{}, fmt.Errorf("%w: unknown or expired nonce", errAttestationFailed)
+	}
+	nonce, err := hex.DecodeString(req.Nonce)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: invalid nonce", errAttestationFailed)
+	}
+
+	data, err := os.ReadFile(a.PolicyPath)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read attestation policy: %w", err)
+	}
+	var policy AttestationPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return time.Time{}, fmt.Errorf("invalid attestation policy %s: %w", a.PolicyPath, err)
+	}
+	if err := verifyQuote(&policy, nonce, req); err != nil {
+		return time.Time{}, fmt.Errorf("%w: %v", errAttestationFailed, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.attestedUntil = a.now().Add(a.TTL)
+	return a.attestedUntil, nil
+}
+
+// Attested reports whether the last successful attestation is still valid.
+func (a *Attestation) Attested(ctx context.Context) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.now().Before(a.attestedUntil), nil
+}
+
+// verifyQuote checks that the quote is signed by a trusted AK, answers the
+// nonce, covers the PCR values sent along and that those match the policy.
+func verifyQuote(policy *AttestationPolicy, nonce []byte, req AttestVerifyRequest) error {
+	sig, err := tpm2.DecodeSignature(bytes.NewBuffer(req.Signature))
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	if err := verifyAKSignature(policy.AKPublicKeys, req.Quote, sig); err != nil {
+		return err
+	}
+
+	attest, err := tpm2.DecodeAttestationData(req.Quote)
+	if err != nil {
+		return fmt.Errorf("invalid quote: %v", err)
+	}
+	if attest.Type != tpm2.TagAttestQuote || attest.AttestedQuoteInfo == nil {
+		return fmt.Errorf("not a quote")
+	}
+	if !bytes.Equal(attest.ExtraData, nonce) {
+		return fmt.Errorf("quote doesn't answer the challenge")
+	}
+
+	// The quote signs a digest of the selected PCRs; recompute it from the
+	// values sent along so they can be checked against the policy
+	selection := attest.AttestedQuoteInfo.PCRSelection
+	if selection.Hash != tpm2.AlgSHA256 {
+		return fmt.Errorf("quote must select the SHA-256 PCR bank")
+	}
+	indexes := append([]int(nil), selection.PCRs...)
+	sort.Ints(indexes)
+	values := make(map[int][]byte, len(indexes))
+	digest := crypto.SHA256.New()
+	for _, i := range indexes {
+		value, err := hex.DecodeString(req.PCRs[i])
+		if err != nil || len(value) != crypto.SHA256.Size() {
+			return fmt.Errorf("missing or invalid value for quoted PCR %d", i)
+		}
+		values[i] = value
+		digest.Write(value)
+	}
+	if !bytes.Equal(digest.Sum(nil), attest.AttestedQuoteInfo.PCRDigest) {
+		return fmt.Errorf("PCR values don't match the quoted digest")
+	}
+
+	if len(policy.PCRs) == 0 {
+		return fmt.Errorf("policy has no PCRs")
+	}
+	for i, allowed := range policy.PCRs {
+		value, ok := values[i]
+		if !ok {
+			return fmt.Errorf("quote doesn't cover PCR %d", i)
+		}
+		if !pcrAllowed(value, allowed) {
+			return fmt.Errorf("PCR %d is %x, which the policy doesn't allow", i, value)
+		}
+	}
+	return nil
+}
+
+// verifyAKSignature checks the signature over quote against each trusted AK.
+func verifyAKSignature(akPEMs []string, quote []byte, sig *tpm2.Signature) error {
+	var hashAlg tpm2.Algorithm
+	switch {
+	case sig.RSA != nil:
+		hashAlg = sig.RSA.HashAlg
+	case sig.ECC != nil:
+		hashAlg = sig.ECC.HashAlg
+	}
+	hash, err := hashAlg.Hash()
+	if err != nil {
+		return fmt.Errorf("unsupported signature hash: %v", err)
+	}
+	h := hash.New()
+	h.Write(quote)
+	digest := h.Sum(nil)
+
+	for _, akPEM := range akPEMs {
+		block, _ := pem.Decode([]byte(akPEM))
+		if block == nil {
+			continue
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			continue
+		}
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			if sig.Alg == tpm2.AlgRSASSA && rsa.VerifyPKCS1v15(key, hash, digest, sig.RSA.Signature) == nil {
+				return nil
+			}
+			if sig.Alg == tpm2.AlgRSAPSS && rsa.VerifyPSS(key, hash, digest, sig.RSA.Signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			if sig.Alg == tpm2.AlgECDSA && ecdsa.Verify(key, digest, sig.ECC.R, sig.ECC.S) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("quote isn't signed by a trusted attestation key")
+}
+
+// pcrAllowed reports whether a PCR value is one of the allowed hex values.
+func pcrAllowed(value []byte, allowed []string) bool {
+	for _, a := range allowed {
+		if b, err := hex.DecodeString(a); err == nil && bytes.Equal(b, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// attestationVerifier returns the AttestationVerifier, or the in-process
+// Attestation if none is set, or nil if attestation is off.
+func (s *Server) attestationVerifier() AttestationVerifier {
+	if s.AttestationVerifier != nil {
+		return s.AttestationVerifier
+	}
+	if s.Attestation != nil {
+		return s.Attestation
+	}
+	return nil
+}
+
+// requireAttestation rejects requests for credential endpoints while the VM
+// isn't attested. It is a no-op without an attestation verifier.
+func (s *Server) requireAttestation(next http.HandlerFunc) http.HandlerFunc {
+	verifier := s.attestationVerifier()
+	if verifier == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		attested, err := verifier.Attested(r.Context())
+		if err != nil {
+			log.Printf("Failed to check attestation state: %v", err)
+			s.writeError(w, http.StatusServiceUnavailable, "attestation_unavailable", "Failed to check the VM's attestation state")
+			return
+		}
+		if !attested {
+			s.writeError(w, http.StatusForbidden, "attestation_required", "Credentials are only served to an attested VM")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleAttestChallenge handles GET /v1/attest/challenge
+func (s *Server) handleAttestChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	nonce, expires, err := s.Attestation.Challenge()
+	if errors.Is(err, errTooManyChallenges) {
+		w.Header().Set("Retry-After", "1")
+		s.writeError(w, http.StatusTooManyRequests, "too_many_challenges", "Too many outstanding challenges")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to create attestation challenge: %v", err)
+		s.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to create challenge")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	s.writeJSON(w, http.StatusOK, AttestChallengeResponse{Nonce: nonce, ExpiresAt: expires})
+}
+
+// handleAttestVerify handles POST /v1/attest/verify with an
+// AttestVerifyRequest as the body.
+func (s *Server) handleAttestVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req AttestVerifyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAttestBytes)).Decode(&req); err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalid_request", "Expected a JSON attestation with nonce, quote, signature and pcrs")
+		return
+	}
+
+	until, err := s.Attestation.Verify(req)
+	if err != nil {
+		log.Printf("Attestation from %s rejected: %v", s.requestSource(r), err)
+		if errors.Is(err, errAttestationFailed) {
+			s.writeError(w, http.StatusForbidden, "attestation_failed", err.Error())
+			return
+		}
+		s.writeError(w, http.StatusInternalServerError, "policy_unavailable", "Failed to read the attestation policy")
+		return
+	}
+
+	log.Printf("Attestation from %s verified, releasing tokens until %s", s.requestSource(r), until.Format(time.RFC3339))
+	s.writeJSON(w, http.StatusOK, AttestVerifyResponse{AttestedUntil: until})
+}
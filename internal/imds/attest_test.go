@@ -0,0 +1,310 @@
+package imds
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+)
+
+// testPCRs are the SHA-256 PCR values of a well-booted test VM
+var testPCRs = map[int]string{
+	0: strings.Repeat("a0", 32),
+	4: strings.Repeat("a4", 32),
+	7: strings.Repeat("a7", 32),
+}
+
+// createTestQuote returns a TPMS_ATTEST quote of pcrs answering nonce.
+func createTestQuote(t *testing.T, nonce []byte, pcrs map[int]string) []byte {
+	t.Helper()
+	var indexes []int
+	digest := sha256.New()
+	for i := 0; i < 24; i++ {
+		if v, ok := pcrs[i]; ok {
+			b, _ := hex.DecodeString(v)
+			digest.Write(b)
+			indexes = append(indexes, i)
+		}
+	}
+	quote, err := tpm2.AttestationData{
+		Magic:           0xff544347,
+		Type:            tpm2.TagAttestQuote,
+		QualifiedSigner: tpm2.Name{Digest: &tpm2.HashValue{Alg: tpm2.AlgSHA256, Value: make([]byte, 32)}},
+		ExtraData:       nonce,
+		AttestedQuoteInfo: &tpm2.QuoteInfo{
+			PCRSelection: tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: indexes},
+			PCRDigest:    digest.Sum(nil),
+		},
+	}.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return quote
+}
+
+// signTestQuote returns a TPMT_SIGNATURE over quote by key.
+func signTestQuote(t *testing.T, key crypto.Signer, quote []byte) []byte {
+	t.Helper()
+	digest := sha256.Sum256(quote)
+	var sig tpm2.Signature
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = tpm2.Signature{Alg: tpm2.AlgECDSA, ECC: &tpm2.SignatureECC{HashAlg: tpm2.AlgSHA256, R: r, S: s}}
+	case *rsa.PrivateKey:
+		b, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = tpm2.Signature{Alg: tpm2.AlgRSASSA, RSA: &tpm2.SignatureRSA{HashAlg: tpm2.AlgSHA256, Signature: b}}
+	}
+	encoded, err := sig.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+// publicKeyPEM returns the PEM public key of key.
+func publicKeyPEM(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// writeTestPolicy writes an attestation policy and returns its path.
+func writeTestPolicy(t *testing.T, policy AttestationPolicy) string {
+	t.Helper()
+	data, err := json.Marshal(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAttestationVerify(t *testing.T) {
+	ak, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaAK, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := AttestationPolicy{
+		AKPublicKeys: []string{publicKeyPEM(t, ak), publicKeyPEM(t, rsaAK)},
+		PCRs: map[int][]string{
+			0: {testPCRs[0]},
+			7: {strings.Repeat("b7", 32), strings.ToUpper(testPCRs[7])},
+		},
+	}
+
+	tamperedPCRs := map[int]string{0: testPCRs[0], 4: testPCRs[4], 7: strings.Repeat("c7", 32)}
+	partialPCRs := map[int]string{0: testPCRs[0], 4: testPCRs[4]}
+
+	tests := []struct {
+		name      string
+		signer    crypto.Signer
+		quotePCRs map[int]string
+		sentPCRs  map[int]string
+		badNonce  bool
+		reuse     bool
+		policy    *AttestationPolicy
+		wantErr   string
+	}{
+		{name: "ECDSA AK", signer: ak, quotePCRs: testPCRs, sentPCRs: testPCRs},
+		{name: "RSA AK", signer: rsaAK, quotePCRs: testPCRs, sentPCRs: testPCRs},
+		{name: "untrusted key", signer: otherKey, quotePCRs: testPCRs, sentPCRs: testPCRs, wantErr: "trusted attestation key"},
+		{name: "wrong nonce", signer: ak, quotePCRs: testPCRs, sentPCRs: testPCRs, badNonce: true, wantErr: "challenge"},
+		{name: "nonce reused", signer: ak, quotePCRs: testPCRs, sentPCRs: testPCRs, reuse: true, wantErr: "nonce"},
+		{name: "PCR not allowed", signer: ak, quotePCRs: tamperedPCRs, sentPCRs: tamperedPCRs, wantErr: "PCR 7"},
+		{name: "PCR values don't match quote", signer: ak, quotePCRs: tamperedPCRs, sentPCRs: testPCRs, wantErr: "digest"},
+		{name: "policy PCR not quoted", signer: ak, quotePCRs: partialPCRs, sentPCRs: partialPCRs, wantErr: "doesn't cover PCR 7"},
+		{name: "empty policy", signer: ak, quotePCRs: testPCRs, sentPCRs: testPCRs, policy: &AttestationPolicy{AKPublicKeys: policy.AKPublicKeys}, wantErr: "no PCRs"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := policy
+			if tt.policy != nil {
+				p = *tt.policy
+			}
+			attestation := NewAttestation(writeTestPolicy(t, p), time.Hour)
+
+			nonce, _, err := attestation.Challenge()
+			if err != nil {
+				t.Fatalf("Challenge() error = %v", err)
+			}
+			quoted, _ := hex.DecodeString(nonce)
+			if tt.badNonce {
+				quoted = bytes.Repeat([]byte{1}, len(quoted))
+			}
+			quote := createTestQuote(t, quoted, tt.quotePCRs)
+			req := AttestVerifyRequest{Nonce: nonce, Quote: quote, Signature: signTestQuote(t, tt.signer, quote), PCRs: tt.sentPCRs}
+			if tt.reuse {
+				if _, err := attestation.Verify(req); err != nil {
+					t.Fatalf("first Verify() error = %v", err)
+				}
+			}
+
+			until, err := attestation.Verify(req)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Verify() error = %v, want %q", err, tt.wantErr)
+				}
+				if attested, _ := attestation.Attested(context.Background()); !tt.reuse && attested {
+					t.Error("Attested() = true after a failed attestation")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if attested, _ := attestation.Attested(context.Background()); !attested || until.IsZero() {
+				t.Errorf("Attested() = false after a successful attestation")
+			}
+		})
+	}
+}
+
+func TestAttestationExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	attestation := NewAttestation("", time.Hour)
+	attestation.now = func() time.Time { return now }
+
+	nonce, _, err := attestation.Challenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * attestChallengeTTL)
+	if _, err := attestation.Verify(AttestVerifyRequest{Nonce: nonce}); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Verify() with an expired nonce error = %v, want expired", err)
+	}
+
+	attestation.attestedUntil = now.Add(time.Minute)
+	if attested, _ := attestation.Attested(context.Background()); !attested {
+		t.Error("Attested() = false before attestedUntil")
+	}
+	now = now.Add(2 * time.Minute)
+	if attested, _ := attestation.Attested(context.Background()); attested {
+		t.Error("Attested() = true after attestedUntil")
+	}
+}
+
+func TestAttestationChallengeLimit(t *testing.T) {
+	attestation := NewAttestation("", time.Hour)
+	for i := 0; i < maxAttestChallenges; i++ {
+		if _, _, err := attestation.Challenge(); err != nil {
+			t.Fatalf("Challenge() %d error = %v", i, err)
+		}
+	}
+	if _, _, err := attestation.Challenge(); err != errTooManyChallenges {
+		t.Errorf("Challenge() over the limit error = %v, want %v", err, errTooManyChallenges)
+	}
+}
+
+func TestHandleAttestation(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("test-token"), 0644); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+	ak, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policyPath := writeTestPolicy(t, AttestationPolicy{
+		AKPublicKeys: []string{publicKeyPEM(t, ak)},
+		PCRs:         map[int][]string{7: {testPCRs[7]}},
+	})
+
+	server := NewServer(tokenPath, "test-ns", "test-vm", "test-sa", "")
+	server.Attestation = NewAttestation(policyPath, time.Hour)
+	mux := server.newMux()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	verify := func(req AttestVerifyRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/attest/verify", bytes.NewReader(body)))
+		return w
+	}
+	wantError := func(w *httptest.ResponseRecorder, status int, code string) {
+		t.Helper()
+		var resp ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != status || resp.Error != code {
+			t.Fatalf("response = %d %q, want %d %q: %s", w.Code, resp.Error, status, code, w.Body.String())
+		}
+	}
+
+	// Tokens are held back until the guest attests
+	wantError(get("/v1/token"), http.StatusForbidden, "attestation_required")
+	wantError(get("/v1/kubeconfig"), http.StatusForbidden, "attestation_required")
+	if w := get("/v1/identity"); w.Code != http.StatusOK {
+		t.Fatalf("identity status = %d, want 200", w.Code)
+	}
+
+	w := get("/v1/attest/challenge")
+	var challenge AttestChallengeResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &challenge); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("challenge = %d %s", w.Code, w.Body.String())
+	}
+	nonce, _ := hex.DecodeString(challenge.Nonce)
+
+	// A quote of a tampered boot is rejected
+	tampered := map[int]string{7: strings.Repeat("c7", 32)}
+	quote := createTestQuote(t, nonce, tampered)
+	wantError(verify(AttestVerifyRequest{Nonce: challenge.Nonce, Quote: quote, Signature: signTestQuote(t, ak, quote), PCRs: tampered}), http.StatusForbidden, "attestation_failed")
+	wantError(get("/v1/token"), http.StatusForbidden, "attestation_required")
+
+	// A good quote releases tokens
+	json.Unmarshal(get("/v1/attest/challenge").Body.Bytes(), &challenge)
+	nonce, _ = hex.DecodeString(challenge.Nonce)
+	quote = createTestQuote(t, nonce, map[int]string{7: testPCRs[7]})
+	w = verify(AttestVerifyRequest{Nonce: challenge.Nonce, Quote: quote, Signature: signTestQuote(t, ak, quote), PCRs: map[int]string{7: testPCRs[7]}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("verify status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if w := get("/v1/token"); w.Code != http.StatusOK {
+		t.Errorf("token status after attestation = %d, want 200: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/attest/verify", strings.NewReader("not json")))
+	wantError(w, http.StatusBadRequest, "invalid_request")
+}
@@ -0,0 +1,219 @@
+package imds
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// DefaultCertificateExpiration is the lifetime requested for certificates
+	DefaultCertificateExpiration = 24 * time.Hour
+	// MinCertificateExpiration is the shortest lifetime the CSR API accepts
+	MinCertificateExpiration = 10 * time.Minute
+
+	// certificateIssueTimeout bounds the wait for a CSR to be approved and signed
+	certificateIssueTimeout = 30 * time.Second
+	// certificatePollInterval is how often a pending CSR is checked
+	certificatePollInterval = time.Second
+	// maxCSRBytes bounds the request body of POST /v1/certificates
+	maxCSRBytes = 64 << 10
+)
+
+// Labels set on the CertificateSigningRequests the sidecar creates
+const (
+	CSRNamespaceLabel = "imds.kubevirt.io/namespace"
+	CSRVMLabel        = "imds.kubevirt.io/vm"
+)
+
+// oidCommonName is the X.509 attribute type of the subject common name
+var oidCommonName = asn1.ObjectIdentifier{2, 5, 4, 3}
+
+// ErrCertificateDenied is returned when a CSR was denied or signing failed.
+var ErrCertificateDenied = errors.New("certificate signing request was denied")
+
+// CertificateResponse is the response for POST /v1/certificates
+type CertificateResponse struct {
+	Certificate         string    `json:"certificate"`
+	ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+}
+
+// CertificateIssuer signs certificate requests on behalf of the VM.
+type CertificateIssuer interface {
+	IssueCertificate(ctx context.Context, csrPEM []byte) ([]byte, error)
+}
+
+// csrIssuer issues certificates through the Kubernetes
+// CertificateSigningRequest API. The VM's ServiceAccount needs "create" and
+// "get" on certificatesigningrequests, and, to approve its own requests,
+// "update" on certificatesigningrequests/approval and "approve" on the signer.
+type csrIssuer struct {
+	client            kubernetes.Interface
+	signerName        string
+	expirationSeconds int32
+	approve           bool
+	namespace         string
+	vmName            string
+}
+
+// NewCSRIssuer creates a CertificateIssuer submitting CSRs for signerName.
+// With approve the sidecar approves its own requests; otherwise it waits for
+// an external approver.
+func NewCSRIssuer(client kubernetes.Interface, signerName string, expiration time.Duration, approve bool, namespace, vmName string) CertificateIssuer {
+	return &csrIssuer{
+		client:            client,
+		signerName:        signerName,
+		expirationSeconds: int32(expiration.Seconds()),
+		approve:           approve,
+		namespace:         namespace,
+		vmName:            vmName,
+	}
+}
+
+// IssueCertificate creates a CSR, approves it if configured to, and waits
+// until the signer has issued the certificate.
+func (c *csrIssuer) IssueCertificate(ctx context.Context, csrPEM []byte) ([]byte, error) {
+	csrs := c.client.CertificatesV1().CertificateSigningRequests()
+	csr, err := csrs.Create(ctx, &certificatesv1.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "imds-" + c.vmName + "-",
+			Labels: map[string]string{
+				CSRNamespaceLabel: c.namespace,
+				CSRVMLabel:        c.vmName,
+			},
+		},
+		Spec: certificatesv1.CertificateSigningRequestSpec{
+			Request:           csrPEM,
+			SignerName:        c.signerName,
+			ExpirationSeconds: &c.expirationSeconds,
+			Usages:            []certificatesv1.KeyUsage{certificatesv1.UsageDigitalSignature, certificatesv1.UsageClientAuth},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CertificateSigningRequest: %w", err)
+	}
+
+	if c.approve {
+		csr.Status.Conditions = append(csr.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{
+			Type:    certificatesv1.CertificateApproved,
+			Status:  corev1.ConditionTrue,
+			Reason:  "IMDSApproved",
+			Message: fmt.Sprintf("Approved by the IMDS sidecar of VM %s/%s", c.namespace, c.vmName),
+		})
+		if _, err := csrs.UpdateApproval(ctx, csr.Name, csr, metav1.UpdateOptions{}); err != nil {
+			return nil, fmt.Errorf("failed to approve CertificateSigningRequest %s: %w", csr.Name, err)
+		}
+	}
+
+	var cert []byte
+	err = wait.PollUntilContextTimeout(ctx, certificatePollInterval, certificateIssueTimeout, true, func(ctx context.Context) (bool, error) {
+		csr, err := csrs.Get(ctx, csr.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("failed to get CertificateSigningRequest: %w", err)
+		}
+		for _, cond := range csr.Status.Conditions {
+			if (cond.Type == certificatesv1.CertificateDenied || cond.Type == certificatesv1.CertificateFailed) && cond.Status == corev1.ConditionTrue {
+				return false, fmt.Errorf("%w: %s: %s", ErrCertificateDenied, cond.Reason, cond.Message)
+			}
+		}
+		cert = csr.Status.Certificate
+		return len(cert) > 0, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("CertificateSigningRequest %s not issued: %w", csr.Name, err)
+	}
+	return cert, nil
+}
+
+// certificateCommonName is the only subject the VM may request, so that
+// signers mapping the subject to a user can't be used to impersonate others.
+func (s *Server) certificateCommonName() string {
+	return fmt.Sprintf("kubevirt:vm:%s:%s", s.Namespace, s.VMName)
+}
+
+// checkCSR parses a PEM certificate request and checks that it only asks
+// for commonName: no other subject fields and no SANs.
+func checkCSR(csrPEM []byte, commonName string) error {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return fmt.Errorf("expected a PEM-encoded CERTIFICATE REQUEST")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("invalid certificate request: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return fmt.Errorf("invalid certificate request signature: %w", err)
+	}
+
+	if csr.Subject.CommonName != commonName {
+		return fmt.Errorf("subject common name must be %q, got %q", commonName, csr.Subject.CommonName)
+	}
+	// Names holds every attribute, including those pkix.Name has no field for
+	if len(csr.Subject.Names) != 1 || !csr.Subject.Names[0].Type.Equal(oidCommonName) {
+		return fmt.Errorf("subject may only contain the common name, got %q", csr.Subject.String())
+	}
+	if len(csr.DNSNames) > 0 || len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return fmt.Errorf("subject alternative names are not allowed")
+	}
+	return nil
+}
+
+// handleCertificates handles POST /v1/certificates with a PEM certificate
+// request as the body.
+func (s *Server) handleCertificates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	csrPEM, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCSRBytes))
+	if err != nil {
+		s.writeError(w, http.StatusRequestEntityTooLarge, "invalid_csr", fmt.Sprintf("Certificate request larger than %d bytes", maxCSRBytes))
+		return
+	}
+	if err := checkCSR(csrPEM, s.certificateCommonName()); err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalid_csr", err.Error())
+		return
+	}
+
+	// Signing outlasts the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(certificateIssueTimeout + 5*time.Second)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("Failed to extend write deadline: %v", err)
+	}
+
+	certPEM, err := s.CertificateIssuer.IssueCertificate(r.Context(), csrPEM)
+	if err != nil {
+		log.Printf("Failed to issue certificate: %v", err)
+		switch {
+		case errors.Is(err, ErrCertificateDenied):
+			s.writeError(w, http.StatusForbidden, "csr_denied", err.Error())
+		case errors.Is(err, context.DeadlineExceeded):
+			s.writeError(w, http.StatusGatewayTimeout, "csr_pending", "The certificate was not issued in time")
+		default:
+			s.writeError(w, http.StatusBadGateway, "certificate_unavailable", "Failed to issue the certificate")
+		}
+		return
+	}
+
+	resp := CertificateResponse{Certificate: string(certPEM)}
+	if block, _ := pem.Decode(certPEM); block != nil {
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			resp.ExpirationTimestamp = cert.NotAfter
+		}
+	}
+	s.writeJSON(w, http.StatusOK, resp)
+}
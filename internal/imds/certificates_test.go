@@ -0,0 +1,215 @@
+package imds
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// createTestCSR returns a PEM certificate request for the template.
+func createTestCSR(t *testing.T, template *x509.CertificateRequest) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+// createTestCertificate returns a PEM self-signed certificate expiring at notAfter.
+func createTestCertificate(t *testing.T, notAfter time.Time) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: notAfter.Add(-time.Hour), NotAfter: notAfter}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestCheckCSR(t *testing.T) {
+	const cn = "kubevirt:vm:test-ns:test-vm"
+	tests := []struct {
+		name    string
+		csr     []byte
+		wantErr string
+	}{
+		{name: "valid", csr: createTestCSR(t, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}})},
+		{name: "other common name", csr: createTestCSR(t, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "admin"}}), wantErr: "common name"},
+		{name: "organization", csr: createTestCSR(t, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn, Organization: []string{"system:masters"}}}), wantErr: "only contain"},
+		{name: "unnamed attribute", csr: createTestCSR(t, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn, ExtraNames: []pkix.AttributeTypeAndValue{{Type: asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}, Value: "admin"}}}}), wantErr: "only contain"},
+		{name: "DNS name", csr: createTestCSR(t, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}, DNSNames: []string{"kubernetes"}}), wantErr: "alternative names"},
+		{name: "not PEM", csr: []byte("hello"), wantErr: "PEM"},
+		{name: "wrong PEM type", csr: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}}), wantErr: "PEM"},
+		{name: "garbage", csr: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: []byte{1}}), wantErr: "invalid certificate request"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCSR(tt.csr, cn)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("checkCSR() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("checkCSR() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCSRIssuer(t *testing.T) {
+	issued := []byte("-----BEGIN CERTIFICATE-----")
+	tests := []struct {
+		name         string
+		approve      bool
+		conditions   []certificatesv1.CertificateSigningRequestCondition
+		certificate  []byte
+		wantApproved bool
+		wantErr      error
+	}{
+		{name: "issued", certificate: issued},
+		{name: "approved by the sidecar", approve: true, certificate: issued, wantApproved: true},
+		{
+			name:       "denied",
+			conditions: []certificatesv1.CertificateSigningRequestCondition{{Type: certificatesv1.CertificateDenied, Status: corev1.ConditionTrue, Reason: "PolicyDenied"}},
+			wantErr:    ErrCertificateDenied,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			var created *certificatesv1.CertificateSigningRequest
+			approved := false
+			client.PrependReactor("create", "certificatesigningrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*certificatesv1.CertificateSigningRequest).DeepCopy()
+				created.Name = created.GenerateName + "abcde"
+				return true, created, nil
+			})
+			client.PrependReactor("update", "certificatesigningrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				approved = action.GetSubresource() == "approval"
+				return true, action.(k8stesting.UpdateAction).GetObject(), nil
+			})
+			client.PrependReactor("get", "certificatesigningrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				csr := created.DeepCopy()
+				csr.Status.Conditions = tt.conditions
+				csr.Status.Certificate = tt.certificate
+				return true, csr, nil
+			})
+
+			issuer := NewCSRIssuer(client, "example.com/vm-signer", time.Hour, tt.approve, "test-ns", "test-vm")
+			cert, err := issuer.IssueCertificate(context.Background(), []byte("csr"))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("IssueCertificate() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && string(cert) != string(tt.certificate) {
+				t.Errorf("IssueCertificate() = %q, want %q", cert, tt.certificate)
+			}
+			if approved != tt.wantApproved {
+				t.Errorf("approved = %v, want %v", approved, tt.wantApproved)
+			}
+
+			spec := created.Spec
+			if spec.SignerName != "example.com/vm-signer" || *spec.ExpirationSeconds != 3600 || string(spec.Request) != "csr" {
+				t.Errorf("CSR spec = %+v", spec)
+			}
+			if created.Labels[CSRNamespaceLabel] != "test-ns" || created.Labels[CSRVMLabel] != "test-vm" {
+				t.Errorf("CSR labels = %v", created.Labels)
+			}
+		})
+	}
+}
+
+// fakeCertificateIssuer is a test CertificateIssuer returning a canned response.
+type fakeCertificateIssuer struct {
+	cert []byte
+	err  error
+}
+
+func (f fakeCertificateIssuer) IssueCertificate(ctx context.Context, csrPEM []byte) ([]byte, error) {
+	return f.cert, f.err
+}
+
+func TestHandleCertificates(t *testing.T) {
+	notAfter := time.Unix(1700000000, 0)
+	cert := createTestCertificate(t, notAfter)
+	csr := createTestCSR(t, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "kubevirt:vm:test-ns:test-vm"}})
+
+	tests := []struct {
+		name       string
+		method     string
+		body       []byte
+		issuer     CertificateIssuer
+		wantStatus int
+		wantError  string
+	}{
+		{name: "issued", method: http.MethodPost, body: csr, issuer: fakeCertificateIssuer{cert: cert}, wantStatus: http.StatusOK},
+		{name: "GET not allowed", method: http.MethodGet, issuer: fakeCertificateIssuer{}, wantStatus: http.StatusMethodNotAllowed},
+		{name: "not enabled", method: http.MethodPost, body: csr, wantStatus: http.StatusNotFound},
+		{name: "invalid CSR", method: http.MethodPost, body: []byte("hello"), issuer: fakeCertificateIssuer{}, wantStatus: http.StatusBadRequest, wantError: "invalid_csr"},
+		{name: "denied", method: http.MethodPost, body: csr, issuer: fakeCertificateIssuer{err: fmt.Errorf("%w: PolicyDenied", ErrCertificateDenied)}, wantStatus: http.StatusForbidden, wantError: "csr_denied"},
+		{name: "pending", method: http.MethodPost, body: csr, issuer: fakeCertificateIssuer{err: context.DeadlineExceeded}, wantStatus: http.StatusGatewayTimeout, wantError: "csr_pending"},
+		{name: "API failure", method: http.MethodPost, body: csr, issuer: fakeCertificateIssuer{err: fmt.Errorf("forbidden")}, wantStatus: http.StatusBadGateway, wantError: "certificate_unavailable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer("", "test-ns", "test-vm", "default", "")
+			server.CertificateIssuer = tt.issuer
+
+			req := httptest.NewRequest(tt.method, "/v1/certificates", strings.NewReader(string(tt.body)))
+			w := httptest.NewRecorder()
+			server.newMux().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantError != "" {
+				var resp ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("failed to parse error response: %v", err)
+				}
+				if resp.Error != tt.wantError {
+					t.Errorf("error = %q, want %q", resp.Error, tt.wantError)
+				}
+			}
+			if w.Code == http.StatusOK {
+				var resp CertificateResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("failed to parse response: %v", err)
+				}
+				if resp.Certificate != string(cert) || !resp.ExpirationTimestamp.Equal(notAfter) {
+					t.Errorf("response = %+v, want the certificate expiring at %v", resp, notAfter)
+				}
+			}
+		})
+	}
+}
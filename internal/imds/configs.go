@@ -0,0 +1,85 @@
+package imds
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ConfigsResponse is the response for GET /v1/configs
+type ConfigsResponse struct {
+	Configs []string `json:"configs"`
+}
+
+// ConfigKeysResponse is the response for GET /v1/configs/<name>
+type ConfigKeysResponse struct {
+	Keys []string `json:"keys"`
+}
+
+// ConfigMapReader reads ConfigMaps from the VM's namespace.
+type ConfigMapReader interface {
+	ReadConfigMap(ctx context.Context, name string) (*corev1.ConfigMap, error)
+}
+
+// kubeConfigMapReader reads ConfigMaps with the VM's ServiceAccount, which
+// needs "get" on each exposed ConfigMap.
+type kubeConfigMapReader struct {
+	client    kubernetes.Interface
+	namespace string
+}
+
+// NewConfigMapReader creates a ConfigMapReader for ConfigMaps in namespace.
+func NewConfigMapReader(client kubernetes.Interface, namespace string) ConfigMapReader {
+	return &kubeConfigMapReader{client: client, namespace: namespace}
+}
+
+// ReadConfigMap returns the ConfigMap.
+func (k *kubeConfigMapReader) ReadConfigMap(ctx context.Context, name string) (*corev1.ConfigMap, error) {
+	cm, err := k.client.CoreV1().ConfigMaps(k.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ConfigMap %s/%s: %w", k.namespace, name, err)
+	}
+	return cm, nil
+}
+
+// handleConfigs handles GET /v1/configs, listing the exposed ConfigMaps.
+func (s *Server) handleConfigs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, ConfigsResponse{Configs: exposedNames(s.ExposedConfigMaps)})
+}
+
+// handleConfig handles GET /v1/configs/<name>, listing the exposed keys, and
+// GET /v1/configs/<name>/<key>, returning the raw value. Responses carry the
+// ConfigMap's resourceVersion as ETag, so the guest can poll for changes
+// with If-None-Match.
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	served := s.serveExposed(w, r, exposedKind{
+		kind:    "ConfigMap",
+		code:    "config",
+		route:   "/configs/",
+		exposed: s.ExposedConfigMaps,
+		read: func(ctx context.Context, name string) (exposedObject, error) {
+			cm, err := s.ConfigMapReader.ReadConfigMap(ctx, name)
+			if err != nil {
+				return exposedObject{}, err
+			}
+			return exposedObject{resourceVersion: cm.ResourceVersion, data: cm.Data, binaryData: cm.BinaryData}, nil
+		},
+		keys: func(keys []string) any { return ConfigKeysResponse{Keys: keys} },
+	})
+	if !served {
+		s.handleConfigs(w, r)
+	}
+}
@@ -0,0 +1,101 @@
+package imds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHandleConfig(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "app-config", Namespace: "test-ns", ResourceVersion: "42"},
+			Data:       map[string]string{"settings.yaml": "level: debug\n", "internal.yaml": "x: y\n"},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "assets", Namespace: "test-ns", ResourceVersion: "7"},
+			Data:       map[string]string{"motd": "hello"},
+			BinaryData: map[string][]byte{"logo.png": {0x89, 'P', 'N', 'G'}},
+		},
+	)
+
+	server := NewServer("/nonexistent", "test-ns", "test-vm", "test-sa", "")
+	server.ConfigMapReader = NewConfigMapReader(client, "test-ns")
+	server.ExposedConfigMaps = map[string][]string{
+		"app-config": {"settings.yaml"},
+		"assets":     {},
+		"missing":    {},
+	}
+	mux := server.newMux()
+
+	tests := []struct {
+		name        string
+		path        string
+		ifNoneMatch string
+		wantStatus  int
+		wantBody    string
+		wantType    string
+		wantKeys    []string
+		wantError   string
+	}{
+		{name: "exposed key", path: "/v1/configs/app-config/settings.yaml", wantStatus: http.StatusOK, wantBody: "level: debug\n", wantType: "text/plain; charset=utf-8"},
+		{name: "binary key", path: "/v1/configs/assets/logo.png", wantStatus: http.StatusOK, wantBody: "\x89PNG", wantType: "application/octet-stream"},
+		{name: "list keys", path: "/v1/configs/assets", wantStatus: http.StatusOK, wantKeys: []string{"logo.png", "motd"}},
+		{name: "list exposed keys", path: "/v1/configs/app-config", wantStatus: http.StatusOK, wantKeys: []string{"settings.yaml"}},
+		{name: "unchanged", path: "/v1/configs/app-config/settings.yaml", ifNoneMatch: `"42"`, wantStatus: http.StatusNotModified},
+		{name: "changed", path: "/v1/configs/app-config/settings.yaml", ifNoneMatch: `"41"`, wantStatus: http.StatusOK, wantBody: "level: debug\n", wantType: "text/plain; charset=utf-8"},
+		{name: "key not exposed", path: "/v1/configs/app-config/internal.yaml", wantStatus: http.StatusForbidden, wantError: "config_not_exposed"},
+		{name: "config not exposed", path: "/v1/configs/other/key", wantStatus: http.StatusForbidden, wantError: "config_not_exposed"},
+		{name: "missing key", path: "/v1/configs/assets/nope", wantStatus: http.StatusNotFound, wantError: "not_found"},
+		{name: "missing config", path: "/v1/configs/missing/key", wantStatus: http.StatusNotFound, wantError: "not_found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			switch {
+			case tt.wantError != "":
+				var resp ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error != tt.wantError {
+					t.Errorf("error = %q, want %q", resp.Error, tt.wantError)
+				}
+			case tt.wantKeys != nil:
+				var resp ConfigKeysResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !reflect.DeepEqual(resp.Keys, tt.wantKeys) {
+					t.Errorf("keys = %v, want %v", resp.Keys, tt.wantKeys)
+				}
+			default:
+				if w.Body.String() != tt.wantBody {
+					t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+				}
+				if tt.wantType != "" && w.Header().Get("Content-Type") != tt.wantType {
+					t.Errorf("Content-Type = %q, want %q", w.Header().Get("Content-Type"), tt.wantType)
+				}
+			}
+			if tt.wantError == "" && w.Header().Get("ETag") == "" {
+				t.Error("no ETag")
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/configs", nil))
+	var list ConfigsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || !reflect.DeepEqual(list.Configs, []string{"app-config", "assets", "missing"}) {
+		t.Errorf("GET /v1/configs = %s", w.Body.String())
+	}
+}
@@ -0,0 +1,76 @@
+package imds
+
+import (
+	"net/http"
+	"time"
+)
+
+// RootResponse is the response for GET /
+type RootResponse struct {
+	Versions []VersionInfo `json:"versions"`
+}
+
+// VersionInfo describes a supported API version.
+type VersionInfo struct {
+	Name       string     `json:"name"`
+	Path       string     `json:"path"`
+	Deprecated bool       `json:"deprecated,omitempty"`
+	Sunset     *time.Time `json:"sunset,omitempty"`
+}
+
+// VersionIndexResponse is the response for GET /<version>/
+type VersionIndexResponse struct {
+	Version   string   `json:"version"`
+	Endpoints []string `json:"endpoints"`
+}
+
+// handleRoot handles GET /
+// Any other path not matched by a more specific route ends up here and gets a 404.
+func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		s.writeError(w, http.StatusNotFound, "not_found", "Endpoint not found")
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resp RootResponse
+	for _, version := range apiVersions {
+		info := VersionInfo{
+			Name:       version.name,
+			Path:       version.prefix() + "/",
+			Deprecated: !version.deprecated.IsZero(),
+		}
+		if !version.sunset.IsZero() {
+			sunset := version.sunset
+			info.Sunset = &sunset
+		}
+		resp.Versions = append(resp.Versions, info)
+	}
+
+	s.writeJSON(w, http.StatusOK, resp)
+}
+
+// versionIndexHandler returns the handler for GET /<version>/, listing routes.
+// Unknown paths under the version prefix end up here and get a 404.
+func (s *Server) versionIndexHandler(version apiVersion, routes []route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != version.prefix()+"/" {
+			s.writeError(w, http.StatusNotFound, "not_found", "Endpoint not found")
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		resp := VersionIndexResponse{Version: version.name}
+		for _, rt := range routes {
+			resp.Endpoints = append(resp.Endpoints, version.prefix()+rt.path)
+		}
+
+		s.writeJSON(w, http.StatusOK, resp)
+	}
+}
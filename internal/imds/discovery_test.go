@@ -0,0 +1,200 @@
+package imds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDiscovery(t *testing.T) {
+	tests := []struct {
+		name          string
+		server        *Server
+		path          string
+		wantStatus    int
+		wantEndpoints []string
+		wantMissing   []string
+	}{
+		{
+			name:       "root lists versions",
+			server:     &Server{},
+			path:       "/",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:          "v1 index lists endpoints",
+			server:        &Server{},
+			path:          "/v1/",
+			wantStatus:    http.StatusOK,
+			wantEndpoints: []string{"/v1/token", "/v1/identity", "/v1/kubeconfig"},
+			wantMissing:   []string{"/v1/svid"},
+		},
+		{
+			name:       "unreleased version returns 404",
+			server:     &Server{},
+			path:       "/v2/token",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:          "v1 index includes optional endpoints when enabled",
+			server:        &Server{SVIDSource: &fakeSVIDSource{}},
+			path:          "/v1/",
+			wantStatus:    http.StatusOK,
+			wantEndpoints: []string{"/v1/token", "/v1/svid", "/v1/svid/jwt"},
+		},
+		{
+			name:       "unknown path returns 404",
+			server:     &Server{},
+			path:       "/latest/meta-data",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "unknown v1 path returns 404",
+			server:     &Server{},
+			path:       "/v1/unknown",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			w := httptest.NewRecorder()
+
+			tt.server.newMux().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+
+			if tt.path == "/" {
+				var resp RootResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("failed to parse response: %v", err)
+				}
+				if len(resp.Versions) != 1 || resp.Versions[0].Name != "v1" {
+					t.Errorf("versions = %+v, want v1", resp.Versions)
+				}
+				return
+			}
+
+			var resp VersionIndexResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to parse response: %v", err)
+			}
+			endpoints := make(map[string]bool)
+			for _, e := range resp.Endpoints {
+				endpoints[e] = true
+			}
+			for _, e := range tt.wantEndpoints {
+				if !endpoints[e] {
+					t.Errorf("endpoints missing %q: %v", e, resp.Endpoints)
+				}
+			}
+			for _, e := range tt.wantMissing {
+				if endpoints[e] {
+					t.Errorf("endpoints unexpectedly include %q", e)
+				}
+			}
+		})
+	}
+}
+
+func TestDeprecationMiddleware(t *testing.T) {
+	deprecated := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sunset := time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name            string
+		version         apiVersion
+		wantDeprecation string
+		wantSunset      string
+		wantLink        string
+	}{
+		{
+			name:    "current version has no headers",
+			version: apiVersion{name: "v2"},
+		},
+		{
+			name:            "deprecated version with sunset and successor",
+			version:         apiVersion{name: "v1", deprecated: deprecated, sunset: sunset, successor: "v2"},
+			wantDeprecation: "@1767225600",
+			wantSunset:      "Wed, 01 Jul 2026 00:00:00 GMT",
+			wantLink:        `</v2/>; rel="successor-version"`,
+		},
+		{
+			name:            "deprecated version without sunset",
+			version:         apiVersion{name: "v1", deprecated: deprecated},
+			wantDeprecation: "@1767225600",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := deprecationMiddleware(tt.version, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/v1/token", nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if got := w.Header().Get("Deprecation"); got != tt.wantDeprecation {
+				t.Errorf("Deprecation = %q, want %q", got, tt.wantDeprecation)
+			}
+			if got := w.Header().Get("Sunset"); got != tt.wantSunset {
+				t.Errorf("Sunset = %q, want %q", got, tt.wantSunset)
+			}
+			if got := w.Header().Get("Link"); got != tt.wantLink {
+				t.Errorf("Link = %q, want %q", got, tt.wantLink)
+			}
+		})
+	}
+}
+
+func TestDeprecatedVersion(t *testing.T) {
+	sunset := time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)
+	saved := apiVersions
+	apiVersions = []apiVersion{
+		{name: "v1", deprecated: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), sunset: sunset, successor: "v2"},
+		{name: "v2"},
+	}
+	t.Cleanup(func() { apiVersions = saved })
+	mux := (&Server{}).newMux()
+
+	tests := []struct {
+		path            string
+		wantDeprecation string
+	}{
+		{path: "/v1/", wantDeprecation: "@1767225600"},
+		{path: "/v1/identity", wantDeprecation: "@1767225600"},
+		{path: "/v2/identity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Deprecation"); got != tt.wantDeprecation {
+				t.Errorf("Deprecation = %q, want %q", got, tt.wantDeprecation)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	var resp RootResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if len(resp.Versions) != 2 || !resp.Versions[0].Deprecated || resp.Versions[0].Sunset == nil || !resp.Versions[0].Sunset.Equal(sunset) || resp.Versions[1].Deprecated {
+		t.Errorf("versions = %+v, want v1 deprecated with its sunset, then v2", resp.Versions)
+	}
+}
@@ -0,0 +1,308 @@
+package imds
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ec2IdentityDir holds the EC2-compatible instance identity document and
+// its signatures, at the paths EC2 serves them
+const ec2IdentityDir = "/latest/dynamic/instance-identity/"
+
+const (
+	// DefaultEC2Region is the region reported when none is configured
+	DefaultEC2Region = "kubevirt"
+	// DefaultEC2InstanceType is the instance type reported for VMs without
+	// an instancetype
+	DefaultEC2InstanceType = "custom"
+	// ec2IdentityVersion is the document version EC2 reports
+	ec2IdentityVersion = "2017-09-30"
+)
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+)
+
+// EC2IdentityDocument is the document served at
+// /latest/dynamic/instance-identity/document, shaped like EC2's. The fields
+// without a KubeVirt counterpart are always null.
+type EC2IdentityDocument struct {
+	AccountID               string    `json:"accountId"`
+	Architecture            string    `json:"architecture"`
+	AvailabilityZone        string    `json:"availabilityZone"`
+	BillingProducts         []string  `json:"billingProducts"`
+	DevpayProductCodes      []string  `json:"devpayProductCodes"`
+	MarketplaceProductCodes []string  `json:"marketplaceProductCodes"`
+	ImageID                 string    `json:"imageId"`
+	InstanceID              string    `json:"instanceId"`
+	InstanceType            string    `json:"instanceType"`
+	KernelID                *string   `json:"kernelId"`
+	PendingTime             time.Time `json:"pendingTime"`
+	PrivateIP               string    `json:"privateIp,omitempty"`
+	RamdiskID               *string   `json:"ramdiskId"`
+	Region                  string    `json:"region"`
+	Version                 string    `json:"version"`
+}
+
+// EC2Instance is what the identity document is synthesized from.
+type EC2Instance struct {
+	// UID is the VMI's UID
+	UID string
+	// Created is when the VMI was created
+	Created time.Time
+	// Architecture is the VMI's architecture, e.g. amd64
+	Architecture string
+	// InstanceType is the name of the VM's instancetype (optional)
+	InstanceType string
+	// Image is the VM's boot image or volume (optional)
+	Image string
+	// PrivateIP is the guest's primary IP (optional)
+	PrivateIP string
+}
+
+// EC2Identity serves an EC2-compatible instance identity document for the
+// VM, signed with the key of a certificate that verifiers are configured to
+// trust instead of AWS's.
+type EC2Identity struct {
+	// AccountID is the 12-digit account reported for the VM
+	AccountID string
+	// Region and AvailabilityZone are the location reported for the VM
+	Region           string
+	AvailabilityZone string
+
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+
+	mu       sync.Mutex
+	instance *EC2Instance
+}
+
+// NewEC2Identity creates an EC2Identity for the VMs of namespace that signs
+// with the PEM RSA key pair. The account defaults to one derived from the
+// namespace, the region to DefaultEC2Region.
+func NewEC2Identity(namespace string, certPEM, keyPEM []byte) (*EC2Identity, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EC2 identity key pair: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid EC2 identity key pair: must be RSA, like AWS's")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid EC2 identity certificate: %w", err)
+	}
+
+	sum := sha256.Sum256([]byte(namespace))
+	return &EC2Identity{
+		AccountID:        fmt.Sprintf("%012d", binary.BigEndian.Uint64(sum[:8])%1e12),
+		Region:           DefaultEC2Region,
+		AvailabilityZone: DefaultEC2Region + "a",
+		key:              key,
+		cert:             cert,
+	}, nil
+}
+
+// SetInstance updates the instance the document describes.
+func (e *EC2Identity) SetInstance(instance EC2Instance) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.instance = &instance
+}
+
+// Document returns the identity document, or nil before SetInstance.
+func (e *EC2Identity) Document() *EC2IdentityDocument {
+	e.mu.Lock()
+	instance := e.instance
+	e.mu.Unlock()
+	if instance == nil {
+		return nil
+	}
+
+	doc := &EC2IdentityDocument{
+		AccountID:        e.AccountID,
+		Architecture:     ec2Architecture(instance.Architecture),
+		AvailabilityZone: e.AvailabilityZone,
+		InstanceID:       "i-" + ec2ID(strings.ReplaceAll(instance.UID, "-", "")),
+		InstanceType:     instance.InstanceType,
+		PendingTime:      instance.Created.UTC(),
+		PrivateIP:        instance.PrivateIP,
+		Region:           e.Region,
+		Version:          ec2IdentityVersion,
+	}
+	if doc.InstanceType == "" {
+		doc.InstanceType = DefaultEC2InstanceType
+	}
+	if instance.Image != "" {
+		sum := sha256.Sum256([]byte(instance.Image))
+		doc.ImageID = "ami-" + ec2ID(hex.EncodeToString(sum[:]))
+	}
+	return doc
+}
+
+// ec2ID shortens a hex string to the 17 digits of current EC2 IDs.
+func ec2ID(s string) string {
+	if len(s) > 17 {
+		return s[:17]
+	}
+	return s
+}
+
+// ec2Architecture maps Kubernetes architecture names to EC2's.
+func ec2Architecture(arch string) string {
+	switch arch {
+	case "", "amd64":
+		// KubeVirt defaults to amd64
+		return "x86_64"
+	default:
+		return arch
+	}
+}
+
+// sign signs the document bytes with RSA PKCS #1 v1.5 over SHA-256.
+func (e *EC2Identity) sign(document []byte) ([]byte, error) {
+	digest := sha256.Sum256(document)
+	return rsa.SignPKCS1v15(rand.Reader, e.key, crypto.SHA256, digest[:])
+}
+
+// pkcs7ContentInfo, pkcs7SignedData and pkcs7SignerInfo are the PKCS #7
+// (RFC 2315) structures of a detached signature
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     pkcs7SignedData `asn1:"explicit,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+	// Certificates is the [0] IMPLICIT SET OF Certificate
+	Certificates asn1.RawValue
+	SignerInfos  []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7SignerInfo struct {
+	Version            int
+	IssuerAndSerial    pkcs7IssuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest    []byte
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+// pkcs7 returns a detached PKCS #7 SignedData over the document, carrying
+// the signing certificate and no signed attributes, as EC2's /pkcs7 does.
+func (e *EC2Identity) pkcs7(document []byte) ([]byte, error) {
+	signature, err := e.sign(document)
+	if err != nil {
+		return nil, err
+	}
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	signed := pkcs7ContentInfo{
+		ContentType: oidSignedData,
+		Content: pkcs7SignedData{
+			Version:          1,
+			DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Alg},
+			ContentInfo:      struct{ ContentType asn1.ObjectIdentifier }{oidData},
+			Certificates: asn1.RawValue{
+				Class:      asn1.ClassContextSpecific,
+				Tag:        0,
+				IsCompound: true,
+				Bytes:      e.cert.Raw,
+			},
+			SignerInfos: []pkcs7SignerInfo{{
+				Version: 1,
+				IssuerAndSerial: pkcs7IssuerAndSerial{
+					Issuer: asn1.RawValue{FullBytes: e.cert.RawIssuer},
+					Serial: e.cert.SerialNumber,
+				},
+				DigestAlgorithm:    sha256Alg,
+				SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+				EncryptedDigest:    signature,
+			}},
+		},
+	}
+	return asn1.Marshal(signed)
+}
+
+// wrapBase64 encodes data as base64 in lines of 64 characters, the way EC2
+// serves signatures: PEM without the header and footer.
+func wrapBase64(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var b strings.Builder
+	for len(encoded) > 64 {
+		b.WriteString(encoded[:64])
+		b.WriteByte('\n')
+		encoded = encoded[64:]
+	}
+	b.WriteString(encoded)
+	return []byte(b.String())
+}
+
+// handleEC2Identity handles GET /latest/dynamic/instance-identity/document,
+// and its signatures at /signature (PKCS #1) and /pkcs7.
+func (s *Server) handleEC2Identity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	doc := s.EC2Identity.Document()
+	if doc == nil {
+		s.writeError(w, http.StatusServiceUnavailable, "identity_unavailable", "The VMI has not been read yet")
+		return
+	}
+	// Marshaling this type can't fail
+	document, _ := json.MarshalIndent(doc, "", "  ")
+
+	var body []byte
+	switch strings.TrimPrefix(r.URL.Path, ec2IdentityDir) {
+	case "document":
+		body = document
+	case "signature":
+		signature, err := s.EC2Identity.sign(document)
+		if err != nil {
+			s.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to sign identity document")
+			return
+		}
+		body = wrapBase64(signature)
+	case "pkcs7":
+		signed, err := s.EC2Identity.pkcs7(document)
+		if err != nil {
+			s.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to sign identity document")
+			return
+		}
+		body = wrapBase64(signed)
+	default:
+		s.writeError(w, http.StatusNotFound, "not_found", "Not found")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
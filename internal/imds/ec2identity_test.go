@@ -0,0 +1,234 @@
+package imds
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestEC2Signer returns a self-signed certificate and its key as PEM.
+func createTestEC2Signer(t *testing.T, key crypto.Signer) (certPEM, keyPEM []byte) {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "kubevirt-imds identity"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+func newTestEC2Identity(t *testing.T) *EC2Identity {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM := createTestEC2Signer(t, key)
+	identity, err := NewEC2Identity("default", certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+func TestNewEC2IdentityRejectsECDSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM := createTestEC2Signer(t, key)
+	if _, err := NewEC2Identity("default", certPEM, keyPEM); err == nil {
+		t.Error("expected error for ECDSA key")
+	}
+}
+
+func TestEC2IdentityDocument(t *testing.T) {
+	identity := newTestEC2Identity(t)
+	if doc := identity.Document(); doc != nil {
+		t.Fatalf("Document() before SetInstance = %+v, want nil", doc)
+	}
+
+	created := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		instance EC2Instance
+		check    func(t *testing.T, doc *EC2IdentityDocument)
+	}{
+		{
+			name: "full",
+			instance: EC2Instance{
+				UID:          "6f1c2d3e-4a5b-4c6d-8e7f-0a1b2c3d4e5f",
+				Created:      created,
+				Architecture: "arm64",
+				InstanceType: "u1.medium",
+				Image:        "quay.io/containerdisks/fedora:40",
+				PrivateIP:    "10.0.2.2",
+			},
+			check: func(t *testing.T, doc *EC2IdentityDocument) {
+				if doc.InstanceID != "i-6f1c2d3e4a5b4c6d8" {
+					t.Errorf("InstanceID = %q", doc.InstanceID)
+				}
+				if doc.Architecture != "arm64" || doc.InstanceType != "u1.medium" || doc.PrivateIP != "10.0.2.2" {
+					t.Errorf("unexpected document %+v", doc)
+				}
+				if !strings.HasPrefix(doc.ImageID, "ami-") || len(doc.ImageID) != len("ami-")+17 {
+					t.Errorf("ImageID = %q", doc.ImageID)
+				}
+				if !doc.PendingTime.Equal(created) {
+					t.Errorf("PendingTime = %v, want %v", doc.PendingTime, created)
+				}
+			},
+		},
+		{
+			name:     "defaults",
+			instance: EC2Instance{UID: "6f1c2d3e-4a5b-4c6d-8e7f-0a1b2c3d4e5f", Created: created},
+			check: func(t *testing.T, doc *EC2IdentityDocument) {
+				if doc.Architecture != "x86_64" {
+					t.Errorf("Architecture = %q, want x86_64", doc.Architecture)
+				}
+				if doc.InstanceType != DefaultEC2InstanceType {
+					t.Errorf("InstanceType = %q, want %q", doc.InstanceType, DefaultEC2InstanceType)
+				}
+				if doc.ImageID != "" {
+					t.Errorf("ImageID = %q, want empty", doc.ImageID)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity.SetInstance(tt.instance)
+			doc := identity.Document()
+			if len(doc.AccountID) != 12 {
+				t.Errorf("AccountID = %q, want 12 digits", doc.AccountID)
+			}
+			if doc.Region != DefaultEC2Region || doc.Version != "2017-09-30" {
+				t.Errorf("Region = %q, Version = %q", doc.Region, doc.Version)
+			}
+			tt.check(t, doc)
+		})
+	}
+}
+
+func TestHandleEC2Identity(t *testing.T) {
+	identity := newTestEC2Identity(t)
+	server := NewServer("/tmp/token", "default", "testvm", "default", "")
+	server.EC2Identity = identity
+	handler := server.metadataHeaderMiddleware(server.newMux())
+
+	get := func(path string) *httptest.ResponseRecorder {
+		// EC2 tooling doesn't send the Metadata header
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get("/latest/dynamic/instance-identity/document"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status before the VMI is read = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	identity.SetInstance(EC2Instance{UID: "6f1c2d3e-4a5b-4c6d-8e7f-0a1b2c3d4e5f", Created: time.Now()})
+	w := get("/latest/dynamic/instance-identity/document")
+	if w.Code != http.StatusOK {
+		t.Fatalf("document status = %d, body: %s", w.Code, w.Body.String())
+	}
+	document := w.Body.Bytes()
+	var fields map[string]interface{}
+	if err := json.Unmarshal(document, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"billingProducts", "devpayProductCodes", "marketplaceProductCodes", "kernelId", "ramdiskId"} {
+		if v, ok := fields[key]; !ok || v != nil {
+			t.Errorf("%s = %v, want null", key, v)
+		}
+	}
+	if fields["instanceId"] != "i-6f1c2d3e4a5b4c6d8" {
+		t.Errorf("instanceId = %v", fields["instanceId"])
+	}
+
+	digest := sha256.Sum256(document)
+	publicKey := identity.cert.PublicKey.(*rsa.PublicKey)
+
+	w = get("/latest/dynamic/instance-identity/signature")
+	if w.Code != http.StatusOK {
+		t.Fatalf("signature status = %d", w.Code)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(w.Body.String(), "\n", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("signature doesn't verify: %v", err)
+	}
+
+	w = get("/latest/dynamic/instance-identity/pkcs7")
+	if w.Code != http.StatusOK {
+		t.Fatalf("pkcs7 status = %d", w.Code)
+	}
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if len(line) > 64 {
+			t.Errorf("pkcs7 line of %d characters, want at most 64", len(line))
+		}
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(w.Body.String(), "\n", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var signed pkcs7ContentInfo
+	if rest, err := asn1.Unmarshal(der, &signed); err != nil || len(rest) > 0 {
+		t.Fatalf("invalid PKCS #7: %v", err)
+	}
+	if !signed.ContentType.Equal(oidSignedData) || !signed.Content.ContentInfo.ContentType.Equal(oidData) {
+		t.Errorf("unexpected content types %v, %v", signed.ContentType, signed.Content.ContentInfo.ContentType)
+	}
+	cert, err := x509.ParseCertificate(signed.Content.Certificates.Bytes)
+	if err != nil || !cert.Equal(identity.cert) {
+		t.Errorf("PKCS #7 doesn't carry the signing certificate: %v", err)
+	}
+	if len(signed.Content.SignerInfos) != 1 {
+		t.Fatalf("got %d signers, want 1", len(signed.Content.SignerInfos))
+	}
+	signer := signed.Content.SignerInfos[0]
+	if signer.IssuerAndSerial.Serial.Cmp(cert.SerialNumber) != 0 {
+		t.Errorf("signer serial = %v, want %v", signer.IssuerAndSerial.Serial, cert.SerialNumber)
+	}
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signer.EncryptedDigest); err != nil {
+		t.Errorf("PKCS #7 signature doesn't verify: %v", err)
+	}
+
+	if w := get("/latest/dynamic/instance-identity/rsa2048"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown path status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/v1/identity", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("/v1/identity without Metadata header = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
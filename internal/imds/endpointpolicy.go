@@ -0,0 +1,114 @@
+package imds
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Endpoint groups an EndpointPolicy can restrict
+const (
+	// EndpointGroupToken is the VM's tokens: /token, /tokens, /kubeconfig,
+	// /token/exchange and the /kubernetes proxy, which uses the token
+	EndpointGroupToken = "token"
+	// EndpointGroupCredentials is the other credentials: /svid,
+	// /certificates, /ssh/certificate, /secrets and /attest
+	EndpointGroupCredentials = "credentials"
+	// EndpointGroupMetadata is what describes the VM: /identity, /metadata,
+	// /pod, /node, /user-data, /configs, /tls/ca, the EC2 identity document
+	// and the OIDC documents
+	EndpointGroupMetadata = "metadata"
+)
+
+// EndpointGroups lists the endpoint groups
+var EndpointGroups = []string{EndpointGroupToken, EndpointGroupCredentials, EndpointGroupMetadata}
+
+// endpointGroupPaths maps the unversioned path of each endpoint, and the
+// paths below it, to its group
+var endpointGroupPaths = map[string]string{
+	"/token":           EndpointGroupToken,
+	"/tokens":          EndpointGroupToken,
+	"/kubeconfig":      EndpointGroupToken,
+	"/kubernetes":      EndpointGroupToken,
+	"/svid":            EndpointGroupCredentials,
+	"/certificates":    EndpointGroupCredentials,
+	"/ssh/certificate": EndpointGroupCredentials,
+	"/secrets":         EndpointGroupCredentials,
+	"/attest":          EndpointGroupCredentials,
+	"/identity":        EndpointGroupMetadata,
+	"/metadata":        EndpointGroupMetadata,
+	"/pod":             EndpointGroupMetadata,
+	"/node":            EndpointGroupMetadata,
+	"/user-data":       EndpointGroupMetadata,
+	"/configs":         EndpointGroupMetadata,
+	"/tls/ca":          EndpointGroupMetadata,
+}
+
+// EndpointRule restricts an endpoint group.
+type EndpointRule struct {
+	// Disabled stops serving the group
+	Disabled bool
+	// RequireSource serves the group only to the VM's own IPs, per
+	// SourceAllowlist
+	RequireSource bool
+}
+
+// ValidEndpointGroup reports whether group is one of EndpointGroups.
+func ValidEndpointGroup(group string) bool {
+	for _, g := range EndpointGroups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointGroup returns the group of the endpoint at path, or "" for paths
+// outside all groups, such as the discovery documents and /healthz.
+func endpointGroup(path string) string {
+	if strings.HasPrefix(path, ec2IdentityDir) || path == oidcDiscoveryPath || path == oidcJWKSPath {
+		return EndpointGroupMetadata
+	}
+	// Strip the API version
+	if !strings.HasPrefix(path, "/v") {
+		return ""
+	}
+	i := strings.Index(path[1:], "/")
+	if i < 0 {
+		return ""
+	}
+	path = path[i+1:]
+	for p := path; p != "" && p != "/"; p = p[:strings.LastIndex(p, "/")] {
+		if group, ok := endpointGroupPaths[p]; ok {
+			return group
+		}
+	}
+	return ""
+}
+
+// endpointPolicyMiddleware applies EndpointPolicy before routing, so it
+// covers all API versions.
+func (s *Server) endpointPolicyMiddleware(next http.Handler) http.Handler {
+	if len(s.EndpointPolicy) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group := endpointGroup(r.URL.Path)
+		rule, ok := s.EndpointPolicy[group]
+		switch {
+		case !ok:
+			next.ServeHTTP(w, r)
+		case rule.Disabled:
+			s.writeError(w, http.StatusForbidden, "endpoint_disabled", fmt.Sprintf("The %s endpoints are disabled for this VM", group))
+		case rule.RequireSource && s.SourceAllowlist == nil:
+			// Fail closed rather than serve without the check
+			log.Printf("Rejected %s from %s (policy requires the source allowlist, which is off)", r.URL.Path, r.RemoteAddr)
+			s.writeError(w, http.StatusForbidden, "source_not_allowed", fmt.Sprintf("The %s endpoints are only served to the VM's own addresses", group))
+		case rule.RequireSource:
+			s.requireAllowedSource(next.ServeHTTP)(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package imds
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEndpointGroup(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/v1/token", EndpointGroupToken},
+		{"/v1/token/exchange", EndpointGroupToken},
+		{"/v1/tokens/vault", EndpointGroupToken},
+		{"/v1/kubeconfig", EndpointGroupToken},
+		{"/v1/kubernetes/api/v1/namespaces/default/configmaps", EndpointGroupToken},
+		{"/v1/svid/jwt", EndpointGroupCredentials},
+		{"/v1/ssh/certificate", EndpointGroupCredentials},
+		{"/v1/secrets/db/password", EndpointGroupCredentials},
+		{"/v1/attest/challenge", EndpointGroupCredentials},
+		{"/v1/identity", EndpointGroupMetadata},
+		{"/v1/metadata/zone", EndpointGroupMetadata},
+		{"/v1/pod/labels", EndpointGroupMetadata},
+		{"/v1/configs/app/settings.yaml", EndpointGroupMetadata},
+		{"/v1/tls/ca", EndpointGroupMetadata},
+		{"/latest/dynamic/instance-identity/pkcs7", EndpointGroupMetadata},
+		{"/.well-known/openid-configuration", EndpointGroupMetadata},
+		{"/openid/v1/jwks", EndpointGroupMetadata},
+		{"/", ""},
+		{"/v1/", ""},
+		{"/healthz", ""},
+		{"/v1/ssh", ""},
+		{"/v1/tokenx", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := endpointGroup(tt.path); got != tt.want {
+				t.Errorf("endpointGroup(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEndpointPolicyMiddleware(t *testing.T) {
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenPath, []byte("test-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		policy     map[string]EndpointRule
+		allowlist  bool
+		path       string
+		remoteAddr string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "no policy",
+			path:       "/v1/token",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "group disabled",
+			policy:     map[string]EndpointRule{EndpointGroupToken: {Disabled: true}},
+			path:       "/v1/token",
+			wantStatus: http.StatusForbidden,
+			wantCode:   "endpoint_disabled",
+		},
+		{
+			name:       "other group served",
+			policy:     map[string]EndpointRule{EndpointGroupToken: {Disabled: true}},
+			path:       "/v1/identity",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "discovery not governed",
+			policy:     map[string]EndpointRule{EndpointGroupToken: {Disabled: true}, EndpointGroupMetadata: {Disabled: true}},
+			path:       "/v1/",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "source required without allowlist",
+			policy:     map[string]EndpointRule{EndpointGroupMetadata: {RequireSource: true}},
+			path:       "/v1/identity",
+			wantStatus: http.StatusForbidden,
+			wantCode:   "source_not_allowed",
+		},
+		{
+			name:       "source required from VM",
+			policy:     map[string]EndpointRule{EndpointGroupMetadata: {RequireSource: true}},
+			allowlist:  true,
+			path:       "/v1/identity",
+			remoteAddr: "10.0.2.2:40000",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "source required from elsewhere",
+			policy:     map[string]EndpointRule{EndpointGroupMetadata: {RequireSource: true}},
+			allowlist:  true,
+			path:       "/v1/identity",
+			remoteAddr: "10.244.1.7:40000",
+			wantStatus: http.StatusForbidden,
+			wantCode:   "source_not_allowed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(tokenPath, "default", "testvm", "default", "")
+			server.EndpointPolicy = tt.policy
+			if tt.allowlist {
+				server.SourceAllowlist = NewSourceAllowlist()
+				server.SourceAllowlist.Set([]net.IP{net.ParseIP("10.0.2.2")})
+			}
+			handler := server.endpointPolicyMiddleware(server.newMux())
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d, body: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantCode != "" {
+				var resp ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Error != tt.wantCode {
+					t.Errorf("error = %q, want %q", resp.Error, tt.wantCode)
+				}
+			}
+		})
+	}
+}
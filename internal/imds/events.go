@@ -0,0 +1,30 @@
+package imds
+
+import "fmt"
+
+// Reasons of the Events recorded for suspicious guest activity
+const (
+	// EventMissingMetadataHeader is a request for a token endpoint without
+	// the Metadata header, typical of SSRF
+	EventMissingMetadataHeader = "MissingMetadataHeader"
+	// EventSourceRejected is a request from an address that isn't the VM's
+	EventSourceRejected = "SourceRejected"
+	// EventTokenBound is a request for a token bound to another source
+	EventTokenBound = "TokenBound"
+	// EventRateLimited is a request over the rate limit
+	EventRateLimited = "RateLimited"
+)
+
+// EventRecorder reports suspicious guest activity outside the sidecar, such
+// as Kubernetes Events on the VMI. Warning must not block.
+type EventRecorder interface {
+	Warning(reason, message string)
+}
+
+// recordEvent reports suspicious activity to Events, if set.
+func (s *Server) recordEvent(reason, format string, args ...interface{}) {
+	if s.Events == nil {
+		return
+	}
+	s.Events.Warning(reason, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,109 @@
+package imds
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeEventRecorder collects the reasons of recorded Events.
+type fakeEventRecorder struct {
+	mu      sync.Mutex
+	reasons []string
+}
+
+func (f *fakeEventRecorder) Warning(reason, message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reasons = append(f.reasons, reason)
+}
+
+func TestServerEvents(t *testing.T) {
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenPath, []byte("test-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	type request struct {
+		path       string
+		remoteAddr string
+		noHeader   bool
+	}
+	tests := []struct {
+		name      string
+		configure func(*Server)
+		requests  []request
+		want      []string
+	}{
+		{
+			name:     "token without Metadata header",
+			requests: []request{{path: "/v1/token", noHeader: true}},
+			want:     []string{EventMissingMetadataHeader},
+		},
+		{
+			name:     "metadata without Metadata header",
+			requests: []request{{path: "/v1/identity", noHeader: true}},
+		},
+		{
+			name:     "allowed requests",
+			requests: []request{{path: "/v1/token"}, {path: "/v1/identity"}},
+		},
+		{
+			name: "rejected source",
+			configure: func(s *Server) {
+				s.SourceAllowlist = NewSourceAllowlist()
+				s.SourceAllowlist.Set([]net.IP{net.ParseIP("10.0.2.2")})
+			},
+			requests: []request{{path: "/v1/token", remoteAddr: "10.244.1.7:40000"}},
+			want:     []string{EventSourceRejected},
+		},
+		{
+			name:      "token bound to another source",
+			configure: func(s *Server) { s.TokenBinding = NewTokenBinding(nil) },
+			requests: []request{
+				{path: "/v1/token", remoteAddr: "10.0.2.2:40000"},
+				{path: "/v1/token", remoteAddr: "10.0.2.9:40000"},
+			},
+			want: []string{EventTokenBound},
+		},
+		{
+			name:      "rate limited",
+			configure: func(s *Server) { s.SetRateLimit(1, 1) },
+			requests:  []request{{path: "/v1/identity"}, {path: "/v1/identity"}},
+			want:      []string{EventRateLimited},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(tokenPath, "default", "testvm", "default", "")
+			events := &fakeEventRecorder{}
+			server.Events = events
+			if tt.configure != nil {
+				tt.configure(server)
+			}
+			handler := server.metadataHeaderMiddleware(server.rateLimitMiddleware(server.newMux()))
+
+			for _, r := range tt.requests {
+				req := httptest.NewRequest(http.MethodGet, r.path, nil)
+				if !r.noHeader {
+					req.Header.Set("Metadata", "true")
+				}
+				if r.remoteAddr != "" {
+					req.RemoteAddr = r.remoteAddr
+				}
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			if !reflect.DeepEqual(events.reasons, tt.want) {
+				t.Errorf("Events = %v, want %v", events.reasons, tt.want)
+			}
+		})
+	}
+}
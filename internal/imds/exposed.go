@@ -0,0 +1,145 @@
+package imds
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// exposedObject is the data of a Secret or ConfigMap read for the guest.
+type exposedObject struct {
+	resourceVersion string
+	data            map[string]string
+	binaryData      map[string][]byte
+}
+
+// exposedKind describes the objects of one kind the VM may read keys of,
+// such as the exposed Secrets.
+type exposedKind struct {
+	// kind names the object in messages, e.g. "Secret"
+	kind string
+	// code prefixes error codes, e.g. "secret" for secret_not_exposed
+	code string
+	// route is the route the object names follow, e.g. "/secrets/"
+	route   string
+	exposed map[string][]string
+	read    func(ctx context.Context, name string) (exposedObject, error)
+	// keys builds the response listing an object's exposed keys
+	keys func(keys []string) any
+	// sensitive objects are never cached and every access is logged. The
+	// others carry their resourceVersion as ETag for If-None-Match polling.
+	sensitive bool
+}
+
+// keyExposed reports whether key of the object name is in exposed. An
+// object exposed without a key list exposes all its keys.
+func keyExposed(exposed map[string][]string, name, key string) bool {
+	keys, ok := exposed[name]
+	if !ok {
+		return false
+	}
+	if len(keys) == 0 {
+		return true
+	}
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// exposedNames returns the names of the exposed objects, sorted.
+func exposedNames(exposed map[string][]string) []string {
+	names := make([]string, 0, len(exposed))
+	for name := range exposed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// serveExposed serves GET <route><name>, listing the exposed keys, and
+// GET <route><name>/<key>, returning the raw value. It reports false if the
+// path has no name, leaving the request to the caller.
+func (s *Server) serveExposed(w http.ResponseWriter, r *http.Request, kind exposedKind) bool {
+	path := routeSuffix(r, kind.route)
+	name, key, hasKey := strings.Cut(path, "/")
+	if name == "" {
+		return false
+	}
+	if _, ok := kind.exposed[name]; !ok || (hasKey && !keyExposed(kind.exposed, name, key)) {
+		if kind.sensitive {
+			log.Printf("Rejected %s %s key %q for %s (not exposed)", kind.kind, name, key, s.requestSource(r))
+		}
+		s.writeError(w, http.StatusForbidden, kind.code+"_not_exposed", fmt.Sprintf("%s %q is not exposed to this VM", kind.kind, path))
+		return true
+	}
+
+	obj, err := kind.read(r.Context(), name)
+	if err != nil {
+		log.Printf("Failed to read %s %s: %v", kind.kind, name, err)
+		switch {
+		case apierrors.IsNotFound(err):
+			s.writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("%s %q not found", kind.kind, name))
+		case apierrors.IsForbidden(err):
+			s.writeError(w, http.StatusForbidden, kind.code+"_forbidden", fmt.Sprintf("The VM's ServiceAccount may not read %s %q", kind.kind, name))
+		default:
+			s.writeError(w, http.StatusBadGateway, kind.code+"_unavailable", "Failed to read "+kind.kind)
+		}
+		return true
+	}
+
+	if kind.sensitive {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		etag := `"` + obj.resourceVersion + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		if obj.resourceVersion != "" && r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	if !hasKey {
+		keys := []string{}
+		for k := range obj.data {
+			if keyExposed(kind.exposed, name, k) {
+				keys = append(keys, k)
+			}
+		}
+		for k := range obj.binaryData {
+			if keyExposed(kind.exposed, name, k) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		s.writeJSON(w, http.StatusOK, kind.keys(keys))
+		return true
+	}
+
+	if value, ok := obj.data[key]; ok {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(value))
+		return true
+	}
+	value, ok := obj.binaryData[key]
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("%s %q has no key %q", kind.kind, name, key))
+		return true
+	}
+	if kind.sensitive {
+		log.Printf("Served %s %s key %s to %s", kind.kind, name, key, s.requestSource(r))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write(value)
+	return true
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"time"
 )
@@ -22,6 +23,29 @@ type IdentityResponse struct {
 	Namespace          string `json:"namespace"`
 	ServiceAccountName string `json:"serviceAccountName"`
 	VMName             string `json:"vmName"`
+	PodName            string `json:"podName,omitempty"`
+	PodUID             string `json:"podUID,omitempty"`
+	NodeName           string `json:"nodeName,omitempty"`
+}
+
+// ExecCredential is the response for GET /v1/token?format=execcredential.
+// It matches client.authentication.k8s.io/v1 so kubectl can use IMDS as an
+// exec credential plugin.
+type ExecCredential struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Status     ExecCredentialStatus `json:"status"`
+}
+
+// ExecCredentialStatus holds the credential returned to the exec plugin caller.
+type ExecCredentialStatus struct {
+	Token               string     `json:"token"`
+	ExpirationTimestamp *time.Time `json:"expirationTimestamp,omitempty"`
+}
+
+// TokensResponse is the response for GET /v1/tokens
+type TokensResponse struct {
+	Tokens []string `json:"tokens"`
 }
 
 // ErrorResponse is the response for errors
@@ -40,34 +64,151 @@ func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
-// handleToken handles GET /v1/token
+// handleToken handles GET /v1/token[?format=json|raw|execcredential]
 func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	// Read token from file
-	tokenBytes, err := os.ReadFile(s.TokenPath)
+	format := r.URL.Query().Get("format")
+	if !validTokenFormat(format) {
+		s.writeError(w, http.StatusBadRequest, "invalid_format", fmt.Sprintf("Unsupported token format %q", format))
+		return
+	}
+
+	// Custom audiences are served from projected tokens, or minted on demand
+	// but only from the allowlist
+	if audience := r.URL.Query().Get("audience"); audience != "" {
+		s.handleAudienceToken(w, r, audience)
+		return
+	}
+
+	s.handleTokenSource(w, r, format, s.tokenSource())
+}
+
+// handleTokenSource serves a token from source.
+func (s *Server) handleTokenSource(w http.ResponseWriter, r *http.Request, format string, source TokenSource) {
+	token, exp, err := source.Token(r.Context())
 	if err != nil {
-		log.Printf("Failed to read token from %s: %v", s.TokenPath, err)
+		log.Printf("Failed to get token from %v: %v", source, err)
 		s.writeError(w, http.StatusInternalServerError, "token_unavailable", "Failed to read ServiceAccount token")
 		return
 	}
+	if !s.bindToken(w, r, token, exp) {
+		return
+	}
+
+	s.writeToken(w, format, TokenResponse{Token: token, ExpirationTimestamp: exp})
+}
+
+// handleAudienceToken handles GET /v1/token?audience=<aud>
+func (s *Server) handleAudienceToken(w http.ResponseWriter, r *http.Request, audience string) {
+	if path, ok := s.AudienceTokenPaths[audience]; ok {
+		s.handleTokenSource(w, r, r.URL.Query().Get("format"), NewFileTokenSource(path))
+		return
+	}
+	if s.TokenMinter == nil {
+		s.writeError(w, http.StatusBadRequest, "audience_unsupported", "Custom token audiences are not enabled for this VM")
+		return
+	}
+	if !s.audienceAllowed(audience) {
+		log.Printf("Rejected token request for audience %q (not in allowlist)", audience)
+		s.writeError(w, http.StatusForbidden, "audience_not_allowed", fmt.Sprintf("Audience %q is not in the allowed audiences list", audience))
+		return
+	}
 
-	token := strings.TrimSpace(string(tokenBytes))
-	resp := TokenResponse{
-		Token: token,
+	token, exp, err := s.TokenMinter.MintToken(r.Context(), audience)
+	if err != nil {
+		log.Printf("Failed to mint token: %v", err)
+		s.writeError(w, http.StatusBadGateway, "token_unavailable", "Failed to mint ServiceAccount token")
+		return
 	}
+	if !s.bindToken(w, r, token, exp) {
+		return
+	}
+	log.Printf("Minted token for audience %q for %s", audience, s.requestSource(r))
 
-	// Parse JWT to extract expiration time
-	if exp, err := parseJWTExpiration(token); err == nil {
-		resp.ExpirationTimestamp = exp
+	s.writeToken(w, r.URL.Query().Get("format"), TokenResponse{Token: token, ExpirationTimestamp: exp})
+}
+
+// handleTokens handles GET /v1/tokens, listing the named tokens.
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
+	resp := TokensResponse{Tokens: make([]string, 0, len(s.TokenNames))}
+	for name := range s.TokenNames {
+		resp.Tokens = append(resp.Tokens, name)
+	}
+	sort.Strings(resp.Tokens)
 	s.writeJSON(w, http.StatusOK, resp)
 }
 
+// handleNamedToken handles GET /v1/tokens/<name>[?format=json|raw|execcredential]
+func (s *Server) handleNamedToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := routeSuffix(r, "/tokens/")
+	if name == "" {
+		s.handleTokens(w, r)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if !validTokenFormat(format) {
+		s.writeError(w, http.StatusBadRequest, "invalid_format", fmt.Sprintf("Unsupported token format %q", format))
+		return
+	}
+	path, ok := s.AudienceTokenPaths[s.TokenNames[name]]
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Token %q not found", name))
+		return
+	}
+	s.handleTokenSource(w, r, format, NewFileTokenSource(path))
+}
+
+// validTokenFormat reports whether the ?format= value is supported.
+// An empty format selects the default JSON response.
+func validTokenFormat(format string) bool {
+	switch format {
+	case "", "json", "raw", "execcredential":
+		return true
+	default:
+		return false
+	}
+}
+
+// writeToken writes a token response in the requested format.
+// "raw" returns just the JWT as text/plain so shell scripts don't need jq.
+// "execcredential" wraps the token in an ExecCredential for kubectl.
+func (s *Server) writeToken(w http.ResponseWriter, format string, resp TokenResponse) {
+	switch format {
+	case "execcredential":
+		cred := ExecCredential{
+			APIVersion: "client.authentication.k8s.io/v1",
+			Kind:       "ExecCredential",
+			Status:     ExecCredentialStatus{Token: resp.Token},
+		}
+		if !resp.ExpirationTimestamp.IsZero() {
+			exp := resp.ExpirationTimestamp.UTC()
+			cred.Status.ExpirationTimestamp = &exp
+		}
+		s.writeJSON(w, http.StatusOK, cred)
+	case "raw":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(resp.Token))
+	default:
+		s.writeJSON(w, http.StatusOK, resp)
+	}
+}
+
 // handleIdentity handles GET /v1/identity
 func (s *Server) handleIdentity(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -79,11 +220,23 @@ func (s *Server) handleIdentity(w http.ResponseWriter, r *http.Request) {
 		Namespace:          s.Namespace,
 		ServiceAccountName: s.ServiceAccountName,
 		VMName:             s.VMName,
+		PodName:            s.PodName,
+		PodUID:             s.PodUID,
+		NodeName:           s.NodeName,
 	}
 
 	s.writeJSON(w, http.StatusOK, resp)
 }
 
+// readTokenFile reads a token from a kubelet-projected file.
+func readTokenFile(path string) (string, error) {
+	tokenBytes, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(tokenBytes)), nil
+}
+
 // writeJSON writes a JSON response
 func (s *Server) writeJSON(w http.ResponseWriter, status int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -102,27 +255,40 @@ func (s *Server) writeError(w http.ResponseWriter, status int, errCode, message
 	s.writeJSON(w, status, resp)
 }
 
-// parseJWTExpiration extracts the expiration time from a JWT token.
+// jwtClaims are the timestamps read from a JWT payload
+type jwtClaims struct {
+	Exp int64 `json:"exp"`
+	Iat int64 `json:"iat"`
+}
+
+// parseJWTClaims decodes the payload of a JWT token.
 // JWTs have three base64-encoded parts separated by dots: header.payload.signature
-// The payload contains the "exp" claim as a Unix timestamp.
-func parseJWTExpiration(token string) (time.Time, error) {
+func parseJWTClaims(token string) (jwtClaims, error) {
+	var claims jwtClaims
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
-		return time.Time{}, fmt.Errorf("invalid JWT format")
+		return claims, fmt.Errorf("invalid JWT format")
 	}
 
 	// Decode the payload (second part)
 	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to decode JWT payload: %w", err)
+		return claims, fmt.Errorf("failed to decode JWT payload: %w", err)
 	}
 
 	// Parse the JSON payload
-	var claims struct {
-		Exp int64 `json:"exp"`
-	}
 	if err := json.Unmarshal(payload, &claims); err != nil {
-		return time.Time{}, fmt.Errorf("failed to parse JWT claims: %w", err)
+		return claims, fmt.Errorf("failed to parse JWT claims: %w", err)
+	}
+	return claims, nil
+}
+
+// parseJWTExpiration extracts the expiration time from a JWT token.
+// The payload contains the "exp" claim as a Unix timestamp.
+func parseJWTExpiration(token string) (time.Time, error) {
+	claims, err := parseJWTClaims(token)
+	if err != nil {
+		return time.Time{}, err
 	}
 
 	if claims.Exp == 0 {
@@ -7,10 +7,9 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
-
-	"golang.org/x/time/rate"
 )
 
 func TestParseJWTExpiration(t *testing.T) {
@@ -277,6 +276,106 @@ func TestHandleToken(t *testing.T) {
 	}
 }
 
+func TestHandleTokenFormat(t *testing.T) {
+	token := createTestJWT(t, map[string]interface{}{"exp": 1700000000})
+
+	tests := []struct {
+		name            string
+		query           string
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			name:            "default format is JSON",
+			query:           "",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+		},
+		{
+			name:            "explicit JSON format",
+			query:           "?format=json",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+		},
+		{
+			name:            "raw format returns bare token",
+			query:           "?format=raw",
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        token,
+		},
+		{
+			name:            "execcredential format",
+			query:           "?format=execcredential",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+		},
+		{
+			name:            "unknown format is rejected",
+			query:           "?format=xml",
+			wantStatus:      http.StatusBadRequest,
+			wantContentType: "application/json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenPath := filepath.Join(t.TempDir(), "token")
+			if err := os.WriteFile(tokenPath, []byte(token+"\n"), 0644); err != nil {
+				t.Fatalf("failed to write token file: %v", err)
+			}
+			server := &Server{TokenPath: tokenPath}
+
+			req := httptest.NewRequest(http.MethodGet, "/v1/token"+tt.query, nil)
+			w := httptest.NewRecorder()
+
+			server.handleToken(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("handleToken() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHandleTokenExecCredential(t *testing.T) {
+	token := createTestJWT(t, map[string]interface{}{"exp": 1700000000})
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte(token), 0644); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+	server := &Server{TokenPath: tokenPath}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/token?format=execcredential", nil)
+	w := httptest.NewRecorder()
+
+	server.handleToken(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("handleToken() status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var cred ExecCredential
+	if err := json.Unmarshal(w.Body.Bytes(), &cred); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if cred.APIVersion != "client.authentication.k8s.io/v1" || cred.Kind != "ExecCredential" {
+		t.Errorf("got apiVersion %q kind %q, want client.authentication.k8s.io/v1 ExecCredential", cred.APIVersion, cred.Kind)
+	}
+	if cred.Status.Token != token {
+		t.Errorf("status.token = %q, want %q", cred.Status.Token, token)
+	}
+	if cred.Status.ExpirationTimestamp == nil || !cred.Status.ExpirationTimestamp.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("status.expirationTimestamp = %v, want %v", cred.Status.ExpirationTimestamp, time.Unix(1700000000, 0))
+	}
+}
+
 func TestHandleIdentity(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -292,6 +391,9 @@ func TestHandleIdentity(t *testing.T) {
 				Namespace:          "test-namespace",
 				ServiceAccountName: "test-sa",
 				VMName:             "test-vm",
+				PodName:            "virt-launcher-test-vm-abcde",
+				PodUID:             "0f1e2d3c",
+				NodeName:           "node-1",
 			},
 			wantStatus: http.StatusOK,
 			checkBody: func(t *testing.T, body string) {
@@ -309,6 +411,9 @@ func TestHandleIdentity(t *testing.T) {
 				if resp.VMName != "test-vm" {
 					t.Errorf("vmName = %q, want %q", resp.VMName, "test-vm")
 				}
+				if resp.PodName != "virt-launcher-test-vm-abcde" || resp.PodUID != "0f1e2d3c" || resp.NodeName != "node-1" {
+					t.Errorf("pod = %q/%q on %q, want virt-launcher-test-vm-abcde/0f1e2d3c on node-1", resp.PodName, resp.PodUID, resp.NodeName)
+				}
 			},
 		},
 		{
@@ -330,6 +435,9 @@ func TestHandleIdentity(t *testing.T) {
 				if resp.ServiceAccountName != "" {
 					t.Errorf("serviceAccountName = %q, want empty", resp.ServiceAccountName)
 				}
+				if strings.Contains(body, "nodeName") {
+					t.Errorf("body = %s, want nodeName omitted", body)
+				}
 			},
 		},
 		{
@@ -471,8 +579,8 @@ func TestRateLimitMiddleware(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			server := NewServer("/tmp/token", "ns", "vm", "sa", ":0")
-			// Override limiter with test values (low burst for testing)
-			server.limiter = rate.NewLimiter(rate.Limit(tt.burstSize), tt.burstSize)
+			// Low burst for testing
+			server.SetRateLimit(float64(tt.burstSize), tt.burstSize)
 
 			handler := server.rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusOK)
@@ -516,3 +624,28 @@ func createTestJWT(t *testing.T, claims map[string]interface{}) string {
 
 	return header + "." + encodedPayload + "." + signature
 }
+
+func TestRouteSuffix(t *testing.T) {
+	tests := []struct {
+		path  string
+		route string
+		want  string
+	}{
+		{path: "/v1/tokens/vault", route: "/tokens/", want: "vault"},
+		{path: "/v1/tokens/", route: "/tokens/", want: ""},
+		{path: "/v1/tokens/a/tokens/b", route: "/tokens/", want: "a/tokens/b"},
+		{path: "/v1/secrets/db/tokens/key", route: "/tokens/", want: ""},
+		{path: "/v1/pod/labels", route: "/pod/labels/", want: ""},
+		{path: "/v1/pod/labels/app", route: "/pod/labels/", want: "app"},
+		{path: "/v1/kubernetes/api/v1/pods", route: "/kubernetes", want: "/api/v1/pods"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if got := routeSuffix(r, tt.route); got != tt.want {
+				t.Errorf("routeSuffix(%q, %q) = %q, want %q", tt.path, tt.route, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package imds
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// healthCheckTimeout bounds a liveness request to the IMDS listener
+const healthCheckTimeout = 2 * time.Second
+
+// HealthServer serves /healthz and /readyz for kubelet probes, and /metrics
+// for Prometheus, on a TCP address in the pod network. The guest-facing
+// listener isn't reachable by the kubelet, and the admin API exposes more
+// than probes need.
+type HealthServer struct {
+	addr string
+
+	// Liveness reports whether IMDS still answers (optional, nil is always live)
+	Liveness func() error
+	// Readiness reports whether guests can reach IMDS (optional, nil is always ready)
+	Readiness func() error
+	// Metrics serves /metrics for Prometheus (optional)
+	Metrics http.Handler
+}
+
+// NewHealthServer creates a health server listening on addr.
+func NewHealthServer(addr string) *HealthServer {
+	return &HealthServer{addr: addr}
+}
+
+// Handler returns the health check router.
+func (h *HealthServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", checkHandler(h.Liveness))
+	mux.HandleFunc("/readyz", checkHandler(h.Readiness))
+	if h.Metrics != nil {
+		mux.Handle("/metrics", h.Metrics)
+	}
+	return mux
+}
+
+// Run serves the health checks until the context is canceled.
+func (h *HealthServer) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", h.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", h.addr, err)
+	}
+
+	srv := &http.Server{
+		Handler:     h.Handler(),
+		ReadTimeout: 5 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("Starting health checks on %s", h.addr)
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+		close(errCh)
+	}()
+
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	case err := <-errCh:
+		return fmt.Errorf("health server error: %w", err)
+	}
+}
+
+// checkHandler answers GET with 200 if check passes, 503 otherwise.
+func checkHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if check != nil {
+			if err := check(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	}
+}
+
+// CheckListener returns a liveness check that requests /healthz from the
+// guest-facing listener, so a wedged HTTP server fails it. An address
+// without a host is checked on the loopback address.
+func CheckListener(addr string) func() error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return func() error { return fmt.Errorf("invalid listen address %q: %w", addr, err) }
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	url := "http://" + net.JoinHostPort(host, port) + "/healthz"
+	client := &http.Client{Timeout: healthCheckTimeout}
+
+	return func() error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return fmt.Errorf("IMDS listener not answering: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("IMDS listener returned %s", resp.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,97 @@
+package imds
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthServerHandler(t *testing.T) {
+	failing := func() error { return fmt.Errorf("broken") }
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		liveness   func() error
+		readiness  func() error
+		metrics    http.Handler
+		wantStatus int
+	}{
+		{name: "healthz without check", method: http.MethodGet, path: "/healthz", wantStatus: http.StatusOK},
+		{name: "healthz fails", method: http.MethodGet, path: "/healthz", liveness: failing, wantStatus: http.StatusServiceUnavailable},
+		{name: "readyz fails", method: http.MethodGet, path: "/readyz", readiness: failing, wantStatus: http.StatusServiceUnavailable},
+		{name: "readyz ignores liveness", method: http.MethodGet, path: "/readyz", liveness: failing, wantStatus: http.StatusOK},
+		{name: "post", method: http.MethodPost, path: "/healthz", wantStatus: http.StatusMethodNotAllowed},
+		{name: "no admin endpoints", method: http.MethodGet, path: "/config", wantStatus: http.StatusNotFound},
+		{name: "metrics served", method: http.MethodGet, path: "/metrics", metrics: NewTokenRefresher(staticTokenSource{}, time.Minute), wantStatus: http.StatusOK},
+		{name: "no metrics", method: http.MethodGet, path: "/metrics", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health := NewHealthServer("")
+			health.Liveness = tt.liveness
+			health.Readiness = tt.readiness
+			health.Metrics = tt.metrics
+
+			w := httptest.NewRecorder()
+			health.Handler().ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCheckListener(t *testing.T) {
+	ts := httptest.NewServer(NewServer("", "ns", "vm", "sa", "").newMux())
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+	if err := CheckListener(addr)(); err != nil {
+		t.Errorf("CheckListener(%s) = %v, want nil", addr, err)
+	}
+
+	_, port, _ := net.SplitHostPort(addr)
+	if err := CheckListener(":" + port)(); err != nil {
+		t.Errorf("CheckListener(:%s) = %v, want nil", port, err)
+	}
+
+	// A listener that accepts but never answers is wedged
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	start := time.Now()
+	if err := CheckListener(l.Addr().String())(); err == nil {
+		t.Error("CheckListener() on a hung listener = nil, want error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*healthCheckTimeout {
+		t.Errorf("CheckListener() took %v, want at most %v", elapsed, healthCheckTimeout)
+	}
+
+	if err := CheckListener("no-port")(); err == nil {
+		t.Error("CheckListener(no-port) = nil, want error")
+	}
+}
+
+func TestHealthServerRun(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	health := NewHealthServer("127.0.0.1:0")
+	done := make(chan error, 1)
+	go func() { done <- health.Run(ctx) }()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() = %v, want nil after cancel", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after cancel")
+	}
+}
@@ -0,0 +1,146 @@
+package imds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultKeylimeAPIVersion is the Keylime verifier REST API version used
+	DefaultKeylimeAPIVersion = "v2.1"
+	// DefaultKeylimeCacheTTL is how long an agent's state is reused before
+	// the verifier is asked again
+	DefaultKeylimeCacheTTL = 10 * time.Second
+	// keylimeTimeout bounds a request to the verifier
+	keylimeTimeout = 5 * time.Second
+	// maxKeylimeBytes bounds the verifier's response
+	maxKeylimeBytes = 1 << 20
+	// keylimeStateGetQuote is the operational state of an agent whose quotes
+	// the verifier is polling and accepting
+	keylimeStateGetQuote = 3
+)
+
+// keylimeAgentResponse is the Keylime verifier's response for
+// GET /<version>/agents/<id>
+type keylimeAgentResponse struct {
+	Results struct {
+		OperationalState int `json:"operational_state"`
+		// LastSuccessfulAttestation is a Unix time, reported by newer verifiers
+		LastSuccessfulAttestation int64 `json:"last_successful_attestation"`
+	} `json:"results"`
+}
+
+// KeylimeVerifier is an AttestationVerifier that asks a Keylime verifier for
+// the state of the agent running in the guest. The VM is attested while the
+// verifier keeps accepting the agent's quotes.
+type KeylimeVerifier struct {
+	// URL is the verifier's base URL, e.g. https://keylime-verifier:8881
+	URL string
+	// AgentID is the UUID of the guest's Keylime agent
+	AgentID string
+	// APIVersion is the verifier REST API version
+	APIVersion string
+	// MaxAge, if set, also requires the verifier's last successful
+	// attestation to be this recent
+	MaxAge time.Duration
+	// CacheTTL is how long a state is reused
+	CacheTTL time.Duration
+
+	client    *http.Client
+	now       func() time.Time
+	mu        sync.Mutex
+	checkedAt time.Time
+	attested  bool
+}
+
+// NewKeylimeVerifier creates a KeylimeVerifier for the agent agentID at the
+// verifier at url. client, which must present the verifier's client
+// certificate, may be nil for http.DefaultClient.
+func NewKeylimeVerifier(url, agentID string, client *http.Client) *KeylimeVerifier {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &KeylimeVerifier{
+		URL:        strings.TrimSuffix(url, "/"),
+		AgentID:    agentID,
+		APIVersion: DefaultKeylimeAPIVersion,
+		CacheTTL:   DefaultKeylimeCacheTTL,
+		client:     client,
+		now:        time.Now,
+	}
+}
+
+// Attested reports whether the verifier currently accepts the agent's
+// quotes. Errors reaching the verifier are returned rather than cached.
+func (k *KeylimeVerifier) Attested(ctx context.Context) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := k.now()
+	if !k.checkedAt.IsZero() && now.Sub(k.checkedAt) < k.CacheTTL {
+		return k.attested, nil
+	}
+
+	attested, err := k.agentAttested(ctx, now)
+	if err != nil {
+		return false, err
+	}
+	if attested != k.attested || k.checkedAt.IsZero() {
+		log.Printf("Keylime agent %s attested: %t", k.AgentID, attested)
+	}
+	k.attested = attested
+	k.checkedAt = now
+	return attested, nil
+}
+
+// agentAttested asks the verifier for the agent's state.
+func (k *KeylimeVerifier) agentAttested(ctx context.Context, now time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, keylimeTimeout)
+	defer cancel()
+	agentURL := fmt.Sprintf("%s/%s/agents/%s", k.URL, k.APIVersion, url.PathEscape(k.AgentID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, agentURL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("keylime verifier request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxKeylimeBytes))
+	if err != nil {
+		return false, fmt.Errorf("failed to read keylime verifier response: %w", err)
+	}
+
+	// An agent the verifier doesn't know isn't attested
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("keylime verifier returned %s for agent %s", resp.Status, k.AgentID)
+	}
+	var agent keylimeAgentResponse
+	if err := json.Unmarshal(body, &agent); err != nil {
+		return false, fmt.Errorf("invalid keylime verifier response: %w", err)
+	}
+
+	if agent.Results.OperationalState != keylimeStateGetQuote {
+		return false, nil
+	}
+	if k.MaxAge > 0 && agent.Results.LastSuccessfulAttestation > 0 {
+		last := time.Unix(agent.Results.LastSuccessfulAttestation, 0)
+		if now.Sub(last) > k.MaxAge {
+			return false, nil
+		}
+	}
+	return true, nil
+}
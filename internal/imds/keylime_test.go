@@ -0,0 +1,145 @@
+package imds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeylimeVerifier(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name         string
+		status       int
+		body         string
+		maxAge       time.Duration
+		wantAttested bool
+		wantErr      bool
+	}{
+		{name: "getting quotes", status: http.StatusOK, body: `{"code": 200, "results": {"operational_state": 3}}`, wantAttested: true},
+		{name: "invalid quote", status: http.StatusOK, body: `{"code": 200, "results": {"operational_state": 9}}`},
+		{name: "failed", status: http.StatusOK, body: `{"code": 200, "results": {"operational_state": 7}}`},
+		{name: "recent attestation", status: http.StatusOK, body: fmt.Sprintf(`{"results": {"operational_state": 3, "last_successful_attestation": %d}}`, now.Add(-time.Minute).Unix()), maxAge: 5 * time.Minute, wantAttested: true},
+		{name: "stale attestation", status: http.StatusOK, body: fmt.Sprintf(`{"results": {"operational_state": 3, "last_successful_attestation": %d}}`, now.Add(-time.Hour).Unix()), maxAge: 5 * time.Minute},
+		{name: "unknown agent", status: http.StatusNotFound, body: `{"code": 404, "status": "agent id not found"}`},
+		{name: "verifier error", status: http.StatusInternalServerError, body: `{}`, wantErr: true},
+		{name: "invalid response", status: http.StatusOK, body: `not json`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPath string
+			verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.URL.Path
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer verifier.Close()
+
+			k := NewKeylimeVerifier(verifier.URL+"/", "d432fbb3-d2f1-4a97-9ef7-75bd81c00000", nil)
+			k.MaxAge = tt.maxAge
+			k.now = func() time.Time { return now }
+
+			attested, err := k.Attested(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Attested() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if attested != tt.wantAttested {
+				t.Errorf("Attested() = %t, want %t", attested, tt.wantAttested)
+			}
+			if want := "/v2.1/agents/d432fbb3-d2f1-4a97-9ef7-75bd81c00000"; gotPath != want {
+				t.Errorf("request path = %q, want %q", gotPath, want)
+			}
+		})
+	}
+}
+
+func TestKeylimeVerifierCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	state, requests := 3, 0
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, `{"results": {"operational_state": %d}}`, state)
+	}))
+	defer verifier.Close()
+
+	k := NewKeylimeVerifier(verifier.URL, "agent", nil)
+	k.now = func() time.Time { return now }
+
+	if attested, _ := k.Attested(context.Background()); !attested {
+		t.Fatal("Attested() = false, want true")
+	}
+	state = 9
+	if attested, _ := k.Attested(context.Background()); !attested || requests != 1 {
+		t.Errorf("Attested() within CacheTTL = %t after %d requests, want cached true", attested, requests)
+	}
+	now = now.Add(DefaultKeylimeCacheTTL)
+	if attested, _ := k.Attested(context.Background()); attested || requests != 2 {
+		t.Errorf("Attested() after CacheTTL = %t after %d requests, want false", attested, requests)
+	}
+}
+
+func TestKeylimeGatesCredentials(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("test-token"), 0644); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{name: "attested", status: http.StatusOK, body: `{"results": {"operational_state": 3}}`, wantStatus: http.StatusOK},
+		{name: "not attested", status: http.StatusOK, body: `{"results": {"operational_state": 9}}`, wantStatus: http.StatusForbidden, wantError: "attestation_required"},
+		{name: "verifier down", status: http.StatusBadGateway, wantStatus: http.StatusServiceUnavailable, wantError: "attestation_unavailable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer verifier.Close()
+
+			server := NewServer(tokenPath, "test-ns", "test-vm", "test-sa", "")
+			server.AttestationVerifier = NewKeylimeVerifier(verifier.URL, "agent", nil)
+			server.SVIDSource = &fakeSVIDSource{x509: &X509SVIDResponse{SPIFFEID: "spiffe://example.org/ns/test-ns/sa/test-sa"}}
+			mux := server.newMux()
+
+			for _, path := range []string{"/v1/token", "/v1/svid"} {
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+				if w.Code != tt.wantStatus {
+					t.Errorf("%s status = %d, want %d: %s", path, w.Code, tt.wantStatus, w.Body.String())
+				}
+				if tt.wantError != "" {
+					var resp ErrorResponse
+					if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+						t.Fatalf("failed to decode error: %v", err)
+					}
+					if resp.Error != tt.wantError {
+						t.Errorf("%s error = %q, want %q", path, resp.Error, tt.wantError)
+					}
+				}
+			}
+
+			// The in-process challenge endpoints aren't served
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/attest/challenge", nil))
+			if w.Code != http.StatusNotFound {
+				t.Errorf("challenge status = %d, want 404", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package imds
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Kubeconfig is a minimal clientcmd v1 Config document.
+type Kubeconfig struct {
+	APIVersion     string              `json:"apiVersion"`
+	Kind           string              `json:"kind"`
+	Clusters       []KubeconfigCluster `json:"clusters"`
+	Users          []KubeconfigUser    `json:"users"`
+	Contexts       []KubeconfigContext `json:"contexts"`
+	CurrentContext string              `json:"current-context"`
+}
+
+// KubeconfigCluster is a named cluster entry.
+type KubeconfigCluster struct {
+	Name    string `json:"name"`
+	Cluster struct {
+		Server                   string `json:"server"`
+		CertificateAuthorityData []byte `json:"certificate-authority-data,omitempty"`
+	} `json:"cluster"`
+}
+
+// KubeconfigUser is a named user entry.
+type KubeconfigUser struct {
+	Name string `json:"name"`
+	User struct {
+		Token string `json:"token,omitempty"`
+	} `json:"user"`
+}
+
+// KubeconfigContext is a named context entry.
+type KubeconfigContext struct {
+	Name    string `json:"name"`
+	Context struct {
+		Cluster   string `json:"cluster"`
+		User      string `json:"user"`
+		Namespace string `json:"namespace,omitempty"`
+	} `json:"context"`
+}
+
+// handleKubeconfig handles GET /v1/kubeconfig
+func (s *Server) handleKubeconfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.APIServerURL == "" {
+		s.writeError(w, http.StatusServiceUnavailable, "kubeconfig_unavailable", "Kubernetes API server address is not configured")
+		return
+	}
+
+	caData, err := os.ReadFile(s.CAPath)
+	if err != nil {
+		log.Printf("Failed to read CA bundle from %s: %v", s.CAPath, err)
+		s.writeError(w, http.StatusInternalServerError, "ca_unavailable", "Failed to read cluster CA bundle")
+		return
+	}
+
+	source := s.tokenSource()
+	token, exp, err := source.Token(r.Context())
+	if err != nil {
+		log.Printf("Failed to get token from %v: %v", source, err)
+		s.writeError(w, http.StatusInternalServerError, "token_unavailable", "Failed to read ServiceAccount token")
+		return
+	}
+	if !s.bindToken(w, r, token, exp) {
+		return
+	}
+
+	body, err := yaml.Marshal(s.buildKubeconfig(caData, token))
+	if err != nil {
+		log.Printf("Failed to encode kubeconfig: %v", err)
+		s.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to encode kubeconfig")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// buildKubeconfig assembles a kubeconfig for the VM's ServiceAccount.
+func (s *Server) buildKubeconfig(caData []byte, token string) Kubeconfig {
+	name := s.VMName
+	if name == "" {
+		name = "imds"
+	}
+
+	var cluster KubeconfigCluster
+	cluster.Name = "kubernetes"
+	cluster.Cluster.Server = s.APIServerURL
+	cluster.Cluster.CertificateAuthorityData = caData
+
+	var user KubeconfigUser
+	user.Name = fmt.Sprintf("system:serviceaccount:%s:%s", s.Namespace, s.ServiceAccountName)
+	user.User.Token = token
+
+	var context KubeconfigContext
+	context.Name = name
+	context.Context.Cluster = cluster.Name
+	context.Context.User = user.Name
+	context.Context.Namespace = s.Namespace
+
+	return Kubeconfig{
+		APIVersion:     "v1",
+		Kind:           "Config",
+		Clusters:       []KubeconfigCluster{cluster},
+		Users:          []KubeconfigUser{user},
+		Contexts:       []KubeconfigContext{context},
+		CurrentContext: context.Name,
+	}
+}
@@ -0,0 +1,134 @@
+package imds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestHandleKubeconfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		apiServerURL string
+		caExists     bool
+		tokenExists  bool
+		wantStatus   int
+		wantError    string
+	}{
+		{
+			name:         "GET request returns kubeconfig",
+			method:       http.MethodGet,
+			apiServerURL: "https://10.96.0.1:443",
+			caExists:     true,
+			tokenExists:  true,
+			wantStatus:   http.StatusOK,
+		},
+		{
+			name:        "missing API server URL returns 503",
+			method:      http.MethodGet,
+			caExists:    true,
+			tokenExists: true,
+			wantStatus:  http.StatusServiceUnavailable,
+			wantError:   "kubeconfig_unavailable",
+		},
+		{
+			name:         "missing CA returns 500",
+			method:       http.MethodGet,
+			apiServerURL: "https://10.96.0.1:443",
+			tokenExists:  true,
+			wantStatus:   http.StatusInternalServerError,
+			wantError:    "ca_unavailable",
+		},
+		{
+			name:         "missing token returns 500",
+			method:       http.MethodGet,
+			apiServerURL: "https://10.96.0.1:443",
+			caExists:     true,
+			wantStatus:   http.StatusInternalServerError,
+			wantError:    "token_unavailable",
+		},
+		{
+			name:       "POST request returns method not allowed",
+			method:     http.MethodPost,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			tokenPath := filepath.Join(tmpDir, "token")
+			caPath := filepath.Join(tmpDir, "ca.crt")
+
+			if tt.tokenExists {
+				if err := os.WriteFile(tokenPath, []byte("test-token\n"), 0644); err != nil {
+					t.Fatalf("failed to write token file: %v", err)
+				}
+			}
+			if tt.caExists {
+				if err := os.WriteFile(caPath, []byte("test-ca"), 0644); err != nil {
+					t.Fatalf("failed to write CA file: %v", err)
+				}
+			}
+
+			server := &Server{
+				TokenPath:          tokenPath,
+				CAPath:             caPath,
+				APIServerURL:       tt.apiServerURL,
+				Namespace:          "test-ns",
+				ServiceAccountName: "test-sa",
+				VMName:             "test-vm",
+			}
+
+			req := httptest.NewRequest(tt.method, "/v1/kubeconfig", nil)
+			w := httptest.NewRecorder()
+
+			server.handleKubeconfig(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("handleKubeconfig() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			if tt.wantError != "" {
+				var resp ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("failed to parse error response: %v", err)
+				}
+				if resp.Error != tt.wantError {
+					t.Errorf("error = %q, want %q", resp.Error, tt.wantError)
+				}
+				return
+			}
+
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var kubeconfig Kubeconfig
+			if err := yaml.Unmarshal(w.Body.Bytes(), &kubeconfig); err != nil {
+				t.Fatalf("failed to parse kubeconfig: %v", err)
+			}
+			if len(kubeconfig.Clusters) != 1 || kubeconfig.Clusters[0].Cluster.Server != tt.apiServerURL {
+				t.Errorf("clusters = %+v, want server %q", kubeconfig.Clusters, tt.apiServerURL)
+			}
+			if string(kubeconfig.Clusters[0].Cluster.CertificateAuthorityData) != "test-ca" {
+				t.Errorf("certificate-authority-data = %q, want %q", kubeconfig.Clusters[0].Cluster.CertificateAuthorityData, "test-ca")
+			}
+			if len(kubeconfig.Users) != 1 || kubeconfig.Users[0].User.Token != "test-token" {
+				t.Errorf("users = %+v, want token %q", kubeconfig.Users, "test-token")
+			}
+			if kubeconfig.CurrentContext != "test-vm" {
+				t.Errorf("current-context = %q, want %q", kubeconfig.CurrentContext, "test-vm")
+			}
+			if kubeconfig.Contexts[0].Context.Namespace != "test-ns" {
+				t.Errorf("context namespace = %q, want %q", kubeconfig.Contexts[0].Context.Namespace, "test-ns")
+			}
+		})
+	}
+}
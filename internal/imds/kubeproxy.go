@@ -0,0 +1,162 @@
+package imds
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// kubernetesProxyPath is where the API server paths are served, relative to
+// the API version
+const kubernetesProxyPath = "/kubernetes"
+
+// kubernetesProxyTimeout bounds a proxied request, long enough for the
+// API server to end a watch first
+const kubernetesProxyTimeout = time.Hour
+
+// connectSubresources are the subresources that open a stream into pods or
+// services rather than read an object, and are never proxied
+var connectSubresources = map[string]bool{
+	"exec":        true,
+	"attach":      true,
+	"portforward": true,
+	"proxy":       true,
+}
+
+// KubernetesProxy forwards read-only requests for an allowlist of API server
+// paths, authenticated as the VM's ServiceAccount, so that the guest can
+// read and watch resources without holding the token.
+type KubernetesProxy struct {
+	allowed []string
+	proxy   *httputil.ReverseProxy
+}
+
+// NewKubernetesProxy creates a KubernetesProxy for the API server at
+// apiServerURL. transport authenticates the requests. Each allowed path, like
+// /api/v1/namespaces/default/configmaps, allows itself and the paths below it.
+func NewKubernetesProxy(apiServerURL string, transport http.RoundTripper, allowed []string) (*KubernetesProxy, error) {
+	target, err := url.Parse(apiServerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API server URL: %w", err)
+	}
+	for _, p := range allowed {
+		if !ValidKubernetesProxyPath(p) {
+			return nil, fmt.Errorf("invalid Kubernetes API path %q: must be a clean path below /api/ or /apis/", p)
+		}
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			// Only forward what selects the response format. The guest's
+			// credentials, impersonation headers and the like never reach
+			// the API server.
+			header := http.Header{}
+			if accept := pr.In.Header.Get("Accept"); accept != "" {
+				header.Set("Accept", accept)
+			}
+			pr.Out.Header = header
+		},
+		Transport: transport,
+		// Stream watch events as they arrive
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Failed to proxy %s: %v", r.URL.Path, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w).Encode(ErrorResponse{Error: "api_unavailable", Message: "Failed to reach the API server"})
+		},
+	}
+	return &KubernetesProxy{allowed: allowed, proxy: proxy}, nil
+}
+
+// ValidKubernetesProxyPath reports whether p can be allowlisted: a clean
+// absolute path below /api/ or /apis/.
+func ValidKubernetesProxyPath(p string) bool {
+	return path.Clean(p) == p && (strings.HasPrefix(p, "/api/") || strings.HasPrefix(p, "/apis/"))
+}
+
+// Allowed reports whether the API server path p may be proxied: it is
+// allowlisted and reads an object rather than connecting to it, or it is a
+// discovery document, which every client needs.
+func (k *KubernetesProxy) Allowed(p string) bool {
+	if path.Clean(p) != p {
+		return false
+	}
+	segments := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	switch {
+	case p == "/version" || p == "/api" || p == "/apis":
+		return true
+	case segments[0] == "api" && len(segments) == 2,
+		segments[0] == "apis" && len(segments) <= 3:
+		return true
+	}
+	if connectSubresources[subresource(segments)] {
+		return false
+	}
+	for _, allowed := range k.allowed {
+		if p == allowed || strings.HasPrefix(p, allowed+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// subresource returns the subresource in the segments of an API path, e.g.
+// "exec" for /api/v1/namespaces/default/pods/web/exec.
+func subresource(segments []string) string {
+	switch {
+	case segments[0] == "api" && len(segments) >= 2:
+		segments = segments[2:]
+	case segments[0] == "apis" && len(segments) >= 3:
+		segments = segments[3:]
+	default:
+		return ""
+	}
+	if len(segments) > 2 && segments[0] == "namespaces" {
+		segments = segments[2:]
+	}
+	if len(segments) < 3 {
+		return ""
+	}
+	return segments[2]
+}
+
+// handleKubernetesProxy handles GET /v1/kubernetes/<path>, forwarding it to
+// the API server's <path>.
+func (s *Server) handleKubernetesProxy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Upgrades could reach past the API server into pods
+	if r.Header.Get("Upgrade") != "" {
+		s.writeError(w, http.StatusBadRequest, "invalid_request", "Connection upgrades are not proxied")
+		return
+	}
+
+	p := routeSuffix(r, kubernetesProxyPath)
+	if !s.KubernetesProxy.Allowed(p) {
+		log.Printf("Refused to proxy %s: not an allowed API path", p)
+		s.writeError(w, http.StatusForbidden, "path_not_allowed", "The API path is not allowed for this VM")
+		return
+	}
+
+	// Watches outlive the server's timeouts. Recorders in tests don't
+	// support deadlines, which is fine.
+	deadline := time.Now().Add(kubernetesProxyTimeout)
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(deadline)
+	_ = rc.SetWriteDeadline(deadline)
+
+	out := r.Clone(r.Context())
+	out.URL.Path = p
+	out.URL.RawPath = ""
+	s.KubernetesProxy.proxy.ServeHTTP(w, out)
+}
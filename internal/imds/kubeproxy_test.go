@@ -0,0 +1,214 @@
+package imds
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// roundTripperFunc is an http.RoundTripper from a function
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// bearerTransport attaches token like the sidecar's client-go transport.
+func bearerTransport(token string) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		r = r.Clone(r.Context())
+		r.Header.Set("Authorization", "Bearer "+token)
+		return http.DefaultTransport.RoundTrip(r)
+	})
+}
+
+func TestNewKubernetesProxyInvalidPath(t *testing.T) {
+	for _, p := range []string{"/api", "/version", "api/v1/pods", "/api/v1/namespaces/default/", "/api/v1/../apis", "/healthz"} {
+		if _, err := NewKubernetesProxy("https://10.96.0.1", http.DefaultTransport, []string{p}); err == nil {
+			t.Errorf("NewKubernetesProxy(%q) error = nil, want error", p)
+		}
+	}
+}
+
+func TestKubernetesProxyAllowed(t *testing.T) {
+	proxy, err := NewKubernetesProxy("https://10.96.0.1", http.DefaultTransport, []string{
+		"/api/v1/namespaces/default/configmaps",
+		"/api/v1/namespaces/default/pods",
+		"/apis/apps/v1/namespaces/default/deployments",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/api/v1/namespaces/default/configmaps", true},
+		{"/api/v1/namespaces/default/configmaps/app", true},
+		{"/apis/apps/v1/namespaces/default/deployments/web/status", true},
+		{"/api/v1/namespaces/default/pods/web/log", true},
+		{"/version", true},
+		{"/api", true},
+		{"/api/v1", true},
+		{"/apis", true},
+		{"/apis/apps", true},
+		{"/apis/apps/v1", true},
+		{"/api/v1/namespaces/default/configmapsx", false},
+		{"/api/v1/namespaces/default/secrets/db", false},
+		{"/api/v1/namespaces/other/configmaps", false},
+		{"/api/v1/configmaps", false},
+		{"/api/v1/namespaces/default/pods/web/exec", false},
+		{"/api/v1/namespaces/default/pods/web/attach", false},
+		{"/api/v1/namespaces/default/pods/web/portforward", false},
+		{"/api/v1/namespaces/default/pods/web/proxy", false},
+		{"/api/v1/namespaces/default/configmaps/../secrets", false},
+		{"/", false},
+		{"/healthz", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := proxy.Allowed(tt.path); got != tt.want {
+				t.Errorf("Allowed(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleKubernetesProxy(t *testing.T) {
+	type apiRequest struct {
+		path, query, auth, impersonate, accept string
+	}
+	requests := make(chan apiRequest, 1)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- apiRequest{
+			path:        r.URL.Path,
+			query:       r.URL.RawQuery,
+			auth:        r.Header.Get("Authorization"),
+			impersonate: r.Header.Get("Impersonate-User"),
+			accept:      r.Header.Get("Accept"),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"kind":"ConfigMapList","items":[]}`))
+	}))
+	defer apiServer.Close()
+
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenPath, []byte("test-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := NewKubernetesProxy(apiServer.URL, bearerTransport("sa-token"), []string{"/api/v1/namespaces/default/configmaps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(tokenPath, "default", "testvm", "default", "")
+	server.KubernetesProxy = proxy
+	handler := server.metadataHeaderMiddleware(server.newMux())
+
+	do := func(method, target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header = header
+		req.Header.Set("Metadata", "true")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodGet, "/v1/kubernetes/api/v1/namespaces/default/configmaps?watch=true&labelSelector=app%3Dweb", http.Header{
+		"Authorization":    {"Bearer guest-token"},
+		"Impersonate-User": {"system:admin"},
+		"Accept":           {"application/json"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", w.Code, w.Body.String())
+	}
+	got := <-requests
+	want := apiRequest{
+		path:   "/api/v1/namespaces/default/configmaps",
+		query:  "labelSelector=app%3Dweb&watch=true",
+		auth:   "Bearer sa-token",
+		accept: "application/json",
+	}
+	if got != want {
+		t.Errorf("API server got %+v, want %+v", got, want)
+	}
+	if body, _ := io.ReadAll(w.Body); string(body) != `{"kind":"ConfigMapList","items":[]}` {
+		t.Errorf("body = %s", body)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		header   http.Header
+		wantCode int
+		wantErr  string
+	}{
+		{name: "not allowed", method: http.MethodGet, target: "/v1/kubernetes/api/v1/namespaces/default/secrets", wantCode: http.StatusForbidden, wantErr: "path_not_allowed"},
+		{name: "exec", method: http.MethodGet, target: "/v1/kubernetes/api/v1/namespaces/default/configmaps/app/exec", wantCode: http.StatusForbidden, wantErr: "path_not_allowed"},
+		{name: "upgrade", method: http.MethodGet, target: "/v1/kubernetes/api/v1/namespaces/default/configmaps", header: http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}, wantCode: http.StatusBadRequest, wantErr: "invalid_request"},
+		{name: "write", method: http.MethodPost, target: "/v1/kubernetes/api/v1/namespaces/default/configmaps", wantCode: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.header
+			if header == nil {
+				header = http.Header{}
+			}
+			w := do(tt.method, tt.target, header)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d, body: %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantErr != "" {
+				var resp ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.Error != tt.wantErr {
+					t.Errorf("error = %q, want %q", resp.Error, tt.wantErr)
+				}
+			}
+		})
+	}
+	select {
+	case r := <-requests:
+		t.Errorf("refused request reached the API server: %+v", r)
+	default:
+	}
+
+	server.SetTokensEnabled(false)
+	if w := do(http.MethodGet, "/v1/kubernetes/api/v1/namespaces/default/configmaps", http.Header{}); w.Code != http.StatusForbidden {
+		t.Errorf("status with tokens disabled = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestHandleKubernetesProxyUnavailable(t *testing.T) {
+	apiServer := httptest.NewServer(http.NotFoundHandler())
+	apiServer.Close()
+	proxy, err := NewKubernetesProxy(apiServer.URL, http.DefaultTransport, []string{"/api/v1/namespaces/default/configmaps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer("/tmp/token", "default", "testvm", "default", "")
+	server.KubernetesProxy = proxy
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/kubernetes/api/v1/namespaces/default/configmaps", nil)
+	w := httptest.NewRecorder()
+	server.newMux().ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error != "api_unavailable" {
+		t.Errorf("error = %q, want api_unavailable", resp.Error)
+	}
+}
@@ -0,0 +1,83 @@
+package imds
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenFDsStart is the first file descriptor passed by a supervisor using
+// the systemd socket activation protocol (sd_listen_fds).
+const listenFDsStart = 3
+
+// listen returns a listener for addr. A listener passed in by a supervisor
+// is preferred; otherwise a new socket is bound, with SO_REUSEPORT if
+// ReusePort is set so a new server can bind while the old one still runs.
+func (s *Server) listen(ctx context.Context, addr string, inherited map[string]net.Listener) (net.Listener, error) {
+	if l, ok := inherited[addr]; ok {
+		delete(inherited, addr)
+		return l, nil
+	}
+
+	var lc net.ListenConfig
+	if s.ReusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		}
+	}
+	return lc.Listen(ctx, "tcp", addr)
+}
+
+// inheritedListeners returns the TCP listeners passed in via LISTEN_FDS, keyed
+// by their local address. The variables are only honored if LISTEN_PID names
+// this process, as in the systemd protocol, and are unset afterwards so child
+// processes don't pick them up.
+func inheritedListeners() (map[string]net.Listener, error) {
+	n, err := listenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid())
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make(map[string]net.Listener, n)
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		unix.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited file descriptor %d is not a listener: %w", fd, err)
+		}
+		listeners[l.Addr().String()] = l
+	}
+	return listeners, nil
+}
+
+// listenFDs returns how many file descriptors were passed to the process
+// with the given pid, or zero if none were passed to it.
+func listenFDs(listenPID, listenFDs string, pid int) (int, error) {
+	if listenPID == "" || listenFDs == "" {
+		return 0, nil
+	}
+	if p, err := strconv.Atoi(listenPID); err != nil || p != pid {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(listenFDs)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid LISTEN_FDS %q", listenFDs)
+	}
+	return n, nil
+}
@@ -0,0 +1,86 @@
+package imds
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestListenFDs(t *testing.T) {
+	tests := []struct {
+		name      string
+		listenPID string
+		listenFDs string
+		want      int
+		wantErr   bool
+	}{
+		{name: "not set", want: 0},
+		{name: "passed to this process", listenPID: "100", listenFDs: "2", want: 2},
+		{name: "passed to another process", listenPID: "200", listenFDs: "2", want: 0},
+		{name: "invalid pid", listenPID: "self", listenFDs: "2", want: 0},
+		{name: "invalid count", listenPID: "100", listenFDs: "two", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := listenFDs(tt.listenPID, tt.listenFDs, 100)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("listenFDs() expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("listenFDs() unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("listenFDs() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListenReusePort(t *testing.T) {
+	ctx := context.Background()
+	s := &Server{ReusePort: true}
+
+	first, err := s.listen(ctx, "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("listen() unexpected error: %v", err)
+	}
+	defer first.Close()
+
+	// A replacement server binds the same port while the first still listens
+	second, err := s.listen(ctx, first.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf("second listen() with ReusePort unexpected error: %v", err)
+	}
+	second.Close()
+
+	if l, err := (&Server{}).listen(ctx, first.Addr().String(), nil); err == nil {
+		l.Close()
+		t.Error("listen() without ReusePort on a bound port expected error, got nil")
+	}
+}
+
+func TestListenPrefersInherited(t *testing.T) {
+	inheritedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inheritedListener.Close()
+
+	addr := inheritedListener.Addr().String()
+	inherited := map[string]net.Listener{addr: inheritedListener}
+
+	l, err := (&Server{}).listen(context.Background(), addr, inherited)
+	if err != nil {
+		t.Fatalf("listen() unexpected error: %v", err)
+	}
+	if l != inheritedListener {
+		t.Error("listen() bound a new socket instead of using the inherited listener")
+	}
+	if len(inherited) != 0 {
+		t.Error("listen() left the used listener in the inherited set")
+	}
+}
@@ -0,0 +1,46 @@
+package imds
+
+import (
+	"net/http"
+)
+
+// handleMetadata handles GET /v1/metadata
+// Returns all custom metadata keys and values as a JSON object.
+func (s *Server) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	metadata := s.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+
+	s.writeJSON(w, http.StatusOK, metadata)
+}
+
+// handleMetadataKey handles GET /v1/metadata/<key>
+// Returns the raw value as text/plain so scripts can use it without a JSON parser.
+func (s *Server) handleMetadataKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := routeSuffix(r, "/metadata/")
+	if key == "" {
+		s.handleMetadata(w, r)
+		return
+	}
+
+	value, ok := s.Metadata[key]
+	if !ok {
+		s.writeError(w, http.StatusNotFound, "not_found", "Metadata key not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(value))
+}
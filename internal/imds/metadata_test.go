@@ -0,0 +1,95 @@
+package imds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleMetadata(t *testing.T) {
+	server := &Server{
+		Metadata: map[string]string{
+			"environment": "prod",
+			"team":        "payments",
+		},
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantBody   string
+		wantJSON   map[string]string
+	}{
+		{
+			name:       "list returns all keys",
+			path:       "/v1/metadata",
+			wantStatus: http.StatusOK,
+			wantJSON:   map[string]string{"environment": "prod", "team": "payments"},
+		},
+		{
+			name:       "trailing slash returns all keys",
+			path:       "/v1/metadata/",
+			wantStatus: http.StatusOK,
+			wantJSON:   map[string]string{"environment": "prod", "team": "payments"},
+		},
+		{
+			name:       "key returns raw value",
+			path:       "/v1/metadata/environment",
+			wantStatus: http.StatusOK,
+			wantBody:   "prod",
+		},
+		{
+			name:       "unknown key returns 404",
+			path:       "/v1/metadata/missing",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			w := httptest.NewRecorder()
+
+			server.newMux().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+			if tt.wantJSON != nil {
+				var got map[string]string
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+					t.Fatalf("failed to parse response: %v", err)
+				}
+				if len(got) != len(tt.wantJSON) {
+					t.Errorf("metadata = %v, want %v", got, tt.wantJSON)
+				}
+				for k, v := range tt.wantJSON {
+					if got[k] != v {
+						t.Errorf("metadata[%q] = %q, want %q", k, got[k], v)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestHandleMetadataEmpty(t *testing.T) {
+	server := &Server{}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/metadata", nil)
+	w := httptest.NewRecorder()
+
+	server.handleMetadata(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Body.String(); got != "{}\n" {
+		t.Errorf("body = %q, want empty object", got)
+	}
+}
@@ -0,0 +1,119 @@
+package imds
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// nodeCacheTTL is how long the Node is reused before it is fetched again
+const nodeCacheTTL = time.Minute
+
+// NodeAddress is an address of the node
+type NodeAddress struct {
+	Type    string `json:"type"`
+	Address string `json:"address"`
+}
+
+// NodeResponse is the response for GET /v1/node
+type NodeResponse struct {
+	Name                    string            `json:"name"`
+	ProviderID              string            `json:"providerID,omitempty"`
+	KubeletVersion          string            `json:"kubeletVersion"`
+	ContainerRuntimeVersion string            `json:"containerRuntimeVersion"`
+	OperatingSystem         string            `json:"operatingSystem"`
+	Architecture            string            `json:"architecture"`
+	OSImage                 string            `json:"osImage"`
+	KernelVersion           string            `json:"kernelVersion"`
+	Addresses               []NodeAddress     `json:"addresses"`
+	Allocatable             map[string]string `json:"allocatable"`
+}
+
+// NodeReader reads the Node the VM runs on.
+type NodeReader interface {
+	ReadNode(ctx context.Context) (*corev1.Node, error)
+}
+
+// kubeNodeReader reads the Node with the VM's ServiceAccount, which needs
+// "get" on nodes. The Node is cached for nodeCacheTTL.
+type kubeNodeReader struct {
+	client kubernetes.Interface
+	name   string
+
+	mu        sync.Mutex
+	node      *corev1.Node
+	fetchedAt time.Time
+}
+
+// NewNodeReader creates a NodeReader for the Node name.
+func NewNodeReader(client kubernetes.Interface, name string) NodeReader {
+	return &kubeNodeReader{client: client, name: name}
+}
+
+// ReadNode returns the Node, from the cache if it is recent.
+func (k *kubeNodeReader) ReadNode(ctx context.Context) (*corev1.Node, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.node != nil && time.Since(k.fetchedAt) < nodeCacheTTL {
+		return k.node, nil
+	}
+
+	node, err := k.client.CoreV1().Nodes().Get(ctx, k.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Node %s: %w", k.name, err)
+	}
+	k.node = node
+	k.fetchedAt = time.Now()
+	return node, nil
+}
+
+// handleNode handles GET /v1/node
+func (s *Server) handleNode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	node, err := s.NodeReader.ReadNode(r.Context())
+	if err != nil {
+		log.Printf("Failed to read node: %v", err)
+		switch {
+		case apierrors.IsNotFound(err):
+			s.writeError(w, http.StatusNotFound, "not_found", "Node not found")
+		case apierrors.IsForbidden(err):
+			s.writeError(w, http.StatusForbidden, "node_forbidden", "The VM's ServiceAccount may not read its Node")
+		default:
+			s.writeError(w, http.StatusBadGateway, "node_unavailable", "Failed to read Node")
+		}
+		return
+	}
+
+	info := node.Status.NodeInfo
+	resp := NodeResponse{
+		Name:                    node.Name,
+		ProviderID:              node.Spec.ProviderID,
+		KubeletVersion:          info.KubeletVersion,
+		ContainerRuntimeVersion: info.ContainerRuntimeVersion,
+		OperatingSystem:         info.OperatingSystem,
+		Architecture:            info.Architecture,
+		OSImage:                 info.OSImage,
+		KernelVersion:           info.KernelVersion,
+		Addresses:               make([]NodeAddress, 0, len(node.Status.Addresses)),
+		Allocatable:             make(map[string]string, len(node.Status.Allocatable)),
+	}
+	for _, addr := range node.Status.Addresses {
+		resp.Addresses = append(resp.Addresses, NodeAddress{Type: string(addr.Type), Address: addr.Address})
+	}
+	for name, quantity := range node.Status.Allocatable {
+		resp.Allocatable[string(name)] = quantity.String()
+	}
+	s.writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,116 @@
+package imds
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestHandleNode(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "worker-1"},
+		Spec:       corev1.NodeSpec{ProviderID: "aws:///us-east-1a/i-0123456789abcdef0"},
+		Status: corev1.NodeStatus{
+			NodeInfo: corev1.NodeSystemInfo{
+				KubeletVersion:          "v1.31.2",
+				ContainerRuntimeVersion: "containerd://1.7.22",
+				OperatingSystem:         "linux",
+				Architecture:            "amd64",
+				OSImage:                 "Ubuntu 24.04.1 LTS",
+				KernelVersion:           "6.8.0-47-generic",
+			},
+			Addresses: []corev1.NodeAddress{
+				{Type: corev1.NodeInternalIP, Address: "10.0.0.11"},
+				{Type: corev1.NodeHostName, Address: "worker-1"},
+			},
+			Allocatable: corev1.ResourceList{
+				corev1.ResourceCPU:        resource.MustParse("7800m"),
+				corev1.ResourceMemory:     resource.MustParse("30Gi"),
+				"devices.kubevirt.io/kvm": resource.MustParse("1k"),
+			},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		objects    []runtime.Object
+		forbidden  bool
+		wantStatus int
+		wantError  string
+	}{
+		{name: "node", objects: []runtime.Object{node}, wantStatus: http.StatusOK},
+		{name: "missing node", wantStatus: http.StatusNotFound, wantError: "not_found"},
+		{name: "RBAC denies", forbidden: true, wantStatus: http.StatusForbidden, wantError: "node_forbidden"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset(tt.objects...)
+			if tt.forbidden {
+				client.PrependReactor("get", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "nodes"}, "worker-1", nil)
+				})
+			}
+			server := NewServer("/nonexistent", "test-ns", "test-vm", "test-sa", "")
+			server.NodeReader = NewNodeReader(client, "worker-1")
+
+			w := httptest.NewRecorder()
+			server.newMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/node", nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantError != "" {
+				var resp ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error != tt.wantError {
+					t.Errorf("error = %q, want %q", resp.Error, tt.wantError)
+				}
+				return
+			}
+
+			var resp NodeResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			want := NodeResponse{
+				Name:                    "worker-1",
+				ProviderID:              "aws:///us-east-1a/i-0123456789abcdef0",
+				KubeletVersion:          "v1.31.2",
+				ContainerRuntimeVersion: "containerd://1.7.22",
+				OperatingSystem:         "linux",
+				Architecture:            "amd64",
+				OSImage:                 "Ubuntu 24.04.1 LTS",
+				KernelVersion:           "6.8.0-47-generic",
+				Addresses:               []NodeAddress{{Type: "InternalIP", Address: "10.0.0.11"}, {Type: "Hostname", Address: "worker-1"}},
+				Allocatable:             map[string]string{"cpu": "7800m", "memory": "30Gi", "devices.kubevirt.io/kvm": "1k"},
+			}
+			if !reflect.DeepEqual(resp, want) {
+				t.Errorf("response = %+v, want %+v", resp, want)
+			}
+		})
+	}
+}
+
+func TestNodeReaderCache(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker-1"}})
+	reader := NewNodeReader(client, "worker-1")
+	for i := 0; i < 3; i++ {
+		if _, err := reader.ReadNode(context.Background()); err != nil {
+			t.Fatalf("ReadNode() error = %v", err)
+		}
+	}
+	if gets := len(client.Actions()); gets != 1 {
+		t.Errorf("API calls = %d, want 1", gets)
+	}
+}
@@ -0,0 +1,145 @@
+package imds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/rest"
+)
+
+// The ServiceAccount issuer's OIDC discovery document and JWKS, served at
+// the same paths as the API server's so the IMDS address can stand in for
+// it as the discovery base URL
+const (
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+	oidcJWKSPath      = "/openid/v1/jwks"
+)
+
+// oidcCacheTTL is how long the documents are reused before they are fetched
+// again. Kubernetes publishes new signing keys ahead of using them, so
+// relying parties see them before tokens signed with them.
+const oidcCacheTTL = 5 * time.Minute
+
+// OIDCSource reads the documents of the ServiceAccount issuer.
+type OIDCSource interface {
+	// ReadOIDC returns the document at oidcDiscoveryPath or oidcJWKSPath
+	ReadOIDC(ctx context.Context, path string) ([]byte, error)
+}
+
+// oidcDocument is a cached document.
+type oidcDocument struct {
+	body      []byte
+	fetchedAt time.Time
+}
+
+// oidcFetchTimeout bounds a fetch of a document. Fetches are shared by the
+// requests waiting for them, so they don't end with the request that
+// started them.
+const oidcFetchTimeout = 10 * time.Second
+
+// kubeOIDCSource reads the documents from the API server with the VM's
+// ServiceAccount. The system:service-account-issuer-discovery ClusterRole
+// allows it, and is bound to all ServiceAccounts by default.
+type kubeOIDCSource struct {
+	client rest.Interface
+	// fetches has one fetch in flight per path
+	fetches singleflight.Group
+
+	mu   sync.Mutex
+	docs map[string]oidcDocument
+}
+
+// NewOIDCSource creates an OIDCSource reading from the API server of client,
+// e.g. a clientset's Discovery().RESTClient().
+func NewOIDCSource(client rest.Interface) OIDCSource {
+	return &kubeOIDCSource{client: client, docs: make(map[string]oidcDocument)}
+}
+
+// ReadOIDC returns the document, from the cache if it is recent. If the API
+// server can't be reached, a stale document is returned instead.
+func (k *kubeOIDCSource) ReadOIDC(ctx context.Context, path string) ([]byte, error) {
+	k.mu.Lock()
+	doc, ok := k.docs[path]
+	k.mu.Unlock()
+	if ok && time.Since(doc.fetchedAt) < oidcCacheTTL {
+		return doc.body, nil
+	}
+
+	fetch := k.fetches.DoChan(path, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), oidcFetchTimeout)
+		defer cancel()
+		body, err := k.client.Get().AbsPath(path).DoRaw(ctx)
+		if err != nil {
+			return nil, err
+		}
+		k.mu.Lock()
+		k.docs[path] = oidcDocument{body: body, fetchedAt: time.Now()}
+		k.mu.Unlock()
+		return body, nil
+	})
+
+	var err error
+	select {
+	case res := <-fetch:
+		if res.Err == nil {
+			return res.Val.([]byte), nil
+		}
+		err = res.Err
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if ok {
+		log.Printf("Serving cached %s: %v", path, err)
+		return doc.body, nil
+	}
+	return nil, fmt.Errorf("failed to get %s: %w", path, err)
+}
+
+// handleOIDC handles GET /.well-known/openid-configuration and
+// GET /openid/v1/jwks.
+func (s *Server) handleOIDC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := s.OIDCSource.ReadOIDC(r.Context(), r.URL.Path)
+	if err != nil {
+		log.Printf("Failed to read OIDC document: %v", err)
+		if apierrors.IsForbidden(err) {
+			s.writeError(w, http.StatusForbidden, "oidc_forbidden", "The VM's ServiceAccount may not read the issuer's documents")
+		} else {
+			s.writeError(w, http.StatusBadGateway, "oidc_unavailable", "Failed to read the issuer's documents")
+		}
+		return
+	}
+
+	if r.URL.Path == oidcDiscoveryPath {
+		// The issuer stays the cluster's, which tokens are issued by, but
+		// the keys are fetched from IMDS
+		var config map[string]interface{}
+		if err := json.Unmarshal(body, &config); err != nil {
+			log.Printf("Invalid OIDC discovery document: %v", err)
+			s.writeError(w, http.StatusBadGateway, "oidc_unavailable", "Invalid discovery document")
+			return
+		}
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		config["jwks_uri"] = scheme + "://" + r.Host + oidcJWKSPath
+		s.writeJSON(w, http.StatusOK, config)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,232 @@
+package imds
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const testJWKS = `{"keys":[{"use":"sig","kty":"RSA","kid":"test","alg":"RS256","n":"AQAB","e":"AQAB"}]}`
+
+// newTestOIDCAPIServer serves the issuer's documents like the API server,
+// until status is set to an error.
+func newTestOIDCAPIServer(t *testing.T, status *atomic.Int32) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if code := int(status.Load()); code != 0 {
+			w.WriteHeader(code)
+			return
+		}
+		switch r.URL.Path {
+		case oidcDiscoveryPath:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"issuer":"https://kubernetes.default.svc.cluster.local","jwks_uri":"https://10.96.0.1:443/openid/v1/jwks","response_types_supported":["id_token"],"subject_types_supported":["public"],"id_token_signing_alg_values_supported":["RS256"]}`))
+		case oidcJWKSPath:
+			w.Header().Set("Content-Type", "application/jwk-set+json")
+			w.Write([]byte(testJWKS))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(apiServer.Close)
+	return apiServer, &requests
+}
+
+func newTestOIDCSource(t *testing.T, url string) OIDCSource {
+	t.Helper()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: url})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewOIDCSource(client.Discovery().RESTClient())
+}
+
+func TestHandleOIDC(t *testing.T) {
+	var status atomic.Int32
+	apiServer, _ := newTestOIDCAPIServer(t, &status)
+	server := NewServer("/tmp/token", "default", "testvm", "default", "")
+	server.OIDCSource = newTestOIDCSource(t, apiServer.URL)
+	handler := server.metadataHeaderMiddleware(server.newMux())
+
+	get := func(path string) *httptest.ResponseRecorder {
+		// OIDC libraries don't send the Metadata header
+		req := httptest.NewRequest(http.MethodGet, "http://169.254.169.254"+path, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(oidcDiscoveryPath)
+	if w.Code != http.StatusOK {
+		t.Fatalf("discovery status = %d, body: %s", w.Code, w.Body.String())
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["issuer"] != "https://kubernetes.default.svc.cluster.local" {
+		t.Errorf("issuer = %v, want the cluster's", config["issuer"])
+	}
+	if config["jwks_uri"] != "http://169.254.169.254/openid/v1/jwks" {
+		t.Errorf("jwks_uri = %v, want the IMDS JWKS", config["jwks_uri"])
+	}
+
+	w = get(oidcJWKSPath)
+	if w.Code != http.StatusOK {
+		t.Fatalf("JWKS status = %d, body: %s", w.Code, w.Body.String())
+	}
+	if w.Body.String() != testJWKS {
+		t.Errorf("JWKS = %s, want %s", w.Body.String(), testJWKS)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/jwk-set+json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+
+	if w := get("/v1/identity"); w.Code != http.StatusBadRequest {
+		t.Errorf("/v1/identity without Metadata header = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHandleOIDCErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		wantCode int
+		wantErr  string
+	}{
+		{name: "forbidden", status: http.StatusForbidden, wantCode: http.StatusForbidden, wantErr: "oidc_forbidden"},
+		{name: "unavailable", status: http.StatusServiceUnavailable, wantCode: http.StatusBadGateway, wantErr: "oidc_unavailable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status atomic.Int32
+			status.Store(int32(tt.status))
+			apiServer, _ := newTestOIDCAPIServer(t, &status)
+			server := NewServer("/tmp/token", "default", "testvm", "default", "")
+			server.OIDCSource = newTestOIDCSource(t, apiServer.URL)
+
+			req := httptest.NewRequest(http.MethodGet, oidcJWKSPath, nil)
+			w := httptest.NewRecorder()
+			server.newMux().ServeHTTP(w, req)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			var resp ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error != tt.wantErr {
+				t.Errorf("error = %q, want %q", resp.Error, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOIDCSourceCache(t *testing.T) {
+	var status atomic.Int32
+	apiServer, requests := newTestOIDCAPIServer(t, &status)
+	source := newTestOIDCSource(t, apiServer.URL).(*kubeOIDCSource)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := source.ReadOIDC(ctx, oidcJWKSPath); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("API server requests = %d, want 1", n)
+	}
+
+	// Once expired, the document is fetched again, and kept if that fails
+	source.mu.Lock()
+	doc := source.docs[oidcJWKSPath]
+	doc.fetchedAt = time.Now().Add(-oidcCacheTTL)
+	source.docs[oidcJWKSPath] = doc
+	source.mu.Unlock()
+	status.Store(http.StatusServiceUnavailable)
+	body, err := source.ReadOIDC(ctx, oidcJWKSPath)
+	if err != nil {
+		t.Fatalf("ReadOIDC() with a stale document error = %v", err)
+	}
+	if string(body) != testJWKS {
+		t.Errorf("ReadOIDC() = %s, want the stale document", body)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("API server requests = %d, want 2", n)
+	}
+}
+
+func TestOIDCSourceSlowFetch(t *testing.T) {
+	release := make(chan struct{})
+	var jwksRequests atomic.Int32
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == oidcJWKSPath {
+			jwksRequests.Add(1)
+			<-release
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer apiServer.Close()
+	defer close(release)
+	source := newTestOIDCSource(t, apiServer.URL)
+	ctx := context.Background()
+
+	if _, err := source.ReadOIDC(ctx, oidcDiscoveryPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers of the JWKS share one fetch, which the API server holds up
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := source.ReadOIDC(ctx, oidcJWKSPath)
+			results <- err
+		}()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for jwksRequests.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The cached discovery document is still served meanwhile
+	done := make(chan error, 1)
+	go func() {
+		_, err := source.ReadOIDC(ctx, oidcDiscoveryPath)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadOIDC() of a cached document blocked on another fetch")
+	}
+
+	// A reader that gives up doesn't wait for the fetch
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := source.ReadOIDC(canceled, oidcJWKSPath); err == nil {
+		t.Error("ReadOIDC() with a canceled context error = nil, want an error")
+	}
+
+	release <- struct{}{}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("ReadOIDC() error = %v", err)
+		}
+	}
+	if n := jwksRequests.Load(); n != 1 {
+		t.Errorf("JWKS requests = %d, want 1", n)
+	}
+}
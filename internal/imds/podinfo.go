@@ -0,0 +1,80 @@
+package imds
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Files in PodInfoDir, as written by a downward API volume
+const (
+	podLabelsFile      = "labels"
+	podAnnotationsFile = "annotations"
+)
+
+// readPodInfo parses a downward API labels or annotations file, one
+// key="quoted value" per line.
+func readPodInfo(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		key, quoted, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid line in %s: %q", path, line)
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of %s in %s: %w", key, path, err)
+		}
+		info[key] = value
+	}
+	return info, nil
+}
+
+// podInfoHandler serves GET /v1/pod/<file> with all entries of the downward
+// API file as a JSON object, and GET /v1/pod/<file>/<key> with one raw value.
+func (s *Server) podInfoHandler(file string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		info, err := readPodInfo(filepath.Join(s.PodInfoDir, file))
+		if err != nil {
+			log.Printf("Failed to read pod %s: %v", file, err)
+			if errors.Is(err, os.ErrNotExist) {
+				s.writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Pod %s are not available", file))
+				return
+			}
+			s.writeError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("Failed to read pod %s", file))
+			return
+		}
+
+		key := routeSuffix(r, "/pod/"+file+"/")
+		if key == "" {
+			s.writeJSON(w, http.StatusOK, info)
+			return
+		}
+		value, ok := info[key]
+		if !ok {
+			s.writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("No pod %s %q", strings.TrimSuffix(file, "s"), key))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(value))
+	}
+}
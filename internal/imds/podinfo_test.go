@@ -0,0 +1,74 @@
+package imds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHandlePodInfo(t *testing.T) {
+	dir := t.TempDir()
+	// As written by the kubelet: sorted keys with Go-quoted values
+	labels := "app=\"web\"\nkubevirt.io/domain=\"test-vm\"\n"
+	annotations := "description=\"line one\\nline \\\"two\\\"\"\nimds.kubevirt.io/enabled=\"true\""
+	if err := os.WriteFile(filepath.Join(dir, "labels"), []byte(labels), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "annotations"), []byte(annotations), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer("/nonexistent", "test-ns", "test-vm", "test-sa", "")
+	server.PodInfoDir = dir
+	mux := server.newMux()
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantJSON   map[string]string
+		wantBody   string
+	}{
+		{name: "labels", path: "/v1/pod/labels", wantStatus: http.StatusOK, wantJSON: map[string]string{"app": "web", "kubevirt.io/domain": "test-vm"}},
+		{name: "annotations", path: "/v1/pod/annotations", wantStatus: http.StatusOK, wantJSON: map[string]string{"description": "line one\nline \"two\"", "imds.kubevirt.io/enabled": "true"}},
+		{name: "trailing slash", path: "/v1/pod/labels/", wantStatus: http.StatusOK, wantJSON: map[string]string{"app": "web", "kubevirt.io/domain": "test-vm"}},
+		{name: "label with slash", path: "/v1/pod/labels/kubevirt.io/domain", wantStatus: http.StatusOK, wantBody: "test-vm"},
+		{name: "annotation", path: "/v1/pod/annotations/description", wantStatus: http.StatusOK, wantBody: "line one\nline \"two\""},
+		{name: "missing label", path: "/v1/pod/labels/nope", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantJSON != nil {
+				var got map[string]string
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || !reflect.DeepEqual(got, tt.wantJSON) {
+					t.Errorf("body = %s, want %v", w.Body.String(), tt.wantJSON)
+				}
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestReadPodInfoInvalid(t *testing.T) {
+	for _, content := range []string{"no-equals-sign", "key=unquoted"} {
+		path := filepath.Join(t.TempDir(), "labels")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readPodInfo(path); err == nil {
+			t.Errorf("readPodInfo(%q) error = nil, want error", content)
+		}
+	}
+}
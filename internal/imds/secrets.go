@@ -0,0 +1,80 @@
+package imds
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// SecretsResponse is the response for GET /v1/secrets
+type SecretsResponse struct {
+	Secrets []string `json:"secrets"`
+}
+
+// SecretKeysResponse is the response for GET /v1/secrets/<name>
+type SecretKeysResponse struct {
+	Keys []string `json:"keys"`
+}
+
+// SecretReader reads Secrets from the VM's namespace.
+type SecretReader interface {
+	ReadSecret(ctx context.Context, name string) (map[string][]byte, error)
+}
+
+// kubeSecretReader reads Secrets with the VM's ServiceAccount, which needs
+// "get" on each exposed Secret.
+type kubeSecretReader struct {
+	client    kubernetes.Interface
+	namespace string
+}
+
+// NewSecretReader creates a SecretReader for Secrets in namespace.
+func NewSecretReader(client kubernetes.Interface, namespace string) SecretReader {
+	return &kubeSecretReader{client: client, namespace: namespace}
+}
+
+// ReadSecret returns the data of the Secret.
+func (k *kubeSecretReader) ReadSecret(ctx context.Context, name string) (map[string][]byte, error) {
+	secret, err := k.client.CoreV1().Secrets(k.namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Secret %s/%s: %w", k.namespace, name, err)
+	}
+	return secret.Data, nil
+}
+
+// handleSecrets handles GET /v1/secrets, listing the exposed Secrets.
+func (s *Server) handleSecrets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, SecretsResponse{Secrets: exposedNames(s.ExposedSecrets)})
+}
+
+// handleSecret handles GET /v1/secrets/<name>, listing the exposed keys,
+// and GET /v1/secrets/<name>/<key>, returning the raw value.
+func (s *Server) handleSecret(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	served := s.serveExposed(w, r, exposedKind{
+		kind:    "Secret",
+		code:    "secret",
+		route:   "/secrets/",
+		exposed: s.ExposedSecrets,
+		read: func(ctx context.Context, name string) (exposedObject, error) {
+			data, err := s.SecretReader.ReadSecret(ctx, name)
+			return exposedObject{binaryData: data}, err
+		},
+		keys:      func(keys []string) any { return SecretKeysResponse{Keys: keys} },
+		sensitive: true,
+	})
+	if !served {
+		s.handleSecrets(w, r)
+	}
+}
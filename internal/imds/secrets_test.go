@@ -0,0 +1,113 @@
+package imds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestHandleSecret(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "db-creds", Namespace: "test-ns"},
+			Data:       map[string][]byte{"username": []byte("app"), "password": []byte("s3cret\n"), "admin-password": []byte("root")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "api-key", Namespace: "test-ns"},
+			Data:       map[string][]byte{"token": []byte("abc")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "test-ns"},
+			Data:       map[string][]byte{"token": []byte("not exposed")},
+		},
+	)
+	client.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.GetAction).GetName() == "rbac-denied" {
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "rbac-denied", nil)
+		}
+		return false, nil, nil
+	})
+
+	server := NewServer("/nonexistent", "test-ns", "test-vm", "test-sa", "")
+	server.SecretReader = NewSecretReader(client, "test-ns")
+	server.ExposedSecrets = map[string][]string{
+		"db-creds":    {"username", "password"},
+		"api-key":     {},
+		"missing":     {},
+		"rbac-denied": {},
+	}
+	mux := server.newMux()
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantBody   string
+		wantKeys   []string
+		wantError  string
+	}{
+		{name: "exposed key", path: "/v1/secrets/db-creds/password", wantStatus: http.StatusOK, wantBody: "s3cret\n"},
+		{name: "all keys exposed", path: "/v1/secrets/api-key/token", wantStatus: http.StatusOK, wantBody: "abc"},
+		{name: "list keys", path: "/v1/secrets/db-creds", wantStatus: http.StatusOK, wantKeys: []string{"password", "username"}},
+		{name: "key not exposed", path: "/v1/secrets/db-creds/admin-password", wantStatus: http.StatusForbidden, wantError: "secret_not_exposed"},
+		{name: "secret not exposed", path: "/v1/secrets/other/token", wantStatus: http.StatusForbidden, wantError: "secret_not_exposed"},
+		{name: "missing key", path: "/v1/secrets/api-key/nope", wantStatus: http.StatusNotFound, wantError: "not_found"},
+		{name: "missing secret", path: "/v1/secrets/missing/token", wantStatus: http.StatusNotFound, wantError: "not_found"},
+		{name: "RBAC denies", path: "/v1/secrets/rbac-denied/token", wantStatus: http.StatusForbidden, wantError: "secret_forbidden"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			switch {
+			case tt.wantError != "":
+				var resp ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error != tt.wantError {
+					t.Errorf("error = %q, want %q", resp.Error, tt.wantError)
+				}
+			case tt.wantKeys != nil:
+				var resp SecretKeysResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !reflect.DeepEqual(resp.Keys, tt.wantKeys) {
+					t.Errorf("keys = %v, want %v", resp.Keys, tt.wantKeys)
+				}
+			default:
+				if w.Body.String() != tt.wantBody {
+					t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+				}
+				if w.Header().Get("Cache-Control") != "no-store" {
+					t.Errorf("Cache-Control = %q, want no-store", w.Header().Get("Cache-Control"))
+				}
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/secrets", nil))
+	var list SecretsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || !reflect.DeepEqual(list.Secrets, []string{"api-key", "db-creds", "missing", "rbac-denied"}) {
+		t.Errorf("GET /v1/secrets = %s", w.Body.String())
+	}
+}
+
+func TestSecretsNotServedByDefault(t *testing.T) {
+	server := NewServer("/nonexistent", "test-ns", "test-vm", "test-sa", "")
+	w := httptest.NewRecorder()
+	server.newMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/secrets/db-creds/password", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want 404", w.Code)
+	}
+}
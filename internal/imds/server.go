@@ -2,30 +2,144 @@ package imds
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
 )
 
+// Default request rate limit, shared by all clients of one server
+const (
+	DefaultRateLimit = 100 // requests per second
+	DefaultRateBurst = 100
+)
+
+// DefaultShutdownTimeout is how long Run waits for open requests on shutdown
+const DefaultShutdownTimeout = 5 * time.Second
+
 // Server is the IMDS HTTP server.
 type Server struct {
 	// TokenPath is the path to the ServiceAccount token file
 	TokenPath string
+	// TokenSource provides the token served at /v1/token (optional, nil
+	// reads TokenPath)
+	TokenSource TokenSource
 	// Namespace is the Kubernetes namespace
 	Namespace string
 	// VMName is the VirtualMachine name
 	VMName string
 	// ServiceAccountName is the ServiceAccount name
 	ServiceAccountName string
+	// PodName, PodUID and NodeName identify the virt-launcher pod and where
+	// it runs (optional)
+	PodName  string
+	PodUID   string
+	NodeName string
 	// ListenAddr is the address to listen on (default: 169.254.169.254:80)
 	ListenAddr string
+	// ListenAddrV6 is an additional IPv6 address to listen on (optional)
+	ListenAddrV6 string
+	// TLSCert also serves HTTPS on TLSPort of each listen address (optional,
+	// nil disables)
+	TLSCert *ServingCert
+	// TLSPort is the port of the HTTPS listeners (default DefaultTLSPort)
+	TLSPort int
+	// Metadata holds custom key/value metadata served under /v1/metadata
+	Metadata map[string]string
+	// NodeReader reads the Node the VM runs on for /v1/node (optional, nil
+	// disables)
+	NodeReader NodeReader
+	// PodInfoDir holds the pod's labels and annotations from a downward API
+	// volume, served under /v1/pod (optional, empty disables)
+	PodInfoDir string
+	// APIServerURL is the Kubernetes API server URL advertised in /v1/kubeconfig
+	APIServerURL string
+	// CAPath is the path to the cluster CA bundle advertised in /v1/kubeconfig
+	CAPath string
+	// TokenMinter mints tokens for ?audience= requests (optional, nil disables)
+	TokenMinter TokenMinter
+	// AllowedAudiences is the allowlist of audiences TokenMinter may be asked for
+	AllowedAudiences []string
+	// AudienceTokenPaths maps audiences to kubelet-projected token files.
+	// These audiences are served from disk, without TokenMinter or the allowlist.
+	AudienceTokenPaths map[string]string
+	// TokenNames maps names to audiences in AudienceTokenPaths, served at
+	// /v1/tokens/<name> (optional, empty disables)
+	TokenNames map[string]string
+	// TokenExchanger exchanges the VM's token with an external STS at
+	// /v1/token/exchange (optional, nil disables)
+	TokenExchanger TokenExchanger
+	// TokenExchangeTargets is the allowlist of audiences and resources
+	// TokenExchanger may be asked for
+	TokenExchangeTargets []string
+	// TokenExchangeSubject provides the subject token of exchanges
+	// (optional, nil uses TokenSource)
+	TokenExchangeSubject TokenSource
+	// UserDataPath is the file served at /v1/user-data (optional, empty disables)
+	UserDataPath string
+	// SVIDSource relays SPIFFE SVIDs to the VM (optional, nil disables /v1/svid)
+	SVIDSource SVIDSource
+	// CertificateIssuer signs the VM's certificate requests (optional, nil
+	// disables /v1/certificates)
+	CertificateIssuer CertificateIssuer
+	// SSHCertificates signs the VM's SSH keys (optional, nil disables
+	// /v1/ssh/certificate)
+	SSHCertificates *SSHCertificates
+	// SourceAllowlist restricts credential endpoints to the VM's IPs (optional, nil disables)
+	SourceAllowlist *SourceAllowlist
+	// EndpointPolicy disables endpoint groups, or restricts them to the VM's
+	// IPs, by group name (optional, empty serves all groups)
+	EndpointPolicy map[string]EndpointRule
+	// Events reports suspicious requests, such as rejected sources and rate
+	// limit storms (optional, nil only logs them)
+	Events EventRecorder
+	// Attestation serves credentials only after the guest proves its boot state
+	// with a vTPM quote at /v1/attest/verify (optional, nil disables)
+	Attestation *Attestation
+	// SecretReader reads the Secrets in ExposedSecrets for /v1/secrets
+	// (optional, nil disables)
+	SecretReader SecretReader
+	// ExposedSecrets maps the Secrets the guest may read to their exposed
+	// keys, or to an empty list to expose all keys
+	ExposedSecrets map[string][]string
+	// ConfigMapReader reads the ConfigMaps in ExposedConfigMaps for
+	// /v1/configs (optional, nil disables)
+	ConfigMapReader ConfigMapReader
+	// ExposedConfigMaps maps the ConfigMaps the guest may read to their
+	// exposed keys, or to an empty list to expose all keys
+	ExposedConfigMaps map[string][]string
+	// KubernetesProxy forwards allowlisted read-only API server paths under
+	// /v1/kubernetes (optional, nil disables)
+	KubernetesProxy *KubernetesProxy
+	// OIDCSource reads the ServiceAccount issuer's discovery document and
+	// JWKS, served at the API server's paths (optional, nil disables)
+	OIDCSource OIDCSource
+	// EC2Identity serves an EC2-compatible instance identity document under
+	// /latest/dynamic/instance-identity (optional, nil disables)
+	EC2Identity *EC2Identity
+	// AttestationVerifier gates credential endpoints on an external
+	// verifier instead of Attestation (optional, nil disables)
+	AttestationVerifier AttestationVerifier
+	// TokenBinding refuses to serve a token to a source other than the one
+	// that first received it (optional, nil disables)
+	TokenBinding *TokenBinding
+	// ReusePort binds with SO_REUSEPORT, so a replacement server can start
+	// listening before this one stops and guests never see a refused connection
+	ReusePort bool
+	// ShutdownTimeout is how long Run waits for open requests to finish when
+	// the context is canceled (default DefaultShutdownTimeout)
+	ShutdownTimeout time.Duration
 
-	server  *http.Server
-	limiter *rate.Limiter
+	server         *http.Server
+	limiter        *rate.Limiter
+	logLevel       atomic.Int32
+	tokensDisabled atomic.Bool
 }
 
 // NewServer creates a new IMDS server with the given configuration.
@@ -40,20 +154,22 @@ func NewServer(tokenPath, namespace, vmName, saName, listenAddr string) *Server
 		VMName:             vmName,
 		ServiceAccountName: saName,
 		ListenAddr:         listenAddr,
-		limiter:            rate.NewLimiter(100, 100), // 100 req/s, burst of 100
+		limiter:            rate.NewLimiter(DefaultRateLimit, DefaultRateBurst),
 	}
 }
 
+// SetRateLimit changes the request rate limit (requests per second) and the
+// burst allowed on top of it.
+func (s *Server) SetRateLimit(limit float64, burst int) {
+	s.limiter.SetLimit(rate.Limit(limit))
+	s.limiter.SetBurst(burst)
+}
+
 // Run starts the IMDS server and blocks until the context is canceled.
 func (s *Server) Run(ctx context.Context) error {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", s.handleHealthz)
-	mux.HandleFunc("/v1/token", s.handleToken)
-	mux.HandleFunc("/v1/identity", s.handleIdentity)
-
 	s.server = &http.Server{
 		Addr:           s.ListenAddr,
-		Handler:        s.loggingMiddleware(s.metadataHeaderMiddleware(s.rateLimitMiddleware(mux))),
+		Handler:        s.loggingMiddleware(s.metadataHeaderMiddleware(s.rateLimitMiddleware(s.endpointPolicyMiddleware(s.newMux())))),
 		ReadTimeout:    5 * time.Second,
 		WriteTimeout:   5 * time.Second,
 		IdleTimeout:    20 * time.Second,
@@ -61,21 +177,77 @@ func (s *Server) Run(ctx context.Context) error {
 		BaseContext:    func(net.Listener) context.Context { return ctx },
 	}
 
-	// Start server in goroutine
-	errCh := make(chan error, 1)
-	go func() {
-		log.Printf("Starting IMDS server on %s", s.ListenAddr)
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			errCh <- err
+	addrs := []string{s.ListenAddr}
+	if s.ListenAddrV6 != "" {
+		addrs = append(addrs, s.ListenAddrV6)
+	}
+	// HTTPS listens on the same hosts and serves the same endpoints
+	tlsAddrs := make(map[string]bool)
+	if s.TLSCert != nil {
+		for _, addr := range addrs {
+			tlsAddr, err := s.tlsListenAddr(addr)
+			if err != nil {
+				return fmt.Errorf("invalid listen address %s: %w", addr, err)
+			}
+			tlsAddrs[tlsAddr] = true
 		}
-		close(errCh)
-	}()
+		for tlsAddr := range tlsAddrs {
+			addrs = append(addrs, tlsAddr)
+		}
+	}
+
+	// Sockets handed over by a supervisor take the place of binding new ones
+	inherited, err := inheritedListeners()
+	if err != nil {
+		return err
+	}
+	for addr := range inherited {
+		log.Printf("Using listener on %s passed in by the supervisor", addr)
+	}
+
+	// Listen on all addresses before serving so a bad address fails fast
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		l, err := s.listen(ctx, addr, inherited)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		if tlsAddrs[addr] {
+			l = tls.NewListener(l, &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: s.TLSCert.GetCertificate,
+			})
+		}
+		listeners = append(listeners, l)
+	}
+	for addr, l := range inherited {
+		log.Printf("Closing unused listener on %s passed in by the supervisor", addr)
+		l.Close()
+	}
+
+	// Start serving in goroutines
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			log.Printf("Starting IMDS server on %s", l.Addr())
+			if err := s.server.Serve(l); err != nil && err != http.ErrServerClosed {
+				errCh <- err
+			}
+		}(l)
+	}
 
 	// Wait for context cancellation or error
 	select {
 	case <-ctx.Done():
 		log.Println("Shutting down IMDS server...")
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		timeout := s.ShutdownTimeout
+		if timeout <= 0 {
+			timeout = DefaultShutdownTimeout
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
 		return s.server.Shutdown(shutdownCtx)
 	case err := <-errCh:
@@ -83,18 +255,214 @@ func (s *Server) Run(ctx context.Context) error {
 	}
 }
 
+// LogLevel returns the current request logging level.
+func (s *Server) LogLevel() LogLevel {
+	return LogLevel(s.logLevel.Load())
+}
+
+// SetLogLevel changes the request logging level at runtime.
+func (s *Server) SetLogLevel(level LogLevel) {
+	s.logLevel.Store(int32(level))
+}
+
+// route is an API endpoint served by the IMDS server.
+// The path is relative to the API version prefix (e.g. "/token").
+type route struct {
+	path    string
+	handler http.HandlerFunc
+}
+
+// apiVersion is a version of the API served under /<name>/.
+// Breaking response changes land in a new version while older versions
+// keep their handlers, optionally flagged as deprecated.
+type apiVersion struct {
+	name string
+	// deprecated is when the version was deprecated (zero if not deprecated)
+	deprecated time.Time
+	// sunset is when the version will be removed (zero if not scheduled)
+	sunset time.Time
+	// successor is the version replacing this one, advertised via Link header
+	successor string
+}
+
+// prefix returns the URL prefix of the version, e.g. "/v1".
+func (v apiVersion) prefix() string {
+	return "/" + v.name
+}
+
+// apiVersions are the API versions served by the server, oldest first. A
+// new version is only added once one of its routes differs from v1.
+var apiVersions = []apiVersion{
+	{name: "v1"},
+}
+
+// routes returns the endpoints served under each API version's prefix.
+func (s *Server) routes() []route {
+	// Credential endpoints are additionally restricted to the VM's own IPs
+	// and may wait for attestation
+	routes := []route{
+		{"/token", s.tokenHandler(s.handleToken)},
+		{"/identity", s.handleIdentity},
+		{"/kubeconfig", s.tokenHandler(s.handleKubeconfig)},
+		{"/metadata", s.handleMetadata},
+		{"/metadata/", s.handleMetadataKey},
+	}
+	if s.NodeReader != nil {
+		routes = append(routes, route{"/node", s.handleNode})
+	}
+	if s.TLSCert != nil {
+		routes = append(routes, route{"/tls/ca", s.handleTLSCA})
+	}
+	if s.PodInfoDir != "" {
+		routes = append(routes,
+			route{"/pod/labels", s.podInfoHandler(podLabelsFile)},
+			route{"/pod/labels/", s.podInfoHandler(podLabelsFile)},
+			route{"/pod/annotations", s.podInfoHandler(podAnnotationsFile)},
+			route{"/pod/annotations/", s.podInfoHandler(podAnnotationsFile)},
+		)
+	}
+	if s.TokenExchanger != nil {
+		routes = append(routes, route{"/token/exchange", s.tokenHandler(s.handleTokenExchange)})
+	}
+	if s.KubernetesProxy != nil {
+		// It reads as the VM's ServiceAccount, so it is guarded like the token
+		routes = append(routes, route{kubernetesProxyPath + "/", s.tokenHandler(s.handleKubernetesProxy)})
+	}
+	if len(s.TokenNames) > 0 {
+		routes = append(routes,
+			route{"/tokens", s.handleTokens},
+			route{"/tokens/", s.tokenHandler(s.handleNamedToken)},
+		)
+	}
+	if s.SecretReader != nil && len(s.ExposedSecrets) > 0 {
+		routes = append(routes,
+			route{"/secrets", s.handleSecrets},
+			route{"/secrets/", s.credentialHandler(s.handleSecret)},
+		)
+	}
+	if s.ConfigMapReader != nil && len(s.ExposedConfigMaps) > 0 {
+		routes = append(routes,
+			route{"/configs", s.handleConfigs},
+			route{"/configs/", s.requireAllowedSource(s.handleConfig)},
+		)
+	}
+	if s.Attestation != nil {
+		routes = append(routes,
+			route{"/attest/challenge", s.requireAllowedSource(s.handleAttestChallenge)},
+			route{"/attest/verify", s.requireAllowedSource(s.handleAttestVerify)},
+		)
+	}
+	if s.UserDataPath != "" {
+		// User data routinely carries bootstrap secrets
+		routes = append(routes, route{"/user-data", s.requireAllowedSource(s.handleUserData)})
+	}
+	if s.SVIDSource != nil {
+		routes = append(routes,
+			route{"/svid", s.credentialHandler(s.handleX509SVID)},
+			route{"/svid/jwt", s.credentialHandler(s.handleJWTSVID)},
+		)
+	}
+	if s.CertificateIssuer != nil {
+		routes = append(routes, route{"/certificates", s.credentialHandler(s.handleCertificates)})
+	}
+	if s.SSHCertificates != nil {
+		routes = append(routes, route{"/ssh/certificate", s.credentialHandler(s.handleSSHCertificate)})
+	}
+	return routes
+}
+
+// credentialHandler guards endpoints handing out credentials: they are
+// restricted to the VM's own IPs and may wait for attestation.
+func (s *Server) credentialHandler(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireAllowedSource(s.requireAttestation(next))
+}
+
+// tokenHandler guards endpoints handing out the VM's tokens, which can also
+// be turned off at runtime.
+func (s *Server) tokenHandler(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireAllowedSource(s.requireTokensEnabled(s.requireAttestation(next)))
+}
+
+// newMux builds the request router, including the discovery documents.
+func (s *Server) newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/", s.handleRoot)
+	routes := s.routes()
+	for _, version := range apiVersions {
+		s.registerVersion(mux, version, routes)
+	}
+	if s.EC2Identity != nil {
+		// Unversioned, where EC2 tooling looks for it
+		mux.HandleFunc(ec2IdentityDir, s.requireAllowedSource(s.handleEC2Identity))
+	}
+	if s.OIDCSource != nil {
+		// Unversioned, where OIDC libraries look for them
+		mux.HandleFunc(oidcDiscoveryPath, s.handleOIDC)
+		mux.HandleFunc(oidcJWKSPath, s.handleOIDC)
+	}
+	return mux
+}
+
+// registerVersion registers the version index and the routes under the
+// version's prefix.
+func (s *Server) registerVersion(mux *http.ServeMux, version apiVersion, routes []route) {
+	prefix := version.prefix()
+	mux.Handle(prefix+"/", deprecationMiddleware(version, s.versionIndexHandler(version, routes)))
+	for _, rt := range routes {
+		mux.Handle(prefix+rt.path, deprecationMiddleware(version, rt.handler))
+	}
+}
+
+// routeSuffix returns the rest of the request path after route, such as the
+// name in /v1/tokens/<name> for "/tokens/", or "" if the path isn't under
+// route. Routes are registered per API version, so the version is skipped.
+func routeSuffix(r *http.Request, route string) string {
+	_, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	suffix, ok := strings.CutPrefix("/"+rest, route)
+	if !ok {
+		return ""
+	}
+	return suffix
+}
+
+// deprecationMiddleware adds Deprecation, Sunset and successor Link headers
+// to responses of deprecated API versions.
+func deprecationMiddleware(version apiVersion, next http.Handler) http.Handler {
+	if version.deprecated.IsZero() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", version.deprecated.Unix()))
+		if !version.sunset.IsZero() {
+			w.Header().Set("Sunset", version.sunset.UTC().Format(http.TimeFormat))
+		}
+		if version.successor != "" {
+			w.Header().Set("Link", fmt.Sprintf("</%s/>; rel=\"successor-version\"", version.successor))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // loggingMiddleware logs incoming requests.
 func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		next.ServeHTTP(w, r)
-		log.Printf("%s %s %s", r.Method, r.URL.Path, time.Since(start))
+		switch s.LogLevel() {
+		case LogLevelError:
+		case LogLevelDebug:
+			log.Printf("%s %s %s from=%s user-agent=%q", r.Method, r.URL.Path, time.Since(start), r.RemoteAddr, r.UserAgent())
+		default:
+			log.Printf("%s %s %s", r.Method, r.URL.Path, time.Since(start))
+		}
 	})
 }
 
 // metadataHeaderMiddleware requires the "Metadata: true" header for SSRF protection.
 // This follows the same pattern as Azure IMDS.
-// The /healthz endpoint is exempt for health checks.
+// The /healthz endpoint is exempt for health checks, and the EC2 identity
+// document for EC2 tooling, which doesn't send the header.
 func (s *Server) metadataHeaderMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Allow healthz without header for health probes
@@ -102,9 +470,20 @@ func (s *Server) metadataHeaderMiddleware(next http.Handler) http.Handler {
 			next.ServeHTTP(w, r)
 			return
 		}
+		if s.EC2Identity != nil && strings.HasPrefix(r.URL.Path, ec2IdentityDir) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if s.OIDCSource != nil && (r.URL.Path == oidcDiscoveryPath || r.URL.Path == oidcJWKSPath) {
+			next.ServeHTTP(w, r)
+			return
+		}
 
 		// Check for required header
 		if r.Header.Get("Metadata") != "true" {
+			if endpointGroup(r.URL.Path) == EndpointGroupToken {
+				s.recordEvent(EventMissingMetadataHeader, "Request for %s from %s without the Metadata header", r.URL.Path, s.requestSource(r))
+			}
 			s.writeError(w, http.StatusBadRequest, "missing_header", "Metadata: true header is required")
 			return
 		}
@@ -113,10 +492,12 @@ func (s *Server) metadataHeaderMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// rateLimitMiddleware enforces rate limiting (100 req/s).
+// rateLimitMiddleware enforces the request rate limit (100 req/s by default).
 func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !s.limiter.Allow() {
+			// Events are themselves rate-limited, so a storm records one
+			s.recordEvent(EventRateLimited, "Rate limit of %g requests per second exceeded by %s", float64(s.limiter.Limit()), r.RemoteAddr)
 			w.Header().Set("Retry-After", "1")
 			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
 			return
@@ -0,0 +1,68 @@
+package imds
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// SourceAllowlist is the set of guest IPs allowed to call credential
+// endpoints. It is kept up to date from the VMI status and complements the
+// MAC-based checks for setups where guest MACs are rewritten.
+type SourceAllowlist struct {
+	mu  sync.RWMutex
+	ips map[string]bool
+}
+
+// NewSourceAllowlist creates an empty allowlist, which allows no sources
+// until Set is called.
+func NewSourceAllowlist() *SourceAllowlist {
+	return &SourceAllowlist{ips: make(map[string]bool)}
+}
+
+// Set replaces the allowed guest IPs.
+func (a *SourceAllowlist) Set(ips []net.IP) {
+	allowed := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		allowed[ip.String()] = true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ips = allowed
+}
+
+// Allowed reports whether requests from the IP may receive credentials.
+// Link-local addresses get no exemption: anything on the bridge or in the
+// pod can pick one, including the IMDS address itself.
+func (a *SourceAllowlist) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.ips[ip.String()]
+}
+
+// requireAllowedSource rejects requests for credential endpoints from IPs
+// that are not in the source allowlist. It is a no-op without an allowlist.
+func (s *Server) requireAllowedSource(next http.HandlerFunc) http.HandlerFunc {
+	if s.SourceAllowlist == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if !s.SourceAllowlist.Allowed(net.ParseIP(host)) {
+			log.Printf("Rejected %s from %s (not a VM address)", r.URL.Path, host)
+			s.recordEvent(EventSourceRejected, "Rejected %s from %s, which is not a VM address", r.URL.Path, host)
+			s.writeError(w, http.StatusForbidden, "source_not_allowed", "Credentials are only served to the VM's own addresses")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,132 @@
+package imds
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSourceAllowlist(t *testing.T) {
+	allowlist := NewSourceAllowlist()
+
+	tests := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{name: "unknown address before set", ip: "10.0.2.2", want: false},
+		{name: "IPv4 link-local", ip: "169.254.10.1", want: false},
+		{name: "IPv6 link-local", ip: "fe80::1", want: false},
+		{name: "invalid address", ip: "", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowlist.Allowed(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Allowed(%q) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+
+	allowlist.Set([]net.IP{net.ParseIP("10.0.2.2"), net.ParseIP("fd10:0:2::2")})
+	if !allowlist.Allowed(net.ParseIP("10.0.2.2")) || !allowlist.Allowed(net.ParseIP("fd10:0:2::2")) {
+		t.Error("expected VM addresses to be allowed after Set")
+	}
+
+	// Set replaces rather than merges
+	allowlist.Set([]net.IP{net.ParseIP("10.0.2.3")})
+	if allowlist.Allowed(net.ParseIP("10.0.2.2")) {
+		t.Error("expected old VM address to be removed")
+	}
+}
+
+func TestRequireAllowedSource(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("test-token"), 0644); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		allowlist  []string
+		remoteAddr string
+		path       string
+		wantStatus int
+	}{
+		{
+			name:       "VM address receives token",
+			allowlist:  []string{"10.0.2.2"},
+			remoteAddr: "10.0.2.2:41000",
+			path:       "/v1/token",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "other address is rejected",
+			allowlist:  []string{"10.0.2.2"},
+			remoteAddr: "10.0.2.9:41000",
+			path:       "/v1/token",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "other address can still read identity",
+			allowlist:  []string{"10.0.2.2"},
+			remoteAddr: "10.0.2.9:41000",
+			path:       "/v1/identity",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "link-local address is rejected",
+			allowlist:  []string{"10.0.2.2"},
+			remoteAddr: "169.254.77.12:41000",
+			path:       "/v1/token",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "IMDS address from inside the pod is rejected",
+			allowlist:  []string{"10.0.2.2"},
+			remoteAddr: "169.254.169.254:41000",
+			path:       "/v1/token",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "reported link-local guest address receives token",
+			allowlist:  []string{"10.0.2.2", "fe80::5054:ff:fe12:3456"},
+			remoteAddr: "[fe80::5054:ff:fe12:3456]:41000",
+			path:       "/v1/token",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "no allowlist configured allows all",
+			allowlist:  nil,
+			remoteAddr: "10.0.2.9:41000",
+			path:       "/v1/token",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(tokenPath, "test-ns", "test-vm", "test-sa", "")
+			if tt.allowlist != nil {
+				server.SourceAllowlist = NewSourceAllowlist()
+				var ips []net.IP
+				for _, ip := range tt.allowlist {
+					ips = append(ips, net.ParseIP(ip))
+				}
+				server.SourceAllowlist.Set(ips)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+
+			server.newMux().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
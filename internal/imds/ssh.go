@@ -0,0 +1,259 @@
+package imds
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// DefaultSSHCertificateTTL is how long SSH certificates are valid for
+	DefaultSSHCertificateTTL = time.Hour
+	// sshClockSkew backdates certificates for guests whose clock is behind
+	sshClockSkew = 5 * time.Minute
+	// sshSignTimeout bounds signing by Vault or a command
+	sshSignTimeout = 10 * time.Second
+	// maxSSHKeyBytes bounds the request body of POST /v1/ssh/certificate
+	maxSSHKeyBytes = 16 << 10
+)
+
+// SSH certificate types accepted in ?type=
+const (
+	SSHCertTypeHost = "host"
+	SSHCertTypeUser = "user"
+)
+
+// SSHCertificateResponse is the response for POST /v1/ssh/certificate
+type SSHCertificateResponse struct {
+	Certificate string    `json:"certificate"`
+	Principals  []string  `json:"principals"`
+	ValidBefore time.Time `json:"validBefore"`
+}
+
+// SSHCertRequest is what an SSHSigner is asked to sign. The principals come
+// from the sidecar's configuration, never from the guest.
+type SSHCertRequest struct {
+	PublicKey  ssh.PublicKey
+	CertType   string
+	KeyID      string
+	Principals []string
+	TTL        time.Duration
+}
+
+// SSHSigner signs SSH public keys on behalf of the VM.
+type SSHSigner interface {
+	SignSSHKey(ctx context.Context, req SSHCertRequest) (*ssh.Certificate, error)
+}
+
+// SSHCertificates configures POST /v1/ssh/certificate.
+type SSHCertificates struct {
+	// Signer signs the keys
+	Signer SSHSigner
+	// HostPrincipals are the names host certificates are valid for
+	HostPrincipals []string
+	// UserPrincipals are the users user certificates are valid for (empty
+	// disables user certificates)
+	UserPrincipals []string
+	// TTL is how long certificates are valid for (default DefaultSSHCertificateTTL)
+	TTL time.Duration
+}
+
+// fileSSHSigner signs with a CA private key read from a file, such as a
+// mounted Secret.
+type fileSSHSigner struct {
+	path string
+}
+
+// NewFileSSHSigner creates an SSHSigner using the OpenSSH or PEM private key
+// at path. The key is read for every certificate, so a rotated Secret is
+// picked up.
+func NewFileSSHSigner(path string) SSHSigner {
+	return fileSSHSigner{path: path}
+}
+
+// SignSSHKey signs the key with the CA key.
+func (f fileSSHSigner) SignSSHKey(ctx context.Context, req SSHCertRequest) (*ssh.Certificate, error) {
+	pemBytes, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SSH CA key: %w", err)
+	}
+	ca, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SSH CA key %s: %w", f.path, err)
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate serial: %w", err)
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             req.PublicKey,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.HostCert,
+		KeyId:           req.KeyID,
+		ValidPrincipals: req.Principals,
+		ValidAfter:      uint64(now.Add(-sshClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(req.TTL).Unix()),
+	}
+	if req.CertType == SSHCertTypeUser {
+		cert.CertType = ssh.UserCert
+		// The extensions ssh-keygen grants user certificates by default
+		cert.Permissions.Extensions = map[string]string{
+			"permit-X11-forwarding":   "",
+			"permit-agent-forwarding": "",
+			"permit-port-forwarding":  "",
+			"permit-pty":              "",
+			"permit-user-rc":          "",
+		}
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, fmt.Errorf("failed to sign SSH certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// execSSHSigner runs an external signer plugin.
+type execSSHSigner struct {
+	command []string
+}
+
+// execSSHRequest is written to the stdin of a signer plugin
+type execSSHRequest struct {
+	PublicKey  string   `json:"publicKey"`
+	CertType   string   `json:"certType"`
+	KeyID      string   `json:"keyId"`
+	Principals []string `json:"principals"`
+	TTL        string   `json:"ttl"`
+}
+
+// NewExecSSHSigner creates an SSHSigner running command. The command reads
+// the request as JSON on stdin and prints the certificate in
+// authorized_keys format.
+func NewExecSSHSigner(command []string) (SSHSigner, error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("SSH signer command is empty")
+	}
+	return execSSHSigner{command: command}, nil
+}
+
+// SignSSHKey runs the command and parses the certificate it prints.
+func (e execSSHSigner) SignSSHKey(ctx context.Context, req SSHCertRequest) (*ssh.Certificate, error) {
+	input, err := json.Marshal(execSSHRequest{
+		PublicKey:  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(req.PublicKey))),
+		CertType:   req.CertType,
+		KeyID:      req.KeyID,
+		Principals: req.Principals,
+		TTL:        req.TTL.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sshSignTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.command[0], e.command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("SSH signer %s failed: %w: %s", e.command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return parseSSHCertificate(out)
+}
+
+// parseSSHCertificate parses a certificate in authorized_keys format.
+func parseSSHCertificate(data []byte) (*ssh.Certificate, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH certificate: %w", err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("signer returned a %s key, not a certificate", key.Type())
+	}
+	return cert, nil
+}
+
+// DefaultSSHHostPrincipals returns the names a VM's host certificate is
+// valid for: the VM name, and the name qualified with its namespace.
+func DefaultSSHHostPrincipals(namespace, vmName string) []string {
+	return []string{vmName, vmName + "." + namespace}
+}
+
+// handleSSHCertificate handles POST /v1/ssh/certificate[?type=host|user]
+// with an SSH public key in authorized_keys format as the body.
+func (s *Server) handleSSHCertificate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	certType := r.URL.Query().Get("type")
+	var principals []string
+	switch certType {
+	case "", SSHCertTypeHost:
+		certType, principals = SSHCertTypeHost, s.SSHCertificates.HostPrincipals
+	case SSHCertTypeUser:
+		principals = s.SSHCertificates.UserPrincipals
+	default:
+		s.writeError(w, http.StatusBadRequest, "invalid_type", fmt.Sprintf("Unsupported certificate type %q", certType))
+		return
+	}
+	if len(principals) == 0 {
+		s.writeError(w, http.StatusForbidden, "type_not_allowed", fmt.Sprintf("%s certificates are not enabled for this VM", certType))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSSHKeyBytes))
+	if err != nil {
+		s.writeError(w, http.StatusRequestEntityTooLarge, "invalid_key", fmt.Sprintf("Public key larger than %d bytes", maxSSHKeyBytes))
+		return
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(body)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalid_key", "Expected an SSH public key in authorized_keys format")
+		return
+	}
+	if _, ok := key.(*ssh.Certificate); ok {
+		s.writeError(w, http.StatusBadRequest, "invalid_key", "Expected a public key, not a certificate")
+		return
+	}
+
+	ttl := s.SSHCertificates.TTL
+	if ttl == 0 {
+		ttl = DefaultSSHCertificateTTL
+	}
+	cert, err := s.SSHCertificates.Signer.SignSSHKey(r.Context(), SSHCertRequest{
+		PublicKey:  key,
+		CertType:   certType,
+		KeyID:      fmt.Sprintf("%s/%s", s.Namespace, s.VMName),
+		Principals: principals,
+		TTL:        ttl,
+	})
+	if err != nil {
+		log.Printf("Failed to sign SSH %s key: %v", certType, err)
+		s.writeError(w, http.StatusBadGateway, "certificate_unavailable", "Failed to sign the SSH key")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, SSHCertificateResponse{
+		Certificate: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))),
+		Principals:  cert.ValidPrincipals,
+		ValidBefore: time.Unix(int64(cert.ValidBefore), 0),
+	})
+}
@@ -0,0 +1,250 @@
+package imds
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// createTestSSHKey returns a new ed25519 SSH key pair.
+func createTestSSHKey(t *testing.T) (ssh.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshPub, priv
+}
+
+// writeTestSSHCA writes a new CA private key in OpenSSH format and returns
+// its path and public key.
+func writeTestSSHCA(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+	pub, priv := createTestSSHKey(t)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ca")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, pub
+}
+
+func TestFileSSHSigner(t *testing.T) {
+	caPath, caPub := writeTestSSHCA(t)
+	key, _ := createTestSSHKey(t)
+
+	tests := []struct {
+		name         string
+		certType     string
+		wantCertType uint32
+		wantPermit   bool
+	}{
+		{name: "host", certType: SSHCertTypeHost, wantCertType: ssh.HostCert},
+		{name: "user", certType: SSHCertTypeUser, wantCertType: ssh.UserCert, wantPermit: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := NewFileSSHSigner(caPath).SignSSHKey(context.Background(), SSHCertRequest{
+				PublicKey:  key,
+				CertType:   tt.certType,
+				KeyID:      "test-ns/test-vm",
+				Principals: []string{"test-vm"},
+				TTL:        time.Hour,
+			})
+			if err != nil {
+				t.Fatalf("SignSSHKey() error = %v", err)
+			}
+			if cert.CertType != tt.wantCertType || cert.KeyId != "test-ns/test-vm" || !reflect.DeepEqual(cert.ValidPrincipals, []string{"test-vm"}) {
+				t.Errorf("certificate = type %d, key ID %q, principals %v", cert.CertType, cert.KeyId, cert.ValidPrincipals)
+			}
+			if _, ok := cert.Permissions.Extensions["permit-pty"]; ok != tt.wantPermit {
+				t.Errorf("permit-pty = %v, want %v", ok, tt.wantPermit)
+			}
+
+			checker := ssh.CertChecker{IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+				return string(auth.Marshal()) == string(caPub.Marshal())
+			}}
+			if err := checker.CheckCert("test-vm", cert); err != nil {
+				t.Errorf("CheckCert() error = %v", err)
+			}
+		})
+	}
+
+	if _, err := NewFileSSHSigner(filepath.Join(t.TempDir(), "missing")).SignSSHKey(context.Background(), SSHCertRequest{PublicKey: key}); err == nil {
+		t.Error("SignSSHKey() with a missing CA key expected error")
+	}
+}
+
+func TestExecSSHSigner(t *testing.T) {
+	caPath, _ := writeTestSSHCA(t)
+	key, _ := createTestSSHKey(t)
+	cert, err := NewFileSSHSigner(caPath).SignSSHKey(context.Background(), SSHCertRequest{PublicKey: key, Principals: []string{"test-vm"}, TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "cert"), ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		command []string
+		wantErr bool
+	}{
+		{name: "certificate", command: []string{"sh", "-c", fmt.Sprintf("cat > %s/request; cat %s/cert", dir, dir)}},
+		{name: "not a certificate", command: []string{"echo", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))}, wantErr: true},
+		{name: "command fails", command: []string{"false"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := NewExecSSHSigner(tt.command)
+			if err != nil {
+				t.Fatalf("NewExecSSHSigner() error = %v", err)
+			}
+			got, err := signer.SignSSHKey(context.Background(), SSHCertRequest{PublicKey: key, CertType: SSHCertTypeHost, Principals: []string{"test-vm"}, TTL: time.Hour})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SignSSHKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Serial != cert.Serial {
+				t.Errorf("SignSSHKey() returned serial %d, want %d", got.Serial, cert.Serial)
+			}
+		})
+	}
+
+	// The plugin got the request on stdin
+	var req execSSHRequest
+	data, err := os.ReadFile(filepath.Join(dir, "request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		t.Fatalf("invalid request %q: %v", data, err)
+	}
+	if req.CertType != SSHCertTypeHost || req.TTL != "1h0m0s" || !reflect.DeepEqual(req.Principals, []string{"test-vm"}) {
+		t.Errorf("request = %+v", req)
+	}
+
+	if _, err := NewExecSSHSigner(nil); err == nil {
+		t.Error("NewExecSSHSigner(nil) expected error")
+	}
+}
+
+// fakeSSHSigner records the request and signs it with the file signer's CA.
+type fakeSSHSigner struct {
+	signer SSHSigner
+	err    error
+	got    *SSHCertRequest
+}
+
+func (f *fakeSSHSigner) SignSSHKey(ctx context.Context, req SSHCertRequest) (*ssh.Certificate, error) {
+	f.got = &req
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.signer.SignSSHKey(ctx, req)
+}
+
+func TestHandleSSHCertificate(t *testing.T) {
+	caPath, _ := writeTestSSHCA(t)
+	key, _ := createTestSSHKey(t)
+	publicKey := string(ssh.MarshalAuthorizedKey(key))
+
+	tests := []struct {
+		name           string
+		method         string
+		query          string
+		body           string
+		userPrincipals []string
+		err            error
+		wantStatus     int
+		wantError      string
+		wantPrincipals []string
+	}{
+		{name: "host", method: http.MethodPost, body: publicKey, wantStatus: http.StatusOK, wantPrincipals: []string{"test-vm", "test-vm.test-ns"}},
+		{name: "user", method: http.MethodPost, query: "?type=user", body: publicKey, userPrincipals: []string{"cloud-user"}, wantStatus: http.StatusOK, wantPrincipals: []string{"cloud-user"}},
+		{name: "user not enabled", method: http.MethodPost, query: "?type=user", body: publicKey, wantStatus: http.StatusForbidden, wantError: "type_not_allowed"},
+		{name: "unknown type", method: http.MethodPost, query: "?type=ca", body: publicKey, wantStatus: http.StatusBadRequest, wantError: "invalid_type"},
+		{name: "not a key", method: http.MethodPost, body: "hello", wantStatus: http.StatusBadRequest, wantError: "invalid_key"},
+		{name: "signer fails", method: http.MethodPost, body: publicKey, err: fmt.Errorf("vault sealed"), wantStatus: http.StatusBadGateway, wantError: "certificate_unavailable"},
+		{name: "GET not allowed", method: http.MethodGet, wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer := &fakeSSHSigner{signer: NewFileSSHSigner(caPath), err: tt.err}
+			server := NewServer("", "test-ns", "test-vm", "default", "")
+			server.SSHCertificates = &SSHCertificates{
+				Signer:         signer,
+				HostPrincipals: DefaultSSHHostPrincipals("test-ns", "test-vm"),
+				UserPrincipals: tt.userPrincipals,
+			}
+
+			req := httptest.NewRequest(tt.method, "/v1/ssh/certificate"+tt.query, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			server.newMux().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantError != "" {
+				var resp ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("failed to parse error response: %v", err)
+				}
+				if resp.Error != tt.wantError {
+					t.Errorf("error = %q, want %q", resp.Error, tt.wantError)
+				}
+				return
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var resp SSHCertificateResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to parse response: %v", err)
+			}
+			if !reflect.DeepEqual(resp.Principals, tt.wantPrincipals) {
+				t.Errorf("principals = %v, want %v", resp.Principals, tt.wantPrincipals)
+			}
+			if _, err := parseSSHCertificate([]byte(resp.Certificate)); err != nil {
+				t.Errorf("certificate: %v", err)
+			}
+			if signer.got.KeyID != "test-ns/test-vm" || signer.got.TTL != DefaultSSHCertificateTTL {
+				t.Errorf("signer request = %+v", signer.got)
+			}
+		})
+	}
+}
+
+func TestHandleSSHCertificateNotEnabled(t *testing.T) {
+	server := NewServer("", "test-ns", "test-vm", "default", "")
+	w := httptest.NewRecorder()
+	server.newMux().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/ssh/certificate", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,139 @@
+package imds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// vaultSSHSigner signs keys with the Vault SSH secrets engine. It logs in
+// with the VM's ServiceAccount token through Vault's Kubernetes auth method.
+type vaultSSHSigner struct {
+	addr      string
+	signPath  string
+	authMount string
+	role      string
+	tokens    TokenSource
+	client    *http.Client
+
+	mu           sync.Mutex
+	vaultToken   string
+	vaultExpires time.Time
+}
+
+// vaultResponse holds the parts of Vault responses the signer reads
+type vaultResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int64  `json:"lease_duration"`
+	} `json:"auth"`
+	Data struct {
+		SignedKey string `json:"signed_key"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// NewVaultSSHSigner creates an SSHSigner calling Vault at addr. signPath is
+// the engine's sign endpoint, such as "ssh/sign/vm". The signer logs in to
+// the Kubernetes auth method mounted at authMount as role with the tokens
+// from tokens. client may be nil for http.DefaultClient.
+func NewVaultSSHSigner(addr, signPath, authMount, role string, tokens TokenSource, client *http.Client) SSHSigner {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &vaultSSHSigner{
+		addr:      strings.TrimSuffix(addr, "/"),
+		signPath:  strings.Trim(signPath, "/"),
+		authMount: strings.Trim(authMount, "/"),
+		role:      role,
+		tokens:    tokens,
+		client:    client,
+	}
+}
+
+// SignSSHKey asks Vault to sign the key.
+func (v *vaultSSHSigner) SignSSHKey(ctx context.Context, req SSHCertRequest) (*ssh.Certificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, sshSignTimeout)
+	defer cancel()
+
+	token, err := v.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.post(ctx, v.signPath, token, map[string]string{
+		"public_key":       string(ssh.MarshalAuthorizedKey(req.PublicKey)),
+		"cert_type":        req.CertType,
+		"valid_principals": strings.Join(req.Principals, ","),
+		"ttl":              req.TTL.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Vault failed to sign the SSH key: %w", err)
+	}
+	return parseSSHCertificate([]byte(resp.Data.SignedKey))
+}
+
+// login returns a Vault token, logging in again once less than a fifth of
+// the previous token's lease is left.
+func (v *vaultSSHSigner) login(ctx context.Context) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.vaultToken != "" && time.Now().Before(v.vaultExpires) {
+		return v.vaultToken, nil
+	}
+
+	jwt, _, err := v.tokens.Token(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read ServiceAccount token for Vault: %w", err)
+	}
+	resp, err := v.post(ctx, "auth/"+v.authMount+"/login", "", map[string]string{"role": v.role, "jwt": jwt})
+	if err != nil {
+		return "", fmt.Errorf("Vault login as role %q failed: %w", v.role, err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", fmt.Errorf("Vault login as role %q returned no token", v.role)
+	}
+
+	lease := time.Duration(resp.Auth.LeaseDuration) * time.Second
+	v.vaultToken, v.vaultExpires = resp.Auth.ClientToken, time.Now().Add(lease-lease/5)
+	return v.vaultToken, nil
+}
+
+// post sends a JSON request to the Vault API path and decodes the response.
+func (v *vaultSSHSigner) post(ctx context.Context, path, token string, body interface{}) (*vaultResponse, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.addr+"/v1/"+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var decoded vaultResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&decoded); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.Join(decoded.Errors, "; "))
+	}
+	return &decoded, nil
+}
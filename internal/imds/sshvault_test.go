@@ -0,0 +1,82 @@
+package imds
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestVaultSSHSigner(t *testing.T) {
+	caPath, _ := writeTestSSHCA(t)
+	key, _ := createTestSSHKey(t)
+
+	var logins, signs int
+	var gotSign map[string]string
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("invalid request body: %v", err)
+		}
+		switch r.URL.Path {
+		case "/v1/auth/kubernetes/login":
+			logins++
+			if body["role"] != "vm" || body["jwt"] != "sa-token" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors":["invalid role or JWT"]}`))
+				return
+			}
+			w.Write([]byte(`{"auth":{"client_token":"vault-token","lease_duration":3600}}`))
+		case "/v1/ssh/sign/vm-host":
+			signs++
+			gotSign = body
+			if r.Header.Get("X-Vault-Token") != "vault-token" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"errors":["permission denied"]}`))
+				return
+			}
+			pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(body["public_key"]))
+			if err != nil {
+				t.Errorf("invalid public key: %v", err)
+			}
+			cert, err := NewFileSSHSigner(caPath).SignSSHKey(r.Context(), SSHCertRequest{PublicKey: pub, Principals: []string{body["valid_principals"]}, TTL: time.Hour})
+			if err != nil {
+				t.Errorf("signing failed: %v", err)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"signed_key": string(ssh.MarshalAuthorizedKey(cert))}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	defer vault.Close()
+
+	req := SSHCertRequest{PublicKey: key, CertType: SSHCertTypeHost, Principals: []string{"test-vm", "test-vm.test-ns"}, TTL: time.Hour}
+
+	signer := NewVaultSSHSigner(vault.URL+"/", "/ssh/sign/vm-host", "kubernetes", "vm", staticTokenSource{token: "sa-token"}, nil)
+	for i := 0; i < 2; i++ {
+		cert, err := signer.SignSSHKey(context.Background(), req)
+		if err != nil {
+			t.Fatalf("SignSSHKey() error = %v", err)
+		}
+		if cert.ValidPrincipals[0] != "test-vm,test-vm.test-ns" {
+			t.Errorf("principals = %v", cert.ValidPrincipals)
+		}
+	}
+	if logins != 1 || signs != 2 {
+		t.Errorf("logins = %d, signs = %d, want 1 and 2", logins, signs)
+	}
+	if gotSign["cert_type"] != "host" || gotSign["ttl"] != "1h0m0s" {
+		t.Errorf("sign request = %v", gotSign)
+	}
+
+	// A rejected login is reported
+	signer = NewVaultSSHSigner(vault.URL, "ssh/sign/vm-host", "kubernetes", "other", staticTokenSource{token: "sa-token"}, nil)
+	if _, err := signer.SignSSHKey(context.Background(), req); err == nil {
+		t.Error("SignSSHKey() with a rejected login expected error")
+	}
+}
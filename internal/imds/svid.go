@@ -0,0 +1,133 @@
+package imds
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/svid/jwtsvid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// X509SVIDResponse is the response for GET /v1/svid
+type X509SVIDResponse struct {
+	SPIFFEID            string    `json:"spiffeId"`
+	Certificates        string    `json:"certificates"`
+	PrivateKey          string    `json:"privateKey"`
+	Bundle              string    `json:"bundle,omitempty"`
+	ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+}
+
+// JWTSVIDResponse is the response for GET /v1/svid/jwt
+type JWTSVIDResponse struct {
+	SPIFFEID            string    `json:"spiffeId"`
+	Token               string    `json:"token"`
+	ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+}
+
+// SVIDSource fetches SPIFFE SVIDs on behalf of the VM.
+type SVIDSource interface {
+	FetchX509SVID(ctx context.Context) (*X509SVIDResponse, error)
+	FetchJWTSVID(ctx context.Context, audience string) (*JWTSVIDResponse, error)
+}
+
+// workloadAPISource relays SVIDs from a SPIRE agent Workload API socket.
+// The agent attests the sidecar process, so the returned identity is that of
+// the virt-launcher pod (and therefore the VMI) the sidecar runs in.
+type workloadAPISource struct {
+	addr string
+}
+
+// NewWorkloadAPISource creates an SVIDSource backed by the SPIFFE Workload API
+// listening on the given unix socket path.
+func NewWorkloadAPISource(socketPath string) SVIDSource {
+	return &workloadAPISource{addr: "unix://" + socketPath}
+}
+
+// FetchX509SVID fetches the default X.509-SVID and its trust bundle.
+func (s *workloadAPISource) FetchX509SVID(ctx context.Context) (*X509SVIDResponse, error) {
+	x509Ctx, err := workloadapi.FetchX509Context(ctx, workloadapi.WithAddr(s.addr))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch X.509 context: %w", err)
+	}
+	if len(x509Ctx.SVIDs) == 0 {
+		return nil, fmt.Errorf("workload API returned no X.509-SVIDs")
+	}
+
+	svid := x509Ctx.DefaultSVID()
+	certs, key, err := svid.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal X.509-SVID: %w", err)
+	}
+
+	resp := &X509SVIDResponse{
+		SPIFFEID:            svid.ID.String(),
+		Certificates:        string(certs),
+		PrivateKey:          string(key),
+		ExpirationTimestamp: svid.Certificates[0].NotAfter,
+	}
+
+	if bundle, err := x509Ctx.Bundles.GetX509BundleForTrustDomain(svid.ID.TrustDomain()); err == nil {
+		if pem, err := bundle.Marshal(); err == nil {
+			resp.Bundle = string(pem)
+		}
+	}
+
+	return resp, nil
+}
+
+// FetchJWTSVID fetches a JWT-SVID for the given audience.
+func (s *workloadAPISource) FetchJWTSVID(ctx context.Context, audience string) (*JWTSVIDResponse, error) {
+	svid, err := workloadapi.FetchJWTSVID(ctx, jwtsvid.Params{Audience: audience}, workloadapi.WithAddr(s.addr))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWT-SVID: %w", err)
+	}
+
+	return &JWTSVIDResponse{
+		SPIFFEID:            svid.ID.String(),
+		Token:               svid.Marshal(),
+		ExpirationTimestamp: svid.Expiry,
+	}, nil
+}
+
+// handleX509SVID handles GET /v1/svid
+func (s *Server) handleX509SVID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp, err := s.SVIDSource.FetchX509SVID(r.Context())
+	if err != nil {
+		log.Printf("Failed to fetch X.509-SVID: %v", err)
+		s.writeError(w, http.StatusBadGateway, "svid_unavailable", "Failed to fetch X.509-SVID from SPIFFE Workload API")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, resp)
+}
+
+// handleJWTSVID handles GET /v1/svid/jwt?audience=<aud>
+func (s *Server) handleJWTSVID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	audience := r.URL.Query().Get("audience")
+	if audience == "" {
+		s.writeError(w, http.StatusBadRequest, "missing_audience", "audience query parameter is required")
+		return
+	}
+
+	resp, err := s.SVIDSource.FetchJWTSVID(r.Context(), audience)
+	if err != nil {
+		log.Printf("Failed to fetch JWT-SVID: %v", err)
+		s.writeError(w, http.StatusBadGateway, "svid_unavailable", "Failed to fetch JWT-SVID from SPIFFE Workload API")
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,146 @@
+package imds
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultTLSPort is the port of the HTTPS listener
+const DefaultTLSPort = 443
+
+// tlsReloadInterval is how often the certificate files are checked for
+// renewals
+const tlsReloadInterval = time.Minute
+
+// Files of a TLS directory, as cert-manager's CSI driver writes them
+const (
+	tlsCertFile = "tls.crt"
+	tlsKeyFile  = "tls.key"
+	tlsCAFile   = "ca.crt"
+)
+
+// ServingCert is the certificate of the HTTPS listener. It is read from a
+// directory holding tls.crt, tls.key and the issuing CA in ca.crt, and
+// reloaded when the files are renewed.
+type ServingCert struct {
+	dir string
+	now func() time.Time
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// NewServingCert loads the certificate in dir.
+func NewServingCert(dir string) (*ServingCert, error) {
+	c := &ServingCert{dir: dir, now: time.Now}
+	modTime, err := c.stat()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	c.cert, c.modTime, c.checked = cert, modTime, c.now()
+	return c, nil
+}
+
+// stat returns when the certificate file last changed.
+func (c *ServingCert) stat() (time.Time, error) {
+	info, err := os.Stat(filepath.Join(c.dir, tlsCertFile))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read TLS certificate: %w", err)
+	}
+	return info.ModTime(), nil
+}
+
+// load reads the key pair.
+func (c *ServingCert) load() (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(c.dir, tlsCertFile), filepath.Join(c.dir, tlsKeyFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// GetCertificate returns the current certificate, reloading it at most every
+// tlsReloadInterval if the files changed. A renewal that can't be loaded,
+// e.g. one written halfway, keeps the previous certificate.
+func (c *ServingCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if now.Sub(c.checked) < tlsReloadInterval {
+		return c.cert, nil
+	}
+	c.checked = now
+	modTime, err := c.stat()
+	if err != nil || modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := c.load()
+	if err != nil {
+		log.Printf("Keeping the previous TLS certificate: %v", err)
+		return c.cert, nil
+	}
+	log.Printf("Reloaded TLS certificate from %s", c.dir)
+	c.cert, c.modTime = cert, modTime
+	return c.cert, nil
+}
+
+// CA returns the PEM CA that issued the certificate, or nil if the issuer
+// doesn't provide one.
+func (c *ServingCert) CA() ([]byte, error) {
+	ca, err := os.ReadFile(filepath.Join(c.dir, tlsCAFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return ca, err
+}
+
+// tlsListenAddr returns the HTTPS address on the host of addr.
+func (s *Server) tlsListenAddr(addr string) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	port := s.TLSPort
+	if port == 0 {
+		port = DefaultTLSPort
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// handleTLSCA handles GET /v1/tls/ca: the CA of the HTTPS listener, served
+// over plain HTTP so the guest can trust the listener from first boot.
+func (s *Server) handleTLSCA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ca, err := s.TLSCert.CA()
+	if err != nil {
+		log.Printf("Failed to read TLS CA: %v", err)
+		s.writeError(w, http.StatusInternalServerError, "internal_error", "Failed to read CA")
+		return
+	}
+	if len(ca) == 0 {
+		s.writeError(w, http.StatusNotFound, "ca_unavailable", "The certificate issuer doesn't provide its CA")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.WriteHeader(http.StatusOK)
+	w.Write(ca)
+}
@@ -0,0 +1,196 @@
+package imds
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writeTestServingCert writes a new self-signed key pair to dir and returns
+// the certificate.
+func writeTestServingCert(t *testing.T, dir string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM := createTestEC2Signer(t, key)
+	if err := os.WriteFile(filepath.Join(dir, tlsCertFile), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, tlsKeyFile), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestNewServingCertMissing(t *testing.T) {
+	if _, err := NewServingCert(t.TempDir()); err == nil {
+		t.Error("expected error for a directory without a certificate")
+	}
+}
+
+func TestServingCertReload(t *testing.T) {
+	dir := t.TempDir()
+	first := writeTestServingCert(t, dir)
+	c, err := NewServingCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	current := func() *x509.Certificate {
+		t.Helper()
+		cert, err := c.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	// Renew, with a modification time the filesystem can tell apart
+	second := writeTestServingCert(t, dir)
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, tlsCertFile), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !current().Equal(first) {
+		t.Error("reloaded before the reload interval")
+	}
+	now = now.Add(tlsReloadInterval)
+	if !current().Equal(second) {
+		t.Error("didn't reload the renewed certificate")
+	}
+
+	// A broken renewal keeps the previous certificate
+	if err := os.WriteFile(filepath.Join(dir, tlsKeyFile), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, tlsCertFile), later.Add(time.Hour), later.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(tlsReloadInterval)
+	if !current().Equal(second) {
+		t.Error("didn't keep the previous certificate")
+	}
+}
+
+func TestHandleTLSCA(t *testing.T) {
+	dir := t.TempDir()
+	writeTestServingCert(t, dir)
+	cert, err := NewServingCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer("/tmp/token", "default", "testvm", "default", "")
+	server.TLSCert = cert
+	handler := server.metadataHeaderMiddleware(server.newMux())
+
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v1/tls/ca", nil)
+		req.Header.Set("Metadata", "true")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get(); w.Code != http.StatusNotFound {
+		t.Errorf("status without ca.crt = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	ca := []byte("-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n")
+	if err := os.WriteFile(filepath.Join(dir, tlsCAFile), ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+	w := get()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", w.Code, w.Body.String())
+	}
+	if w.Body.String() != string(ca) {
+		t.Errorf("body = %q, want %q", w.Body.String(), ca)
+	}
+}
+
+// freePort returns a TCP port on 127.0.0.1 that was free a moment ago.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestRunServesHTTPS(t *testing.T) {
+	dir := t.TempDir()
+	want := writeTestServingCert(t, dir)
+	cert, err := NewServingCert(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+	tlsPort := freePort(t)
+	server := NewServer("/tmp/token", "default", "testvm", "default", httpAddr)
+	server.TLSCert = cert
+	server.TLSPort = tlsPort
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	}()
+
+	// The test certificate has no SANs, so compare it instead of verifying
+	client := &http.Client{
+		Timeout:   time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+net.JoinHostPort("127.0.0.1", strconv.Itoa(tlsPort))+"/v1/identity", nil)
+		req.Header.Set("Metadata", "true")
+		if resp, err = client.Do(req); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("HTTPS request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if got := resp.TLS.PeerCertificates[0]; !got.Equal(want) {
+		t.Errorf("served certificate %v, want %v", got.Subject, want.Subject)
+	}
+}
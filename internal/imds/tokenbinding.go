@@ -0,0 +1,137 @@
+package imds
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultBindingTTL is how long a token without a known expiry stays bound
+// to its source
+const defaultBindingTTL = 24 * time.Hour
+
+// RequestSource identifies the client a token was served to.
+type RequestSource struct {
+	IP  net.IP
+	MAC net.HardwareAddr
+}
+
+// String returns the source as "<mac>/<ip>", or the IP if the MAC is unknown.
+func (src RequestSource) String() string {
+	if src.MAC == nil {
+		return src.IP.String()
+	}
+	return fmt.Sprintf("%s/%s", src.MAC, src.IP)
+}
+
+// Same reports whether two sources are the same interface: the same MAC if
+// both are known, the same IP otherwise.
+func (src RequestSource) Same(other RequestSource) bool {
+	if src.MAC != nil && other.MAC != nil {
+		return src.MAC.String() == other.MAC.String()
+	}
+	return src.IP.Equal(other.IP)
+}
+
+// boundToken is the source a token is bound to
+type boundToken struct {
+	source  RequestSource
+	expires time.Time
+}
+
+// TokenBinding binds each token the server serves repeatedly, such as the
+// ServiceAccount token, to the first source that received it. Other sources
+// asking for the same token are refused until it rotates, which limits
+// replay from elsewhere on the bridge.
+type TokenBinding struct {
+	// SourceMAC resolves a client IP to its MAC (optional, nil binds to IPs)
+	SourceMAC func(ip net.IP) (net.HardwareAddr, error)
+
+	now   func() time.Time
+	mu    sync.Mutex
+	bound map[[sha256.Size]byte]boundToken
+}
+
+// NewTokenBinding creates a TokenBinding resolving MACs with sourceMAC,
+// which may be nil.
+func NewTokenBinding(sourceMAC func(ip net.IP) (net.HardwareAddr, error)) *TokenBinding {
+	return &TokenBinding{
+		SourceMAC: sourceMAC,
+		now:       time.Now,
+		bound:     make(map[[sha256.Size]byte]boundToken),
+	}
+}
+
+// Source returns the source of a request. It may be called on a nil
+// TokenBinding, which leaves the MAC unknown.
+func (b *TokenBinding) Source(r *http.Request) RequestSource {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	source := RequestSource{IP: net.ParseIP(host)}
+	if b != nil && b.SourceMAC != nil && source.IP != nil {
+		if mac, err := b.SourceMAC(source.IP); err == nil {
+			source.MAC = mac
+		}
+	}
+	return source
+}
+
+// Bind binds the token to source until it expires, or reports false if it
+// is bound to another source. A zero expiry binds it for defaultBindingTTL.
+func (b *TokenBinding) Bind(token string, source RequestSource, expires time.Time) bool {
+	now := b.now()
+	if expires.IsZero() {
+		expires = now.Add(defaultBindingTTL)
+	}
+	key := sha256.Sum256([]byte(token))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for k, bound := range b.bound {
+		if !now.Before(bound.expires) {
+			delete(b.bound, k)
+		}
+	}
+	if bound, ok := b.bound[key]; ok {
+		if !bound.source.Same(source) {
+			return false
+		}
+		// Learn the MAC once it resolves, so the IP alone no longer matches
+		if bound.source.MAC == nil && source.MAC != nil {
+			bound.source.MAC = source.MAC
+			b.bound[key] = bound
+		}
+		return true
+	}
+	b.bound[key] = boundToken{source: source, expires: expires}
+	return true
+}
+
+// requestSource returns the source of a request, for recording who a token
+// was issued to.
+func (s *Server) requestSource(r *http.Request) RequestSource {
+	return s.TokenBinding.Source(r)
+}
+
+// bindToken binds a token about to be served to the request's source. If
+// the token is bound to another source it writes 403 and returns false. It
+// is a no-op without a TokenBinding.
+func (s *Server) bindToken(w http.ResponseWriter, r *http.Request, token string, expires time.Time) bool {
+	if s.TokenBinding == nil {
+		return true
+	}
+	source := s.TokenBinding.Source(r)
+	if !s.TokenBinding.Bind(token, source, expires) {
+		log.Printf("Refused %s to %s: the token was served to another source", r.URL.Path, source)
+		s.recordEvent(EventTokenBound, "Refused %s to %s: the token was served to another source", r.URL.Path, source)
+		s.writeError(w, http.StatusForbidden, "token_bound", "The token is bound to another source")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,176 @@
+package imds
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBindingBind(t *testing.T) {
+	vmMAC, _ := net.ParseMAC("52:54:00:12:34:56")
+	otherMAC, _ := net.ParseMAC("52:54:00:ab:cd:ef")
+	vm := RequestSource{IP: net.ParseIP("10.0.2.2"), MAC: vmMAC}
+	vmNoMAC := RequestSource{IP: net.ParseIP("10.0.2.2")}
+	vmOtherIP := RequestSource{IP: net.ParseIP("fd10:0:2::2"), MAC: vmMAC}
+	other := RequestSource{IP: net.ParseIP("10.0.2.9"), MAC: otherMAC}
+	spoofer := RequestSource{IP: net.ParseIP("10.0.2.2"), MAC: otherMAC}
+
+	tests := []struct {
+		name    string
+		first   RequestSource
+		second  RequestSource
+		advance time.Duration
+		want    bool
+	}{
+		{name: "same source", first: vm, second: vm, want: true},
+		{name: "same MAC, other IP", first: vm, second: vmOtherIP, want: true},
+		{name: "MAC not resolved", first: vm, second: vmNoMAC, want: true},
+		{name: "other source", first: vm, second: other, want: false},
+		{name: "spoofed IP", first: vm, second: spoofer, want: false},
+		{name: "other source after expiry", first: vm, second: other, advance: 2 * time.Hour, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Unix(1700000000, 0)
+			binding := NewTokenBinding(nil)
+			binding.now = func() time.Time { return now }
+
+			if !binding.Bind("token", tt.first, now.Add(time.Hour)) {
+				t.Fatal("first Bind() = false, want true")
+			}
+			now = now.Add(tt.advance)
+			if got := binding.Bind("token", tt.second, now.Add(time.Hour)); got != tt.want {
+				t.Errorf("second Bind() = %v, want %v", got, tt.want)
+			}
+			if !binding.Bind("other-token", tt.second, time.Time{}) {
+				t.Error("Bind() of another token = false, want true")
+			}
+		})
+	}
+}
+
+func TestTokenBindingLearnsMAC(t *testing.T) {
+	vmMAC, _ := net.ParseMAC("52:54:00:12:34:56")
+	otherMAC, _ := net.ParseMAC("52:54:00:ab:cd:ef")
+	binding := NewTokenBinding(nil)
+
+	// Bound before the MAC resolved, then the VM's MAC is learned
+	binding.Bind("token", RequestSource{IP: net.ParseIP("10.0.2.2")}, time.Time{})
+	binding.Bind("token", RequestSource{IP: net.ParseIP("10.0.2.2"), MAC: vmMAC}, time.Time{})
+	if binding.Bind("token", RequestSource{IP: net.ParseIP("10.0.2.2"), MAC: otherMAC}, time.Time{}) {
+		t.Error("Bind() from another MAC with the VM's IP = true, want false")
+	}
+}
+
+func TestHandleTokenBinding(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("test-token"), 0644); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		binding    bool
+		paths      []string
+		remoteAddr string
+		wantStatus int
+	}{
+		{name: "same source", binding: true, paths: []string{"/v1/token", "/v1/token"}, remoteAddr: "10.0.2.2:41000", wantStatus: http.StatusOK},
+		{name: "other source", binding: true, paths: []string{"/v1/token", "/v1/token"}, remoteAddr: "10.0.2.9:41000", wantStatus: http.StatusForbidden},
+		{name: "other source, kubeconfig", binding: true, paths: []string{"/v1/token", "/v1/kubeconfig"}, remoteAddr: "10.0.2.9:41000", wantStatus: http.StatusForbidden},
+		{name: "other source, binding off", paths: []string{"/v1/token", "/v1/token"}, remoteAddr: "10.0.2.9:41000", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(tokenPath, "test-ns", "test-vm", "test-sa", "")
+			server.APIServerURL = "https://10.96.0.1:443"
+			server.CAPath = tokenPath
+			if tt.binding {
+				server.TokenBinding = NewTokenBinding(nil)
+			}
+			mux := server.newMux()
+
+			first := httptest.NewRequest(http.MethodGet, tt.paths[0], nil)
+			first.RemoteAddr = "10.0.2.2:40000"
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, first)
+			if w.Code != http.StatusOK {
+				t.Fatalf("first status = %d, want 200: %s", w.Code, w.Body.String())
+			}
+
+			second := httptest.NewRequest(http.MethodGet, tt.paths[1], nil)
+			second.RemoteAddr = tt.remoteAddr
+			w = httptest.NewRecorder()
+			mux.ServeHTTP(w, second)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("second status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if w.Code == http.StatusForbidden {
+				var resp ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("failed to parse error response: %v", err)
+				}
+				if resp.Error != "token_bound" {
+					t.Errorf("error = %q, want token_bound", resp.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleMintedTokenBinding(t *testing.T) {
+	exchanger := &fakeTokenExchanger{resp: &TokenExchangeResponse{AccessToken: "exchanged-token", TokenType: "Bearer", ExpiresIn: 3600}}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		remoteAddr string
+		wantStatus int
+	}{
+		{name: "minted, same source", method: http.MethodGet, path: "/v1/token?audience=sts.example.com", remoteAddr: "10.0.2.2:41000", wantStatus: http.StatusOK},
+		{name: "minted, other source", method: http.MethodGet, path: "/v1/token?audience=sts.example.com", remoteAddr: "10.0.2.9:41000", wantStatus: http.StatusForbidden},
+		{name: "exchanged, same source", method: http.MethodPost, path: "/v1/token/exchange", body: "audience=https://sts.example.com", remoteAddr: "10.0.2.2:41000", wantStatus: http.StatusOK},
+		{name: "exchanged, other source", method: http.MethodPost, path: "/v1/token/exchange", body: "audience=https://sts.example.com", remoteAddr: "10.0.2.9:41000", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer("", "test-ns", "test-vm", "default", "")
+			server.TokenSource = staticTokenSource{token: "sa-token"}
+			server.TokenMinter = &fakeTokenMinter{}
+			server.AllowedAudiences = []string{"sts.example.com"}
+			server.TokenExchanger = exchanger
+			server.TokenExchangeTargets = []string{"https://sts.example.com"}
+			// The fake minter's tokens expire in 2023
+			server.TokenBinding = NewTokenBinding(nil)
+			server.TokenBinding.now = func() time.Time { return time.Unix(1690000000, 0) }
+			mux := server.newMux()
+
+			for i, remoteAddr := range []string{"10.0.2.2:40000", tt.remoteAddr} {
+				req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				req.RemoteAddr = remoteAddr
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, req)
+
+				want := http.StatusOK
+				if i == 1 {
+					want = tt.wantStatus
+				}
+				if w.Code != want {
+					t.Fatalf("request %d status = %d, want %d: %s", i, w.Code, want, w.Body.String())
+				}
+			}
+		})
+	}
+}
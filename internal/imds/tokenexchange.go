@@ -0,0 +1,222 @@
+package imds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RFC 8693 grant and token types
+const (
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+const (
+	// tokenExchangeTimeout bounds a request to the STS
+	tokenExchangeTimeout = 10 * time.Second
+	// maxTokenExchangeBytes bounds request and response bodies
+	maxTokenExchangeBytes = 64 << 10
+)
+
+// TokenExchangeRequest holds the parameters the guest may set on an RFC 8693
+// token exchange. The subject token is always the VM's.
+type TokenExchangeRequest struct {
+	Audience           []string
+	Resource           []string
+	Scope              string
+	RequestedTokenType string
+}
+
+// TokenExchangeResponse is the response for POST /v1/token/exchange, the
+// STS's RFC 8693 response.
+type TokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+	RefreshToken    string `json:"refresh_token,omitempty"`
+}
+
+// TokenExchangeError is an OAuth2 error returned by the STS.
+type TokenExchangeError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// Error returns the OAuth2 error code and description.
+func (e *TokenExchangeError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// TokenExchanger exchanges the VM's token for another token.
+type TokenExchanger interface {
+	ExchangeToken(ctx context.Context, subjectToken string, req TokenExchangeRequest) (*TokenExchangeResponse, error)
+}
+
+// stsExchanger calls the token endpoint of an external STS.
+type stsExchanger struct {
+	url      string
+	clientID string
+	client   *http.Client
+}
+
+// NewSTSExchanger creates a TokenExchanger posting RFC 8693 requests to the
+// token endpoint at url, as a public client with clientID if it is set.
+// client may be nil for http.DefaultClient.
+func NewSTSExchanger(url, clientID string, client *http.Client) TokenExchanger {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &stsExchanger{url: url, clientID: clientID, client: client}
+}
+
+// ExchangeToken posts the exchange to the STS.
+func (e *stsExchanger) ExchangeToken(ctx context.Context, subjectToken string, req TokenExchangeRequest) (*TokenExchangeResponse, error) {
+	form := url.Values{
+		"grant_type":         {grantTypeTokenExchange},
+		"subject_token":      {subjectToken},
+		"subject_token_type": {tokenTypeJWT},
+	}
+	for _, audience := range req.Audience {
+		form.Add("audience", audience)
+	}
+	for _, resource := range req.Resource {
+		form.Add("resource", resource)
+	}
+	if req.Scope != "" {
+		form.Set("scope", req.Scope)
+	}
+	if req.RequestedTokenType != "" {
+		form.Set("requested_token_type", req.RequestedTokenType)
+	}
+	if e.clientID != "" {
+		form.Set("client_id", e.clientID)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tokenExchangeTimeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("token exchange with %s failed: %w", e.url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenExchangeBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token exchange response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr TokenExchangeError
+		if resp.StatusCode < 500 && json.Unmarshal(body, &oauthErr) == nil && oauthErr.Code != "" {
+			return nil, &oauthErr
+		}
+		return nil, fmt.Errorf("token exchange with %s returned %s", e.url, resp.Status)
+	}
+	var exchanged TokenExchangeResponse
+	if err := json.Unmarshal(body, &exchanged); err != nil {
+		return nil, fmt.Errorf("invalid token exchange response: %w", err)
+	}
+	if exchanged.AccessToken == "" {
+		return nil, fmt.Errorf("token exchange response has no access_token")
+	}
+	return &exchanged, nil
+}
+
+// tokenExchangeTargetAllowed reports whether the VM may exchange its token
+// for the audience or resource.
+func (s *Server) tokenExchangeTargetAllowed(target string) bool {
+	for _, allowed := range s.TokenExchangeTargets {
+		if allowed == target {
+			return true
+		}
+	}
+	return false
+}
+
+// handleTokenExchange handles POST /v1/token/exchange with the RFC 8693
+// parameters audience, resource, scope and requested_token_type, form
+// encoded. The sidecar adds the VM's token as the subject token.
+func (s *Server) handleTokenExchange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxTokenExchangeBytes)
+	if err := r.ParseForm(); err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalid_request", "Expected form-encoded token exchange parameters")
+		return
+	}
+	req := TokenExchangeRequest{
+		Audience:           r.PostForm["audience"],
+		Resource:           r.PostForm["resource"],
+		Scope:              r.PostForm.Get("scope"),
+		RequestedTokenType: r.PostForm.Get("requested_token_type"),
+	}
+	targets := append(append([]string{}, req.Audience...), req.Resource...)
+	if len(targets) == 0 {
+		s.writeError(w, http.StatusBadRequest, "invalid_request", "At least one audience or resource is required")
+		return
+	}
+	for _, target := range targets {
+		if !s.tokenExchangeTargetAllowed(target) {
+			log.Printf("Rejected token exchange for %q (not in allowed targets)", target)
+			s.writeError(w, http.StatusForbidden, "target_not_allowed", fmt.Sprintf("Target %q is not in the allowed token exchange targets", target))
+			return
+		}
+	}
+
+	source := s.TokenExchangeSubject
+	if source == nil {
+		source = s.tokenSource()
+	}
+	subjectToken, _, err := source.Token(r.Context())
+	if err != nil {
+		log.Printf("Failed to read subject token for token exchange: %v", err)
+		s.writeError(w, http.StatusInternalServerError, "token_unavailable", "Failed to read ServiceAccount token")
+		return
+	}
+
+	resp, err := s.TokenExchanger.ExchangeToken(r.Context(), subjectToken, req)
+	if err != nil {
+		log.Printf("Token exchange failed: %v", err)
+		var oauthErr *TokenExchangeError
+		if errors.As(err, &oauthErr) {
+			s.writeError(w, http.StatusForbidden, "exchange_rejected", oauthErr.Error())
+			return
+		}
+		s.writeError(w, http.StatusBadGateway, "exchange_unavailable", "Token exchange with the STS failed")
+		return
+	}
+
+	// The STS may hand back a cached token, so bind it like the tokens we serve
+	var expires time.Time
+	if resp.ExpiresIn > 0 {
+		expires = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	if !s.bindToken(w, r, resp.AccessToken, expires) {
+		return
+	}
+	log.Printf("Exchanged token for %v for %s", targets, s.requestSource(r))
+	w.Header().Set("Cache-Control", "no-store")
+	s.writeJSON(w, http.StatusOK, resp)
+}
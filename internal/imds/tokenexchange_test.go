@@ -0,0 +1,159 @@
+package imds
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeTokenExchanger records the exchange it is asked for.
+type fakeTokenExchanger struct {
+	resp    *TokenExchangeResponse
+	err     error
+	subject string
+	req     TokenExchangeRequest
+}
+
+func (f *fakeTokenExchanger) ExchangeToken(ctx context.Context, subjectToken string, req TokenExchangeRequest) (*TokenExchangeResponse, error) {
+	f.subject, f.req = subjectToken, req
+	return f.resp, f.err
+}
+
+func TestSTSExchanger(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		wantToken string
+		wantOAuth string
+		wantErr   bool
+	}{
+		{name: "exchanged", status: http.StatusOK, body: `{"access_token":"at","issued_token_type":"urn:ietf:params:oauth:token-type:access_token","token_type":"Bearer","expires_in":300}`, wantToken: "at"},
+		{name: "rejected", status: http.StatusBadRequest, body: `{"error":"invalid_target","error_description":"unknown audience"}`, wantOAuth: "invalid_target", wantErr: true},
+		{name: "server error", status: http.StatusInternalServerError, body: `{"error":"server_error"}`, wantErr: true},
+		{name: "no access token", status: http.StatusOK, body: `{"token_type":"Bearer"}`, wantErr: true},
+		{name: "invalid JSON", status: http.StatusOK, body: `<html>`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var form map[string][]string
+			sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Errorf("ParseForm() error = %v", err)
+				}
+				form = r.PostForm
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer sts.Close()
+
+			exchanger := NewSTSExchanger(sts.URL, "imds", sts.Client())
+			resp, err := exchanger.ExchangeToken(context.Background(), "sa-token", TokenExchangeRequest{
+				Audience: []string{"https://sts.example.com"},
+				Resource: []string{"https://api.example.com"},
+				Scope:    "read",
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExchangeToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var oauthErr *TokenExchangeError
+			if errors.As(err, &oauthErr) != (tt.wantOAuth != "") || (oauthErr != nil && oauthErr.Code != tt.wantOAuth) {
+				t.Errorf("ExchangeToken() error = %v, want OAuth error %q", err, tt.wantOAuth)
+			}
+			if resp != nil && resp.AccessToken != tt.wantToken {
+				t.Errorf("access_token = %q, want %q", resp.AccessToken, tt.wantToken)
+			}
+
+			want := map[string][]string{
+				"grant_type":         {grantTypeTokenExchange},
+				"subject_token":      {"sa-token"},
+				"subject_token_type": {tokenTypeJWT},
+				"audience":           {"https://sts.example.com"},
+				"resource":           {"https://api.example.com"},
+				"scope":              {"read"},
+				"client_id":          {"imds"},
+			}
+			if !reflect.DeepEqual(form, want) {
+				t.Errorf("STS request = %v, want %v", form, want)
+			}
+		})
+	}
+}
+
+func TestHandleTokenExchange(t *testing.T) {
+	exchanged := &TokenExchangeResponse{AccessToken: "at", IssuedTokenType: "urn:ietf:params:oauth:token-type:access_token", TokenType: "Bearer"}
+
+	tests := []struct {
+		name        string
+		method      string
+		body        string
+		exchanger   *fakeTokenExchanger
+		subject     TokenSource
+		wantStatus  int
+		wantError   string
+		wantSubject string
+	}{
+		{name: "exchanged", method: http.MethodPost, body: "audience=https://sts.example.com&scope=read", exchanger: &fakeTokenExchanger{resp: exchanged}, wantStatus: http.StatusOK, wantSubject: "sa-token"},
+		{name: "resource", method: http.MethodPost, body: "resource=https://api.example.com", exchanger: &fakeTokenExchanger{resp: exchanged}, wantStatus: http.StatusOK, wantSubject: "sa-token"},
+		{name: "subject audience token", method: http.MethodPost, body: "audience=https://sts.example.com", exchanger: &fakeTokenExchanger{resp: exchanged}, subject: staticTokenSource{token: "sts-token"}, wantStatus: http.StatusOK, wantSubject: "sts-token"},
+		{name: "GET not allowed", method: http.MethodGet, exchanger: &fakeTokenExchanger{}, wantStatus: http.StatusMethodNotAllowed},
+		{name: "not enabled", method: http.MethodPost, body: "audience=https://sts.example.com", wantStatus: http.StatusNotFound},
+		{name: "no target", method: http.MethodPost, body: "scope=read", exchanger: &fakeTokenExchanger{}, wantStatus: http.StatusBadRequest, wantError: "invalid_request"},
+		{name: "target not allowed", method: http.MethodPost, body: "audience=https://sts.example.com&audience=https://other.example.com", exchanger: &fakeTokenExchanger{}, wantStatus: http.StatusForbidden, wantError: "target_not_allowed"},
+		{name: "subject unavailable", method: http.MethodPost, body: "audience=https://sts.example.com", exchanger: &fakeTokenExchanger{}, subject: staticTokenSource{err: fmt.Errorf("no token")}, wantStatus: http.StatusInternalServerError, wantError: "token_unavailable"},
+		{name: "STS rejected", method: http.MethodPost, body: "audience=https://sts.example.com", exchanger: &fakeTokenExchanger{err: &TokenExchangeError{Code: "invalid_target"}}, wantStatus: http.StatusForbidden, wantError: "exchange_rejected"},
+		{name: "STS unavailable", method: http.MethodPost, body: "audience=https://sts.example.com", exchanger: &fakeTokenExchanger{err: fmt.Errorf("connection refused")}, wantStatus: http.StatusBadGateway, wantError: "exchange_unavailable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer("", "test-ns", "test-vm", "default", "")
+			server.TokenSource = staticTokenSource{token: "sa-token"}
+			server.TokenExchangeTargets = []string{"https://sts.example.com", "https://api.example.com"}
+			server.TokenExchangeSubject = tt.subject
+			if tt.exchanger != nil {
+				server.TokenExchanger = tt.exchanger
+			}
+
+			req := httptest.NewRequest(tt.method, "/v1/token/exchange", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			server.newMux().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantError != "" {
+				var resp ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("failed to parse error response: %v", err)
+				}
+				if resp.Error != tt.wantError {
+					t.Errorf("error = %q, want %q", resp.Error, tt.wantError)
+				}
+			}
+			if w.Code == http.StatusOK {
+				var resp TokenExchangeResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("failed to parse response: %v", err)
+				}
+				if resp != *exchanged {
+					t.Errorf("response = %+v, want %+v", resp, *exchanged)
+				}
+				if tt.exchanger.subject != tt.wantSubject {
+					t.Errorf("subject token = %q, want %q", tt.exchanger.subject, tt.wantSubject)
+				}
+				if w.Header().Get("Cache-Control") != "no-store" {
+					t.Errorf("Cache-Control = %q, want no-store", w.Header().Get("Cache-Control"))
+				}
+			}
+		})
+	}
+}
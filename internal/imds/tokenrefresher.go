@@ -0,0 +1,188 @@
+package imds
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultTokenRefreshInterval is how often TokenRefresher checks the token
+const DefaultTokenRefreshInterval = 30 * time.Second
+
+// errTokenNotRead is reported until the first refresh has run
+var errTokenNotRead = fmt.Errorf("ServiceAccount token not read yet")
+
+// TokenRefresher keeps the ServiceAccount token from a TokenSource fresh in
+// the background. It renews the token once less than a fifth of its
+// lifetime is left, which is when the kubelet rotates projected tokens, and
+// reports it stale once less than a tenth is left. Rotation that broke is
+// then seen in readiness and metrics instead of by guests getting 401s.
+type TokenRefresher struct {
+	source   TokenSource
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.RWMutex
+	token   string
+	issued  time.Time
+	expires time.Time
+	lastErr error
+
+	failures atomic.Int64
+}
+
+// NewTokenRefresher creates a refresher checking source every interval.
+func NewTokenRefresher(source TokenSource, interval time.Duration) *TokenRefresher {
+	return &TokenRefresher{source: source, interval: interval, now: time.Now, lastErr: errTokenNotRead}
+}
+
+// Run refreshes the token immediately and then periodically until the
+// context is canceled.
+func (r *TokenRefresher) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if r.due() {
+			r.refresh(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Token returns the cached token while it isn't due for renewal, and
+// otherwise reads a new one from the source. If that fails, the cached
+// token is served until it expires.
+func (r *TokenRefresher) Token(ctx context.Context) (string, time.Time, error) {
+	if r.due() {
+		token, exp, err := r.refresh(ctx)
+		if err == nil {
+			return token, exp, nil
+		}
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		if r.token == "" || (!r.expires.IsZero() && !r.now().Before(r.expires)) {
+			return "", time.Time{}, err
+		}
+		return r.token, r.expires, nil
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.token, r.expires, nil
+}
+
+// Ready returns an error when there is no token, or when it is stale.
+// Tokens without a known expiration are never stale.
+func (r *TokenRefresher) Ready() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.token == "" {
+		return r.lastErr
+	}
+	if r.expires.IsZero() || r.now().Before(r.staleAt()) {
+		return nil
+	}
+	if r.lastErr != nil {
+		return fmt.Errorf("ServiceAccount token expires at %s and renewing it failed: %w", r.expires.Format(time.RFC3339), r.lastErr)
+	}
+	return fmt.Errorf("ServiceAccount token expires at %s and hasn't been rotated", r.expires.Format(time.RFC3339))
+}
+
+// ServeHTTP writes the token freshness metrics in the Prometheus text format.
+func (r *TokenRefresher) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.RLock()
+	expires, stale := r.expires, r.token != "" && !r.expires.IsZero() && !r.now().Before(r.staleAt())
+	r.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if !expires.IsZero() {
+		fmt.Fprintln(w, "# HELP imds_token_expiry_seconds Seconds until the served ServiceAccount token expires.")
+		fmt.Fprintln(w, "# TYPE imds_token_expiry_seconds gauge")
+		fmt.Fprintf(w, "imds_token_expiry_seconds %g\n", expires.Sub(r.now()).Seconds())
+	}
+	fmt.Fprintln(w, "# HELP imds_token_stale Whether the served ServiceAccount token has less than a tenth of its lifetime left.")
+	fmt.Fprintln(w, "# TYPE imds_token_stale gauge")
+	fmt.Fprintf(w, "imds_token_stale %d\n", boolToInt(stale))
+	fmt.Fprintln(w, "# HELP imds_token_refresh_errors_total Failed reads of the ServiceAccount token.")
+	fmt.Fprintln(w, "# TYPE imds_token_refresh_errors_total counter")
+	fmt.Fprintf(w, "imds_token_refresh_errors_total %d\n", r.failures.Load())
+}
+
+// String names the source in logs.
+func (r *TokenRefresher) String() string {
+	return fmt.Sprintf("%v, refreshed every %v", r.source, r.interval)
+}
+
+// due reports whether the token should be read again: there is none yet,
+// its expiration is unknown, or less than a fifth of its lifetime is left.
+func (r *TokenRefresher) due() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.token == "" || r.expires.IsZero() {
+		return true
+	}
+	return !r.now().Before(r.expires.Add(-r.lifetime() / 5))
+}
+
+// refresh reads the token from the source and caches it. Failures keep the
+// previous token, which may still be valid.
+func (r *TokenRefresher) refresh(ctx context.Context) (string, time.Time, error) {
+	token, exp, err := r.source.Token(ctx)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.failures.Add(1)
+		if r.lastErr == nil || r.lastErr.Error() != err.Error() {
+			log.Printf("Failed to renew the ServiceAccount token: %v", err)
+		}
+		r.lastErr = err
+		return "", time.Time{}, err
+	}
+	r.lastErr = nil
+	if token == r.token {
+		return token, exp, nil
+	}
+
+	// The kubelet sets iat on the tokens it projects; otherwise the
+	// lifetime starts when the token is first seen
+	r.issued = r.now()
+	if claims, err := parseJWTClaims(token); err == nil && claims.Iat != 0 {
+		r.issued = time.Unix(claims.Iat, 0)
+	}
+	if r.token != "" && !exp.IsZero() {
+		log.Printf("Renewed the ServiceAccount token, expires at %s", exp.Format(time.RFC3339))
+	}
+	r.token, r.expires = token, exp
+	return token, exp, nil
+}
+
+// lifetime is how long the cached token is valid for in total.
+func (r *TokenRefresher) lifetime() time.Duration {
+	return r.expires.Sub(r.issued)
+}
+
+// staleAt is when less than a tenth of the cached token's lifetime is left.
+func (r *TokenRefresher) staleAt() time.Time {
+	return r.expires.Add(-r.lifetime() / 10)
+}
+
+// boolToInt returns 1 for true and 0 for false.
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,130 @@
+package imds
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sequenceTokenSource returns its tokens in turn, then keeps returning err.
+type sequenceTokenSource struct {
+	tokens  []string
+	expires []time.Time
+	err     error
+	reads   int
+}
+
+func (s *sequenceTokenSource) Token(ctx context.Context) (string, time.Time, error) {
+	s.reads++
+	if len(s.tokens) == 0 {
+		return "", time.Time{}, s.err
+	}
+	token, exp := s.tokens[0], s.expires[0]
+	s.tokens, s.expires = s.tokens[1:], s.expires[1:]
+	return token, exp, nil
+}
+
+func TestTokenRefresherReady(t *testing.T) {
+	issued := time.Unix(1700000000, 0)
+	expires := issued.Add(time.Hour)
+	token := createTestJWT(t, map[string]interface{}{"iat": issued.Unix(), "exp": expires.Unix()})
+
+	tests := []struct {
+		name      string
+		token     string
+		expires   time.Time
+		now       time.Time
+		wantErr   string
+		wantStale bool
+	}{
+		{name: "fresh", token: token, expires: expires, now: issued.Add(30 * time.Minute)},
+		{name: "due but not stale", token: token, expires: expires, now: issued.Add(50 * time.Minute)},
+		{name: "stale", token: token, expires: expires, now: issued.Add(55 * time.Minute), wantErr: "hasn't been rotated", wantStale: true},
+		{name: "no token", now: issued, wantErr: "file not found"},
+		{name: "unknown expiry", token: "opaque", now: issued.Add(24 * time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &sequenceTokenSource{err: fmt.Errorf("file not found")}
+			if tt.token != "" {
+				source.tokens, source.expires = []string{tt.token}, []time.Time{tt.expires}
+			}
+			r := NewTokenRefresher(source, time.Minute)
+			r.now = func() time.Time { return tt.now }
+			r.refresh(context.Background())
+
+			err := r.Ready()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Ready() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Ready() error = %v, want %q", err, tt.wantErr)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+			wantStale := "imds_token_stale 0"
+			if tt.wantStale {
+				wantStale = "imds_token_stale 1"
+			}
+			if !strings.Contains(w.Body.String(), wantStale) {
+				t.Errorf("metrics = %q, want %q", w.Body.String(), wantStale)
+			}
+		})
+	}
+}
+
+func TestTokenRefresherToken(t *testing.T) {
+	issued := time.Unix(1700000000, 0)
+	first := createTestJWT(t, map[string]interface{}{"iat": issued.Unix(), "exp": issued.Add(time.Hour).Unix()})
+	second := createTestJWT(t, map[string]interface{}{"iat": issued.Add(48 * time.Minute).Unix(), "exp": issued.Add(108 * time.Minute).Unix()})
+	source := &sequenceTokenSource{
+		tokens:  []string{first, second},
+		expires: []time.Time{issued.Add(time.Hour), issued.Add(108 * time.Minute)},
+		err:     fmt.Errorf("broken"),
+	}
+	r := NewTokenRefresher(source, time.Minute)
+	now := issued
+	r.now = func() time.Time { return now }
+
+	steps := []struct {
+		now       time.Time
+		wantToken string
+		wantReads int
+		wantErr   bool
+	}{
+		// Read once, then served from the cache
+		{now: issued, wantToken: first, wantReads: 1},
+		{now: issued.Add(30 * time.Minute), wantToken: first, wantReads: 1},
+		// Renewed once less than a fifth of the lifetime is left
+		{now: issued.Add(49 * time.Minute), wantToken: second, wantReads: 2},
+		// A failed renewal keeps serving the cached token until it expires
+		{now: issued.Add(100 * time.Minute), wantToken: second, wantReads: 3},
+		{now: issued.Add(110 * time.Minute), wantReads: 4, wantErr: true},
+	}
+	for _, step := range steps {
+		now = step.now
+		token, _, err := r.Token(context.Background())
+		if (err != nil) != step.wantErr {
+			t.Errorf("at %v: Token() error = %v, wantErr %v", step.now.Sub(issued), err, step.wantErr)
+		}
+		if token != step.wantToken {
+			t.Errorf("at %v: Token() = %q, want %q", step.now.Sub(issued), token, step.wantToken)
+		}
+		if source.reads != step.wantReads {
+			t.Errorf("at %v: source read %d times, want %d", step.now.Sub(issued), source.reads, step.wantReads)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{"imds_token_expiry_seconds -120", "imds_token_refresh_errors_total 2"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("metrics = %q, want %q", w.Body.String(), want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package imds
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// TokenMinter mints ServiceAccount tokens for custom audiences.
+type TokenMinter interface {
+	MintToken(ctx context.Context, audience string) (string, time.Time, error)
+}
+
+// tokenRequestMinter mints tokens through the Kubernetes TokenRequest API.
+// The VM's ServiceAccount needs "create" on its own serviceaccounts/token.
+type tokenRequestMinter struct {
+	client            kubernetes.Interface
+	namespace         string
+	saName            string
+	expirationSeconds int64
+}
+
+// NewTokenRequestMinter creates a TokenMinter backed by the TokenRequest API.
+func NewTokenRequestMinter(client kubernetes.Interface, namespace, saName string, expirationSeconds int64) TokenMinter {
+	return &tokenRequestMinter{
+		client:            client,
+		namespace:         namespace,
+		saName:            saName,
+		expirationSeconds: expirationSeconds,
+	}
+}
+
+// MintToken requests a token for the given audience, or for the API
+// server's default audiences if it is empty.
+func (m *tokenRequestMinter) MintToken(ctx context.Context, audience string) (string, time.Time, error) {
+	expiration := m.expirationSeconds
+	tr := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			ExpirationSeconds: &expiration,
+		},
+	}
+	if audience != "" {
+		tr.Spec.Audiences = []string{audience}
+	}
+
+	resp, err := m.client.CoreV1().ServiceAccounts(m.namespace).CreateToken(ctx, m.saName, tr, metav1.CreateOptions{})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("TokenRequest for audience %q failed: %w", audience, err)
+	}
+
+	return resp.Status.Token, resp.Status.ExpirationTimestamp.Time, nil
+}
+
+// audienceAllowed reports whether the server may mint tokens for the audience.
+func (s *Server) audienceAllowed(audience string) bool {
+	for _, allowed := range s.AllowedAudiences {
+		if allowed == audience {
+			return true
+		}
+	}
+	return false
+}
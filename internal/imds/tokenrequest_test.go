@@ -0,0 +1,232 @@
+package imds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTokenMinter is a test TokenMinter recording requested audiences.
+type fakeTokenMinter struct {
+	err       error
+	audiences []string
+}
+
+func (f *fakeTokenMinter) MintToken(ctx context.Context, audience string) (string, time.Time, error) {
+	f.audiences = append(f.audiences, audience)
+	if f.err != nil {
+		return "", time.Time{}, f.err
+	}
+	return "minted-" + audience, time.Unix(1700000000, 0), nil
+}
+
+func TestHandleTokenAudience(t *testing.T) {
+	tests := []struct {
+		name       string
+		minter     *fakeTokenMinter
+		allowed    []string
+		audience   string
+		wantStatus int
+		wantError  string
+		wantToken  string
+		wantMinted bool
+	}{
+		{
+			name:       "allowed audience is minted",
+			minter:     &fakeTokenMinter{},
+			allowed:    []string{"vault", "sts.example.com"},
+			audience:   "vault",
+			wantStatus: http.StatusOK,
+			wantToken:  "minted-vault",
+			wantMinted: true,
+		},
+		{
+			name:       "audience not in allowlist is rejected",
+			minter:     &fakeTokenMinter{},
+			allowed:    []string{"vault"},
+			audience:   "evil.example.com",
+			wantStatus: http.StatusForbidden,
+			wantError:  "audience_not_allowed",
+		},
+		{
+			name:       "empty allowlist rejects everything",
+			minter:     &fakeTokenMinter{},
+			audience:   "vault",
+			wantStatus: http.StatusForbidden,
+			wantError:  "audience_not_allowed",
+		},
+		{
+			name:       "minting disabled",
+			audience:   "vault",
+			wantStatus: http.StatusBadRequest,
+			wantError:  "audience_unsupported",
+		},
+		{
+			name:       "TokenRequest failure returns 502",
+			minter:     &fakeTokenMinter{err: fmt.Errorf("forbidden")},
+			allowed:    []string{"vault"},
+			audience:   "vault",
+			wantStatus: http.StatusBadGateway,
+			wantError:  "token_unavailable",
+			wantMinted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &Server{AllowedAudiences: tt.allowed}
+			if tt.minter != nil {
+				server.TokenMinter = tt.minter
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/v1/token?audience="+tt.audience, nil)
+			w := httptest.NewRecorder()
+
+			server.handleToken(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("handleToken() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.minter != nil && (len(tt.minter.audiences) > 0) != tt.wantMinted {
+				t.Errorf("minted audiences = %v, wantMinted %v", tt.minter.audiences, tt.wantMinted)
+			}
+
+			if tt.wantError != "" {
+				var resp ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("failed to parse error response: %v", err)
+				}
+				if resp.Error != tt.wantError {
+					t.Errorf("error = %q, want %q", resp.Error, tt.wantError)
+				}
+				return
+			}
+
+			var resp TokenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to parse response: %v", err)
+			}
+			if resp.Token != tt.wantToken {
+				t.Errorf("token = %q, want %q", resp.Token, tt.wantToken)
+			}
+		})
+	}
+}
+
+func TestHandleTokenProjectedAudience(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audience-0")
+	if err := os.WriteFile(path, []byte("projected-vault\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	minter := &fakeTokenMinter{}
+	server := &Server{
+		TokenMinter:      minter,
+		AllowedAudiences: []string{"sts.example.com"},
+		AudienceTokenPaths: map[string]string{
+			"vault":   path,
+			"missing": filepath.Join(dir, "audience-1"),
+		},
+	}
+
+	tests := []struct {
+		audience   string
+		wantStatus int
+		wantToken  string
+	}{
+		{audience: "vault", wantStatus: http.StatusOK, wantToken: "projected-vault"},
+		{audience: "sts.example.com", wantStatus: http.StatusOK, wantToken: "minted-sts.example.com"},
+		{audience: "missing", wantStatus: http.StatusInternalServerError},
+		{audience: "other", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.audience, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v1/token?audience="+tt.audience, nil)
+			w := httptest.NewRecorder()
+
+			server.handleToken(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("handleToken() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantToken == "" {
+				return
+			}
+			var resp TokenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to parse response: %v", err)
+			}
+			if resp.Token != tt.wantToken {
+				t.Errorf("token = %q, want %q", resp.Token, tt.wantToken)
+			}
+		})
+	}
+
+	if len(minter.audiences) != 1 {
+		t.Errorf("minted audiences = %v, want only sts.example.com", minter.audiences)
+	}
+}
+
+func TestHandleNamedToken(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token-vault")
+	if err := os.WriteFile(path, []byte("projected-vault\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &Server{
+		AudienceTokenPaths: map[string]string{
+			"https://vault.example.com": path,
+			"sts.example.com":           filepath.Join(dir, "token-sts"),
+		},
+		TokenNames: map[string]string{
+			"vault": "https://vault.example.com",
+			"sts":   "sts.example.com",
+		},
+	}
+	mux := server.newMux()
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{path: "/v1/tokens", wantStatus: http.StatusOK, wantBody: `{"tokens":["sts","vault"]}`},
+		{path: "/v1/tokens/", wantStatus: http.StatusOK, wantBody: `{"tokens":["sts","vault"]}`},
+		{path: "/v1/tokens/vault?format=raw", wantStatus: http.StatusOK, wantBody: "projected-vault"},
+		{path: "/v1/tokens/vault?format=yaml", wantStatus: http.StatusBadRequest},
+		{path: "/v1/tokens/sts", wantStatus: http.StatusInternalServerError},
+		{path: "/v1/tokens/other", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantBody != "" && strings.TrimSpace(w.Body.String()) != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestNamedTokenRoutes(t *testing.T) {
+	for _, rt := range (&Server{}).routes() {
+		if strings.HasPrefix(rt.path, "/tokens") {
+			t.Errorf("route %s registered without named tokens", rt.path)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package imds
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// execTokenTimeout bounds a token command
+const execTokenTimeout = 10 * time.Second
+
+// TokenSource provides the VM's ServiceAccount token. The expiration is zero
+// when it isn't known.
+type TokenSource interface {
+	Token(ctx context.Context) (string, time.Time, error)
+}
+
+// fileTokenSource reads a kubelet-projected token file, which the kubelet
+// rotates in place.
+type fileTokenSource struct {
+	path string
+}
+
+// NewFileTokenSource creates a TokenSource reading a projected token file.
+func NewFileTokenSource(path string) TokenSource {
+	return fileTokenSource{path: path}
+}
+
+// Token reads the token and takes its expiration from the JWT.
+func (f fileTokenSource) Token(ctx context.Context) (string, time.Time, error) {
+	token, err := readTokenFile(f.path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	exp, _ := parseJWTExpiration(token)
+	return token, exp, nil
+}
+
+// String names the source in logs.
+func (f fileTokenSource) String() string {
+	return "file " + f.path
+}
+
+// tokenRequestSource requests tokens from the TokenRequest API and reuses
+// each until less than a fifth of its lifetime is left, like the kubelet.
+type tokenRequestSource struct {
+	minter   TokenMinter
+	audience string
+
+	mu      sync.Mutex
+	token   string
+	issued  time.Time
+	expires time.Time
+}
+
+// NewTokenRequestSource creates a TokenSource that requests tokens for the
+// audience through minter, such as NewTokenRequestMinter. Unlike projected
+// tokens these don't depend on the pod's volumes.
+func NewTokenRequestSource(minter TokenMinter, audience string) TokenSource {
+	return &tokenRequestSource{minter: minter, audience: audience}
+}
+
+// Token returns the cached token, or requests a new one when it is due.
+func (t *tokenRequestSource) Token(ctx context.Context) (string, time.Time, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.token != "" && now.Before(t.expires.Add(-t.expires.Sub(t.issued)/5)) {
+		return t.token, t.expires, nil
+	}
+	token, exp, err := t.minter.MintToken(ctx, t.audience)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	t.token, t.issued, t.expires = token, now, exp
+	return token, exp, nil
+}
+
+// String names the source in logs.
+func (t *tokenRequestSource) String() string {
+	if t.audience == "" {
+		return "TokenRequest for the default audiences"
+	}
+	return "TokenRequest for audience " + t.audience
+}
+
+// execTokenSource runs a command that prints the token, for credentials
+// brokered outside Kubernetes.
+type execTokenSource struct {
+	command []string
+}
+
+// NewExecTokenSource creates a TokenSource running command. The command
+// prints either the raw token or a client.authentication.k8s.io
+// ExecCredential, as kubectl credential plugins do, whose expiration is then
+// used.
+func NewExecTokenSource(command []string) (TokenSource, error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("token command is empty")
+	}
+	return execTokenSource{command: command}, nil
+}
+
+// ParseCommand splits a command from the environment. A JSON array of
+// strings is used as is, so arguments may contain spaces; anything else is
+// split on spaces.
+func ParseCommand(s string) ([]string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(s), "[") {
+		return strings.Fields(s), nil
+	}
+	var command []string
+	if err := json.Unmarshal([]byte(s), &command); err != nil {
+		return nil, fmt.Errorf("invalid command array: %w", err)
+	}
+	return command, nil
+}
+
+// Token runs the command and parses its output.
+func (e execTokenSource) Token(ctx context.Context) (string, time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, execTokenTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.command[0], e.command[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("token command %s failed: %w: %s", e.command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return parseTokenOutput(out)
+}
+
+// String names the source in logs.
+func (e execTokenSource) String() string {
+	return "command " + strings.Join(e.command, " ")
+}
+
+// parseTokenOutput parses a token command's output: an ExecCredential, or
+// the token itself.
+func parseTokenOutput(out []byte) (string, time.Time, error) {
+	out = bytes.TrimSpace(out)
+	if bytes.HasPrefix(out, []byte("{")) {
+		var cred ExecCredential
+		if err := json.Unmarshal(out, &cred); err != nil {
+			return "", time.Time{}, fmt.Errorf("invalid ExecCredential from token command: %w", err)
+		}
+		if cred.Status.Token == "" {
+			return "", time.Time{}, fmt.Errorf("ExecCredential from token command has no token")
+		}
+		var exp time.Time
+		if cred.Status.ExpirationTimestamp != nil {
+			exp = *cred.Status.ExpirationTimestamp
+		} else {
+			exp, _ = parseJWTExpiration(cred.Status.Token)
+		}
+		return cred.Status.Token, exp, nil
+	}
+	if len(out) == 0 {
+		return "", time.Time{}, fmt.Errorf("token command printed nothing")
+	}
+	token := string(out)
+	exp, _ := parseJWTExpiration(token)
+	return token, exp, nil
+}
+
+// tokenSource returns the server's TokenSource, by default the projected
+// file at TokenPath.
+func (s *Server) tokenSource() TokenSource {
+	if s.TokenSource != nil {
+		return s.TokenSource
+	}
+	return NewFileTokenSource(s.TokenPath)
+}
@@ -0,0 +1,182 @@
+package imds
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileTokenSource(t *testing.T) {
+	exp := time.Unix(1700000000, 0)
+	token := createTestJWT(t, map[string]interface{}{"exp": exp.Unix()})
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, gotExp, err := NewFileTokenSource(path).Token(context.Background())
+	if err != nil {
+		t.Fatalf("Token() error = %v", err)
+	}
+	if got != token || !gotExp.Equal(exp) {
+		t.Errorf("Token() = %q, %v, want %q, %v", got, gotExp, token, exp)
+	}
+
+	if _, _, err := NewFileTokenSource(filepath.Join(t.TempDir(), "missing")).Token(context.Background()); err == nil {
+		t.Error("Token() for a missing file expected error")
+	}
+}
+
+// countingMinter mints tokens valid for lifetime, numbering them.
+type countingMinter struct {
+	lifetime time.Duration
+	minted   int
+}
+
+func (c *countingMinter) MintToken(ctx context.Context, audience string) (string, time.Time, error) {
+	c.minted++
+	return fmt.Sprintf("token-%d", c.minted), time.Now().Add(c.lifetime), nil
+}
+
+func TestTokenRequestSource(t *testing.T) {
+	tests := []struct {
+		name       string
+		lifetime   time.Duration
+		wantMinted int
+	}{
+		{name: "reused while fresh", lifetime: time.Hour, wantMinted: 1},
+		{name: "renewed when nearly expired", lifetime: 0, wantMinted: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			minter := &countingMinter{lifetime: tt.lifetime}
+			source := NewTokenRequestSource(minter, "")
+			for i := 0; i < 2; i++ {
+				if _, _, err := source.Token(context.Background()); err != nil {
+					t.Fatalf("Token() error = %v", err)
+				}
+			}
+			if minter.minted != tt.wantMinted {
+				t.Errorf("minted %d tokens, want %d", minter.minted, tt.wantMinted)
+			}
+		})
+	}
+
+	failing := NewTokenRequestSource(&fakeTokenMinter{err: fmt.Errorf("forbidden")}, "api")
+	if _, _, err := failing.Token(context.Background()); err == nil {
+		t.Error("Token() with a failing minter expected error")
+	}
+}
+
+func TestExecTokenSource(t *testing.T) {
+	tests := []struct {
+		name      string
+		command   []string
+		wantToken string
+		wantExp   time.Time
+		wantErr   bool
+	}{
+		{name: "raw token", command: []string{"echo", "raw-token"}, wantToken: "raw-token"},
+		{
+			name:      "ExecCredential",
+			command:   []string{"echo", `{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential","status":{"token":"cred-token","expirationTimestamp":"2023-11-14T22:13:20Z"}}`},
+			wantToken: "cred-token",
+			wantExp:   time.Unix(1700000000, 0),
+		},
+		{name: "ExecCredential without token", command: []string{"echo", `{"status":{}}`}, wantErr: true},
+		{name: "no output", command: []string{"true"}, wantErr: true},
+		{name: "command fails", command: []string{"false"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := NewExecTokenSource(tt.command)
+			if err != nil {
+				t.Fatalf("NewExecTokenSource() error = %v", err)
+			}
+			token, exp, err := source.Token(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Token() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if token != tt.wantToken || !exp.Equal(tt.wantExp) {
+				t.Errorf("Token() = %q, %v, want %q, %v", token, exp, tt.wantToken, tt.wantExp)
+			}
+		})
+	}
+
+	if _, err := NewExecTokenSource(nil); err == nil {
+		t.Error("NewExecTokenSource(nil) expected error")
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "", want: []string{}},
+		{in: "/usr/bin/broker --audience vm", want: []string{"/usr/bin/broker", "--audience", "vm"}},
+		{in: `["/bin/sh", "-c", "broker --role 'web server'"]`, want: []string{"/bin/sh", "-c", "broker --role 'web server'"}},
+		{in: `["/bin/sh", 1]`, wantErr: true},
+		{in: `[`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseCommand(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseCommand() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// staticTokenSource serves a fixed token, or an error.
+type staticTokenSource struct {
+	token string
+	err   error
+}
+
+func (s staticTokenSource) Token(ctx context.Context) (string, time.Time, error) {
+	return s.token, time.Time{}, s.err
+}
+
+func TestHandleTokenSource(t *testing.T) {
+	tests := []struct {
+		name       string
+		source     TokenSource
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "token", source: staticTokenSource{token: "from-source"}, wantStatus: http.StatusOK, wantBody: "from-source"},
+		{name: "error", source: staticTokenSource{err: fmt.Errorf("unavailable")}, wantStatus: http.StatusInternalServerError, wantBody: "token_unavailable"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &Server{TokenSource: tt.source}
+			req := httptest.NewRequest(http.MethodGet, "/v1/token?format=raw", nil)
+			w := httptest.NewRecorder()
+			server.handleToken(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package imds
+
+import (
+	"log"
+	"net/http"
+)
+
+// SetTokensEnabled turns serving ServiceAccount tokens on or off at runtime,
+// for incident response on a VM suspected to be compromised. While off,
+// every endpoint handing out the VM's tokens returns 403.
+func (s *Server) SetTokensEnabled(enabled bool) {
+	if s.tokensDisabled.Swap(!enabled) == !enabled {
+		return
+	}
+	if enabled {
+		log.Printf("Token serving re-enabled")
+	} else {
+		log.Printf("Token serving disabled")
+	}
+}
+
+// TokensEnabled reports whether ServiceAccount tokens are served.
+func (s *Server) TokensEnabled() bool {
+	return !s.tokensDisabled.Load()
+}
+
+// requireTokensEnabled rejects requests for token endpoints while token
+// serving is turned off.
+func (s *Server) requireTokensEnabled(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.TokensEnabled() {
+			log.Printf("Rejected %s (token serving is disabled)", r.URL.Path)
+			s.writeError(w, http.StatusForbidden, "tokens_disabled", "Token serving is disabled for this VM")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,59 @@
+package imds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetTokensEnabled(t *testing.T) {
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("test-token"), 0644); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		enabled    []bool
+		path       string
+		wantStatus int
+	}{
+		{name: "enabled by default", path: "/v1/token", wantStatus: http.StatusOK},
+		{name: "disabled token", enabled: []bool{false}, path: "/v1/token", wantStatus: http.StatusForbidden},
+		{name: "disabled kubeconfig", enabled: []bool{false}, path: "/v1/kubeconfig", wantStatus: http.StatusForbidden},
+		{name: "disabled named token", enabled: []bool{false}, path: "/v1/tokens/vault", wantStatus: http.StatusForbidden},
+		{name: "disabled identity still served", enabled: []bool{false}, path: "/v1/identity", wantStatus: http.StatusOK},
+		{name: "re-enabled", enabled: []bool{false, true}, path: "/v1/token", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(tokenPath, "test-ns", "test-vm", "test-sa", "")
+			server.AudienceTokenPaths = map[string]string{"vault": tokenPath}
+			server.TokenNames = map[string]string{"vault": "vault"}
+			for _, enabled := range tt.enabled {
+				server.SetTokensEnabled(enabled)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			w := httptest.NewRecorder()
+			server.newMux().ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if w.Code == http.StatusForbidden {
+				var resp ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("failed to parse error response: %v", err)
+				}
+				if resp.Error != "tokens_disabled" {
+					t.Errorf("error = %q, want tokens_disabled", resp.Error)
+				}
+			}
+		})
+	}
+}
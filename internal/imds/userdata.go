@@ -0,0 +1,36 @@
+package imds
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+)
+
+// handleUserData handles GET /v1/user-data
+// The file is re-read on every request, so updates to the ConfigMap or Secret
+// it is mounted from are served as soon as the kubelet syncs them.
+func (s *Server) handleUserData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := os.ReadFile(s.UserDataPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		s.writeError(w, http.StatusNotFound, "not_found", "User data not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read user data from %s: %v", s.UserDataPath, err)
+		s.writeError(w, http.StatusInternalServerError, "user_data_unavailable", "Failed to read user data")
+		return
+	}
+
+	// User data is opaque to IMDS; cloud-init accepts scripts, cloud-config
+	// and gzip-compressed payloads alike
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
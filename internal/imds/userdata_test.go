@@ -0,0 +1,80 @@
+package imds
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandleUserData(t *testing.T) {
+	dir := t.TempDir()
+	userData := filepath.Join(dir, "user-data")
+	if err := os.WriteFile(userData, []byte("#cloud-config\nhostname: test\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		method     string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "serves file contents",
+			path:       userData,
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantBody:   "#cloud-config\nhostname: test\n",
+		},
+		{
+			name:       "missing file",
+			path:       filepath.Join(dir, "missing"),
+			method:     http.MethodGet,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "wrong method",
+			path:       userData,
+			method:     http.MethodPost,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &Server{UserDataPath: tt.path}
+			req := httptest.NewRequest(tt.method, "/v1/user-data", nil)
+			w := httptest.NewRecorder()
+
+			server.handleUserData(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("handleUserData() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("handleUserData() body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestUserDataRoute(t *testing.T) {
+	if routeRegistered((&Server{}).routes(), "/user-data") {
+		t.Error("/user-data registered without UserDataPath")
+	}
+	if !routeRegistered((&Server{UserDataPath: "/tmp/user-data"}).routes(), "/user-data") {
+		t.Error("/user-data not registered with UserDataPath")
+	}
+}
+
+func routeRegistered(routes []route, path string) bool {
+	for _, rt := range routes {
+		if rt.path == path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package kube
+
+import (
+	"fmt"
+	"net/http"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// SidecarConfig returns a client config for the IMDS sidecar.
+// The sidecar authenticates as the VM's ServiceAccount using the projected
+// token, which client-go re-reads from disk as the kubelet rotates it.
+func SidecarConfig(apiServerURL, tokenPath, caPath string) (*rest.Config, error) {
+	if apiServerURL == "" {
+		return nil, fmt.Errorf("kubernetes API server address is not configured")
+	}
+
+	return &rest.Config{
+		Host:            apiServerURL,
+		BearerTokenFile: tokenPath,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAFile: caPath,
+		},
+		UserAgent: "kubevirt-imds",
+	}, nil
+}
+
+// NewSidecarTransport creates an HTTP transport to the API server that
+// authenticates as the VM's ServiceAccount.
+func NewSidecarTransport(apiServerURL, tokenPath, caPath string) (http.RoundTripper, error) {
+	config, err := SidecarConfig(apiServerURL, tokenPath, caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes transport: %w", err)
+	}
+
+	return transport, nil
+}
+
+// NewSidecarClient creates a clientset authenticated as the VM's ServiceAccount.
+func NewSidecarClient(apiServerURL, tokenPath, caPath string) (kubernetes.Interface, error) {
+	config, err := SidecarConfig(apiServerURL, tokenPath, caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+
+	return client, nil
+}
@@ -0,0 +1,131 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// EventComponent is the source component of the Events the sidecar creates
+	EventComponent = "kubevirt-imds"
+	// DefaultEventInterval is how often an Event is created per reason
+	DefaultEventInterval = time.Minute
+	// eventTimeout bounds creating one Event
+	eventTimeout = 5 * time.Second
+)
+
+// VMIEventRecorder creates Warning Events on a VMI. An Event is created at
+// most once per Interval for each reason; repeats in between are counted and
+// reported with the next Event, so a misbehaving guest can't flood the API
+// server. The VM's ServiceAccount needs "create" on events.
+type VMIEventRecorder struct {
+	// Interval is how often an Event is created per reason
+	Interval time.Duration
+
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	host      string
+	now       func() time.Time
+
+	mu         sync.Mutex
+	uid        types.UID
+	sent       map[string]time.Time
+	suppressed map[string]int
+	seq        int
+	// wg tracks Events being created
+	wg sync.WaitGroup
+}
+
+// wait waits for the Events being created.
+func (e *VMIEventRecorder) wait() {
+	e.wg.Wait()
+}
+
+// NewVMIEventRecorder creates a VMIEventRecorder for the VMI namespace/name.
+// host is the node reported as the Events' source (optional).
+func NewVMIEventRecorder(client kubernetes.Interface, namespace, name, host string) *VMIEventRecorder {
+	return &VMIEventRecorder{
+		Interval:   DefaultEventInterval,
+		client:     client,
+		namespace:  namespace,
+		name:       name,
+		host:       host,
+		now:        time.Now,
+		sent:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+}
+
+// SetUID sets the VMI's UID, which tools such as kubectl describe use to
+// find its Events.
+func (e *VMIEventRecorder) SetUID(uid types.UID) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.uid = uid
+}
+
+// Warning records a Warning Event. It doesn't block: the Event is created in
+// the background, and failures are only logged.
+func (e *VMIEventRecorder) Warning(reason, message string) {
+	e.mu.Lock()
+	now := e.now()
+	if last, ok := e.sent[reason]; ok && now.Sub(last) < e.Interval {
+		e.suppressed[reason]++
+		e.mu.Unlock()
+		return
+	}
+	if n := e.suppressed[reason]; n > 0 {
+		message = fmt.Sprintf("%s (%d more since %s)", message, n, e.sent[reason].UTC().Format(time.RFC3339))
+	}
+	e.sent[reason] = now
+	delete(e.suppressed, reason)
+	e.seq++
+	event := e.event(reason, message, now)
+	e.mu.Unlock()
+
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+		defer cancel()
+		if _, err := e.client.CoreV1().Events(e.namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+			log.Printf("Failed to create %s Event on VMI %s/%s: %v", reason, e.namespace, e.name, err)
+		}
+	}()
+}
+
+// event builds the Event. The caller holds e.mu.
+func (e *VMIEventRecorder) event(reason, message string, now time.Time) *corev1.Event {
+	timestamp := metav1.NewTime(now)
+	return &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			// Named like client-go's Events, plus a sequence number for
+			// Events created at the same instant
+			Name:      fmt.Sprintf("%s.%x.%d", e.name, now.UnixNano(), e.seq),
+			Namespace: e.namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: VMIResource.Group + "/" + VMIResource.Version,
+			Kind:       "VirtualMachineInstance",
+			Namespace:  e.namespace,
+			Name:       e.name,
+			UID:        e.uid,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           corev1.EventTypeWarning,
+		Source:         corev1.EventSource{Component: EventComponent, Host: e.host},
+		FirstTimestamp: timestamp,
+		LastTimestamp:  timestamp,
+		Count:          1,
+	}
+}
@@ -0,0 +1,69 @@
+package kube
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestVMIEventRecorder(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	recorder := NewVMIEventRecorder(client, "default", "my-vm", "worker-1")
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	recorder.now = func() time.Time { return now }
+	recorder.SetUID("6f1c2d3e-4a5b-4c6d-8e7f-0a1b2c3d4e5f")
+
+	list := func() []corev1.Event {
+		t.Helper()
+		recorder.wait()
+		events, err := client.CoreV1().Events("default").List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return events.Items
+	}
+
+	recorder.Warning("RateLimited", "Rate limit exceeded by 10.0.2.2")
+	events := list()
+	if len(events) != 1 {
+		t.Fatalf("got %d Events, want 1", len(events))
+	}
+	event := events[0]
+	if event.Type != corev1.EventTypeWarning || event.Reason != "RateLimited" || event.Message != "Rate limit exceeded by 10.0.2.2" {
+		t.Errorf("unexpected Event %+v", event)
+	}
+	ref := event.InvolvedObject
+	if ref.Kind != "VirtualMachineInstance" || ref.APIVersion != "kubevirt.io/v1" || ref.Name != "my-vm" || ref.UID != "6f1c2d3e-4a5b-4c6d-8e7f-0a1b2c3d4e5f" {
+		t.Errorf("unexpected involved object %+v", ref)
+	}
+	if event.Source.Component != EventComponent || event.Source.Host != "worker-1" {
+		t.Errorf("unexpected source %+v", event.Source)
+	}
+
+	// Repeats within the interval are counted, other reasons still go out
+	recorder.Warning("RateLimited", "Rate limit exceeded by 10.0.2.2")
+	recorder.Warning("RateLimited", "Rate limit exceeded by 10.0.2.2")
+	recorder.Warning("SourceRejected", "Rejected /v1/token from 10.244.1.7")
+	if events := list(); len(events) != 2 {
+		t.Fatalf("got %d Events, want 2", len(events))
+	}
+
+	now = now.Add(DefaultEventInterval)
+	recorder.Warning("RateLimited", "Rate limit exceeded by 10.0.2.2")
+	events = list()
+	if len(events) != 3 {
+		t.Fatalf("got %d Events, want 3", len(events))
+	}
+	var found bool
+	for _, event := range events {
+		found = found || strings.HasSuffix(event.Message, "(2 more since 2026-03-01T12:00:00Z)")
+	}
+	if !found {
+		t.Errorf("no Event reports the suppressed repeats: %+v", events)
+	}
+}
@@ -0,0 +1,347 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+)
+
+// IMDSConfigResource is the cluster-scoped IMDSConfig resource.
+var IMDSConfigResource = schema.GroupVersionResource{
+	Group:    "imds.kubevirt.io",
+	Version:  "v1alpha1",
+	Resource: "imdsconfigs",
+}
+
+// IMDSConfigName is the name of the IMDSConfig holding the cluster policy.
+// Other IMDSConfig objects are ignored.
+const IMDSConfigName = "default"
+
+// Feature gates in IMDSConfig spec.featureGates. A gate set to false turns
+// the feature off regardless of VM annotations; unset gates are on.
+const (
+	FeatureTokenAudiences  = "TokenAudiences"
+	FeatureSPIFFE          = "SPIFFE"
+	FeatureIPv6            = "IPv6"
+	FeatureDNS             = "DNS"
+	FeatureDHCPRoutes      = "DHCPRoutes"
+	FeatureFirewall        = "Firewall"
+	FeatureSourceAllowlist = "SourceAllowlist"
+	FeatureNotrack         = "Notrack"
+	FeatureCertificates    = "Certificates"
+	FeatureSSHCertificates = "SSHCertificates"
+	FeatureTokenExchange   = "TokenExchange"
+	FeatureTokenBinding    = "TokenBinding"
+	FeatureAttestation     = "Attestation"
+	FeatureSecrets         = "Secrets"
+	FeatureConfigMaps      = "ConfigMaps"
+	FeaturePodMetadata     = "PodMetadata"
+	FeatureNodeInfo        = "NodeInfo"
+	FeatureEC2Identity     = "EC2Identity"
+	FeatureEvents          = "Events"
+	FeatureTLS             = "TLS"
+	FeatureOIDC            = "OIDC"
+	FeatureKubernetesProxy = "KubernetesProxy"
+	FeatureTokenCommand    = "TokenCommand"
+)
+
+// GatedEnv lists the sidecar environment variables controlled by each
+// feature gate. The sidecar unsets them when their gate is off, and the
+// webhook refuses to pass them through then.
+var GatedEnv = map[string][]string{
+	FeatureTokenAudiences:  {"IMDS_ALLOWED_AUDIENCES", "IMDS_AUDIENCE_TOKENS", "IMDS_TOKEN_NAMES"},
+	FeatureSPIFFE:          {"IMDS_SPIFFE_SOCKET"},
+	FeatureIPv6:            {"IMDS_IPV6_ENABLED"},
+	FeatureDNS:             {"IMDS_DNS_ENABLED", "IMDS_DNS_NAME"},
+	FeatureDHCPRoutes:      {"IMDS_DHCP_ROUTES"},
+	FeatureFirewall:        {"IMDS_FIREWALL"},
+	FeatureSourceAllowlist: {"IMDS_SOURCE_ALLOWLIST"},
+	FeatureNotrack:         {"IMDS_NOTRACK"},
+	FeatureCertificates:    {"IMDS_CERTIFICATE_SIGNER"},
+	FeatureSSHCertificates: {"IMDS_SSH_SIGNER"},
+	FeatureTokenExchange:   {"IMDS_TOKEN_EXCHANGE_URL"},
+	FeatureTokenBinding:    {"IMDS_TOKEN_BINDING"},
+	FeatureAttestation:     {"IMDS_ATTESTATION_POLICY", "IMDS_KEYLIME_VERIFIER_URL"},
+	FeatureSecrets:         {"IMDS_EXPOSE_SECRETS"},
+	FeatureConfigMaps:      {"IMDS_EXPOSE_CONFIGMAPS"},
+	FeaturePodMetadata:     {"IMDS_POD_INFO_DIR"},
+	FeatureNodeInfo:        {"IMDS_NODE_INFO"},
+	FeatureEC2Identity:     {"IMDS_EC2_IDENTITY_CERT"},
+	FeatureEvents:          {"IMDS_EVENTS"},
+	FeatureTLS:             {"IMDS_TLS_DIR"},
+	FeatureOIDC:            {"IMDS_OIDC"},
+	FeatureKubernetesProxy: {"IMDS_KUBERNETES_PROXY_PATHS"},
+	FeatureTokenCommand:    {"IMDS_TOKEN_COMMAND"},
+}
+
+// IMDSConfigSpec is the spec of an IMDSConfig.
+type IMDSConfigSpec struct {
+	IMDSPolicy `json:",inline"`
+	// ExemptNamespaces never get IMDS, whatever their VMs request. Entries
+	// may be patterns such as "openshift-*".
+	ExemptNamespaces []string `json:"exemptNamespaces,omitempty"`
+	// Overrides replace parts of the cluster policy for single namespaces
+	Overrides []IMDSNamespaceOverride `json:"overrides,omitempty"`
+	// Install configures the webhook installed by imds-operator. The webhook
+	// itself ignores it.
+	Install IMDSInstall `json:"install,omitempty"`
+}
+
+// IMDSInstall is the webhook installation managed by imds-operator. Unset
+// fields use the operator's defaults.
+type IMDSInstall struct {
+	// WebhookImage is the webhook image
+	WebhookImage string `json:"webhookImage,omitempty"`
+	// Replicas is the number of webhook replicas
+	Replicas *int32 `json:"replicas,omitempty"`
+}
+
+// Conditions in IMDSConfig status.conditions, set by imds-operator
+const (
+	// ConditionAvailable is true while a webhook replica is ready
+	ConditionAvailable = "Available"
+	// ConditionDegraded is true while the last reconcile failed
+	ConditionDegraded = "Degraded"
+)
+
+// IMDSConfigStatus is the status of an IMDSConfig, written by imds-operator.
+type IMDSConfigStatus struct {
+	// ObservedGeneration is the generation the conditions describe
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// IMDSPolicy is the part of the IMDS policy that namespaces can override.
+type IMDSPolicy struct {
+	// InjectByDefault injects IMDS into VMs that don't set
+	// imds.kubevirt.io/enabled
+	InjectByDefault *bool `json:"injectByDefault,omitempty"`
+	// AllowedAudiences may be minted by every VM, in addition to the ones in
+	// its imds.kubevirt.io/allowed-audiences annotation
+	AllowedAudiences []string `json:"allowedAudiences,omitempty"`
+	// FeatureGates turns features off by name
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+	// Endpoints restricts IMDS endpoint groups by name
+	Endpoints map[string]EndpointAccess `json:"endpoints,omitempty"`
+	// Image replaces the webhook's sidecar image. Pin it by digest
+	// (repository@sha256:...) to run a vetted build.
+	Image string `json:"image,omitempty"`
+}
+
+// EndpointAccess restricts a group of IMDS endpoints.
+type EndpointAccess struct {
+	// Enabled set to false stops serving the group
+	Enabled *bool `json:"enabled,omitempty"`
+	// RequireSource serves the group only to the VM's own IPs
+	RequireSource bool `json:"requireSource,omitempty"`
+}
+
+// IMDSNamespaceOverride is the policy for a single namespace.
+type IMDSNamespaceOverride struct {
+	Namespace  string `json:"namespace"`
+	IMDSPolicy `json:",inline"`
+}
+
+// Exempt reports whether IMDS is never injected into the namespace.
+func (s *IMDSConfigSpec) Exempt(namespace string) bool {
+	return MatchNamespace(s.ExemptNamespaces, namespace)
+}
+
+// MatchNamespace reports whether a namespace matches any of the names or
+// path.Match patterns.
+func MatchNamespace(patterns []string, namespace string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyFor returns the policy for a namespace: the cluster policy with the
+// namespace's override applied. Override fields that are set replace the
+// cluster ones, except feature gates and endpoints, which are merged by name.
+func (s *IMDSConfigSpec) PolicyFor(namespace string) IMDSPolicy {
+	policy := IMDSPolicy{
+		InjectByDefault:  s.InjectByDefault,
+		AllowedAudiences: s.AllowedAudiences,
+		Image:            s.Image,
+		FeatureGates:     make(map[string]bool, len(s.FeatureGates)),
+	}
+	for gate, enabled := range s.FeatureGates {
+		policy.FeatureGates[gate] = enabled
+	}
+	if s.Endpoints != nil {
+		policy.Endpoints = make(map[string]EndpointAccess, len(s.Endpoints))
+		for group, access := range s.Endpoints {
+			policy.Endpoints[group] = access
+		}
+	}
+
+	for _, override := range s.Overrides {
+		if override.Namespace != namespace {
+			continue
+		}
+		if override.InjectByDefault != nil {
+			policy.InjectByDefault = override.InjectByDefault
+		}
+		if override.AllowedAudiences != nil {
+			policy.AllowedAudiences = override.AllowedAudiences
+		}
+		if override.Image != "" {
+			policy.Image = override.Image
+		}
+		for gate, enabled := range override.FeatureGates {
+			policy.FeatureGates[gate] = enabled
+		}
+		for group, access := range override.Endpoints {
+			if policy.Endpoints == nil {
+				policy.Endpoints = make(map[string]EndpointAccess)
+			}
+			policy.Endpoints[group] = access
+		}
+	}
+	return policy
+}
+
+// FeatureEnabled reports whether a feature gate is on. Unset gates are on.
+func (p IMDSPolicy) FeatureEnabled(gate string) bool {
+	enabled, ok := p.FeatureGates[gate]
+	return !ok || enabled
+}
+
+// ParseIMDSConfig extracts the spec from an IMDSConfig object.
+func ParseIMDSConfig(obj *unstructured.Unstructured) (*IMDSConfigSpec, error) {
+	raw, ok := obj.Object["spec"].(map[string]interface{})
+	if !ok {
+		return &IMDSConfigSpec{}, nil
+	}
+	var spec IMDSConfigSpec
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &spec); err != nil {
+		return nil, fmt.Errorf("invalid IMDSConfig spec: %w", err)
+	}
+	if err := validImage(spec.Image); err != nil {
+		return nil, fmt.Errorf("invalid IMDSConfig spec: %w", err)
+	}
+	for _, override := range spec.Overrides {
+		if err := validImage(override.Image); err != nil {
+			return nil, fmt.Errorf("invalid IMDSConfig override for namespace %s: %w", override.Namespace, err)
+		}
+	}
+	if err := validImage(spec.Install.WebhookImage); err != nil {
+		return nil, fmt.Errorf("invalid IMDSConfig install: %w", err)
+	}
+	if spec.Install.Replicas != nil && *spec.Install.Replicas < 0 {
+		return nil, fmt.Errorf("invalid IMDSConfig install: replicas must not be negative")
+	}
+	return &spec, nil
+}
+
+// imageDigest matches the digest of an image pinned as repository@digest
+var imageDigest = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// validImage checks an optional image reference, including its digest when
+// it is pinned by one.
+func validImage(image string) error {
+	if image == "" {
+		return nil
+	}
+	if strings.ContainsAny(image, " \t\n") {
+		return fmt.Errorf("image %q contains whitespace", image)
+	}
+	if i := strings.Index(image, "@"); i >= 0 {
+		if i == 0 || !imageDigest.MatchString(image[i+1:]) {
+			return fmt.Errorf("image %q must be pinned as repository@sha256:<64 hex digits>", image)
+		}
+	}
+	return nil
+}
+
+// GetIMDSConfig reads the cluster IMDSConfig.
+// The caller needs "get" on imdsconfigs.
+func GetIMDSConfig(ctx context.Context, client dynamic.Interface) (*IMDSConfigSpec, error) {
+	obj, err := client.Resource(IMDSConfigResource).Get(ctx, IMDSConfigName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get IMDSConfig %s: %w", IMDSConfigName, err)
+	}
+	return ParseIMDSConfig(obj)
+}
+
+// imdsConfigRetryInterval is how long WatchIMDSConfig waits after a failed
+// watch, e.g. while the CRD isn't installed
+const imdsConfigRetryInterval = 30 * time.Second
+
+// WatchIMDSConfig calls onChange with the cluster IMDSConfig whenever it
+// changes, and with nil while it doesn't exist, until the context is
+// canceled. The caller needs "list" and "watch" on imdsconfigs.
+func WatchIMDSConfig(ctx context.Context, client dynamic.Interface, onChange func(*IMDSConfigSpec)) {
+	resource := client.Resource(IMDSConfigResource)
+	for ctx.Err() == nil {
+		if err := watchIMDSConfigOnce(ctx, resource, onChange); err != nil {
+			log.Printf("IMDSConfig watch failed: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(imdsConfigRetryInterval):
+			}
+		}
+	}
+}
+
+// watchIMDSConfigOnce lists the IMDSConfig and follows its changes until the
+// watch closes.
+func watchIMDSConfigOnce(ctx context.Context, resource dynamic.NamespaceableResourceInterface, onChange func(*IMDSConfigSpec)) error {
+	selector := fields.OneTermEqualSelector("metadata.name", IMDSConfigName).String()
+	list, err := resource.List(ctx, metav1.ListOptions{FieldSelector: selector})
+	if err != nil {
+		return err
+	}
+	var spec *IMDSConfigSpec
+	if len(list.Items) > 0 {
+		if spec, err = ParseIMDSConfig(&list.Items[0]); err != nil {
+			return err
+		}
+	}
+	onChange(spec)
+
+	w, err := resource.Watch(ctx, metav1.ListOptions{
+		FieldSelector:   selector,
+		ResourceVersion: list.GetResourceVersion(),
+	})
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+
+	for event := range w.ResultChan() {
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			obj, ok := event.Object.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			spec, err := ParseIMDSConfig(obj)
+			if err != nil {
+				log.Printf("Ignoring IMDSConfig %s: %v", IMDSConfigName, err)
+				continue
+			}
+			onChange(spec)
+		case watch.Deleted:
+			onChange(nil)
+		case watch.Error:
+			return fmt.Errorf("watch error: %v", event.Object)
+		}
+	}
+	return nil
+}
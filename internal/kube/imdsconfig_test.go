@@ -0,0 +1,310 @@
+package kube
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestParseIMDSConfig(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "imds.kubevirt.io/v1alpha1",
+		"kind":       "IMDSConfig",
+		"metadata":   map[string]interface{}{"name": IMDSConfigName},
+		"spec": map[string]interface{}{
+			"injectByDefault":  true,
+			"allowedAudiences": []interface{}{"vault"},
+			"featureGates":     map[string]interface{}{FeatureSPIFFE: false},
+			"exemptNamespaces": []interface{}{"kube-system"},
+			"overrides": []interface{}{
+				map[string]interface{}{"namespace": "dev", "injectByDefault": false},
+			},
+		},
+	}}
+
+	got, err := ParseIMDSConfig(obj)
+	if err != nil {
+		t.Fatalf("ParseIMDSConfig() error = %v", err)
+	}
+
+	enabled, disabled := true, false
+	want := &IMDSConfigSpec{
+		IMDSPolicy: IMDSPolicy{
+			InjectByDefault:  &enabled,
+			AllowedAudiences: []string{"vault"},
+			FeatureGates:     map[string]bool{FeatureSPIFFE: false},
+		},
+		ExemptNamespaces: []string{"kube-system"},
+		Overrides: []IMDSNamespaceOverride{
+			{Namespace: "dev", IMDSPolicy: IMDSPolicy{InjectByDefault: &disabled}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseIMDSConfig() = %+v, want %+v", got, want)
+	}
+
+	if got, err := ParseIMDSConfig(&unstructured.Unstructured{Object: map[string]interface{}{}}); err != nil || !reflect.DeepEqual(got, &IMDSConfigSpec{}) {
+		t.Errorf("ParseIMDSConfig(no spec) = %+v, %v; want empty spec", got, err)
+	}
+
+	for _, spec := range []map[string]interface{}{
+		{"allowedAudiences": "vault"},
+		{"image": "imds@sha256:short"},
+		{"image": "imds:v1 "},
+		{"overrides": []interface{}{
+			map[string]interface{}{"namespace": "dev", "image": "@sha256:" + strings.Repeat("a", 64)},
+		}},
+		{"install": map[string]interface{}{"webhookImage": "webhook@sha256:short"}},
+		{"install": map[string]interface{}{"replicas": int64(-1)}},
+	} {
+		bad := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+		if _, err := ParseIMDSConfig(bad); err == nil {
+			t.Errorf("ParseIMDSConfig(%v) expected error", spec)
+		}
+	}
+
+	pinned := "registry.example.com/imds@sha256:" + strings.Repeat("0", 64)
+	obj.Object["spec"] = map[string]interface{}{"image": pinned}
+	if got, err := ParseIMDSConfig(obj); err != nil || got.Image != pinned {
+		t.Errorf("ParseIMDSConfig(pinned image) = %+v, %v; want image %s", got, err, pinned)
+	}
+
+	obj.Object["spec"] = map[string]interface{}{
+		"install": map[string]interface{}{"webhookImage": "kubevirt-imds-webhook:v2", "replicas": int64(2)},
+	}
+	if got, err := ParseIMDSConfig(obj); err != nil || got.Install.WebhookImage != "kubevirt-imds-webhook:v2" || *got.Install.Replicas != 2 {
+		t.Errorf("ParseIMDSConfig(install) = %+v, %v; want webhook image and 2 replicas", got, err)
+	}
+}
+
+func TestIMDSConfigPolicyFor(t *testing.T) {
+	enabled, disabled := true, false
+	spec := &IMDSConfigSpec{
+		IMDSPolicy: IMDSPolicy{
+			InjectByDefault:  &enabled,
+			AllowedAudiences: []string{"vault"},
+			FeatureGates:     map[string]bool{FeatureSPIFFE: false, FeatureDNS: true},
+		},
+		ExemptNamespaces: []string{"kube-system", "openshift-*"},
+		Overrides: []IMDSNamespaceOverride{
+			{
+				Namespace: "dev",
+				IMDSPolicy: IMDSPolicy{
+					InjectByDefault: &disabled,
+					FeatureGates:    map[string]bool{FeatureDNS: false},
+				},
+			},
+			{
+				Namespace:  "ci",
+				IMDSPolicy: IMDSPolicy{AllowedAudiences: []string{}, Image: "imds:vetted"},
+			},
+		},
+	}
+
+	tests := []struct {
+		namespace     string
+		want          IMDSPolicy
+		exempt        bool
+		spiffeEnabled bool
+		dnsEnabled    bool
+	}{
+		{
+			namespace: "prod",
+			want: IMDSPolicy{
+				InjectByDefault:  &enabled,
+				AllowedAudiences: []string{"vault"},
+				FeatureGates:     map[string]bool{FeatureSPIFFE: false, FeatureDNS: true},
+			},
+			dnsEnabled: true,
+		},
+		{
+			namespace: "dev",
+			want: IMDSPolicy{
+				InjectByDefault:  &disabled,
+				AllowedAudiences: []string{"vault"},
+				FeatureGates:     map[string]bool{FeatureSPIFFE: false, FeatureDNS: false},
+			},
+		},
+		{
+			namespace: "ci",
+			want: IMDSPolicy{
+				InjectByDefault:  &enabled,
+				AllowedAudiences: []string{},
+				FeatureGates:     map[string]bool{FeatureSPIFFE: false, FeatureDNS: true},
+				Image:            "imds:vetted",
+			},
+			dnsEnabled: true,
+		},
+		{
+			namespace: "kube-system",
+			want: IMDSPolicy{
+				InjectByDefault:  &enabled,
+				AllowedAudiences: []string{"vault"},
+				FeatureGates:     map[string]bool{FeatureSPIFFE: false, FeatureDNS: true},
+			},
+			exempt:     true,
+			dnsEnabled: true,
+		},
+		{
+			namespace: "openshift-monitoring",
+			want: IMDSPolicy{
+				InjectByDefault:  &enabled,
+				AllowedAudiences: []string{"vault"},
+				FeatureGates:     map[string]bool{FeatureSPIFFE: false, FeatureDNS: true},
+			},
+			exempt:     true,
+			dnsEnabled: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			got := spec.PolicyFor(tt.namespace)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PolicyFor() = %+v, want %+v", got, tt.want)
+			}
+			if got := spec.Exempt(tt.namespace); got != tt.exempt {
+				t.Errorf("Exempt() = %v, want %v", got, tt.exempt)
+			}
+			if got.FeatureEnabled(FeatureSPIFFE) != tt.spiffeEnabled {
+				t.Errorf("FeatureEnabled(%s) = %v, want %v", FeatureSPIFFE, !tt.spiffeEnabled, tt.spiffeEnabled)
+			}
+			if got.FeatureEnabled(FeatureDNS) != tt.dnsEnabled {
+				t.Errorf("FeatureEnabled(%s) = %v, want %v", FeatureDNS, !tt.dnsEnabled, tt.dnsEnabled)
+			}
+			if !got.FeatureEnabled(FeatureIPv6) {
+				t.Errorf("FeatureEnabled(%s) = false for an unset gate", FeatureIPv6)
+			}
+		})
+	}
+
+	// Overrides never leak into the cluster policy
+	if !spec.FeatureGates[FeatureDNS] {
+		t.Error("PolicyFor() modified the cluster feature gates")
+	}
+}
+
+func TestIMDSConfigPolicyForEndpoints(t *testing.T) {
+	disabled := false
+	spec := &IMDSConfigSpec{
+		IMDSPolicy: IMDSPolicy{
+			Endpoints: map[string]EndpointAccess{
+				"token":       {RequireSource: true},
+				"credentials": {Enabled: &disabled},
+			},
+		},
+		Overrides: []IMDSNamespaceOverride{
+			{
+				Namespace: "dev",
+				IMDSPolicy: IMDSPolicy{
+					Endpoints: map[string]EndpointAccess{"credentials": {}},
+				},
+			},
+			{
+				Namespace: "kiosk",
+				IMDSPolicy: IMDSPolicy{
+					Endpoints: map[string]EndpointAccess{"metadata": {RequireSource: true}},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		namespace string
+		want      map[string]EndpointAccess
+	}{
+		{
+			namespace: "prod",
+			want: map[string]EndpointAccess{
+				"token":       {RequireSource: true},
+				"credentials": {Enabled: &disabled},
+			},
+		},
+		{
+			namespace: "dev",
+			want: map[string]EndpointAccess{
+				"token":       {RequireSource: true},
+				"credentials": {},
+			},
+		},
+		{
+			namespace: "kiosk",
+			want: map[string]EndpointAccess{
+				"token":       {RequireSource: true},
+				"credentials": {Enabled: &disabled},
+				"metadata":    {RequireSource: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			if got := spec.PolicyFor(tt.namespace).Endpoints; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PolicyFor().Endpoints = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// Overrides never leak into the cluster policy
+	if len(spec.Endpoints) != 2 {
+		t.Errorf("PolicyFor() modified the cluster endpoints: %+v", spec.Endpoints)
+	}
+
+	// Without endpoints anywhere, the policy has none
+	if got := (&IMDSConfigSpec{}).PolicyFor("prod").Endpoints; got != nil {
+		t.Errorf("PolicyFor().Endpoints = %+v, want nil", got)
+	}
+}
+
+func TestMatchNamespace(t *testing.T) {
+	patterns := []string{"kube-system", "openshift-*", "[invalid"}
+	tests := []struct {
+		namespace string
+		want      bool
+	}{
+		{"kube-system", true},
+		{"kube-system-2", false},
+		{"openshift-monitoring", true},
+		{"openshift", false},
+		{"[invalid", false},
+		{"default", false},
+	}
+	for _, tt := range tests {
+		if got := MatchNamespace(patterns, tt.namespace); got != tt.want {
+			t.Errorf("MatchNamespace(%q) = %v, want %v", tt.namespace, got, tt.want)
+		}
+	}
+}
+
+func TestWatchIMDSConfig(t *testing.T) {
+	config := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "imds.kubevirt.io/v1alpha1",
+		"kind":       "IMDSConfig",
+		"metadata":   map[string]interface{}{"name": IMDSConfigName},
+		"spec":       map[string]interface{}{"exemptNamespaces": []interface{}{"kube-system"}},
+	}}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{IMDSConfigResource: "IMDSConfigList"}, config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := make(chan *IMDSConfigSpec, 10)
+	go WatchIMDSConfig(ctx, client, func(spec *IMDSConfigSpec) { updates <- spec })
+
+	select {
+	case got := <-updates:
+		if got == nil || !got.Exempt("kube-system") {
+			t.Errorf("initial IMDSConfig = %+v, want kube-system exempt", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for IMDSConfig")
+	}
+}
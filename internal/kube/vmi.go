@@ -0,0 +1,258 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+)
+
+// VMIResource is the KubeVirt VirtualMachineInstance resource.
+// It is accessed through the dynamic client to avoid depending on the
+// KubeVirt API module.
+var VMIResource = schema.GroupVersionResource{
+	Group:    "kubevirt.io",
+	Version:  "v1",
+	Resource: "virtualmachineinstances",
+}
+
+// VMIInterface is a guest network interface reported in the VMI status.
+type VMIInterface struct {
+	Name string   `json:"name"`
+	MAC  string   `json:"mac"`
+	IPs  []string `json:"ips,omitempty"`
+}
+
+// VMIInstance describes the VM a VMI runs.
+type VMIInstance struct {
+	UID          string
+	Created      time.Time
+	Architecture string
+	// InstanceType is the name of the VM's instancetype, if it has one
+	InstanceType string
+	// Image is the first volume's containerDisk image, DataVolume or PVC
+	Image string
+}
+
+// Annotations KubeVirt sets on VMIs created from an instancetype
+const (
+	annotationInstancetypeName        = "kubevirt.io/instancetype-name"
+	annotationClusterInstancetypeName = "kubevirt.io/cluster-instancetype-name"
+)
+
+// NewSidecarDynamicClient creates a dynamic client authenticated as the VM's ServiceAccount.
+func NewSidecarDynamicClient(apiServerURL, tokenPath, caPath string) (dynamic.Interface, error) {
+	config, err := SidecarConfig(apiServerURL, tokenPath, caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dynamic client: %w", err)
+	}
+
+	return client, nil
+}
+
+// GetVMIInterfaces returns the guest interfaces reported in the VMI status.
+// The VM's ServiceAccount needs "get" on virtualmachineinstances.
+func GetVMIInterfaces(ctx context.Context, client dynamic.Interface, namespace, name string) ([]VMIInterface, error) {
+	vmi, err := client.Resource(VMIResource).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get VMI %s/%s: %w", namespace, name, err)
+	}
+	return ParseVMIInterfaces(vmi)
+}
+
+// AnnotationTokenEnabled on a VMI set to "false" makes its sidecar stop
+// serving ServiceAccount tokens until the annotation is removed or set to
+// "true", without restarting the VM.
+const AnnotationTokenEnabled = "imds.kubevirt.io/token-enabled"
+
+// TokensEnabled reports whether the VMI's sidecar may serve tokens, per
+// AnnotationTokenEnabled.
+func TokensEnabled(vmi *unstructured.Unstructured) bool {
+	return vmi.GetAnnotations()[AnnotationTokenEnabled] != "false"
+}
+
+// WatchVMIInterfaces calls onChange with the VMI's interfaces whenever the
+// VMI changes, until the context is canceled. onChange is also called each
+// time the watch is re-established, so consumers periodically resync and
+// must tolerate repeated, unchanged interface lists.
+// The VM's ServiceAccount needs "get" and "watch" on virtualmachineinstances.
+func WatchVMIInterfaces(ctx context.Context, client dynamic.Interface, namespace, name string, onChange func([]VMIInterface)) {
+	WatchVMI(ctx, client, namespace, name, func(vmi *unstructured.Unstructured) {
+		interfaces, err := ParseVMIInterfaces(vmi)
+		if err != nil {
+			log.Printf("Ignoring interfaces of VMI %s/%s: %v", namespace, name, err)
+			return
+		}
+		onChange(interfaces)
+	})
+}
+
+// WatchVMI calls onChange with the VMI whenever it changes, until the
+// context is canceled, and again each time the watch is re-established.
+// The VM's ServiceAccount needs "get" and "watch" on virtualmachineinstances.
+func WatchVMI(ctx context.Context, client dynamic.Interface, namespace, name string, onChange func(*unstructured.Unstructured)) {
+	resource := client.Resource(VMIResource).Namespace(namespace)
+	for ctx.Err() == nil {
+		if err := watchVMIOnce(ctx, resource, name, onChange); err != nil {
+			log.Printf("VMI watch for %s/%s failed: %v", namespace, name, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+}
+
+// watchVMIOnce reads the VMI and follows its changes until the watch closes.
+func watchVMIOnce(ctx context.Context, resource dynamic.ResourceInterface, name string, onChange func(*unstructured.Unstructured)) error {
+	vmi, err := resource.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	onChange(vmi)
+
+	w, err := resource.Watch(ctx, metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+		ResourceVersion: vmi.GetResourceVersion(),
+	})
+	if err != nil {
+		return err
+	}
+	defer w.Stop()
+
+	for event := range w.ResultChan() {
+		switch event.Type {
+		case watch.Added, watch.Modified:
+			if obj, ok := event.Object.(*unstructured.Unstructured); ok {
+				onChange(obj)
+			}
+		case watch.Error:
+			return fmt.Errorf("watch error: %v", event.Object)
+		}
+	}
+	return nil
+}
+
+// ParseVMIInterfaces extracts the guest interfaces from a VMI object.
+// status.interfaces is authoritative, but is only populated once the guest
+// runs. Interfaces with an explicit spec MAC (spec.domain.devices.interfaces
+// [].macAddress) are known before boot, so their MACs fill in anything the
+// status doesn't report yet.
+func ParseVMIInterfaces(vmi *unstructured.Unstructured) ([]VMIInterface, error) {
+	items, _, err := unstructured.NestedSlice(vmi.Object, "status", "interfaces")
+	if err != nil {
+		return nil, fmt.Errorf("invalid VMI status.interfaces: %w", err)
+	}
+	specMACs, err := specInterfaceMACs(vmi)
+	if err != nil {
+		return nil, err
+	}
+
+	var interfaces []VMIInterface
+	for _, item := range items {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		iface := VMIInterface{}
+		iface.Name, _, _ = unstructured.NestedString(obj, "name")
+		iface.MAC, _, _ = unstructured.NestedString(obj, "mac")
+
+		// ipAddresses lists every address; ipAddress is the primary one
+		// and is all older KubeVirt versions report
+		iface.IPs, _, _ = unstructured.NestedStringSlice(obj, "ipAddresses")
+		if len(iface.IPs) == 0 {
+			if ip, _, _ := unstructured.NestedString(obj, "ipAddress"); ip != "" {
+				iface.IPs = []string{ip}
+			}
+		}
+
+		if iface.MAC == "" {
+			iface.MAC = specMACs[iface.Name]
+		}
+		delete(specMACs, iface.Name)
+
+		interfaces = append(interfaces, iface)
+	}
+
+	// Interfaces the guest hasn't reported yet, in spec order
+	specItems, _, _ := unstructured.NestedSlice(vmi.Object, "spec", "domain", "devices", "interfaces")
+	for _, item := range specItems {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(obj, "name")
+		if mac, ok := specMACs[name]; ok {
+			interfaces = append(interfaces, VMIInterface{Name: name, MAC: mac})
+		}
+	}
+
+	return interfaces, nil
+}
+
+// specInterfaceMACs returns the explicitly configured MACs from
+// spec.domain.devices.interfaces, keyed by interface name.
+func specInterfaceMACs(vmi *unstructured.Unstructured) (map[string]string, error) {
+	items, _, err := unstructured.NestedSlice(vmi.Object, "spec", "domain", "devices", "interfaces")
+	if err != nil {
+		return nil, fmt.Errorf("invalid VMI spec.domain.devices.interfaces: %w", err)
+	}
+
+	macs := make(map[string]string)
+	for _, item := range items {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _, _ := unstructured.NestedString(obj, "name")
+		if mac, _, _ := unstructured.NestedString(obj, "macAddress"); mac != "" {
+			macs[name] = mac
+		}
+	}
+	return macs, nil
+}
+
+// ParseVMIInstance extracts what describes the VM from a VMI object.
+func ParseVMIInstance(vmi *unstructured.Unstructured) VMIInstance {
+	instance := VMIInstance{
+		UID:     string(vmi.GetUID()),
+		Created: vmi.GetCreationTimestamp().Time,
+	}
+	instance.Architecture, _, _ = unstructured.NestedString(vmi.Object, "spec", "architecture")
+
+	annotations := vmi.GetAnnotations()
+	instance.InstanceType = annotations[annotationInstancetypeName]
+	if instance.InstanceType == "" {
+		instance.InstanceType = annotations[annotationClusterInstancetypeName]
+	}
+
+	volumes, _, _ := unstructured.NestedSlice(vmi.Object, "spec", "volumes")
+	if len(volumes) > 0 {
+		if volume, ok := volumes[0].(map[string]interface{}); ok {
+			for _, field := range [][]string{
+				{"containerDisk", "image"},
+				{"dataVolume", "name"},
+				{"persistentVolumeClaim", "claimName"},
+			} {
+				if v, _, _ := unstructured.NestedString(volume, field...); v != "" {
+					instance.Image = v
+					break
+				}
+			}
+		}
+	}
+	return instance
+}
@@ -0,0 +1,280 @@
+package kube
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestParseVMIInterfaces(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    map[string]interface{}
+		status  map[string]interface{}
+		want    []VMIInterface
+		wantErr bool
+	}{
+		{
+			name: "ipAddresses preferred over ipAddress",
+			status: map[string]interface{}{
+				"interfaces": []interface{}{
+					map[string]interface{}{
+						"name":        "default",
+						"mac":         "52:54:00:12:34:56",
+						"ipAddress":   "10.0.2.2",
+						"ipAddresses": []interface{}{"10.0.2.2", "fd10:0:2::2"},
+					},
+				},
+			},
+			want: []VMIInterface{
+				{Name: "default", MAC: "52:54:00:12:34:56", IPs: []string{"10.0.2.2", "fd10:0:2::2"}},
+			},
+		},
+		{
+			name: "ipAddress only",
+			status: map[string]interface{}{
+				"interfaces": []interface{}{
+					map[string]interface{}{"name": "default", "mac": "52:54:00:12:34:56", "ipAddress": "10.0.2.2"},
+				},
+			},
+			want: []VMIInterface{
+				{Name: "default", MAC: "52:54:00:12:34:56", IPs: []string{"10.0.2.2"}},
+			},
+		},
+		{
+			name: "interface without addresses yet",
+			status: map[string]interface{}{
+				"interfaces": []interface{}{
+					map[string]interface{}{"name": "default", "mac": "52:54:00:12:34:56"},
+				},
+			},
+			want: []VMIInterface{
+				{Name: "default", MAC: "52:54:00:12:34:56"},
+			},
+		},
+		{
+			name:   "no interfaces reported",
+			status: map[string]interface{}{},
+			want:   nil,
+		},
+		{
+			name: "spec MACs before boot",
+			spec: specInterfaces(
+				map[string]interface{}{"name": "default", "macAddress": "02:00:00:00:00:01"},
+				map[string]interface{}{"name": "secondary"},
+			),
+			status: map[string]interface{}{},
+			want: []VMIInterface{
+				{Name: "default", MAC: "02:00:00:00:00:01"},
+			},
+		},
+		{
+			name: "status preferred over spec",
+			spec: specInterfaces(
+				map[string]interface{}{"name": "default", "macAddress": "02:00:00:00:00:01"},
+				map[string]interface{}{"name": "secondary", "macAddress": "02:00:00:00:00:02"},
+			),
+			status: map[string]interface{}{
+				"interfaces": []interface{}{
+					map[string]interface{}{"name": "default", "mac": "52:54:00:12:34:56", "ipAddress": "10.0.2.2"},
+					map[string]interface{}{"name": "secondary", "ipAddress": "192.168.1.10"},
+				},
+			},
+			want: []VMIInterface{
+				{Name: "default", MAC: "52:54:00:12:34:56", IPs: []string{"10.0.2.2"}},
+				{Name: "secondary", MAC: "02:00:00:00:00:02", IPs: []string{"192.168.1.10"}},
+			},
+		},
+		{
+			name:    "malformed interfaces",
+			status:  map[string]interface{}{"interfaces": "eth0"},
+			wantErr: true,
+		},
+		{
+			name:    "malformed spec interfaces",
+			spec:    map[string]interface{}{"domain": map[string]interface{}{"devices": map[string]interface{}{"interfaces": "eth0"}}},
+			status:  map[string]interface{}{},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmi := &unstructured.Unstructured{Object: map[string]interface{}{"status": tt.status}}
+			if tt.spec != nil {
+				vmi.Object["spec"] = tt.spec
+			}
+			got, err := ParseVMIInterfaces(vmi)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("ParseVMIInterfaces() expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseVMIInterfaces() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseVMIInterfaces() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// specInterfaces builds a VMI spec with the given domain interfaces.
+func specInterfaces(interfaces ...interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"domain": map[string]interface{}{
+			"devices": map[string]interface{}{"interfaces": interfaces},
+		},
+	}
+}
+
+func TestTokensEnabled(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        bool
+	}{
+		{name: "not annotated", want: true},
+		{name: "enabled", annotations: map[string]string{AnnotationTokenEnabled: "true"}, want: true},
+		{name: "disabled", annotations: map[string]string{AnnotationTokenEnabled: "false"}, want: false},
+		{name: "other annotations", annotations: map[string]string{"imds.kubevirt.io/firewall": "false"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmi := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			vmi.SetAnnotations(tt.annotations)
+			if got := TokensEnabled(vmi); got != tt.want {
+				t.Errorf("TokensEnabled() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVMIInstance(t *testing.T) {
+	created := metav1.NewTime(time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC))
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		spec        map[string]interface{}
+		want        VMIInstance
+	}{
+		{
+			name:        "containerDisk and instancetype",
+			annotations: map[string]string{"kubevirt.io/instancetype-name": "u1.medium"},
+			spec: map[string]interface{}{
+				"architecture": "arm64",
+				"volumes": []interface{}{
+					map[string]interface{}{"name": "rootdisk", "containerDisk": map[string]interface{}{"image": "quay.io/containerdisks/fedora:40"}},
+					map[string]interface{}{"name": "cloudinit", "cloudInitNoCloud": map[string]interface{}{}},
+				},
+			},
+			want: VMIInstance{Architecture: "arm64", InstanceType: "u1.medium", Image: "quay.io/containerdisks/fedora:40"},
+		},
+		{
+			name:        "dataVolume and cluster instancetype",
+			annotations: map[string]string{"kubevirt.io/cluster-instancetype-name": "cx1.large"},
+			spec: map[string]interface{}{
+				"volumes": []interface{}{
+					map[string]interface{}{"name": "rootdisk", "dataVolume": map[string]interface{}{"name": "fedora-root"}},
+				},
+			},
+			want: VMIInstance{InstanceType: "cx1.large", Image: "fedora-root"},
+		},
+		{
+			name: "PVC",
+			spec: map[string]interface{}{
+				"volumes": []interface{}{
+					map[string]interface{}{"name": "rootdisk", "persistentVolumeClaim": map[string]interface{}{"claimName": "root"}},
+				},
+			},
+			want: VMIInstance{Image: "root"},
+		},
+		{name: "no volumes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmi := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			if tt.spec != nil {
+				vmi.Object["spec"] = tt.spec
+			}
+			vmi.SetUID("6f1c2d3e-4a5b-4c6d-8e7f-0a1b2c3d4e5f")
+			vmi.SetCreationTimestamp(created)
+			vmi.SetAnnotations(tt.annotations)
+
+			tt.want.UID = "6f1c2d3e-4a5b-4c6d-8e7f-0a1b2c3d4e5f"
+			tt.want.Created = created.Time
+			got := ParseVMIInstance(vmi)
+			if !got.Created.Equal(tt.want.Created) {
+				t.Errorf("Created = %v, want %v", got.Created, tt.want.Created)
+			}
+			got.Created = tt.want.Created
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseVMIInstance() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchVMIInterfaces(t *testing.T) {
+	vmi := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachineInstance",
+		"metadata":   map[string]interface{}{"name": "test-vm", "namespace": "test-ns"},
+		"status": map[string]interface{}{
+			"interfaces": []interface{}{
+				map[string]interface{}{"name": "default", "mac": "52:54:00:12:34:56"},
+			},
+		},
+	}}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{VMIResource: "VirtualMachineInstanceList"}, vmi)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := make(chan []VMIInterface, 10)
+	go WatchVMIInterfaces(ctx, client, "test-ns", "test-vm", func(interfaces []VMIInterface) {
+		updates <- interfaces
+	})
+
+	select {
+	case got := <-updates:
+		if len(got) != 1 || len(got[0].IPs) != 0 {
+			t.Fatalf("initial interfaces = %+v, want one interface without IPs", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for VMI interfaces")
+	}
+
+	// The guest agent reports an address. The fake client drops updates made
+	// before the watch is established, so keep updating until one arrives.
+	updated := vmi.DeepCopy()
+	unstructured.SetNestedSlice(updated.Object, []interface{}{
+		map[string]interface{}{"name": "default", "mac": "52:54:00:12:34:56", "ipAddress": "10.0.2.2"},
+	}, "status", "interfaces")
+	for i := 0; i < 50; i++ {
+		if _, err := client.Resource(VMIResource).Namespace("test-ns").Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("failed to update VMI: %v", err)
+		}
+		select {
+		case got := <-updates:
+			if len(got) != 1 || !reflect.DeepEqual(got[0].IPs, []string{"10.0.2.2"}) {
+				t.Errorf("updated interfaces = %+v, want IP 10.0.2.2", got)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	t.Fatal("timed out waiting for updated VMI interfaces")
+}
@@ -0,0 +1,106 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// EnsureARPGuard only lets ARP from the VM's tap ports reach the IMDS veth.
+//
+// The bridge floods ARP requests to every port, so without the guard the
+// IMDS veth also answers requests coming in from other bridge members, such
+// as the pod's original NIC with the bridge binding. The rules live in a
+// bridge-family table and are rebuilt from the bridge's current tap ports,
+// so this should be re-run when links change.
+func EnsureARPGuard(iface string) error {
+	port, taps, err := bridgePorts(iface)
+	if err != nil {
+		return err
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables connection: %w", err)
+	}
+
+	table := imdsBridgeTable()
+	chain := replaceChain(conn, &nftables.Chain{
+		Name:     "arp_guard",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	for _, exprs := range arpGuardRules(port, taps) {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to install ARP guard rules: %w", err)
+	}
+	return nil
+}
+
+// bridgePorts returns the bridge-side peer of the IMDS veth and the tap
+// devices attached to the same bridge.
+func bridgePorts(iface string) (string, []string, error) {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get %s: %w", iface, err)
+	}
+	veth, ok := link.(*netlink.Veth)
+	if !ok {
+		return "", nil, fmt.Errorf("%s is not a veth (type: %s)", iface, link.Type())
+	}
+	peerIndex, err := netlink.VethPeerIndex(veth)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get peer of %s: %w", iface, err)
+	}
+	peer, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get peer of %s: %w", iface, err)
+	}
+	bridgeIndex := peer.Attrs().MasterIndex
+	if bridgeIndex == 0 {
+		return "", nil, fmt.Errorf("%s is not attached to a bridge", peer.Attrs().Name)
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to list network links: %w", err)
+	}
+	var taps []string
+	for _, l := range links {
+		if l.Attrs().MasterIndex == bridgeIndex && l.Type() == "tuntap" {
+			taps = append(taps, l.Attrs().Name)
+		}
+	}
+
+	return peer.Attrs().Name, taps, nil
+}
+
+// arpGuardRules builds the arp_guard chain:
+//
+//	oifname <port> ether type arp iifname <tap> accept    (per tap)
+//	oifname <port> ether type arp drop
+func arpGuardRules(port string, taps []string) [][]expr.Any {
+	matchARP := func() []expr.Any {
+		return append(matchOIFName(port),
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseLLHeader, Offset: 12, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(unix.ETH_P_ARP)},
+		)
+	}
+
+	var rules [][]expr.Any
+	for _, tap := range taps {
+		rule := append(matchARP(), matchIIFName(tap)...)
+		rules = append(rules, append(rule, &expr.Verdict{Kind: expr.VerdictAccept}))
+	}
+	rules = append(rules, append(matchARP(), &expr.Verdict{Kind: expr.VerdictDrop}))
+	return rules
+}
@@ -0,0 +1,57 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/nftables/expr"
+)
+
+func TestARPGuardRules(t *testing.T) {
+	port := testVeth + "-br"
+
+	tests := []struct {
+		name string
+		taps []string
+	}{
+		{name: "no taps"},
+		{name: "one tap", taps: []string{"tap0"}},
+		{name: "two taps", taps: []string{"tap0", "tap1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := arpGuardRules(port, tt.taps)
+			if len(rules) != len(tt.taps)+1 {
+				t.Fatalf("got %d rules, want %d", len(rules), len(tt.taps)+1)
+			}
+
+			for i, rule := range rules {
+				cmp, ok := rule[1].(*expr.Cmp)
+				if !ok || !bytes.Equal(cmp.Data, ifname(port)) {
+					t.Errorf("rule %d: first comparison = %+v, want oifname %s", i, rule[1], port)
+				}
+				cmp, ok = rule[3].(*expr.Cmp)
+				if !ok || !bytes.Equal(cmp.Data, []byte{0x08, 0x06}) {
+					t.Errorf("rule %d: second comparison = %+v, want ether type arp", i, rule[3])
+				}
+
+				verdict, ok := rule[len(rule)-1].(*expr.Verdict)
+				if !ok {
+					t.Fatalf("rule %d: last expression = %T, want *expr.Verdict", i, rule[len(rule)-1])
+				}
+				if i < len(tt.taps) {
+					cmp, ok := rule[5].(*expr.Cmp)
+					if !ok || !bytes.Equal(cmp.Data, ifname(tt.taps[i])) {
+						t.Errorf("rule %d: third comparison = %+v, want iifname %s", i, rule[5], tt.taps[i])
+					}
+					if verdict.Kind != expr.VerdictAccept {
+						t.Errorf("rule %d: verdict = %v, want accept", i, verdict.Kind)
+					}
+				} else if verdict.Kind != expr.VerdictDrop {
+					t.Errorf("rule %d: verdict = %v, want drop", i, verdict.Kind)
+				}
+			}
+		})
+	}
+}
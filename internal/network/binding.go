@@ -0,0 +1,52 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// Bindings that use a KubeVirt (k6t-*) bridge
+const (
+	BindingBridge     = "bridge"
+	BindingMasquerade = "masquerade"
+)
+
+// DetectBridgeBinding tells the bridge and masquerade bindings apart, since
+// both create a k6t bridge. With the bridge binding the pod's eth0 is moved
+// onto the bridge and its IP and MAC are handed to the guest, so the bridge
+// has no IPv4 address. With masquerade the bridge holds the gateway address
+// the guest routes through (e.g. 10.0.2.1).
+func DetectBridgeBinding(bridgeName string) (string, error) {
+	bridge, err := GetBridge(bridgeName)
+	if err != nil {
+		return "", err
+	}
+
+	addrs, err := netlink.AddrList(bridge, netlink.FAMILY_V4)
+	if err != nil {
+		return "", fmt.Errorf("failed to list addresses on %s: %w", bridgeName, err)
+	}
+
+	return bridgeBinding(addrs), nil
+}
+
+// bridgeBinding returns the binding for a k6t bridge with the given IPv4 addresses.
+func bridgeBinding(addrs []netlink.Addr) string {
+	if len(addrs) > 0 {
+		return BindingMasquerade
+	}
+	return BindingBridge
+}
+
+// GuestLink returns the interface whose neighbor table holds the guest's
+// MACs for a VM on a k6t bridge. With the bridge binding the guest resolves
+// the IMDS address itself, so it is a neighbor of the IMDS interface.
+// Masquerade guests send IMDS traffic to the gateway on the bridge, with
+// either the veth or the DNAT rule, so their MACs are learned there.
+func GuestLink(binding, bridgeName, imdsIface string) string {
+	if binding == BindingMasquerade {
+		return bridgeName
+	}
+	return imdsIface
+}
@@ -0,0 +1,55 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestBridgeBinding(t *testing.T) {
+	tests := []struct {
+		name  string
+		addrs []netlink.Addr
+		want  string
+	}{
+		{
+			name: "no address",
+			want: BindingBridge,
+		},
+		{
+			name: "gateway address",
+			addrs: []netlink.Addr{
+				{IPNet: &net.IPNet{IP: net.ParseIP("10.0.2.1"), Mask: net.CIDRMask(24, 32)}},
+			},
+			want: BindingMasquerade,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bridgeBinding(tt.addrs); got != tt.want {
+				t.Errorf("bridgeBinding() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGuestLink(t *testing.T) {
+	tests := []struct {
+		binding string
+		want    string
+	}{
+		{binding: BindingBridge, want: "imds-1a2b3c"},
+		{binding: BindingMasquerade, want: "k6t-eth0"},
+		{binding: "", want: "imds-1a2b3c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.binding, func(t *testing.T) {
+			if got := GuestLink(tt.binding, "k6t-eth0", "imds-1a2b3c"); got != tt.want {
+				t.Errorf("GuestLink(%q) = %q, want %q", tt.binding, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	// captureSnapLen is the maximum number of bytes captured per frame
+	captureSnapLen = 65535
+	// linkTypeEthernet is the pcap link type for Ethernet frames
+	linkTypeEthernet = 1
+)
+
+// Capture writes the ARP and IMDS HTTP traffic seen on the interface to w
+// in pcap format until the context is canceled, so connectivity problems can
+// be debugged without tcpdump in the image. Writes are passed through as
+// frames arrive, so w may stream them.
+func Capture(ctx context.Context, iface string, w io.Writer) error {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", iface, err)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: ifi.Index}); err != nil {
+		return fmt.Errorf("failed to bind packet socket to %s: %w", iface, err)
+	}
+	// Wake up regularly to notice cancellation
+	tv := syscall.NsecToTimeval(int64(200 * time.Millisecond))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return fmt.Errorf("failed to set receive timeout: %w", err)
+	}
+
+	if _, err := w.Write(pcapHeader()); err != nil {
+		return err
+	}
+
+	buf := make([]byte, captureSnapLen)
+	for ctx.Err() == nil {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			return fmt.Errorf("failed to read from %s: %w", iface, err)
+		}
+		if !isIMDSTraffic(buf[:n]) {
+			continue
+		}
+		if _, err := w.Write(pcapRecord(time.Now(), buf[:n])); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pcapHeader returns the pcap global header for Ethernet captures.
+func pcapHeader() []byte {
+	h := make([]byte, 24)
+	binary.LittleEndian.PutUint32(h[0:4], 0xa1b2c3d4) // magic, microsecond timestamps
+	binary.LittleEndian.PutUint16(h[4:6], 2)          // version 2.4
+	binary.LittleEndian.PutUint16(h[6:8], 4)
+	binary.LittleEndian.PutUint32(h[16:20], captureSnapLen)
+	binary.LittleEndian.PutUint32(h[20:24], linkTypeEthernet)
+	return h
+}
+
+// pcapRecord returns a pcap record holding the frame.
+func pcapRecord(ts time.Time, frame []byte) []byte {
+	r := make([]byte, 16, 16+len(frame))
+	binary.LittleEndian.PutUint32(r[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(r[4:8], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(r[8:12], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(r[12:16], uint32(len(frame)))
+	return append(r, frame...)
+}
+
+// isIMDSTraffic reports whether the Ethernet frame is ARP or TCP to or from
+// the IMDS port, over IPv4 or IPv6.
+func isIMDSTraffic(frame []byte) bool {
+	if len(frame) < 14 {
+		return false
+	}
+	payload := frame[14:]
+
+	var l4 []byte
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case syscall.ETH_P_ARP:
+		return true
+	case syscall.ETH_P_IP:
+		if len(payload) < 20 || payload[9] != syscall.IPPROTO_TCP {
+			return false
+		}
+		ihl := int(payload[0]&0x0f) * 4
+		if len(payload) < ihl {
+			return false
+		}
+		l4 = payload[ihl:]
+	case syscall.ETH_P_IPV6:
+		// Extension headers are rare for IMDS traffic and not followed
+		if len(payload) < 40 || payload[6] != syscall.IPPROTO_TCP {
+			return false
+		}
+		l4 = payload[40:]
+	default:
+		return false
+	}
+
+	if len(l4) < 4 {
+		return false
+	}
+	return binary.BigEndian.Uint16(l4[0:2]) == IMDSPort || binary.BigEndian.Uint16(l4[2:4]) == IMDSPort
+}
@@ -0,0 +1,84 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsIMDSTraffic(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+
+	// frame builds an Ethernet frame with the given ethertype and payload
+	frame := func(etherType uint16, payload []byte) []byte {
+		f := make([]byte, 14)
+		copy(f[6:12], mac)
+		binary.BigEndian.PutUint16(f[12:14], etherType)
+		return append(f, payload...)
+	}
+	ipv4 := func(proto byte, srcPort, dstPort uint16) []byte {
+		p := make([]byte, 24)
+		p[0] = 0x45
+		p[9] = proto
+		binary.BigEndian.PutUint16(p[20:22], srcPort)
+		binary.BigEndian.PutUint16(p[22:24], dstPort)
+		return p
+	}
+	ipv6 := func(next byte, srcPort, dstPort uint16) []byte {
+		p := make([]byte, 44)
+		p[0] = 0x60
+		p[6] = next
+		binary.BigEndian.PutUint16(p[40:42], srcPort)
+		binary.BigEndian.PutUint16(p[42:44], dstPort)
+		return p
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  bool
+	}{
+		{name: "ARP", frame: buildGratuitousARP(mac, net.ParseIP(IMDSAddress)), want: true},
+		{name: "IPv4 request", frame: frame(0x0800, ipv4(6, 40000, 80)), want: true},
+		{name: "IPv4 response", frame: frame(0x0800, ipv4(6, 80, 40000)), want: true},
+		{name: "IPv4 other port", frame: frame(0x0800, ipv4(6, 40000, 443)), want: false},
+		{name: "IPv4 UDP", frame: frame(0x0800, ipv4(17, 68, 67)), want: false},
+		{name: "IPv6 request", frame: frame(0x86dd, ipv6(6, 40000, 80)), want: true},
+		{name: "IPv6 ICMP", frame: frame(0x86dd, ipv6(58, 0, 0)), want: false},
+		{name: "truncated IPv4", frame: frame(0x0800, ipv4(6, 40000, 80)[:10]), want: false},
+		{name: "runt frame", frame: []byte{0xff, 0xff}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isIMDSTraffic(tt.frame); got != tt.want {
+				t.Errorf("isIMDSTraffic() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPcapRecord(t *testing.T) {
+	header := pcapHeader()
+	if len(header) != 24 || binary.LittleEndian.Uint32(header[0:4]) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(header[20:24]) != linkTypeEthernet {
+		t.Errorf("pcapHeader() = %x, want little-endian Ethernet pcap header", header)
+	}
+
+	ts := time.Unix(1700000000, 123456000)
+	frame := []byte{1, 2, 3}
+	record := pcapRecord(ts, frame)
+
+	if got := binary.LittleEndian.Uint32(record[0:4]); got != 1700000000 {
+		t.Errorf("seconds = %d, want 1700000000", got)
+	}
+	if got := binary.LittleEndian.Uint32(record[4:8]); got != 123456 {
+		t.Errorf("microseconds = %d, want 123456", got)
+	}
+	if got := binary.LittleEndian.Uint32(record[8:12]); got != 3 {
+		t.Errorf("captured length = %d, want 3", got)
+	}
+	if string(record[16:]) != string(frame) {
+		t.Errorf("record data = %v, want %v", record[16:], frame)
+	}
+}
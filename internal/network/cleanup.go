@@ -0,0 +1,63 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+)
+
+// CleanupDummy removes the passt dummy interface if it exists.
+func CleanupDummy() error {
+	return deleteLink(DummyIMDS, "dummy")
+}
+
+// CleanupMacvlan removes the macvtap-mode macvlan if it exists. Its ingress
+// qdisc and filters are removed along with it.
+func CleanupMacvlan() error {
+	return deleteLink(MacvlanIMDS, "macvlan")
+}
+
+// CleanupNftables removes the IMDS nftables tables, and with them the
+// masquerade DNAT, firewall and ARP guard chains, if they exist.
+func CleanupNftables() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables connection: %w", err)
+	}
+
+	tables, err := conn.ListTables()
+	if err != nil {
+		return fmt.Errorf("failed to list nftables tables: %w", err)
+	}
+	for _, table := range tables {
+		if table.Name != nftTableName {
+			continue
+		}
+		conn.DelTable(table)
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to delete table %s: %w", nftTableName, err)
+	}
+
+	return nil
+}
+
+// deleteLink removes the named link if it exists and has the expected type.
+// Deleting a link also drops its addresses and the routes through it.
+func deleteLink(name, linkType string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		// Link doesn't exist, nothing to clean up
+		return nil
+	}
+	if link.Type() != linkType {
+		return fmt.Errorf("%s is not a %s (type: %s), not deleting it", name, linkType, link.Type())
+	}
+
+	if err := retryNetlink(func() error { return netlink.LinkDel(link) }); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+
+	return nil
+}
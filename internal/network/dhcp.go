@@ -0,0 +1,195 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+)
+
+// DHCP message layout (RFC 2131) and the options the responder cares about.
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpHeaderLen   = 236
+	dhcpOpRequest   = 1
+	dhcpOpReply     = 2
+	dhcpFlagsOffset = 10
+
+	optPad                  = 0
+	optMessageType          = 53
+	optServerID             = 54
+	optParameterRequestList = 55
+	optClasslessRoutes      = 121
+	optMSClasslessRoutes    = 249
+	optEnd                  = 255
+
+	dhcpInform = 8
+	dhcpAck    = 5
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+// DHCPResponder answers DHCPINFORM requests on the IMDS veth with a classless
+// static route (option 121) for 169.254.169.254/32. The route is on-link, so
+// the guest ARPs for the IMDS address and reaches the veth directly.
+//
+// Only DHCPINFORM is answered: the guest already has an address from another
+// source, and replying to DISCOVER/REQUEST would race the real DHCP server.
+// Clients that never send DHCPINFORM don't get the route and still rely on
+// their link-local route.
+type DHCPResponder struct {
+	iface string
+}
+
+// NewDHCPResponder creates a responder bound to the given interface.
+func NewDHCPResponder(iface string) *DHCPResponder {
+	return &DHCPResponder{iface: iface}
+}
+
+// Run answers DHCPINFORM requests until the context is canceled.
+func (d *DHCPResponder) Run(ctx context.Context) error {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				// Bind to the veth so we neither see nor answer traffic on
+				// other interfaces (virt-launcher runs its own DHCP server).
+				if sockErr = syscall.BindToDevice(int(fd), d.iface); sockErr != nil {
+					return
+				}
+				if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); sockErr != nil {
+					return
+				}
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	pc, err := lc.ListenPacket(ctx, "udp4", fmt.Sprintf(":%d", dhcpServerPort))
+	if err != nil {
+		return fmt.Errorf("failed to listen for DHCP on %s: %w", d.iface, err)
+	}
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	log.Printf("Answering DHCPINFORM on %s with a route to %s", d.iface, IMDSAddress)
+
+	// Replies are always broadcast: the veth has no route to the guest's
+	// ciaddr, and clients accept broadcast replies for INFORM.
+	dst := &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpClientPort}
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read DHCP request: %w", err)
+		}
+
+		reply, err := buildInformReply(buf[:n])
+		if err != nil {
+			continue
+		}
+		if _, err := pc.WriteTo(reply, dst); err != nil {
+			log.Printf("Failed to send DHCPACK: %v", err)
+		}
+	}
+}
+
+// buildInformReply builds a DHCPACK for a DHCPINFORM request.
+// Any other message type is rejected with an error.
+func buildInformReply(req []byte) ([]byte, error) {
+	if len(req) < dhcpHeaderLen+len(dhcpMagicCookie) || req[0] != dhcpOpRequest {
+		return nil, fmt.Errorf("not a DHCP request")
+	}
+	if string(req[dhcpHeaderLen:dhcpHeaderLen+4]) != string(dhcpMagicCookie) {
+		return nil, fmt.Errorf("missing DHCP magic cookie")
+	}
+
+	opts := parseDHCPOptions(req[dhcpHeaderLen+4:])
+	if t := opts[optMessageType]; len(t) != 1 || t[0] != dhcpInform {
+		return nil, fmt.Errorf("not a DHCPINFORM")
+	}
+
+	// Echo htype, hlen, xid, ciaddr, giaddr and chaddr from the request.
+	// yiaddr stays zero: INFORM never assigns an address.
+	reply := make([]byte, dhcpHeaderLen, dhcpHeaderLen+64)
+	reply[0] = dhcpOpReply
+	copy(reply[1:3], req[1:3])
+	copy(reply[4:8], req[4:8])
+	binary.BigEndian.PutUint16(reply[dhcpFlagsOffset:], 0x8000)
+	copy(reply[12:16], req[12:16])
+	copy(reply[20:24], net.ParseIP(IMDSAddress).To4())
+	copy(reply[24:44], req[24:44])
+
+	reply = append(reply, dhcpMagicCookie...)
+	reply = append(reply, optMessageType, 1, dhcpAck)
+	reply = append(reply, optServerID, 4)
+	reply = append(reply, net.ParseIP(IMDSAddress).To4()...)
+
+	route := imdsClasslessRoute()
+	for _, code := range requestedRouteOptions(opts[optParameterRequestList]) {
+		reply = append(reply, code, byte(len(route)))
+		reply = append(reply, route...)
+	}
+
+	return append(reply, optEnd), nil
+}
+
+// requestedRouteOptions returns the classless route options to include.
+// Option 121 is sent if requested or if the client sent no request list;
+// option 249 is the pre-standard Windows equivalent.
+func requestedRouteOptions(prl []byte) []byte {
+	if len(prl) == 0 {
+		return []byte{optClasslessRoutes}
+	}
+	var codes []byte
+	for _, code := range prl {
+		if code == optClasslessRoutes || code == optMSClasslessRoutes {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
+
+// imdsClasslessRoute encodes 169.254.169.254/32 via 0.0.0.0 (on-link) in the
+// RFC 3442 format: prefix length, significant destination octets, router.
+func imdsClasslessRoute() []byte {
+	route := []byte{32}
+	route = append(route, net.ParseIP(IMDSAddress).To4()...)
+	return append(route, 0, 0, 0, 0)
+}
+
+// parseDHCPOptions parses DHCP options into a map keyed by option code.
+// Parsing stops at the end option or at the first truncated option.
+func parseDHCPOptions(b []byte) map[byte][]byte {
+	opts := make(map[byte][]byte)
+	for i := 0; i < len(b); {
+		code := b[i]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			i++
+			continue
+		}
+		if i+1 >= len(b) || i+2+int(b[i+1]) > len(b) {
+			break
+		}
+		length := int(b[i+1])
+		opts[code] = b[i+2 : i+2+length]
+		i += 2 + length
+	}
+	return opts
+}
@@ -0,0 +1,124 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testDHCPRequest builds a minimal DHCP request with the given options.
+func testDHCPRequest(options ...byte) []byte {
+	req := make([]byte, dhcpHeaderLen)
+	req[0] = dhcpOpRequest
+	req[1] = 1 // ethernet
+	req[2] = 6
+	copy(req[4:8], []byte{0xde, 0xad, 0xbe, 0xef})
+	copy(req[12:16], []byte{10, 0, 2, 2})
+	copy(req[28:34], []byte{0x52, 0x54, 0x00, 0x12, 0x34, 0x56})
+	req = append(req, dhcpMagicCookie...)
+	req = append(req, options...)
+	return append(req, optEnd)
+}
+
+func TestBuildInformReply(t *testing.T) {
+	route := []byte{32, 169, 254, 169, 254, 0, 0, 0, 0}
+
+	tests := []struct {
+		name       string
+		req        []byte
+		wantErr    bool
+		wantRoutes []byte
+	}{
+		{
+			name:       "INFORM without request list gets option 121",
+			req:        testDHCPRequest(optMessageType, 1, dhcpInform),
+			wantRoutes: []byte{optClasslessRoutes},
+		},
+		{
+			name:       "INFORM requesting both route options",
+			req:        testDHCPRequest(optMessageType, 1, dhcpInform, optParameterRequestList, 3, 1, optMSClasslessRoutes, optClasslessRoutes),
+			wantRoutes: []byte{optMSClasslessRoutes, optClasslessRoutes},
+		},
+		{
+			name:       "INFORM not requesting routes",
+			req:        testDHCPRequest(optMessageType, 1, dhcpInform, optParameterRequestList, 2, 1, 3),
+			wantRoutes: nil,
+		},
+		{
+			name:    "DISCOVER is ignored",
+			req:     testDHCPRequest(optMessageType, 1, 1),
+			wantErr: true,
+		},
+		{
+			name:    "truncated packet",
+			req:     []byte{dhcpOpRequest, 1, 6},
+			wantErr: true,
+		},
+		{
+			name:    "reply op is ignored",
+			req:     append([]byte{dhcpOpReply}, testDHCPRequest(optMessageType, 1, dhcpInform)[1:]...),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply, err := buildInformReply(tt.req)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("buildInformReply() expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("buildInformReply() unexpected error: %v", err)
+			}
+
+			if reply[0] != dhcpOpReply {
+				t.Errorf("op = %d, want %d", reply[0], dhcpOpReply)
+			}
+			if !bytes.Equal(reply[4:8], tt.req[4:8]) {
+				t.Errorf("xid = %x, want %x", reply[4:8], tt.req[4:8])
+			}
+			if !bytes.Equal(reply[28:44], tt.req[28:44]) {
+				t.Errorf("chaddr = %x, want %x", reply[28:44], tt.req[28:44])
+			}
+
+			opts := parseDHCPOptions(reply[dhcpHeaderLen+4:])
+			if got := opts[optMessageType]; !bytes.Equal(got, []byte{dhcpAck}) {
+				t.Errorf("message type = %v, want DHCPACK", got)
+			}
+			if got := opts[optServerID]; !bytes.Equal(got, []byte{169, 254, 169, 254}) {
+				t.Errorf("server id = %v, want 169.254.169.254", got)
+			}
+			for _, code := range []byte{optClasslessRoutes, optMSClasslessRoutes} {
+				want := bytes.IndexByte(tt.wantRoutes, code) >= 0
+				got, ok := opts[code]
+				if ok != want {
+					t.Errorf("option %d present = %v, want %v", code, ok, want)
+					continue
+				}
+				if ok && !bytes.Equal(got, route) {
+					t.Errorf("option %d = %v, want %v", code, got, route)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDHCPOptions(t *testing.T) {
+	opts := parseDHCPOptions([]byte{optPad, optMessageType, 1, dhcpInform, 12, 3, 'v', 'm', '1', optEnd, 99, 1, 1})
+	if got := opts[optMessageType]; !bytes.Equal(got, []byte{dhcpInform}) {
+		t.Errorf("message type = %v, want [%d]", got, dhcpInform)
+	}
+	if got := string(opts[12]); got != "vm1" {
+		t.Errorf("hostname = %q, want %q", got, "vm1")
+	}
+	if _, ok := opts[99]; ok {
+		t.Error("options after the end option should be ignored")
+	}
+
+	// A truncated option must not panic or be returned
+	if opts := parseDHCPOptions([]byte{optMessageType, 4, 1}); len(opts) != 0 {
+		t.Errorf("truncated option parsed as %v", opts)
+	}
+}
@@ -0,0 +1,140 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// rpFilterRoot is where the per-interface IPv4 rp_filter settings live.
+const rpFilterRoot = "/proc/sys/net/ipv4/conf"
+
+// Diagnostics is a snapshot of the pod network namespace, for support to
+// diagnose guests that can't reach IMDS.
+type Diagnostics struct {
+	IMDSInterface string            `json:"imdsInterface"`
+	Links         []LinkInfo        `json:"links"`
+	Routes        []RouteInfo       `json:"routes"`
+	Neighbors     []NeighborEntry   `json:"neighbors"`
+	RPFilter      map[string]string `json:"rpFilter"`
+}
+
+// LinkInfo describes a network interface.
+type LinkInfo struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	MAC       string   `json:"mac,omitempty"`
+	Master    string   `json:"master,omitempty"`
+	MTU       int      `json:"mtu"`
+	Up        bool     `json:"up"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// RouteInfo describes a route.
+type RouteInfo struct {
+	Destination string `json:"destination"`
+	Gateway     string `json:"gateway,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Interface   string `json:"interface,omitempty"`
+	Table       int    `json:"table"`
+}
+
+// CollectDiagnostics returns the links, addresses, routes, neighbors and
+// rp_filter settings of the current network namespace.
+func CollectDiagnostics(iface string) (*Diagnostics, error) {
+	diag := &Diagnostics{IMDSInterface: iface}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %w", err)
+	}
+	names := make(map[int]string, len(links))
+	for _, link := range links {
+		names[link.Attrs().Index] = link.Attrs().Name
+	}
+
+	for _, link := range links {
+		attrs := link.Attrs()
+		info := LinkInfo{
+			Name:   attrs.Name,
+			Type:   link.Type(),
+			MAC:    attrs.HardwareAddr.String(),
+			Master: names[attrs.MasterIndex],
+			MTU:    attrs.MTU,
+			Up:     attrs.Flags&net.FlagUp != 0,
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list addresses on %s: %w", attrs.Name, err)
+		}
+		for _, addr := range addrs {
+			info.Addresses = append(info.Addresses, addr.IPNet.String())
+		}
+		diag.Links = append(diag.Links, info)
+
+		neighs, err := netlink.NeighList(attrs.Index, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list neighbors on %s: %w", attrs.Name, err)
+		}
+		for _, n := range neighs {
+			diag.Neighbors = append(diag.Neighbors, NeighborEntry{
+				Interface: attrs.Name,
+				IP:        n.IP.String(),
+				MAC:       n.HardwareAddr.String(),
+				State:     neighStateString(n.State),
+			})
+		}
+	}
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: 0}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %w", err)
+	}
+	for _, route := range routes {
+		info := RouteInfo{
+			Destination: "default",
+			Interface:   names[route.LinkIndex],
+			Table:       route.Table,
+		}
+		if route.Dst != nil {
+			info.Destination = route.Dst.String()
+		}
+		if route.Gw != nil {
+			info.Gateway = route.Gw.String()
+		}
+		if route.Src != nil {
+			info.Source = route.Src.String()
+		}
+		diag.Routes = append(diag.Routes, info)
+	}
+
+	diag.RPFilter, err = readRPFilter(rpFilterRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	return diag, nil
+}
+
+// readRPFilter reads rp_filter for every entry (including "all" and
+// "default") under root.
+func readRPFilter(root string) (map[string]string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", root, err)
+	}
+
+	values := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(root, entry.Name(), "rp_filter"))
+		if err != nil {
+			continue
+		}
+		values[entry.Name()] = strings.TrimSpace(string(data))
+	}
+	return values, nil
+}
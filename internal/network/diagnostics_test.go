@@ -0,0 +1,38 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadRPFilter(t *testing.T) {
+	root := t.TempDir()
+	for name, value := range map[string]string{"all": "0\n", "default": "1\n", "k6t-eth0": "2\n"} {
+		dir := filepath.Join(root, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "rp_filter"), []byte(value), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An entry without rp_filter is skipped
+	if err := os.Mkdir(filepath.Join(root, "lo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readRPFilter(root)
+	if err != nil {
+		t.Fatalf("readRPFilter() unexpected error: %v", err)
+	}
+	want := map[string]string{"all": "0", "default": "1", "k6t-eth0": "2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readRPFilter() = %v, want %v", got, want)
+	}
+
+	if _, err := readRPFilter(filepath.Join(root, "missing")); err == nil {
+		t.Error("readRPFilter() expected error for a missing directory, got nil")
+	}
+}
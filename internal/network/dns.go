@@ -0,0 +1,198 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsPort = 53
+	// dnsTTL is the TTL of answers. The IMDS address never changes, but a
+	// short TTL lets guests notice when the responder is disabled.
+	dnsTTL = 300
+)
+
+// DefaultDNSNames are the metadata hostnames that cloud images resolve.
+var DefaultDNSNames = []string{"metadata.internal", "metadata.google.internal"}
+
+// DNSResponder answers DNS queries for metadata hostnames with the IMDS
+// address, so images that discover metadata by hostname work unchanged.
+// It is not a resolver: queries for any other name are refused.
+type DNSResponder struct {
+	// names are lowercase, fully qualified names
+	names map[string]bool
+	ipv6  bool
+}
+
+// NewDNSResponder creates a responder for the given names. With ipv6 it also
+// listens on and answers AAAA queries with IMDSAddressV6.
+func NewDNSResponder(names []string, ipv6 bool) *DNSResponder {
+	d := &DNSResponder{names: make(map[string]bool), ipv6: ipv6}
+	for _, name := range names {
+		d.names[canonicalDNSName(name)] = true
+	}
+	return d
+}
+
+// Run answers queries on port 53 of the IMDS address until the context is canceled.
+func (d *DNSResponder) Run(ctx context.Context) error {
+	addrs := []string{IMDSAddress}
+	if d.ipv6 {
+		addrs = append(addrs, IMDSAddressV6)
+	}
+
+	var conns []net.PacketConn
+	for _, addr := range addrs {
+		var lc net.ListenConfig
+		pc, err := lc.ListenPacket(ctx, "udp", net.JoinHostPort(addr, fmt.Sprint(dnsPort)))
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return fmt.Errorf("failed to listen for DNS on %s: %w", addr, err)
+		}
+		conns = append(conns, pc)
+	}
+	go func() {
+		<-ctx.Done()
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	log.Printf("Answering DNS queries on %v for %s", addrs, strings.Join(d.sortedNames(), ", "))
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, pc := range conns {
+		wg.Add(1)
+		go func(pc net.PacketConn) {
+			defer wg.Done()
+			if err := d.serve(ctx, pc); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(pc)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// serve answers queries on one socket.
+func (d *DNSResponder) serve(ctx context.Context, pc net.PacketConn) error {
+	buf := make([]byte, 512)
+	for {
+		n, src, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read DNS query: %w", err)
+		}
+
+		reply, err := d.answer(buf[:n])
+		if err != nil {
+			continue
+		}
+		if _, err := pc.WriteTo(reply, src); err != nil {
+			log.Printf("Failed to send DNS reply to %s: %v", src, err)
+		}
+	}
+}
+
+// answer builds the reply to a query. Malformed messages are rejected with
+// an error and get no reply.
+func (d *DNSResponder) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DNS header: %w", err)
+	}
+	if header.Response {
+		return nil, fmt.Errorf("not a DNS query")
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DNS question: %w", err)
+	}
+
+	reply := dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		OpCode:           header.OpCode,
+		RecursionDesired: header.RecursionDesired,
+	}
+	ours := d.names[canonicalDNSName(q.Name.String())]
+	switch {
+	case header.OpCode != 0:
+		reply.RCode = dnsmessage.RCodeNotImplemented
+	case !ours || q.Class != dnsmessage.ClassINET:
+		reply.RCode = dnsmessage.RCodeRefused
+	default:
+		reply.Authoritative = true
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), reply)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	// Other record types get an empty NOERROR answer: the name exists
+	if reply.Authoritative {
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+		switch {
+		case q.Type == dnsmessage.TypeA:
+			var a dnsmessage.AResource
+			copy(a.A[:], net.ParseIP(IMDSAddress).To4())
+			if err := b.AResource(rh, a); err != nil {
+				return nil, err
+			}
+		case q.Type == dnsmessage.TypeAAAA && d.ipv6:
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], net.ParseIP(IMDSAddressV6).To16())
+			if err := b.AAAAResource(rh, aaaa); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return b.Finish()
+}
+
+// sortedNames returns the names answered for, for logging.
+func (d *DNSResponder) sortedNames() []string {
+	names := make([]string, 0, len(d.names))
+	for name := range d.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// canonicalDNSName lowercases a name and makes it fully qualified.
+func canonicalDNSName(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
@@ -0,0 +1,101 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// buildDNSQuery builds a query for one name and type.
+func buildDNSQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	if err := b.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	query, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func TestDNSResponderAnswer(t *testing.T) {
+	tests := []struct {
+		name      string
+		ipv6      bool
+		qname     string
+		qtype     dnsmessage.Type
+		wantRCode dnsmessage.RCode
+		wantIP    string
+	}{
+		{name: "A for metadata.internal", qname: "metadata.internal.", qtype: dnsmessage.TypeA, wantIP: IMDSAddress},
+		{name: "A for metadata.google.internal", qname: "metadata.google.internal.", qtype: dnsmessage.TypeA, wantIP: IMDSAddress},
+		{name: "case insensitive", qname: "Metadata.Internal.", qtype: dnsmessage.TypeA, wantIP: IMDSAddress},
+		{name: "custom name", qname: "imds.example.com.", qtype: dnsmessage.TypeA, wantIP: IMDSAddress},
+		{name: "AAAA without IPv6", qname: "metadata.internal.", qtype: dnsmessage.TypeAAAA},
+		{name: "AAAA with IPv6", ipv6: true, qname: "metadata.internal.", qtype: dnsmessage.TypeAAAA, wantIP: IMDSAddressV6},
+		{name: "other type", qname: "metadata.internal.", qtype: dnsmessage.TypeTXT},
+		{name: "other name", qname: "example.com.", qtype: dnsmessage.TypeA, wantRCode: dnsmessage.RCodeRefused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDNSResponder(append(DefaultDNSNames, "imds.example.com"), tt.ipv6)
+			reply, err := d.answer(buildDNSQuery(t, tt.qname, tt.qtype))
+			if err != nil {
+				t.Fatalf("answer() unexpected error: %v", err)
+			}
+
+			var msg dnsmessage.Message
+			if err := msg.Unpack(reply); err != nil {
+				t.Fatalf("failed to unpack reply: %v", err)
+			}
+			if msg.ID != 42 || !msg.Response {
+				t.Errorf("header = %+v, want response with ID 42", msg.Header)
+			}
+			if msg.RCode != tt.wantRCode {
+				t.Errorf("RCode = %v, want %v", msg.RCode, tt.wantRCode)
+			}
+
+			if tt.wantIP == "" {
+				if len(msg.Answers) != 0 {
+					t.Errorf("got %d answers, want none", len(msg.Answers))
+				}
+				return
+			}
+			if len(msg.Answers) != 1 {
+				t.Fatalf("got %d answers, want 1", len(msg.Answers))
+			}
+			var got net.IP
+			switch body := msg.Answers[0].Body.(type) {
+			case *dnsmessage.AResource:
+				got = body.A[:]
+			case *dnsmessage.AAAAResource:
+				got = body.AAAA[:]
+			}
+			if !got.Equal(net.ParseIP(tt.wantIP)) {
+				t.Errorf("answer = %v, want %s", got, tt.wantIP)
+			}
+		})
+	}
+}
+
+func TestDNSResponderRejectsResponses(t *testing.T) {
+	d := NewDNSResponder(DefaultDNSNames, false)
+	reply, err := d.answer(buildDNSQuery(t, "metadata.internal.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.answer(reply); err == nil {
+		t.Error("answer() of a response expected error, got nil")
+	}
+}
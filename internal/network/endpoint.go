@@ -0,0 +1,56 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// The address guests reach IMDS on. Everything that plumbs, announces or
+// filters IMDS traffic uses these, so change them with SetEndpoint before
+// setting up the network.
+var (
+	// IMDSAddress is the link-local IP address for IMDS
+	IMDSAddress = "169.254.169.254"
+	// IMDSPort is the TCP port guests connect to
+	IMDSPort uint16 = 80
+)
+
+// imdsNet is the range the IMDS address must stay in. Guests send link-local
+// traffic straight onto the segment, and the pod never routes it elsewhere.
+var imdsNet = &net.IPNet{IP: net.IPv4(169, 254, 0, 0), Mask: net.CIDRMask(16, 32)}
+
+// SetEndpoint moves IMDS to addr, given as "host:port". The host may be
+// left out (":8080") to keep the current address.
+func SetEndpoint(addr string) error {
+	host, port, err := ParseEndpoint(addr)
+	if err != nil {
+		return err
+	}
+	if host != "" {
+		IMDSAddress = host
+	}
+	IMDSPort = port
+	return nil
+}
+
+// ParseEndpoint validates an IMDS endpoint "host:port". host is empty if it
+// was left out, otherwise an IPv4 address in 169.254.0.0/16.
+func ParseEndpoint(addr string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid IMDS endpoint %q: %w", addr, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, fmt.Errorf("invalid IMDS endpoint %q: port must be between 1 and 65535", addr)
+	}
+	if host != "" {
+		ip := net.ParseIP(host).To4()
+		if ip == nil || !imdsNet.Contains(ip) {
+			return "", 0, fmt.Errorf("invalid IMDS endpoint %q: address must be an IPv4 address in %s", addr, imdsNet)
+		}
+		host = ip.String()
+	}
+	return host, uint16(port), nil
+}
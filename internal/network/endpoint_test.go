@@ -0,0 +1,56 @@
+package network
+
+import "testing"
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		addr     string
+		wantHost string
+		wantPort uint16
+		wantErr  bool
+	}{
+		{addr: "169.254.169.254:80", wantHost: "169.254.169.254", wantPort: 80},
+		{addr: "169.254.170.2:8080", wantHost: "169.254.170.2", wantPort: 8080},
+		{addr: ":8080", wantPort: 8080},
+		{addr: "10.0.2.1:80", wantErr: true},
+		{addr: "[fd00:ec2::254]:80", wantErr: true},
+		{addr: "169.254.169.254", wantErr: true},
+		{addr: "169.254.169.254:0", wantErr: true},
+		{addr: "169.254.169.254:65536", wantErr: true},
+		{addr: "metadata:80", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			host, port, err := ParseEndpoint(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEndpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if host != tt.wantHost || port != tt.wantPort {
+				t.Errorf("ParseEndpoint() = %q, %d, want %q, %d", host, port, tt.wantHost, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestSetEndpoint(t *testing.T) {
+	defer func(addr string, port uint16) { IMDSAddress, IMDSPort = addr, port }(IMDSAddress, IMDSPort)
+
+	if err := SetEndpoint(":8080"); err != nil {
+		t.Fatalf("SetEndpoint() error = %v", err)
+	}
+	if IMDSAddress != "169.254.169.254" || IMDSPort != 8080 {
+		t.Errorf("endpoint = %s:%d, want 169.254.169.254:8080", IMDSAddress, IMDSPort)
+	}
+
+	if err := SetEndpoint("169.254.170.2:80"); err != nil {
+		t.Fatalf("SetEndpoint() error = %v", err)
+	}
+	if IMDSAddress != "169.254.170.2" || IMDSPort != 80 {
+		t.Errorf("endpoint = %s:%d, want 169.254.170.2:80", IMDSAddress, IMDSPort)
+	}
+
+	if err := SetEndpoint("10.0.0.1:80"); err == nil {
+		t.Error("SetEndpoint() outside link-local expected error")
+	}
+}
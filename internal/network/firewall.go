@@ -0,0 +1,158 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// linkLocalNet is always allowed as a source so guests that only have an
+// APIPA address can still reach IMDS.
+var linkLocalNet = &net.IPNet{IP: net.IPv4(169, 254, 0, 0).To4(), Mask: net.CIDRMask(16, 32)}
+
+// linkLocalNetV6 is always allowed as an IPv6 source. Guests send Router
+// and Neighbor Solicitations from their link-local address.
+var linkLocalNetV6 = &net.IPNet{IP: net.ParseIP("fe80::"), Mask: net.CIDRMask(10, 128)}
+
+// firewallFamily describes how the firewall matches one address family.
+type firewallFamily struct {
+	imds      net.IP
+	linkLocal *net.IPNet
+	// host returns the host network of ip, or nil if ip is of another family
+	host  func(ip net.IP) *net.IPNet
+	daddr func(ip net.IP) []expr.Any
+	saddr func(network *net.IPNet) []expr.Any
+}
+
+var (
+	firewallIPv4 = firewallFamily{
+		imds:      net.ParseIP(IMDSAddress),
+		linkLocal: linkLocalNet,
+		host: func(ip net.IP) *net.IPNet {
+			if ip.To4() == nil {
+				return nil
+			}
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+		},
+		daddr: matchIPv4Daddr,
+		saddr: matchIPv4Saddr,
+	}
+	firewallIPv6 = firewallFamily{
+		imds:      net.ParseIP(IMDSAddressV6),
+		linkLocal: linkLocalNetV6,
+		host: func(ip net.IP) *net.IPNet {
+			if ip.To4() != nil || ip.To16() == nil {
+				return nil
+			}
+			return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+		},
+		daddr: matchIPv6Daddr,
+		saddr: matchIPv6Saddr,
+	}
+)
+
+// FirewallPeer is a guest interface allowed to reach IMDS.
+type FirewallPeer struct {
+	// MAC is the guest interface MAC (nil matches any MAC)
+	MAC net.HardwareAddr
+	// IPs are the guest's IPv4 and IPv6 addresses. When empty, any source address
+	// from the MAC is allowed, since KubeVirt only reports IPs once the
+	// guest agent is running.
+	IPs []net.IP
+}
+
+// ApplyFirewall restricts IMDS to the given guest peers, over both IPv4
+// and IPv6.
+//
+// Only packets arriving on iface from an allowed MAC and source IP (or a
+// link-local source) are accepted. Packets for the IMDS address arriving on
+// any other interface are dropped, which keeps other containers in the pod
+// and stray bridge members away from the token endpoint.
+func ApplyFirewall(iface string, peers []FirewallPeer) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables connection: %w", err)
+	}
+
+	for _, family := range []struct {
+		table *nftables.Table
+		rules [][]expr.Any
+	}{
+		{imdsTable(), firewallRules(iface, peers)},
+		{imdsTableV6(), firewallRulesV6(iface, peers)},
+	} {
+		chain := replaceChain(conn, &nftables.Chain{
+			Name:     "input",
+			Table:    family.table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookInput,
+			Priority: nftables.ChainPriorityFilter,
+		})
+		for _, exprs := range family.rules {
+			conn.AddRule(&nftables.Rule{Table: family.table, Chain: chain, Exprs: exprs})
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to install firewall rules: %w", err)
+	}
+	return nil
+}
+
+// firewallRules builds the IPv4 input chain:
+//
+//	ip daddr 169.254.169.254 iifname != <iface> drop
+//	iifname <iface> ether saddr <mac> ip saddr <ip> accept    (per peer and address)
+//	iifname <iface> drop
+func firewallRules(iface string, peers []FirewallPeer) [][]expr.Any {
+	return buildFirewallRules(firewallIPv4, iface, peers)
+}
+
+// firewallRulesV6 builds the IPv6 input chain, like firewallRules but for
+// fd00:ec2::254, the guests' IPv6 addresses and fe80::/10.
+func firewallRulesV6(iface string, peers []FirewallPeer) [][]expr.Any {
+	return buildFirewallRules(firewallIPv6, iface, peers)
+}
+
+// buildFirewallRules builds the input chain for one address family.
+func buildFirewallRules(family firewallFamily, iface string, peers []FirewallPeer) [][]expr.Any {
+	var rules [][]expr.Any
+
+	foreign := family.daddr(family.imds)
+	foreign = append(foreign,
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: ifname(iface)},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	)
+	rules = append(rules, foreign)
+
+	for _, peer := range peers {
+		var sources []*net.IPNet
+		for _, ip := range peer.IPs {
+			if host := family.host(ip); host != nil {
+				sources = append(sources, host)
+			}
+		}
+		if len(peer.IPs) > 0 {
+			sources = append(sources, family.linkLocal)
+		} else {
+			sources = []*net.IPNet{nil}
+		}
+
+		for _, source := range sources {
+			rule := matchIIFName(iface)
+			if peer.MAC != nil {
+				rule = append(rule, matchEtherSaddr(peer.MAC)...)
+			}
+			if source != nil {
+				rule = append(rule, family.saddr(source)...)
+			}
+			rules = append(rules, append(rule, &expr.Verdict{Kind: expr.VerdictAccept}))
+		}
+	}
+
+	rules = append(rules, append(matchIIFName(iface), &expr.Verdict{Kind: expr.VerdictDrop}))
+	return rules
+}
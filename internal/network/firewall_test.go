@@ -0,0 +1,130 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/nftables/expr"
+)
+
+// testVeth is the IMDS interface name used in firewall tests.
+const testVeth = "imds-3f2a1c"
+
+// ruleSummary reduces a rule to its comparison operands and verdict.
+func ruleSummary(rule []expr.Any) (cmps [][]byte, verdict expr.VerdictKind) {
+	for _, e := range rule {
+		switch e := e.(type) {
+		case *expr.Cmp:
+			cmps = append(cmps, e.Data)
+		case *expr.Verdict:
+			verdict = e.Kind
+		}
+	}
+	return cmps, verdict
+}
+
+func TestFirewallRules(t *testing.T) {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+
+	tests := []struct {
+		name  string
+		peers []FirewallPeer
+		// wantAccept lists the comparison operands of each accept rule
+		wantAccept [][][]byte
+	}{
+		{
+			name:       "no peers drops everything",
+			peers:      nil,
+			wantAccept: nil,
+		},
+		{
+			name:  "peer with address allows address and link-local",
+			peers: []FirewallPeer{{MAC: mac, IPs: []net.IP{net.ParseIP("10.0.2.2"), net.ParseIP("fd10::2")}}},
+			wantAccept: [][][]byte{
+				{ifname(testVeth), mac, {10, 0, 2, 2}},
+				{ifname(testVeth), mac, {169, 254, 0, 0}},
+			},
+		},
+		{
+			name:  "peer without addresses allows any source from its MAC",
+			peers: []FirewallPeer{{MAC: mac}},
+			wantAccept: [][][]byte{
+				{ifname(testVeth), mac},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := firewallRules(testVeth, tt.peers)
+			if len(rules) != len(tt.wantAccept)+2 {
+				t.Fatalf("got %d rules, want %d", len(rules), len(tt.wantAccept)+2)
+			}
+
+			// First rule drops IMDS traffic from other interfaces
+			cmps, verdict := ruleSummary(rules[0])
+			if verdict != expr.VerdictDrop || !bytes.Equal(cmps[0], []byte{169, 254, 169, 254}) || !bytes.Equal(cmps[1], ifname(testVeth)) {
+				t.Errorf("rule 0 = %v %v, want drop of foreign IMDS traffic", cmps, verdict)
+			}
+
+			for i, want := range tt.wantAccept {
+				cmps, verdict := ruleSummary(rules[i+1])
+				if verdict != expr.VerdictAccept {
+					t.Errorf("rule %d verdict = %v, want accept", i+1, verdict)
+				}
+				if len(cmps) != len(want) {
+					t.Errorf("rule %d matches %v, want %v", i+1, cmps, want)
+					continue
+				}
+				for j := range want {
+					if !bytes.Equal(cmps[j], want[j]) {
+						t.Errorf("rule %d match %d = %v, want %v", i+1, j, cmps[j], want[j])
+					}
+				}
+			}
+
+			// Last rule drops everything else on the interface
+			cmps, verdict = ruleSummary(rules[len(rules)-1])
+			if verdict != expr.VerdictDrop || len(cmps) != 1 || !bytes.Equal(cmps[0], ifname(testVeth)) {
+				t.Errorf("last rule = %v %v, want drop on %s", cmps, verdict, testVeth)
+			}
+		})
+	}
+}
+
+func TestFirewallRulesV6(t *testing.T) {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	peers := []FirewallPeer{{MAC: mac, IPs: []net.IP{net.ParseIP("10.0.2.2"), net.ParseIP("fd10::2")}}}
+
+	rules := firewallRulesV6(testVeth, peers)
+	if len(rules) != 4 {
+		t.Fatalf("got %d rules, want 4", len(rules))
+	}
+
+	cmps, verdict := ruleSummary(rules[0])
+	if verdict != expr.VerdictDrop || !bytes.Equal(cmps[0], net.ParseIP(IMDSAddressV6)) || !bytes.Equal(cmps[1], ifname(testVeth)) {
+		t.Errorf("rule 0 = %v %v, want drop of foreign IMDS traffic", cmps, verdict)
+	}
+
+	for i, want := range [][][]byte{
+		{ifname(testVeth), mac, net.ParseIP("fd10::2")},
+		{ifname(testVeth), mac, net.ParseIP("fe80::")},
+	} {
+		cmps, verdict := ruleSummary(rules[i+1])
+		if verdict != expr.VerdictAccept || len(cmps) != len(want) {
+			t.Errorf("rule %d = %v %v, want accept of %v", i+1, cmps, verdict, want)
+			continue
+		}
+		for j := range want {
+			if !bytes.Equal(cmps[j], want[j]) {
+				t.Errorf("rule %d match %d = %v, want %v", i+1, j, cmps[j], want[j])
+			}
+		}
+	}
+
+	cmps, verdict = ruleSummary(rules[3])
+	if verdict != expr.VerdictDrop || len(cmps) != 1 || !bytes.Equal(cmps[0], ifname(testVeth)) {
+		t.Errorf("last rule = %v %v, want drop on %s", cmps, verdict, testVeth)
+	}
+}
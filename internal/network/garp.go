@@ -0,0 +1,127 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+// gratuitousARPCount is how many announcements are sent on startup.
+// Several are sent since the first may be lost while the bridge port is
+// still learning.
+const gratuitousARPCount = 3
+
+// ARPAnnouncer sends gratuitous ARP for the IMDS address, so guests that
+// cached the MAC of a previous sidecar incarnation update it right away
+// instead of waiting for their ARP cache entry to expire.
+type ARPAnnouncer struct {
+	iface string
+	// interval between periodic announcements (0 announces only on startup)
+	interval time.Duration
+}
+
+// NewARPAnnouncer creates an announcer for the given interface.
+func NewARPAnnouncer(iface string, interval time.Duration) *ARPAnnouncer {
+	return &ARPAnnouncer{iface: iface, interval: interval}
+}
+
+// Run announces the IMDS address on startup and then periodically until
+// the context is canceled. The interface is looked up for every announcement,
+// so a recreated interface is announced with its new MAC.
+func (a *ARPAnnouncer) Run(ctx context.Context) error {
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ARP)))
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	for i := 0; i < gratuitousARPCount; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Second):
+			}
+		}
+		if err := a.announce(fd); err != nil {
+			return err
+		}
+	}
+	log.Printf("Announced %s on %s", IMDSAddress, a.iface)
+
+	if a.interval <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := a.announce(fd); err != nil {
+				log.Printf("Failed to send gratuitous ARP: %v", err)
+			}
+		}
+	}
+}
+
+// announce sends one gratuitous ARP for the IMDS address on the interface.
+func (a *ARPAnnouncer) announce(fd int) error {
+	ifi, err := net.InterfaceByName(a.iface)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", a.iface, err)
+	}
+
+	frame := buildGratuitousARP(ifi.HardwareAddr, net.ParseIP(IMDSAddress))
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ARP),
+		Ifindex:  ifi.Index,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+
+	if err := syscall.Sendto(fd, frame, 0, addr); err != nil {
+		return fmt.Errorf("failed to send gratuitous ARP on %s: %w", a.iface, err)
+	}
+	return nil
+}
+
+// buildGratuitousARP builds a broadcast Ethernet frame carrying a
+// gratuitous ARP request (sender and target IP both set to ip).
+// Requests rather than replies are used since more stacks honor them.
+func buildGratuitousARP(mac net.HardwareAddr, ip net.IP) []byte {
+	return buildARPRequest(mac, ip, ip)
+}
+
+// buildARPRequest builds a broadcast Ethernet frame carrying an ARP request
+// for targetIP.
+func buildARPRequest(mac net.HardwareAddr, senderIP, targetIP net.IP) []byte {
+	frame := make([]byte, 0, 42)
+
+	// Ethernet header
+	frame = append(frame, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	frame = append(frame, mac...)
+	frame = binary.BigEndian.AppendUint16(frame, syscall.ETH_P_ARP)
+
+	// ARP payload
+	frame = binary.BigEndian.AppendUint16(frame, 1) // hardware type: Ethernet
+	frame = binary.BigEndian.AppendUint16(frame, syscall.ETH_P_IP)
+	frame = append(frame, 6, 4)
+	frame = binary.BigEndian.AppendUint16(frame, 1) // opcode: request
+	frame = append(frame, mac...)
+	frame = append(frame, senderIP.To4()...)
+	frame = append(frame, 0, 0, 0, 0, 0, 0) // target MAC: unknown
+	frame = append(frame, targetIP.To4()...)
+
+	return frame
+}
+
+// htons converts a uint16 from host to network byte order.
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,47 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestBuildGratuitousARP(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	frame := buildGratuitousARP(mac, net.ParseIP(IMDSAddress))
+
+	if len(frame) != 42 {
+		t.Fatalf("frame length = %d, want 42", len(frame))
+	}
+
+	tests := []struct {
+		name  string
+		start int
+		want  []byte
+	}{
+		{name: "broadcast destination", start: 0, want: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{name: "source MAC", start: 6, want: mac},
+		{name: "ethertype ARP", start: 12, want: []byte{0x08, 0x06}},
+		{name: "hardware and protocol type", start: 14, want: []byte{0x00, 0x01, 0x08, 0x00, 6, 4}},
+		{name: "opcode request", start: 20, want: []byte{0x00, 0x01}},
+		{name: "sender MAC", start: 22, want: mac},
+		{name: "sender IP", start: 28, want: []byte{169, 254, 169, 254}},
+		{name: "target MAC unknown", start: 32, want: make([]byte, 6)},
+		{name: "target IP equals sender IP", start: 38, want: []byte{169, 254, 169, 254}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := frame[tt.start : tt.start+len(tt.want)]
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("bytes %d-%d = %x, want %x", tt.start, tt.start+len(tt.want)-1, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHtons(t *testing.T) {
+	if got := htons(0x0806); got != 0x0608 {
+		t.Errorf("htons(0x0806) = %#x, want 0x0608", got)
+	}
+}
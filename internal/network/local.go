@@ -0,0 +1,41 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// DummyIMDS is the name of the dummy interface holding the IMDS address when
+// there is no VM bridge to attach to.
+const DummyIMDS = "imds0"
+
+// EnsureDummy ensures a dummy interface carrying the IMDS address exists in
+// the pod network namespace.
+//
+// This is used with the passt binding: passt proxies guest connections
+// through sockets in the pod namespace, so a connection from the guest to
+// 169.254.169.254:80 is made from the pod and reaches a local listener
+// without any bridge or veth.
+func EnsureDummy() error {
+	link, err := netlink.LinkByName(DummyIMDS)
+	if err != nil {
+		dummy := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: DummyIMDS}}
+		if err := retryNetlink(func() error { return netlink.LinkAdd(dummy) }); err != nil {
+			return fmt.Errorf("failed to create %s: %w", DummyIMDS, err)
+		}
+		if link, err = netlink.LinkByName(DummyIMDS); err != nil {
+			return fmt.Errorf("failed to get %s: %w", DummyIMDS, err)
+		}
+	}
+
+	if err := ensureIPAddress(link); err != nil {
+		return err
+	}
+
+	if err := retryNetlink(func() error { return netlink.LinkSetUp(link) }); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", DummyIMDS, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// MacvlanIMDS is the name of the macvlan interface where IMDS listens when the
+// VM uses the macvtap binding.
+const MacvlanIMDS = "macvlan-imds"
+
+// Priorities of the ingress filters scoping the macvlan to the VM's MAC.
+const (
+	filterPrioAllowVM = 1
+	filterPrioDropAll = 2
+)
+
+// DiscoverMacvtap finds the VM's macvtap interface in the pod network namespace.
+func DiscoverMacvtap() (string, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return "", fmt.Errorf("failed to list network links: %w", err)
+	}
+
+	for _, link := range links {
+		if link.Type() == "macvtap" {
+			return link.Attrs().Name, nil
+		}
+	}
+
+	return "", fmt.Errorf("no macvtap interface found")
+}
+
+// EnsureMacvlan attaches a bridge-mode macvlan carrying the IMDS address to the
+// same lower device as the VM's macvtap, so the two can talk directly.
+//
+// The macvlan shares the physical segment with other hosts, so its ingress is
+// restricted to frames from the VM's MAC. Otherwise the kernel would answer ARP
+// for 169.254.169.254 on the wire and other VMs' guests could reach this
+// sidecar and its tokens.
+func EnsureMacvlan(macvtapName string) error {
+	macvtap, err := netlink.LinkByName(macvtapName)
+	if err != nil {
+		return fmt.Errorf("failed to get macvtap %s: %w", macvtapName, err)
+	}
+	vmMAC := macvtap.Attrs().HardwareAddr
+	if len(vmMAC) == 0 {
+		return fmt.Errorf("macvtap %s has no MAC address", macvtapName)
+	}
+
+	link, err := netlink.LinkByName(MacvlanIMDS)
+	if err != nil {
+		// The kernel resolves a macvtap parent to its real lower device
+		macvlan := &netlink.Macvlan{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:        MacvlanIMDS,
+				ParentIndex: macvtap.Attrs().Index,
+			},
+			Mode: netlink.MACVLAN_MODE_BRIDGE,
+		}
+		if err := retryNetlink(func() error { return netlink.LinkAdd(macvlan) }); err != nil {
+			return fmt.Errorf("failed to create %s on %s: %w", MacvlanIMDS, macvtapName, err)
+		}
+		if link, err = netlink.LinkByName(MacvlanIMDS); err != nil {
+			return fmt.Errorf("failed to get %s: %w", MacvlanIMDS, err)
+		}
+	}
+
+	if err := restrictIngressToMAC(link, vmMAC); err != nil {
+		return err
+	}
+
+	if err := ensureIPAddress(link); err != nil {
+		return err
+	}
+
+	if err := retryNetlink(func() error { return netlink.LinkSetUp(link) }); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", MacvlanIMDS, err)
+	}
+
+	return nil
+}
+
+// restrictIngressToMAC drops all frames arriving on the link except those
+// sent from the given MAC, using an ingress qdisc with two flower filters.
+func restrictIngressToMAC(link netlink.Link, mac net.HardwareAddr) error {
+	index := link.Attrs().Index
+	name := link.Attrs().Name
+
+	ingress := &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+	if err := retryNetlink(func() error { return netlink.QdiscReplace(ingress) }); err != nil {
+		return fmt.Errorf("failed to add ingress qdisc to %s: %w", name, err)
+	}
+
+	filterAttrs := func(priority uint16) netlink.FilterAttrs {
+		return netlink.FilterAttrs{
+			LinkIndex: index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Priority:  priority,
+			Protocol:  unix.ETH_P_ALL,
+		}
+	}
+	allow := &netlink.Flower{
+		FilterAttrs: filterAttrs(filterPrioAllowVM),
+		SrcMac:      mac,
+		Actions:     []netlink.Action{&netlink.GenericAction{ActionAttrs: netlink.ActionAttrs{Action: netlink.TC_ACT_OK}}},
+	}
+	drop := &netlink.Flower{
+		FilterAttrs: filterAttrs(filterPrioDropAll),
+		Actions:     []netlink.Action{&netlink.GenericAction{ActionAttrs: netlink.ActionAttrs{Action: netlink.TC_ACT_SHOT}}},
+	}
+	for _, filter := range []*netlink.Flower{allow, drop} {
+		if err := retryNetlink(func() error { return netlink.FilterReplace(filter) }); err != nil {
+			return fmt.Errorf("failed to add ingress filter to %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// BridgeGateway returns the IPv4 address of the bridge. With the masquerade
+// binding this is the gateway KubeVirt hands out to the guest (e.g. 10.0.2.1).
+func BridgeGateway(bridgeName string) (net.IP, error) {
+	bridge, err := GetBridge(bridgeName)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := netlink.AddrList(bridge, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses on %s: %w", bridgeName, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("bridge %s has no IPv4 address", bridgeName)
+	}
+
+	return addrs[0].IP, nil
+}
+
+// EnsureMasqueradeDNAT redirects guest traffic for the IMDS endpoint
+// (169.254.169.254:80 unless changed with SetEndpoint) to a listener on the
+// bridge gateway address and returns that listener address.
+//
+// With the masquerade binding the guest routes 169.254.169.254 through its
+// default gateway into the pod, so a DNAT rule is enough and no veth needs
+// to be plumbed onto the bridge. The gateway address is used rather than the
+// pod IP because it is only reachable from the guest, not from the cluster.
+func EnsureMasqueradeDNAT(bridgeName string) (string, error) {
+	gateway, err := BridgeGateway(bridgeName)
+	if err != nil {
+		return "", err
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return "", fmt.Errorf("failed to open nftables connection: %w", err)
+	}
+
+	table := imdsTable()
+	chain := replaceChain(conn, &nftables.Chain{
+		Name:     "prerouting",
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	})
+	conn.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: masqueradeDNATExprs(bridgeName, gateway),
+	})
+
+	if err := conn.Flush(); err != nil {
+		return "", fmt.Errorf("failed to install DNAT rule: %w", err)
+	}
+
+	return net.JoinHostPort(gateway.String(), strconv.Itoa(int(IMDSPort))), nil
+}
+
+// masqueradeDNATExprs builds the rule
+//
+//	iifname <bridge> ip daddr 169.254.169.254 tcp dport 80 dnat to <gateway>:80
+func masqueradeDNATExprs(bridgeName string, gateway net.IP) []expr.Any {
+	var exprs []expr.Any
+	exprs = append(exprs, matchIIFName(bridgeName)...)
+	exprs = append(exprs, matchIPv4Daddr(net.ParseIP(IMDSAddress))...)
+	exprs = append(exprs, matchTCPDport(IMDSPort)...)
+	return append(exprs,
+		&expr.Immediate{Register: 1, Data: gateway.To4()},
+		&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(IMDSPort)},
+		&expr.NAT{
+			Type:        expr.NATTypeDestNAT,
+			Family:      unix.NFPROTO_IPV4,
+			RegAddrMin:  1,
+			RegProtoMin: 2,
+		},
+	)
+}
@@ -0,0 +1,60 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/nftables/expr"
+)
+
+func TestMasqueradeDNATExprs(t *testing.T) {
+	gateway := net.ParseIP("10.0.2.1")
+	exprs := masqueradeDNATExprs("k6t-eth0", gateway)
+
+	var cmps [][]byte
+	var immediates [][]byte
+	var nat *expr.NAT
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Cmp:
+			cmps = append(cmps, e.Data)
+		case *expr.Immediate:
+			immediates = append(immediates, e.Data)
+		case *expr.NAT:
+			nat = e
+		}
+	}
+
+	wantCmps := [][]byte{
+		ifname("k6t-eth0"),
+		{169, 254, 169, 254},
+		{6},     // TCP
+		{0, 80}, // port 80, big endian
+	}
+	if len(cmps) != len(wantCmps) {
+		t.Fatalf("got %d comparisons, want %d", len(cmps), len(wantCmps))
+	}
+	for i, want := range wantCmps {
+		if !bytes.Equal(cmps[i], want) {
+			t.Errorf("comparison %d = %v, want %v", i, cmps[i], want)
+		}
+	}
+
+	if len(immediates) != 2 || !bytes.Equal(immediates[0], []byte{10, 0, 2, 1}) || !bytes.Equal(immediates[1], []byte{0, 80}) {
+		t.Errorf("DNAT target = %v, want 10.0.2.1:80", immediates)
+	}
+	if nat == nil || nat.Type != expr.NATTypeDestNAT {
+		t.Errorf("expected a dnat expression, got %+v", nat)
+	}
+}
+
+func TestIfname(t *testing.T) {
+	got := ifname("veth-imds")
+	if len(got) != 16 {
+		t.Fatalf("len = %d, want 16", len(got))
+	}
+	if !bytes.Equal(got[:9], []byte("veth-imds")) || got[9] != 0 {
+		t.Errorf("ifname = %q", got)
+	}
+}
@@ -0,0 +1,58 @@
+package network
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+
+	"github.com/vishvananda/netns"
+)
+
+// NetNSPath returns the path of a network namespace given either a path or
+// the PID of a process in it (e.g. the virt-launcher's).
+func NetNSPath(pathOrPID string) string {
+	if pid, err := strconv.Atoi(pathOrPID); err == nil && pid > 0 {
+		return fmt.Sprintf("/proc/%d/ns/net", pid)
+	}
+	return pathOrPID
+}
+
+// InNetNS runs fn with the calling goroutine in the network namespace at
+// path, so all netlink, nftables and socket operations in fn act on that
+// namespace. An empty path runs fn in the current namespace.
+//
+// Namespaces are per thread, so fn must not hand work to other goroutines.
+func InNetNS(path string, fn func() error) error {
+	if path == "" {
+		return fn()
+	}
+
+	runtime.LockOSThread()
+	orig, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to get current network namespace: %w", err)
+	}
+	defer orig.Close()
+
+	target, err := netns.GetFromPath(path)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open network namespace %s: %w", path, err)
+	}
+	defer target.Close()
+
+	if err := netns.Set(target); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter network namespace %s: %w", path, err)
+	}
+	defer func() {
+		// If the thread can't be moved back it stays locked, so the runtime
+		// discards it instead of reusing it for other goroutines
+		if err := netns.Set(orig); err == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	return fn()
+}
@@ -0,0 +1,48 @@
+package network
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNetNSPath(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "pid", input: "4242", want: "/proc/4242/ns/net"},
+		{name: "path", input: "/var/run/netns/vm1", want: "/var/run/netns/vm1"},
+		{name: "zero is not a pid", input: "0", want: "0"},
+		{name: "empty", input: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NetNSPath(tt.input); got != tt.want {
+				t.Errorf("NetNSPath(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInNetNSEmptyPathRunsInPlace(t *testing.T) {
+	wantErr := errors.New("ran")
+	if err := InNetNS("", func() error { return wantErr }); err != wantErr {
+		t.Errorf("InNetNS() = %v, want %v", err, wantErr)
+	}
+}
+
+func TestInNetNSMissingPath(t *testing.T) {
+	ran := false
+	err := InNetNS("/nonexistent/netns", func() error {
+		ran = true
+		return nil
+	})
+	if err == nil {
+		t.Error("InNetNS() expected error for a missing namespace, got nil")
+	}
+	if ran {
+		t.Error("InNetNS() ran fn without entering the namespace")
+	}
+}
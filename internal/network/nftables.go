@@ -0,0 +1,116 @@
+package network
+
+import (
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// nftTableName is the nftables table owning all IMDS rules. Keeping our rules
+// in a dedicated table means they never interfere with KubeVirt's own tables
+// and can be replaced atomically.
+const nftTableName = "kubevirt_imds"
+
+// imdsTable returns the IPv4 table holding the IMDS rules.
+func imdsTable() *nftables.Table {
+	return &nftables.Table{Name: nftTableName, Family: nftables.TableFamilyIPv4}
+}
+
+// imdsTableV6 returns the IPv6 table holding the IMDS rules.
+func imdsTableV6() *nftables.Table {
+	return &nftables.Table{Name: nftTableName, Family: nftables.TableFamilyIPv6}
+}
+
+// imdsBridgeTable returns the bridge-family table holding the IMDS rules that
+// filter frames forwarded between bridge ports.
+func imdsBridgeTable() *nftables.Table {
+	return &nftables.Table{Name: nftTableName, Family: nftables.TableFamilyBridge}
+}
+
+// replaceChain queues the chain, and the IMDS table holding it, with all of
+// its existing rules removed. Each feature owns one chain, so rebuilding it
+// leaves the other chains in the table alone.
+func replaceChain(conn *nftables.Conn, chain *nftables.Chain) *nftables.Chain {
+	conn.AddTable(chain.Table)
+	c := conn.AddChain(chain)
+	conn.FlushChain(c)
+	return c
+}
+
+// matchIIFName matches packets received on the named interface.
+func matchIIFName(name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(name)},
+	}
+}
+
+// matchOIFName matches packets sent out of the named interface.
+func matchOIFName(name string) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(name)},
+	}
+}
+
+// matchIPv4Daddr matches packets sent to the given IPv4 address.
+func matchIPv4Daddr(ip net.IP) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.To4()},
+	}
+}
+
+// matchTCPDport matches TCP packets sent to the given port.
+func matchTCPDport(port uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+	}
+}
+
+// matchIPv4Saddr matches packets sent from the given IPv4 network.
+func matchIPv4Saddr(network *net.IPNet) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: net.IP(network.Mask).To4(), Xor: make([]byte, 4)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: network.IP.To4()},
+	}
+}
+
+// matchIPv6Daddr matches packets sent to the given IPv6 address.
+func matchIPv6Daddr(ip net.IP) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 24, Len: 16},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.To16()},
+	}
+}
+
+// matchIPv6Saddr matches packets sent from the given IPv6 network.
+func matchIPv6Saddr(network *net.IPNet) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 16},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 16, Mask: net.IP(network.Mask).To16(), Xor: make([]byte, 16)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: network.IP.To16()},
+	}
+}
+
+// matchEtherSaddr matches frames sent from the given MAC address.
+func matchEtherSaddr(mac net.HardwareAddr) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseLLHeader, Offset: 6, Len: 6},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: mac},
+	}
+}
+
+// ifname returns an interface name padded to IFNAMSIZ, as nftables expects.
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
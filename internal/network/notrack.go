@@ -0,0 +1,65 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// EnsureNotrack exempts IMDS traffic on the interface from connection
+// tracking, so heavy metadata polling doesn't fill the node's conntrack
+// table. Requests to and replies from 169.254.169.254 are matched in raw
+// chains, which run before conntrack.
+//
+// This must not be used with masquerade, whose DNAT relies on conntrack.
+func EnsureNotrack(iface string) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables connection: %w", err)
+	}
+
+	table := imdsTable()
+	prerouting := replaceChain(conn, &nftables.Chain{
+		Name:     "notrack_prerouting",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityRaw,
+	})
+	output := replaceChain(conn, &nftables.Chain{
+		Name:     "notrack_output",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityRaw,
+	})
+
+	requests, replies := notrackRules(iface)
+	conn.AddRule(&nftables.Rule{Table: table, Chain: prerouting, Exprs: requests})
+	conn.AddRule(&nftables.Rule{Table: table, Chain: output, Exprs: replies})
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to install notrack rules: %w", err)
+	}
+	return nil
+}
+
+// notrackRules builds the rules
+//
+//	iifname <iface> ip daddr 169.254.169.254 notrack
+//	oifname <iface> ip saddr 169.254.169.254 notrack
+func notrackRules(iface string) (requests, replies []expr.Any) {
+	imds := &net.IPNet{IP: net.ParseIP(IMDSAddress).To4(), Mask: net.CIDRMask(32, 32)}
+
+	requests = append(requests, matchIIFName(iface)...)
+	requests = append(requests, matchIPv4Daddr(imds.IP)...)
+	requests = append(requests, &expr.Notrack{})
+
+	replies = append(replies, matchOIFName(iface)...)
+	replies = append(replies, matchIPv4Saddr(imds)...)
+	replies = append(replies, &expr.Notrack{})
+
+	return requests, replies
+}
@@ -0,0 +1,44 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/nftables/expr"
+)
+
+func TestNotrackRules(t *testing.T) {
+	requests, replies := notrackRules(testVeth)
+
+	tests := []struct {
+		name     string
+		rule     []expr.Any
+		wantMeta expr.MetaKey
+	}{
+		{name: "requests", rule: requests, wantMeta: expr.MetaKeyIIFNAME},
+		{name: "replies", rule: replies, wantMeta: expr.MetaKeyOIFNAME},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, ok := tt.rule[0].(*expr.Meta)
+			if !ok || meta.Key != tt.wantMeta {
+				t.Errorf("first expression = %+v, want meta key %v", tt.rule[0], tt.wantMeta)
+			}
+
+			var cmps [][]byte
+			for _, e := range tt.rule {
+				if cmp, ok := e.(*expr.Cmp); ok {
+					cmps = append(cmps, cmp.Data)
+				}
+			}
+			if len(cmps) != 2 || !bytes.Equal(cmps[0], ifname(testVeth)) || !bytes.Equal(cmps[1], []byte{169, 254, 169, 254}) {
+				t.Errorf("comparisons = %v, want interface %s and 169.254.169.254", cmps, testVeth)
+			}
+
+			if _, ok := tt.rule[len(tt.rule)-1].(*expr.Notrack); !ok {
+				t.Errorf("last expression = %T, want *expr.Notrack", tt.rule[len(tt.rule)-1])
+			}
+		})
+	}
+}
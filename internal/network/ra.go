@@ -0,0 +1,186 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// IMDSAddressV6 is the IPv6 address for IMDS. It matches the address EC2
+	// uses, so guest tooling that already special-cases it keeps working.
+	IMDSAddressV6 = "fd00:ec2::254"
+	// imdsPrefixV6Len is the length of the on-link prefix advertised in RAs
+	imdsPrefixV6Len = 64
+
+	// raInterval is how often unsolicited RAs are sent
+	raInterval = 60 * time.Second
+	// raPrefixLifetime is the valid lifetime of the advertised prefix.
+	// It outlives several missed RAs so a slow sidecar restart is harmless.
+	raPrefixLifetime = 30 * time.Minute
+
+	ndOptSourceLinkAddr = 1
+	ndOptPrefixInfo     = 3
+	ndPrefixFlagOnLink  = 0x80
+)
+
+// EnsureIPv6Address ensures the IMDS IPv6 address is configured on the interface.
+// Duplicate address detection is skipped so the address is usable immediately.
+func EnsureIPv6Address(iface string) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", iface, err)
+	}
+
+	ip := net.ParseIP(IMDSAddressV6)
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses on %s: %w", iface, err)
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(ip) {
+			return nil
+		}
+	}
+
+	addr := &netlink.Addr{
+		IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)},
+		Flags: unix.IFA_F_NODAD,
+	}
+	if err := addAddr(link, addr); err != nil {
+		return fmt.Errorf("failed to add address %s to %s: %w", IMDSAddressV6, iface, err)
+	}
+	return nil
+}
+
+// RouterAdvertiser sends IPv6 Router Advertisements on the IMDS interface that
+// mark the IMDS prefix as on-link, so guests reach IMDSAddressV6 via NDP
+// without any manual configuration.
+//
+// The router lifetime is zero: the sidecar never becomes a default router,
+// and the autonomous flag is clear so guests don't configure addresses.
+type RouterAdvertiser struct {
+	iface string
+}
+
+// NewRouterAdvertiser creates an advertiser for the given interface.
+func NewRouterAdvertiser(iface string) *RouterAdvertiser {
+	return &RouterAdvertiser{iface: iface}
+}
+
+// Run sends periodic RAs and answers Router Solicitations until the
+// context is canceled.
+func (r *RouterAdvertiser) Run(ctx context.Context) error {
+	ifi, err := net.InterfaceByName(r.iface)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", r.iface, err)
+	}
+
+	c, err := net.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return fmt.Errorf("failed to open ICMPv6 socket: %w", err)
+	}
+	defer c.Close()
+
+	pc := ipv6.NewPacketConn(c)
+	allRouters := &net.UDPAddr{IP: net.IPv6linklocalallrouters}
+	if err := pc.JoinGroup(ifi, allRouters); err != nil {
+		return fmt.Errorf("failed to join all-routers group on %s: %w", r.iface, err)
+	}
+	// NDP messages must be sent with hop limit 255 (RFC 4861 section 6.1.2)
+	if err := pc.SetMulticastHopLimit(255); err != nil {
+		return fmt.Errorf("failed to set hop limit: %w", err)
+	}
+	if err := pc.SetHopLimit(255); err != nil {
+		return fmt.Errorf("failed to set hop limit: %w", err)
+	}
+	if err := pc.SetMulticastInterface(ifi); err != nil {
+		return fmt.Errorf("failed to set multicast interface: %w", err)
+	}
+	if err := pc.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+		return fmt.Errorf("failed to enable interface control messages: %w", err)
+	}
+	var filter ipv6.ICMPFilter
+	filter.SetAll(true)
+	filter.Accept(ipv6.ICMPTypeRouterSolicitation)
+	if err := pc.SetICMPFilter(&filter); err != nil {
+		return fmt.Errorf("failed to set ICMPv6 filter: %w", err)
+	}
+
+	ra := buildRouterAdvertisement(ifi.HardwareAddr)
+	allNodes := &net.IPAddr{IP: net.IPv6linklocalallnodes, Zone: r.iface}
+	send := func() {
+		if _, err := pc.WriteTo(ra, &ipv6.ControlMessage{IfIndex: ifi.Index}, allNodes); err != nil {
+			log.Printf("Failed to send router advertisement: %v", err)
+		}
+	}
+
+	// Answer solicitations as they arrive; guests send them on boot
+	solicited := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			_, cm, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if cm != nil && cm.IfIndex != ifi.Index {
+				continue
+			}
+			select {
+			case solicited <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	log.Printf("Advertising %s/%d on %s", IMDSAddressV6, imdsPrefixV6Len, r.iface)
+
+	ticker := time.NewTicker(raInterval)
+	defer ticker.Stop()
+	send()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			send()
+		case <-solicited:
+			send()
+		}
+	}
+}
+
+// buildRouterAdvertisement builds an ICMPv6 Router Advertisement carrying
+// the IMDS prefix as an on-link-only Prefix Information option.
+// The checksum is left zero; the kernel fills it in for ICMPv6 raw sockets.
+func buildRouterAdvertisement(mac net.HardwareAddr) []byte {
+	msg := make([]byte, 16)
+	msg[0] = byte(ipv6.ICMPTypeRouterAdvertisement)
+	// Bytes 4-15: cur hop limit, flags, router lifetime, reachable time and
+	// retrans timer are all zero ("unspecified" / not a default router)
+
+	if len(mac) == 6 {
+		msg = append(msg, ndOptSourceLinkAddr, 1)
+		msg = append(msg, mac...)
+	}
+
+	prefix := make([]byte, 32)
+	prefix[0] = ndOptPrefixInfo
+	prefix[1] = 4 // length in units of 8 octets
+	prefix[2] = imdsPrefixV6Len
+	prefix[3] = ndPrefixFlagOnLink
+	binary.BigEndian.PutUint32(prefix[4:8], uint32(raPrefixLifetime.Seconds()))
+	// Preferred lifetime (8:12) stays zero: guests never use the prefix for addresses
+	ip := net.ParseIP(IMDSAddressV6).Mask(net.CIDRMask(imdsPrefixV6Len, 128))
+	copy(prefix[16:32], ip)
+
+	return append(msg, prefix...)
+}
@@ -0,0 +1,60 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv6"
+)
+
+func TestBuildRouterAdvertisement(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+
+	tests := []struct {
+		name      string
+		mac       net.HardwareAddr
+		wantSLLAO bool
+	}{
+		{name: "with source link-layer address", mac: mac, wantSLLAO: true},
+		{name: "without hardware address", mac: nil, wantSLLAO: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ra := buildRouterAdvertisement(tt.mac)
+
+			if ra[0] != byte(ipv6.ICMPTypeRouterAdvertisement) {
+				t.Errorf("type = %d, want %d", ra[0], ipv6.ICMPTypeRouterAdvertisement)
+			}
+			if lifetime := binary.BigEndian.Uint16(ra[6:8]); lifetime != 0 {
+				t.Errorf("router lifetime = %d, want 0 (never a default router)", lifetime)
+			}
+
+			opts := ra[16:]
+			if tt.wantSLLAO {
+				if opts[0] != ndOptSourceLinkAddr || !bytes.Equal(opts[2:8], tt.mac) {
+					t.Errorf("source link-layer option = %x, want MAC %s", opts[:8], tt.mac)
+				}
+				opts = opts[8:]
+			}
+
+			if len(opts) != 32 || opts[0] != ndOptPrefixInfo || opts[1] != 4 {
+				t.Fatalf("prefix information option = %x", opts)
+			}
+			if opts[2] != imdsPrefixV6Len {
+				t.Errorf("prefix length = %d, want %d", opts[2], imdsPrefixV6Len)
+			}
+			if opts[3] != ndPrefixFlagOnLink {
+				t.Errorf("prefix flags = %#x, want on-link only", opts[3])
+			}
+			if valid := binary.BigEndian.Uint32(opts[4:8]); valid == 0 {
+				t.Error("valid lifetime should be non-zero")
+			}
+			if got, want := net.IP(opts[16:32]), net.ParseIP("fd00:ec2::"); !got.Equal(want) {
+				t.Errorf("prefix = %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package network
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// reconcileDebounce coalesces bursts of link events, such as a bridge being
+// recreated, into a single setup run.
+const reconcileDebounce = time.Second
+
+// Reconciler re-runs the sidecar's network setup whenever links in the pod
+// network namespace change, and periodically in case an event was missed.
+// This repairs IMDS when libvirt or a NIC hotplug deletes or recreates the
+// bridge or the IMDS interface, instead of leaving it broken until the pod
+// restarts. The setup function must be idempotent.
+type Reconciler struct {
+	setup  func() error
+	resync time.Duration
+}
+
+// NewReconciler creates a reconciler running setup on link changes and every
+// resync interval.
+func NewReconciler(setup func() error, resync time.Duration) *Reconciler {
+	return &Reconciler{setup: setup, resync: resync}
+}
+
+// Run reconciles until the context is canceled.
+func (r *Reconciler) Run(ctx context.Context) {
+	var updates chan netlink.LinkUpdate
+	subscribe := func() {
+		updates = make(chan netlink.LinkUpdate, 64)
+		err := netlink.LinkSubscribeWithOptions(updates, ctx.Done(), netlink.LinkSubscribeOptions{
+			ErrorCallback: func(err error) {
+				// Closing the subscription on shutdown also reports an error
+				if ctx.Err() == nil {
+					log.Printf("Link event subscription error: %v", err)
+				}
+			},
+		})
+		if err != nil {
+			// Fall back to periodic resyncs until subscribing works
+			log.Printf("Failed to subscribe to link events: %v", err)
+			updates = nil
+		}
+	}
+	subscribe()
+
+	ticker := time.NewTicker(r.resync)
+	defer ticker.Stop()
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-updates:
+			if !ok {
+				updates = nil
+				continue
+			}
+			if debounce == nil {
+				debounce = time.After(reconcileDebounce)
+			}
+		case <-debounce:
+			debounce = nil
+			r.reconcile()
+		case <-ticker.C:
+			if updates == nil {
+				subscribe()
+			}
+			r.reconcile()
+		}
+	}
+}
+
+// reconcile runs setup once, logging failures. They are retried on the next
+// event or resync.
+func (r *Reconciler) reconcile() {
+	if err := r.setup(); err != nil {
+		log.Printf("Network reconcile failed: %v", err)
+	}
+}
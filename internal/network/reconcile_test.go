@@ -0,0 +1,43 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReconcilerResyncs(t *testing.T) {
+	var calls atomic.Int32
+	setup := func() error {
+		// Failures are retried on the next resync
+		if calls.Add(1) == 1 {
+			return errors.New("bridge not found")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewReconciler(setup, 10*time.Millisecond).Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.After(5 * time.Second)
+	for calls.Load() < 3 {
+		select {
+		case <-deadline:
+			t.Fatalf("setup ran %d times, want at least 3", calls.Load())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return after cancellation")
+	}
+}
@@ -0,0 +1,50 @@
+package network
+
+import (
+	"errors"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// retryAttempts bounds how often a netlink operation is tried.
+const retryAttempts = 5
+
+// retryBaseDelay is the delay before the first retry; it doubles after each.
+// It is a variable so tests can shorten it.
+var retryBaseDelay = 100 * time.Millisecond
+
+// retryNetlink runs fn, retrying with exponential backoff on errors that are
+// transient while KubeVirt is still setting up the pod network, e.g. a device
+// that is busy or briefly missing while it is being moved or renamed.
+// Other errors are returned immediately.
+func retryNetlink(fn func() error) error {
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransientNetlinkError(err) || attempt == retryAttempts {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// isTransientNetlinkError reports whether a netlink error may go away on retry.
+func isTransientNetlinkError(err error) bool {
+	return errors.Is(err, unix.EBUSY) ||
+		errors.Is(err, unix.ENODEV) ||
+		errors.Is(err, unix.EAGAIN) ||
+		errors.Is(err, unix.EINTR)
+}
+
+// addAddr adds the address to the link with retries. An address that already
+// exists, e.g. because it was added concurrently, counts as success.
+func addAddr(link netlink.Link, addr *netlink.Addr) error {
+	err := retryNetlink(func() error { return netlink.AddrAdd(link, addr) })
+	if errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+	return err
+}
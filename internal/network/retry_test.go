@@ -0,0 +1,66 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRetryNetlink(t *testing.T) {
+	defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantErr   error
+		wantCalls int
+	}{
+		{
+			name:      "success",
+			errs:      []error{nil},
+			wantCalls: 1,
+		},
+		{
+			name:      "transient then success",
+			errs:      []error{unix.EBUSY, unix.ENODEV, nil},
+			wantCalls: 3,
+		},
+		{
+			name:      "wrapped transient error",
+			errs:      []error{fmt.Errorf("link add: %w", unix.EAGAIN), nil},
+			wantCalls: 2,
+		},
+		{
+			name:      "permanent error",
+			errs:      []error{unix.EPERM},
+			wantErr:   unix.EPERM,
+			wantCalls: 1,
+		},
+		{
+			name:      "gives up",
+			errs:      []error{unix.EBUSY, unix.EBUSY, unix.EBUSY, unix.EBUSY, unix.EBUSY, nil},
+			wantErr:   unix.EBUSY,
+			wantCalls: retryAttempts,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryNetlink(func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if err != tt.wantErr {
+				t.Errorf("retryNetlink() error = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("retryNetlink() calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
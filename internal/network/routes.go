@@ -0,0 +1,81 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// SyncGuestRoutesV6 routes the guest's IPv6 addresses through the IMDS
+// interface and removes host routes to addresses the guest no longer has.
+//
+// Guests reach fd00:ec2::254 on-link and use their own global address as
+// the source, but with the bridge binding the pod network namespace has no
+// route back to it, since that address belongs to the guest rather than the
+// pod. Link-local addresses need no route.
+func SyncGuestRoutesV6(iface string, ips []net.IP) error {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", iface, err)
+	}
+
+	want := guestRouteDsts(ips)
+	for _, dst := range want {
+		route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst, Scope: netlink.SCOPE_LINK}
+		if err := retryNetlink(func() error { return netlink.RouteReplace(route) }); err != nil {
+			return fmt.Errorf("failed to add route to %s via %s: %w", dst, iface, err)
+		}
+	}
+
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return fmt.Errorf("failed to list routes on %s: %w", iface, err)
+	}
+	var errs []error
+	for _, route := range staleGuestRoutes(routes, want) {
+		if err := netlink.RouteDel(&route); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove route to %s via %s: %w", route.Dst, iface, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// guestRouteDsts returns host routes for the routable IPv6 addresses in ips.
+func guestRouteDsts(ips []net.IP) []*net.IPNet {
+	var dsts []*net.IPNet
+	for _, ip := range ips {
+		if ip.To4() != nil || ip.To16() == nil || ip.IsLinkLocalUnicast() || ip.IsLoopback() {
+			continue
+		}
+		dsts = append(dsts, &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)})
+	}
+	return dsts
+}
+
+// staleGuestRoutes returns the IPv6 host routes in routes whose destination
+// isn't in want. Other routes on the interface, like the kernel's fe80::/64,
+// are left alone.
+func staleGuestRoutes(routes []netlink.Route, want []*net.IPNet) []netlink.Route {
+	var stale []netlink.Route
+	for _, route := range routes {
+		if route.Dst == nil || route.Dst.IP.To4() != nil {
+			continue
+		}
+		if ones, bits := route.Dst.Mask.Size(); ones != 128 || bits != 128 {
+			continue
+		}
+		wanted := false
+		for _, dst := range want {
+			if dst.IP.Equal(route.Dst.IP) {
+				wanted = true
+				break
+			}
+		}
+		if !wanted {
+			stale = append(stale, route)
+		}
+	}
+	return stale
+}
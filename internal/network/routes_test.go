@@ -0,0 +1,51 @@
+package network
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestGuestRouteDsts(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("10.0.2.2"),
+		net.ParseIP("fd10::2"),
+		net.ParseIP("fe80::5054:ff:fe12:3456"),
+		net.ParseIP("2001:db8::7"),
+	}
+
+	dsts := guestRouteDsts(ips)
+	want := []string{"fd10::2/128", "2001:db8::7/128"}
+	if len(dsts) != len(want) {
+		t.Fatalf("guestRouteDsts() = %v, want %v", dsts, want)
+	}
+	for i := range want {
+		if dsts[i].String() != want[i] {
+			t.Errorf("guestRouteDsts()[%d] = %s, want %s", i, dsts[i], want[i])
+		}
+	}
+}
+
+func TestStaleGuestRoutes(t *testing.T) {
+	mustCIDR := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	routes := []netlink.Route{
+		{Dst: mustCIDR("fe80::/64")},
+		{Dst: mustCIDR("fd10::2/128")},
+		{Dst: mustCIDR("fd10::3/128")},
+		{},
+	}
+	want := []*net.IPNet{mustCIDR("fd10::2/128")}
+
+	stale := staleGuestRoutes(routes, want)
+	if len(stale) != 1 || stale[0].Dst.String() != "fd10::3/128" {
+		t.Errorf("staleGuestRoutes() = %v, want only fd10::3/128", stale)
+	}
+}
@@ -0,0 +1,169 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// selfTestTimeout is how long a self-test waits for the ARP reply.
+const selfTestTimeout = time.Second
+
+// errNotChecked is reported until the first self-test has run.
+var errNotChecked = fmt.Errorf("data path not checked yet")
+
+// SelfTester periodically checks the IMDS data path the way a guest uses
+// it: it sends an ARP request for the IMDS address from the bridge side of
+// the veth pair and expects the IMDS side to answer. It also checks that the
+// bridge side is still attached to an up bridge, so states like a veth left
+// detached after a bridge flap are reported instead of silently failing
+// guests.
+type SelfTester struct {
+	iface    string
+	interval time.Duration
+
+	mu      sync.RWMutex
+	lastErr error
+}
+
+// NewSelfTester creates a self-tester for the IMDS veth.
+func NewSelfTester(iface string, interval time.Duration) *SelfTester {
+	return &SelfTester{iface: iface, interval: interval, lastErr: errNotChecked}
+}
+
+// Run checks the data path immediately and then periodically until the
+// context is canceled. Changes in the result are logged.
+func (t *SelfTester) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		err := t.check()
+
+		t.mu.Lock()
+		prev := t.lastErr
+		t.lastErr = err
+		t.mu.Unlock()
+
+		switch {
+		case err != nil && (prev == nil || prev.Error() != err.Error()):
+			log.Printf("IMDS data path self-test failed: %v", err)
+		case err == nil && prev != nil:
+			log.Printf("IMDS data path self-test passed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Ready returns the result of the last self-test.
+func (t *SelfTester) Ready() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.lastErr
+}
+
+// check runs one self-test.
+func (t *SelfTester) check() error {
+	link, err := netlink.LinkByName(t.iface)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", t.iface, err)
+	}
+	veth, ok := link.(*netlink.Veth)
+	if !ok {
+		return fmt.Errorf("%s is not a veth (type: %s)", t.iface, link.Type())
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("%s is down", t.iface)
+	}
+
+	peerIndex, err := netlink.VethPeerIndex(veth)
+	if err != nil {
+		return fmt.Errorf("failed to get peer of %s: %w", t.iface, err)
+	}
+	peer, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return fmt.Errorf("failed to get peer of %s: %w", t.iface, err)
+	}
+	if peer.Attrs().MasterIndex == 0 {
+		return fmt.Errorf("%s is not attached to a bridge", peer.Attrs().Name)
+	}
+	bridge, err := netlink.LinkByIndex(peer.Attrs().MasterIndex)
+	if err != nil {
+		return fmt.Errorf("failed to get bridge of %s: %w", peer.Attrs().Name, err)
+	}
+	if bridge.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("bridge %s is down", bridge.Attrs().Name)
+	}
+
+	return arpProbe(peer)
+}
+
+// arpProbe sends an ARP probe for the IMDS address out of the link and waits
+// for the reply. The probe has sender IP 0.0.0.0 (as in RFC 5227), so it
+// doesn't add the link to the IMDS side's neighbor table.
+func arpProbe(link netlink.Link) error {
+	// ETH_P_ALL taps the bridge port before the bridge consumes the reply
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(syscall.ETH_P_ALL)))
+	if err != nil {
+		return fmt.Errorf("failed to open packet socket: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	attrs := link.Attrs()
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ALL), Ifindex: attrs.Index}); err != nil {
+		return fmt.Errorf("failed to bind packet socket to %s: %w", attrs.Name, err)
+	}
+	tv := syscall.NsecToTimeval(int64(selfTestTimeout / 10))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return fmt.Errorf("failed to set receive timeout: %w", err)
+	}
+
+	frame := buildARPRequest(attrs.HardwareAddr, net.IPv4zero, net.ParseIP(IMDSAddress))
+	addr := &syscall.SockaddrLinklayer{Protocol: htons(syscall.ETH_P_ARP), Ifindex: attrs.Index, Halen: 6}
+	copy(addr.Addr[:], net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	if err := syscall.Sendto(fd, frame, 0, addr); err != nil {
+		return fmt.Errorf("failed to send ARP probe on %s: %w", attrs.Name, err)
+	}
+
+	buf := make([]byte, 1500)
+	deadline := time.Now().Add(selfTestTimeout)
+	for time.Now().Before(deadline) {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EINTR {
+				continue
+			}
+			return fmt.Errorf("failed to read ARP reply on %s: %w", attrs.Name, err)
+		}
+		if isIMDSARPReply(buf[:n], attrs.HardwareAddr) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no ARP reply for %s on %s within %v", IMDSAddress, attrs.Name, selfTestTimeout)
+}
+
+// isIMDSARPReply reports whether the Ethernet frame is an ARP reply for the
+// IMDS address addressed to mac.
+func isIMDSARPReply(frame []byte, mac net.HardwareAddr) bool {
+	if len(frame) < 42 || binary.BigEndian.Uint16(frame[12:14]) != syscall.ETH_P_ARP {
+		return false
+	}
+	arp := frame[14:]
+	return binary.BigEndian.Uint16(arp[6:8]) == 2 && // opcode: reply
+		net.IP(arp[14:18]).Equal(net.ParseIP(IMDSAddress)) &&
+		bytes.Equal(arp[18:24], mac)
+}
@@ -0,0 +1,49 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsIMDSARPReply(t *testing.T) {
+	probeMAC := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	imdsMAC := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x02}
+	otherMAC := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x03}
+
+	// reply builds an ARP reply from sender to target, starting from a
+	// request frame and rewriting the opcode and addresses
+	reply := func(senderMAC net.HardwareAddr, senderIP string, targetMAC net.HardwareAddr) []byte {
+		frame := buildARPRequest(senderMAC, net.ParseIP(senderIP), net.IPv4zero)
+		copy(frame[0:6], targetMAC)
+		frame[21] = 2
+		copy(frame[32:38], targetMAC)
+		return frame
+	}
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  bool
+	}{
+		{name: "reply to the probe", frame: reply(imdsMAC, IMDSAddress, probeMAC), want: true},
+		{name: "our own request", frame: buildARPRequest(probeMAC, net.IPv4zero, net.ParseIP(IMDSAddress)), want: false},
+		{name: "reply for another address", frame: reply(imdsMAC, "10.0.2.2", probeMAC), want: false},
+		{name: "reply to another host", frame: reply(imdsMAC, IMDSAddress, otherMAC), want: false},
+		{name: "truncated frame", frame: reply(imdsMAC, IMDSAddress, probeMAC)[:30], want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isIMDSARPReply(tt.frame, probeMAC); got != tt.want {
+				t.Errorf("isIMDSARPReply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelfTesterNotReadyBeforeFirstCheck(t *testing.T) {
+	tester := NewSelfTester("imds-3f2a1c", 0)
+	if err := tester.Ready(); err == nil {
+		t.Error("Ready() = nil before the first check, want error")
+	}
+}
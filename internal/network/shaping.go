@@ -0,0 +1,76 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// ShapingLimits caps the traffic a guest can send to the IMDS interface.
+// Zero disables a limit.
+type ShapingLimits struct {
+	// PacketsPerSecond is the maximum packet rate
+	PacketsPerSecond uint64
+	// BytesPerSecond is the maximum bandwidth
+	BytesPerSecond uint64
+}
+
+// EnsureShaping drops traffic arriving on the interface above the limits,
+// in the kernel, before a runaway guest can keep the sidecar busy. Bursts of
+// up to one second's worth of traffic are let through.
+func EnsureShaping(iface string, limits ShapingLimits) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to open nftables connection: %w", err)
+	}
+
+	table := imdsTable()
+	chain := replaceChain(conn, &nftables.Chain{
+		Name:     "shaping",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	for _, rule := range shapingRules(iface, limits) {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: rule})
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to install shaping rules: %w", err)
+	}
+	return nil
+}
+
+// shapingRules builds one rule per configured limit:
+//
+//	iifname <iface> limit rate over <pps>/second burst <pps> packets drop
+//	iifname <iface> limit rate over <bps> bytes/second burst <bps> bytes drop
+func shapingRules(iface string, limits ShapingLimits) [][]expr.Any {
+	var rules [][]expr.Any
+
+	limit := func(limitType expr.LimitType, rate uint64) []expr.Any {
+		burst := rate
+		if burst > 1<<32-1 {
+			burst = 1<<32 - 1
+		}
+		rule := append(matchIIFName(iface), &expr.Limit{
+			Type:  limitType,
+			Rate:  rate,
+			Over:  true,
+			Unit:  expr.LimitTimeSecond,
+			Burst: uint32(burst),
+		})
+		return append(rule, &expr.Verdict{Kind: expr.VerdictDrop})
+	}
+
+	if limits.PacketsPerSecond > 0 {
+		rules = append(rules, limit(expr.LimitTypePkts, limits.PacketsPerSecond))
+	}
+	if limits.BytesPerSecond > 0 {
+		rules = append(rules, limit(expr.LimitTypePktBytes, limits.BytesPerSecond))
+	}
+
+	return rules
+}
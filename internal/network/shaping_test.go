@@ -0,0 +1,66 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/google/nftables/expr"
+)
+
+func TestShapingRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits ShapingLimits
+		want   []expr.Limit
+	}{
+		{
+			name:   "no limits",
+			limits: ShapingLimits{},
+			want:   nil,
+		},
+		{
+			name:   "packet rate",
+			limits: ShapingLimits{PacketsPerSecond: 100},
+			want: []expr.Limit{
+				{Type: expr.LimitTypePkts, Rate: 100, Over: true, Unit: expr.LimitTimeSecond, Burst: 100},
+			},
+		},
+		{
+			name:   "packet rate and bandwidth",
+			limits: ShapingLimits{PacketsPerSecond: 100, BytesPerSecond: 1 << 20},
+			want: []expr.Limit{
+				{Type: expr.LimitTypePkts, Rate: 100, Over: true, Unit: expr.LimitTimeSecond, Burst: 100},
+				{Type: expr.LimitTypePktBytes, Rate: 1 << 20, Over: true, Unit: expr.LimitTimeSecond, Burst: 1 << 20},
+			},
+		},
+		{
+			name:   "burst capped",
+			limits: ShapingLimits{BytesPerSecond: 1 << 40},
+			want: []expr.Limit{
+				{Type: expr.LimitTypePktBytes, Rate: 1 << 40, Over: true, Unit: expr.LimitTimeSecond, Burst: 1<<32 - 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := shapingRules(testVeth, tt.limits)
+			if len(rules) != len(tt.want) {
+				t.Fatalf("got %d rules, want %d", len(rules), len(tt.want))
+			}
+			for i, rule := range rules {
+				var limit *expr.Limit
+				for _, e := range rule {
+					if l, ok := e.(*expr.Limit); ok {
+						limit = l
+					}
+				}
+				if limit == nil || *limit != tt.want[i] {
+					t.Errorf("rule %d limit = %+v, want %+v", i, limit, tt.want[i])
+				}
+				if v, ok := rule[len(rule)-1].(*expr.Verdict); !ok || v.Kind != expr.VerdictDrop {
+					t.Errorf("rule %d does not end in drop", i)
+				}
+			}
+		})
+	}
+}
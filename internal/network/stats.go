@@ -0,0 +1,135 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// LinkStats holds traffic counters for one end of the IMDS veth pair.
+type LinkStats struct {
+	Name      string `json:"name"`
+	MAC       string `json:"mac"`
+	Up        bool   `json:"up"`
+	RxPackets uint64 `json:"rxPackets"`
+	TxPackets uint64 `json:"txPackets"`
+	RxBytes   uint64 `json:"rxBytes"`
+	TxBytes   uint64 `json:"txBytes"`
+	RxDropped uint64 `json:"rxDropped"`
+	TxDropped uint64 `json:"txDropped"`
+}
+
+// NeighborEntry is a neighbor (ARP/NDP) cache entry.
+type NeighborEntry struct {
+	Interface string `json:"interface,omitempty"`
+	IP        string `json:"ip"`
+	MAC       string `json:"mac"`
+	State     string `json:"state"`
+}
+
+// VethStats is a snapshot of the IMDS veth pair and its ARP cache.
+type VethStats struct {
+	Links     []LinkStats     `json:"links"`
+	Neighbors []NeighborEntry `json:"neighbors"`
+}
+
+// Statistics returns traffic counters for the IMDS interface (and its veth
+// peer, if any) and the neighbors (guests) that have resolved the IMDS address.
+func Statistics(iface string) (*VethStats, error) {
+	stats := &VethStats{}
+
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", iface, err)
+	}
+	stats.Links = append(stats.Links, linkStats(link))
+
+	if veth, ok := link.(*netlink.Veth); ok {
+		peerIndex, err := netlink.VethPeerIndex(veth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get peer of %s: %w", iface, err)
+		}
+		peer, err := netlink.LinkByIndex(peerIndex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get peer of %s: %w", iface, err)
+		}
+		stats.Links = append(stats.Links, linkStats(peer))
+	}
+
+	neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list neighbors on %s: %w", iface, err)
+	}
+	for _, n := range neighs {
+		stats.Neighbors = append(stats.Neighbors, NeighborEntry{
+			IP:    n.IP.String(),
+			MAC:   n.HardwareAddr.String(),
+			State: neighStateString(n.State),
+		})
+	}
+
+	return stats, nil
+}
+
+// NeighborMAC returns the MAC of the neighbor with the IP on iface, from the
+// kernel's ARP/NDP cache.
+func NeighborMAC(iface string, ip net.IP) (net.HardwareAddr, error) {
+	link, err := netlink.LinkByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", iface, err)
+	}
+	neighs, err := netlink.NeighList(link.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list neighbors on %s: %w", iface, err)
+	}
+	for _, n := range neighs {
+		if n.IP.Equal(ip) && len(n.HardwareAddr) > 0 && n.State != netlink.NUD_FAILED && n.State != netlink.NUD_INCOMPLETE {
+			return n.HardwareAddr, nil
+		}
+	}
+	return nil, fmt.Errorf("no neighbor %s on %s", ip, iface)
+}
+
+// linkStats converts netlink link attributes into LinkStats.
+func linkStats(link netlink.Link) LinkStats {
+	attrs := link.Attrs()
+	ls := LinkStats{
+		Name: attrs.Name,
+		MAC:  attrs.HardwareAddr.String(),
+		Up:   attrs.OperState == netlink.OperUp,
+	}
+	if s := attrs.Statistics; s != nil {
+		ls.RxPackets = s.RxPackets
+		ls.TxPackets = s.TxPackets
+		ls.RxBytes = s.RxBytes
+		ls.TxBytes = s.TxBytes
+		ls.RxDropped = s.RxDropped
+		ls.TxDropped = s.TxDropped
+	}
+	return ls
+}
+
+// neighStateString returns a human-readable neighbor state.
+func neighStateString(state int) string {
+	switch state {
+	case netlink.NUD_REACHABLE:
+		return "reachable"
+	case netlink.NUD_STALE:
+		return "stale"
+	case netlink.NUD_DELAY:
+		return "delay"
+	case netlink.NUD_PROBE:
+		return "probe"
+	case netlink.NUD_FAILED:
+		return "failed"
+	case netlink.NUD_INCOMPLETE:
+		return "incomplete"
+	case netlink.NUD_PERMANENT:
+		return "permanent"
+	case netlink.NUD_NOARP:
+		return "noarp"
+	default:
+		return fmt.Sprintf("0x%x", state)
+	}
+}
@@ -2,23 +2,60 @@ package network
 
 import (
 	"fmt"
+	"hash/fnv"
 	"net"
 
 	"github.com/vishvananda/netlink"
 )
 
 const (
-	// VethIMDS is the name of the veth interface where IMDS listens
-	VethIMDS = "veth-imds"
-	// VethIMDSBridge is the name of the veth interface attached to the bridge
-	VethIMDSBridge = "veth-imds-br"
-	// IMDSAddress is the link-local IP address for IMDS
-	IMDSAddress = "169.254.169.254"
+	// DefaultVethPrefix is the default prefix of the IMDS veth names
+	DefaultVethPrefix = "imds"
+	// maxVethPrefixLen keeps "<prefix>-<hash>-br" within IFNAMSIZ-1 (15) bytes
+	maxVethPrefixLen = 5
 )
 
+// VethPair holds the interface names of an IMDS veth pair.
+type VethPair struct {
+	// IMDS is the end where IMDS listens
+	IMDS string
+	// Bridge is the end attached to the VM bridge
+	Bridge string
+	// MTU of both ends. Zero matches the bridge, so the veth neither lowers
+	// the MTU of a jumbo-frame bridge nor limits the TCP MSS of responses.
+	MTU int
+}
+
+// mtuFor returns the MTU the pair should have on the bridge.
+func (p VethPair) mtuFor(bridge netlink.Link) int {
+	if p.MTU > 0 {
+		return p.MTU
+	}
+	return bridge.Attrs().MTU
+}
+
+// NewVethPair derives the veth names for a bridge from the prefix and a hash
+// of the bridge name, e.g. "imds-3f2a1c" and "imds-3f2a1c-br". Sidecars
+// attached to different bridges therefore never pick the same names.
+// An empty prefix selects DefaultVethPrefix.
+func NewVethPair(prefix, bridgeName string) (VethPair, error) {
+	if prefix == "" {
+		prefix = DefaultVethPrefix
+	}
+	if len(prefix) > maxVethPrefixLen {
+		return VethPair{}, fmt.Errorf("veth prefix %q is longer than %d characters", prefix, maxVethPrefixLen)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(bridgeName))
+	name := fmt.Sprintf("%s-%06x", prefix, h.Sum32()&0xffffff)
+
+	return VethPair{IMDS: name, Bridge: name + "-br"}, nil
+}
+
 // SetupVeth creates a veth pair and attaches one end to the specified bridge.
 // The other end is configured with the IMDS IP address (169.254.169.254).
-func SetupVeth(bridgeName string) error {
+func SetupVeth(pair VethPair, bridgeName string) error {
 	// Get the bridge
 	bridge, err := GetBridge(bridgeName)
 	if err != nil {
@@ -26,37 +63,40 @@ func SetupVeth(bridgeName string) error {
 	}
 
 	// Create veth pair
+	mtu := pair.mtuFor(bridge)
 	veth := &netlink.Veth{
 		LinkAttrs: netlink.LinkAttrs{
-			Name: VethIMDS,
+			Name: pair.IMDS,
+			MTU:  mtu,
 		},
-		PeerName: VethIMDSBridge,
+		PeerName: pair.Bridge,
+		PeerMTU:  uint32(mtu),
 	}
 
-	if err := netlink.LinkAdd(veth); err != nil {
+	if err := retryNetlink(func() error { return netlink.LinkAdd(veth) }); err != nil {
 		return fmt.Errorf("failed to create veth pair: %w", err)
 	}
 
 	// Get the bridge-side veth
-	vethBr, err := netlink.LinkByName(VethIMDSBridge)
+	vethBr, err := netlink.LinkByName(pair.Bridge)
 	if err != nil {
-		return fmt.Errorf("failed to get %s: %w", VethIMDSBridge, err)
+		return fmt.Errorf("failed to get %s: %w", pair.Bridge, err)
 	}
 
 	// Attach bridge-side veth to the bridge
-	if err := netlink.LinkSetMaster(vethBr, bridge); err != nil {
-		return fmt.Errorf("failed to attach %s to bridge %s: %w", VethIMDSBridge, bridgeName, err)
+	if err := retryNetlink(func() error { return netlink.LinkSetMaster(vethBr, bridge) }); err != nil {
+		return fmt.Errorf("failed to attach %s to bridge %s: %w", pair.Bridge, bridgeName, err)
 	}
 
 	// Bring up the bridge-side veth
-	if err := netlink.LinkSetUp(vethBr); err != nil {
-		return fmt.Errorf("failed to bring up %s: %w", VethIMDSBridge, err)
+	if err := retryNetlink(func() error { return netlink.LinkSetUp(vethBr) }); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", pair.Bridge, err)
 	}
 
 	// Get the IMDS-side veth
-	vethIMDS, err := netlink.LinkByName(VethIMDS)
+	vethIMDS, err := netlink.LinkByName(pair.IMDS)
 	if err != nil {
-		return fmt.Errorf("failed to get %s: %w", VethIMDS, err)
+		return fmt.Errorf("failed to get %s: %w", pair.IMDS, err)
 	}
 
 	// Add IMDS IP address to the IMDS-side veth
@@ -66,28 +106,31 @@ func SetupVeth(bridgeName string) error {
 			Mask: net.CIDRMask(32, 32),
 		},
 	}
-	if err := netlink.AddrAdd(vethIMDS, addr); err != nil {
-		return fmt.Errorf("failed to add address %s to %s: %w", IMDSAddress, VethIMDS, err)
+	if err := addAddr(vethIMDS, addr); err != nil {
+		return fmt.Errorf("failed to add address %s to %s: %w", IMDSAddress, pair.IMDS, err)
 	}
 
 	// Bring up the IMDS-side veth
-	if err := netlink.LinkSetUp(vethIMDS); err != nil {
-		return fmt.Errorf("failed to bring up %s: %w", VethIMDS, err)
+	if err := retryNetlink(func() error { return netlink.LinkSetUp(vethIMDS) }); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", pair.IMDS, err)
 	}
 
 	return nil
 }
 
 // CleanupVeth removes the veth pair if it exists.
-func CleanupVeth() error {
-	link, err := netlink.LinkByName(VethIMDS)
+func CleanupVeth(pair VethPair) error {
+	link, err := netlink.LinkByName(pair.IMDS)
 	if err != nil {
 		// Link doesn't exist, nothing to clean up
 		return nil
 	}
+	if link.Type() != "veth" {
+		return fmt.Errorf("%s is not a veth (type: %s), not deleting it", pair.IMDS, link.Type())
+	}
 
-	if err := netlink.LinkDel(link); err != nil {
-		return fmt.Errorf("failed to delete %s: %w", VethIMDS, err)
+	if err := retryNetlink(func() error { return netlink.LinkDel(link) }); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", pair.IMDS, err)
 	}
 
 	return nil
@@ -95,7 +138,7 @@ func CleanupVeth() error {
 
 // EnsureVeth validates existing veth pair or creates a new one.
 // This preserves the MAC address across restarts to avoid ARP cache issues.
-func EnsureVeth(bridgeName string) error {
+func EnsureVeth(pair VethPair, bridgeName string) error {
 	// Get the bridge first
 	bridge, err := GetBridge(bridgeName)
 	if err != nil {
@@ -103,25 +146,33 @@ func EnsureVeth(bridgeName string) error {
 	}
 
 	// Check if veth already exists
-	vethIMDS, err := netlink.LinkByName(VethIMDS)
+	vethIMDS, err := netlink.LinkByName(pair.IMDS)
 	if err != nil {
 		// Doesn't exist, create new
-		return SetupVeth(bridgeName)
+		return SetupVeth(pair, bridgeName)
+	}
+
+	// Never reuse or delete an interface that something else created
+	if vethIMDS.Type() != "veth" {
+		return fmt.Errorf("%s already exists and is not a veth (type: %s)", pair.IMDS, vethIMDS.Type())
 	}
 
 	// veth exists, validate and fix if needed
-	vethBr, err := netlink.LinkByName(VethIMDSBridge)
+	vethBr, err := netlink.LinkByName(pair.Bridge)
+	if err == nil && vethBr.Type() != "veth" {
+		return fmt.Errorf("%s already exists and is not a veth (type: %s)", pair.Bridge, vethBr.Type())
+	}
 	if err != nil {
 		// Bridge side missing (shouldn't happen), recreate
-		CleanupVeth()
-		return SetupVeth(bridgeName)
+		CleanupVeth(pair)
+		return SetupVeth(pair, bridgeName)
 	}
 
 	// Check if attached to correct bridge
 	if !isAttachedToBridge(vethBr, bridge) {
 		// Wrong bridge, recreate
-		CleanupVeth()
-		return SetupVeth(bridgeName)
+		CleanupVeth(pair)
+		return SetupVeth(pair, bridgeName)
 	}
 
 	// Ensure IP address is configured
@@ -129,17 +180,36 @@ func EnsureVeth(bridgeName string) error {
 		return err
 	}
 
+	// Follow MTU changes of the bridge (or of IMDS_MTU)
+	mtu := pair.mtuFor(bridge)
+	for _, link := range []netlink.Link{vethBr, vethIMDS} {
+		if err := ensureMTU(link, mtu); err != nil {
+			return err
+		}
+	}
+
 	// Ensure both interfaces are UP
-	if err := netlink.LinkSetUp(vethBr); err != nil {
-		return fmt.Errorf("failed to bring up %s: %w", VethIMDSBridge, err)
+	if err := retryNetlink(func() error { return netlink.LinkSetUp(vethBr) }); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", pair.Bridge, err)
 	}
-	if err := netlink.LinkSetUp(vethIMDS); err != nil {
-		return fmt.Errorf("failed to bring up %s: %w", VethIMDS, err)
+	if err := retryNetlink(func() error { return netlink.LinkSetUp(vethIMDS) }); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", pair.IMDS, err)
 	}
 
 	return nil
 }
 
+// ensureMTU sets the link's MTU if it differs.
+func ensureMTU(link netlink.Link, mtu int) error {
+	if link.Attrs().MTU == mtu {
+		return nil
+	}
+	if err := retryNetlink(func() error { return netlink.LinkSetMTU(link, mtu) }); err != nil {
+		return fmt.Errorf("failed to set MTU of %s to %d: %w", link.Attrs().Name, mtu, err)
+	}
+	return nil
+}
+
 // isAttachedToBridge checks if the link is attached to the specified bridge.
 func isAttachedToBridge(link netlink.Link, bridge netlink.Link) bool {
 	return link.Attrs().MasterIndex == bridge.Attrs().Index
@@ -168,7 +238,7 @@ func ensureIPAddress(link netlink.Link) error {
 	}
 
 	// IP not found, add it
-	if err := netlink.AddrAdd(link, expectedAddr); err != nil {
+	if err := addAddr(link, expectedAddr); err != nil {
 		return fmt.Errorf("failed to add address %s to %s: %w", IMDSAddress, link.Attrs().Name, err)
 	}
 
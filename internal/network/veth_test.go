@@ -0,0 +1,83 @@
+package network
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestNewVethPair(t *testing.T) {
+	tests := []struct {
+		name       string
+		prefix     string
+		bridge     string
+		wantPrefix string
+		wantErr    bool
+	}{
+		{name: "default prefix", prefix: "", bridge: "k6t-eth0", wantPrefix: "imds-"},
+		{name: "custom prefix", prefix: "md", bridge: "k6t-eth0", wantPrefix: "md-"},
+		{name: "longest prefix", prefix: "abcde", bridge: "k6t-net1", wantPrefix: "abcde-"},
+		{name: "prefix too long", prefix: "abcdef", bridge: "k6t-eth0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pair, err := NewVethPair(tt.prefix, tt.bridge)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("NewVethPair() expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewVethPair() unexpected error: %v", err)
+			}
+			if !strings.HasPrefix(pair.IMDS, tt.wantPrefix) {
+				t.Errorf("IMDS = %q, want prefix %q", pair.IMDS, tt.wantPrefix)
+			}
+			if pair.Bridge != pair.IMDS+"-br" {
+				t.Errorf("Bridge = %q, want %q", pair.Bridge, pair.IMDS+"-br")
+			}
+			// IFNAMSIZ is 16 including the terminating NUL
+			if len(pair.Bridge) > 15 {
+				t.Errorf("Bridge = %q is longer than 15 bytes", pair.Bridge)
+			}
+		})
+	}
+}
+
+func TestNewVethPairPerBridge(t *testing.T) {
+	a, _ := NewVethPair("", "k6t-eth0")
+	again, _ := NewVethPair("", "k6t-eth0")
+	b, _ := NewVethPair("", "k6t-net1")
+
+	if a != again {
+		t.Errorf("names for the same bridge differ: %+v vs %+v", a, again)
+	}
+	if a.IMDS == b.IMDS {
+		t.Errorf("bridges k6t-eth0 and k6t-net1 both map to %q", a.IMDS)
+	}
+}
+
+func TestVethPairMTUFor(t *testing.T) {
+	bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "k6t-eth0", MTU: 9000}}
+
+	tests := []struct {
+		name string
+		mtu  int
+		want int
+	}{
+		{name: "matches the bridge", mtu: 0, want: 9000},
+		{name: "forced", mtu: 1400, want: 1400},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pair := VethPair{IMDS: "imds-3f2a1c", Bridge: "imds-3f2a1c-br", MTU: tt.mtu}
+			if got := pair.mtuFor(bridge); got != tt.want {
+				t.Errorf("mtuFor() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
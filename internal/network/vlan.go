@@ -0,0 +1,59 @@
+package network
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// MaxVLAN is the highest usable 802.1Q VLAN ID.
+const MaxVLAN = 4094
+
+// EnsureVethVLAN puts the bridge-side veth on the VM's VLAN of a bridge with
+// VLAN filtering enabled. The VLAN is the port's untagged PVID, so frames from
+// guests on that VLAN reach the IMDS veth without a tag, where the kernel
+// answers ARP and the responders see plain frames. Any other VLANs on the
+// port (like the default VLAN 1) are removed, so the veth only sees the VM's
+// VLAN.
+func EnsureVethVLAN(pair VethPair, bridgeName string, vid uint16) error {
+	bridge, err := GetBridge(bridgeName)
+	if err != nil {
+		return err
+	}
+	if br, ok := bridge.(*netlink.Bridge); !ok || br.VlanFiltering == nil || !*br.VlanFiltering {
+		return fmt.Errorf("bridge %s does not have VLAN filtering enabled", bridgeName)
+	}
+
+	port, err := netlink.LinkByName(pair.Bridge)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", pair.Bridge, err)
+	}
+
+	if err := retryNetlink(func() error { return netlink.BridgeVlanAdd(port, vid, true, true, false, true) }); err != nil {
+		return fmt.Errorf("failed to add VLAN %d to %s: %w", vid, pair.Bridge, err)
+	}
+
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		return fmt.Errorf("failed to list bridge VLANs: %w", err)
+	}
+	for _, stale := range staleVLANs(vlans[int32(port.Attrs().Index)], vid) {
+		if err := retryNetlink(func() error { return netlink.BridgeVlanDel(port, stale, false, false, false, true) }); err != nil {
+			return fmt.Errorf("failed to remove VLAN %d from %s: %w", stale, pair.Bridge, err)
+		}
+	}
+
+	return nil
+}
+
+// staleVLANs returns the VLANs on a port other than vid.
+func staleVLANs(infos []*nl.BridgeVlanInfo, vid uint16) []uint16 {
+	var stale []uint16
+	for _, info := range infos {
+		if info.Vid != vid {
+			stale = append(stale, info.Vid)
+		}
+	}
+	return stale
+}
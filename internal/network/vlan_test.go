@@ -0,0 +1,45 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+func TestStaleVLANs(t *testing.T) {
+	tests := []struct {
+		name  string
+		infos []*nl.BridgeVlanInfo
+		vid   uint16
+		want  []uint16
+	}{
+		{
+			name: "no VLANs",
+			vid:  100,
+		},
+		{
+			name:  "only the VM's VLAN",
+			infos: []*nl.BridgeVlanInfo{{Vid: 100, Flags: nl.BRIDGE_VLAN_INFO_PVID | nl.BRIDGE_VLAN_INFO_UNTAGGED}},
+			vid:   100,
+		},
+		{
+			name: "default VLAN left over",
+			infos: []*nl.BridgeVlanInfo{
+				{Vid: 1, Flags: nl.BRIDGE_VLAN_INFO_PVID | nl.BRIDGE_VLAN_INFO_UNTAGGED},
+				{Vid: 100},
+				{Vid: 200},
+			},
+			vid:  100,
+			want: []uint16{1, 200},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := staleVLANs(tt.infos, tt.vid); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("staleVLANs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
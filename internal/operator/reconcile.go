@@ -0,0 +1,239 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/kubevirt/kubevirt-imds/internal/kube"
+	"github.com/kubevirt/kubevirt-imds/internal/webhook"
+)
+
+// Reconciler installs the webhook described by the cluster IMDSConfig.
+type Reconciler struct {
+	Client  kubernetes.Interface
+	Dynamic dynamic.Interface
+	Options Options
+}
+
+// Reconcile brings the webhook objects in line with the IMDSConfig and
+// records the outcome in its status. Without an IMDSConfig nothing is done;
+// the objects are owned by it, so deleting it uninstalls the webhook.
+func (r *Reconciler) Reconcile(ctx context.Context) error {
+	configs := r.Dynamic.Resource(kube.IMDSConfigResource)
+	obj, err := configs.Get(ctx, kube.IMDSConfigName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get IMDSConfig %s: %w", kube.IMDSConfigName, err)
+	}
+
+	available, reconcileErr := r.install(ctx, obj)
+	if err := r.updateStatus(ctx, obj, available, reconcileErr); err != nil {
+		if reconcileErr != nil {
+			return fmt.Errorf("%w (and failed to update status: %v)", reconcileErr, err)
+		}
+		return err
+	}
+	return reconcileErr
+}
+
+// install applies every webhook object and reports whether a webhook
+// replica is available.
+func (r *Reconciler) install(ctx context.Context, obj *unstructured.Unstructured) (bool, error) {
+	spec, err := kube.ParseIMDSConfig(obj)
+	if err != nil {
+		return false, err
+	}
+	owner := metav1.OwnerReference{
+		APIVersion:         kube.IMDSConfigResource.GroupVersion().String(),
+		Kind:               "IMDSConfig",
+		Name:               obj.GetName(),
+		UID:                obj.GetUID(),
+		Controller:         ptr(true),
+		BlockOwnerDeletion: ptr(true),
+	}
+	o := r.Options
+	c := r.Client
+
+	if err := apply(ctx, c.CoreV1().ServiceAccounts(o.Namespace), owner, serviceAccount(o), nil); err != nil {
+		return false, err
+	}
+	for _, role := range []*rbacv1.ClusterRole{clusterRole(), configReaderClusterRole()} {
+		if err := apply(ctx, c.RbacV1().ClusterRoles(), owner, role, func(existing, desired *rbacv1.ClusterRole) {
+			existing.Rules = desired.Rules
+		}); err != nil {
+			return false, err
+		}
+	}
+	for _, binding := range []*rbacv1.ClusterRoleBinding{clusterRoleBinding(o), configReaderClusterRoleBinding()} {
+		if err := apply(ctx, c.RbacV1().ClusterRoleBindings(), owner, binding, func(existing, desired *rbacv1.ClusterRoleBinding) {
+			existing.Subjects = desired.Subjects
+		}); err != nil {
+			return false, err
+		}
+	}
+	if err := apply(ctx, c.RbacV1().Roles(o.Namespace), owner, role(o), func(existing, desired *rbacv1.Role) {
+		existing.Rules = desired.Rules
+	}); err != nil {
+		return false, err
+	}
+	if err := apply(ctx, c.RbacV1().RoleBindings(o.Namespace), owner, roleBinding(o), func(existing, desired *rbacv1.RoleBinding) {
+		existing.Subjects = desired.Subjects
+	}); err != nil {
+		return false, err
+	}
+	if err := apply(ctx, c.CoreV1().Services(o.Namespace), owner, service(o), func(existing, desired *corev1.Service) {
+		// Keep the cluster IP and other fields the API server fills in
+		existing.Spec.Selector = desired.Spec.Selector
+		existing.Spec.Ports = desired.Spec.Ports
+	}); err != nil {
+		return false, err
+	}
+
+	// The CA survives renewals of the serving certificate, so the caBundle
+	// only changes when the CA itself is replaced
+	certs, err := webhook.EnsureCertificates(ctx, c, o.Namespace, TLSSecretName, WebhookName)
+	if err != nil {
+		return false, err
+	}
+
+	if err := apply(ctx, c.AppsV1().Deployments(o.Namespace), owner, deployment(o, spec.Install, certs.Cert), func(existing, desired *appsv1.Deployment) {
+		existing.Spec = desired.Spec
+	}); err != nil {
+		return false, err
+	}
+	if err := apply(ctx, c.AdmissionregistrationV1().MutatingWebhookConfigurations(), owner, mutatingWebhookConfiguration(o, certs.CACert), func(existing, desired *admissionregistrationv1.MutatingWebhookConfiguration) {
+		existing.Webhooks = desired.Webhooks
+	}); err != nil {
+		return false, err
+	}
+
+	current, err := c.AppsV1().Deployments(o.Namespace).Get(ctx, WebhookName, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to get Deployment %s/%s: %w", o.Namespace, WebhookName, err)
+	}
+	return current.Status.AvailableReplicas > 0, nil
+}
+
+// object is a typed Kubernetes object such as *corev1.Service.
+type object interface {
+	metav1.Object
+	runtime.Object
+}
+
+// client is the part of a typed client apply needs.
+type client[T object] interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (T, error)
+	Create(ctx context.Context, obj T, opts metav1.CreateOptions) (T, error)
+	Update(ctx context.Context, obj T, opts metav1.UpdateOptions) (T, error)
+}
+
+// apply creates desired, or updates the existing object with desired's
+// labels, owner and whatever update copies over. Objects that already match
+// are left alone; fields the API server defaults may still cause an update,
+// which it then doesn't persist.
+func apply[T object](ctx context.Context, c client[T], owner metav1.OwnerReference, desired T, update func(existing, desired T)) error {
+	kind := reflect.TypeOf(desired).Elem().Name()
+	desired.SetOwnerReferences([]metav1.OwnerReference{owner})
+
+	existing, err := c.Get(ctx, desired.GetName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if _, err := c.Create(ctx, desired, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create %s %s: %w", kind, desired.GetName(), err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get %s %s: %w", kind, desired.GetName(), err)
+	}
+
+	before := existing.DeepCopyObject()
+	labels := existing.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	for k, v := range desired.GetLabels() {
+		labels[k] = v
+	}
+	existing.SetLabels(labels)
+	existing.SetOwnerReferences(desired.GetOwnerReferences())
+	if update != nil {
+		update(existing, desired)
+	}
+	if reflect.DeepEqual(before, existing) {
+		return nil
+	}
+	if _, err := c.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update %s %s: %w", kind, desired.GetName(), err)
+	}
+	return nil
+}
+
+// updateStatus records the Available and Degraded conditions.
+func (r *Reconciler) updateStatus(ctx context.Context, obj *unstructured.Unstructured, available bool, reconcileErr error) error {
+	var status kube.IMDSConfigStatus
+	if raw, ok := obj.Object["status"].(map[string]interface{}); ok {
+		// A status that doesn't parse is simply rewritten
+		_ = runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &status)
+	}
+	status.ObservedGeneration = obj.GetGeneration()
+
+	availableCondition := metav1.Condition{
+		Type:    kube.ConditionAvailable,
+		Status:  metav1.ConditionFalse,
+		Reason:  "WebhookUnavailable",
+		Message: "No webhook replica is available",
+	}
+	if available {
+		availableCondition.Status = metav1.ConditionTrue
+		availableCondition.Reason = "WebhookAvailable"
+		availableCondition.Message = "The webhook is serving"
+	}
+	degradedCondition := metav1.Condition{
+		Type:    kube.ConditionDegraded,
+		Status:  metav1.ConditionFalse,
+		Reason:  "Reconciled",
+		Message: "All webhook objects are up to date",
+	}
+	if reconcileErr != nil {
+		degradedCondition.Status = metav1.ConditionTrue
+		degradedCondition.Reason = "ReconcileFailed"
+		degradedCondition.Message = reconcileErr.Error()
+	}
+	for _, condition := range []metav1.Condition{availableCondition, degradedCondition} {
+		condition.ObservedGeneration = status.ObservedGeneration
+		meta.SetStatusCondition(&status.Conditions, condition)
+	}
+
+	raw, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		return fmt.Errorf("failed to encode IMDSConfig status: %w", err)
+	}
+	if reflect.DeepEqual(obj.Object["status"], raw) {
+		return nil
+	}
+	updated := obj.DeepCopy()
+	updated.Object["status"] = raw
+	if _, err := r.Dynamic.Resource(kube.IMDSConfigResource).UpdateStatus(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update IMDSConfig %s status: %w", kube.IMDSConfigName, err)
+	}
+	return nil
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,179 @@
+package operator
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/kubevirt/kubevirt-imds/internal/kube"
+	"github.com/kubevirt/kubevirt-imds/internal/webhook"
+)
+
+func newReconciler(objects ...runtime.Object) *Reconciler {
+	dynamic := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{kube.IMDSConfigResource: "IMDSConfigList"}, objects...)
+	return &Reconciler{
+		Client:  fake.NewSimpleClientset(),
+		Dynamic: dynamic,
+		Options: Options{
+			Namespace:    "kubevirt-imds",
+			WebhookImage: "kubevirt-imds-webhook:latest",
+			IMDSImage:    "kubevirt-imds:latest",
+		},
+	}
+}
+
+func imdsConfig(spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "imds.kubevirt.io/v1alpha1",
+		"kind":       "IMDSConfig",
+		"metadata":   map[string]interface{}{"name": kube.IMDSConfigName, "uid": "5f0c2c6e", "generation": int64(2)},
+		"spec":       spec,
+	}}
+}
+
+func status(t *testing.T, r *Reconciler) kube.IMDSConfigStatus {
+	t.Helper()
+	obj, err := r.Dynamic.Resource(kube.IMDSConfigResource).Get(context.Background(), kube.IMDSConfigName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	var status kube.IMDSConfigStatus
+	if raw, ok := obj.Object["status"].(map[string]interface{}); ok {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &status); err != nil {
+			t.Fatalf("invalid status: %v", err)
+		}
+	}
+	return status
+}
+
+func TestReconcileWithoutIMDSConfig(t *testing.T) {
+	r := newReconciler()
+	if err := r.Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	deployments, _ := r.Client.AppsV1().Deployments("kubevirt-imds").List(context.Background(), metav1.ListOptions{})
+	if len(deployments.Items) > 0 {
+		t.Error("Deployment created without an IMDSConfig")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	r := newReconciler(imdsConfig(map[string]interface{}{
+		"install": map[string]interface{}{"replicas": int64(2)},
+	}))
+
+	if err := r.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	d, err := r.Client.AppsV1().Deployments("kubevirt-imds").Get(ctx, WebhookName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Deployment not created: %v", err)
+	}
+	if *d.Spec.Replicas != 2 {
+		t.Errorf("replicas = %d, want 2", *d.Spec.Replicas)
+	}
+	if refs := d.GetOwnerReferences(); len(refs) != 1 || refs[0].Kind != "IMDSConfig" || refs[0].UID != "5f0c2c6e" {
+		t.Errorf("owner references = %+v, want the IMDSConfig", refs)
+	}
+
+	secret, err := r.Client.CoreV1().Secrets("kubevirt-imds").Get(ctx, TLSSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("TLS Secret not created: %v", err)
+	}
+	config, err := r.Client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, WebhookName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("MutatingWebhookConfiguration not created: %v", err)
+	}
+	if !bytes.Equal(config.Webhooks[0].ClientConfig.CABundle, secret.Data[webhook.SecretKeyCACert]) {
+		t.Error("caBundle doesn't match the CA in the Secret")
+	}
+	for _, name := range []string{WebhookName, ConfigReaderName} {
+		if _, err := r.Client.RbacV1().ClusterRoles().Get(ctx, name, metav1.GetOptions{}); err != nil {
+			t.Errorf("ClusterRole %s not created: %v", name, err)
+		}
+	}
+	if _, err := r.Client.CoreV1().Services("kubevirt-imds").Get(ctx, WebhookName, metav1.GetOptions{}); err != nil {
+		t.Errorf("Service not created: %v", err)
+	}
+
+	got := status(t, r)
+	if got.ObservedGeneration != 2 {
+		t.Errorf("observedGeneration = %d, want 2", got.ObservedGeneration)
+	}
+	if !meta.IsStatusConditionFalse(got.Conditions, kube.ConditionAvailable) || !meta.IsStatusConditionFalse(got.Conditions, kube.ConditionDegraded) {
+		t.Errorf("conditions = %+v, want not available and not degraded", got.Conditions)
+	}
+
+	// Once a replica is up the IMDSConfig reports it; the certificates and
+	// so the pod template stay the same
+	hash := d.Spec.Template.Annotations[AnnotationTLSHash]
+	d.Status.AvailableReplicas = 1
+	if _, err := r.Client.AppsV1().Deployments("kubevirt-imds").UpdateStatus(ctx, d, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("UpdateStatus() error = %v", err)
+	}
+	if err := r.Reconcile(ctx); err != nil {
+		t.Fatalf("second Reconcile() error = %v", err)
+	}
+	if !meta.IsStatusConditionTrue(status(t, r).Conditions, kube.ConditionAvailable) {
+		t.Error("Available isn't true with an available replica")
+	}
+	d, _ = r.Client.AppsV1().Deployments("kubevirt-imds").Get(ctx, WebhookName, metav1.GetOptions{})
+	if d.Spec.Template.Annotations[AnnotationTLSHash] != hash {
+		t.Error("second Reconcile() changed the serving certificate")
+	}
+}
+
+func TestReconcileRepairsDrift(t *testing.T) {
+	ctx := context.Background()
+	r := newReconciler(imdsConfig(map[string]interface{}{}))
+	if err := r.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	service, _ := r.Client.CoreV1().Services("kubevirt-imds").Get(ctx, WebhookName, metav1.GetOptions{})
+	service.Spec.ClusterIP = "10.96.0.42"
+	service.Spec.Ports[0].Port = 8080
+	if _, err := r.Client.CoreV1().Services("kubevirt-imds").Update(ctx, service, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+
+	if err := r.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	service, _ = r.Client.CoreV1().Services("kubevirt-imds").Get(ctx, WebhookName, metav1.GetOptions{})
+	if service.Spec.Ports[0].Port != 443 {
+		t.Errorf("port = %d, want 443 restored", service.Spec.Ports[0].Port)
+	}
+	if service.Spec.ClusterIP != "10.96.0.42" {
+		t.Errorf("clusterIP = %q, want it kept", service.Spec.ClusterIP)
+	}
+}
+
+func TestReconcileInvalidIMDSConfig(t *testing.T) {
+	r := newReconciler(imdsConfig(map[string]interface{}{
+		"install": map[string]interface{}{"webhookImage": "webhook@sha256:short"},
+	}))
+
+	if err := r.Reconcile(context.Background()); err == nil {
+		t.Fatal("Reconcile() expected error")
+	}
+	degraded := meta.FindStatusCondition(status(t, r).Conditions, kube.ConditionDegraded)
+	if degraded == nil || degraded.Status != metav1.ConditionTrue || !strings.Contains(degraded.Message, "sha256") {
+		t.Errorf("Degraded = %+v, want true with the validation error", degraded)
+	}
+	if _, err := r.Client.CoreV1().Services("kubevirt-imds").Get(context.Background(), WebhookName, metav1.GetOptions{}); err == nil {
+		t.Error("objects created from an invalid IMDSConfig")
+	}
+}
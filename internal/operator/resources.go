@@ -0,0 +1,279 @@
+package operator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"github.com/kubevirt/kubevirt-imds/internal/kube"
+	"github.com/kubevirt/kubevirt-imds/internal/webhook"
+)
+
+// Names of the objects the operator manages, matching deploy/webhook
+const (
+	// WebhookName names the webhook's Deployment, Service, ServiceAccount,
+	// RBAC and MutatingWebhookConfiguration
+	WebhookName = "imds-webhook"
+	// TLSSecretName is the Secret holding the webhook certificates
+	TLSSecretName = "imds-webhook-tls"
+	// ConfigReaderName is the ClusterRole letting sidecars read the policy
+	ConfigReaderName = "imds-config-reader"
+)
+
+// AnnotationTLSHash on the webhook pod template changes with the serving
+// certificate, so a renewal rolls the webhook pods onto it.
+const AnnotationTLSHash = "imds.kubevirt.io/tls-hash"
+
+const (
+	webhookPort  = 8443
+	certsVolume  = "webhook-certs"
+	certsDir     = "/etc/webhook/certs"
+	managedLabel = "app.kubernetes.io/managed-by"
+	operatorName = "imds-operator"
+)
+
+// Options are the operator's defaults for the install.
+type Options struct {
+	// Namespace the webhook runs in
+	Namespace string
+	// WebhookImage is the webhook image unless IMDSConfig sets one
+	WebhookImage string
+	// IMDSImage is the sidecar image the webhook injects
+	IMDSImage string
+	// ImagePullPolicy of the webhook container
+	ImagePullPolicy corev1.PullPolicy
+}
+
+// labels are set on every managed object.
+func labels() map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/name": WebhookName,
+		managedLabel:             operatorName,
+	}
+}
+
+// selectorLabels select the webhook pods.
+func selectorLabels() map[string]string {
+	return map[string]string{"app.kubernetes.io/name": WebhookName}
+}
+
+func (o Options) meta(name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{Name: name, Namespace: o.Namespace, Labels: labels()}
+}
+
+func clusterMeta(name string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{Name: name, Labels: labels()}
+}
+
+func serviceAccount(o Options) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{ObjectMeta: o.meta(WebhookName)}
+}
+
+// clusterRole mirrors the imds-webhook ClusterRole in deploy/webhook/rbac.yaml.
+func clusterRole() *rbacv1.ClusterRole {
+	return &rbacv1.ClusterRole{
+		ObjectMeta: clusterMeta(WebhookName),
+		Rules: []rbacv1.PolicyRule{
+			{APIGroups: []string{""}, Resources: []string{"pods", "namespaces", "secrets"}, Verbs: []string{"get", "list", "watch"}},
+			{APIGroups: []string{"imds.kubevirt.io"}, Resources: []string{"imdsconfigs"}, Verbs: []string{"get", "list", "watch"}},
+			{APIGroups: []string{kube.VMIResource.Group}, Resources: []string{kube.VMIResource.Resource}, Verbs: []string{"get", "list", "watch"}},
+		},
+	}
+}
+
+func clusterRoleBinding(o Options) *rbacv1.ClusterRoleBinding {
+	return &rbacv1.ClusterRoleBinding{
+		ObjectMeta: clusterMeta(WebhookName),
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: WebhookName},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: WebhookName, Namespace: o.Namespace}},
+	}
+}
+
+// configReaderClusterRole lets sidecars, which run as the VM's
+// ServiceAccount, read the cluster IMDSConfig.
+func configReaderClusterRole() *rbacv1.ClusterRole {
+	return &rbacv1.ClusterRole{
+		ObjectMeta: clusterMeta(ConfigReaderName),
+		Rules: []rbacv1.PolicyRule{
+			{APIGroups: []string{"imds.kubevirt.io"}, Resources: []string{"imdsconfigs"}, ResourceNames: []string{kube.IMDSConfigName}, Verbs: []string{"get"}},
+		},
+	}
+}
+
+func configReaderClusterRoleBinding() *rbacv1.ClusterRoleBinding {
+	return &rbacv1.ClusterRoleBinding{
+		ObjectMeta: clusterMeta(ConfigReaderName),
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: ConfigReaderName},
+		Subjects:   []rbacv1.Subject{{APIGroup: rbacv1.GroupName, Kind: rbacv1.GroupKind, Name: "system:serviceaccounts"}},
+	}
+}
+
+// role lets the webhook reload its ConfigMap. The operator owns the TLS
+// Secret, so unlike deploy/webhook the webhook can't write Secrets.
+func role(o Options) *rbacv1.Role {
+	return &rbacv1.Role{
+		ObjectMeta: o.meta(WebhookName),
+		Rules: []rbacv1.PolicyRule{
+			{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get", "list", "watch"}},
+		},
+	}
+}
+
+func roleBinding(o Options) *rbacv1.RoleBinding {
+	return &rbacv1.RoleBinding{
+		ObjectMeta: o.meta(WebhookName),
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: WebhookName},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: WebhookName, Namespace: o.Namespace}},
+	}
+}
+
+func service(o Options) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: o.meta(WebhookName),
+		Spec: corev1.ServiceSpec{
+			Selector: selectorLabels(),
+			Ports: []corev1.ServicePort{{
+				Name:       "https",
+				Port:       443,
+				TargetPort: intstr.FromInt32(webhookPort),
+				Protocol:   corev1.ProtocolTCP,
+			}},
+		},
+	}
+}
+
+// deployment is the webhook Deployment. servingCert is hashed into the pod
+// template so that new certificates roll the pods.
+func deployment(o Options, install kube.IMDSInstall, servingCert []byte) *appsv1.Deployment {
+	image := o.WebhookImage
+	if install.WebhookImage != "" {
+		image = install.WebhookImage
+	}
+	replicas := int32(1)
+	if install.Replicas != nil {
+		replicas = *install.Replicas
+	}
+	hash := sha256.Sum256(servingCert)
+
+	probe := &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{
+			Path:   "/healthz",
+			Port:   intstr.FromInt32(webhookPort),
+			Scheme: corev1.URISchemeHTTPS,
+		}},
+		InitialDelaySeconds: 5,
+		PeriodSeconds:       10,
+	}
+
+	return &appsv1.Deployment{
+		ObjectMeta: o.meta(WebhookName),
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: selectorLabels()},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      selectorLabels(),
+					Annotations: map[string]string{AnnotationTLSHash: hex.EncodeToString(hash[:8])},
+				},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: WebhookName,
+					Containers: []corev1.Container{{
+						Name:            "webhook",
+						Image:           image,
+						ImagePullPolicy: o.ImagePullPolicy,
+						Args: []string{
+							"--listen-addr=:8443",
+							"--cert-file=" + certsDir + "/" + corev1.TLSCertKey,
+							"--key-file=" + certsDir + "/" + corev1.TLSPrivateKeyKey,
+						},
+						Env: []corev1.EnvVar{
+							{Name: "IMDS_IMAGE", Value: o.IMDSImage},
+							{Name: "POD_NAMESPACE", ValueFrom: &corev1.EnvVarSource{
+								FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"},
+							}},
+						},
+						Ports:          []corev1.ContainerPort{{Name: "https", ContainerPort: webhookPort, Protocol: corev1.ProtocolTCP}},
+						ReadinessProbe: probe,
+						LivenessProbe:  probe,
+						VolumeMounts:   []corev1.VolumeMount{{Name: certsVolume, MountPath: certsDir, ReadOnly: true}},
+						Resources: corev1.ResourceRequirements{
+							Requests: corev1.ResourceList{
+								corev1.ResourceCPU:    resource.MustParse("10m"),
+								corev1.ResourceMemory: resource.MustParse("32Mi"),
+							},
+							Limits: corev1.ResourceList{
+								corev1.ResourceCPU:    resource.MustParse("100m"),
+								corev1.ResourceMemory: resource.MustParse("64Mi"),
+							},
+						},
+					}},
+					Volumes: []corev1.Volume{{
+						Name:         certsVolume,
+						VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: TLSSecretName}},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// mutatingWebhookConfiguration mirrors deploy/webhook/webhook.yaml, with the
+// operator's CA in the caBundle.
+func mutatingWebhookConfiguration(o Options, caBundle []byte) *admissionregistrationv1.MutatingWebhookConfiguration {
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	scope := admissionregistrationv1.NamespacedScope
+	path := "/mutate"
+	port := int32(443)
+	fail, ignore := admissionregistrationv1.Fail, admissionregistrationv1.Ignore
+	ifNeeded, never := admissionregistrationv1.IfNeededReinvocationPolicy, admissionregistrationv1.NeverReinvocationPolicy
+
+	newWebhook := func(name string, operation admissionregistrationv1.OperationType, timeout int32, failurePolicy *admissionregistrationv1.FailurePolicyType, reinvocation *admissionregistrationv1.ReinvocationPolicyType) admissionregistrationv1.MutatingWebhook {
+		return admissionregistrationv1.MutatingWebhook{
+			Name:                    name,
+			AdmissionReviewVersions: []string{"v1"},
+			SideEffects:             &sideEffects,
+			TimeoutSeconds:          &timeout,
+			NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{
+				Key:      corev1.LabelMetadataName,
+				Operator: metav1.LabelSelectorOpNotIn,
+				Values:   []string{"kube-system", o.Namespace},
+			}}},
+			ObjectSelector: &metav1.LabelSelector{MatchLabels: map[string]string{webhook.LauncherLabel: webhook.LauncherLabelValue}},
+			Rules: []admissionregistrationv1.RuleWithOperations{{
+				Operations: []admissionregistrationv1.OperationType{operation},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{""},
+					APIVersions: []string{"v1"},
+					Resources:   []string{"pods"},
+					Scope:       &scope,
+				},
+			}},
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Name:      WebhookName,
+					Namespace: o.Namespace,
+					Path:      &path,
+					Port:      &port,
+				},
+				CABundle: caBundle,
+			},
+			FailurePolicy:      failurePolicy,
+			ReinvocationPolicy: reinvocation,
+		}
+	}
+
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: clusterMeta(WebhookName),
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			newWebhook("imds.kubevirt.io", admissionregistrationv1.Create, 10, &fail, &ifNeeded),
+			newWebhook("update.imds.kubevirt.io", admissionregistrationv1.Update, 5, &ignore, &never),
+		},
+	}
+}
@@ -0,0 +1,78 @@
+package operator
+
+import (
+	"bytes"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/kubevirt/kubevirt-imds/internal/kube"
+)
+
+func TestDeployment(t *testing.T) {
+	o := Options{Namespace: "kubevirt-imds", WebhookImage: "kubevirt-imds-webhook:v1", IMDSImage: "kubevirt-imds:v1", ImagePullPolicy: corev1.PullIfNotPresent}
+	replicas := int32(3)
+
+	tests := []struct {
+		name         string
+		install      kube.IMDSInstall
+		wantImage    string
+		wantReplicas int32
+	}{
+		{name: "operator defaults", wantImage: "kubevirt-imds-webhook:v1", wantReplicas: 1},
+		{
+			name:         "IMDSConfig install",
+			install:      kube.IMDSInstall{WebhookImage: "kubevirt-imds-webhook:v2", Replicas: &replicas},
+			wantImage:    "kubevirt-imds-webhook:v2",
+			wantReplicas: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := deployment(o, tt.install, []byte("cert"))
+			container := d.Spec.Template.Spec.Containers[0]
+			if container.Image != tt.wantImage {
+				t.Errorf("image = %s, want %s", container.Image, tt.wantImage)
+			}
+			if *d.Spec.Replicas != tt.wantReplicas {
+				t.Errorf("replicas = %d, want %d", *d.Spec.Replicas, tt.wantReplicas)
+			}
+			if container.Env[0].Name != "IMDS_IMAGE" || container.Env[0].Value != o.IMDSImage {
+				t.Errorf("env[0] = %+v, want IMDS_IMAGE=%s", container.Env[0], o.IMDSImage)
+			}
+			if d.Spec.Template.Spec.Volumes[0].Secret.SecretName != TLSSecretName {
+				t.Errorf("certificates not mounted from %s", TLSSecretName)
+			}
+		})
+	}
+
+	// A new serving certificate rolls the pods
+	before := deployment(o, kube.IMDSInstall{}, []byte("cert"))
+	after := deployment(o, kube.IMDSInstall{}, []byte("renewed cert"))
+	if before.Spec.Template.Annotations[AnnotationTLSHash] == after.Spec.Template.Annotations[AnnotationTLSHash] {
+		t.Error("pod template doesn't change with the serving certificate")
+	}
+}
+
+func TestMutatingWebhookConfiguration(t *testing.T) {
+	config := mutatingWebhookConfiguration(Options{Namespace: "imds-system"}, []byte("ca"))
+
+	if len(config.Webhooks) != 2 {
+		t.Fatalf("webhooks = %d, want 2", len(config.Webhooks))
+	}
+	for _, w := range config.Webhooks {
+		if !bytes.Equal(w.ClientConfig.CABundle, []byte("ca")) {
+			t.Errorf("%s caBundle = %q, want the CA", w.Name, w.ClientConfig.CABundle)
+		}
+		if w.ClientConfig.Service.Namespace != "imds-system" {
+			t.Errorf("%s service namespace = %s, want imds-system", w.Name, w.ClientConfig.Service.Namespace)
+		}
+		if excluded := w.NamespaceSelector.MatchExpressions[0].Values; excluded[len(excluded)-1] != "imds-system" {
+			t.Errorf("%s doesn't exclude its own namespace: %v", w.Name, excluded)
+		}
+	}
+	if *config.Webhooks[0].FailurePolicy != "Fail" || *config.Webhooks[1].FailurePolicy != "Ignore" {
+		t.Error("CREATE must fail closed and UPDATE must fail open")
+	}
+}
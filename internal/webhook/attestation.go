@@ -0,0 +1,68 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// AttestationVolumeName is the volume holding the TPM attestation policy
+	AttestationVolumeName = "imds-attestation"
+	// AttestationMountPath is where the TPM attestation policy is mounted
+	AttestationMountPath = "/var/run/imds/attestation"
+	// DefaultAttestationPolicyKey is the Secret key read when the reference
+	// names none
+	DefaultAttestationPolicyKey = "policy.json"
+)
+
+// attestationVolume returns the volume for the Secret referenced by
+// AnnotationAttestationPolicySecret as "<name>" or "<name>/<key>", or nil if
+// the annotation isn't set.
+func attestationVolume(annotations map[string]string) (*corev1.Volume, error) {
+	ref := annotations[AnnotationAttestationPolicySecret]
+	if ref == "" {
+		return nil, nil
+	}
+
+	name, key, found := strings.Cut(ref, "/")
+	if !found {
+		key = DefaultAttestationPolicyKey
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s %q: %s", AnnotationAttestationPolicySecret, ref, strings.Join(errs, "; "))
+	}
+	if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s %q: %s", AnnotationAttestationPolicySecret, ref, strings.Join(errs, "; "))
+	}
+
+	// A Secret rather than a ConfigMap, so the VM owner's namespace RBAC on
+	// ConfigMaps can't loosen the policy
+	mode := int32(0400)
+	return &corev1.Volume{
+		Name: AttestationVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName:  name,
+				Items:       []corev1.KeyToPath{{Key: key, Path: DefaultAttestationPolicyKey}},
+				DefaultMode: &mode,
+			},
+		},
+	}, nil
+}
+
+// configureAttestation mounts the attestation policy and has the sidecar
+// hold tokens back until the guest attests against it.
+func configureAttestation(container *corev1.Container) {
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      AttestationVolumeName,
+		MountPath: AttestationMountPath,
+		ReadOnly:  true,
+	})
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "IMDS_ATTESTATION_POLICY",
+		Value: AttestationMountPath + "/" + DefaultAttestationPolicyKey,
+	})
+}
@@ -0,0 +1,74 @@
+package webhook
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAttestationVolume(t *testing.T) {
+	tests := []struct {
+		name       string
+		ref        string
+		wantSecret string
+		wantKey    string
+		wantErr    bool
+	}{
+		{name: "not set"},
+		{name: "default key", ref: "vm-tpm-policy", wantSecret: "vm-tpm-policy", wantKey: "policy.json"},
+		{name: "explicit key", ref: "vm-tpm-policy/fedora-40.json", wantSecret: "vm-tpm-policy", wantKey: "fedora-40.json"},
+		{name: "invalid name", ref: "VM_Policy", wantErr: true},
+		{name: "invalid key", ref: "vm-tpm-policy/a:b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volume, err := attestationVolume(map[string]string{AnnotationAttestationPolicySecret: tt.ref})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("attestationVolume() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantSecret == "" {
+				if volume != nil {
+					t.Errorf("attestationVolume() = %v, want nil", volume)
+				}
+				return
+			}
+			if volume.Secret == nil || volume.Secret.SecretName != tt.wantSecret || volume.Secret.Items[0].Key != tt.wantKey {
+				t.Errorf("attestationVolume() = %+v, want Secret %s key %s", volume.VolumeSource, tt.wantSecret, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestMutateAttestation(t *testing.T) {
+	mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test-ns",
+			Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+			Annotations: map[string]string{AnnotationEnabled: "true", AnnotationAttestationPolicySecret: "vm-tpm-policy"},
+		},
+	}
+
+	patches, err := mutator.Mutate(pod)
+	if err != nil {
+		t.Fatalf("Mutate() error = %v", err)
+	}
+
+	container := patches[1].Value.(corev1.Container)
+	var mounted bool
+	for _, m := range container.VolumeMounts {
+		mounted = mounted || (m.Name == AttestationVolumeName && m.MountPath == AttestationMountPath)
+	}
+	if !mounted {
+		t.Errorf("no %s mount in %v", AttestationVolumeName, container.VolumeMounts)
+	}
+	env := map[string]string{}
+	for _, e := range container.Env {
+		env[e.Name] = e.Value
+	}
+	if env["IMDS_ATTESTATION_POLICY"] != AttestationMountPath+"/policy.json" {
+		t.Errorf("env = %v", env)
+	}
+}
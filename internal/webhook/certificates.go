@@ -0,0 +1,55 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Approval modes for AnnotationCertificateApproval
+const (
+	CertificateApprovalExternal = "external"
+	CertificateApprovalAuto     = "auto"
+)
+
+// configureCertificates points the sidecar at the signer named in
+// AnnotationCertificateSigner, which enables POST /v1/certificates.
+func configureCertificates(container *corev1.Container, annotations map[string]string) error {
+	signer := annotations[AnnotationCertificateSigner]
+	approval := annotations[AnnotationCertificateApproval]
+	if signer == "" {
+		if approval != "" {
+			return fmt.Errorf("%s is set without %s", AnnotationCertificateApproval, AnnotationCertificateSigner)
+		}
+		return nil
+	}
+	if err := validateSignerName(signer); err != nil {
+		return fmt.Errorf("invalid %s %q: %w", AnnotationCertificateSigner, signer, err)
+	}
+	switch approval {
+	case "", CertificateApprovalExternal, CertificateApprovalAuto:
+	default:
+		return fmt.Errorf("invalid %s %q: must be %q or %q", AnnotationCertificateApproval, approval, CertificateApprovalExternal, CertificateApprovalAuto)
+	}
+
+	container.Env = append(container.Env, corev1.EnvVar{Name: "IMDS_CERTIFICATE_SIGNER", Value: signer})
+	if approval != "" {
+		container.Env = append(container.Env, corev1.EnvVar{Name: "IMDS_CERTIFICATE_APPROVAL", Value: approval})
+	}
+	return nil
+}
+
+// validateSignerName checks the "<domain>/<path>" form the CSR API requires
+// of signer names.
+func validateSignerName(signer string) error {
+	domain, path, ok := strings.Cut(signer, "/")
+	if !ok || path == "" {
+		return fmt.Errorf("must be <domain>/<path>")
+	}
+	if errs := validation.IsDNS1123Subdomain(domain); len(errs) > 0 {
+		return fmt.Errorf("domain %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package webhook
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestConfigureCertificates(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantEnv     []corev1.EnvVar
+		wantErr     string
+	}{
+		{name: "not requested"},
+		{
+			name:        "signer",
+			annotations: map[string]string{AnnotationCertificateSigner: "example.com/vm-signer"},
+			wantEnv:     []corev1.EnvVar{{Name: "IMDS_CERTIFICATE_SIGNER", Value: "example.com/vm-signer"}},
+		},
+		{
+			name:        "auto approval",
+			annotations: map[string]string{AnnotationCertificateSigner: "example.com/vm-signer", AnnotationCertificateApproval: "auto"},
+			wantEnv: []corev1.EnvVar{
+				{Name: "IMDS_CERTIFICATE_SIGNER", Value: "example.com/vm-signer"},
+				{Name: "IMDS_CERTIFICATE_APPROVAL", Value: "auto"},
+			},
+		},
+		{name: "signer without path", annotations: map[string]string{AnnotationCertificateSigner: "example.com"}, wantErr: "<domain>/<path>"},
+		{name: "invalid domain", annotations: map[string]string{AnnotationCertificateSigner: "Example_com/signer"}, wantErr: "domain"},
+		{name: "invalid approval", annotations: map[string]string{AnnotationCertificateSigner: "example.com/vm-signer", AnnotationCertificateApproval: "always"}, wantErr: "must be"},
+		{name: "approval without signer", annotations: map[string]string{AnnotationCertificateApproval: "auto"}, wantErr: "without"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var container corev1.Container
+			err := configureCertificates(&container, tt.annotations)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("configureCertificates() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("configureCertificates() error = %v", err)
+			}
+			if !reflect.DeepEqual(container.Env, tt.wantEnv) {
+				t.Errorf("env = %v, want %v", container.Env, tt.wantEnv)
+			}
+		})
+	}
+}
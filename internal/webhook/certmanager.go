@@ -0,0 +1,154 @@
+package webhook
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"reflect"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// CertificateResource is the cert-manager Certificate resource
+var CertificateResource = schema.GroupVersionResource{
+	Group:    "cert-manager.io",
+	Version:  "v1",
+	Resource: "certificates",
+}
+
+// AnnotationInjectCAFrom has the cert-manager CA injector keep the caBundle
+// of a webhook configuration in sync with a Certificate
+const AnnotationInjectCAFrom = "cert-manager.io/inject-ca-from"
+
+// Issuer kinds for CertManagerCerts.IssuerKind
+const (
+	IssuerKind        = "Issuer"
+	ClusterIssuerKind = "ClusterIssuer"
+)
+
+// CertManagerCerts has cert-manager issue and renew the webhook's serving
+// certificate, for clusters that already run it.
+type CertManagerCerts struct {
+	// Namespace and Service are where the API server reaches the webhook
+	Namespace string
+	Service   string
+	// CertificateName is the Certificate created in Namespace
+	CertificateName string
+	// SecretName is the TLS Secret cert-manager stores the certificate in
+	SecretName string
+	// IssuerKind and IssuerName reference the Issuer or ClusterIssuer
+	IssuerKind string
+	IssuerName string
+	// WebhookConfiguration is the MutatingWebhookConfiguration whose
+	// caBundle the CA injector fills in
+	WebhookConfiguration string
+}
+
+// ParseIssuer parses an issuer reference written "<name>", "Issuer/<name>"
+// or "ClusterIssuer/<name>".
+func ParseIssuer(ref string) (kind, name string, err error) {
+	kind, name, found := strings.Cut(ref, "/")
+	if !found {
+		kind, name = IssuerKind, ref
+	}
+	if kind != IssuerKind && kind != ClusterIssuerKind {
+		return "", "", fmt.Errorf("invalid issuer kind %q: must be %s or %s", kind, IssuerKind, ClusterIssuerKind)
+	}
+	if name == "" {
+		return "", "", fmt.Errorf("issuer name is empty")
+	}
+	return kind, name, nil
+}
+
+// certificate returns the desired Certificate.
+func (c CertManagerCerts) certificate() *unstructured.Unstructured {
+	dnsNames := make([]interface{}, 0, 4)
+	for _, name := range serviceDNSNames(c.Service, c.Namespace) {
+		dnsNames = append(dnsNames, name)
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": CertificateResource.GroupVersion().String(),
+		"kind":       "Certificate",
+		"metadata": map[string]interface{}{
+			"name":      c.CertificateName,
+			"namespace": c.Namespace,
+		},
+		"spec": map[string]interface{}{
+			"secretName": c.SecretName,
+			"dnsNames":   dnsNames,
+			"usages":     []interface{}{"server auth"},
+			"issuerRef": map[string]interface{}{
+				"group": CertificateResource.Group,
+				"kind":  c.IssuerKind,
+				"name":  c.IssuerName,
+			},
+		},
+	}}
+}
+
+// Ensure creates or updates the Certificate and annotates the webhook
+// configuration for CA injection. It doesn't wait for the certificate to be
+// issued; Load fails until it is. The webhook needs get, create and update on
+// the Certificate.
+func (c CertManagerCerts) Ensure(ctx context.Context, client kubernetes.Interface, dynamicClient dynamic.Interface) error {
+	desired := c.certificate()
+	certificates := dynamicClient.Resource(CertificateResource).Namespace(c.Namespace)
+	existing, err := certificates.Get(ctx, c.CertificateName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		_, err := certificates.Create(ctx, desired, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// Another replica got there first; make sure it matches
+			return c.Ensure(ctx, client, dynamicClient)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create Certificate %s/%s: %w", c.Namespace, c.CertificateName, err)
+		}
+	case err != nil:
+		return fmt.Errorf("failed to get Certificate %s/%s: %w", c.Namespace, c.CertificateName, err)
+	case !reflect.DeepEqual(existing.Object["spec"], desired.Object["spec"]):
+		existing.Object["spec"] = desired.Object["spec"]
+		_, err := certificates.Update(ctx, existing, metav1.UpdateOptions{})
+		if apierrors.IsConflict(err) {
+			return c.Ensure(ctx, client, dynamicClient)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update Certificate %s/%s: %w", c.Namespace, c.CertificateName, err)
+		}
+	}
+
+	return AnnotateCAInjection(ctx, client, c.WebhookConfiguration, c.Namespace+"/"+c.CertificateName)
+}
+
+// Load returns the serving certificate cert-manager stored in the Secret.
+func (c CertManagerCerts) Load(ctx context.Context, client kubernetes.Interface) (tls.Certificate, error) {
+	return LoadCertificate(ctx, client, c.Namespace, c.SecretName)
+}
+
+// AnnotateCAInjection points the cert-manager CA injector at a Certificate,
+// given as "<namespace>/<name>", for a MutatingWebhookConfiguration. The
+// webhook needs get and update on the configuration.
+func AnnotateCAInjection(ctx context.Context, client kubernetes.Interface, name, certificate string) error {
+	configs := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	config, err := configs.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get MutatingWebhookConfiguration %s: %w", name, err)
+	}
+	if config.Annotations[AnnotationInjectCAFrom] == certificate {
+		return nil
+	}
+	if config.Annotations == nil {
+		config.Annotations = make(map[string]string)
+	}
+	config.Annotations[AnnotationInjectCAFrom] = certificate
+	if _, err := configs.Update(ctx, config, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update MutatingWebhookConfiguration %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseIssuer(t *testing.T) {
+	tests := []struct {
+		ref      string
+		wantKind string
+		wantName string
+		wantErr  bool
+	}{
+		{ref: "ca-issuer", wantKind: IssuerKind, wantName: "ca-issuer"},
+		{ref: "Issuer/ca-issuer", wantKind: IssuerKind, wantName: "ca-issuer"},
+		{ref: "ClusterIssuer/letsencrypt", wantKind: ClusterIssuerKind, wantName: "letsencrypt"},
+		{ref: "Certificate/foo", wantErr: true},
+		{ref: "ClusterIssuer/", wantErr: true},
+		{ref: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			kind, name, err := ParseIssuer(tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseIssuer(%q) error = %v, wantErr %v", tt.ref, err, tt.wantErr)
+			}
+			if kind != tt.wantKind || name != tt.wantName {
+				t.Errorf("ParseIssuer(%q) = %s/%s, want %s/%s", tt.ref, kind, name, tt.wantKind, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestCertManagerCertsEnsure(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "imds-webhook"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "imds.kubevirt.io"}},
+	})
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{CertificateResource: "CertificateList"})
+	certs := CertManagerCerts{
+		Namespace:            "kubevirt-imds",
+		Service:              "imds-webhook",
+		CertificateName:      "imds-webhook",
+		SecretName:           "imds-webhook-tls",
+		IssuerKind:           IssuerKind,
+		IssuerName:           "ca-issuer",
+		WebhookConfiguration: "imds-webhook",
+	}
+
+	getCertificate := func() *unstructured.Unstructured {
+		t.Helper()
+		cert, err := dynamicClient.Resource(CertificateResource).Namespace(certs.Namespace).Get(ctx, certs.CertificateName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Certificate not created: %v", err)
+		}
+		return cert
+	}
+
+	if err := certs.Ensure(ctx, client, dynamicClient); err != nil {
+		t.Fatalf("Ensure() error = %v", err)
+	}
+	cert := getCertificate()
+	if secret, _, _ := unstructured.NestedString(cert.Object, "spec", "secretName"); secret != certs.SecretName {
+		t.Errorf("secretName = %q, want %q", secret, certs.SecretName)
+	}
+	dnsNames, _, _ := unstructured.NestedStringSlice(cert.Object, "spec", "dnsNames")
+	if len(dnsNames) != 4 || dnsNames[2] != "imds-webhook.kubevirt-imds.svc" {
+		t.Errorf("dnsNames = %v, want the Service names", dnsNames)
+	}
+
+	config, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, certs.WebhookConfiguration, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got := config.Annotations[AnnotationInjectCAFrom]; got != "kubevirt-imds/imds-webhook" {
+		t.Errorf("%s = %q, want kubevirt-imds/imds-webhook", AnnotationInjectCAFrom, got)
+	}
+
+	// A changed issuer is applied to the existing Certificate
+	certs.IssuerKind, certs.IssuerName = ClusterIssuerKind, "letsencrypt"
+	if err := certs.Ensure(ctx, client, dynamicClient); err != nil {
+		t.Fatalf("second Ensure() error = %v", err)
+	}
+	issuer, _, _ := unstructured.NestedStringMap(getCertificate().Object, "spec", "issuerRef")
+	if issuer["kind"] != ClusterIssuerKind || issuer["name"] != "letsencrypt" {
+		t.Errorf("issuerRef = %v, want ClusterIssuer/letsencrypt", issuer)
+	}
+
+	missing := certs
+	missing.WebhookConfiguration = "missing"
+	if err := missing.Ensure(ctx, client, dynamicClient); err == nil {
+		t.Error("Ensure() with a missing MutatingWebhookConfiguration expected error")
+	}
+}
+
+func TestCertManagerCertsLoad(t *testing.T) {
+	ctx := context.Background()
+	certs := CertManagerCerts{Namespace: "kubevirt-imds", SecretName: "imds-webhook-tls"}
+
+	client := fake.NewSimpleClientset()
+	if _, err := certs.Load(ctx, client); err == nil {
+		t.Error("Load() before the certificate is issued expected error")
+	}
+
+	bundle, _, err := reconcileCertificates(nil, serviceDNSNames("imds-webhook", "kubevirt-imds"), time.Now())
+	if err != nil {
+		t.Fatalf("reconcileCertificates() error = %v", err)
+	}
+	client = fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kubevirt-imds", Name: "imds-webhook-tls"},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       bundle.Cert,
+			corev1.TLSPrivateKeyKey: bundle.Key,
+		},
+	})
+	if _, err := certs.Load(ctx, client); err != nil {
+		t.Errorf("Load() error = %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Secret keys holding the self-managed CA next to the standard
+// corev1.TLSCertKey and corev1.TLSPrivateKeyKey
+const (
+	SecretKeyCACert = "ca.crt"
+	SecretKeyCAKey  = "ca.key"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 365 * 24 * time.Hour
+	// certRenewBefore is how long before expiry the CA or serving
+	// certificate is replaced
+	certRenewBefore = 30 * 24 * time.Hour
+)
+
+// CertBundle is the webhook's serving certificate and the CA that signed
+// it, PEM encoded.
+type CertBundle struct {
+	CACert []byte
+	Cert   []byte
+	Key    []byte
+	// caKey is only kept in the Secret
+	caKey []byte
+}
+
+// TLSCertificate returns the serving certificate for a tls.Config.
+func (b *CertBundle) TLSCertificate() (tls.Certificate, error) {
+	return tls.X509KeyPair(b.Cert, b.Key)
+}
+
+// serviceDNSNames are the names the API server may use to reach the service.
+func serviceDNSNames(service, namespace string) []string {
+	return []string{
+		service,
+		service + "." + namespace,
+		service + "." + namespace + ".svc",
+		service + "." + namespace + ".svc.cluster.local",
+	}
+}
+
+// EnsureCertificates returns the webhook certificates stored in a TLS Secret,
+// creating the Secret, or replacing a missing, expiring or mismatched CA or
+// serving certificate, as needed. The CA is kept as long as it is valid, so
+// renewing the serving certificate doesn't change the caBundle. The webhook
+// needs get, create and update on the Secret.
+func EnsureCertificates(ctx context.Context, client kubernetes.Interface, namespace, secretName, service string) (*CertBundle, error) {
+	secrets := client.CoreV1().Secrets(namespace)
+	secret, err := secrets.Get(ctx, secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get Secret %s/%s: %w", namespace, secretName, err)
+	}
+
+	var data map[string][]byte
+	if secret != nil {
+		data = secret.Data
+	}
+	bundle, changed, err := reconcileCertificates(data, serviceDNSNames(service, namespace), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if !changed {
+		return bundle, nil
+	}
+
+	updated := map[string][]byte{
+		corev1.TLSCertKey:       bundle.Cert,
+		corev1.TLSPrivateKeyKey: bundle.Key,
+		SecretKeyCACert:         bundle.CACert,
+		SecretKeyCAKey:          bundle.caKey,
+	}
+	if secret == nil {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: namespace},
+			Type:       corev1.SecretTypeTLS,
+			Data:       updated,
+		}
+		_, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			// Another replica got there first; use its certificates
+			return EnsureCertificates(ctx, client, namespace, secretName, service)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Secret %s/%s: %w", namespace, secretName, err)
+		}
+		return bundle, nil
+	}
+	secret.Data = updated
+	_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		return EnsureCertificates(ctx, client, namespace, secretName, service)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update Secret %s/%s: %w", namespace, secretName, err)
+	}
+	return bundle, nil
+}
+
+// reconcileCertificates validates the certificates in Secret data and
+// generates whatever is missing or due for renewal. It reports whether the
+// data needs updating.
+func reconcileCertificates(data map[string][]byte, dnsNames []string, now time.Time) (*CertBundle, bool, error) {
+	changed := false
+
+	caCert, caKey, err := parseCA(data[SecretKeyCACert], data[SecretKeyCAKey])
+	if err != nil || !validUntil(caCert, now.Add(certRenewBefore)) {
+		caCertPEM, caKeyPEM, err := newCA(now)
+		if err != nil {
+			return nil, false, err
+		}
+		if caCert, caKey, err = parseCA(caCertPEM, caKeyPEM); err != nil {
+			return nil, false, err
+		}
+		data = map[string][]byte{SecretKeyCACert: caCertPEM, SecretKeyCAKey: caKeyPEM}
+		changed = true
+	}
+
+	bundle := &CertBundle{
+		CACert: data[SecretKeyCACert],
+		Cert:   data[corev1.TLSCertKey],
+		Key:    data[corev1.TLSPrivateKeyKey],
+		caKey:  data[SecretKeyCAKey],
+	}
+	if !changed && servingCertValid(bundle, caCert, dnsNames, now) {
+		return bundle, false, nil
+	}
+
+	if bundle.Cert, bundle.Key, err = issueServingCert(caCert, caKey, dnsNames, now); err != nil {
+		return nil, false, err
+	}
+	return bundle, true, nil
+}
+
+// servingCertValid reports whether the serving certificate matches its key,
+// is signed by the CA, covers every DNS name and isn't due for renewal.
+func servingCertValid(bundle *CertBundle, ca *x509.Certificate, dnsNames []string, now time.Time) bool {
+	pair, err := bundle.TLSCertificate()
+	if err != nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil || !validUntil(cert, now.Add(certRenewBefore)) {
+		return false
+	}
+	if cert.CheckSignatureFrom(ca) != nil {
+		return false
+	}
+	for _, name := range dnsNames {
+		if cert.VerifyHostname(name) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// validUntil reports whether a certificate is still valid at t.
+func validUntil(cert *x509.Certificate, t time.Time) bool {
+	return t.Before(cert.NotAfter)
+}
+
+// parseCA parses a PEM CA certificate and its ECDSA key.
+func parseCA(certPEM, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, fmt.Errorf("missing CA certificate or key")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CA certificate: %w", err)
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CA key: %w", err)
+	}
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return nil, nil, fmt.Errorf("CA key doesn't match the CA certificate")
+	}
+	return cert, key, nil
+}
+
+// newCA generates a self-signed CA certificate and key.
+func newCA(now time.Time) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "IMDS Webhook CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return signCertificate(template, template, &key.PublicKey, key, key)
+}
+
+// issueServingCert issues a serving certificate for dnsNames signed by the CA.
+func issueServingCert(ca *x509.Certificate, caKey *ecdsa.PrivateKey, dnsNames []string, now time.Time) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serving key: %w", err)
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: dnsNames[len(dnsNames)-2]},
+		DNSNames:    dnsNames,
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(certValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	return signCertificate(template, ca, &key.PublicKey, caKey, key)
+}
+
+// signCertificate signs a certificate and returns it with its key, PEM encoded.
+func signCertificate(template, parent *x509.Certificate, pub *ecdsa.PublicKey, signer, key *ecdsa.PrivateKey) (certPEM, keyPEM []byte, err error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	template.SerialNumber = serial
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode key: %w", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// PatchCABundle sets the caBundle of every webhook in a
+// MutatingWebhookConfiguration, if it isn't set already. The webhook needs get
+// and update on the configuration.
+func PatchCABundle(ctx context.Context, client kubernetes.Interface, name string, caBundle []byte) error {
+	configs := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	config, err := configs.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get MutatingWebhookConfiguration %s: %w", name, err)
+	}
+
+	changed := false
+	for i := range config.Webhooks {
+		if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caBundle) {
+			config.Webhooks[i].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if _, err := configs.Update(ctx, config, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update MutatingWebhookConfiguration %s: %w", name, err)
+	}
+	return nil
+}
+
+// SelfSignedCerts manages a self-signed CA and serving certificate for the
+// webhook, for installs without external certificate tooling.
+type SelfSignedCerts struct {
+	// Namespace and Service are where the API server reaches the webhook
+	Namespace string
+	Service   string
+	// SecretName is the TLS Secret in Namespace holding the certificates
+	SecretName string
+	// WebhookConfiguration is the MutatingWebhookConfiguration whose
+	// caBundle is kept pointing at the CA
+	WebhookConfiguration string
+}
+
+// Reconcile creates or renews the certificates, patches the caBundle and
+// returns the serving certificate.
+func (c SelfSignedCerts) Reconcile(ctx context.Context, client kubernetes.Interface) (tls.Certificate, error) {
+	bundle, err := EnsureCertificates(ctx, client, c.Namespace, c.SecretName, c.Service)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := PatchCABundle(ctx, client, c.WebhookConfiguration, bundle.CACert); err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := bundle.TLSCertificate()
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid serving certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// Load returns the serving certificate stored in the Secret without
+// creating or renewing anything, for replicas that leave that to the leader.
+// The webhook needs get on the Secret.
+func (c SelfSignedCerts) Load(ctx context.Context, client kubernetes.Interface) (tls.Certificate, error) {
+	return LoadCertificate(ctx, client, c.Namespace, c.SecretName)
+}
+
+// LoadCertificate returns the serving certificate in a TLS Secret. The
+// webhook needs get on the Secret.
+func LoadCertificate(ctx context.Context, client kubernetes.Interface, namespace, secretName string) (tls.Certificate, error) {
+	secret, err := client.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to get Secret %s/%s: %w", namespace, secretName, err)
+	}
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid serving certificate in Secret %s/%s: %w", namespace, secretName, err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,209 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func parseCertificate(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("certificate is not PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	return cert
+}
+
+func TestReconcileCertificates(t *testing.T) {
+	names := serviceDNSNames("imds-webhook", "kubevirt-imds")
+	now := time.Now()
+
+	initial, changed, err := reconcileCertificates(nil, names, now)
+	if err != nil || !changed {
+		t.Fatalf("reconcileCertificates(empty) = %v, %v; want new certificates", changed, err)
+	}
+	data := map[string][]byte{
+		corev1.TLSCertKey:       initial.Cert,
+		corev1.TLSPrivateKeyKey: initial.Key,
+		SecretKeyCACert:         initial.CACert,
+		SecretKeyCAKey:          initial.caKey,
+	}
+
+	ca := parseCertificate(t, initial.CACert)
+	cert := parseCertificate(t, initial.Cert)
+	if err := cert.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("serving certificate not signed by the CA: %v", err)
+	}
+	for _, name := range names {
+		if err := cert.VerifyHostname(name); err != nil {
+			t.Errorf("serving certificate doesn't cover %s: %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		data     map[string][]byte
+		dnsNames []string
+		now      time.Time
+		changed  bool
+		newCA    bool
+	}{
+		{name: "valid", data: data, dnsNames: names, now: now},
+		{
+			name:     "serving certificate expiring",
+			data:     data,
+			dnsNames: names,
+			now:      now.Add(certValidity - certRenewBefore/2),
+			changed:  true,
+		},
+		{
+			name:     "service renamed",
+			data:     data,
+			dnsNames: serviceDNSNames("imds", "kubevirt-imds"),
+			now:      now,
+			changed:  true,
+		},
+		{
+			name: "serving key missing",
+			data: map[string][]byte{
+				corev1.TLSCertKey: initial.Cert,
+				SecretKeyCACert:   initial.CACert,
+				SecretKeyCAKey:    initial.caKey,
+			},
+			dnsNames: names,
+			now:      now,
+			changed:  true,
+		},
+		{
+			name:     "CA expiring",
+			data:     data,
+			dnsNames: names,
+			now:      now.Add(caValidity - certRenewBefore/2),
+			changed:  true,
+			newCA:    true,
+		},
+		{
+			name: "externally managed certificate without CA key",
+			data: map[string][]byte{
+				corev1.TLSCertKey:       initial.Cert,
+				corev1.TLSPrivateKeyKey: initial.Key,
+			},
+			dnsNames: names,
+			now:      now,
+			changed:  true,
+			newCA:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed, err := reconcileCertificates(tt.data, tt.dnsNames, tt.now)
+			if err != nil {
+				t.Fatalf("reconcileCertificates() error = %v", err)
+			}
+			if changed != tt.changed {
+				t.Errorf("changed = %v, want %v", changed, tt.changed)
+			}
+			if gotNewCA := !bytes.Equal(got.CACert, initial.CACert); gotNewCA != tt.newCA {
+				t.Errorf("new CA = %v, want %v", gotNewCA, tt.newCA)
+			}
+			if !servingCertValid(got, parseCertificate(t, got.CACert), tt.dnsNames, tt.now) {
+				t.Error("serving certificate is not valid")
+			}
+		})
+	}
+}
+
+func TestSelfSignedCertsReconcile(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "imds-webhook"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "imds.kubevirt.io"}},
+	})
+	certs := SelfSignedCerts{
+		Namespace:            "kubevirt-imds",
+		Service:              "imds-webhook",
+		SecretName:           "imds-webhook-tls",
+		WebhookConfiguration: "imds-webhook",
+	}
+
+	first, err := certs.Reconcile(ctx, client)
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+
+	secret, err := client.CoreV1().Secrets(certs.Namespace).Get(ctx, certs.SecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Secret not created: %v", err)
+	}
+	if secret.Type != corev1.SecretTypeTLS || len(secret.Data[SecretKeyCAKey]) == 0 {
+		t.Errorf("Secret = type %s with keys %d, want a TLS Secret with the CA key", secret.Type, len(secret.Data))
+	}
+
+	config, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, certs.WebhookConfiguration, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !bytes.Equal(config.Webhooks[0].ClientConfig.CABundle, secret.Data[SecretKeyCACert]) {
+		t.Error("caBundle doesn't match the CA in the Secret")
+	}
+
+	// A second run reuses the stored certificates
+	second, err := certs.Reconcile(ctx, client)
+	if err != nil {
+		t.Fatalf("second Reconcile() error = %v", err)
+	}
+	if !bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Error("second Reconcile() issued a new serving certificate")
+	}
+
+	missing := certs
+	missing.WebhookConfiguration = "missing"
+	if _, err := missing.Reconcile(ctx, client); err == nil {
+		t.Error("Reconcile() with a missing MutatingWebhookConfiguration expected error")
+	}
+}
+
+func TestSelfSignedCertsLoad(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "imds-webhook"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "imds.kubevirt.io"}},
+	})
+	certs := SelfSignedCerts{
+		Namespace:            "kubevirt-imds",
+		Service:              "imds-webhook",
+		SecretName:           "imds-webhook-tls",
+		WebhookConfiguration: "imds-webhook",
+	}
+
+	// Followers wait for the leader to create the Secret
+	if _, err := certs.Load(ctx, client); err == nil {
+		t.Error("Load() before the Secret exists expected error")
+	}
+
+	issued, err := certs.Reconcile(ctx, client)
+	if err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	loaded, err := certs.Load(ctx, client)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !bytes.Equal(issued.Certificate[0], loaded.Certificate[0]) {
+		t.Error("Load() returned a different serving certificate than Reconcile()")
+	}
+}
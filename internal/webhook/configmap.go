@@ -0,0 +1,241 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigMap keys holding sidecar defaults
+const (
+	ConfigKeyImage                  = "image"
+	ConfigKeyImagePullPolicy        = "imagePullPolicy"
+	ConfigKeyImagePullSecrets       = "imagePullSecrets"
+	ConfigKeyResources              = "resources"
+	ConfigKeyTokenExpirationSeconds = "tokenExpirationSeconds"
+	ConfigKeyEnv                    = "env"
+	ConfigKeyDryRun                 = "dryRun"
+	ConfigKeyHTTPProxy              = "httpProxy"
+	ConfigKeyHTTPSProxy             = "httpsProxy"
+	ConfigKeyNoProxy                = "noProxy"
+	ConfigKeySecurityContext        = "securityContext"
+	ConfigKeyProfiles               = "profiles"
+	ConfigKeyProbes                 = "probes"
+	ConfigKeyPodSecurity            = "podSecurity"
+)
+
+// ApplyConfigMap returns base with the sidecar defaults from a ConfigMap's
+// data applied on top. Keys that are absent keep the base value; resources,
+// env and securityContext are YAML in the same shape as a container spec, and
+// profiles is a YAML map of Profile by name.
+func ApplyConfigMap(base Config, data map[string]string) (Config, error) {
+	config := base
+
+	if v, ok := data[ConfigKeyImage]; ok && v != "" {
+		config.IMDSImage = v
+	}
+
+	if v, ok := data[ConfigKeyImagePullPolicy]; ok && v != "" {
+		switch policy := corev1.PullPolicy(v); policy {
+		case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+			config.ImagePullPolicy = policy
+		default:
+			return base, fmt.Errorf("invalid %s %q", ConfigKeyImagePullPolicy, v)
+		}
+	}
+
+	if v, ok := data[ConfigKeyImagePullSecrets]; ok {
+		var secrets []corev1.LocalObjectReference
+		if err := yaml.UnmarshalStrict([]byte(v), &secrets); err != nil {
+			return base, fmt.Errorf("invalid %s: %w", ConfigKeyImagePullSecrets, err)
+		}
+		if err := validImagePullSecrets(secrets); err != nil {
+			return base, fmt.Errorf("invalid %s: %w", ConfigKeyImagePullSecrets, err)
+		}
+		config.ImagePullSecrets = secrets
+	}
+
+	if v, ok := data[ConfigKeyResources]; ok {
+		var resources corev1.ResourceRequirements
+		if err := yaml.UnmarshalStrict([]byte(v), &resources); err != nil {
+			return base, fmt.Errorf("invalid %s: %w", ConfigKeyResources, err)
+		}
+		config.Resources = resources
+	}
+
+	if v, ok := data[ConfigKeyTokenExpirationSeconds]; ok && v != "" {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || !validTokenExpiration(seconds) {
+			return base, fmt.Errorf("invalid %s %q: must be between %d and %d", ConfigKeyTokenExpirationSeconds, v, MinTokenExpiration, MaxTokenExpiration)
+		}
+		config.TokenExpirationSeconds = seconds
+	}
+
+	if v, ok := data[ConfigKeyEnv]; ok {
+		var env []corev1.EnvVar
+		if err := yaml.UnmarshalStrict([]byte(v), &env); err != nil {
+			return base, fmt.Errorf("invalid %s: %w", ConfigKeyEnv, err)
+		}
+		for _, e := range env {
+			if e.Name == "" {
+				return base, fmt.Errorf("invalid %s: variable without a name", ConfigKeyEnv)
+			}
+		}
+		config.Env = env
+	}
+
+	if v, ok := data[ConfigKeySecurityContext]; ok && v != "" {
+		var securityContext corev1.SecurityContext
+		if err := yaml.UnmarshalStrict([]byte(v), &securityContext); err != nil {
+			return base, fmt.Errorf("invalid %s: %w", ConfigKeySecurityContext, err)
+		}
+		config.SecurityContext = &securityContext
+	}
+
+	if v, ok := data[ConfigKeyProfiles]; ok {
+		var profiles map[string]Profile
+		if err := yaml.UnmarshalStrict([]byte(v), &profiles); err != nil {
+			return base, fmt.Errorf("invalid %s: %w", ConfigKeyProfiles, err)
+		}
+		for name, profile := range profiles {
+			for _, e := range profile.Env {
+				if e.Name == "" {
+					return base, fmt.Errorf("invalid %s: profile %s has a variable without a name", ConfigKeyProfiles, name)
+				}
+			}
+		}
+		config.Profiles = profiles
+	}
+
+	for key, field := range map[string]*string{
+		ConfigKeyHTTPProxy:  &config.Proxy.HTTPProxy,
+		ConfigKeyHTTPSProxy: &config.Proxy.HTTPSProxy,
+	} {
+		if v, ok := data[key]; ok {
+			if err := validProxyURL(v); err != nil {
+				return base, fmt.Errorf("invalid %s: %w", key, err)
+			}
+			*field = v
+		}
+	}
+	if v, ok := data[ConfigKeyNoProxy]; ok {
+		config.Proxy.NoProxy = v
+	}
+
+	if v, ok := data[ConfigKeyProbes]; ok {
+		if !validProbes(v) {
+			return base, fmt.Errorf("invalid %s %q: must be %q, %q or %q", ConfigKeyProbes, v, ProbesExec, ProbesHTTPGet, ProbesNone)
+		}
+		config.Probes = v
+	}
+
+	if v, ok := data[ConfigKeyPodSecurity]; ok {
+		if !validPodSecurity(v) {
+			return base, fmt.Errorf("invalid %s %q: must be %q, %q or %q", ConfigKeyPodSecurity, v, PodSecurityDeny, PodSecuritySkip, PodSecurityIgnore)
+		}
+		config.PodSecurity = v
+	}
+
+	if v, ok := data[ConfigKeyDryRun]; ok && v != "" {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			return base, fmt.Errorf("invalid %s %q", ConfigKeyDryRun, v)
+		}
+		config.DryRun = dryRun
+	}
+
+	return config, nil
+}
+
+// PullSecretReferences returns references to the named pull secrets, as
+// given to the webhook's --image-pull-secrets flag
+func PullSecretReferences(names []string) ([]corev1.LocalObjectReference, error) {
+	secrets := make([]corev1.LocalObjectReference, 0, len(names))
+	for _, name := range names {
+		secrets = append(secrets, corev1.LocalObjectReference{Name: name})
+	}
+	if err := validImagePullSecrets(secrets); err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// validImagePullSecrets checks that every pull secret has a valid Secret name
+func validImagePullSecrets(secrets []corev1.LocalObjectReference) error {
+	for _, secret := range secrets {
+		if errs := validation.IsDNS1123Subdomain(secret.Name); len(errs) > 0 {
+			return fmt.Errorf("secret name %q: %s", secret.Name, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
+// validProxyURL checks an optional proxy URL. Like Go's HTTP client, a bare
+// host:port is accepted as http://host:port.
+func validProxyURL(v string) error {
+	if v == "" {
+		return nil
+	}
+	u, err := url.Parse(v)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		if u, err = url.Parse("http://" + v); err != nil || u.Host == "" {
+			return fmt.Errorf("%q is not a proxy URL", v)
+		}
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return nil
+	default:
+		return fmt.Errorf("%q has unsupported scheme %q", v, u.Scheme)
+	}
+}
+
+// WatchConfigMap calls onChange with the ConfigMap's data whenever it is
+// created or updated, and with nil when it is deleted, until the context is
+// canceled. It blocks until the initial state has been delivered. The webhook
+// needs list and watch on configmaps in the namespace.
+func WatchConfigMap(ctx context.Context, client kubernetes.Interface, namespace, name string, onChange func(data map[string]string)) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+	informer := factory.Core().V1().ConfigMaps().Informer()
+
+	update := func(obj interface{}) {
+		if cm, ok := obj.(*corev1.ConfigMap); ok {
+			onChange(cm.Data)
+		}
+	}
+	registration, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(_, obj interface{}) { update(obj) },
+		DeleteFunc: func(interface{}) { onChange(nil) },
+	})
+	if err != nil {
+		return fmt.Errorf("failed to watch ConfigMap %s/%s: %w", namespace, name, err)
+	}
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), registration.HasSynced) {
+		return fmt.Errorf("failed to sync ConfigMap %s/%s", namespace, name)
+	}
+
+	if len(informer.GetStore().List()) == 0 {
+		log.Printf("ConfigMap %s/%s not found, using defaults", namespace, name)
+	}
+	return nil
+}
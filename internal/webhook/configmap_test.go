@@ -0,0 +1,284 @@
+package webhook
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestApplyConfigMap(t *testing.T) {
+	base := Config{
+		IMDSImage:       "imds:base",
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		SPIFFESocketDir: "/run/spire",
+	}
+
+	root, privileged := int64(0), true
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    Config
+		wantErr bool
+	}{
+		{
+			name: "no data keeps base",
+			data: nil,
+			want: base,
+		},
+		{
+			name: "image and pull policy",
+			data: map[string]string{
+				ConfigKeyImage:           "imds:v2",
+				ConfigKeyImagePullPolicy: "Always",
+			},
+			want: Config{
+				IMDSImage:       "imds:v2",
+				ImagePullPolicy: corev1.PullAlways,
+				SPIFFESocketDir: "/run/spire",
+			},
+		},
+		{
+			name: "resources, expiration and env",
+			data: map[string]string{
+				ConfigKeyResources:              "requests:\n  cpu: 10m\nlimits:\n  memory: 64Mi\n",
+				ConfigKeyTokenExpirationSeconds: "7200",
+				ConfigKeyEnv:                    "- name: IMDS_LOG_LEVEL\n  value: debug\n",
+			},
+			want: Config{
+				IMDSImage:       "imds:base",
+				ImagePullPolicy: corev1.PullIfNotPresent,
+				SPIFFESocketDir: "/run/spire",
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("10m")},
+					Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")},
+				},
+				TokenExpirationSeconds: 7200,
+				Env:                    []corev1.EnvVar{{Name: "IMDS_LOG_LEVEL", Value: "debug"}},
+			},
+		},
+		{
+			name: "dry run",
+			data: map[string]string{ConfigKeyDryRun: "true"},
+			want: Config{
+				IMDSImage:       "imds:base",
+				ImagePullPolicy: corev1.PullIfNotPresent,
+				SPIFFESocketDir: "/run/spire",
+				DryRun:          true,
+			},
+		},
+		{
+			name: "proxy",
+			data: map[string]string{
+				ConfigKeyHTTPProxy:  "http://proxy.corp:3128",
+				ConfigKeyHTTPSProxy: "proxy.corp:3128",
+				ConfigKeyNoProxy:    ".svc,.cluster.local,10.96.0.1",
+			},
+			want: Config{
+				IMDSImage:       "imds:base",
+				ImagePullPolicy: corev1.PullIfNotPresent,
+				SPIFFESocketDir: "/run/spire",
+				Proxy: ProxyConfig{
+					HTTPProxy:  "http://proxy.corp:3128",
+					HTTPSProxy: "proxy.corp:3128",
+					NoProxy:    ".svc,.cluster.local,10.96.0.1",
+				},
+			},
+		},
+		{
+			name: "security context",
+			data: map[string]string{ConfigKeySecurityContext: "runAsUser: 0\nprivileged: true\n"},
+			want: Config{
+				IMDSImage:       "imds:base",
+				ImagePullPolicy: corev1.PullIfNotPresent,
+				SPIFFESocketDir: "/run/spire",
+				SecurityContext: &corev1.SecurityContext{RunAsUser: &root, Privileged: &privileged},
+			},
+		},
+		{
+			name:    "unknown security context field",
+			data:    map[string]string{ConfigKeySecurityContext: "runAsRoot: true\n"},
+			wantErr: true,
+		},
+		{
+			name: "profiles",
+			data: map[string]string{ConfigKeyProfiles: "debug:\n  image: imds:debug\n  env:\n  - name: IMDS_LOG_LEVEL\n    value: debug\n"},
+			want: Config{
+				IMDSImage:       "imds:base",
+				ImagePullPolicy: corev1.PullIfNotPresent,
+				SPIFFESocketDir: "/run/spire",
+				Profiles: map[string]Profile{
+					ProfileDebug: {Image: "imds:debug", Env: []corev1.EnvVar{{Name: "IMDS_LOG_LEVEL", Value: "debug"}}},
+				},
+			},
+		},
+		{
+			name:    "profile env without name",
+			data:    map[string]string{ConfigKeyProfiles: "debug:\n  env:\n  - value: debug\n"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid proxy scheme",
+			data:    map[string]string{ConfigKeyHTTPSProxy: "ftp://proxy.corp"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid dry run",
+			data:    map[string]string{ConfigKeyDryRun: "maybe"},
+			wantErr: true,
+		},
+		{
+			name: "probes",
+			data: map[string]string{ConfigKeyProbes: ProbesExec},
+			want: Config{
+				IMDSImage:       "imds:base",
+				ImagePullPolicy: corev1.PullIfNotPresent,
+				SPIFFESocketDir: "/run/spire",
+				Probes:          ProbesExec,
+			},
+		},
+		{
+			name:    "invalid probes",
+			data:    map[string]string{ConfigKeyProbes: "tcpSocket"},
+			wantErr: true,
+		},
+		{
+			name: "pod security",
+			data: map[string]string{ConfigKeyPodSecurity: PodSecuritySkip},
+			want: Config{
+				IMDSImage:       "imds:base",
+				ImagePullPolicy: corev1.PullIfNotPresent,
+				SPIFFESocketDir: "/run/spire",
+				PodSecurity:     PodSecuritySkip,
+			},
+		},
+		{
+			name:    "invalid pod security",
+			data:    map[string]string{ConfigKeyPodSecurity: "warn"},
+			wantErr: true,
+		},
+		{
+			name: "image pull secrets",
+			data: map[string]string{ConfigKeyImagePullSecrets: "- name: imds-registry\n"},
+			want: Config{
+				IMDSImage:        "imds:base",
+				ImagePullPolicy:  corev1.PullIfNotPresent,
+				SPIFFESocketDir:  "/run/spire",
+				ImagePullSecrets: []corev1.LocalObjectReference{{Name: "imds-registry"}},
+			},
+		},
+		{
+			name:    "invalid image pull secret name",
+			data:    map[string]string{ConfigKeyImagePullSecrets: "- name: Not_Valid\n"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid pull policy",
+			data:    map[string]string{ConfigKeyImagePullPolicy: "Sometimes"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid resources",
+			data:    map[string]string{ConfigKeyResources: "requests: [cpu]"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown resources field",
+			data:    map[string]string{ConfigKeyResources: "request:\n  cpu: 10m\n"},
+			wantErr: true,
+		},
+		{
+			name:    "token expiration too short",
+			data:    map[string]string{ConfigKeyTokenExpirationSeconds: "60"},
+			wantErr: true,
+		},
+		{
+			name:    "token expiration too long",
+			data:    map[string]string{ConfigKeyTokenExpirationSeconds: "604800"},
+			wantErr: true,
+		},
+		{
+			name:    "token expiration not a number",
+			data:    map[string]string{ConfigKeyTokenExpirationSeconds: "1h"},
+			wantErr: true,
+		},
+		{
+			name:    "env without name",
+			data:    map[string]string{ConfigKeyEnv: "- value: debug\n"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyConfigMap(base, tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("ApplyConfigMap() expected error")
+				}
+				if !reflect.DeepEqual(got, base) {
+					t.Errorf("ApplyConfigMap() = %+v on error, want base", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyConfigMap() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ApplyConfigMap() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchConfigMap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "imds-webhook-config", Namespace: "kubevirt-imds"},
+		Data:       map[string]string{ConfigKeyImage: "imds:v1"},
+	}
+	client := fake.NewSimpleClientset(cm)
+
+	changes := make(chan map[string]string, 10)
+	onChange := func(data map[string]string) { changes <- data }
+	if err := WatchConfigMap(ctx, client, cm.Namespace, cm.Name, onChange); err != nil {
+		t.Fatalf("WatchConfigMap() error = %v", err)
+	}
+
+	next := func() map[string]string {
+		t.Helper()
+		select {
+		case data := <-changes:
+			return data
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for ConfigMap change")
+			return nil
+		}
+	}
+
+	if data := next(); data[ConfigKeyImage] != "imds:v1" {
+		t.Errorf("initial data = %v, want image imds:v1", data)
+	}
+
+	cm.Data = map[string]string{ConfigKeyImage: "imds:v2"}
+	if _, err := client.CoreV1().ConfigMaps(cm.Namespace).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if data := next(); data[ConfigKeyImage] != "imds:v2" {
+		t.Errorf("updated data = %v, want image imds:v2", data)
+	}
+
+	if err := client.CoreV1().ConfigMaps(cm.Namespace).Delete(ctx, cm.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if data := next(); data != nil {
+		t.Errorf("data after delete = %v, want nil", data)
+	}
+}
@@ -0,0 +1,59 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// EC2IdentityVolumeName is the volume holding the key pair that signs
+	// the EC2 instance identity document
+	EC2IdentityVolumeName = "imds-ec2-identity"
+	// EC2IdentityMountPath is where the EC2 identity key pair is mounted
+	EC2IdentityMountPath = "/var/run/imds/ec2-identity"
+)
+
+// ec2IdentityVolume returns the volume for the TLS Secret named in
+// AnnotationEC2IdentitySecret, or nil if the annotation isn't set.
+func ec2IdentityVolume(annotations map[string]string) (*corev1.Volume, error) {
+	secret := annotations[AnnotationEC2IdentitySecret]
+	if secret == "" {
+		return nil, nil
+	}
+	if errs := validation.IsDNS1123Subdomain(secret); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s %q: %s", AnnotationEC2IdentitySecret, secret, strings.Join(errs, "; "))
+	}
+
+	// Only the sidecar's user may read the signing key
+	mode := int32(0400)
+	return &corev1.Volume{
+		Name: EC2IdentityVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: secret,
+				Items: []corev1.KeyToPath{
+					{Key: "tls.crt", Path: "tls.crt"},
+					{Key: "tls.key", Path: "tls.key"},
+				},
+				DefaultMode: &mode,
+			},
+		},
+	}, nil
+}
+
+// configureEC2Identity mounts the key pair and has the sidecar serve a
+// signed EC2 instance identity document.
+func configureEC2Identity(container *corev1.Container) {
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      EC2IdentityVolumeName,
+		MountPath: EC2IdentityMountPath,
+		ReadOnly:  true,
+	})
+	container.Env = append(container.Env,
+		corev1.EnvVar{Name: "IMDS_EC2_IDENTITY_CERT", Value: EC2IdentityMountPath + "/tls.crt"},
+		corev1.EnvVar{Name: "IMDS_EC2_IDENTITY_KEY", Value: EC2IdentityMountPath + "/tls.key"},
+	)
+}
@@ -0,0 +1,72 @@
+package webhook
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEC2IdentityVolume(t *testing.T) {
+	tests := []struct {
+		name       string
+		secret     string
+		wantVolume bool
+		wantErr    bool
+	}{
+		{name: "not set"},
+		{name: "secret", secret: "ec2-identity-signer", wantVolume: true},
+		{name: "invalid name", secret: "EC2_Signer", wantErr: true},
+		{name: "secret with key", secret: "ec2-identity-signer/tls.key", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volume, err := ec2IdentityVolume(map[string]string{AnnotationEC2IdentitySecret: tt.secret})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ec2IdentityVolume() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantVolume {
+				if volume != nil {
+					t.Errorf("ec2IdentityVolume() = %v, want nil", volume)
+				}
+				return
+			}
+			if volume.Secret == nil || volume.Secret.SecretName != tt.secret || len(volume.Secret.Items) != 2 {
+				t.Errorf("ec2IdentityVolume() = %+v, want Secret %s", volume.VolumeSource, tt.secret)
+			}
+		})
+	}
+}
+
+func TestMutateEC2Identity(t *testing.T) {
+	mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test-ns",
+			Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+			Annotations: map[string]string{AnnotationEnabled: "true", AnnotationEC2IdentitySecret: "ec2-identity-signer"},
+		},
+	}
+
+	patches, err := mutator.Mutate(pod)
+	if err != nil {
+		t.Fatalf("Mutate() error = %v", err)
+	}
+
+	container := patches[1].Value.(corev1.Container)
+	var mounted bool
+	for _, m := range container.VolumeMounts {
+		mounted = mounted || (m.Name == EC2IdentityVolumeName && m.MountPath == EC2IdentityMountPath)
+	}
+	if !mounted {
+		t.Errorf("no %s mount in %v", EC2IdentityVolumeName, container.VolumeMounts)
+	}
+	env := map[string]string{}
+	for _, e := range container.Env {
+		env[e.Name] = e.Value
+	}
+	if env["IMDS_EC2_IDENTITY_CERT"] != EC2IdentityMountPath+"/tls.crt" || env["IMDS_EC2_IDENTITY_KEY"] != EC2IdentityMountPath+"/tls.key" {
+		t.Errorf("env = %v", env)
+	}
+}
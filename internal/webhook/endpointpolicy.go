@@ -0,0 +1,66 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// EndpointPolicyVolumeName is the volume holding the VM's endpoint policy
+	EndpointPolicyVolumeName = "imds-endpoint-policy"
+	// EndpointPolicyMountPath is where the endpoint policy is mounted
+	EndpointPolicyMountPath = "/var/run/imds/endpoint-policy"
+	// DefaultEndpointPolicyKey is the ConfigMap key read when the reference
+	// names none
+	DefaultEndpointPolicyKey = "policy.json"
+)
+
+// endpointPolicyVolume returns the volume for the ConfigMap referenced by
+// AnnotationEndpointPolicyConfigMap as "<name>" or "<name>/<key>", or nil
+// if the annotation isn't set.
+func endpointPolicyVolume(annotations map[string]string) (*corev1.Volume, error) {
+	ref := annotations[AnnotationEndpointPolicyConfigMap]
+	if ref == "" {
+		return nil, nil
+	}
+
+	name, key, found := strings.Cut(ref, "/")
+	if !found {
+		key = DefaultEndpointPolicyKey
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s %q: %s", AnnotationEndpointPolicyConfigMap, ref, strings.Join(errs, "; "))
+	}
+	if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s %q: %s", AnnotationEndpointPolicyConfigMap, ref, strings.Join(errs, "; "))
+	}
+
+	// Not optional: the policy only restricts, so the sidecar must not start
+	// without it
+	return &corev1.Volume{
+		Name: EndpointPolicyVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: name},
+				Items:                []corev1.KeyToPath{{Key: key, Path: DefaultEndpointPolicyKey}},
+			},
+		},
+	}, nil
+}
+
+// configureEndpointPolicy mounts the endpoint policy and has the sidecar
+// apply it.
+func configureEndpointPolicy(container *corev1.Container) {
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      EndpointPolicyVolumeName,
+		MountPath: EndpointPolicyMountPath,
+		ReadOnly:  true,
+	})
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "IMDS_ENDPOINT_POLICY",
+		Value: EndpointPolicyMountPath + "/" + DefaultEndpointPolicyKey,
+	})
+}
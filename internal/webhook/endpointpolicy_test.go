@@ -0,0 +1,77 @@
+package webhook
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEndpointPolicyVolume(t *testing.T) {
+	tests := []struct {
+		name          string
+		ref           string
+		wantConfigMap string
+		wantKey       string
+		wantErr       bool
+	}{
+		{name: "not set"},
+		{name: "default key", ref: "imds-policy", wantConfigMap: "imds-policy", wantKey: "policy.json"},
+		{name: "explicit key", ref: "imds-policy/kiosk.json", wantConfigMap: "imds-policy", wantKey: "kiosk.json"},
+		{name: "invalid name", ref: "IMDS_Policy", wantErr: true},
+		{name: "invalid key", ref: "imds-policy/a:b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volume, err := endpointPolicyVolume(map[string]string{AnnotationEndpointPolicyConfigMap: tt.ref})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("endpointPolicyVolume() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantConfigMap == "" {
+				if volume != nil {
+					t.Errorf("endpointPolicyVolume() = %v, want nil", volume)
+				}
+				return
+			}
+			if volume.ConfigMap == nil || volume.ConfigMap.Name != tt.wantConfigMap || volume.ConfigMap.Items[0].Key != tt.wantKey {
+				t.Errorf("endpointPolicyVolume() = %+v, want ConfigMap %s key %s", volume.VolumeSource, tt.wantConfigMap, tt.wantKey)
+			}
+			if volume.ConfigMap.Optional != nil && *volume.ConfigMap.Optional {
+				t.Error("endpoint policy volume is optional")
+			}
+		})
+	}
+}
+
+func TestMutateEndpointPolicy(t *testing.T) {
+	mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test-ns",
+			Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+			Annotations: map[string]string{AnnotationEnabled: "true", AnnotationEndpointPolicyConfigMap: "imds-policy"},
+		},
+	}
+
+	patches, err := mutator.Mutate(pod)
+	if err != nil {
+		t.Fatalf("Mutate() error = %v", err)
+	}
+
+	container := patches[1].Value.(corev1.Container)
+	var mounted bool
+	for _, m := range container.VolumeMounts {
+		mounted = mounted || (m.Name == EndpointPolicyVolumeName && m.MountPath == EndpointPolicyMountPath)
+	}
+	if !mounted {
+		t.Errorf("no %s mount in %v", EndpointPolicyVolumeName, container.VolumeMounts)
+	}
+	env := map[string]string{}
+	for _, e := range container.Env {
+		env[e.Name] = e.Value
+	}
+	if env["IMDS_ENDPOINT_POLICY"] != EndpointPolicyMountPath+"/policy.json" {
+		t.Errorf("env = %v", env)
+	}
+}
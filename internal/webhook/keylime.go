@@ -0,0 +1,88 @@
+package webhook
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// KeylimeVolumeName is the volume holding the Keylime verifier's CA and
+	// the sidecar's client certificate
+	KeylimeVolumeName = "imds-keylime"
+	// KeylimeMountPath is where the Keylime TLS Secret is mounted
+	KeylimeMountPath = "/var/run/imds/keylime"
+)
+
+// keylimeAgentID matches the agent IDs the webhook passes on: UUIDs, EK
+// hashes and other plain names
+var keylimeAgentID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,254}$`)
+
+// configureKeylime points the sidecar at the Keylime verifier named in
+// AnnotationKeylimeVerifierURL to gate credentials on the state of the agent
+// AnnotationKeylimeAgentID. It returns the volume for the TLS Secret in
+// AnnotationKeylimeTLSSecret, or nil if none is set.
+func configureKeylime(container *corev1.Container, annotations map[string]string) (*corev1.Volume, error) {
+	verifierURL := annotations[AnnotationKeylimeVerifierURL]
+	agentID := annotations[AnnotationKeylimeAgentID]
+	secret := annotations[AnnotationKeylimeTLSSecret]
+	if verifierURL == "" {
+		for _, annotation := range []string{AnnotationKeylimeAgentID, AnnotationKeylimeTLSSecret} {
+			if annotations[annotation] != "" {
+				return nil, fmt.Errorf("%s is set without %s", annotation, AnnotationKeylimeVerifierURL)
+			}
+		}
+		return nil, nil
+	}
+	if annotations[AnnotationAttestationPolicySecret] != "" {
+		return nil, fmt.Errorf("%s and %s are mutually exclusive", AnnotationKeylimeVerifierURL, AnnotationAttestationPolicySecret)
+	}
+	if u, err := url.Parse(verifierURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid %s %q: must be an https URL", AnnotationKeylimeVerifierURL, verifierURL)
+	}
+	if !keylimeAgentID.MatchString(agentID) {
+		return nil, fmt.Errorf("invalid %s %q: must be the agent's UUID", AnnotationKeylimeAgentID, agentID)
+	}
+
+	container.Env = append(container.Env,
+		corev1.EnvVar{Name: "IMDS_KEYLIME_VERIFIER_URL", Value: verifierURL},
+		corev1.EnvVar{Name: "IMDS_KEYLIME_AGENT_ID", Value: agentID},
+	)
+	if secret == "" {
+		return nil, nil
+	}
+	if errs := validation.IsDNS1123Subdomain(secret); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s %q: %s", AnnotationKeylimeTLSSecret, secret, strings.Join(errs, "; "))
+	}
+
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      KeylimeVolumeName,
+		MountPath: KeylimeMountPath,
+		ReadOnly:  true,
+	})
+	container.Env = append(container.Env,
+		corev1.EnvVar{Name: "IMDS_KEYLIME_CA", Value: KeylimeMountPath + "/ca.crt"},
+		corev1.EnvVar{Name: "IMDS_KEYLIME_CLIENT_CERT", Value: KeylimeMountPath + "/tls.crt"},
+		corev1.EnvVar{Name: "IMDS_KEYLIME_CLIENT_KEY", Value: KeylimeMountPath + "/tls.key"},
+	)
+	// Only the sidecar's user may read the client key
+	mode := int32(0400)
+	return &corev1.Volume{
+		Name: KeylimeVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: secret,
+				Items: []corev1.KeyToPath{
+					{Key: "ca.crt", Path: "ca.crt"},
+					{Key: "tls.crt", Path: "tls.crt"},
+					{Key: "tls.key", Path: "tls.key"},
+				},
+				DefaultMode: &mode,
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,107 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestConfigureKeylime(t *testing.T) {
+	const (
+		verifier = "https://keylime-verifier.keylime.svc:8881"
+		agent    = "d432fbb3-d2f1-4a97-9ef7-75bd81c00000"
+	)
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantEnv     map[string]string
+		wantVolume  bool
+		wantErr     string
+	}{
+		{name: "not set"},
+		{
+			name:        "verifier and agent",
+			annotations: map[string]string{AnnotationKeylimeVerifierURL: verifier, AnnotationKeylimeAgentID: agent},
+			wantEnv:     map[string]string{"IMDS_KEYLIME_VERIFIER_URL": verifier, "IMDS_KEYLIME_AGENT_ID": agent},
+		},
+		{
+			name:        "with TLS secret",
+			annotations: map[string]string{AnnotationKeylimeVerifierURL: verifier, AnnotationKeylimeAgentID: agent, AnnotationKeylimeTLSSecret: "keylime-client"},
+			wantEnv: map[string]string{
+				"IMDS_KEYLIME_VERIFIER_URL": verifier,
+				"IMDS_KEYLIME_AGENT_ID":     agent,
+				"IMDS_KEYLIME_CA":           KeylimeMountPath + "/ca.crt",
+				"IMDS_KEYLIME_CLIENT_CERT":  KeylimeMountPath + "/tls.crt",
+				"IMDS_KEYLIME_CLIENT_KEY":   KeylimeMountPath + "/tls.key",
+			},
+			wantVolume: true,
+		},
+		{
+			name:        "agent without verifier",
+			annotations: map[string]string{AnnotationKeylimeAgentID: agent},
+			wantErr:     "without",
+		},
+		{
+			name:        "plain http verifier",
+			annotations: map[string]string{AnnotationKeylimeVerifierURL: "http://keylime-verifier:8881", AnnotationKeylimeAgentID: agent},
+			wantErr:     "https",
+		},
+		{
+			name:        "missing agent",
+			annotations: map[string]string{AnnotationKeylimeVerifierURL: verifier},
+			wantErr:     AnnotationKeylimeAgentID,
+		},
+		{
+			name:        "agent with path",
+			annotations: map[string]string{AnnotationKeylimeVerifierURL: verifier, AnnotationKeylimeAgentID: "../admin"},
+			wantErr:     AnnotationKeylimeAgentID,
+		},
+		{
+			name:        "invalid secret",
+			annotations: map[string]string{AnnotationKeylimeVerifierURL: verifier, AnnotationKeylimeAgentID: agent, AnnotationKeylimeTLSSecret: "Keylime_Client"},
+			wantErr:     AnnotationKeylimeTLSSecret,
+		},
+		{
+			name:        "with attestation policy",
+			annotations: map[string]string{AnnotationKeylimeVerifierURL: verifier, AnnotationKeylimeAgentID: agent, AnnotationAttestationPolicySecret: "vm-tpm-policy"},
+			wantErr:     "mutually exclusive",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var container corev1.Container
+			volume, err := configureKeylime(&container, tt.annotations)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("configureKeylime() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("configureKeylime() error = %v", err)
+			}
+
+			env := map[string]string{}
+			for _, e := range container.Env {
+				env[e.Name] = e.Value
+			}
+			if len(env) != len(tt.wantEnv) {
+				t.Errorf("env = %v, want %v", env, tt.wantEnv)
+			}
+			for name, value := range tt.wantEnv {
+				if env[name] != value {
+					t.Errorf("env %s = %q, want %q", name, env[name], value)
+				}
+			}
+			if (volume != nil) != tt.wantVolume {
+				t.Fatalf("volume = %v, want volume %t", volume, tt.wantVolume)
+			}
+			if volume != nil && (volume.Secret == nil || volume.Secret.SecretName != "keylime-client" || len(container.VolumeMounts) != 1) {
+				t.Errorf("volume = %+v, mounts = %v", volume, container.VolumeMounts)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/kubevirt/kubevirt-imds/internal/imds"
+)
+
+// configureKubernetesProxy has the sidecar proxy the read-only API paths in
+// AnnotationKubernetesProxyPaths at /v1/kubernetes.
+func configureKubernetesProxy(container *corev1.Container, annotations map[string]string) error {
+	value := annotations[AnnotationKubernetesProxyPaths]
+	if value == "" {
+		return nil
+	}
+
+	var paths []string
+	for _, p := range strings.Split(value, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if !imds.ValidKubernetesProxyPath(p) {
+			return fmt.Errorf("invalid %s path %q: must be a clean path below /api/ or /apis/", AnnotationKubernetesProxyPaths, p)
+		}
+		paths = append(paths, p)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("invalid %s %q: no paths", AnnotationKubernetesProxyPaths, value)
+	}
+
+	container.Env = append(container.Env, corev1.EnvVar{Name: "IMDS_KUBERNETES_PROXY_PATHS", Value: strings.Join(paths, ",")})
+	return nil
+}
@@ -0,0 +1,45 @@
+package webhook
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestConfigureKubernetesProxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantEnv string
+		wantErr bool
+	}{
+		{name: "not set"},
+		{name: "one path", value: "/api/v1/namespaces/default/configmaps", wantEnv: "/api/v1/namespaces/default/configmaps"},
+		{
+			name:    "paths with spaces",
+			value:   "/api/v1/namespaces/default/configmaps, /apis/apps/v1/namespaces/default/deployments,",
+			wantEnv: "/api/v1/namespaces/default/configmaps,/apis/apps/v1/namespaces/default/deployments",
+		},
+		{name: "invalid path", value: "/api/v1/namespaces/default/configmaps,/healthz", wantErr: true},
+		{name: "only commas", value: ",,", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container := &corev1.Container{}
+			err := configureKubernetesProxy(container, map[string]string{AnnotationKubernetesProxyPaths: tt.value})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("configureKubernetesProxy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var env string
+			for _, e := range container.Env {
+				if e.Name == "IMDS_KUBERNETES_PROXY_PATHS" {
+					env = e.Value
+				}
+			}
+			if env != tt.wantEnv {
+				t.Errorf("IMDS_KUBERNETES_PROXY_PATHS = %q, want %q", env, tt.wantEnv)
+			}
+		})
+	}
+}
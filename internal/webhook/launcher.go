@@ -0,0 +1,60 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// KubeVirt's virt-launcher pod layout
+const (
+	LauncherLabel          = "kubevirt.io"
+	LauncherLabelValue     = "virt-launcher"
+	LauncherCreatedByLabel = "kubevirt.io/created-by"
+	ComputeContainerName   = "compute"
+)
+
+// launcherVolumes are emptyDir volumes KubeVirt has added to every
+// virt-launcher pod since long before the sidecar existed.
+var launcherVolumes = []string{"private", "public"}
+
+// ValidateLauncherPod checks that a pod looks like a virt-launcher pod
+// rather than a pod that merely carries the kubevirt.io/domain label. The
+// error lists everything that is missing.
+func ValidateLauncherPod(pod *corev1.Pod) error {
+	var problems []string
+
+	if pod.Labels[LauncherLabel] != LauncherLabelValue {
+		problems = append(problems, fmt.Sprintf("label %s=%s", LauncherLabel, LauncherLabelValue))
+	}
+	if pod.Labels[LauncherCreatedByLabel] == "" {
+		problems = append(problems, fmt.Sprintf("label %s", LauncherCreatedByLabel))
+	}
+
+	hasCompute := false
+	for _, c := range pod.Spec.Containers {
+		if c.Name == ComputeContainerName {
+			hasCompute = true
+			break
+		}
+	}
+	if !hasCompute {
+		problems = append(problems, fmt.Sprintf("container %q", ComputeContainerName))
+	}
+
+	volumes := make(map[string]bool, len(pod.Spec.Volumes))
+	for _, v := range pod.Spec.Volumes {
+		volumes[v.Name] = true
+	}
+	for _, name := range launcherVolumes {
+		if !volumes[name] {
+			problems = append(problems, fmt.Sprintf("volume %q", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("not a virt-launcher pod: missing %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
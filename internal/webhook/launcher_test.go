@@ -0,0 +1,73 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestValidateLauncherPod(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(pod *corev1.Pod)
+		wantErr []string
+	}{
+		{
+			name:   "virt-launcher pod",
+			modify: func(pod *corev1.Pod) {},
+		},
+		{
+			name: "only the domain label",
+			modify: func(pod *corev1.Pod) {
+				delete(pod.Labels, LauncherLabel)
+				delete(pod.Labels, LauncherCreatedByLabel)
+			},
+			wantErr: []string{"label kubevirt.io=virt-launcher", "label kubevirt.io/created-by"},
+		},
+		{
+			name: "wrong launcher label value",
+			modify: func(pod *corev1.Pod) {
+				pod.Labels[LauncherLabel] = "virt-handler"
+			},
+			wantErr: []string{"label kubevirt.io=virt-launcher"},
+		},
+		{
+			name: "no compute container",
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.Containers = []corev1.Container{{Name: "app"}}
+			},
+			wantErr: []string{`container "compute"`},
+		},
+		{
+			name: "no KubeVirt volumes",
+			modify: func(pod *corev1.Pod) {
+				pod.Spec.Volumes = nil
+			},
+			wantErr: []string{`volume "private"`, `volume "public"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := launcherPod(nil)
+			tt.modify(pod)
+
+			err := ValidateLauncherPod(pod)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("ValidateLauncherPod() error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("ValidateLauncherPod() expected error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %s", err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Lease timings, the client-go defaults used by most controllers
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// LeaderElection elects one webhook replica, through a Lease, to carry out
+// cluster-wide duties such as rotating the self-signed CA and patching the
+// caBundle. Every replica keeps serving admission requests.
+type LeaderElection struct {
+	// Namespace and LeaseName locate the Lease
+	Namespace string
+	LeaseName string
+	// Identity tells replicas apart, usually the pod name
+	Identity string
+}
+
+// Run takes part in the election until the context is canceled. lead runs
+// while this replica is the leader; its context is canceled when the lease
+// is lost, after which the replica campaigns again. The lease is released on
+// shutdown so another replica takes over without waiting for it to expire.
+// The webhook needs get, create and update on the Lease.
+func (l LeaderElection) Run(ctx context.Context, client kubernetes.Interface, lead func(ctx context.Context)) error {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: l.Namespace, Name: l.LeaseName},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: l.Identity},
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            l.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Printf("Became leader of Lease %s/%s", l.Namespace, l.LeaseName)
+				lead(ctx)
+				log.Printf("Stopped leading Lease %s/%s", l.Namespace, l.LeaseName)
+			},
+			// Called even if this replica never led, which is logged above
+			OnStoppedLeading: func() {},
+			OnNewLeader: func(identity string) {
+				if identity != l.Identity {
+					log.Printf("Lease %s/%s is held by %s", l.Namespace, l.LeaseName, identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up leader election: %w", err)
+	}
+
+	// Run returns when leadership is lost; campaign again until shutdown
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+	return nil
+}
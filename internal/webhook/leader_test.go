@@ -0,0 +1,65 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaderElection(t *testing.T) {
+	tests := []struct {
+		name     string
+		holder   string
+		wantLead bool
+	}{
+		{name: "no lease", wantLead: true},
+		{name: "held by another replica", holder: "imds-webhook-b", wantLead: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			if tt.holder != "" {
+				duration := int32(leaseDuration.Seconds())
+				now := metav1.NewMicroTime(time.Now())
+				client = fake.NewSimpleClientset(&coordinationv1.Lease{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "kubevirt-imds", Name: "imds-webhook"},
+					Spec: coordinationv1.LeaseSpec{
+						HolderIdentity:       &tt.holder,
+						LeaseDurationSeconds: &duration,
+						AcquireTime:          &now,
+						RenewTime:            &now,
+					},
+				})
+			}
+			election := LeaderElection{Namespace: "kubevirt-imds", LeaseName: "imds-webhook", Identity: "imds-webhook-a"}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			led := make(chan struct{})
+			done := make(chan error, 1)
+			go func() {
+				done <- election.Run(ctx, client, func(context.Context) { close(led) })
+			}()
+
+			select {
+			case <-led:
+				if !tt.wantLead {
+					t.Error("became leader of a lease held by another replica")
+				}
+			case <-ctx.Done():
+				if tt.wantLead {
+					t.Error("did not become leader")
+				}
+			}
+			cancel()
+			if err := <-done; err != nil {
+				t.Errorf("Run() error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package webhook
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// stopMarginSeconds is the part of the pod's grace period left for the
+// network cleanup after the server has drained
+const stopMarginSeconds = 10
+
+// configureCleanupOnStop adds a preStop hook that drains the sidecar and
+// removes the IMDS network configuration before the kubelet stops it, so
+// nothing is left in the pod's network namespace during VM shutdown. The
+// drain gets whatever of the pod's grace period the cleanup doesn't need.
+func configureCleanupOnStop(container *corev1.Container, gracePeriodSeconds *int64) {
+	container.Lifecycle = &corev1.Lifecycle{
+		PreStop: &corev1.LifecycleHandler{
+			Exec: &corev1.ExecAction{Command: []string{"/imds-server", "stop"}},
+		},
+	}
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "IMDS_SHUTDOWN_TIMEOUT",
+		Value: fmt.Sprintf("%ds", drainSeconds(gracePeriodSeconds)),
+	})
+}
+
+// drainSeconds is how long the sidecar waits for open requests in a pod with
+// the given grace period, at least one second.
+func drainSeconds(gracePeriodSeconds *int64) int64 {
+	grace := int64(corev1.DefaultTerminationGracePeriodSeconds)
+	if gracePeriodSeconds != nil {
+		grace = *gracePeriodSeconds
+	}
+	if grace-stopMarginSeconds < 1 {
+		return 1
+	}
+	return grace - stopMarginSeconds
+}
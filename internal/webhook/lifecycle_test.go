@@ -0,0 +1,46 @@
+package webhook
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestConfigureCleanupOnStop(t *testing.T) {
+	int64Ptr := func(v int64) *int64 { return &v }
+
+	tests := []struct {
+		name        string
+		gracePeriod *int64
+		wantTimeout string
+	}{
+		{name: "default grace period", wantTimeout: "20s"},
+		{name: "VM grace period", gracePeriod: int64Ptr(180), wantTimeout: "170s"},
+		{name: "grace period shorter than the margin", gracePeriod: int64Ptr(5), wantTimeout: "1s"},
+		{name: "no grace period", gracePeriod: int64Ptr(0), wantTimeout: "1s"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container := corev1.Container{}
+			configureCleanupOnStop(&container, tt.gracePeriod)
+
+			if container.Lifecycle == nil || container.Lifecycle.PreStop == nil || container.Lifecycle.PreStop.Exec == nil {
+				t.Fatalf("expected a preStop exec hook, got %+v", container.Lifecycle)
+			}
+			if got, want := container.Lifecycle.PreStop.Exec.Command, []string{"/imds-server", "stop"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("preStop command = %v, want %v", got, want)
+			}
+			timeout := ""
+			for _, e := range container.Env {
+				if e.Name == "IMDS_SHUTDOWN_TIMEOUT" {
+					timeout = e.Value
+				}
+			}
+			if timeout != tt.wantTimeout {
+				t.Errorf("IMDS_SHUTDOWN_TIMEOUT = %q, want %q", timeout, tt.wantTimeout)
+			}
+		})
+	}
+}
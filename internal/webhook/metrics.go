@@ -0,0 +1,56 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Admission results counted in imds_webhook_admissions_total
+const (
+	resultMutated = "mutated"
+	resultSkipped = "skipped"
+	resultDryRun  = "dry_run"
+	resultError   = "error"
+)
+
+// admissionMetrics counts admission results, served in the Prometheus text
+// format.
+type admissionMetrics struct {
+	mutated atomic.Int64
+	skipped atomic.Int64
+	dryRun  atomic.Int64
+	failed  atomic.Int64
+}
+
+// record counts one admission with the given result.
+func (m *admissionMetrics) record(result string) {
+	switch result {
+	case resultMutated:
+		m.mutated.Add(1)
+	case resultSkipped:
+		m.skipped.Add(1)
+	case resultDryRun:
+		m.dryRun.Add(1)
+	case resultError:
+		m.failed.Add(1)
+	}
+}
+
+// ServeHTTP writes the counters.
+func (m *admissionMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, "# HELP imds_webhook_admissions_total VM pod admissions by result. dry_run counts pods that would have been mutated.")
+	fmt.Fprintln(w, "# TYPE imds_webhook_admissions_total counter")
+	for _, c := range []struct {
+		result string
+		value  *atomic.Int64
+	}{
+		{resultMutated, &m.mutated},
+		{resultSkipped, &m.skipped},
+		{resultDryRun, &m.dryRun},
+		{resultError, &m.failed},
+	} {
+		fmt.Fprintf(w, "imds_webhook_admissions_total{result=%q} %d\n", c.result, c.value.Load())
+	}
+}
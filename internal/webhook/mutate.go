@@ -1,35 +1,305 @@
 package webhook
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/kubevirt/kubevirt-imds/internal/kube"
 )
 
 const (
 	// AnnotationEnabled is the annotation to enable IMDS injection
 	AnnotationEnabled = "imds.kubevirt.io/enabled"
+	// LabelEnabled is the namespace label that enables IMDS for every VM in
+	// the namespace. The pod annotation still overrides it either way.
+	LabelEnabled = "imds.kubevirt.io/enabled"
 	// AnnotationBridgeName is the annotation to override bridge name
 	AnnotationBridgeName = "imds.kubevirt.io/bridge-name"
 	// AnnotationInjected marks that IMDS has been injected
 	AnnotationInjected = "imds.kubevirt.io/injected"
+	// AnnotationConfigHash records a hash of the sidecar the pod was
+	// injected with, see Mutator.ConfigHash
+	AnnotationConfigHash = "imds.kubevirt.io/config-hash"
+	// AnnotationAllowedAudiences is a comma-separated allowlist of audiences the
+	// sidecar may mint tokens for via GET /v1/token?audience=<aud>
+	AnnotationAllowedAudiences = "imds.kubevirt.io/allowed-audiences"
+	// AnnotationMetaPrefix is the prefix of annotations exposed as custom metadata
+	// (e.g. imds.kubevirt.io/meta-environment: prod -> /v1/metadata/environment)
+	AnnotationMetaPrefix = "imds.kubevirt.io/meta-"
+	// AnnotationEnvPrefix is the prefix of annotations passed to the sidecar
+	// as environment variables, e.g. imds.kubevirt.io/env-IMDS_LOG_LEVEL
+	AnnotationEnvPrefix = "imds.kubevirt.io/env-"
+	// AnnotationSPIFFEEnabled is the annotation to relay SPIFFE SVIDs to the VM
+	AnnotationSPIFFEEnabled = "imds.kubevirt.io/spiffe-enabled"
+	// AnnotationDHCPRoutes is the annotation to answer DHCPINFORM with a
+	// classless static route (option 121) to the IMDS address
+	AnnotationDHCPRoutes = "imds.kubevirt.io/dhcp-routes"
+	// AnnotationIPv6Enabled is the annotation to serve IMDS on fd00:ec2::254
+	// and advertise its prefix to the guest via Router Advertisements
+	AnnotationIPv6Enabled = "imds.kubevirt.io/ipv6-enabled"
+	// AnnotationNetworkMode selects how the sidecar attaches to the VM network
+	// ("bridge", "masquerade", "passt" or "macvtap")
+	AnnotationNetworkMode = "imds.kubevirt.io/network-mode"
+	// AnnotationFirewall is the annotation to restrict IMDS to the source
+	// MACs/IPs reported in the VMI status
+	AnnotationFirewall = "imds.kubevirt.io/firewall"
+	// AnnotationSourceAllowlist is the annotation to serve credentials only to
+	// the guest IPs reported in the VMI status
+	AnnotationSourceAllowlist = "imds.kubevirt.io/source-allowlist"
+	// AnnotationTokenBinding is the annotation to serve each token only
+	// to the source that first received it
+	AnnotationTokenBinding = "imds.kubevirt.io/token-binding"
+	// AnnotationPodMetadata is the annotation to serve the pod's labels and
+	// annotations under /v1/pod
+	AnnotationPodMetadata = "imds.kubevirt.io/pod-metadata"
+	// AnnotationNodeInfo is the annotation to serve details of the VM's node
+	// at /v1/node
+	AnnotationNodeInfo = "imds.kubevirt.io/node-info"
+	// AnnotationOIDC is the annotation to serve the ServiceAccount issuer's
+	// OIDC discovery document and JWKS
+	AnnotationOIDC = "imds.kubevirt.io/oidc"
+	// AnnotationEvents is the annotation to record suspicious requests as
+	// Events on the VMI
+	AnnotationEvents = "imds.kubevirt.io/events"
+	// AnnotationNotrack is the annotation to exempt IMDS traffic from
+	// connection tracking
+	AnnotationNotrack = "imds.kubevirt.io/notrack"
+	// AnnotationMaxPPS caps the packets per second a guest may send to IMDS
+	AnnotationMaxPPS = "imds.kubevirt.io/max-pps"
+	// AnnotationMaxBandwidth caps the bytes per second a guest may send to IMDS
+	AnnotationMaxBandwidth = "imds.kubevirt.io/max-bandwidth"
+	// AnnotationRateLimit and AnnotationRateBurst tune the sidecar's HTTP
+	// request rate limit (requests per second, default 100) and its burst
+	// (default 100)
+	AnnotationRateLimit = "imds.kubevirt.io/rate-limit"
+	AnnotationRateBurst = "imds.kubevirt.io/rate-burst"
+	// AnnotationVethPrefix overrides the prefix of the IMDS veth names
+	// (up to 5 lowercase letters or digits)
+	AnnotationVethPrefix = "imds.kubevirt.io/veth-prefix"
+	// AnnotationDNS is the annotation to answer DNS queries for metadata
+	// hostnames (metadata.internal, metadata.google.internal) on the IMDS address
+	AnnotationDNS = "imds.kubevirt.io/dns"
+	// AnnotationDNSName is an additional hostname the DNS responder answers for
+	AnnotationDNSName = "imds.kubevirt.io/dns-name"
+	// AnnotationVLAN puts the IMDS veth on the VM's VLAN (1-4094) of a
+	// bridge with VLAN filtering enabled
+	AnnotationVLAN = "imds.kubevirt.io/vlan"
+	// AnnotationListenAddr moves IMDS to another link-local "host:port", or
+	// ":port" to keep 169.254.169.254, e.g. when something else owns port 80
+	AnnotationListenAddr = "imds.kubevirt.io/listen-addr"
+	// AnnotationCPURequest, AnnotationCPULimit, AnnotationMemoryRequest and
+	// AnnotationMemoryLimit override the sidecar's resources for one VM
+	AnnotationCPURequest    = "imds.kubevirt.io/cpu-request"
+	AnnotationCPULimit      = "imds.kubevirt.io/cpu-limit"
+	AnnotationMemoryRequest = "imds.kubevirt.io/memory-request"
+	AnnotationMemoryLimit   = "imds.kubevirt.io/memory-limit"
+	// AnnotationTokenExpiration overrides the lifetime of the projected
+	// ServiceAccount token, in seconds
+	AnnotationTokenExpiration = "imds.kubevirt.io/token-expiration-seconds"
+	// AnnotationTokenAudience is a comma-separated list of audiences to
+	// project tokens for, served at GET /v1/token?audience=<aud>. Entries
+	// written "name=audience", and audiences that are valid names, are also
+	// served at GET /v1/tokens/<name>
+	AnnotationTokenAudience = "imds.kubevirt.io/token-audience"
+	// AnnotationTokenPath moves the projected ServiceAccount token in the
+	// sidecar to another absolute file path, for images that expect it
+	// elsewhere. The cluster CA and audience tokens move with it.
+	AnnotationTokenPath = "imds.kubevirt.io/token-path"
+	// AnnotationUserDataConfigMap and AnnotationUserDataSecret reference the
+	// user-data served at /v1/user-data, as "<name>" or "<name>/<key>"
+	AnnotationUserDataConfigMap = "imds.kubevirt.io/user-data-configmap"
+	AnnotationUserDataSecret    = "imds.kubevirt.io/user-data-secret"
+	// AnnotationProfile selects a named sidecar profile, such as "debug"
+	AnnotationProfile = "imds.kubevirt.io/profile"
+	// AnnotationProbes overrides Config.Probes for the pod ("exec",
+	// "httpGet" or "none")
+	AnnotationProbes = "imds.kubevirt.io/probes"
+	// AnnotationCertificateSigner names the signer of the certificates the
+	// guest requests at POST /v1/certificates, e.g. "example.com/vm-signer"
+	AnnotationCertificateSigner = "imds.kubevirt.io/certificate-signer"
+	// AnnotationCertificateApproval is "external" (default) to wait for an
+	// approver, or "auto" to have the sidecar approve the requests
+	AnnotationCertificateApproval = "imds.kubevirt.io/certificate-approval"
+	// AnnotationSSHCASecret references the SSH CA private key, as "<name>"
+	// or "<name>/<key>", that signs the keys posted to /v1/ssh/certificate
+	AnnotationSSHCASecret = "imds.kubevirt.io/ssh-ca-secret"
+	// AnnotationTokenExchangeURL is the https token endpoint of an STS that
+	// POST /v1/token/exchange exchanges the VM's token with (RFC 8693)
+	AnnotationTokenExchangeURL = "imds.kubevirt.io/token-exchange-url"
+	// AnnotationTokenExchangeTargets is a comma-separated list of the
+	// audiences and resources the guest may exchange its token for
+	AnnotationTokenExchangeTargets = "imds.kubevirt.io/token-exchange-targets"
+	// AnnotationTokenExchangeSubjectAudience selects a projected audience
+	// token, from AnnotationTokenAudience, as the subject token instead of
+	// the ServiceAccount token
+	AnnotationTokenExchangeSubjectAudience = "imds.kubevirt.io/token-exchange-subject-audience"
+	// AnnotationAttestationPolicySecret references the TPM attestation policy,
+	// as "<name>" or "<name>/<key>", that the guest must attest against at
+	// /v1/attest/verify before it is served tokens
+	AnnotationAttestationPolicySecret = "imds.kubevirt.io/attestation-policy-secret"
+	// AnnotationExposeSecrets lists the Secrets, as comma-separated "<name>"
+	// or "<name>/<key>" entries, the guest may read at /v1/secrets with the
+	// VM's ServiceAccount
+	AnnotationExposeSecrets = "imds.kubevirt.io/expose-secrets"
+	// AnnotationExposeConfigMaps lists the ConfigMaps, as comma-separated
+	// "<name>" or "<name>/<key>" entries, the guest may read at /v1/configs
+	// with the VM's ServiceAccount
+	AnnotationExposeConfigMaps = "imds.kubevirt.io/expose-configmaps"
+	// AnnotationKeylimeVerifierURL is the https URL of a Keylime verifier
+	// that must attest the guest before credentials are served
+	AnnotationKeylimeVerifierURL = "imds.kubevirt.io/keylime-verifier-url"
+	// AnnotationKeylimeAgentID is the UUID of the guest's Keylime agent
+	AnnotationKeylimeAgentID = "imds.kubevirt.io/keylime-agent-id"
+	// AnnotationKeylimeTLSSecret names the Secret with the verifier's CA
+	// (ca.crt) and the sidecar's client certificate (tls.crt, tls.key)
+	AnnotationKeylimeTLSSecret = "imds.kubevirt.io/keylime-tls-secret"
+	// AnnotationEndpointPolicyConfigMap references the VM's endpoint policy,
+	// as "<name>" or "<name>/<key>", which disables endpoint groups or
+	// restricts them to the VM's IPs on top of the cluster IMDSConfig
+	AnnotationEndpointPolicyConfigMap = "imds.kubevirt.io/endpoint-policy-configmap"
+	// AnnotationEC2IdentitySecret names the TLS Secret (tls.crt, tls.key)
+	// whose RSA key signs the EC2 instance identity document served at
+	// /latest/dynamic/instance-identity/document
+	AnnotationEC2IdentitySecret = "imds.kubevirt.io/ec2-identity-secret"
+	// AnnotationKubernetesProxyPaths lists the read-only API server paths
+	// proxied at /v1/kubernetes as the VM's ServiceAccount, comma-separated
+	AnnotationKubernetesProxyPaths = "imds.kubevirt.io/kubernetes-proxy-paths"
+	// AnnotationTLSIssuer has cert-manager issue a certificate for an HTTPS
+	// listener, from the issuer written "<name>", "Issuer/<name>" or
+	// "ClusterIssuer/<name>"
+	AnnotationTLSIssuer = "imds.kubevirt.io/tls-issuer"
+	// AnnotationCleanupOnStop adds a preStop hook that drains the sidecar and
+	// removes the IMDS network configuration before the pod stops
+	AnnotationCleanupOnStop = "imds.kubevirt.io/cleanup-on-stop"
 
 	// Container and volume names
-	ContainerName   = "imds-server"
-	TokenVolumeName = "imds-token"
+	ContainerName          = "imds-server"
+	TokenVolumeName        = "imds-token"
+	SPIFFESocketVolumeName = "imds-spire-agent-socket"
+	UserDataVolumeName     = "imds-user-data"
+	RuntimeVolumeName      = "imds-run"
+
+	// RootCAConfigMap is the per-namespace ConfigMap published by kube-controller-manager
+	RootCAConfigMap = "kube-root-ca.crt"
 
 	// Default values
 	DefaultTokenPath       = "/var/run/secrets/tokens/token"
+	DefaultCAPath          = "/var/run/secrets/tokens/ca.crt"
+	TokenMountPath         = "/var/run/secrets/tokens"
+	RuntimeMountPath       = "/var/run/imds"
 	DefaultTokenExpiration = int64(3600)
+	// MinTokenExpiration is the shortest token lifetime the kubelet accepts;
+	// MaxTokenExpiration keeps a leaked token from being useful for long
+	MinTokenExpiration = int64(600)
+	MaxTokenExpiration = int64(86400)
+	// MaxTokenAudiences caps the projected audience tokens per VM
+	MaxTokenAudiences     = 8
+	SPIFFESocketMountPath = "/run/spire/sockets"
+	UserDataMountPath     = "/var/run/imds/user-data"
+	// DefaultUserDataKey is the key read when the reference names none. It
+	// matches the key KubeVirt's cloudInitNoCloud secretRef expects.
+	DefaultUserDataKey = "userdata"
+	SPIFFESocketName   = "agent.sock"
 )
 
+// DefaultResources returns the sidecar resources used unless the webhook
+// ConfigMap sets others. Setting both requests and limits keeps the sidecar
+// admissible in namespaces with a ResourceQuota.
+func DefaultResources() corev1.ResourceRequirements {
+	return corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("10m"),
+			corev1.ResourceMemory: resource.MustParse("32Mi"),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("100m"),
+			corev1.ResourceMemory: resource.MustParse("128Mi"),
+		},
+	}
+}
+
 // Config holds the webhook configuration
 type Config struct {
 	// IMDSImage is the image to use for the IMDS sidecar
 	IMDSImage string
 	// ImagePullPolicy is the pull policy for the IMDS image
 	ImagePullPolicy corev1.PullPolicy
+	// ImagePullSecrets are added to the pod's imagePullSecrets, for IMDS
+	// images in private registries. They must exist in the VM's namespace.
+	ImagePullSecrets []corev1.LocalObjectReference
+	// SPIFFESocketDir is the host directory containing the SPIRE agent socket.
+	// SVID relaying is only available when this is set.
+	SPIFFESocketDir string
+	// NamespaceLabels returns the labels of a namespace. Namespace opt-in via
+	// LabelEnabled is only available when this is set.
+	NamespaceLabels func(namespace string) (map[string]string, error)
+	// Resources are the compute resources of the sidecar container
+	Resources corev1.ResourceRequirements
+	// TokenExpirationSeconds is the lifetime of the projected ServiceAccount
+	// token. Defaults to DefaultTokenExpiration.
+	TokenExpirationSeconds int64
+	// Env is extra environment passed to every sidecar, ahead of the
+	// variables derived from pod annotations
+	Env []corev1.EnvVar
+	// Proxy is the egress proxy the sidecar uses for TokenRequest, STS and
+	// Vault calls
+	Proxy ProxyConfig
+	// SecurityContext replaces DefaultSecurityContext for clusters with
+	// different policies
+	SecurityContext *corev1.SecurityContext
+	// Profiles are selectable with AnnotationProfile, on top of and
+	// replacing DefaultProfiles
+	Profiles map[string]Profile
+	// ClusterConfig returns the cluster IMDSConfig, or nil if there is none.
+	// Its policy takes precedence over DefaultEnabled.
+	ClusterConfig func() *kube.IMDSConfigSpec
+	// DefaultEnabled injects IMDS into every VM pod that isn't opted out with
+	// AnnotationEnabled or LabelEnabled set to "false".
+	DefaultEnabled bool
+	// NativeSidecar injects the sidecar as an init container with
+	// restartPolicy Always, so it starts before compute and stops after it.
+	// Requires Kubernetes 1.29, or 1.28 with the SidecarContainers gate.
+	NativeSidecar bool
+	// ExcludedNamespaces are never mutated, whatever the pod annotation,
+	// namespace label or IMDSConfig says. Entries may be patterns such as
+	// "openshift-*".
+	ExcludedNamespaces []string
+	// ExcludedNamespaceSelector excludes namespaces by label. It is only
+	// enforced when NamespaceLabels is set.
+	ExcludedNamespaceSelector labels.Selector
+	// Probes is the kind of startup, liveness and readiness probes put on
+	// the sidecar: ProbesExec, ProbesHTTPGet, or none if empty
+	Probes string
+	// VMNameLabels are the pod labels holding the VM name, tried in order
+	// before the owning VMI. Empty means DomainLabel; forks and older
+	// KubeVirt releases may use others, such as vm.kubevirt.io/name.
+	VMNameLabels []string
+	// VMI returns what the webhook reads from a VirtualMachineInstance.
+	// When set, imds.kubevirt.io annotations on a pod's owning VMI apply
+	// unless the pod overrides them, and the VMI's network binding is passed
+	// to the sidecar.
+	VMI func(namespace, name string) (*VMIInfo, error)
+	// PodSecurity is what happens to pods the sidecar would make violate
+	// their namespace's enforced Pod Security Standard: PodSecurityDeny (the
+	// default when empty), PodSecuritySkip or PodSecurityIgnore. It is only
+	// checked when NamespaceLabels is set.
+	PodSecurity string
+	// DryRun computes patches without applying them. The server logs them
+	// and records them in audit annotations instead.
+	DryRun bool
 }
 
 // Mutator handles pod mutation for IMDS injection
@@ -42,43 +312,263 @@ func NewMutator(config Config) *Mutator {
 	if config.ImagePullPolicy == "" {
 		config.ImagePullPolicy = corev1.PullIfNotPresent
 	}
+	if config.TokenExpirationSeconds == 0 {
+		config.TokenExpirationSeconds = DefaultTokenExpiration
+	}
 	return &Mutator{config: config}
 }
 
+// DryRun reports whether patches are only previewed.
+func (m *Mutator) DryRun() bool {
+	return m.config.DryRun
+}
+
 // ShouldMutate checks if the pod should be mutated
 func (m *Mutator) ShouldMutate(pod *corev1.Pod) bool {
-	// Check if IMDS is enabled via annotation
-	if pod.Annotations == nil {
+	if m.excluded(pod.Namespace) {
 		return false
 	}
 
-	enabled, ok := pod.Annotations[AnnotationEnabled]
-	if !ok || enabled != "true" {
+	cluster := m.clusterConfig()
+	if cluster != nil && cluster.Exempt(pod.Namespace) {
 		return false
 	}
 
-	// Check if already injected
-	if pod.Annotations[AnnotationInjected] == "true" {
+	pod = m.withVMIAnnotations(pod)
+	if !m.enabled(pod, cluster) {
 		return false
 	}
 
-	// Check if this is a virt-launcher pod (has kubevirt.io/domain label)
-	if pod.Labels == nil {
+	// Check if already injected, e.g. when the webhook is reinvoked
+	if Injected(pod) {
 		return false
 	}
-	if _, ok := pod.Labels["kubevirt.io/domain"]; !ok {
+
+	// Check if this is a VM pod: owned by a VMI, or with a VM name label
+	return m.vmName(pod) != ""
+}
+
+// SkipWarnings explains why ShouldMutate skips a pod that asks for IMDS, or
+// looks like it meant to, when the pod's owner can fix the cause. Pods that
+// opt out or never asked get none.
+func (m *Mutator) SkipWarnings(pod *corev1.Pod) []string {
+	pod = m.withVMIAnnotations(pod)
+	value, ok := pod.Annotations[AnnotationEnabled]
+	if ok && value != "true" && value != "false" {
+		return []string{fmt.Sprintf(`%s is %q; only "true" enables IMDS`, AnnotationEnabled, value)}
+	}
+	if value != "true" {
+		return nil
+	}
+
+	if m.excluded(pod.Namespace) {
+		return []string{fmt.Sprintf("namespace %s is excluded from IMDS injection by the webhook configuration", pod.Namespace)}
+	}
+	if cluster := m.clusterConfig(); cluster != nil && cluster.Exempt(pod.Namespace) {
+		return []string{fmt.Sprintf("namespace %s is exempt from IMDS injection in IMDSConfig %s", pod.Namespace, kube.IMDSConfigName)}
+	}
+	// On reinvocation the pod has both the annotation and the container; the
+	// annotation alone was most likely copied from another pod's manifest
+	if pod.Annotations[AnnotationInjected] == "true" && !hasIMDSContainer(pod) {
+		return []string{fmt.Sprintf("%s is set but the pod has no %s container; remove the annotation", AnnotationInjected, ContainerName)}
+	}
+	if m.vmName(pod) == "" {
+		return []string{fmt.Sprintf("pod has no %s label or VirtualMachineInstance owner; IMDS is only injected into KubeVirt VM pods", strings.Join(m.vmNameLabels(), " or "))}
+	}
+	return nil
+}
+
+// excluded reports whether the webhook configuration rules out the namespace.
+// A namespace whose labels can't be checked against the selector is treated
+// as excluded.
+func (m *Mutator) excluded(namespace string) bool {
+	if kube.MatchNamespace(m.config.ExcludedNamespaces, namespace) {
+		return true
+	}
+	selector := m.config.ExcludedNamespaceSelector
+	if selector == nil || selector.Empty() || m.config.NamespaceLabels == nil {
 		return false
 	}
+	nsLabels, err := m.config.NamespaceLabels(namespace)
+	if err != nil {
+		log.Printf("Not mutating: failed to check namespace %s against the exclusion selector: %v", namespace, err)
+		return true
+	}
+	return selector.Matches(labels.Set(nsLabels))
+}
 
-	return true
+// Injected reports whether the pod already has IMDS: the injected annotation,
+// or the IMDS container in case another webhook dropped the annotation.
+func Injected(pod *corev1.Pod) bool {
+	return pod.Annotations[AnnotationInjected] == "true" || hasIMDSContainer(pod)
+}
+
+// hasIMDSContainer reports whether the pod has the IMDS container, as a
+// regular or native sidecar.
+func hasIMDSContainer(pod *corev1.Pod) bool {
+	for _, containers := range [][]corev1.Container{pod.Spec.Containers, pod.Spec.InitContainers} {
+		for _, c := range containers {
+			if c.Name == ContainerName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MutateUpdate returns the patches for a pod update. Containers can't be
+// added to an existing pod, so it only restores the injected annotation on
+// pods that have the IMDS container.
+func (m *Mutator) MutateUpdate(pod *corev1.Pod) []PatchOperation {
+	if !hasIMDSContainer(pod) || pod.Annotations[AnnotationInjected] == "true" {
+		return nil
+	}
+	return []PatchOperation{addAnnotation(pod, AnnotationInjected, "true")}
+}
+
+// clusterConfig returns the cluster IMDSConfig, or nil if there is none.
+func (m *Mutator) clusterConfig() *kube.IMDSConfigSpec {
+	if m.config.ClusterConfig == nil {
+		return nil
+	}
+	return m.config.ClusterConfig()
+}
+
+// enabled reports whether IMDS was requested for the pod. The pod annotation
+// wins, then the namespace label, then the IMDSConfig policy, then the
+// webhook-wide default.
+func (m *Mutator) enabled(pod *corev1.Pod, cluster *kube.IMDSConfigSpec) bool {
+	if enabled, ok := pod.Annotations[AnnotationEnabled]; ok {
+		return enabled == "true"
+	}
+
+	if m.config.NamespaceLabels != nil && pod.Namespace != "" {
+		labels, err := m.config.NamespaceLabels(pod.Namespace)
+		if err != nil {
+			log.Printf("Failed to look up namespace labels: %v", err)
+		} else if enabled, ok := labels[LabelEnabled]; ok {
+			return enabled == "true"
+		}
+	}
+
+	if cluster != nil {
+		if inject := cluster.PolicyFor(pod.Namespace).InjectByDefault; inject != nil {
+			return *inject
+		}
+	}
+
+	return m.config.DefaultEnabled
+}
+
+// gatedAnnotations lists the annotations of each IMDSConfig feature gate
+var gatedAnnotations = map[string][]string{
+	kube.FeatureTokenAudiences:  {AnnotationAllowedAudiences, AnnotationTokenAudience},
+	kube.FeatureSPIFFE:          {AnnotationSPIFFEEnabled},
+	kube.FeatureIPv6:            {AnnotationIPv6Enabled},
+	kube.FeatureDNS:             {AnnotationDNS, AnnotationDNSName},
+	kube.FeatureDHCPRoutes:      {AnnotationDHCPRoutes},
+	kube.FeatureFirewall:        {AnnotationFirewall},
+	kube.FeatureSourceAllowlist: {AnnotationSourceAllowlist},
+	kube.FeatureNotrack:         {AnnotationNotrack},
+	kube.FeatureTokenBinding:    {AnnotationTokenBinding},
+	kube.FeatureCertificates:    {AnnotationCertificateSigner, AnnotationCertificateApproval},
+	kube.FeatureSSHCertificates: {AnnotationSSHCASecret},
+	kube.FeatureTokenExchange:   {AnnotationTokenExchangeURL, AnnotationTokenExchangeTargets, AnnotationTokenExchangeSubjectAudience},
+	kube.FeatureSecrets:         {AnnotationExposeSecrets},
+	kube.FeatureConfigMaps:      {AnnotationExposeConfigMaps},
+	kube.FeaturePodMetadata:     {AnnotationPodMetadata},
+	kube.FeatureNodeInfo:        {AnnotationNodeInfo},
+	kube.FeatureEC2Identity:     {AnnotationEC2IdentitySecret},
+	kube.FeatureEvents:          {AnnotationEvents},
+	kube.FeatureTLS:             {AnnotationTLSIssuer},
+	kube.FeatureOIDC:            {AnnotationOIDC},
+	kube.FeatureKubernetesProxy: {AnnotationKubernetesProxyPaths},
+	kube.FeatureAttestation:     {AnnotationAttestationPolicySecret, AnnotationKeylimeVerifierURL, AnnotationKeylimeAgentID, AnnotationKeylimeTLSSecret},
+	kube.FeatureTokenCommand:    {AnnotationEnvPrefix + "IMDS_TOKEN_COMMAND"},
+}
+
+// withoutDisabledFeatures returns the pod with the annotations of features
+// the IMDSConfig policy turns off removed. The pod itself is not modified.
+func withoutDisabledFeatures(pod *corev1.Pod, policy kube.IMDSPolicy) *corev1.Pod {
+	var annotations map[string]string
+	for gate, keys := range gatedAnnotations {
+		if policy.FeatureEnabled(gate) {
+			continue
+		}
+		for _, key := range keys {
+			if _, ok := pod.Annotations[key]; !ok {
+				continue
+			}
+			if annotations == nil {
+				annotations = make(map[string]string, len(pod.Annotations))
+				for k, v := range pod.Annotations {
+					annotations[k] = v
+				}
+			}
+			log.Printf("Ignoring %s on pod %s/%s: feature gate %s is off", key, pod.Namespace, pod.Name, gate)
+			delete(annotations, key)
+		}
+	}
+	if annotations == nil {
+		return pod
+	}
+	filtered := *pod
+	filtered.Annotations = annotations
+	return &filtered
 }
 
 // Mutate mutates the pod to inject IMDS sidecar
 func (m *Mutator) Mutate(pod *corev1.Pod) ([]PatchOperation, error) {
+	serverContainer, volumes, err := m.sidecar(pod)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkPodSecurity(pod, serverContainer, volumes); err != nil {
+		return nil, err
+	}
+
 	var patches []PatchOperation
+	patches = append(patches, addVolumes(pod, volumes)...)
+	if m.config.NativeSidecar {
+		patches = append(patches, addInitContainer(pod, serverContainer))
+	} else {
+		patches = append(patches, addContainer(pod, serverContainer))
+	}
+	patches = append(patches, addImagePullSecrets(pod, m.config.ImagePullSecrets)...)
+
+	// Mark the pod injected, with the configuration it was injected with
+	patches = append(patches, addAnnotations(pod, map[string]string{
+		AnnotationInjected:   "true",
+		AnnotationConfigHash: configHash(serverContainer, volumes),
+	})...)
+
+	return patches, nil
+}
+
+// ConfigHash returns the configuration hash the webhook would stamp on the
+// pod now. A running pod whose AnnotationConfigHash differs was injected
+// with an older configuration and needs a restart to pick up the current one.
+func (m *Mutator) ConfigHash(pod *corev1.Pod) (string, error) {
+	serverContainer, volumes, err := m.sidecar(pod)
+	if err != nil {
+		return "", err
+	}
+	return configHash(serverContainer, volumes), nil
+}
 
-	// Get VM name from label
-	vmName := pod.Labels["kubevirt.io/domain"]
+// sidecar builds the IMDS container and the volumes it needs for the pod.
+// The pod itself is not modified.
+func (m *Mutator) sidecar(pod *corev1.Pod) (corev1.Container, []corev1.Volume, error) {
+	pod = m.withVMIAnnotations(pod)
+
+	// Features turned off cluster-wide are treated as not requested
+	var policy kube.IMDSPolicy
+	if cluster := m.clusterConfig(); cluster != nil {
+		policy = cluster.PolicyFor(pod.Namespace)
+		pod = withoutDisabledFeatures(pod, policy)
+	}
+
+	vmName := m.vmName(pod)
 
 	// Get bridge name override if specified
 	bridgeName := ""
@@ -86,26 +576,417 @@ func (m *Mutator) Mutate(pod *corev1.Pod) ([]PatchOperation, error) {
 		bridgeName = pod.Annotations[AnnotationBridgeName]
 	}
 
+	// Get network mode, defaulting to the bridge veth
+	networkMode := pod.Annotations[AnnotationNetworkMode]
+	if networkMode != "" && !validNetworkMode(networkMode) {
+		return corev1.Container{}, nil, fmt.Errorf("unsupported %s %q", AnnotationNetworkMode, networkMode)
+	}
+
+	// Bindings without a k6t bridge can't use the veth, so they pick the
+	// mode unless the annotation does. Masquerade keeps the veth, as the
+	// sidecar would on its own.
+	binding := m.vmiBinding(pod)
+	if networkMode == "" && (binding == "passt" || binding == "macvtap") {
+		networkMode = binding
+	}
+
+	vethPrefix := pod.Annotations[AnnotationVethPrefix]
+	if vethPrefix != "" && !validVethPrefix(vethPrefix) {
+		return corev1.Container{}, nil, fmt.Errorf("invalid %s %q: must be 1-5 lowercase letters or digits", AnnotationVethPrefix, vethPrefix)
+	}
+
+	vlan := pod.Annotations[AnnotationVLAN]
+	if vlan != "" {
+		if vid, err := strconv.ParseUint(vlan, 10, 16); err != nil || vid < 1 || vid > 4094 {
+			return corev1.Container{}, nil, fmt.Errorf("invalid %s %q: must be between 1 and 4094", AnnotationVLAN, vlan)
+		}
+	}
+
+	listenAddr := pod.Annotations[AnnotationListenAddr]
+	if listenAddr != "" && !validListenAddr(listenAddr) {
+		return corev1.Container{}, nil, fmt.Errorf("invalid %s %q: must be \"host:port\" or \":port\" with a host in 169.254.0.0/16", AnnotationListenAddr, listenAddr)
+	}
+
+	dnsName := pod.Annotations[AnnotationDNSName]
+	if dnsName != "" {
+		if errs := validation.IsDNS1123Subdomain(strings.TrimSuffix(dnsName, ".")); len(errs) > 0 {
+			return corev1.Container{}, nil, fmt.Errorf("invalid %s %q: %s", AnnotationDNSName, dnsName, strings.Join(errs, "; "))
+		}
+	}
+
+	profile, err := m.profile(pod)
+	if err != nil {
+		return corev1.Container{}, nil, err
+	}
+
+	baseResources := m.config.Resources
+	if profile.Resources != nil {
+		baseResources = *profile.Resources
+	}
+	resources, err := m.containerResources(pod, baseResources)
+	if err != nil {
+		return corev1.Container{}, nil, err
+	}
+
+	expiration := m.config.TokenExpirationSeconds
+	if v := pod.Annotations[AnnotationTokenExpiration]; v != "" {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || !validTokenExpiration(seconds) {
+			return corev1.Container{}, nil, fmt.Errorf("invalid %s %q: must be between %d and %d", AnnotationTokenExpiration, v, MinTokenExpiration, MaxTokenExpiration)
+		}
+		expiration = seconds
+	}
+
+	audiences, err := tokenAudiences(pod.Annotations[AnnotationTokenAudience])
+	if err != nil {
+		return corev1.Container{}, nil, err
+	}
+
+	tokenMountPath, tokenFile := TokenMountPath, path.Base(DefaultTokenPath)
+	if v := pod.Annotations[AnnotationTokenPath]; v != "" {
+		if tokenMountPath, tokenFile, err = tokenPathLayout(v); err != nil {
+			return corev1.Container{}, nil, err
+		}
+	}
+
 	// Add projected ServiceAccount token volume
-	tokenVolume := m.createTokenVolume()
-	patches = append(patches, addVolume(pod, tokenVolume))
+	tokenVolume := m.createTokenVolume(expiration, audiences)
+	tokenVolume.Projected.Sources[0].ServiceAccountToken.Path = tokenFile
+	volumes := []corev1.Volume{tokenVolume}
 
 	// Add IMDS server container (runs init then serve in sequence)
-	// We don't use an init container because the VM bridge (k6t-*) is created
-	// by the compute container, which runs after init containers.
+	// It can't be a regular init container because the VM bridge (k6t-*) is
+	// created by the compute container, which runs after init containers. A
+	// native sidecar works: it only has to start, not finish, before compute.
 	serverContainer := m.createServerContainer(pod.Namespace, vmName, bridgeName)
-	patches = append(patches, addContainer(pod, serverContainer))
+	serverContainer.Resources = resources
+	if profile.Image != "" {
+		serverContainer.Image = profile.Image
+	}
+	serverContainer.Env = append(serverContainer.Env, profile.Env...)
+	// A cluster-pinned image wins over the profile's
+	if policy.Image != "" {
+		serverContainer.Image = policy.Image
+	}
+
+	if networkMode != "" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_NETWORK_MODE", Value: networkMode})
+	}
 
-	// Add injected annotation
-	patches = append(patches, addAnnotation(pod, AnnotationInjected, "true"))
+	if binding != "" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_BINDING_MODE", Value: binding})
+	}
 
-	return patches, nil
+	// With passt the guest reaches IMDS through passt's sockets, so there is
+	// no guest-facing link for ARP, DHCP or packet capture sockets
+	if networkMode == "passt" && m.config.SecurityContext == nil {
+		serverContainer.SecurityContext.Capabilities.Add = []corev1.Capability{"NET_ADMIN", "NET_BIND_SERVICE"}
+	}
+
+	if vethPrefix != "" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_VETH_PREFIX", Value: vethPrefix})
+	}
+
+	if vlan != "" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_VLAN", Value: vlan})
+	}
+
+	if listenAddr != "" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_LISTEN_ADDR", Value: listenAddr})
+	}
+
+	// Keep the mount and the paths the sidecar reads in step
+	serverContainer.VolumeMounts[0].MountPath = tokenMountPath
+	for i, env := range serverContainer.Env {
+		switch env.Name {
+		case "IMDS_TOKEN_PATH":
+			serverContainer.Env[i].Value = path.Join(tokenMountPath, tokenFile)
+		case "IMDS_CA_PATH":
+			serverContainer.Env[i].Value = path.Join(tokenMountPath, path.Base(DefaultCAPath))
+		}
+	}
+
+	// Serve the projected audience tokens
+	if len(audiences) > 0 {
+		paths := make(map[string]string, len(audiences))
+		names := make(map[string]string)
+		for i, audience := range audiences {
+			paths[audience.audience] = path.Join(tokenMountPath, audience.file(i))
+			if audience.name != "" {
+				names[audience.name] = audience.audience
+			}
+		}
+		encoded, err := json.Marshal(paths)
+		if err != nil {
+			return corev1.Container{}, nil, fmt.Errorf("failed to encode token audiences: %w", err)
+		}
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_AUDIENCE_TOKENS", Value: string(encoded)})
+		if len(names) > 0 {
+			encoded, err := json.Marshal(names)
+			if err != nil {
+				return corev1.Container{}, nil, fmt.Errorf("failed to encode token names: %w", err)
+			}
+			serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_TOKEN_NAMES", Value: string(encoded)})
+		}
+	}
+
+	// Allow minting tokens for the listed audiences
+	if audiences := pod.Annotations[AnnotationAllowedAudiences]; audiences != "" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_ALLOWED_AUDIENCES", Value: audiences})
+	}
+
+	// Pass custom metadata annotations through to the server
+	if metadata := customMetadata(pod); len(metadata) > 0 {
+		encoded, err := json.Marshal(metadata)
+		if err != nil {
+			return corev1.Container{}, nil, fmt.Errorf("failed to encode custom metadata: %w", err)
+		}
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_METADATA", Value: string(encoded)})
+	}
+
+	// Advertise the IMDS route over DHCP for guests without a link-local fallback
+	if pod.Annotations[AnnotationDHCPRoutes] == "true" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_DHCP_ROUTES", Value: "true"})
+	}
+
+	// Resolve metadata hostnames for images that discover IMDS by name
+	if pod.Annotations[AnnotationDNS] == "true" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_DNS_ENABLED", Value: "true"})
+		if dnsName != "" {
+			serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_DNS_NAME", Value: dnsName})
+		}
+	}
+
+	// Serve IMDS over IPv6 for dual-stack and IPv6-only guests
+	if pod.Annotations[AnnotationIPv6Enabled] == "true" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_IPV6_ENABLED", Value: "true"})
+	}
+
+	// Restrict IMDS to the VM's own interfaces
+	if pod.Annotations[AnnotationFirewall] == "true" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_FIREWALL", Value: "true"})
+	}
+
+	// Serve credentials only to the VM's own IPs
+	if pod.Annotations[AnnotationSourceAllowlist] == "true" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_SOURCE_ALLOWLIST", Value: "true"})
+	}
+
+	// Bind tokens to the source that first received them
+	if pod.Annotations[AnnotationTokenBinding] == "true" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_TOKEN_BINDING", Value: "true"})
+	}
+
+	// Serve details of the VM's node
+	if pod.Annotations[AnnotationNodeInfo] == "true" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_NODE_INFO", Value: "true"})
+	}
+
+	// Proxy the ServiceAccount issuer's OIDC documents
+	if pod.Annotations[AnnotationOIDC] == "true" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_OIDC", Value: "true"})
+	}
+
+	// Record suspicious requests as Events on the VMI
+	if pod.Annotations[AnnotationEvents] == "true" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_EVENTS", Value: "true"})
+	}
+
+	// Keep metadata polling out of the conntrack table
+	if pod.Annotations[AnnotationNotrack] == "true" {
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_NOTRACK", Value: "true"})
+	}
+
+	// Cap guest traffic to IMDS in the kernel, and tune the HTTP rate limit
+	for _, limit := range []struct {
+		annotation, env string
+		bits            int
+	}{
+		{AnnotationMaxPPS, "IMDS_MAX_PPS", 64},
+		{AnnotationMaxBandwidth, "IMDS_MAX_BANDWIDTH", 64},
+		{AnnotationRateLimit, "IMDS_RATE_LIMIT", 32},
+		{AnnotationRateBurst, "IMDS_RATE_BURST", 32},
+	} {
+		value := pod.Annotations[limit.annotation]
+		if value == "" {
+			continue
+		}
+		if n, err := strconv.ParseUint(value, 10, limit.bits); err != nil || n == 0 {
+			return corev1.Container{}, nil, fmt.Errorf("invalid %s %q: must be a positive integer", limit.annotation, value)
+		}
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: limit.env, Value: value})
+	}
+
+	// Mount the referenced user-data for /v1/user-data
+	userData, err := userDataVolume(pod.Annotations)
+	if err != nil {
+		return corev1.Container{}, nil, err
+	}
+	if userData != nil {
+		volumes = append(volumes, *userData)
+		serverContainer.VolumeMounts = append(serverContainer.VolumeMounts, corev1.VolumeMount{
+			Name:      UserDataVolumeName,
+			MountPath: UserDataMountPath,
+			ReadOnly:  true,
+		})
+		serverContainer.Env = append(serverContainer.Env, corev1.EnvVar{Name: "IMDS_USER_DATA_PATH", Value: UserDataMountPath + "/user-data"})
+	}
+
+	// Mount the pod's labels and annotations for /v1/pod
+	if pod.Annotations[AnnotationPodMetadata] == "true" {
+		volumes = append(volumes, podInfoVolume())
+		configurePodInfo(&serverContainer)
+	}
+
+	// Mount the SPIRE agent socket if SVID relaying is requested
+	if pod.Annotations[AnnotationSPIFFEEnabled] == "true" {
+		if m.config.SPIFFESocketDir == "" {
+			return corev1.Container{}, nil, fmt.Errorf("%s is set but the webhook has no SPIFFE socket directory configured", AnnotationSPIFFEEnabled)
+		}
+		volumes = append(volumes, m.createSPIFFESocketVolume())
+		configureSPIFFE(&serverContainer)
+	}
+
+	// Mount the VM's endpoint policy
+	endpointPolicy, err := endpointPolicyVolume(pod.Annotations)
+	if err != nil {
+		return corev1.Container{}, nil, err
+	}
+	if endpointPolicy != nil {
+		volumes = append(volumes, *endpointPolicy)
+		configureEndpointPolicy(&serverContainer)
+	}
+
+	// Mount the signer of the EC2 instance identity document
+	ec2Identity, err := ec2IdentityVolume(pod.Annotations)
+	if err != nil {
+		return corev1.Container{}, nil, err
+	}
+	if ec2Identity != nil {
+		volumes = append(volumes, *ec2Identity)
+		configureEC2Identity(&serverContainer)
+	}
+
+	// Mount the certificate of the HTTPS listener
+	tlsCert, err := tlsVolume(pod.Annotations)
+	if err != nil {
+		return corev1.Container{}, nil, err
+	}
+	if tlsCert != nil {
+		volumes = append(volumes, *tlsCert)
+		configureTLS(&serverContainer)
+	}
+
+	// Sign the guest's certificate requests through the CSR API
+	if err := configureCertificates(&serverContainer, pod.Annotations); err != nil {
+		return corev1.Container{}, nil, err
+	}
+
+	// Mount the SSH CA for /v1/ssh/certificate
+	sshCA, err := sshCAVolume(pod.Annotations)
+	if err != nil {
+		return corev1.Container{}, nil, err
+	}
+	if sshCA != nil {
+		volumes = append(volumes, *sshCA)
+		configureSSHCA(&serverContainer)
+	}
+
+	// Serve the exposed Secrets and ConfigMaps
+	if err := configureExposedSecrets(&serverContainer, pod.Annotations); err != nil {
+		return corev1.Container{}, nil, err
+	}
+	if err := configureExposedConfigMaps(&serverContainer, pod.Annotations); err != nil {
+		return corev1.Container{}, nil, err
+	}
+
+	// Proxy read-only API paths as the VM's ServiceAccount
+	if err := configureKubernetesProxy(&serverContainer, pod.Annotations); err != nil {
+		return corev1.Container{}, nil, err
+	}
+
+	// Mount the TPM attestation policy for /v1/attest/verify
+	attestation, err := attestationVolume(pod.Annotations)
+	if err != nil {
+		return corev1.Container{}, nil, err
+	}
+	if attestation != nil {
+		volumes = append(volumes, *attestation)
+		configureAttestation(&serverContainer)
+	}
+
+	// Or gate credentials on a Keylime verifier
+	keylime, err := configureKeylime(&serverContainer, pod.Annotations)
+	if err != nil {
+		return corev1.Container{}, nil, err
+	}
+	if keylime != nil {
+		volumes = append(volumes, *keylime)
+	}
+
+	// Exchange the VM's token with an external STS
+	if err := configureTokenExchange(&serverContainer, pod.Annotations, audiences); err != nil {
+		return corev1.Container{}, nil, err
+	}
+
+	// Let the kubelet restart a wedged sidecar
+	probes := m.config.Probes
+	if v := pod.Annotations[AnnotationProbes]; v != "" {
+		if !validProbes(v) {
+			return corev1.Container{}, nil, fmt.Errorf("invalid %s %q: must be %q, %q or %q", AnnotationProbes, v, ProbesExec, ProbesHTTPGet, ProbesNone)
+		}
+		probes = v
+	}
+	configureProbes(&serverContainer, probes)
+
+	// Leave nothing behind in the network namespace during VM shutdown
+	if pod.Annotations[AnnotationCleanupOnStop] == "true" {
+		configureCleanupOnStop(&serverContainer, pod.Spec.TerminationGracePeriodSeconds)
+	}
+
+	// Sidecar settings that have no annotation of their own
+	env, err := passthroughEnv(pod, serverContainer.Env)
+	if err != nil {
+		return corev1.Container{}, nil, err
+	}
+	serverContainer.Env = append(serverContainer.Env, env...)
+
+	// A read-only root filesystem needs somewhere to put the admin socket
+	if sc := serverContainer.SecurityContext; sc != nil && sc.ReadOnlyRootFilesystem != nil && *sc.ReadOnlyRootFilesystem {
+		volumes = append(volumes, corev1.Volume{
+			Name:         RuntimeVolumeName,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}},
+		})
+		serverContainer.VolumeMounts = append(serverContainer.VolumeMounts, corev1.VolumeMount{
+			Name:      RuntimeVolumeName,
+			MountPath: RuntimeMountPath,
+		})
+	}
+
+	if m.config.NativeSidecar {
+		restartPolicy := corev1.ContainerRestartPolicyAlways
+		serverContainer.RestartPolicy = &restartPolicy
+	}
+
+	return serverContainer, volumes, nil
 }
 
-// createTokenVolume creates the projected ServiceAccount token volume
-func (m *Mutator) createTokenVolume() corev1.Volume {
-	expiration := DefaultTokenExpiration
-	return corev1.Volume{
+// configHash returns a short hash of the injected sidecar. Only the sidecar
+// is hashed, so changes elsewhere in the pod don't make it look stale.
+func configHash(container corev1.Container, volumes []corev1.Volume) string {
+	// Marshaling these types can't fail
+	encoded, _ := json.Marshal(struct {
+		Container corev1.Container `json:"container"`
+		Volumes   []corev1.Volume  `json:"volumes"`
+	}{container, volumes})
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:8])
+}
+
+// createTokenVolume creates the projected ServiceAccount token volume, with
+// an extra token for each audience
+func (m *Mutator) createTokenVolume(expiration int64, audiences []tokenAudience) corev1.Volume {
+	volume := corev1.Volume{
 		Name: TokenVolumeName,
 		VolumeSource: corev1.VolumeSource{
 			Projected: &corev1.ProjectedVolumeSource{
@@ -116,10 +997,354 @@ func (m *Mutator) createTokenVolume() corev1.Volume {
 							ExpirationSeconds: &expiration,
 						},
 					},
+					{
+						// Cluster CA, used by /v1/kubeconfig
+						ConfigMap: &corev1.ConfigMapProjection{
+							LocalObjectReference: corev1.LocalObjectReference{Name: RootCAConfigMap},
+							Items: []corev1.KeyToPath{
+								{Key: "ca.crt", Path: "ca.crt"},
+							},
+						},
+					},
 				},
 			},
 		},
 	}
+	for i, audience := range audiences {
+		volume.Projected.Sources = append(volume.Projected.Sources, corev1.VolumeProjection{
+			ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+				Audience:          audience.audience,
+				Path:              audience.file(i),
+				ExpirationSeconds: &expiration,
+			},
+		})
+	}
+	return volume
+}
+
+// tokenPathLayout splits the token-path annotation into the token volume's
+// mount path and the token's file name. The volume also holds the cluster CA
+// and audience tokens, so the file can't take their names, and the mount
+// can't overlap the sidecar's other mounts.
+func tokenPathLayout(value string) (mountPath, file string, err error) {
+	mountPath, file = path.Split(value)
+	mountPath = path.Clean(mountPath)
+	if !path.IsAbs(value) || path.Clean(value) != value || mountPath == "/" {
+		return "", "", fmt.Errorf("invalid %s %q: must be a clean absolute file path below a directory, e.g. /var/run/secrets/tokens/token", AnnotationTokenPath, value)
+	}
+	if file == path.Base(DefaultCAPath) || strings.HasPrefix(file, "audience-") || strings.HasPrefix(file, "token-") || strings.HasPrefix(file, "..") {
+		return "", "", fmt.Errorf("invalid %s %q: file name %q is reserved", AnnotationTokenPath, value, file)
+	}
+	for _, other := range []string{RuntimeMountPath, UserDataMountPath, SPIFFESocketMountPath, SSHCAMountPath, AttestationMountPath, KeylimeMountPath, PodInfoMountPath, EC2IdentityMountPath, EndpointPolicyMountPath, TLSMountPath} {
+		if mountPath == other || strings.HasPrefix(mountPath, other+"/") || strings.HasPrefix(other, mountPath+"/") {
+			return "", "", fmt.Errorf("invalid %s %q: %s overlaps the sidecar's %s mount", AnnotationTokenPath, value, mountPath, other)
+		}
+	}
+	return mountPath, file, nil
+}
+
+// tokenAudience is an audience to project a token for, and the name it is
+// served under at /v1/tokens/<name>, if any.
+type tokenAudience struct {
+	name     string
+	audience string
+}
+
+// file is the file name of the i-th projected audience token: token-<name>,
+// or audience-<i> for unnamed audiences, which are often URLs.
+func (a tokenAudience) file(i int) string {
+	if a.name != "" {
+		return "token-" + a.name
+	}
+	return fmt.Sprintf("audience-%d", i)
+}
+
+// tokenAudiences parses the token-audience annotation. An entry is an
+// audience or "name=audience"; audiences that are DNS labels name
+// themselves.
+func tokenAudiences(value string) ([]tokenAudience, error) {
+	var audiences []tokenAudience
+	seen := make(map[string]bool)
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		var audience tokenAudience
+		if name, aud, ok := strings.Cut(entry, "="); ok {
+			audience.name = strings.TrimSpace(name)
+			audience.audience = strings.TrimSpace(aud)
+			if errs := validation.IsDNS1123Label(audience.name); len(errs) > 0 {
+				return nil, fmt.Errorf("invalid %s token name %q: %s", AnnotationTokenAudience, audience.name, strings.Join(errs, "; "))
+			}
+			if audience.audience == "" {
+				return nil, fmt.Errorf("invalid %s: token %q has no audience", AnnotationTokenAudience, audience.name)
+			}
+		} else {
+			audience.audience = strings.TrimSpace(entry)
+			if len(validation.IsDNS1123Label(audience.audience)) == 0 {
+				audience.name = audience.audience
+			}
+		}
+		if audience.audience == "" || seen[audience.audience] {
+			continue
+		}
+		if audience.name != "" {
+			if names[audience.name] {
+				return nil, fmt.Errorf("invalid %s: token name %q is used twice", AnnotationTokenAudience, audience.name)
+			}
+			names[audience.name] = true
+		}
+		seen[audience.audience] = true
+		audiences = append(audiences, audience)
+	}
+	if len(audiences) > MaxTokenAudiences {
+		return nil, fmt.Errorf("invalid %s: at most %d audiences are supported", AnnotationTokenAudience, MaxTokenAudiences)
+	}
+	return audiences, nil
+}
+
+// containerResources returns the sidecar resources: base with the pod's
+// resource annotations applied on top.
+func (m *Mutator) containerResources(pod *corev1.Pod, base corev1.ResourceRequirements) (corev1.ResourceRequirements, error) {
+	resources := *base.DeepCopy()
+	for _, override := range []struct {
+		annotation string
+		name       corev1.ResourceName
+		limit      bool
+	}{
+		{AnnotationCPURequest, corev1.ResourceCPU, false},
+		{AnnotationCPULimit, corev1.ResourceCPU, true},
+		{AnnotationMemoryRequest, corev1.ResourceMemory, false},
+		{AnnotationMemoryLimit, corev1.ResourceMemory, true},
+	} {
+		value := pod.Annotations[override.annotation]
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil || quantity.Sign() <= 0 {
+			return resources, fmt.Errorf("invalid %s %q: must be a positive quantity", override.annotation, value)
+		}
+		list := &resources.Requests
+		if override.limit {
+			list = &resources.Limits
+		}
+		if *list == nil {
+			*list = corev1.ResourceList{}
+		}
+		(*list)[override.name] = quantity
+	}
+
+	// Report a request above its limit here, with a clearer error than the API server's
+	for name, request := range resources.Requests {
+		if limit, ok := resources.Limits[name]; ok && request.Cmp(limit) > 0 {
+			return resources, fmt.Errorf("sidecar %s request %s exceeds its limit %s", name, request.String(), limit.String())
+		}
+	}
+	return resources, nil
+}
+
+// userDataVolume returns the volume projecting the user-data referenced by
+// the pod's annotations, or nil if there is none. The volume is optional so a
+// missing object doesn't keep the VM from starting; /v1/user-data returns 404
+// until it exists.
+func userDataVolume(annotations map[string]string) (*corev1.Volume, error) {
+	configMap := annotations[AnnotationUserDataConfigMap]
+	secret := annotations[AnnotationUserDataSecret]
+	if configMap != "" && secret != "" {
+		return nil, fmt.Errorf("only one of %s and %s may be set", AnnotationUserDataConfigMap, AnnotationUserDataSecret)
+	}
+
+	annotation, ref := AnnotationUserDataConfigMap, configMap
+	if secret != "" {
+		annotation, ref = AnnotationUserDataSecret, secret
+	}
+	if ref == "" {
+		return nil, nil
+	}
+
+	name, key, found := strings.Cut(ref, "/")
+	if !found {
+		key = DefaultUserDataKey
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s %q: %s", annotation, ref, strings.Join(errs, "; "))
+	}
+	if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s %q: %s", annotation, ref, strings.Join(errs, "; "))
+	}
+
+	optional := true
+	items := []corev1.KeyToPath{{Key: key, Path: "user-data"}}
+	volume := corev1.Volume{Name: UserDataVolumeName}
+	if secret != "" {
+		volume.Secret = &corev1.SecretVolumeSource{SecretName: name, Items: items, Optional: &optional}
+	} else {
+		volume.ConfigMap = &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name},
+			Items:                items,
+			Optional:             &optional,
+		}
+	}
+	return &volume, nil
+}
+
+// validTokenExpiration reports whether a projected token lifetime is within bounds
+func validTokenExpiration(seconds int64) bool {
+	return seconds >= MinTokenExpiration && seconds <= MaxTokenExpiration
+}
+
+// validNetworkMode reports whether the sidecar supports the network mode
+func validNetworkMode(mode string) bool {
+	switch mode {
+	case "bridge", "masquerade", "passt", "macvtap":
+		return true
+	default:
+		return false
+	}
+}
+
+// validVethPrefix reports whether the prefix keeps the veth names valid
+// interface names (the sidecar appends "-<hash>-br")
+func validVethPrefix(prefix string) bool {
+	if len(prefix) == 0 || len(prefix) > 5 {
+		return false
+	}
+	for _, c := range prefix {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// validListenAddr reports whether the sidecar accepts addr as its IMDS
+// endpoint: an IPv4 link-local host, which may be left out, and a port
+func validListenAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return false
+	}
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host).To4()
+	return ip != nil && ip[0] == 169 && ip[1] == 254
+}
+
+// customMetadata collects imds.kubevirt.io/meta-* annotations keyed by suffix
+func customMetadata(pod *corev1.Pod) map[string]string {
+	metadata := make(map[string]string)
+	for key, value := range pod.Annotations {
+		if name, ok := strings.CutPrefix(key, AnnotationMetaPrefix); ok && name != "" {
+			metadata[name] = value
+		}
+	}
+	return metadata
+}
+
+// passthroughAllowedEnv are the sidecar variables that
+// imds.kubevirt.io/env-<NAME> annotations may set. They only tune how the
+// sidecar runs. Everything else picks where credentials come from, widens
+// what the guest can reach or has an annotation the webhook validates, so
+// it is left to the annotations, the sidecar defaults or a profile.
+var passthroughAllowedEnv = map[string]bool{
+	"IMDS_LOG_LEVEL":              true,
+	"IMDS_GARP_INTERVAL":          true,
+	"IMDS_SELFTEST_INTERVAL":      true,
+	"IMDS_RECONCILE_INTERVAL":     true,
+	"IMDS_TOKEN_REFRESH_INTERVAL": true,
+	"IMDS_SHUTDOWN_TIMEOUT":       true,
+	"IMDS_MTU":                    true,
+	"IMDS_TEARDOWN_ON_EXIT":       true,
+	"IMDS_KEYLIME_API_VERSION":    true,
+}
+
+// passthroughEnv turns imds.kubevirt.io/env-<NAME> annotations into sidecar
+// environment variables, sorted by name. Only variables in
+// passthroughAllowedEnv that the webhook doesn't already set are allowed, so
+// the escape hatch can't override what the webhook, its defaults or a
+// profile decided.
+func passthroughEnv(pod *corev1.Pod, existing []corev1.EnvVar) ([]corev1.EnvVar, error) {
+	set := make(map[string]bool, len(existing))
+	for _, e := range existing {
+		set[e.Name] = true
+	}
+
+	var env []corev1.EnvVar
+	for key, value := range pod.Annotations {
+		name, ok := strings.CutPrefix(key, AnnotationEnvPrefix)
+		if !ok {
+			continue
+		}
+		if !passthroughAllowedEnv[name] {
+			return nil, fmt.Errorf("invalid %s: %s can't be passed through, only sidecar tuning variables can", key, name)
+		}
+		if set[name] {
+			return nil, fmt.Errorf("invalid %s: %s is set by the webhook", key, name)
+		}
+		env = append(env, corev1.EnvVar{Name: name, Value: value})
+	}
+	sort.Slice(env, func(i, j int) bool { return env[i].Name < env[j].Name })
+	return env, nil
+}
+
+// createSPIFFESocketVolume creates the hostPath volume exposing the SPIRE agent socket
+func (m *Mutator) createSPIFFESocketVolume() corev1.Volume {
+	hostPathType := corev1.HostPathDirectory
+	return corev1.Volume{
+		Name: SPIFFESocketVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{
+				Path: m.config.SPIFFESocketDir,
+				Type: &hostPathType,
+			},
+		},
+	}
+}
+
+// configureSPIFFE mounts the SPIRE agent socket into the container and points
+// the IMDS server at it.
+func configureSPIFFE(container *corev1.Container) {
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "IMDS_SPIFFE_SOCKET",
+		Value: SPIFFESocketMountPath + "/" + SPIFFESocketName,
+	})
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      SPIFFESocketVolumeName,
+		MountPath: SPIFFESocketMountPath,
+		ReadOnly:  true,
+	})
+}
+
+// DefaultSecurityContext is the sidecar's security context: root with only
+// the network capabilities it needs, a read-only root filesystem and the
+// runtime's default seccomp profile.
+func DefaultSecurityContext() *corev1.SecurityContext {
+	// Override pod-level security context to allow NET_ADMIN to work.
+	// virt-launcher pods enforce runAsNonRoot: true and runAsUser: 107,
+	// but NET_ADMIN requires root to create veth pairs.
+	runAsNonRoot := false
+	runAsUser := int64(0)
+	readOnlyRootFilesystem := true
+	allowPrivilegeEscalation := false
+
+	return &corev1.SecurityContext{
+		RunAsNonRoot:             &runAsNonRoot,
+		RunAsUser:                &runAsUser,
+		ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+			// NET_RAW is for the ARP and packet capture sockets, and
+			// NET_BIND_SERVICE for listening on ports 80, 443, 67 and 53
+			Add: []corev1.Capability{"NET_ADMIN", "NET_RAW", "NET_BIND_SERVICE"},
+		},
+	}
 }
 
 // createServerContainer creates the IMDS server container
@@ -127,6 +1352,7 @@ func (m *Mutator) createTokenVolume() corev1.Volume {
 func (m *Mutator) createServerContainer(namespace, vmName, bridgeName string) corev1.Container {
 	env := []corev1.EnvVar{
 		{Name: "IMDS_TOKEN_PATH", Value: DefaultTokenPath},
+		{Name: "IMDS_CA_PATH", Value: DefaultCAPath},
 		{Name: "IMDS_NAMESPACE", Value: namespace},
 		{Name: "IMDS_VM_NAME", Value: vmName},
 		{
@@ -138,16 +1364,29 @@ func (m *Mutator) createServerContainer(namespace, vmName, bridgeName string) co
 			},
 		},
 	}
+	// The pod's name, UID and node are only known once it is created and scheduled
+	for _, field := range []struct{ name, path string }{
+		{"IMDS_POD_NAME", "metadata.name"},
+		{"IMDS_POD_UID", "metadata.uid"},
+		{"IMDS_NODE_NAME", "spec.nodeName"},
+	} {
+		env = append(env, corev1.EnvVar{
+			Name:      field.name,
+			ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: field.path}},
+		})
+	}
 
 	if bridgeName != "" {
 		env = append(env, corev1.EnvVar{Name: "IMDS_BRIDGE_NAME", Value: bridgeName})
 	}
 
-	// Override pod-level security context to allow NET_ADMIN to work.
-	// virt-launcher pods enforce runAsNonRoot: true and runAsUser: 107,
-	// but NET_ADMIN requires root to create veth pairs.
-	runAsNonRoot := false
-	runAsUser := int64(0)
+	env = append(env, m.config.Proxy.env()...)
+	env = append(env, m.config.Env...)
+
+	securityContext := DefaultSecurityContext()
+	if m.config.SecurityContext != nil {
+		securityContext = m.config.SecurityContext.DeepCopy()
+	}
 
 	return corev1.Container{
 		Name:            ContainerName,
@@ -155,23 +1394,46 @@ func (m *Mutator) createServerContainer(namespace, vmName, bridgeName string) co
 		ImagePullPolicy: m.config.ImagePullPolicy,
 		Command:         []string{"/imds-server", "run"},
 		Env:             env,
-		SecurityContext: &corev1.SecurityContext{
-			RunAsNonRoot: &runAsNonRoot,
-			RunAsUser:    &runAsUser,
-			Capabilities: &corev1.Capabilities{
-				Add: []corev1.Capability{"NET_ADMIN"},
-			},
-		},
+		Resources:       m.config.Resources,
+		SecurityContext: securityContext,
 		VolumeMounts: []corev1.VolumeMount{
 			{
 				Name:      TokenVolumeName,
-				MountPath: "/var/run/secrets/tokens",
+				MountPath: TokenMountPath,
 				ReadOnly:  true,
 			},
 		},
 	}
 }
 
+// ProxyConfig is the standard proxy environment for the sidecar. Empty
+// fields are not set.
+type ProxyConfig struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+}
+
+// env returns the proxy variables. Both spellings are set, since tools
+// disagree on which one they read.
+func (p ProxyConfig) env() []corev1.EnvVar {
+	var env []corev1.EnvVar
+	for _, v := range []struct{ name, value string }{
+		{"HTTP_PROXY", p.HTTPProxy},
+		{"HTTPS_PROXY", p.HTTPSProxy},
+		{"NO_PROXY", p.NoProxy},
+	} {
+		if v.value == "" {
+			continue
+		}
+		env = append(env,
+			corev1.EnvVar{Name: v.name, Value: v.value},
+			corev1.EnvVar{Name: strings.ToLower(v.name), Value: v.value},
+		)
+	}
+	return env
+}
+
 // PatchOperation represents a JSON patch operation
 type PatchOperation struct {
 	Op    string      `json:"op"`
@@ -179,20 +1441,77 @@ type PatchOperation struct {
 	Value interface{} `json:"value,omitempty"`
 }
 
-// addVolume creates a patch to add a volume
-func addVolume(pod *corev1.Pod, volume corev1.Volume) PatchOperation {
+// addVolumes creates patches to add volumes
+func addVolumes(pod *corev1.Pod, volumes []corev1.Volume) []PatchOperation {
+	// Skip volumes the pod already has, so a reordered webhook chain can't
+	// produce duplicates
+	existing := make(map[string]bool, len(pod.Spec.Volumes))
+	for _, volume := range pod.Spec.Volumes {
+		existing[volume.Name] = true
+	}
+	missing := make([]corev1.Volume, 0, len(volumes))
+	for _, volume := range volumes {
+		if !existing[volume.Name] {
+			missing = append(missing, volume)
+		}
+	}
+	volumes = missing
+	if len(volumes) == 0 {
+		return nil
+	}
+
 	if len(pod.Spec.Volumes) == 0 {
-		return PatchOperation{
+		return []PatchOperation{{
 			Op:    "add",
 			Path:  "/spec/volumes",
-			Value: []corev1.Volume{volume},
+			Value: volumes,
+		}}
+	}
+	patches := make([]PatchOperation, 0, len(volumes))
+	for _, volume := range volumes {
+		patches = append(patches, PatchOperation{
+			Op:    "add",
+			Path:  "/spec/volumes/-",
+			Value: volume,
+		})
+	}
+	return patches
+}
+
+// addImagePullSecrets creates patches adding the pull secrets the pod
+// doesn't reference yet
+func addImagePullSecrets(pod *corev1.Pod, secrets []corev1.LocalObjectReference) []PatchOperation {
+	existing := make(map[string]bool, len(pod.Spec.ImagePullSecrets))
+	for _, secret := range pod.Spec.ImagePullSecrets {
+		existing[secret.Name] = true
+	}
+	var missing []corev1.LocalObjectReference
+	for _, secret := range secrets {
+		if !existing[secret.Name] {
+			existing[secret.Name] = true
+			missing = append(missing, secret)
 		}
 	}
-	return PatchOperation{
-		Op:    "add",
-		Path:  "/spec/volumes/-",
-		Value: volume,
+	if len(missing) == 0 {
+		return nil
 	}
+
+	if len(pod.Spec.ImagePullSecrets) == 0 {
+		return []PatchOperation{{
+			Op:    "add",
+			Path:  "/spec/imagePullSecrets",
+			Value: missing,
+		}}
+	}
+	patches := make([]PatchOperation, 0, len(missing))
+	for _, secret := range missing {
+		patches = append(patches, PatchOperation{
+			Op:    "add",
+			Path:  "/spec/imagePullSecrets/-",
+			Value: secret,
+		})
+	}
+	return patches
 }
 
 // addContainer creates a patch to add a container
@@ -204,6 +1523,23 @@ func addContainer(pod *corev1.Pod, container corev1.Container) PatchOperation {
 	}
 }
 
+// addInitContainer creates a patch to append an init container. It runs after
+// the pod's own init containers, such as KubeVirt's container disk setup.
+func addInitContainer(pod *corev1.Pod, container corev1.Container) PatchOperation {
+	if len(pod.Spec.InitContainers) == 0 {
+		return PatchOperation{
+			Op:    "add",
+			Path:  "/spec/initContainers",
+			Value: []corev1.Container{container},
+		}
+	}
+	return PatchOperation{
+		Op:    "add",
+		Path:  "/spec/initContainers/-",
+		Value: container,
+	}
+}
+
 // addAnnotation creates a patch to add an annotation
 func addAnnotation(pod *corev1.Pod, key, value string) PatchOperation {
 	if pod.Annotations == nil {
@@ -222,6 +1558,27 @@ func addAnnotation(pod *corev1.Pod, key, value string) PatchOperation {
 	}
 }
 
+// addAnnotations creates patches to set the annotations, in key order
+func addAnnotations(pod *corev1.Pod, annotations map[string]string) []PatchOperation {
+	if pod.Annotations == nil {
+		return []PatchOperation{{
+			Op:    "add",
+			Path:  "/metadata/annotations",
+			Value: annotations,
+		}}
+	}
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	patches := make([]PatchOperation, 0, len(keys))
+	for _, key := range keys {
+		patches = append(patches, addAnnotation(pod, key, annotations[key]))
+	}
+	return patches
+}
+
 // escapeJSONPointer escapes special characters for JSON pointer (RFC 6901)
 func escapeJSONPointer(s string) string {
 	s = replaceAll(s, "~", "~0")
@@ -2,10 +2,17 @@ package webhook
 
 import (
 	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/kubevirt/kubevirt-imds/internal/kube"
 )
 
 func TestShouldMutate(t *testing.T) {
@@ -126,6 +133,364 @@ func TestShouldMutate(t *testing.T) {
 	}
 }
 
+func TestShouldMutateNamespaceLabel(t *testing.T) {
+	namespaces := map[string]map[string]string{
+		"enabled":  {LabelEnabled: "true"},
+		"disabled": {LabelEnabled: "false"},
+		"plain":    {},
+	}
+	mutator := NewMutator(Config{
+		IMDSImage: "test-image:latest",
+		NamespaceLabels: func(namespace string) (map[string]string, error) {
+			labels, ok := namespaces[namespace]
+			if !ok {
+				return nil, fmt.Errorf("namespace %q not found", namespace)
+			}
+			return labels, nil
+		},
+	})
+
+	tests := []struct {
+		name        string
+		namespace   string
+		annotations map[string]string
+		want        bool
+	}{
+		{name: "labeled namespace", namespace: "enabled", want: true},
+		{name: "unlabeled namespace", namespace: "plain", want: false},
+		{name: "namespace label false", namespace: "disabled", want: false},
+		{name: "unknown namespace", namespace: "missing", want: false},
+		{name: "no namespace", namespace: "", want: false},
+		{
+			name:        "annotation opts out of labeled namespace",
+			namespace:   "enabled",
+			annotations: map[string]string{AnnotationEnabled: "false"},
+			want:        false,
+		},
+		{
+			name:        "annotation opts in to unlabeled namespace",
+			namespace:   "plain",
+			annotations: map[string]string{AnnotationEnabled: "true"},
+			want:        true,
+		},
+		{
+			name:        "already injected in labeled namespace",
+			namespace:   "enabled",
+			annotations: map[string]string{AnnotationInjected: "true"},
+			want:        false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   tt.namespace,
+					Annotations: tt.annotations,
+					Labels: map[string]string{
+						"kubevirt.io/domain": "test-vm",
+					},
+				},
+			}
+			if got := mutator.ShouldMutate(pod); got != tt.want {
+				t.Errorf("ShouldMutate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldMutateExcludedNamespaces(t *testing.T) {
+	namespaces := map[string]map[string]string{
+		"tenant":   {},
+		"platform": {"tier": "platform", LabelEnabled: "true"},
+	}
+	selector, err := labels.Parse("tier=platform")
+	if err != nil {
+		t.Fatalf("labels.Parse() error = %v", err)
+	}
+	mutator := NewMutator(Config{
+		IMDSImage:      "test-image:latest",
+		DefaultEnabled: true,
+		NamespaceLabels: func(namespace string) (map[string]string, error) {
+			labels, ok := namespaces[namespace]
+			if !ok {
+				return nil, fmt.Errorf("namespace %q not found", namespace)
+			}
+			return labels, nil
+		},
+		ExcludedNamespaces:        []string{"kube-system", "openshift-*"},
+		ExcludedNamespaceSelector: selector,
+	})
+
+	tests := []struct {
+		namespace string
+		want      bool
+	}{
+		{namespace: "tenant", want: true},
+		{namespace: "kube-system", want: false},
+		{namespace: "openshift-monitoring", want: false},
+		{namespace: "platform", want: false},
+		// The selector can't be checked, so the namespace is excluded
+		{namespace: "missing", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: tt.namespace,
+					// The pod annotation doesn't override the exclusion
+					Annotations: map[string]string{AnnotationEnabled: "true"},
+					Labels: map[string]string{
+						"kubevirt.io/domain": "test-vm",
+					},
+				},
+			}
+			if got := mutator.ShouldMutate(pod); got != tt.want {
+				t.Errorf("ShouldMutate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldMutateDefaultEnabled(t *testing.T) {
+	namespaces := map[string]map[string]string{
+		"opted-out": {LabelEnabled: "false"},
+		"plain":     {},
+	}
+	mutator := NewMutator(Config{
+		IMDSImage:      "test-image:latest",
+		DefaultEnabled: true,
+		NamespaceLabels: func(namespace string) (map[string]string, error) {
+			labels, ok := namespaces[namespace]
+			if !ok {
+				return nil, fmt.Errorf("namespace %q not found", namespace)
+			}
+			return labels, nil
+		},
+	})
+
+	tests := []struct {
+		name        string
+		namespace   string
+		annotations map[string]string
+		labels      map[string]string
+		want        bool
+	}{
+		{name: "no opt-out", namespace: "plain", want: true},
+		{name: "unknown namespace", namespace: "missing", want: true},
+		{name: "namespace opted out", namespace: "opted-out", want: false},
+		{
+			name:        "pod opted out",
+			namespace:   "plain",
+			annotations: map[string]string{AnnotationEnabled: "false"},
+			want:        false,
+		},
+		{
+			name:        "pod opted in to opted-out namespace",
+			namespace:   "opted-out",
+			annotations: map[string]string{AnnotationEnabled: "true"},
+			want:        true,
+		},
+		{
+			name:        "already injected",
+			namespace:   "plain",
+			annotations: map[string]string{AnnotationInjected: "true"},
+			want:        false,
+		},
+		{
+			name:      "not a virt-launcher pod",
+			namespace: "plain",
+			labels:    map[string]string{"app": "other"},
+			want:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			labels := tt.labels
+			if labels == nil {
+				labels = map[string]string{"kubevirt.io/domain": "test-vm"}
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   tt.namespace,
+					Annotations: tt.annotations,
+					Labels:      labels,
+				},
+			}
+			if got := mutator.ShouldMutate(pod); got != tt.want {
+				t.Errorf("ShouldMutate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldMutateClusterConfig(t *testing.T) {
+	enabled, disabled := true, false
+	cluster := &kube.IMDSConfigSpec{
+		IMDSPolicy:       kube.IMDSPolicy{InjectByDefault: &enabled},
+		ExemptNamespaces: []string{"infra"},
+		Overrides: []kube.IMDSNamespaceOverride{
+			{Namespace: "dev", IMDSPolicy: kube.IMDSPolicy{InjectByDefault: &disabled}},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		cluster     *kube.IMDSConfigSpec
+		namespace   string
+		annotations map[string]string
+		want        bool
+	}{
+		{name: "no IMDSConfig", namespace: "prod", want: false},
+		{name: "inject by default", cluster: cluster, namespace: "prod", want: true},
+		{name: "namespace override", cluster: cluster, namespace: "dev", want: false},
+		{
+			name:        "annotation beats namespace override",
+			cluster:     cluster,
+			namespace:   "dev",
+			annotations: map[string]string{AnnotationEnabled: "true"},
+			want:        true,
+		},
+		{
+			name:        "annotation opts out",
+			cluster:     cluster,
+			namespace:   "prod",
+			annotations: map[string]string{AnnotationEnabled: "false"},
+			want:        false,
+		},
+		{
+			name:        "exempt namespace ignores annotation",
+			cluster:     cluster,
+			namespace:   "infra",
+			annotations: map[string]string{AnnotationEnabled: "true"},
+			want:        false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{
+				IMDSImage:     "test-image:latest",
+				ClusterConfig: func() *kube.IMDSConfigSpec { return tt.cluster },
+			})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   tt.namespace,
+					Annotations: tt.annotations,
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+				},
+			}
+			if got := mutator.ShouldMutate(pod); got != tt.want {
+				t.Errorf("ShouldMutate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkipWarnings(t *testing.T) {
+	mutator := NewMutator(Config{
+		IMDSImage:          "test-image:latest",
+		ExcludedNamespaces: []string{"kube-system"},
+		ClusterConfig: func() *kube.IMDSConfigSpec {
+			return &kube.IMDSConfigSpec{ExemptNamespaces: []string{"infra"}}
+		},
+	})
+
+	tests := []struct {
+		name        string
+		namespace   string
+		annotations map[string]string
+		labels      map[string]string
+		containers  []string
+		want        string
+	}{
+		{
+			name:        "enabled value typo",
+			annotations: map[string]string{AnnotationEnabled: "yes"},
+			want:        `imds.kubevirt.io/enabled is "yes"`,
+		},
+		{
+			name:        "enabled value capitalized",
+			annotations: map[string]string{AnnotationEnabled: "True"},
+			want:        `imds.kubevirt.io/enabled is "True"`,
+		},
+		{
+			name:        "missing domain label",
+			annotations: map[string]string{AnnotationEnabled: "true"},
+			labels:      map[string]string{},
+			want:        "no kubevirt.io/domain label",
+		},
+		{
+			name:        "copied injected annotation",
+			annotations: map[string]string{AnnotationEnabled: "true", AnnotationInjected: "true"},
+			want:        "imds.kubevirt.io/injected is set",
+		},
+		{
+			name:        "excluded namespace",
+			namespace:   "kube-system",
+			annotations: map[string]string{AnnotationEnabled: "true"},
+			want:        "namespace kube-system is excluded",
+		},
+		{
+			name:        "exempt namespace",
+			namespace:   "infra",
+			annotations: map[string]string{AnnotationEnabled: "true"},
+			want:        "namespace infra is exempt",
+		},
+		{
+			name:        "reinvocation after injection",
+			annotations: map[string]string{AnnotationEnabled: "true", AnnotationInjected: "true"},
+			containers:  []string{ContainerName},
+		},
+		{
+			name:        "opted out",
+			annotations: map[string]string{AnnotationEnabled: "false"},
+		},
+		{
+			name: "not requested",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace := tt.namespace
+			if namespace == "" {
+				namespace = "default"
+			}
+			podLabels := tt.labels
+			if podLabels == nil {
+				podLabels = map[string]string{"kubevirt.io/domain": "test-vm"}
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   namespace,
+					Annotations: tt.annotations,
+					Labels:      podLabels,
+				},
+			}
+			for _, name := range tt.containers {
+				pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name})
+			}
+
+			if mutator.ShouldMutate(pod) {
+				t.Fatal("ShouldMutate() = true, want false")
+			}
+			got := mutator.SkipWarnings(pod)
+			if tt.want == "" {
+				if len(got) > 0 {
+					t.Errorf("SkipWarnings() = %v, want none", got)
+				}
+				return
+			}
+			if len(got) != 1 || !strings.Contains(got[0], tt.want) {
+				t.Errorf("SkipWarnings() = %v, want one containing %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestMutate(t *testing.T) {
 	mutator := NewMutator(Config{
 		IMDSImage:       "test-image:latest",
@@ -162,24 +527,63 @@ func TestMutate(t *testing.T) {
 			},
 			wantErr: false,
 			checkPatch: func(t *testing.T, patches []PatchOperation) {
-				if len(patches) != 3 {
-					t.Errorf("expected 3 patches, got %d", len(patches))
+				if len(patches) != 5 {
+					t.Errorf("expected 5 patches, got %d", len(patches))
 					return
 				}
 
-				// Check volume patch
-				if patches[0].Op != "add" || patches[0].Path != "/spec/volumes/-" {
-					t.Errorf("patch[0] = %+v, want add volume", patches[0])
+				// Check volume patches: token and runtime volumes
+				for _, patch := range patches[:2] {
+					if patch.Op != "add" || patch.Path != "/spec/volumes/-" {
+						t.Errorf("patch = %+v, want add volume", patch)
+					}
 				}
 
 				// Check container patch
-				if patches[1].Op != "add" || patches[1].Path != "/spec/containers/-" {
-					t.Errorf("patch[1] = %+v, want add container", patches[1])
+				if patches[2].Op != "add" || patches[2].Path != "/spec/containers/-" {
+					t.Errorf("patch[2] = %+v, want add container", patches[2])
 				}
 
-				// Check annotation patch
-				if patches[2].Op != "add" {
-					t.Errorf("patch[2] = %+v, want add annotation", patches[2])
+				// Check annotation patches, in key order
+				if patches[3].Op != "add" || patches[3].Path != "/metadata/annotations/imds.kubevirt.io~1config-hash" {
+					t.Errorf("patch[3] = %+v, want add config-hash annotation", patches[3])
+				}
+				if patches[4].Op != "add" || patches[4].Path != "/metadata/annotations/imds.kubevirt.io~1injected" {
+					t.Errorf("patch[4] = %+v, want add injected annotation", patches[4])
+				}
+			},
+		},
+		{
+			name: "existing IMDS volume is not duplicated",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test-ns",
+					Name:      "test-pod",
+					Labels: map[string]string{
+						"kubevirt.io/domain": "test-vm",
+					},
+					Annotations: map[string]string{
+						AnnotationEnabled: "true",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "compute"},
+					},
+					Volumes: []corev1.Volume{
+						{Name: TokenVolumeName},
+					},
+				},
+			},
+			wantErr: false,
+			checkPatch: func(t *testing.T, patches []PatchOperation) {
+				for _, patch := range patches {
+					if volume, ok := patch.Value.(corev1.Volume); ok && volume.Name == TokenVolumeName {
+						t.Errorf("patch %+v duplicates the token volume", patch)
+					}
+				}
+				if patches[0].Path != "/spec/volumes/-" || patches[0].Value.(corev1.Volume).Name != RuntimeVolumeName {
+					t.Errorf("patch[0] = %+v, want only the runtime volume", patches[0])
 				}
 			},
 		},
@@ -279,76 +683,1485 @@ func TestMutate(t *testing.T) {
 	}
 }
 
-func TestEscapeJSONPointer(t *testing.T) {
-	tests := []struct {
-		name  string
-		input string
-		want  string
-	}{
-		{
-			name:  "no special characters",
-			input: "simple-key",
-			want:  "simple-key",
-		},
-		{
-			name:  "with tilde",
-			input: "key~with~tilde",
-			want:  "key~0with~0tilde",
-		},
-		{
-			name:  "with slash",
-			input: "key/with/slash",
-			want:  "key~1with~1slash",
-		},
-		{
-			name:  "with both tilde and slash",
-			input: "key~with/both",
-			want:  "key~0with~1both",
-		},
-		{
-			name:  "annotation with dots and slashes",
-			input: "imds.kubevirt.io/enabled",
-			want:  "imds.kubevirt.io~1enabled",
-		},
-		{
-			name:  "empty string",
-			input: "",
-			want:  "",
-		},
-		{
-			name:  "only tilde",
-			input: "~",
-			want:  "~0",
-		},
-		{
-			name:  "only slash",
-			input: "/",
-			want:  "~1",
-		},
-		{
-			name:  "tilde followed by slash",
-			input: "~/",
-			want:  "~0~1",
-		},
-		{
-			name:  "multiple consecutive tildes",
-			input: "~~~",
-			want:  "~0~0~0",
+func TestCustomMetadata(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				AnnotationEnabled:                    "true",
+				AnnotationMetaPrefix + "environment": "prod",
+				AnnotationMetaPrefix + "team":        "payments",
+				AnnotationMetaPrefix:                 "ignored",
+				"other.io/meta-foo":                  "ignored",
+			},
 		},
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := escapeJSONPointer(tt.input)
-			if got != tt.want {
-				t.Errorf("escapeJSONPointer(%q) = %q, want %q", tt.input, got, tt.want)
+	got := customMetadata(pod)
+	want := map[string]string{"environment": "prod", "team": "payments"}
+	if len(got) != len(want) {
+		t.Fatalf("customMetadata() = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("customMetadata()[%q] = %q, want %q", k, got[k], v)
+		}
+	}
+
+	mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+	pod.Labels = map[string]string{"kubevirt.io/domain": "test-vm"}
+	patches, err := mutator.Mutate(pod)
+	if err != nil {
+		t.Fatalf("Mutate() unexpected error: %v", err)
+	}
+	container := patches[1].Value.(corev1.Container)
+	for _, env := range container.Env {
+		if env.Name == "IMDS_METADATA" {
+			var decoded map[string]string
+			if err := json.Unmarshal([]byte(env.Value), &decoded); err != nil {
+				t.Fatalf("IMDS_METADATA is not valid JSON: %v", err)
 			}
-		})
+			if decoded["environment"] != "prod" {
+				t.Errorf("IMDS_METADATA = %s, want environment=prod", env.Value)
+			}
+			return
+		}
 	}
+	t.Error("expected IMDS_METADATA env var")
 }
 
-func TestCreatePatch(t *testing.T) {
-	tests := []struct {
+func TestMutateAllowedAudiences(t *testing.T) {
+	mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "test-ns",
+			Labels:    map[string]string{"kubevirt.io/domain": "test-vm"},
+			Annotations: map[string]string{
+				AnnotationEnabled:          "true",
+				AnnotationAllowedAudiences: "vault,sts.example.com",
+			},
+		},
+	}
+
+	patches, err := mutator.Mutate(pod)
+	if err != nil {
+		t.Fatalf("Mutate() unexpected error: %v", err)
+	}
+	container := patches[1].Value.(corev1.Container)
+	for _, env := range container.Env {
+		if env.Name == "IMDS_ALLOWED_AUDIENCES" {
+			if env.Value != "vault,sts.example.com" {
+				t.Errorf("IMDS_ALLOWED_AUDIENCES = %q, want %q", env.Value, "vault,sts.example.com")
+			}
+			return
+		}
+	}
+	t.Error("expected IMDS_ALLOWED_AUDIENCES env var")
+}
+
+func TestMutateBooleanAnnotations(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+		value      string
+		env        string
+		wantEnv    bool
+	}{
+		{name: "dhcp routes enabled", annotation: AnnotationDHCPRoutes, value: "true", env: "IMDS_DHCP_ROUTES", wantEnv: true},
+		{name: "dhcp routes not set", env: "IMDS_DHCP_ROUTES", wantEnv: false},
+		{name: "dhcp routes not true", annotation: AnnotationDHCPRoutes, value: "yes", env: "IMDS_DHCP_ROUTES", wantEnv: false},
+		{name: "ipv6 enabled", annotation: AnnotationIPv6Enabled, value: "true", env: "IMDS_IPV6_ENABLED", wantEnv: true},
+		{name: "ipv6 not set", env: "IMDS_IPV6_ENABLED", wantEnv: false},
+		{name: "firewall enabled", annotation: AnnotationFirewall, value: "true", env: "IMDS_FIREWALL", wantEnv: true},
+		{name: "firewall not set", env: "IMDS_FIREWALL", wantEnv: false},
+		{name: "source allowlist enabled", annotation: AnnotationSourceAllowlist, value: "true", env: "IMDS_SOURCE_ALLOWLIST", wantEnv: true},
+		{name: "token binding enabled", annotation: AnnotationTokenBinding, value: "true", env: "IMDS_TOKEN_BINDING", wantEnv: true},
+		{name: "token binding not set", env: "IMDS_TOKEN_BINDING", wantEnv: false},
+		{name: "node info enabled", annotation: AnnotationNodeInfo, value: "true", env: "IMDS_NODE_INFO", wantEnv: true},
+		{name: "node info not set", env: "IMDS_NODE_INFO", wantEnv: false},
+		{name: "oidc enabled", annotation: AnnotationOIDC, value: "true", env: "IMDS_OIDC", wantEnv: true},
+		{name: "oidc not set", env: "IMDS_OIDC", wantEnv: false},
+		{name: "events enabled", annotation: AnnotationEvents, value: "true", env: "IMDS_EVENTS", wantEnv: true},
+		{name: "events not set", env: "IMDS_EVENTS", wantEnv: false},
+		{name: "notrack enabled", annotation: AnnotationNotrack, value: "true", env: "IMDS_NOTRACK", wantEnv: true},
+		{name: "notrack not set", env: "IMDS_NOTRACK", wantEnv: false},
+		{name: "dns enabled", annotation: AnnotationDNS, value: "true", env: "IMDS_DNS_ENABLED", wantEnv: true},
+		{name: "dns not set", env: "IMDS_DNS_ENABLED", wantEnv: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test-ns",
+					Labels:    map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{
+						AnnotationEnabled: "true",
+					},
+				},
+			}
+			if tt.annotation != "" {
+				pod.Annotations[tt.annotation] = tt.value
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+			container := patches[1].Value.(corev1.Container)
+			gotEnv := false
+			for _, env := range container.Env {
+				if env.Name == tt.env && env.Value == "true" {
+					gotEnv = true
+				}
+			}
+			if gotEnv != tt.wantEnv {
+				t.Errorf("%s set = %v, want %v", tt.env, gotEnv, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestMutateFeatureGates(t *testing.T) {
+	cluster := &kube.IMDSConfigSpec{
+		IMDSPolicy: kube.IMDSPolicy{
+			FeatureGates: map[string]bool{kube.FeatureDNS: false, kube.FeatureFirewall: true},
+		},
+		Overrides: []kube.IMDSNamespaceOverride{
+			{Namespace: "locked", IMDSPolicy: kube.IMDSPolicy{FeatureGates: map[string]bool{kube.FeatureFirewall: false}}},
+		},
+	}
+	mutator := NewMutator(Config{
+		IMDSImage:     "test-image:latest",
+		ClusterConfig: func() *kube.IMDSConfigSpec { return cluster },
+	})
+
+	tests := []struct {
+		namespace string
+		wantEnv   map[string]bool
+	}{
+		{
+			namespace: "prod",
+			wantEnv:   map[string]bool{"IMDS_DNS_ENABLED": false, "IMDS_DNS_NAME": false, "IMDS_FIREWALL": true, "IMDS_IPV6_ENABLED": true},
+		},
+		{
+			namespace: "locked",
+			wantEnv:   map[string]bool{"IMDS_DNS_ENABLED": false, "IMDS_FIREWALL": false, "IMDS_IPV6_ENABLED": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			annotations := map[string]string{
+				AnnotationEnabled:     "true",
+				AnnotationDNS:         "true",
+				AnnotationDNSName:     "metadata.example.com",
+				AnnotationFirewall:    "true",
+				AnnotationIPv6Enabled: "true",
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   tt.namespace,
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: annotations,
+				},
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+			container := patches[1].Value.(corev1.Container)
+			gotEnv := make(map[string]bool)
+			for _, env := range container.Env {
+				gotEnv[env.Name] = true
+			}
+			for env, want := range tt.wantEnv {
+				if gotEnv[env] != want {
+					t.Errorf("%s set = %v, want %v", env, gotEnv[env], want)
+				}
+			}
+			if len(pod.Annotations) != 5 || pod.Annotations[AnnotationDNS] != "true" {
+				t.Errorf("Mutate() modified the pod annotations: %v", pod.Annotations)
+			}
+		})
+	}
+}
+
+func TestMutateImagePolicy(t *testing.T) {
+	pinned := "registry.example.com/kubevirt-imds@sha256:" + strings.Repeat("a", 64)
+	cluster := &kube.IMDSConfigSpec{
+		IMDSPolicy: kube.IMDSPolicy{Image: "kubevirt-imds:v2"},
+		Overrides: []kube.IMDSNamespaceOverride{
+			{Namespace: "regulated", IMDSPolicy: kube.IMDSPolicy{Image: pinned}},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		cluster   *kube.IMDSConfigSpec
+		namespace string
+		want      string
+	}{
+		{name: "no IMDSConfig", namespace: "prod", want: "test-image:latest"},
+		{name: "cluster image", cluster: cluster, namespace: "prod", want: "kubevirt-imds:v2"},
+		{name: "namespace image", cluster: cluster, namespace: "regulated", want: pinned},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{
+				IMDSImage:     "test-image:latest",
+				ClusterConfig: func() *kube.IMDSConfigSpec { return tt.cluster },
+			})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   tt.namespace,
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{AnnotationEnabled: "true"},
+				},
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+			if got := patches[1].Value.(corev1.Container).Image; got != tt.want {
+				t.Errorf("image = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMutateNetworkMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		wantEnv string
+		wantErr bool
+	}{
+		{name: "default bridge", mode: "", wantEnv: ""},
+		{name: "explicit bridge", mode: "bridge", wantEnv: "bridge"},
+		{name: "masquerade", mode: "masquerade", wantEnv: "masquerade"},
+		{name: "passt", mode: "passt", wantEnv: "passt"},
+		{name: "macvtap", mode: "macvtap", wantEnv: "macvtap"},
+		{name: "unknown mode rejected", mode: "sriov", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test-ns",
+					Labels:    map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{
+						AnnotationEnabled: "true",
+					},
+				},
+			}
+			if tt.mode != "" {
+				pod.Annotations[AnnotationNetworkMode] = tt.mode
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Mutate() expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+
+			container := patches[1].Value.(corev1.Container)
+			gotEnv := ""
+			for _, env := range container.Env {
+				if env.Name == "IMDS_NETWORK_MODE" {
+					gotEnv = env.Value
+				}
+			}
+			if gotEnv != tt.wantEnv {
+				t.Errorf("IMDS_NETWORK_MODE = %q, want %q", gotEnv, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestMutateVethPrefix(t *testing.T) {
+	tests := []struct {
+		name    string
+		prefix  string
+		wantEnv string
+		wantErr bool
+	}{
+		{name: "default prefix", prefix: "", wantEnv: ""},
+		{name: "custom prefix", prefix: "md2", wantEnv: "md2"},
+		{name: "too long", prefix: "metadata", wantErr: true},
+		{name: "invalid characters", prefix: "md/x", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test-ns",
+					Labels:    map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{
+						AnnotationEnabled: "true",
+					},
+				},
+			}
+			if tt.prefix != "" {
+				pod.Annotations[AnnotationVethPrefix] = tt.prefix
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Mutate() expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+
+			container := patches[1].Value.(corev1.Container)
+			gotEnv := ""
+			for _, env := range container.Env {
+				if env.Name == "IMDS_VETH_PREFIX" {
+					gotEnv = env.Value
+				}
+			}
+			if gotEnv != tt.wantEnv {
+				t.Errorf("IMDS_VETH_PREFIX = %q, want %q", gotEnv, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestMutateVLAN(t *testing.T) {
+	tests := []struct {
+		name    string
+		vlan    string
+		wantEnv string
+		wantErr bool
+	}{
+		{name: "no VLAN", vlan: "", wantEnv: ""},
+		{name: "valid VLAN", vlan: "100", wantEnv: "100"},
+		{name: "zero", vlan: "0", wantErr: true},
+		{name: "out of range", vlan: "4095", wantErr: true},
+		{name: "not a number", vlan: "blue", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test-ns",
+					Labels:    map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{
+						AnnotationEnabled: "true",
+					},
+				},
+			}
+			if tt.vlan != "" {
+				pod.Annotations[AnnotationVLAN] = tt.vlan
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Mutate() expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+
+			container := patches[1].Value.(corev1.Container)
+			gotEnv := ""
+			for _, env := range container.Env {
+				if env.Name == "IMDS_VLAN" {
+					gotEnv = env.Value
+				}
+			}
+			if gotEnv != tt.wantEnv {
+				t.Errorf("IMDS_VLAN = %q, want %q", gotEnv, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestMutateListenAddr(t *testing.T) {
+	tests := []struct {
+		name       string
+		listenAddr string
+		wantErr    bool
+	}{
+		{name: "default", listenAddr: ""},
+		{name: "port only", listenAddr: ":8080"},
+		{name: "link-local address", listenAddr: "169.254.170.2:80"},
+		{name: "not link-local", listenAddr: "10.0.2.1:80", wantErr: true},
+		{name: "IPv6", listenAddr: "[fd00:ec2::254]:80", wantErr: true},
+		{name: "no port", listenAddr: "169.254.169.254", wantErr: true},
+		{name: "port zero", listenAddr: ":0", wantErr: true},
+		{name: "port out of range", listenAddr: ":70000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test-ns",
+					Labels:    map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{
+						AnnotationEnabled: "true",
+					},
+				},
+			}
+			if tt.listenAddr != "" {
+				pod.Annotations[AnnotationListenAddr] = tt.listenAddr
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Mutate() expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+
+			container := patches[1].Value.(corev1.Container)
+			gotEnv := ""
+			for _, env := range container.Env {
+				if env.Name == "IMDS_LISTEN_ADDR" {
+					gotEnv = env.Value
+				}
+			}
+			if gotEnv != tt.listenAddr {
+				t.Errorf("IMDS_LISTEN_ADDR = %q, want %q", gotEnv, tt.listenAddr)
+			}
+		})
+	}
+}
+
+func TestMutateDNSName(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantEnv     string
+		wantErr     bool
+	}{
+		{name: "custom name", annotations: map[string]string{AnnotationDNS: "true", AnnotationDNSName: "metadata.example.com"}, wantEnv: "metadata.example.com"},
+		{name: "fully qualified", annotations: map[string]string{AnnotationDNS: "true", AnnotationDNSName: "metadata.example.com."}, wantEnv: "metadata.example.com."},
+		{name: "dns not enabled", annotations: map[string]string{AnnotationDNSName: "metadata.example.com"}, wantEnv: ""},
+		{name: "invalid name", annotations: map[string]string{AnnotationDNS: "true", AnnotationDNSName: "Metadata_Server"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test-ns",
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{AnnotationEnabled: "true"},
+				},
+			}
+			for k, v := range tt.annotations {
+				pod.Annotations[k] = v
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Mutate() expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+
+			container := patches[1].Value.(corev1.Container)
+			gotEnv := ""
+			for _, env := range container.Env {
+				if env.Name == "IMDS_DNS_NAME" {
+					gotEnv = env.Value
+				}
+			}
+			if gotEnv != tt.wantEnv {
+				t.Errorf("IMDS_DNS_NAME = %q, want %q", gotEnv, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestMutateShapingLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantEnv     map[string]string
+		wantErr     bool
+	}{
+		{
+			name:    "no limits",
+			wantEnv: map[string]string{},
+		},
+		{
+			name:        "both limits",
+			annotations: map[string]string{AnnotationMaxPPS: "200", AnnotationMaxBandwidth: "1048576"},
+			wantEnv:     map[string]string{"IMDS_MAX_PPS": "200", "IMDS_MAX_BANDWIDTH": "1048576"},
+		},
+		{
+			name:        "zero rejected",
+			annotations: map[string]string{AnnotationMaxPPS: "0"},
+			wantErr:     true,
+		},
+		{
+			name:        "unit suffix rejected",
+			annotations: map[string]string{AnnotationMaxBandwidth: "1mbit"},
+			wantErr:     true,
+		},
+		{
+			name:        "request rate limit",
+			annotations: map[string]string{AnnotationRateLimit: "500", AnnotationRateBurst: "1000"},
+			wantEnv:     map[string]string{"IMDS_RATE_LIMIT": "500", "IMDS_RATE_BURST": "1000"},
+		},
+		{
+			name:        "burst only",
+			annotations: map[string]string{AnnotationRateBurst: "10"},
+			wantEnv:     map[string]string{"IMDS_RATE_BURST": "10"},
+		},
+		{
+			name:        "rate limit zero rejected",
+			annotations: map[string]string{AnnotationRateLimit: "0"},
+			wantErr:     true,
+		},
+		{
+			name:        "rate burst too large",
+			annotations: map[string]string{AnnotationRateBurst: "4294967296"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test-ns",
+					Labels:    map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{
+						AnnotationEnabled: "true",
+					},
+				},
+			}
+			for k, v := range tt.annotations {
+				pod.Annotations[k] = v
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Mutate() expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+
+			container := patches[1].Value.(corev1.Container)
+			gotEnv := map[string]string{}
+			for _, env := range container.Env {
+				switch env.Name {
+				case "IMDS_MAX_PPS", "IMDS_MAX_BANDWIDTH", "IMDS_RATE_LIMIT", "IMDS_RATE_BURST":
+					gotEnv[env.Name] = env.Value
+				}
+			}
+			if !reflect.DeepEqual(gotEnv, tt.wantEnv) {
+				t.Errorf("limit env = %v, want %v", gotEnv, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestMutatePassthroughEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      Config
+		annotations map[string]string
+		wantEnv     []corev1.EnvVar
+		wantErr     bool
+	}{
+		{
+			name: "no passthrough",
+		},
+		{
+			name: "sorted by name",
+			annotations: map[string]string{
+				AnnotationEnvPrefix + "IMDS_SELFTEST_INTERVAL": "5s",
+				AnnotationEnvPrefix + "IMDS_GARP_INTERVAL":     "10s",
+			},
+			wantEnv: []corev1.EnvVar{
+				{Name: "IMDS_GARP_INTERVAL", Value: "10s"},
+				{Name: "IMDS_SELFTEST_INTERVAL", Value: "5s"},
+			},
+		},
+		{
+			name:        "empty value",
+			annotations: map[string]string{AnnotationEnvPrefix + "IMDS_LOG_LEVEL": ""},
+			wantEnv:     []corev1.EnvVar{{Name: "IMDS_LOG_LEVEL", Value: ""}},
+		},
+		{
+			name:        "not a tuning variable",
+			annotations: map[string]string{AnnotationEnvPrefix + "IMDS_EXPERIMENT": "true"},
+			wantErr:     true,
+		},
+		{
+			name:        "not an IMDS variable",
+			annotations: map[string]string{AnnotationEnvPrefix + "LD_PRELOAD": "/tmp/evil.so"},
+			wantErr:     true,
+		},
+		{
+			name:        "invalid name",
+			annotations: map[string]string{AnnotationEnvPrefix + "IMDS_A.B": "x"},
+			wantErr:     true,
+		},
+		{
+			name:        "set by the webhook",
+			annotations: map[string]string{AnnotationEnvPrefix + "IMDS_VM_NAME": "other-vm"},
+			wantErr:     true,
+		},
+		{
+			name:        "set by the webhook defaults",
+			config:      Config{Env: []corev1.EnvVar{{Name: "IMDS_LOG_LEVEL", Value: "warn"}}},
+			annotations: map[string]string{AnnotationEnvPrefix + "IMDS_LOG_LEVEL": "debug"},
+			wantErr:     true,
+		},
+		{
+			name:        "token command",
+			annotations: map[string]string{AnnotationEnvPrefix + "IMDS_TOKEN_COMMAND": "/bin/sh -c id"},
+			wantErr:     true,
+		},
+		{
+			name:        "source allowlist switch",
+			annotations: map[string]string{AnnotationEnvPrefix + "IMDS_SOURCE_ALLOWLIST": "false"},
+			wantErr:     true,
+		},
+		{
+			name:        "feature switch",
+			annotations: map[string]string{AnnotationEnvPrefix + "IMDS_OIDC": "true"},
+			wantErr:     true,
+		},
+		{
+			name:        "network mode",
+			annotations: map[string]string{AnnotationEnvPrefix + "IMDS_NETWORK_MODE": "passt"},
+			wantErr:     true,
+		},
+		{
+			name:        "token exchange endpoint",
+			annotations: map[string]string{AnnotationEnvPrefix + "IMDS_TOKEN_EXCHANGE_URL": "https://sts.example.com/token"},
+			wantErr:     true,
+		},
+		{
+			name:        "SSH signer endpoint",
+			annotations: map[string]string{AnnotationEnvPrefix + "IMDS_SSH_VAULT_ADDR": "https://vault.example.com"},
+			wantErr:     true,
+		},
+		{
+			name:        "exposed Secrets",
+			annotations: map[string]string{AnnotationEnvPrefix + "IMDS_EXPOSE_SECRETS": `{"db":null}`},
+			wantErr:     true,
+		},
+		{
+			name:        "Kubernetes API paths",
+			annotations: map[string]string{AnnotationEnvPrefix + "IMDS_KUBERNETES_PROXY_PATHS": "/api/v1/namespaces/test-ns/secrets"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.IMDSImage = "test-image:latest"
+			mutator := NewMutator(tt.config)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test-ns",
+					Labels:    map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{
+						AnnotationEnabled: "true",
+					},
+				},
+			}
+			for k, v := range tt.annotations {
+				pod.Annotations[k] = v
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Mutate() expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+
+			container := patches[1].Value.(corev1.Container)
+			base := mutator.createServerContainer(pod.Namespace, "test-vm", "")
+			gotEnv := container.Env[len(base.Env):]
+			if len(gotEnv) == 0 {
+				gotEnv = nil
+			}
+			if !reflect.DeepEqual(gotEnv, tt.wantEnv) {
+				t.Errorf("passthrough env = %v, want %v", gotEnv, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestMutateResources(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        corev1.ResourceRequirements
+		wantErr     bool
+	}{
+		{
+			name: "defaults",
+			want: DefaultResources(),
+		},
+		{
+			name: "overrides",
+			annotations: map[string]string{
+				AnnotationCPURequest:  "50m",
+				AnnotationMemoryLimit: "256Mi",
+			},
+			want: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("50m"),
+					corev1.ResourceMemory: resource.MustParse("32Mi"),
+				},
+				Limits: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("100m"),
+					corev1.ResourceMemory: resource.MustParse("256Mi"),
+				},
+			},
+		},
+		{
+			name:        "invalid quantity",
+			annotations: map[string]string{AnnotationCPULimit: "lots"},
+			wantErr:     true,
+		},
+		{
+			name:        "zero quantity",
+			annotations: map[string]string{AnnotationMemoryRequest: "0"},
+			wantErr:     true,
+		},
+		{
+			name:        "request above limit",
+			annotations: map[string]string{AnnotationMemoryRequest: "1Gi"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest", Resources: DefaultResources()})
+			annotations := map[string]string{AnnotationEnabled: "true"}
+			for k, v := range tt.annotations {
+				annotations[k] = v
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test-ns",
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: annotations,
+				},
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Mutate() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+			container := patches[1].Value.(corev1.Container)
+			if !reflect.DeepEqual(container.Resources, tt.want) {
+				t.Errorf("container.Resources = %+v, want %+v", container.Resources, tt.want)
+			}
+		})
+	}
+
+	// Overrides never leak into the configured defaults
+	mutator := NewMutator(Config{IMDSImage: "test-image:latest", Resources: DefaultResources()})
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+		Annotations: map[string]string{AnnotationCPULimit: "1"},
+	}}
+	if _, err := mutator.Mutate(pod); err != nil {
+		t.Fatalf("Mutate() unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(mutator.config.Resources, DefaultResources()) {
+		t.Errorf("Mutate() modified the configured resources: %+v", mutator.config.Resources)
+	}
+}
+
+func TestMutateTokenExpiration(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{name: "configured default", value: "", want: 7200},
+		{name: "override", value: "900", want: 900},
+		{name: "minimum", value: "600", want: 600},
+		{name: "maximum", value: "86400", want: 86400},
+		{name: "too short", value: "599", wantErr: true},
+		{name: "too long", value: "86401", wantErr: true},
+		{name: "not a number", value: "1h", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest", TokenExpirationSeconds: 7200})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test-ns",
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{AnnotationEnabled: "true"},
+				},
+			}
+			if tt.value != "" {
+				pod.Annotations[AnnotationTokenExpiration] = tt.value
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Mutate() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+			// The pod has no volumes, so they are added as a list
+			volume := patches[0].Value.([]corev1.Volume)[0]
+			if got := *volume.Projected.Sources[0].ServiceAccountToken.ExpirationSeconds; got != tt.want {
+				t.Errorf("ExpirationSeconds = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMutateTokenAudience(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		want      []string
+		wantFiles []string
+		wantPaths map[string]string
+		wantNames map[string]string
+		wantErr   bool
+	}{
+		{name: "not set"},
+		{
+			name:      "single audience",
+			value:     "vault",
+			want:      []string{"vault"},
+			wantFiles: []string{"token-vault"},
+			wantPaths: map[string]string{
+				"vault": "/var/run/secrets/tokens/token-vault",
+			},
+			wantNames: map[string]string{"vault": "vault"},
+		},
+		{
+			name:      "multiple audiences, duplicates and blanks dropped",
+			value:     "vault, https://oidc.example.com,,vault",
+			want:      []string{"vault", "https://oidc.example.com"},
+			wantFiles: []string{"token-vault", "audience-1"},
+			wantPaths: map[string]string{
+				"vault":                    "/var/run/secrets/tokens/token-vault",
+				"https://oidc.example.com": "/var/run/secrets/tokens/audience-1",
+			},
+			wantNames: map[string]string{"vault": "vault"},
+		},
+		{
+			name:      "named audiences",
+			value:     "oidc=https://oidc.example.com, sts = sts.amazonaws.com",
+			want:      []string{"https://oidc.example.com", "sts.amazonaws.com"},
+			wantFiles: []string{"token-oidc", "token-sts"},
+			wantPaths: map[string]string{
+				"https://oidc.example.com": "/var/run/secrets/tokens/token-oidc",
+				"sts.amazonaws.com":        "/var/run/secrets/tokens/token-sts",
+			},
+			wantNames: map[string]string{
+				"oidc": "https://oidc.example.com",
+				"sts":  "sts.amazonaws.com",
+			},
+		},
+		{name: "too many audiences", value: "a,b,c,d,e,f,g,h,i", wantErr: true},
+		{name: "invalid name", value: "Vault=vault", wantErr: true},
+		{name: "name without audience", value: "vault=", wantErr: true},
+		{name: "name used twice", value: "vault=a,vault=b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test-ns",
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{AnnotationEnabled: "true"},
+				},
+			}
+			if tt.value != "" {
+				pod.Annotations[AnnotationTokenAudience] = tt.value
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Mutate() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+
+			// The first two sources are the default token and the cluster CA
+			volume := patches[0].Value.([]corev1.Volume)[0]
+			var got []string
+			for i, source := range volume.Projected.Sources[2:] {
+				projection := source.ServiceAccountToken
+				if projection == nil {
+					t.Fatalf("source %d is not a token projection", i+2)
+				}
+				if projection.Path != tt.wantFiles[i] {
+					t.Errorf("source %d path = %q, want %q", i+2, projection.Path, tt.wantFiles[i])
+				}
+				got = append(got, projection.Audience)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("projected audiences = %v, want %v", got, tt.want)
+			}
+
+			container := patches[1].Value.(corev1.Container)
+			var gotPaths, gotNames map[string]string
+			for _, env := range container.Env {
+				switch env.Name {
+				case "IMDS_AUDIENCE_TOKENS":
+					if err := json.Unmarshal([]byte(env.Value), &gotPaths); err != nil {
+						t.Fatalf("invalid IMDS_AUDIENCE_TOKENS: %v", err)
+					}
+				case "IMDS_TOKEN_NAMES":
+					if err := json.Unmarshal([]byte(env.Value), &gotNames); err != nil {
+						t.Fatalf("invalid IMDS_TOKEN_NAMES: %v", err)
+					}
+				}
+			}
+			if !reflect.DeepEqual(gotPaths, tt.wantPaths) {
+				t.Errorf("IMDS_AUDIENCE_TOKENS = %v, want %v", gotPaths, tt.wantPaths)
+			}
+			if !reflect.DeepEqual(gotNames, tt.wantNames) {
+				t.Errorf("IMDS_TOKEN_NAMES = %v, want %v", gotNames, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestMutateTokenPath(t *testing.T) {
+	tests := []struct {
+		name          string
+		value         string
+		wantMountPath string
+		wantFile      string
+		wantCAPath    string
+		wantErr       bool
+	}{
+		{
+			name:          "not set",
+			wantMountPath: TokenMountPath,
+			wantFile:      "token",
+			wantCAPath:    DefaultCAPath,
+		},
+		{
+			name:          "service account layout",
+			value:         "/var/run/secrets/kubernetes.io/serviceaccount/token",
+			wantMountPath: "/var/run/secrets/kubernetes.io/serviceaccount",
+			wantFile:      "token",
+			wantCAPath:    "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt",
+		},
+		{
+			name:          "custom file name",
+			value:         "/etc/vault/jwt",
+			wantMountPath: "/etc/vault",
+			wantFile:      "jwt",
+			wantCAPath:    "/etc/vault/ca.crt",
+		},
+		{name: "relative", value: "tokens/token", wantErr: true},
+		{name: "not clean", value: "/var/run/../token", wantErr: true},
+		{name: "directory", value: "/var/run/secrets/", wantErr: true},
+		{name: "root directory", value: "/token", wantErr: true},
+		{name: "reserved CA name", value: "/etc/vault/ca.crt", wantErr: true},
+		{name: "reserved audience name", value: "/etc/vault/audience-0", wantErr: true},
+		{name: "reserved named token name", value: "/etc/vault/token-vault", wantErr: true},
+		{name: "dot-dot file name", value: "/etc/vault/..data", wantErr: true},
+		{name: "runtime mount", value: "/var/run/imds/token", wantErr: true},
+		{name: "below user-data mount", value: "/var/run/imds/user-data/tokens/token", wantErr: true},
+		{name: "above runtime mount", value: "/var/run/token", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "test-ns",
+					Labels:    map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{
+						AnnotationEnabled:       "true",
+						AnnotationTokenAudience: "vault",
+					},
+				},
+			}
+			if tt.value != "" {
+				pod.Annotations[AnnotationTokenPath] = tt.value
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Mutate() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+
+			volume := patches[0].Value.([]corev1.Volume)[0]
+			if got := volume.Projected.Sources[0].ServiceAccountToken.Path; got != tt.wantFile {
+				t.Errorf("token projection path = %q, want %q", got, tt.wantFile)
+			}
+
+			container := patches[1].Value.(corev1.Container)
+			if got := container.VolumeMounts[0]; got.Name != TokenVolumeName || got.MountPath != tt.wantMountPath {
+				t.Errorf("token mount = %s at %s, want %s at %s", got.Name, got.MountPath, TokenVolumeName, tt.wantMountPath)
+			}
+			env := make(map[string]string)
+			for _, e := range container.Env {
+				env[e.Name] = e.Value
+			}
+			if want := tt.wantMountPath + "/" + tt.wantFile; env["IMDS_TOKEN_PATH"] != want {
+				t.Errorf("IMDS_TOKEN_PATH = %q, want %q", env["IMDS_TOKEN_PATH"], want)
+			}
+			if env["IMDS_CA_PATH"] != tt.wantCAPath {
+				t.Errorf("IMDS_CA_PATH = %q, want %q", env["IMDS_CA_PATH"], tt.wantCAPath)
+			}
+			if want := `{"vault":"` + tt.wantMountPath + `/token-vault"}`; env["IMDS_AUDIENCE_TOKENS"] != want {
+				t.Errorf("IMDS_AUDIENCE_TOKENS = %s, want %s", env["IMDS_AUDIENCE_TOKENS"], want)
+			}
+		})
+	}
+}
+
+func TestMutateUserData(t *testing.T) {
+	optional := true
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        *corev1.Volume
+		wantErr     bool
+	}{
+		{name: "not set"},
+		{
+			name:        "configmap with default key",
+			annotations: map[string]string{AnnotationUserDataConfigMap: "vm-user-data"},
+			want: &corev1.Volume{
+				Name: UserDataVolumeName,
+				VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "vm-user-data"},
+					Items:                []corev1.KeyToPath{{Key: "userdata", Path: "user-data"}},
+					Optional:             &optional,
+				}},
+			},
+		},
+		{
+			name:        "secret with key",
+			annotations: map[string]string{AnnotationUserDataSecret: "vm-secrets/cloud-init.yaml"},
+			want: &corev1.Volume{
+				Name: UserDataVolumeName,
+				VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+					SecretName: "vm-secrets",
+					Items:      []corev1.KeyToPath{{Key: "cloud-init.yaml", Path: "user-data"}},
+					Optional:   &optional,
+				}},
+			},
+		},
+		{
+			name: "both set",
+			annotations: map[string]string{
+				AnnotationUserDataConfigMap: "a",
+				AnnotationUserDataSecret:    "b",
+			},
+			wantErr: true,
+		},
+		{
+			name:        "invalid name",
+			annotations: map[string]string{AnnotationUserDataConfigMap: "Not_Valid"},
+			wantErr:     true,
+		},
+		{
+			name:        "invalid key",
+			annotations: map[string]string{AnnotationUserDataSecret: "vm-secrets/a/b"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+			annotations := map[string]string{AnnotationEnabled: "true"}
+			for k, v := range tt.annotations {
+				annotations[k] = v
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test-ns",
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: annotations,
+				},
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Mutate() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+
+			var got *corev1.Volume
+			for _, volume := range patches[0].Value.([]corev1.Volume) {
+				if volume.Name == UserDataVolumeName {
+					got = &volume
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("user-data volume = %+v, want %+v", got, tt.want)
+			}
+
+			container := patches[1].Value.(corev1.Container)
+			gotPath := ""
+			for _, env := range container.Env {
+				if env.Name == "IMDS_USER_DATA_PATH" {
+					gotPath = env.Value
+				}
+			}
+			mounted := false
+			for _, mount := range container.VolumeMounts {
+				if mount.Name == UserDataVolumeName && mount.MountPath == UserDataMountPath {
+					mounted = true
+				}
+			}
+			if want := tt.want != nil; mounted != want || (gotPath != "") != want {
+				t.Errorf("mounted = %v, IMDS_USER_DATA_PATH = %q, want user-data %v", mounted, gotPath, want)
+			}
+			if tt.want != nil && gotPath != UserDataMountPath+"/user-data" {
+				t.Errorf("IMDS_USER_DATA_PATH = %q, want %q", gotPath, UserDataMountPath+"/user-data")
+			}
+		})
+	}
+}
+
+func TestMutateSecurityContext(t *testing.T) {
+	runAsUser := int64(0)
+	custom := &corev1.SecurityContext{
+		RunAsUser:    &runAsUser,
+		Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"NET_ADMIN"}},
+	}
+
+	tests := []struct {
+		name        string
+		config      *corev1.SecurityContext
+		want        *corev1.SecurityContext
+		wantRuntime bool
+	}{
+		{name: "hardened default", want: DefaultSecurityContext(), wantRuntime: true},
+		{name: "override", config: custom, want: custom},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest", SecurityContext: tt.config})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test-ns",
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{AnnotationEnabled: "true"},
+				},
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+			container := patches[1].Value.(corev1.Container)
+			if !reflect.DeepEqual(container.SecurityContext, tt.want) {
+				t.Errorf("SecurityContext = %+v, want %+v", container.SecurityContext, tt.want)
+			}
+			if tt.config != nil && container.SecurityContext == tt.config {
+				t.Error("SecurityContext shares the configured one instead of copying it")
+			}
+
+			hasVolume := false
+			for _, volume := range patches[0].Value.([]corev1.Volume) {
+				if volume.Name == RuntimeVolumeName {
+					hasVolume = volume.EmptyDir != nil
+				}
+			}
+			hasMount := false
+			for _, mount := range container.VolumeMounts {
+				if mount.Name == RuntimeVolumeName && mount.MountPath == RuntimeMountPath {
+					hasMount = true
+				}
+			}
+			if hasVolume != tt.wantRuntime || hasMount != tt.wantRuntime {
+				t.Errorf("runtime volume = %v, mount = %v, want %v", hasVolume, hasMount, tt.wantRuntime)
+			}
+		})
+	}
+
+	sc := DefaultSecurityContext()
+	if !*sc.ReadOnlyRootFilesystem || *sc.AllowPrivilegeEscalation || sc.SeccompProfile.Type != corev1.SeccompProfileTypeRuntimeDefault {
+		t.Errorf("DefaultSecurityContext() = %+v, want read-only, no privilege escalation, RuntimeDefault seccomp", sc)
+	}
+	if !reflect.DeepEqual(sc.Capabilities.Drop, []corev1.Capability{"ALL"}) {
+		t.Errorf("DefaultSecurityContext() drops %v, want ALL", sc.Capabilities.Drop)
+	}
+}
+
+func TestMutateNativeSidecar(t *testing.T) {
+	tests := []struct {
+		name           string
+		native         bool
+		initContainers []corev1.Container
+		wantPath       string
+	}{
+		{name: "regular container", wantPath: "/spec/containers/-"},
+		{name: "no init containers", native: true, wantPath: "/spec/initContainers"},
+		{
+			name:           "after existing init containers",
+			native:         true,
+			initContainers: []corev1.Container{{Name: "container-disk-binary"}},
+			wantPath:       "/spec/initContainers/-",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest", NativeSidecar: tt.native})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test-ns",
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{AnnotationEnabled: "true"},
+				},
+				Spec: corev1.PodSpec{
+					InitContainers: tt.initContainers,
+					Containers:     []corev1.Container{{Name: "compute"}},
+				},
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+			if patches[1].Op != "add" || patches[1].Path != tt.wantPath {
+				t.Fatalf("patch[1] = %s %s, want add %s", patches[1].Op, patches[1].Path, tt.wantPath)
+			}
+
+			var container corev1.Container
+			switch v := patches[1].Value.(type) {
+			case corev1.Container:
+				container = v
+			case []corev1.Container:
+				if len(v) != 1 {
+					t.Fatalf("patch[1] adds %d init containers, want 1", len(v))
+				}
+				container = v[0]
+			}
+			if container.Name != ContainerName {
+				t.Errorf("container name = %q, want %q", container.Name, ContainerName)
+			}
+
+			gotAlways := container.RestartPolicy != nil && *container.RestartPolicy == corev1.ContainerRestartPolicyAlways
+			if gotAlways != tt.native {
+				t.Errorf("restartPolicy Always = %v, want %v", gotAlways, tt.native)
+			}
+		})
+	}
+}
+
+func TestMutateSPIFFE(t *testing.T) {
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "test-ns",
+				Name:      "test-pod",
+				Labels: map[string]string{
+					"kubevirt.io/domain": "test-vm",
+				},
+				Annotations: map[string]string{
+					AnnotationEnabled:       "true",
+					AnnotationSPIFFEEnabled: "true",
+				},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "compute"}},
+			},
+		}
+	}
+
+	t.Run("socket dir configured mounts socket", func(t *testing.T) {
+		mutator := NewMutator(Config{IMDSImage: "test-image:latest", SPIFFESocketDir: "/run/spire/agent-sockets"})
+
+		patches, err := mutator.Mutate(newPod())
+		if err != nil {
+			t.Fatalf("Mutate() unexpected error: %v", err)
+		}
+
+		// All volumes must land in the single array-creating patch
+		volumes, ok := patches[0].Value.([]corev1.Volume)
+		if !ok || patches[0].Path != "/spec/volumes" {
+			t.Fatalf("patch[0] = %+v, want add volumes array", patches[0])
+		}
+		if len(volumes) != 3 || volumes[1].Name != SPIFFESocketVolumeName || volumes[2].Name != RuntimeVolumeName {
+			t.Fatalf("volumes = %+v, want token, SPIFFE socket and runtime volumes", volumes)
+		}
+		if volumes[1].HostPath == nil || volumes[1].HostPath.Path != "/run/spire/agent-sockets" {
+			t.Errorf("SPIFFE volume hostPath = %+v, want /run/spire/agent-sockets", volumes[1].HostPath)
+		}
+
+		container, ok := patches[1].Value.(corev1.Container)
+		if !ok {
+			t.Fatalf("patch[1] value is not a Container")
+		}
+		found := false
+		for _, env := range container.Env {
+			if env.Name == "IMDS_SPIFFE_SOCKET" && env.Value == SPIFFESocketMountPath+"/"+SPIFFESocketName {
+				found = true
+			}
+		}
+		if !found {
+			t.Error("expected IMDS_SPIFFE_SOCKET env var")
+		}
+	})
+
+	t.Run("socket dir not configured fails", func(t *testing.T) {
+		mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+
+		if _, err := mutator.Mutate(newPod()); err == nil {
+			t.Error("Mutate() expected error, got nil")
+		}
+	})
+}
+
+func TestEscapeJSONPointer(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "no special characters",
+			input: "simple-key",
+			want:  "simple-key",
+		},
+		{
+			name:  "with tilde",
+			input: "key~with~tilde",
+			want:  "key~0with~0tilde",
+		},
+		{
+			name:  "with slash",
+			input: "key/with/slash",
+			want:  "key~1with~1slash",
+		},
+		{
+			name:  "with both tilde and slash",
+			input: "key~with/both",
+			want:  "key~0with~1both",
+		},
+		{
+			name:  "annotation with dots and slashes",
+			input: "imds.kubevirt.io/enabled",
+			want:  "imds.kubevirt.io~1enabled",
+		},
+		{
+			name:  "empty string",
+			input: "",
+			want:  "",
+		},
+		{
+			name:  "only tilde",
+			input: "~",
+			want:  "~0",
+		},
+		{
+			name:  "only slash",
+			input: "/",
+			want:  "~1",
+		},
+		{
+			name:  "tilde followed by slash",
+			input: "~/",
+			want:  "~0~1",
+		},
+		{
+			name:  "multiple consecutive tildes",
+			input: "~~~",
+			want:  "~0~0~0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := escapeJSONPointer(tt.input)
+			if got != tt.want {
+				t.Errorf("escapeJSONPointer(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreatePatch(t *testing.T) {
+	tests := []struct {
 		name    string
 		patches []PatchOperation
 		wantErr bool
@@ -465,7 +2278,7 @@ func TestCreateServerContainer(t *testing.T) {
 
 func TestCreateTokenVolume(t *testing.T) {
 	mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
-	volume := mutator.createTokenVolume()
+	volume := mutator.createTokenVolume(mutator.config.TokenExpirationSeconds, nil)
 
 	// Check volume name
 	if volume.Name != TokenVolumeName {
@@ -476,8 +2289,8 @@ func TestCreateTokenVolume(t *testing.T) {
 	if volume.Projected == nil {
 		t.Fatal("volume.Projected is nil")
 	}
-	if len(volume.Projected.Sources) != 1 {
-		t.Fatalf("expected 1 projected source, got %d", len(volume.Projected.Sources))
+	if len(volume.Projected.Sources) != 2 {
+		t.Fatalf("expected 2 projected sources, got %d", len(volume.Projected.Sources))
 	}
 
 	// Check service account token projection
@@ -491,4 +2304,279 @@ func TestCreateTokenVolume(t *testing.T) {
 	if tokenSource.ExpirationSeconds == nil || *tokenSource.ExpirationSeconds != DefaultTokenExpiration {
 		t.Errorf("token expiration = %v, want %d", tokenSource.ExpirationSeconds, DefaultTokenExpiration)
 	}
+
+	// Check cluster CA projection
+	caSource := volume.Projected.Sources[1].ConfigMap
+	if caSource == nil {
+		t.Fatal("ConfigMap projection is nil")
+	}
+	if caSource.Name != RootCAConfigMap {
+		t.Errorf("CA configmap = %q, want %q", caSource.Name, RootCAConfigMap)
+	}
+	if len(caSource.Items) != 1 || caSource.Items[0].Path != "ca.crt" {
+		t.Errorf("CA items = %+v, want ca.crt", caSource.Items)
+	}
+}
+
+func TestSidecarDefaults(t *testing.T) {
+	resources := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("10m")},
+	}
+	mutator := NewMutator(Config{
+		IMDSImage:              "test-image:latest",
+		Resources:              resources,
+		TokenExpirationSeconds: 7200,
+		Env:                    []corev1.EnvVar{{Name: "IMDS_LOG_LEVEL", Value: "debug"}},
+	})
+
+	container := mutator.createServerContainer("test-ns", "test-vm", "")
+	if !reflect.DeepEqual(container.Resources, resources) {
+		t.Errorf("container.Resources = %+v, want %+v", container.Resources, resources)
+	}
+	found := false
+	for _, env := range container.Env {
+		if env.Name == "IMDS_LOG_LEVEL" && env.Value == "debug" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("container.Env = %v, want IMDS_LOG_LEVEL=debug", container.Env)
+	}
+
+	proxied := NewMutator(Config{
+		IMDSImage: "test-image:latest",
+		Proxy:     ProxyConfig{HTTPSProxy: "http://proxy.corp:3128", NoProxy: ".svc"},
+		// Explicit env wins over the proxy settings
+		Env: []corev1.EnvVar{{Name: "NO_PROXY", Value: ".svc,10.0.0.1"}},
+	})
+	gotEnv := make(map[string]string)
+	for _, env := range proxied.createServerContainer("test-ns", "test-vm", "").Env {
+		gotEnv[env.Name] = env.Value
+	}
+	for name, want := range map[string]string{
+		"HTTPS_PROXY": "http://proxy.corp:3128",
+		"https_proxy": "http://proxy.corp:3128",
+		"NO_PROXY":    ".svc,10.0.0.1",
+		"no_proxy":    ".svc",
+		"HTTP_PROXY":  "",
+	} {
+		if gotEnv[name] != want {
+			t.Errorf("%s = %q, want %q", name, gotEnv[name], want)
+		}
+	}
+
+	volume := mutator.createTokenVolume(mutator.config.TokenExpirationSeconds, nil)
+	if got := *volume.Projected.Sources[0].ServiceAccountToken.ExpirationSeconds; got != 7200 {
+		t.Errorf("token ExpirationSeconds = %d, want 7200", got)
+	}
+
+	// Unset expiration falls back to the default
+	defaults := NewMutator(Config{IMDSImage: "test-image:latest"})
+	volume = defaults.createTokenVolume(defaults.config.TokenExpirationSeconds, nil)
+	if got := *volume.Projected.Sources[0].ServiceAccountToken.ExpirationSeconds; got != DefaultTokenExpiration {
+		t.Errorf("default token ExpirationSeconds = %d, want %d", got, DefaultTokenExpiration)
+	}
+}
+
+func TestMutateDownwardAPIEnv(t *testing.T) {
+	mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test-ns",
+			Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+			Annotations: map[string]string{AnnotationEnabled: "true"},
+		},
+	}
+
+	patches, err := mutator.Mutate(pod)
+	if err != nil {
+		t.Fatalf("Mutate() error = %v", err)
+	}
+	fields := make(map[string]string)
+	for _, e := range patches[1].Value.(corev1.Container).Env {
+		if e.ValueFrom != nil && e.ValueFrom.FieldRef != nil {
+			fields[e.Name] = e.ValueFrom.FieldRef.FieldPath
+		}
+	}
+	want := map[string]string{
+		"IMDS_SA_NAME":   "spec.serviceAccountName",
+		"IMDS_POD_NAME":  "metadata.name",
+		"IMDS_POD_UID":   "metadata.uid",
+		"IMDS_NODE_NAME": "spec.nodeName",
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("fieldRef env = %v, want %v", fields, want)
+	}
+}
+
+func TestMutateCleanupOnStop(t *testing.T) {
+	gracePeriod := int64(45)
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantTimeout string
+	}{
+		{name: "off by default", annotations: map[string]string{AnnotationEnabled: "true"}},
+		{name: "enabled", annotations: map[string]string{AnnotationEnabled: "true", AnnotationCleanupOnStop: "true"}, wantTimeout: "35s"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test-ns",
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: tt.annotations,
+				},
+				Spec: corev1.PodSpec{TerminationGracePeriodSeconds: &gracePeriod},
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if err != nil {
+				t.Fatalf("Mutate() error = %v", err)
+			}
+			container := patches[1].Value.(corev1.Container)
+			timeout := ""
+			for _, e := range container.Env {
+				if e.Name == "IMDS_SHUTDOWN_TIMEOUT" {
+					timeout = e.Value
+				}
+			}
+			if timeout != tt.wantTimeout {
+				t.Errorf("IMDS_SHUTDOWN_TIMEOUT = %q, want %q", timeout, tt.wantTimeout)
+			}
+			if hasHook := container.Lifecycle != nil && container.Lifecycle.PreStop != nil; hasHook != (tt.wantTimeout != "") {
+				t.Errorf("preStop hook = %v, want %v", hasHook, tt.wantTimeout != "")
+			}
+		})
+	}
+}
+
+func TestMutateImagePullSecrets(t *testing.T) {
+	configured := []corev1.LocalObjectReference{{Name: "imds-registry"}, {Name: "mirror"}}
+	tests := []struct {
+		name        string
+		configured  []corev1.LocalObjectReference
+		existing    []corev1.LocalObjectReference
+		wantPatches []PatchOperation
+	}{
+		{name: "none configured"},
+		{
+			name:       "pod without pull secrets",
+			configured: configured,
+			wantPatches: []PatchOperation{
+				{Op: "add", Path: "/spec/imagePullSecrets", Value: configured},
+			},
+		},
+		{
+			name:       "appended to existing",
+			configured: configured,
+			existing:   []corev1.LocalObjectReference{{Name: "vm-registry"}, {Name: "mirror"}},
+			wantPatches: []PatchOperation{
+				{Op: "add", Path: "/spec/imagePullSecrets/-", Value: corev1.LocalObjectReference{Name: "imds-registry"}},
+			},
+		},
+		{
+			name:       "already referenced",
+			configured: configured,
+			existing:   configured,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest", ImagePullSecrets: tt.configured})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test-ns",
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{AnnotationEnabled: "true"},
+				},
+				Spec: corev1.PodSpec{ImagePullSecrets: tt.existing},
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if err != nil {
+				t.Fatalf("Mutate() error = %v", err)
+			}
+			var got []PatchOperation
+			for _, patch := range patches {
+				if strings.HasPrefix(patch.Path, "/spec/imagePullSecrets") {
+					got = append(got, patch)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.wantPatches) {
+				t.Errorf("imagePullSecrets patches = %+v, want %+v", got, tt.wantPatches)
+			}
+			if last := patches[len(patches)-1]; last.Path != "/metadata/annotations" && !strings.HasPrefix(last.Path, "/metadata/annotations/") {
+				t.Errorf("last patch = %s, want the injected annotation", last.Path)
+			}
+		})
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	newPod := func(annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test-ns",
+				Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+				Annotations: annotations,
+			},
+		}
+	}
+	base := Config{IMDSImage: "imds:v1", TokenExpirationSeconds: 3600}
+	mutator := NewMutator(base)
+
+	patches, err := mutator.Mutate(newPod(map[string]string{AnnotationEnabled: "true"}))
+	if err != nil {
+		t.Fatalf("Mutate() error = %v", err)
+	}
+	stamped := ""
+	for _, patch := range patches {
+		if patch.Path == "/metadata/annotations/imds.kubevirt.io~1config-hash" {
+			stamped = patch.Value.(string)
+		}
+	}
+	if len(stamped) != 16 {
+		t.Fatalf("config-hash = %q, want 16 hex characters", stamped)
+	}
+
+	// The injected pod still hashes the same under the same configuration
+	injected := newPod(map[string]string{AnnotationEnabled: "true", AnnotationInjected: "true", AnnotationConfigHash: stamped})
+	if got, err := mutator.ConfigHash(injected); err != nil || got != stamped {
+		t.Errorf("ConfigHash() = %q, %v, want %q", got, err, stamped)
+	}
+
+	tests := []struct {
+		name        string
+		config      Config
+		annotations map[string]string
+	}{
+		{name: "image", config: Config{IMDSImage: "imds:v2", TokenExpirationSeconds: 3600}},
+		{name: "token expiration", config: Config{IMDSImage: "imds:v1", TokenExpirationSeconds: 7200}},
+		{name: "env", config: Config{IMDSImage: "imds:v1", TokenExpirationSeconds: 3600, Env: []corev1.EnvVar{{Name: "IMDS_LOG_LEVEL", Value: "debug"}}}},
+		{name: "native sidecar", config: Config{IMDSImage: "imds:v1", TokenExpirationSeconds: 3600, NativeSidecar: true}},
+		{name: "pod annotation", config: base, annotations: map[string]string{AnnotationVLAN: "100"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{AnnotationEnabled: "true"}
+			for k, v := range tt.annotations {
+				annotations[k] = v
+			}
+			got, err := NewMutator(tt.config).ConfigHash(newPod(annotations))
+			if err != nil {
+				t.Fatalf("ConfigHash() error = %v", err)
+			}
+			if got == stamped {
+				t.Errorf("ConfigHash() = %q, want a different hash than the original", got)
+			}
+		})
+	}
+
+	if _, err := mutator.ConfigHash(newPod(map[string]string{AnnotationEnabled: "true", AnnotationVLAN: "5000"})); err == nil {
+		t.Error("ConfigHash() with an invalid annotation error = nil, want error")
+	}
 }
@@ -0,0 +1,37 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+)
+
+// namespaceResync is how often the namespace cache is resynced
+const namespaceResync = 10 * time.Minute
+
+// NamespaceLabelLookup returns a Config.NamespaceLabels function backed by a
+// namespace informer, so admission requests never wait on the API server.
+// It blocks until the cache has synced. The webhook needs list and watch on
+// namespaces.
+func NamespaceLabelLookup(ctx context.Context, client kubernetes.Interface) (func(string) (map[string]string, error), error) {
+	factory := informers.NewSharedInformerFactory(client, namespaceResync)
+	lister := factory.Core().V1().Namespaces().Lister()
+	factory.Start(ctx.Done())
+
+	for typ, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return nil, fmt.Errorf("failed to sync %v cache", typ)
+		}
+	}
+
+	return func(name string) (map[string]string, error) {
+		ns, err := lister.Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get namespace %s: %w", name, err)
+		}
+		return ns.Labels, nil
+	}, nil
+}
@@ -0,0 +1,39 @@
+package webhook
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNamespaceLabelLookup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := fake.NewSimpleClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "vms",
+			Labels: map[string]string{LabelEnabled: "true"},
+		},
+	})
+
+	lookup, err := NamespaceLabelLookup(ctx, client)
+	if err != nil {
+		t.Fatalf("NamespaceLabelLookup() error = %v", err)
+	}
+
+	labels, err := lookup("vms")
+	if err != nil {
+		t.Fatalf("lookup(vms) error = %v", err)
+	}
+	if labels[LabelEnabled] != "true" {
+		t.Errorf("lookup(vms) labels = %v, want %s=true", labels, LabelEnabled)
+	}
+
+	if _, err := lookup("missing"); err == nil {
+		t.Error("lookup(missing) expected error")
+	}
+}
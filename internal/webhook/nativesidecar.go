@@ -0,0 +1,34 @@
+package webhook
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/discovery"
+)
+
+// Native sidecar modes for the webhook's --native-sidecar flag
+const (
+	NativeSidecarAuto     = "auto"
+	NativeSidecarEnabled  = "true"
+	NativeSidecarDisabled = "false"
+)
+
+// nativeSidecarVersion is the first Kubernetes release with the
+// SidecarContainers feature gate on by default. It is beta but off by
+// default in 1.28, so clusters enabling it there must opt in explicitly.
+var nativeSidecarVersion = version.MustParseGeneric("1.29.0")
+
+// NativeSidecarSupported reports whether the API server runs a Kubernetes
+// version that accepts init containers with restartPolicy Always.
+func NativeSidecarSupported(client discovery.ServerVersionInterface) (bool, error) {
+	info, err := client.ServerVersion()
+	if err != nil {
+		return false, fmt.Errorf("failed to get server version: %w", err)
+	}
+	v, err := version.ParseGeneric(info.GitVersion)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse server version %q: %w", info.GitVersion, err)
+	}
+	return v.AtLeast(nativeSidecarVersion), nil
+}
@@ -0,0 +1,45 @@
+package webhook
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNativeSidecarSupported(t *testing.T) {
+	tests := []struct {
+		gitVersion string
+		want       bool
+		wantErr    bool
+	}{
+		{gitVersion: "v1.27.3", want: false},
+		{gitVersion: "v1.28.9", want: false},
+		{gitVersion: "v1.29.0", want: true},
+		{gitVersion: "v1.30.2+k3s1", want: true},
+		{gitVersion: "v1.31.0-eks-a737599", want: true},
+		{gitVersion: "unknown", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.gitVersion, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			client.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &version.Info{GitVersion: tt.gitVersion}
+
+			got, err := NativeSidecarSupported(client.Discovery())
+			if tt.wantErr {
+				if err == nil {
+					t.Error("NativeSidecarSupported() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NativeSidecarSupported() unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("NativeSidecarSupported() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package webhook
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// PodInfoVolumeName is the downward API volume with the pod's labels and
+	// annotations
+	PodInfoVolumeName = "imds-podinfo"
+	// PodInfoMountPath is where the pod's labels and annotations are mounted
+	PodInfoMountPath = "/var/run/imds/podinfo"
+)
+
+// podInfoVolume returns the downward API volume exposing the pod's labels
+// and annotations, which the kubelet keeps up to date.
+func podInfoVolume() corev1.Volume {
+	return corev1.Volume{
+		Name: PodInfoVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items: []corev1.DownwardAPIVolumeFile{
+					{Path: "labels", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels"}},
+					{Path: "annotations", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations"}},
+				},
+			},
+		},
+	}
+}
+
+// configurePodInfo mounts the pod info volume and has the sidecar serve it
+// under /v1/pod.
+func configurePodInfo(container *corev1.Container) {
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      PodInfoVolumeName,
+		MountPath: PodInfoMountPath,
+		ReadOnly:  true,
+	})
+	container.Env = append(container.Env, corev1.EnvVar{Name: "IMDS_POD_INFO_DIR", Value: PodInfoMountPath})
+}
@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMutatePodMetadata(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        bool
+	}{
+		{name: "off by default", annotations: map[string]string{AnnotationEnabled: "true"}},
+		{name: "enabled", annotations: map[string]string{AnnotationEnabled: "true", AnnotationPodMetadata: "true"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test-ns",
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: tt.annotations,
+				},
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if err != nil {
+				t.Fatalf("Mutate() error = %v", err)
+			}
+
+			var mounted bool
+			for _, m := range patches[1].Value.(corev1.Container).VolumeMounts {
+				mounted = mounted || m.Name == PodInfoVolumeName
+			}
+			var volume *corev1.Volume
+			for _, patch := range patches {
+				if volumes, ok := patch.Value.([]corev1.Volume); ok {
+					for i := range volumes {
+						if volumes[i].Name == PodInfoVolumeName {
+							volume = &volumes[i]
+						}
+					}
+				}
+				if v, ok := patch.Value.(corev1.Volume); ok && v.Name == PodInfoVolumeName {
+					volume = &v
+				}
+			}
+			if mounted != tt.want || (volume != nil) != tt.want {
+				t.Fatalf("mounted = %t, volume = %v, want %t", mounted, volume, tt.want)
+			}
+			if volume != nil && (volume.DownwardAPI == nil || len(volume.DownwardAPI.Items) != 2) {
+				t.Errorf("volume = %+v, want labels and annotations", volume.VolumeSource)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package webhook
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// PodSecurityEnforceLabel is the namespace label selecting the Pod Security
+// Standard that Pod Security Admission enforces
+const PodSecurityEnforceLabel = "pod-security.kubernetes.io/enforce"
+
+// Pod Security Standard levels
+const (
+	LevelPrivileged = "privileged"
+	LevelBaseline   = "baseline"
+	LevelRestricted = "restricted"
+)
+
+// Actions for Config.PodSecurity when the sidecar would violate the
+// namespace's enforced Pod Security Standard
+const (
+	// PodSecurityDeny rejects the pod, explaining the conflict
+	PodSecurityDeny = "deny"
+	// PodSecuritySkip admits the pod without IMDS, with a warning
+	PodSecuritySkip = "skip"
+	// PodSecurityIgnore injects anyway, for clusters that exempt KubeVirt
+	// from Pod Security Admission
+	PodSecurityIgnore = "ignore"
+)
+
+// baselineCapabilities are the capabilities the baseline standard allows a
+// container to add
+var baselineCapabilities = map[corev1.Capability]bool{
+	"AUDIT_WRITE": true, "CHOWN": true, "DAC_OVERRIDE": true, "FOWNER": true,
+	"FSETID": true, "KILL": true, "MKNOD": true, "NET_BIND_SERVICE": true,
+	"SETFCAP": true, "SETGID": true, "SETPCAP": true, "SETUID": true,
+	"SYS_CHROOT": true,
+}
+
+// PodSecurityError is returned by Mutate when the sidecar would make the pod
+// fail Pod Security Admission.
+type PodSecurityError struct {
+	Namespace  string
+	Level      string
+	Violations []string
+}
+
+func (e *PodSecurityError) Error() string {
+	return fmt.Sprintf("namespace %s enforces the %s Pod Security Standard, which the IMDS sidecar violates (%s); label the namespace %s=%s, exempt KubeVirt from Pod Security Admission, or disable IMDS for this VM",
+		e.Namespace, e.Level, strings.Join(e.Violations, "; "), PodSecurityEnforceLabel, LevelPrivileged)
+}
+
+// validPodSecurity reports whether action is a supported Config.PodSecurity
+// action. The empty string is PodSecurityDeny.
+func validPodSecurity(action string) bool {
+	switch action {
+	case "", PodSecurityDeny, PodSecuritySkip, PodSecurityIgnore:
+		return true
+	default:
+		return false
+	}
+}
+
+// PodSecuritySkip reports whether pods the sidecar can't be injected into
+// under Pod Security Admission are admitted without it.
+func (m *Mutator) PodSecuritySkip() bool {
+	return m.config.PodSecurity == PodSecuritySkip
+}
+
+// checkPodSecurity returns a PodSecurityError if the sidecar and its volumes
+// violate the Pod Security Standard enforced on the pod's namespace.
+// Namespaces without the label are privileged, the Kubernetes default;
+// cluster-wide defaults and exemptions in the API server's admission
+// configuration aren't visible to the webhook.
+func (m *Mutator) checkPodSecurity(pod *corev1.Pod, container corev1.Container, volumes []corev1.Volume) error {
+	if m.config.PodSecurity == PodSecurityIgnore || m.config.NamespaceLabels == nil || pod.Namespace == "" {
+		return nil
+	}
+	nsLabels, err := m.config.NamespaceLabels(pod.Namespace)
+	if err != nil {
+		log.Printf("Not checking Pod Security: failed to get namespace %s: %v", pod.Namespace, err)
+		return nil
+	}
+	level := nsLabels[PodSecurityEnforceLabel]
+	violations := podSecurityViolations(pod.Spec.SecurityContext, container, volumes, level)
+	if len(violations) == 0 {
+		return nil
+	}
+	return &PodSecurityError{Namespace: pod.Namespace, Level: level, Violations: violations}
+}
+
+// podSecurityViolations lists how a container and its volumes violate the
+// baseline or restricted level, following the Pod Security Standards checks
+// that apply to what the webhook injects. Other levels allow everything.
+func podSecurityViolations(podSC *corev1.PodSecurityContext, container corev1.Container, volumes []corev1.Volume, level string) []string {
+	if level != LevelBaseline && level != LevelRestricted {
+		return nil
+	}
+	if podSC == nil {
+		podSC = &corev1.PodSecurityContext{}
+	}
+	sc := container.SecurityContext
+	if sc == nil {
+		sc = &corev1.SecurityContext{}
+	}
+
+	var violations []string
+	if sc.Privileged != nil && *sc.Privileged {
+		violations = append(violations, "privileged")
+	}
+	var added []string
+	if sc.Capabilities != nil {
+		for _, capability := range sc.Capabilities.Add {
+			allowed := baselineCapabilities[capability]
+			if level == LevelRestricted {
+				allowed = capability == "NET_BIND_SERVICE"
+			}
+			if !allowed {
+				added = append(added, string(capability))
+			}
+		}
+	}
+	if len(added) > 0 {
+		sort.Strings(added)
+		violations = append(violations, "adds capabilities "+strings.Join(added, ", "))
+	}
+	var hostPaths []string
+	for _, v := range volumes {
+		if v.HostPath != nil {
+			hostPaths = append(hostPaths, v.Name)
+		}
+	}
+	if len(hostPaths) > 0 {
+		violations = append(violations, "hostPath volumes "+strings.Join(hostPaths, ", "))
+	}
+	seccomp := sc.SeccompProfile
+	if seccomp == nil {
+		seccomp = podSC.SeccompProfile
+	}
+	if seccomp != nil && seccomp.Type == corev1.SeccompProfileTypeUnconfined {
+		violations = append(violations, "unconfined seccomp profile")
+	}
+	if level == LevelBaseline {
+		return violations
+	}
+
+	if sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+		violations = append(violations, "allows privilege escalation")
+	}
+	runAsNonRoot := podSC.RunAsNonRoot
+	if sc.RunAsNonRoot != nil {
+		runAsNonRoot = sc.RunAsNonRoot
+	}
+	if runAsNonRoot == nil || !*runAsNonRoot {
+		violations = append(violations, "doesn't set runAsNonRoot")
+	}
+	runAsUser := podSC.RunAsUser
+	if sc.RunAsUser != nil {
+		runAsUser = sc.RunAsUser
+	}
+	if runAsUser != nil && *runAsUser == 0 {
+		violations = append(violations, "runs as root")
+	}
+	dropsAll := false
+	if sc.Capabilities != nil {
+		for _, capability := range sc.Capabilities.Drop {
+			dropsAll = dropsAll || capability == "ALL"
+		}
+	}
+	if !dropsAll {
+		violations = append(violations, "doesn't drop ALL capabilities")
+	}
+	if seccomp == nil {
+		violations = append(violations, "no seccomp profile")
+	}
+	return violations
+}
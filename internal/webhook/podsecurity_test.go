@@ -0,0 +1,114 @@
+package webhook
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodSecurityViolations(t *testing.T) {
+	nonRoot := true
+	escalation := false
+	uid := int64(107)
+	restricted := &corev1.SecurityContext{
+		RunAsNonRoot:             &nonRoot,
+		RunAsUser:                &uid,
+		AllowPrivilegeEscalation: &escalation,
+		SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+			Add:  []corev1.Capability{"NET_BIND_SERVICE"},
+		},
+	}
+	hostPath := corev1.Volume{Name: SPIFFESocketVolumeName, VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: "/run/spire"}}}
+
+	tests := []struct {
+		name    string
+		sc      *corev1.SecurityContext
+		volumes []corev1.Volume
+		level   string
+		want    []string
+	}{
+		{name: "unlabeled namespace", sc: DefaultSecurityContext()},
+		{name: "privileged", sc: DefaultSecurityContext(), level: LevelPrivileged},
+		{
+			name:  "default sidecar under baseline",
+			sc:    DefaultSecurityContext(),
+			level: LevelBaseline,
+			want:  []string{"adds capabilities NET_ADMIN, NET_RAW"},
+		},
+		{
+			name:  "default sidecar under restricted",
+			sc:    DefaultSecurityContext(),
+			level: LevelRestricted,
+			want:  []string{"adds capabilities NET_ADMIN, NET_RAW", "doesn't set runAsNonRoot", "runs as root"},
+		},
+		{
+			name:    "SPIFFE socket under baseline",
+			sc:      restricted,
+			volumes: []corev1.Volume{hostPath},
+			level:   LevelBaseline,
+			want:    []string{"hostPath volumes " + SPIFFESocketVolumeName},
+		},
+		{name: "restricted-compatible override", sc: restricted, level: LevelRestricted},
+		{
+			name:  "no security context under restricted",
+			level: LevelRestricted,
+			want:  []string{"allows privilege escalation", "doesn't set runAsNonRoot", "doesn't drop ALL capabilities", "no seccomp profile"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			container := corev1.Container{Name: ContainerName, SecurityContext: tt.sc}
+			got := podSecurityViolations(nil, container, tt.volumes, tt.level)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("podSecurityViolations() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMutatePodSecurity(t *testing.T) {
+	tests := []struct {
+		name      string
+		action    string
+		nsLabels  map[string]string
+		wantError bool
+	}{
+		{name: "unlabeled namespace"},
+		{name: "privileged namespace", nsLabels: map[string]string{PodSecurityEnforceLabel: LevelPrivileged}},
+		{name: "baseline namespace", nsLabels: map[string]string{PodSecurityEnforceLabel: LevelBaseline}, wantError: true},
+		{name: "baseline namespace, skip", action: PodSecuritySkip, nsLabels: map[string]string{PodSecurityEnforceLabel: LevelBaseline}, wantError: true},
+		{name: "baseline namespace, ignore", action: PodSecurityIgnore, nsLabels: map[string]string{PodSecurityEnforceLabel: LevelBaseline}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{
+				IMDSImage:       "test-image:latest",
+				PodSecurity:     tt.action,
+				NamespaceLabels: func(string) (map[string]string, error) { return tt.nsLabels, nil },
+			})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test-ns",
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: map[string]string{AnnotationEnabled: "true"},
+				},
+			}
+
+			patches, err := mutator.Mutate(pod)
+			var podSecurityErr *PodSecurityError
+			if gotError := errors.As(err, &podSecurityErr); gotError != tt.wantError {
+				t.Fatalf("Mutate() error = %v, want PodSecurityError %v", err, tt.wantError)
+			}
+			if !tt.wantError && len(patches) == 0 {
+				t.Error("Mutate() returned no patches")
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Probe kinds for Config.Probes and AnnotationProbes
+const (
+	ProbesNone    = "none"
+	ProbesExec    = "exec"
+	ProbesHTTPGet = "httpGet"
+)
+
+const (
+	// HealthPort is where the sidecar answers httpGet probes
+	HealthPort = 8086
+	// HealthPortName names HealthPort on the sidecar container
+	HealthPortName = "imds-health"
+)
+
+const (
+	probePeriodSeconds  = 10
+	probeTimeoutSeconds = 5
+	// startupFailureThreshold covers the five minutes the sidecar waits for
+	// the VM network before it starts serving
+	startupFailureThreshold = 30
+)
+
+// validProbes reports whether kind is a supported probe kind. The empty
+// string leaves the sidecar without probes, like ProbesNone.
+func validProbes(kind string) bool {
+	switch kind {
+	case "", ProbesNone, ProbesExec, ProbesHTTPGet:
+		return true
+	default:
+		return false
+	}
+}
+
+// configureProbes adds startup, liveness and readiness probes of the given
+// kind to the sidecar. Liveness requests /healthz from the guest-facing
+// listener, so a wedged server is restarted; readiness is the data path
+// self-test. exec probes go through the admin socket, httpGet probes to a
+// health listener on the pod IP.
+func configureProbes(container *corev1.Container, kind string) {
+	var liveness, readiness corev1.ProbeHandler
+	switch kind {
+	case ProbesExec:
+		liveness.Exec = &corev1.ExecAction{Command: []string{"/imds-server", "admin", "healthz"}}
+		readiness.Exec = &corev1.ExecAction{Command: []string{"/imds-server", "admin", "readyz"}}
+	case ProbesHTTPGet:
+		port := intstr.FromString(HealthPortName)
+		liveness.HTTPGet = &corev1.HTTPGetAction{Path: "/healthz", Port: port}
+		readiness.HTTPGet = &corev1.HTTPGetAction{Path: "/readyz", Port: port}
+		container.Ports = append(container.Ports, corev1.ContainerPort{
+			Name:          HealthPortName,
+			ContainerPort: HealthPort,
+			Protocol:      corev1.ProtocolTCP,
+		})
+		container.Env = append(container.Env, corev1.EnvVar{Name: "IMDS_HEALTH_ADDR", Value: fmt.Sprintf(":%d", HealthPort)})
+	default:
+		return
+	}
+
+	container.StartupProbe = &corev1.Probe{
+		ProbeHandler:     liveness,
+		PeriodSeconds:    probePeriodSeconds,
+		TimeoutSeconds:   probeTimeoutSeconds,
+		FailureThreshold: startupFailureThreshold,
+	}
+	container.LivenessProbe = &corev1.Probe{
+		ProbeHandler:     liveness,
+		PeriodSeconds:    probePeriodSeconds,
+		TimeoutSeconds:   probeTimeoutSeconds,
+		FailureThreshold: 3,
+	}
+	container.ReadinessProbe = &corev1.Probe{
+		ProbeHandler:     readiness,
+		PeriodSeconds:    probePeriodSeconds,
+		TimeoutSeconds:   probeTimeoutSeconds,
+		FailureThreshold: 3,
+	}
+}
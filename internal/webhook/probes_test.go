@@ -0,0 +1,97 @@
+package webhook
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMutateProbes(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		annotation string
+		wantKind   string
+		wantErr    bool
+	}{
+		{name: "none by default"},
+		{name: "exec from config", config: ProbesExec, wantKind: ProbesExec},
+		{name: "httpGet from config", config: ProbesHTTPGet, wantKind: ProbesHTTPGet},
+		{name: "annotation overrides config", config: ProbesHTTPGet, annotation: ProbesExec, wantKind: ProbesExec},
+		{name: "annotation turns probes off", config: ProbesExec, annotation: ProbesNone},
+		{name: "invalid annotation", annotation: "tcpSocket", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest", Probes: tt.config})
+			annotations := map[string]string{AnnotationEnabled: "true"}
+			if tt.annotation != "" {
+				annotations[AnnotationProbes] = tt.annotation
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test-ns",
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: annotations,
+				},
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Mutate() error = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() error = %v", err)
+			}
+			container := patches[1].Value.(corev1.Container)
+
+			healthAddr := ""
+			for _, e := range container.Env {
+				if e.Name == "IMDS_HEALTH_ADDR" {
+					healthAddr = e.Value
+				}
+			}
+
+			switch tt.wantKind {
+			case "":
+				if container.StartupProbe != nil || container.LivenessProbe != nil || container.ReadinessProbe != nil {
+					t.Errorf("probes = %v/%v/%v, want none", container.StartupProbe, container.LivenessProbe, container.ReadinessProbe)
+				}
+				if healthAddr != "" || len(container.Ports) != 0 {
+					t.Errorf("IMDS_HEALTH_ADDR = %q, ports = %v, want neither", healthAddr, container.Ports)
+				}
+			case ProbesExec:
+				if got := container.LivenessProbe.Exec.Command; len(got) != 3 || got[2] != "healthz" {
+					t.Errorf("liveness command = %v, want admin healthz", got)
+				}
+				if got := container.ReadinessProbe.Exec.Command; len(got) != 3 || got[2] != "readyz" {
+					t.Errorf("readiness command = %v, want admin readyz", got)
+				}
+				if container.StartupProbe.Exec == nil || container.StartupProbe.FailureThreshold*container.StartupProbe.PeriodSeconds < 300 {
+					t.Errorf("startup probe = %+v, want exec allowing 5 minutes", container.StartupProbe)
+				}
+				if healthAddr != "" {
+					t.Errorf("IMDS_HEALTH_ADDR = %q, want unset for exec probes", healthAddr)
+				}
+			case ProbesHTTPGet:
+				if got := container.LivenessProbe.HTTPGet; got.Path != "/healthz" || got.Port.StrVal != HealthPortName {
+					t.Errorf("liveness = %+v, want /healthz on %s", got, HealthPortName)
+				}
+				if got := container.ReadinessProbe.HTTPGet; got.Path != "/readyz" {
+					t.Errorf("readiness path = %s, want /readyz", got.Path)
+				}
+				if len(container.Ports) != 1 || container.Ports[0].Name != HealthPortName || container.Ports[0].ContainerPort != HealthPort {
+					t.Errorf("ports = %v, want %s:%d", container.Ports, HealthPortName, HealthPort)
+				}
+				if healthAddr != ":8086" {
+					t.Errorf("IMDS_HEALTH_ADDR = %q, want :8086", healthAddr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package webhook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Built-in injection profiles
+const (
+	ProfileDefault = "default"
+	ProfileDebug   = "debug"
+	ProfileMinimal = "minimal"
+)
+
+// Profile is a named variant of the sidecar, selected per VM with
+// AnnotationProfile. Unset fields keep the webhook defaults.
+type Profile struct {
+	// Image replaces the sidecar image, e.g. with a build that has extra tools
+	Image string `json:"image,omitempty"`
+	// Env is added after the webhook's Env, so it wins over it
+	Env []corev1.EnvVar `json:"env,omitempty"`
+	// Resources replace the webhook's default resources. The per-VM resource
+	// annotations still apply on top.
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+}
+
+// DefaultProfiles returns the built-in profiles. Profiles in Config.Profiles
+// with the same name replace them.
+func DefaultProfiles() map[string]Profile {
+	return map[string]Profile{
+		ProfileDefault: {},
+		ProfileDebug: {
+			Env: []corev1.EnvVar{
+				{Name: "IMDS_LOG_LEVEL", Value: "debug"},
+				{Name: "IMDS_SELFTEST_INTERVAL", Value: "10s"},
+			},
+		},
+		ProfileMinimal: {
+			Env: []corev1.EnvVar{
+				{Name: "IMDS_LOG_LEVEL", Value: "error"},
+				// Announce the IMDS address only on startup
+				{Name: "IMDS_GARP_INTERVAL", Value: "0"},
+				{Name: "IMDS_SELFTEST_INTERVAL", Value: "0"},
+			},
+			Resources: &corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("5m"),
+					corev1.ResourceMemory: resource.MustParse("16Mi"),
+				},
+				Limits: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("50m"),
+					corev1.ResourceMemory: resource.MustParse("64Mi"),
+				},
+			},
+		},
+	}
+}
+
+// profile returns the profile a pod asks for with AnnotationProfile, or the
+// default profile.
+func (m *Mutator) profile(pod *corev1.Pod) (Profile, error) {
+	name := pod.Annotations[AnnotationProfile]
+	if name == "" {
+		name = ProfileDefault
+	}
+	if profile, ok := m.config.Profiles[name]; ok {
+		return profile, nil
+	}
+	if profile, ok := DefaultProfiles()[name]; ok {
+		return profile, nil
+	}
+	return Profile{}, fmt.Errorf("unknown %s %q: must be one of %s", AnnotationProfile, name, strings.Join(m.profileNames(), ", "))
+}
+
+// profileNames lists the available profiles, sorted.
+func (m *Mutator) profileNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, profiles := range []map[string]Profile{DefaultProfiles(), m.config.Profiles} {
+		for name := range profiles {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,128 @@
+package webhook
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMutateProfile(t *testing.T) {
+	mutator := NewMutator(Config{
+		IMDSImage: "test-image:latest",
+		Resources: DefaultResources(),
+		Env:       []corev1.EnvVar{{Name: "IMDS_LOG_LEVEL", Value: "info"}},
+		Profiles: map[string]Profile{
+			ProfileDebug: {
+				Image: "test-image:debug",
+				Env:   []corev1.EnvVar{{Name: "IMDS_LOG_LEVEL", Value: "debug"}},
+			},
+			"quiet": {Env: []corev1.EnvVar{{Name: "IMDS_LOG_LEVEL", Value: "error"}}},
+		},
+	})
+
+	tests := []struct {
+		name          string
+		annotations   map[string]string
+		wantImage     string
+		wantLogLevel  string
+		wantResources corev1.ResourceRequirements
+		wantErr       bool
+	}{
+		{
+			name:          "no profile",
+			wantImage:     "test-image:latest",
+			wantLogLevel:  "info",
+			wantResources: DefaultResources(),
+		},
+		{
+			name:          "configured profile replaces built-in",
+			annotations:   map[string]string{AnnotationProfile: ProfileDebug},
+			wantImage:     "test-image:debug",
+			wantLogLevel:  "debug",
+			wantResources: DefaultResources(),
+		},
+		{
+			name:          "custom profile",
+			annotations:   map[string]string{AnnotationProfile: "quiet"},
+			wantImage:     "test-image:latest",
+			wantLogLevel:  "error",
+			wantResources: DefaultResources(),
+		},
+		{
+			name:          "built-in minimal profile",
+			annotations:   map[string]string{AnnotationProfile: ProfileMinimal},
+			wantImage:     "test-image:latest",
+			wantLogLevel:  "error",
+			wantResources: *DefaultProfiles()[ProfileMinimal].Resources,
+		},
+		{
+			name: "resource annotations apply on top of the profile",
+			annotations: map[string]string{
+				AnnotationProfile:     ProfileMinimal,
+				AnnotationMemoryLimit: "96Mi",
+			},
+			wantImage:    "test-image:latest",
+			wantLogLevel: "error",
+			wantResources: corev1.ResourceRequirements{
+				Requests: DefaultProfiles()[ProfileMinimal].Resources.Requests,
+				Limits: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("50m"),
+					corev1.ResourceMemory: resource.MustParse("96Mi"),
+				},
+			},
+		},
+		{
+			name:        "unknown profile",
+			annotations: map[string]string{AnnotationProfile: "verbose"},
+			wantErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{AnnotationEnabled: "true"}
+			for k, v := range tt.annotations {
+				annotations[k] = v
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test-ns",
+					Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+					Annotations: annotations,
+				},
+			}
+
+			patches, err := mutator.Mutate(pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("Mutate() expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Mutate() unexpected error: %v", err)
+			}
+
+			container := patches[1].Value.(corev1.Container)
+			if container.Image != tt.wantImage {
+				t.Errorf("image = %q, want %q", container.Image, tt.wantImage)
+			}
+			// The last IMDS_LOG_LEVEL takes effect
+			logLevel := ""
+			for _, env := range container.Env {
+				if env.Name == "IMDS_LOG_LEVEL" {
+					logLevel = env.Value
+				}
+			}
+			if logLevel != tt.wantLogLevel {
+				t.Errorf("IMDS_LOG_LEVEL = %q, want %q", logLevel, tt.wantLogLevel)
+			}
+			if !reflect.DeepEqual(container.Resources, tt.wantResources) {
+				t.Errorf("resources = %+v, want %+v", container.Resources, tt.wantResources)
+			}
+		})
+	}
+}
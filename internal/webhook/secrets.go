@@ -0,0 +1,66 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// configureExposedSecrets passes the Secrets listed in
+// AnnotationExposeSecrets to the sidecar for /v1/secrets.
+func configureExposedSecrets(container *corev1.Container, annotations map[string]string) error {
+	return configureExposed(container, annotations, AnnotationExposeSecrets, "IMDS_EXPOSE_SECRETS")
+}
+
+// configureExposedConfigMaps passes the ConfigMaps listed in
+// AnnotationExposeConfigMaps to the sidecar for /v1/configs.
+func configureExposedConfigMaps(container *corev1.Container, annotations map[string]string) error {
+	return configureExposed(container, annotations, AnnotationExposeConfigMaps, "IMDS_EXPOSE_CONFIGMAPS")
+}
+
+// configureExposed sets env to the objects listed in annotation, as
+// comma-separated "<name>" or "<name>/<key>" entries, encoded as a JSON map
+// of names to keys. A bare name exposes all keys.
+func configureExposed(container *corev1.Container, annotations map[string]string, annotation, env string) error {
+	value := annotations[annotation]
+	if value == "" {
+		return nil
+	}
+
+	exposed := make(map[string][]string)
+	allKeys := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, key, hasKey := strings.Cut(entry, "/")
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			return fmt.Errorf("invalid %s entry %q: %s", annotation, entry, strings.Join(errs, "; "))
+		}
+		if !hasKey {
+			allKeys[name] = true
+			exposed[name] = []string{}
+			continue
+		}
+		if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+			return fmt.Errorf("invalid %s entry %q: %s", annotation, entry, strings.Join(errs, "; "))
+		}
+		if !allKeys[name] {
+			exposed[name] = append(exposed[name], key)
+		}
+	}
+	if len(exposed) == 0 {
+		return fmt.Errorf("invalid %s %q: no objects listed", annotation, value)
+	}
+
+	encoded, err := json.Marshal(exposed)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", annotation, err)
+	}
+	container.Env = append(container.Env, corev1.EnvVar{Name: env, Value: string(encoded)})
+	return nil
+}
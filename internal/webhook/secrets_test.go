@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestConfigureExposedSecrets(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantEnv string
+		wantErr string
+	}{
+		{name: "not set"},
+		{name: "all keys", value: "db-creds", wantEnv: `{"db-creds":[]}`},
+		{name: "keys", value: "db-creds/username, db-creds/password,api-key", wantEnv: `{"api-key":[],"db-creds":["username","password"]}`},
+		{name: "all keys win", value: "db-creds/username,db-creds", wantEnv: `{"db-creds":[]}`},
+		{name: "invalid name", value: "DB_Creds", wantErr: "invalid"},
+		{name: "invalid key", value: "db-creds/a:b", wantErr: "invalid"},
+		{name: "nested key", value: "db-creds/a/b", wantErr: "invalid"},
+		{name: "empty list", value: " , ", wantErr: "no objects"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var container corev1.Container
+			err := configureExposedSecrets(&container, map[string]string{AnnotationExposeSecrets: tt.value})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("configureExposedSecrets() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("configureExposedSecrets() error = %v", err)
+			}
+			var got string
+			for _, e := range container.Env {
+				if e.Name == "IMDS_EXPOSE_SECRETS" {
+					got = e.Value
+				}
+			}
+			if got != tt.wantEnv {
+				t.Errorf("IMDS_EXPOSE_SECRETS = %q, want %q", got, tt.wantEnv)
+			}
+		})
+	}
+}
+
+func TestConfigureExposedConfigMaps(t *testing.T) {
+	var container corev1.Container
+	err := configureExposedConfigMaps(&container, map[string]string{AnnotationExposeConfigMaps: "app-config/settings.yaml,feature-flags"})
+	if err != nil {
+		t.Fatalf("configureExposedConfigMaps() error = %v", err)
+	}
+	want := corev1.EnvVar{Name: "IMDS_EXPOSE_CONFIGMAPS", Value: `{"app-config":["settings.yaml"],"feature-flags":[]}`}
+	if len(container.Env) != 1 || container.Env[0] != want {
+		t.Errorf("env = %v, want %v", container.Env, want)
+	}
+}
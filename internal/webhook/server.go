@@ -4,12 +4,17 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -27,23 +32,53 @@ func init() {
 	_ = admissionv1.AddToScheme(scheme)
 }
 
+// Audit annotations set in dry-run mode. The API server prefixes them with
+// the webhook name, e.g. imds.kubevirt.io/dry-run-patch.
+const (
+	AuditAnnotationDryRunPatch = "dry-run-patch"
+	AuditAnnotationDryRunError = "dry-run-error"
+)
+
 // Server is the webhook HTTP server
 type Server struct {
-	mutator    *Mutator
+	mutator    atomic.Pointer[Mutator]
 	listenAddr string
 	certFile   string
 	keyFile    string
+	cert       atomic.Pointer[tls.Certificate]
+	metrics    admissionMetrics
+	tracer     trace.Tracer
 	server     *http.Server
 }
 
 // NewServer creates a new webhook server
 func NewServer(mutator *Mutator, listenAddr, certFile, keyFile string) *Server {
-	return &Server{
-		mutator:    mutator,
+	s := &Server{
 		listenAddr: listenAddr,
 		certFile:   certFile,
 		keyFile:    keyFile,
+		tracer:     noopTracer,
 	}
+	s.mutator.Store(mutator)
+	return s
+}
+
+// SetMutator replaces the mutator used for subsequent admission requests.
+// Requests already being processed finish with the previous one.
+func (s *Server) SetMutator(mutator *Mutator) {
+	s.mutator.Store(mutator)
+}
+
+// SetCertificate replaces the serving certificate. Once set, the certificate
+// files are no longer read.
+func (s *Server) SetCertificate(cert tls.Certificate) {
+	s.cert.Store(&cert)
+}
+
+// SetTracerProvider enables tracing of admission requests. It must be
+// called before Run.
+func (s *Server) SetTracerProvider(provider trace.TracerProvider) {
+	s.tracer = provider.Tracer(tracingScope)
 }
 
 // Run starts the webhook server
@@ -51,18 +86,24 @@ func (s *Server) Run(ctx context.Context) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/mutate", s.handleMutate)
 	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.Handle("/metrics", &s.metrics)
 
-	// Load TLS cert
-	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
-	if err != nil {
-		return fmt.Errorf("failed to load TLS cert: %w", err)
+	// Load TLS cert, unless one was set directly
+	if s.cert.Load() == nil {
+		cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS cert: %w", err)
+		}
+		s.SetCertificate(cert)
 	}
 
 	s.server = &http.Server{
 		Addr:    s.listenAddr,
 		Handler: mux,
 		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{cert},
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return s.cert.Load(), nil
+			},
 		},
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
@@ -98,10 +139,18 @@ func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
 
 // handleMutate handles admission review requests
 func (s *Server) handleMutate(w http.ResponseWriter, r *http.Request) {
+	// Join the API server's trace, if it propagated one
+	ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := s.tracer.Start(ctx, "admission", trace.WithSpanKind(trace.SpanKindServer))
+	// Requests rejected before processing are recorded on this span
+	var spanErr error
+	defer func() { endSpan(span, spanErr) }()
+
 	// Read body
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Printf("Failed to read request body: %v", err)
+		spanErr = err
 		http.Error(w, "failed to read body", http.StatusBadRequest)
 		return
 	}
@@ -110,12 +159,24 @@ func (s *Server) handleMutate(w http.ResponseWriter, r *http.Request) {
 	var admissionReview admissionv1.AdmissionReview
 	if _, _, err := codecs.UniversalDeserializer().Decode(body, nil, &admissionReview); err != nil {
 		log.Printf("Failed to decode admission review: %v", err)
+		spanErr = fmt.Errorf("failed to decode admission review: %w", err)
 		http.Error(w, "failed to decode admission review", http.StatusBadRequest)
 		return
 	}
 
+	if admissionReview.Request == nil {
+		spanErr = errors.New("admission review has no request")
+		http.Error(w, "admission review has no request", http.StatusBadRequest)
+		return
+	}
+	span.SetAttributes(
+		attribute.String(AttributeAdmissionUID, string(admissionReview.Request.UID)),
+		attribute.String(AttributeOperation, string(admissionReview.Request.Operation)),
+		attribute.String(AttributeNamespace, admissionReview.Request.Namespace),
+	)
+
 	// Process the request
-	response := s.processAdmission(admissionReview.Request)
+	response := s.processAdmission(ctx, admissionReview.Request)
 
 	// Build response
 	admissionReview.Response = response
@@ -125,6 +186,7 @@ func (s *Server) handleMutate(w http.ResponseWriter, r *http.Request) {
 	respBytes, err := json.Marshal(admissionReview)
 	if err != nil {
 		log.Printf("Failed to encode admission review response: %v", err)
+		spanErr = err
 		http.Error(w, "failed to encode response", http.StatusInternalServerError)
 		return
 	}
@@ -133,16 +195,49 @@ func (s *Server) handleMutate(w http.ResponseWriter, r *http.Request) {
 	w.Write(respBytes)
 }
 
+// processUpdate handles a pod UPDATE request.
+func (s *Server) processUpdate(mutator *Mutator, pod *corev1.Pod) *admissionv1.AdmissionResponse {
+	patches := mutator.MutateUpdate(pod)
+	if len(patches) == 0 || mutator.DryRun() {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	patchBytes, err := CreatePatch(patches)
+	if err != nil {
+		// Never block an update over a missing marker annotation
+		log.Printf("Failed to create update patch for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	log.Printf("Restoring %s on pod %s/%s", AnnotationInjected, pod.Namespace, pod.Name)
+	patchType := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patchBytes,
+		PatchType: &patchType,
+	}
+}
+
+// startSpan starts a span for one step of an admission request, tagged with
+// the request's UID.
+func (s *Server) startSpan(ctx context.Context, name string, req *admissionv1.AdmissionRequest) trace.Span {
+	_, span := s.tracer.Start(ctx, name, trace.WithAttributes(attribute.String(AttributeAdmissionUID, string(req.UID))))
+	return span
+}
+
 // processAdmission processes an admission request
-func (s *Server) processAdmission(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
-	// Only handle Pod creation
-	if req.Kind.Kind != "Pod" {
+func (s *Server) processAdmission(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	// Only handle Pod creation and updates
+	if req.Kind.Kind != "Pod" || (req.Operation != admissionv1.Create && req.Operation != admissionv1.Update) {
 		return &admissionv1.AdmissionResponse{Allowed: true}
 	}
 
 	// Decode pod
 	var pod corev1.Pod
-	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+	span := s.startSpan(ctx, "decode", req)
+	err := json.Unmarshal(req.Object.Raw, &pod)
+	endSpan(span, err)
+	if err != nil {
 		log.Printf("Failed to decode pod: %v", err)
 		return &admissionv1.AdmissionResponse{
 			Allowed: false,
@@ -152,18 +247,69 @@ func (s *Server) processAdmission(req *admissionv1.AdmissionRequest) *admissionv
 		}
 	}
 
+	// The pod's namespace may be unset on create; the request always has it
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+
+	mutator := s.mutator.Load()
+
+	// Updates can't add containers; at most they restore the injected
+	// annotation
+	if req.Operation == admissionv1.Update {
+		return s.processUpdate(mutator, &pod)
+	}
 	// Check if we should mutate
-	if !s.mutator.ShouldMutate(&pod) {
+	span = s.startSpan(ctx, "ShouldMutate", req)
+	shouldMutate := mutator.ShouldMutate(&pod)
+	span.End()
+	if !shouldMutate {
 		log.Printf("Pod %s/%s does not need IMDS injection", pod.Namespace, pod.Name)
-		return &admissionv1.AdmissionResponse{Allowed: true}
+		s.metrics.record(resultSkipped)
+		// Tell the user, in kubectl's output, when IMDS was likely wanted
+		var warnings []string
+		for _, warning := range mutator.SkipWarnings(&pod) {
+			warnings = append(warnings, "IMDS sidecar not injected: "+warning)
+		}
+		return &admissionv1.AdmissionResponse{Allowed: true, Warnings: warnings}
+	}
+
+	// A pod that only borrows KubeVirt's labels is left alone rather than
+	// rejected; it isn't a VM the sidecar could serve
+	if err := ValidateLauncherPod(&pod); err != nil {
+		log.Printf("Skipping IMDS injection for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		s.metrics.record(resultSkipped)
+		return &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{fmt.Sprintf("IMDS sidecar not injected: %v", err)},
+		}
 	}
 
 	log.Printf("Mutating pod %s/%s for IMDS injection", pod.Namespace, pod.Name)
 
 	// Get patches
-	patches, err := s.mutator.Mutate(&pod)
+	span = s.startSpan(ctx, "Mutate", req)
+	patches, err := mutator.Mutate(&pod)
+	endSpan(span, err)
+	var podSecurityErr *PodSecurityError
+	if errors.As(err, &podSecurityErr) && mutator.PodSecuritySkip() {
+		log.Printf("Skipping IMDS injection for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		s.metrics.record(resultSkipped)
+		return &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{fmt.Sprintf("IMDS sidecar not injected: %v", err)},
+		}
+	}
 	if err != nil {
 		log.Printf("Failed to mutate pod: %v", err)
+		s.metrics.record(resultError)
+		if mutator.DryRun() {
+			// Nothing would be injected, so don't block the pod
+			return &admissionv1.AdmissionResponse{
+				Allowed:          true,
+				AuditAnnotations: map[string]string{AuditAnnotationDryRunError: err.Error()},
+			}
+		}
 		return &admissionv1.AdmissionResponse{
 			Allowed: false,
 			Result: &metav1.Status{
@@ -173,9 +319,12 @@ func (s *Server) processAdmission(req *admissionv1.AdmissionRequest) *admissionv
 	}
 
 	// Create patch bytes
+	span = s.startSpan(ctx, "CreatePatch", req)
 	patchBytes, err := CreatePatch(patches)
+	endSpan(span, err)
 	if err != nil {
 		log.Printf("Failed to create patch: %v", err)
+		s.metrics.record(resultError)
 		return &admissionv1.AdmissionResponse{
 			Allowed: false,
 			Result: &metav1.Status{
@@ -184,7 +333,18 @@ func (s *Server) processAdmission(req *admissionv1.AdmissionRequest) *admissionv
 		}
 	}
 
+	// In dry-run mode the patch is only logged and recorded in the audit log
+	if mutator.DryRun() {
+		log.Printf("Dry run: would patch pod %s/%s: %s", pod.Namespace, pod.Name, string(patchBytes))
+		s.metrics.record(resultDryRun)
+		return &admissionv1.AdmissionResponse{
+			Allowed:          true,
+			AuditAnnotations: map[string]string{AuditAnnotationDryRunPatch: string(patchBytes)},
+		}
+	}
+
 	log.Printf("Generated patch for pod %s/%s: %s", pod.Namespace, pod.Name, string(patchBytes))
+	s.metrics.record(resultMutated)
 
 	patchType := admissionv1.PatchTypeJSONPatch
 	return &admissionv1.AdmissionResponse{
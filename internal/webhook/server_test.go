@@ -0,0 +1,261 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func launcherPod(annotations map[string]string, containers ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "virt-launcher-test-vm",
+			Labels: map[string]string{
+				"kubevirt.io/domain":   "test-vm",
+				LauncherLabel:          LauncherLabelValue,
+				LauncherCreatedByLabel: "8d1ecd35-2f4b-4c6a-9c37-3f1b8a4d2e10",
+			},
+			Annotations: annotations,
+		},
+	}
+	for _, name := range launcherVolumes {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: name})
+	}
+	for _, name := range append([]string{ComputeContainerName}, containers...) {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name})
+	}
+	return pod
+}
+
+func admissionRequest(t *testing.T, operation admissionv1.Operation, pod *corev1.Pod) *admissionv1.AdmissionRequest {
+	t.Helper()
+	req := &admissionv1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Operation: operation,
+		Namespace: "test-ns",
+	}
+	if pod != nil {
+		raw, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatalf("Marshal() error = %v", err)
+		}
+		req.Object = runtime.RawExtension{Raw: raw}
+	}
+	return req
+}
+
+func TestProcessAdmissionDryRun(t *testing.T) {
+	tests := []struct {
+		name        string
+		dryRun      bool
+		annotations map[string]string
+		wantPatch   bool
+		wantAllowed bool
+		wantAudit   string
+		wantMetric  string
+	}{
+		{
+			name:        "mutated",
+			annotations: map[string]string{AnnotationEnabled: "true"},
+			wantPatch:   true,
+			wantAllowed: true,
+			wantMetric:  `imds_webhook_admissions_total{result="mutated"} 1`,
+		},
+		{
+			name:        "dry run",
+			dryRun:      true,
+			annotations: map[string]string{AnnotationEnabled: "true"},
+			wantAllowed: true,
+			wantAudit:   AuditAnnotationDryRunPatch,
+			wantMetric:  `imds_webhook_admissions_total{result="dry_run"} 1`,
+		},
+		{
+			name:        "dry run skipped",
+			dryRun:      true,
+			annotations: map[string]string{AnnotationEnabled: "false"},
+			wantAllowed: true,
+			wantMetric:  `imds_webhook_admissions_total{result="skipped"} 1`,
+		},
+		{
+			name:        "mutation error",
+			annotations: map[string]string{AnnotationEnabled: "true", AnnotationVLAN: "5000"},
+			wantMetric:  `imds_webhook_admissions_total{result="error"} 1`,
+		},
+		{
+			name:        "dry run mutation error is allowed",
+			dryRun:      true,
+			annotations: map[string]string{AnnotationEnabled: "true", AnnotationVLAN: "5000"},
+			wantAllowed: true,
+			wantAudit:   AuditAnnotationDryRunError,
+			wantMetric:  `imds_webhook_admissions_total{result="error"} 1`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(NewMutator(Config{IMDSImage: "test-image:latest", DryRun: tt.dryRun}), ":0", "", "")
+
+			resp := server.processAdmission(context.Background(), admissionRequest(t, admissionv1.Create, launcherPod(tt.annotations)))
+			if resp.Allowed != tt.wantAllowed {
+				t.Errorf("Allowed = %v, want %v", resp.Allowed, tt.wantAllowed)
+			}
+			if gotPatch := len(resp.Patch) > 0; gotPatch != tt.wantPatch {
+				t.Errorf("patch returned = %v, want %v", gotPatch, tt.wantPatch)
+			}
+			if tt.wantAudit != "" && resp.AuditAnnotations[tt.wantAudit] == "" {
+				t.Errorf("AuditAnnotations = %v, want %s", resp.AuditAnnotations, tt.wantAudit)
+			}
+			if tt.wantAudit == "" && len(resp.AuditAnnotations) > 0 {
+				t.Errorf("AuditAnnotations = %v, want none", resp.AuditAnnotations)
+			}
+
+			rec := httptest.NewRecorder()
+			server.metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+			if !strings.Contains(rec.Body.String(), tt.wantMetric) {
+				t.Errorf("metrics = %q, want %q", rec.Body.String(), tt.wantMetric)
+			}
+		})
+	}
+}
+
+func TestProcessAdmissionOperations(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation admissionv1.Operation
+		pod       *corev1.Pod
+		wantPatch []PatchOperation
+	}{
+		{
+			name:      "reinvocation after injection",
+			operation: admissionv1.Create,
+			pod:       launcherPod(map[string]string{AnnotationEnabled: "true"}, ContainerName),
+		},
+		{
+			name:      "update restores injected annotation",
+			operation: admissionv1.Update,
+			pod:       launcherPod(map[string]string{AnnotationEnabled: "true"}, ContainerName),
+			wantPatch: []PatchOperation{{Op: "add", Path: "/metadata/annotations/imds.kubevirt.io~1injected", Value: "true"}},
+		},
+		{
+			name:      "update of injected pod",
+			operation: admissionv1.Update,
+			pod:       launcherPod(map[string]string{AnnotationEnabled: "true", AnnotationInjected: "true"}, ContainerName),
+		},
+		{
+			name:      "update never injects",
+			operation: admissionv1.Update,
+			pod:       launcherPod(map[string]string{AnnotationEnabled: "true"}),
+		},
+		{
+			name:      "delete without object",
+			operation: admissionv1.Delete,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(NewMutator(Config{IMDSImage: "test-image:latest"}), ":0", "", "")
+
+			resp := server.processAdmission(context.Background(), admissionRequest(t, tt.operation, tt.pod))
+			if !resp.Allowed {
+				t.Fatalf("Allowed = false: %v", resp.Result)
+			}
+			if tt.wantPatch == nil {
+				if len(resp.Patch) > 0 {
+					t.Errorf("Patch = %s, want none", resp.Patch)
+				}
+				return
+			}
+			want, err := CreatePatch(tt.wantPatch)
+			if err != nil {
+				t.Fatalf("CreatePatch() error = %v", err)
+			}
+			if string(resp.Patch) != string(want) {
+				t.Errorf("Patch = %s, want %s", resp.Patch, want)
+			}
+		})
+	}
+}
+
+func TestProcessAdmissionSkipWarnings(t *testing.T) {
+	server := NewServer(NewMutator(Config{IMDSImage: "test-image:latest"}), ":0", "", "")
+
+	resp := server.processAdmission(context.Background(), admissionRequest(t, admissionv1.Create, launcherPod(map[string]string{AnnotationEnabled: "yes"})))
+	if !resp.Allowed {
+		t.Fatalf("Allowed = false: %v", resp.Result)
+	}
+	if len(resp.Patch) > 0 {
+		t.Errorf("Patch = %s, want none", resp.Patch)
+	}
+	if len(resp.Warnings) != 1 || !strings.HasPrefix(resp.Warnings[0], "IMDS sidecar not injected: ") {
+		t.Errorf("Warnings = %v, want one explaining the skip", resp.Warnings)
+	}
+}
+
+func TestProcessAdmissionNotLauncherPod(t *testing.T) {
+	server := NewServer(NewMutator(Config{IMDSImage: "test-image:latest"}), ":0", "", "")
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "lookalike",
+			Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+			Annotations: map[string]string{AnnotationEnabled: "true"},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	resp := server.processAdmission(context.Background(), admissionRequest(t, admissionv1.Create, pod))
+	if !resp.Allowed {
+		t.Fatalf("Allowed = false: %v", resp.Result)
+	}
+	if len(resp.Patch) > 0 {
+		t.Errorf("Patch = %s, want none", resp.Patch)
+	}
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], `container "compute"`) {
+		t.Errorf("Warnings = %v, want one naming the missing compute container", resp.Warnings)
+	}
+}
+
+func TestProcessAdmissionPodSecurity(t *testing.T) {
+	tests := []struct {
+		name        string
+		action      string
+		wantAllowed bool
+		wantWarning bool
+	}{
+		{name: "deny", action: PodSecurityDeny},
+		{name: "skip", action: PodSecuritySkip, wantAllowed: true, wantWarning: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServer(NewMutator(Config{
+				IMDSImage:   "test-image:latest",
+				PodSecurity: tt.action,
+				NamespaceLabels: func(string) (map[string]string, error) {
+					return map[string]string{PodSecurityEnforceLabel: LevelBaseline}, nil
+				},
+			}), ":0", "", "")
+
+			resp := server.processAdmission(context.Background(), admissionRequest(t, admissionv1.Create, launcherPod(map[string]string{AnnotationEnabled: "true"})))
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("Allowed = %v, want %v: %v", resp.Allowed, tt.wantAllowed, resp.Result)
+			}
+			if len(resp.Patch) > 0 {
+				t.Errorf("Patch = %s, want none", resp.Patch)
+			}
+			if !tt.wantAllowed && !strings.Contains(resp.Result.Message, "baseline Pod Security Standard") {
+				t.Errorf("Message = %q, want it to explain the Pod Security conflict", resp.Result.Message)
+			}
+			if hasWarning := len(resp.Warnings) == 1 && strings.Contains(resp.Warnings[0], "NET_ADMIN"); hasWarning != tt.wantWarning {
+				t.Errorf("Warnings = %v, want warning %v", resp.Warnings, tt.wantWarning)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package webhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// SSHCAVolumeName is the volume holding the SSH CA private key
+	SSHCAVolumeName = "imds-ssh-ca"
+	// SSHCAMountPath is where the SSH CA private key is mounted
+	SSHCAMountPath = "/var/run/imds/ssh-ca"
+	// DefaultSSHCAKey is the Secret key read when the reference names none
+	DefaultSSHCAKey = "ca"
+)
+
+// sshCAVolume returns the volume for the Secret referenced by
+// AnnotationSSHCASecret as "<name>" or "<name>/<key>", or nil if the
+// annotation isn't set.
+func sshCAVolume(annotations map[string]string) (*corev1.Volume, error) {
+	ref := annotations[AnnotationSSHCASecret]
+	if ref == "" {
+		return nil, nil
+	}
+
+	name, key, found := strings.Cut(ref, "/")
+	if !found {
+		key = DefaultSSHCAKey
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s %q: %s", AnnotationSSHCASecret, ref, strings.Join(errs, "; "))
+	}
+	if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s %q: %s", AnnotationSSHCASecret, ref, strings.Join(errs, "; "))
+	}
+
+	// Only the sidecar's user may read the key
+	mode := int32(0400)
+	return &corev1.Volume{
+		Name: SSHCAVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName:  name,
+				Items:       []corev1.KeyToPath{{Key: key, Path: "ca"}},
+				DefaultMode: &mode,
+			},
+		},
+	}, nil
+}
+
+// configureSSHCA mounts the SSH CA volume and has the sidecar sign SSH keys
+// with it.
+func configureSSHCA(container *corev1.Container) {
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      SSHCAVolumeName,
+		MountPath: SSHCAMountPath,
+		ReadOnly:  true,
+	})
+	container.Env = append(container.Env,
+		corev1.EnvVar{Name: "IMDS_SSH_SIGNER", Value: "file"},
+		corev1.EnvVar{Name: "IMDS_SSH_CA_KEY", Value: SSHCAMountPath + "/ca"},
+	)
+}
@@ -0,0 +1,85 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSSHCAVolume(t *testing.T) {
+	tests := []struct {
+		name       string
+		ref        string
+		wantSecret string
+		wantKey    string
+		wantErr    bool
+	}{
+		{name: "not set"},
+		{name: "default key", ref: "vm-ssh-ca", wantSecret: "vm-ssh-ca", wantKey: "ca"},
+		{name: "explicit key", ref: "vm-ssh-ca/id_ed25519", wantSecret: "vm-ssh-ca", wantKey: "id_ed25519"},
+		{name: "invalid name", ref: "VM_CA", wantErr: true},
+		{name: "invalid key", ref: "vm-ssh-ca/a:b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volume, err := sshCAVolume(map[string]string{AnnotationSSHCASecret: tt.ref})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sshCAVolume() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantSecret == "" {
+				if volume != nil {
+					t.Errorf("sshCAVolume() = %v, want nil", volume)
+				}
+				return
+			}
+			if volume.Secret == nil || volume.Secret.SecretName != tt.wantSecret || volume.Secret.Items[0].Key != tt.wantKey {
+				t.Errorf("sshCAVolume() = %+v, want Secret %s key %s", volume.VolumeSource, tt.wantSecret, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestMutateSSHCA(t *testing.T) {
+	mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test-ns",
+			Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+			Annotations: map[string]string{AnnotationEnabled: "true", AnnotationSSHCASecret: "vm-ssh-ca"},
+		},
+	}
+
+	patches, err := mutator.Mutate(pod)
+	if err != nil {
+		t.Fatalf("Mutate() error = %v", err)
+	}
+
+	var mounted bool
+	for _, patch := range patches {
+		if strings.HasPrefix(patch.Path, "/spec/volumes") {
+			if volumes, ok := patch.Value.([]corev1.Volume); ok {
+				for _, v := range volumes {
+					mounted = mounted || v.Name == SSHCAVolumeName
+				}
+			}
+			if v, ok := patch.Value.(corev1.Volume); ok {
+				mounted = mounted || v.Name == SSHCAVolumeName
+			}
+		}
+	}
+	if !mounted {
+		t.Errorf("no %s volume in patches %v", SSHCAVolumeName, patches)
+	}
+
+	container := patches[1].Value.(corev1.Container)
+	env := map[string]string{}
+	for _, e := range container.Env {
+		env[e.Name] = e.Value
+	}
+	if env["IMDS_SSH_SIGNER"] != "file" || env["IMDS_SSH_CA_KEY"] != SSHCAMountPath+"/ca" {
+		t.Errorf("env = %v", env)
+	}
+}
@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// TLSVolumeName is the volume holding the HTTPS listener's certificate
+	TLSVolumeName = "imds-tls"
+	// TLSMountPath is where the HTTPS listener's certificate is mounted
+	TLSMountPath = "/var/run/imds/tls"
+	// CertManagerCSIDriver is cert-manager's CSI driver, which issues a
+	// certificate for each pod and renews it before it expires
+	CertManagerCSIDriver = "csi.cert-manager.io"
+)
+
+// Addresses and hostnames guests reach IMDS at, as the sidecar serves them
+const (
+	imdsAddress   = "169.254.169.254"
+	imdsAddressV6 = "fd00:ec2::254"
+)
+
+var metadataDNSNames = []string{"metadata.internal", "metadata.google.internal"}
+
+// tlsVolume returns a cert-manager CSI volume for the issuer in
+// AnnotationTLSIssuer, or nil if the annotation isn't set. The certificate
+// is for the IMDS addresses and hostnames the VM is configured with.
+func tlsVolume(annotations map[string]string) (*corev1.Volume, error) {
+	ref := annotations[AnnotationTLSIssuer]
+	if ref == "" {
+		return nil, nil
+	}
+	kind, name, err := ParseIssuer(ref)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %w", AnnotationTLSIssuer, ref, err)
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return nil, fmt.Errorf("invalid %s %q: %s", AnnotationTLSIssuer, ref, strings.Join(errs, "; "))
+	}
+
+	ips := []string{imdsAddress}
+	if host, _, err := net.SplitHostPort(annotations[AnnotationListenAddr]); err == nil && host != "" {
+		ips[0] = host
+	}
+	if annotations[AnnotationIPv6Enabled] == "true" {
+		ips = append(ips, imdsAddressV6)
+	}
+	dnsNames := append([]string{}, metadataDNSNames...)
+	if name := strings.TrimSuffix(annotations[AnnotationDNSName], "."); name != "" {
+		dnsNames = append(dnsNames, name)
+	}
+
+	readOnly := true
+	return &corev1.Volume{
+		Name: TLSVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			CSI: &corev1.CSIVolumeSource{
+				Driver:   CertManagerCSIDriver,
+				ReadOnly: &readOnly,
+				VolumeAttributes: map[string]string{
+					"csi.cert-manager.io/issuer-name": name,
+					"csi.cert-manager.io/issuer-kind": kind,
+					"csi.cert-manager.io/common-name": dnsNames[0],
+					"csi.cert-manager.io/dns-names":   strings.Join(dnsNames, ","),
+					"csi.cert-manager.io/ip-sans":     strings.Join(ips, ","),
+					"csi.cert-manager.io/key-usages":  "server auth,digital signature,key encipherment",
+				},
+			},
+		},
+	}, nil
+}
+
+// configureTLS mounts the certificate and has the sidecar also serve HTTPS.
+func configureTLS(container *corev1.Container) {
+	container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+		Name:      TLSVolumeName,
+		MountPath: TLSMountPath,
+		ReadOnly:  true,
+	})
+	container.Env = append(container.Env, corev1.EnvVar{Name: "IMDS_TLS_DIR", Value: TLSMountPath})
+}
@@ -0,0 +1,115 @@
+package webhook
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTLSVolume(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantKind    string
+		wantIssuer  string
+		wantIPs     string
+		wantDNS     string
+		wantErr     bool
+	}{
+		{name: "not set", annotations: map[string]string{}},
+		{
+			name:        "issuer",
+			annotations: map[string]string{AnnotationTLSIssuer: "imds-ca"},
+			wantKind:    IssuerKind,
+			wantIssuer:  "imds-ca",
+			wantIPs:     "169.254.169.254",
+			wantDNS:     "metadata.internal,metadata.google.internal",
+		},
+		{
+			name: "cluster issuer with IPv6, hostname and listen address",
+			annotations: map[string]string{
+				AnnotationTLSIssuer:   "ClusterIssuer/imds-ca",
+				AnnotationIPv6Enabled: "true",
+				AnnotationDNSName:     "metadata.example.com.",
+				AnnotationListenAddr:  "169.254.170.2:80",
+			},
+			wantKind:   ClusterIssuerKind,
+			wantIssuer: "imds-ca",
+			wantIPs:    "169.254.170.2,fd00:ec2::254",
+			wantDNS:    "metadata.internal,metadata.google.internal,metadata.example.com",
+		},
+		{
+			name:        "port-only listen address",
+			annotations: map[string]string{AnnotationTLSIssuer: "imds-ca", AnnotationListenAddr: ":8080"},
+			wantKind:    IssuerKind,
+			wantIssuer:  "imds-ca",
+			wantIPs:     "169.254.169.254",
+			wantDNS:     "metadata.internal,metadata.google.internal",
+		},
+		{name: "invalid kind", annotations: map[string]string{AnnotationTLSIssuer: "Vault/imds-ca"}, wantErr: true},
+		{name: "invalid name", annotations: map[string]string{AnnotationTLSIssuer: "Issuer/IMDS_CA"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volume, err := tlsVolume(tt.annotations)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tlsVolume() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantIssuer == "" {
+				if volume != nil {
+					t.Errorf("tlsVolume() = %v, want nil", volume)
+				}
+				return
+			}
+			if volume.CSI == nil || volume.CSI.Driver != CertManagerCSIDriver {
+				t.Fatalf("tlsVolume() = %+v, want a %s volume", volume.VolumeSource, CertManagerCSIDriver)
+			}
+			attrs := volume.CSI.VolumeAttributes
+			if attrs["csi.cert-manager.io/issuer-kind"] != tt.wantKind || attrs["csi.cert-manager.io/issuer-name"] != tt.wantIssuer {
+				t.Errorf("issuer = %s/%s, want %s/%s", attrs["csi.cert-manager.io/issuer-kind"], attrs["csi.cert-manager.io/issuer-name"], tt.wantKind, tt.wantIssuer)
+			}
+			if attrs["csi.cert-manager.io/ip-sans"] != tt.wantIPs {
+				t.Errorf("ip-sans = %q, want %q", attrs["csi.cert-manager.io/ip-sans"], tt.wantIPs)
+			}
+			if attrs["csi.cert-manager.io/dns-names"] != tt.wantDNS {
+				t.Errorf("dns-names = %q, want %q", attrs["csi.cert-manager.io/dns-names"], tt.wantDNS)
+			}
+		})
+	}
+}
+
+func TestMutateTLS(t *testing.T) {
+	mutator := NewMutator(Config{IMDSImage: "test-image:latest"})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "test-ns",
+			Labels:      map[string]string{"kubevirt.io/domain": "test-vm"},
+			Annotations: map[string]string{AnnotationEnabled: "true", AnnotationTLSIssuer: "ClusterIssuer/imds-ca"},
+		},
+	}
+
+	patches, err := mutator.Mutate(pod)
+	if err != nil {
+		t.Fatalf("Mutate() error = %v", err)
+	}
+
+	container := patches[1].Value.(corev1.Container)
+	var mounted bool
+	for _, m := range container.VolumeMounts {
+		mounted = mounted || (m.Name == TLSVolumeName && m.MountPath == TLSMountPath)
+	}
+	if !mounted {
+		t.Errorf("no %s mount in %v", TLSVolumeName, container.VolumeMounts)
+	}
+	var env string
+	for _, e := range container.Env {
+		if e.Name == "IMDS_TLS_DIR" {
+			env = e.Value
+		}
+	}
+	if env != TLSMountPath {
+		t.Errorf("IMDS_TLS_DIR = %q, want %q", env, TLSMountPath)
+	}
+}
@@ -0,0 +1,62 @@
+package webhook
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// configureTokenExchange points the sidecar at the STS named in
+// AnnotationTokenExchangeURL, which enables POST /v1/token/exchange for the
+// targets in AnnotationTokenExchangeTargets. A subject audience must be one
+// of the projected audiences.
+func configureTokenExchange(container *corev1.Container, annotations map[string]string, audiences []tokenAudience) error {
+	stsURL := annotations[AnnotationTokenExchangeURL]
+	targets := annotations[AnnotationTokenExchangeTargets]
+	subject := annotations[AnnotationTokenExchangeSubjectAudience]
+	if stsURL == "" {
+		for _, annotation := range []string{AnnotationTokenExchangeTargets, AnnotationTokenExchangeSubjectAudience} {
+			if annotations[annotation] != "" {
+				return fmt.Errorf("%s is set without %s", annotation, AnnotationTokenExchangeURL)
+			}
+		}
+		return nil
+	}
+	if u, err := url.Parse(stsURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid %s %q: must be an https URL", AnnotationTokenExchangeURL, stsURL)
+	}
+
+	var allowed []string
+	for _, target := range strings.Split(targets, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			allowed = append(allowed, target)
+		}
+	}
+	if len(allowed) == 0 {
+		return fmt.Errorf("%s requires %s", AnnotationTokenExchangeURL, AnnotationTokenExchangeTargets)
+	}
+
+	container.Env = append(container.Env,
+		corev1.EnvVar{Name: "IMDS_TOKEN_EXCHANGE_URL", Value: stsURL},
+		corev1.EnvVar{Name: "IMDS_TOKEN_EXCHANGE_TARGETS", Value: strings.Join(allowed, ",")},
+	)
+	if subject != "" {
+		if !hasTokenAudience(audiences, subject) {
+			return fmt.Errorf("%s %q is not listed in %s", AnnotationTokenExchangeSubjectAudience, subject, AnnotationTokenAudience)
+		}
+		container.Env = append(container.Env, corev1.EnvVar{Name: "IMDS_TOKEN_EXCHANGE_SUBJECT_AUDIENCE", Value: subject})
+	}
+	return nil
+}
+
+// hasTokenAudience reports whether audience is projected.
+func hasTokenAudience(audiences []tokenAudience, audience string) bool {
+	for _, a := range audiences {
+		if a.audience == audience {
+			return true
+		}
+	}
+	return false
+}
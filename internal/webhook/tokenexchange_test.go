@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestConfigureTokenExchange(t *testing.T) {
+	const sts = "https://sts.example.com/token"
+	audiences := []tokenAudience{{name: "sts", audience: "sts.example.com"}}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantEnv     []corev1.EnvVar
+		wantErr     string
+	}{
+		{name: "not requested"},
+		{
+			name:        "targets",
+			annotations: map[string]string{AnnotationTokenExchangeURL: sts, AnnotationTokenExchangeTargets: "https://api.example.com, vault "},
+			wantEnv: []corev1.EnvVar{
+				{Name: "IMDS_TOKEN_EXCHANGE_URL", Value: sts},
+				{Name: "IMDS_TOKEN_EXCHANGE_TARGETS", Value: "https://api.example.com,vault"},
+			},
+		},
+		{
+			name:        "subject audience",
+			annotations: map[string]string{AnnotationTokenExchangeURL: sts, AnnotationTokenExchangeTargets: "vault", AnnotationTokenExchangeSubjectAudience: "sts.example.com"},
+			wantEnv: []corev1.EnvVar{
+				{Name: "IMDS_TOKEN_EXCHANGE_URL", Value: sts},
+				{Name: "IMDS_TOKEN_EXCHANGE_TARGETS", Value: "vault"},
+				{Name: "IMDS_TOKEN_EXCHANGE_SUBJECT_AUDIENCE", Value: "sts.example.com"},
+			},
+		},
+		{name: "plain http", annotations: map[string]string{AnnotationTokenExchangeURL: "http://sts.example.com/token", AnnotationTokenExchangeTargets: "vault"}, wantErr: "https URL"},
+		{name: "no targets", annotations: map[string]string{AnnotationTokenExchangeURL: sts, AnnotationTokenExchangeTargets: " , "}, wantErr: "requires"},
+		{name: "subject audience not projected", annotations: map[string]string{AnnotationTokenExchangeURL: sts, AnnotationTokenExchangeTargets: "vault", AnnotationTokenExchangeSubjectAudience: "other"}, wantErr: "not listed"},
+		{name: "targets without URL", annotations: map[string]string{AnnotationTokenExchangeTargets: "vault"}, wantErr: "without"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var container corev1.Container
+			err := configureTokenExchange(&container, tt.annotations, audiences)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("configureTokenExchange() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("configureTokenExchange() error = %v", err)
+			}
+			if !reflect.DeepEqual(container.Env, tt.wantEnv) {
+				t.Errorf("env = %v, want %v", container.Env, tt.wantEnv)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// Span attributes recorded on every admission span
+const (
+	AttributeAdmissionUID = "admission.uid"
+	AttributeOperation    = "admission.operation"
+	AttributeNamespace    = "k8s.namespace.name"
+)
+
+const (
+	// tracingScope is the instrumentation scope reported with the spans
+	tracingScope = "github.com/kubevirt/kubevirt-imds/internal/webhook"
+	// defaultServiceName is the service name unless OTEL_SERVICE_NAME or
+	// OTEL_RESOURCE_ATTRIBUTES set one
+	defaultServiceName = "imds-webhook"
+)
+
+// traceContext reads the W3C traceparent and tracestate headers sent by API
+// servers with tracing enabled
+var traceContext = propagation.TraceContext{}
+
+// noopTracer records nothing, for servers without tracing
+var noopTracer = noop.NewTracerProvider().Tracer(tracingScope)
+
+// TracingEnabled reports whether the standard OpenTelemetry environment
+// configures an OTLP endpoint for traces.
+func TracingEnabled() bool {
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// NewTracerProvider creates a TracerProvider batching spans to a collector
+// over OTLP/HTTP. The exporter, batching and sampler are configured by the
+// standard OTEL_* environment variables, e.g. OTEL_EXPORTER_OTLP_ENDPOINT.
+// Shut it down to flush the spans still queued.
+func NewTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", defaultServiceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the tracing resource: %w", err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// endSpan ends span, marking it as failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
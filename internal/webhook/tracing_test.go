@@ -0,0 +1,194 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// postAdmission sends req to the server's /mutate handler with the traceparent header.
+func postAdmission(t *testing.T, server *Server, req *admissionv1.AdmissionRequest, traceparent string) {
+	t.Helper()
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  req,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	if traceparent != "" {
+		r.Header.Set("traceparent", traceparent)
+	}
+	w := httptest.NewRecorder()
+	server.handleMutate(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTracingSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	server := NewServer(NewMutator(Config{IMDSImage: "test-image:latest"}), ":0", "", "")
+	server.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	req := admissionRequest(t, admissionv1.Create, launcherPod(map[string]string{AnnotationEnabled: "true"}))
+	req.UID = "705ab4f5-6393-11e8-b7cc-42010a800002"
+	postAdmission(t, server, req, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	spans := recorder.Ended()
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name())
+		if got := span.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %s trace = %s, want the propagated trace", span.Name(), got)
+		}
+		var uid string
+		for _, attr := range span.Attributes() {
+			if string(attr.Key) == AttributeAdmissionUID {
+				uid = attr.Value.AsString()
+			}
+		}
+		if uid != string(req.UID) {
+			t.Errorf("span %s %s = %q, want %q", span.Name(), AttributeAdmissionUID, uid, req.UID)
+		}
+	}
+	want := []string{"decode", "ShouldMutate", "Mutate", "CreatePatch", "admission"}
+	if len(names) != len(want) {
+		t.Fatalf("spans = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("spans = %v, want %v", names, want)
+		}
+	}
+	admission := spans[len(spans)-1]
+	if got := admission.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("admission parent = %s, want the API server's span", got)
+	}
+	for _, span := range spans[:len(spans)-1] {
+		if span.Parent().SpanID() != admission.SpanContext().SpanID() {
+			t.Errorf("span %s parent = %s, want the admission span", span.Name(), span.Parent().SpanID())
+		}
+	}
+}
+
+func TestTracingUnsampledParent(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	server := NewServer(NewMutator(Config{IMDSImage: "test-image:latest"}), ":0", "", "")
+	server.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	req := admissionRequest(t, admissionv1.Create, launcherPod(map[string]string{AnnotationEnabled: "true"}))
+	postAdmission(t, server, req, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if spans := recorder.Ended(); len(spans) != 0 {
+		t.Errorf("recorded %d spans under an unsampled parent, want none", len(spans))
+	}
+}
+
+func TestTracingDecodeError(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	server := NewServer(NewMutator(Config{IMDSImage: "test-image:latest"}), ":0", "", "")
+	server.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader([]byte("not an admission review")))
+	w := httptest.NewRecorder()
+	server.handleMutate(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want the admission span", len(spans))
+	}
+	if got := spans[0].Status(); got.Code != codes.Error {
+		t.Errorf("status = %+v, want error", got)
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	server := NewServer(NewMutator(Config{IMDSImage: "test-image:latest"}), ":0", "", "")
+	req := admissionRequest(t, admissionv1.Create, launcherPod(map[string]string{AnnotationEnabled: "true"}))
+	postAdmission(t, server, req, "")
+}
+
+func TestEndSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(tracingScope)
+
+	_, span := tracer.Start(context.Background(), "ok")
+	endSpan(span, nil)
+	_, span = tracer.Start(context.Background(), "failed")
+	endSpan(span, errors.New("failed"))
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	if got := spans[0].Status().Code; got != codes.Unset {
+		t.Errorf("status = %v, want unset", got)
+	}
+	if got := spans[1].Status(); got.Code != codes.Error || got.Description != "failed" {
+		t.Errorf("status = %+v, want error failed", got)
+	}
+}
+
+func TestTracingEnabled(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want bool
+	}{
+		{name: "not configured"},
+		{name: "endpoint", env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://otel-collector:4318"}, want: true},
+		{name: "traces endpoint", env: map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://otel-collector:4318/v1/traces"}, want: true},
+		{name: "SDK disabled", env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://otel-collector:4318", "OTEL_SDK_DISABLED": "true"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_SDK_DISABLED"} {
+				t.Setenv(key, tt.env[key])
+			}
+			if got := TracingEnabled(); got != tt.want {
+				t.Errorf("TracingEnabled() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTracerProvider(t *testing.T) {
+	var exports atomic.Int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("path = %s, want /v1/traces", r.URL.Path)
+		}
+		exports.Add(1)
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+
+	provider, err := NewTracerProvider(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := provider.Tracer(tracingScope).Start(context.Background(), "test")
+	span.End()
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if exports.Load() == 0 {
+		t.Error("Shutdown() didn't export the queued span")
+	}
+}
@@ -0,0 +1,234 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+
+	"github.com/kubevirt/kubevirt-imds/internal/kube"
+)
+
+// vmiResync is how often the VMI cache is resynced
+const vmiResync = 10 * time.Minute
+
+// DomainLabel is the label KubeVirt sets on virt-launcher pods to the VMI name
+const DomainLabel = "kubevirt.io/domain"
+
+// errVMICacheNotSynced is returned by VMI lookups before the cache is filled
+var errVMICacheNotSynced = errors.New("VMI cache not synced yet")
+
+// VMIInfo is what the webhook reads from a VirtualMachineInstance
+type VMIInfo struct {
+	Annotations map[string]string
+	// Binding is the network binding of the interface IMDS attaches to
+	// ("bridge", "masquerade", "passt" or "macvtap"), or "" if unknown
+	Binding string
+}
+
+// VMILookup returns a Config.VMI function backed by a VMI informer. Unlike
+// NamespaceLabelLookup it doesn't wait for the cache, so the webhook still
+// starts where KubeVirt isn't installed yet; lookups fail until the cache
+// has synced. The webhook needs list and watch on virtualmachineinstances.
+func VMILookup(ctx context.Context, client dynamic.Interface) func(namespace, name string) (*VMIInfo, error) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, vmiResync)
+	informer := factory.ForResource(kube.VMIResource)
+	// Only the metadata and network interfaces are read; dropping the rest
+	// keeps the cache small
+	_ = informer.Informer().SetTransform(func(obj interface{}) (interface{}, error) {
+		vmi, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return obj, nil
+		}
+		stripped := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": vmi.GetAPIVersion(),
+			"kind":       vmi.GetKind(),
+			"metadata":   vmi.Object["metadata"],
+		}}
+		stripped.SetManagedFields(nil)
+		if networks, ok, _ := unstructured.NestedSlice(vmi.Object, "spec", "networks"); ok {
+			_ = unstructured.SetNestedSlice(stripped.Object, networks, "spec", "networks")
+		}
+		if interfaces, ok, _ := unstructured.NestedSlice(vmi.Object, "spec", "domain", "devices", "interfaces"); ok {
+			_ = unstructured.SetNestedSlice(stripped.Object, interfaces, "spec", "domain", "devices", "interfaces")
+		}
+		return stripped, nil
+	})
+	lister := informer.Lister()
+	factory.Start(ctx.Done())
+
+	return func(namespace, name string) (*VMIInfo, error) {
+		if !informer.Informer().HasSynced() {
+			return nil, errVMICacheNotSynced
+		}
+		obj, err := lister.ByNamespace(namespace).Get(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get VMI %s/%s: %w", namespace, name, err)
+		}
+		vmi, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return nil, fmt.Errorf("unexpected VMI object %T", obj)
+		}
+		return &VMIInfo{Annotations: vmi.GetAnnotations(), Binding: vmiSpecBinding(vmi)}, nil
+	}
+}
+
+// vmiSpecBinding returns the binding of the VMI's pod network interface, or of
+// its first macvtap interface if it has none. KubeVirt's default binding is
+// cluster configuration, so an interface list the VMI leaves empty is
+// reported as "".
+func vmiSpecBinding(vmi *unstructured.Unstructured) string {
+	networks, _, _ := unstructured.NestedSlice(vmi.Object, "spec", "networks")
+	podNetwork := ""
+	for _, n := range networks {
+		network, ok := n.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, ok := network["pod"]; ok {
+			podNetwork, _ = network["name"].(string)
+			break
+		}
+	}
+
+	interfaces, _, _ := unstructured.NestedSlice(vmi.Object, "spec", "domain", "devices", "interfaces")
+	macvtap := ""
+	for _, i := range interfaces {
+		iface, ok := i.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		binding := interfaceBinding(iface)
+		if name, _ := iface["name"].(string); podNetwork != "" && name == podNetwork {
+			return binding
+		}
+		if binding == "macvtap" && macvtap == "" {
+			macvtap = binding
+		}
+	}
+	return macvtap
+}
+
+// interfaceBinding returns the supported binding of a VMI interface, from
+// either its core binding field or a network binding plugin of the same
+// name, or "" for other bindings.
+func interfaceBinding(iface map[string]interface{}) string {
+	for _, mode := range []string{"bridge", "masquerade", "passt", "macvtap"} {
+		if _, ok := iface[mode]; ok {
+			return mode
+		}
+	}
+	if plugin, ok := iface["binding"].(map[string]interface{}); ok {
+		if name, _ := plugin["name"].(string); validNetworkMode(name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// vmiOwner returns the name of the VirtualMachineInstance controlling the
+// pod, or "" if it has none.
+func vmiOwner(pod *corev1.Pod) string {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind != "VirtualMachineInstance" || ref.Controller == nil || !*ref.Controller {
+			continue
+		}
+		if gv, err := schema.ParseGroupVersion(ref.APIVersion); err == nil && gv.Group == kube.VMIResource.Group {
+			return ref.Name
+		}
+	}
+	return ""
+}
+
+// vmName returns the name of the pod's VM: the first of the labels the pod
+// has, or the owning VMI for launcher pods without any. It is "" for pods
+// that aren't VM pods.
+func vmName(pod *corev1.Pod, labels []string) string {
+	for _, label := range labels {
+		if name := pod.Labels[label]; name != "" {
+			return name
+		}
+	}
+	return vmiOwner(pod)
+}
+
+// vmNameLabels returns the labels holding the VM name, in the order they
+// are tried
+func (m *Mutator) vmNameLabels() []string {
+	if len(m.config.VMNameLabels) > 0 {
+		return m.config.VMNameLabels
+	}
+	return []string{DomainLabel}
+}
+
+// vmName returns the name of the pod's VM, see vmName
+func (m *Mutator) vmName(pod *corev1.Pod) string {
+	return vmName(pod, m.vmNameLabels())
+}
+
+// withVMIAnnotations returns the pod with the imds.kubevirt.io annotations
+// set on its VMI, but not on the pod, filled in. Annotations set on the VMI
+// object rather than its template never reach the pod otherwise. The pod
+// itself is not modified.
+func (m *Mutator) withVMIAnnotations(pod *corev1.Pod) *corev1.Pod {
+	name := vmiOwner(pod)
+	if m.config.VMI == nil || name == "" {
+		return pod
+	}
+	vmi, err := m.config.VMI(pod.Namespace, name)
+	if err != nil {
+		// The pod's own annotations still apply
+		if !apierrors.IsNotFound(err) {
+			log.Printf("Reading annotations of pod %s/%s only: %v", pod.Namespace, pod.Name, err)
+		}
+		return pod
+	}
+
+	vmiAnnotations := vmi.Annotations
+	var annotations map[string]string
+	for key, value := range vmiAnnotations {
+		if !strings.HasPrefix(key, "imds.kubevirt.io/") || key == AnnotationInjected {
+			continue
+		}
+		if _, ok := pod.Annotations[key]; ok {
+			continue
+		}
+		if annotations == nil {
+			annotations = make(map[string]string, len(pod.Annotations)+len(vmiAnnotations))
+			for k, v := range pod.Annotations {
+				annotations[k] = v
+			}
+		}
+		annotations[key] = value
+	}
+	if annotations == nil {
+		return pod
+	}
+	merged := *pod
+	merged.Annotations = annotations
+	return &merged
+}
+
+// vmiBinding returns the network binding of the pod's VMI, or "" if it is
+// unknown.
+func (m *Mutator) vmiBinding(pod *corev1.Pod) string {
+	name := vmiOwner(pod)
+	if m.config.VMI == nil || name == "" {
+		return ""
+	}
+	// withVMIAnnotations has already logged lookup errors
+	vmi, err := m.config.VMI(pod.Namespace, name)
+	if err != nil {
+		return ""
+	}
+	return vmi.Binding
+}
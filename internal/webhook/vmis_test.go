@@ -0,0 +1,404 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/kubevirt/kubevirt-imds/internal/kube"
+)
+
+func vmiOwnerReference(apiVersion, kind, name string, controller bool) metav1.OwnerReference {
+	return metav1.OwnerReference{APIVersion: apiVersion, Kind: kind, Name: name, UID: types.UID("uid-" + name), Controller: &controller}
+}
+
+func TestVMName(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		owners []metav1.OwnerReference
+		want   string
+	}{
+		{name: "domain label", labels: map[string]string{DomainLabel: "vm-a"}, want: "vm-a"},
+		{
+			name:   "owner VMI",
+			owners: []metav1.OwnerReference{vmiOwnerReference("kubevirt.io/v1", "VirtualMachineInstance", "vm-b", true)},
+			want:   "vm-b",
+		},
+		{
+			name:   "label wins over owner",
+			labels: map[string]string{DomainLabel: "vm-a"},
+			owners: []metav1.OwnerReference{vmiOwnerReference("kubevirt.io/v1", "VirtualMachineInstance", "vm-b", true)},
+			want:   "vm-a",
+		},
+		{
+			name:   "older API version",
+			owners: []metav1.OwnerReference{vmiOwnerReference("kubevirt.io/v1alpha3", "VirtualMachineInstance", "vm-c", true)},
+			want:   "vm-c",
+		},
+		{
+			name:   "not the controller",
+			owners: []metav1.OwnerReference{vmiOwnerReference("kubevirt.io/v1", "VirtualMachineInstance", "vm-d", false)},
+		},
+		{
+			name:   "other group",
+			owners: []metav1.OwnerReference{vmiOwnerReference("example.com/v1", "VirtualMachineInstance", "vm-e", true)},
+		},
+		{
+			name:   "other kind",
+			owners: []metav1.OwnerReference{vmiOwnerReference("apps/v1", "ReplicaSet", "rs", true)},
+		},
+		{name: "neither"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: tt.labels, OwnerReferences: tt.owners}}
+			if got := vmName(pod, []string{DomainLabel}); got != tt.want {
+				t.Errorf("vmName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVMNameLabels(t *testing.T) {
+	owner := []metav1.OwnerReference{vmiOwnerReference("kubevirt.io/v1", "VirtualMachineInstance", "vm-owner", true)}
+	tests := []struct {
+		name   string
+		config []string
+		labels map[string]string
+		owners []metav1.OwnerReference
+		want   string
+	}{
+		{name: "default is the domain label", labels: map[string]string{DomainLabel: "vm-a", "vm.kubevirt.io/name": "vm-b"}, want: "vm-a"},
+		{name: "default ignores other labels", labels: map[string]string{"vm.kubevirt.io/name": "vm-b"}},
+		{
+			name:   "first label present wins",
+			config: []string{"vm.kubevirt.io/name", DomainLabel},
+			labels: map[string]string{DomainLabel: "vm-a", "vm.kubevirt.io/name": "vm-b"},
+			want:   "vm-b",
+		},
+		{
+			name:   "falls through to the next label",
+			config: []string{"vm.kubevirt.io/name", DomainLabel},
+			labels: map[string]string{DomainLabel: "vm-a"},
+			want:   "vm-a",
+		},
+		{
+			name:   "owner after all labels",
+			config: []string{"vm.kubevirt.io/name"},
+			labels: map[string]string{DomainLabel: "vm-a"},
+			owners: owner,
+			want:   "vm-owner",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{IMDSImage: "test-image:latest", VMNameLabels: tt.config})
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Labels:          tt.labels,
+				OwnerReferences: tt.owners,
+				Annotations:     map[string]string{AnnotationEnabled: "true"},
+			}}
+			if got := mutator.vmName(pod); got != tt.want {
+				t.Errorf("vmName() = %q, want %q", got, tt.want)
+			}
+			if got := mutator.ShouldMutate(pod); got != (tt.want != "") {
+				t.Errorf("ShouldMutate() = %v, want %v", got, tt.want != "")
+			}
+		})
+	}
+
+	mutator := NewMutator(Config{IMDSImage: "test-image:latest", VMNameLabels: []string{"vm.kubevirt.io/name", DomainLabel}})
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{AnnotationEnabled: "true"}}}
+	want := "pod has no vm.kubevirt.io/name or kubevirt.io/domain label or VirtualMachineInstance owner; IMDS is only injected into KubeVirt VM pods"
+	if got := mutator.SkipWarnings(pod); len(got) != 1 || got[0] != want {
+		t.Errorf("SkipWarnings() = %q, want %q", got, want)
+	}
+}
+
+func TestShouldMutateVMIOwner(t *testing.T) {
+	vmis := map[string]map[string]string{
+		"opted-in":  {AnnotationEnabled: "true", AnnotationVLAN: "100"},
+		"opted-out": {AnnotationEnabled: "false"},
+		"plain":     {"kubevirt.io/latest-observed-api-version": "v1"},
+	}
+	mutator := NewMutator(Config{
+		IMDSImage: "test-image:latest",
+		VMI: func(namespace, name string) (*VMIInfo, error) {
+			annotations, ok := vmis[name]
+			if !ok {
+				return nil, apierrors.NewNotFound(schema.GroupResource{Group: "kubevirt.io", Resource: "virtualmachineinstances"}, name)
+			}
+			return &VMIInfo{Annotations: annotations}, nil
+		},
+	})
+
+	tests := []struct {
+		name        string
+		vmi         string
+		annotations map[string]string
+		want        bool
+	}{
+		{name: "VMI annotation enables", vmi: "opted-in", want: true},
+		{name: "pod annotation wins over VMI", vmi: "opted-in", annotations: map[string]string{AnnotationEnabled: "false"}, want: false},
+		{name: "VMI annotation disables", vmi: "opted-out", want: false},
+		{name: "pod annotation on owned pod", vmi: "plain", annotations: map[string]string{AnnotationEnabled: "true"}, want: true},
+		{name: "VMI not found", vmi: "missing", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "virt-launcher-" + tt.vmi,
+					Namespace:       "vms",
+					Annotations:     tt.annotations,
+					OwnerReferences: []metav1.OwnerReference{vmiOwnerReference("kubevirt.io/v1", "VirtualMachineInstance", tt.vmi, true)},
+				},
+			}
+			if got := mutator.ShouldMutate(pod); got != tt.want {
+				t.Errorf("ShouldMutate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("mutate", func(t *testing.T) {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "virt-launcher-opted-in",
+				Namespace:       "vms",
+				OwnerReferences: []metav1.OwnerReference{vmiOwnerReference("kubevirt.io/v1", "VirtualMachineInstance", "opted-in", true)},
+			},
+		}
+		patches, err := mutator.Mutate(pod)
+		if err != nil {
+			t.Fatalf("Mutate() error = %v", err)
+		}
+		env := make(map[string]string)
+		for _, e := range patches[1].Value.(corev1.Container).Env {
+			env[e.Name] = e.Value
+		}
+		if env["IMDS_VM_NAME"] != "opted-in" {
+			t.Errorf("IMDS_VM_NAME = %q, want opted-in", env["IMDS_VM_NAME"])
+		}
+		if env["IMDS_VLAN"] != "100" {
+			t.Errorf("IMDS_VLAN = %q, want the VMI's 100", env["IMDS_VLAN"])
+		}
+		// The pod has no annotations of its own, so the map is created
+		if last := patches[len(patches)-1]; last.Path != "/metadata/annotations" {
+			t.Errorf("annotation patch path = %s, want /metadata/annotations", last.Path)
+		}
+		if pod.Annotations != nil {
+			t.Errorf("pod annotations modified: %v", pod.Annotations)
+		}
+	})
+}
+
+func TestWithVMIAnnotationsLookupError(t *testing.T) {
+	mutator := NewMutator(Config{
+		IMDSImage: "test-image:latest",
+		VMI: func(namespace, name string) (*VMIInfo, error) {
+			return nil, fmt.Errorf("cache not synced")
+		},
+	})
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations:     map[string]string{AnnotationEnabled: "true"},
+			OwnerReferences: []metav1.OwnerReference{vmiOwnerReference("kubevirt.io/v1", "VirtualMachineInstance", "vm", true)},
+		},
+	}
+	if got := mutator.withVMIAnnotations(pod); got != pod {
+		t.Errorf("withVMIAnnotations() = %v, want the pod unchanged", got)
+	}
+}
+
+func TestVMISpecBinding(t *testing.T) {
+	podNetwork := []interface{}{map[string]interface{}{"name": "default", "pod": map[string]interface{}{}}}
+	tests := []struct {
+		name       string
+		networks   []interface{}
+		interfaces []interface{}
+		want       string
+	}{
+		{
+			name:       "masquerade",
+			networks:   podNetwork,
+			interfaces: []interface{}{map[string]interface{}{"name": "default", "masquerade": map[string]interface{}{}}},
+			want:       "masquerade",
+		},
+		{
+			name:       "bridge",
+			networks:   podNetwork,
+			interfaces: []interface{}{map[string]interface{}{"name": "default", "bridge": map[string]interface{}{}}},
+			want:       "bridge",
+		},
+		{
+			name:       "passt plugin",
+			networks:   podNetwork,
+			interfaces: []interface{}{map[string]interface{}{"name": "default", "binding": map[string]interface{}{"name": "passt"}}},
+			want:       "passt",
+		},
+		{
+			name:       "other plugin",
+			networks:   podNetwork,
+			interfaces: []interface{}{map[string]interface{}{"name": "default", "binding": map[string]interface{}{"name": "custom"}}},
+		},
+		{
+			name: "pod network interface wins",
+			networks: append([]interface{}{
+				map[string]interface{}{"name": "secondary", "multus": map[string]interface{}{"networkName": "net"}},
+			}, podNetwork...),
+			interfaces: []interface{}{
+				map[string]interface{}{"name": "secondary", "macvtap": map[string]interface{}{}},
+				map[string]interface{}{"name": "default", "bridge": map[string]interface{}{}},
+			},
+			want: "bridge",
+		},
+		{
+			name:     "macvtap without pod network",
+			networks: []interface{}{map[string]interface{}{"name": "secondary", "multus": map[string]interface{}{"networkName": "net"}}},
+			interfaces: []interface{}{
+				map[string]interface{}{"name": "secondary", "macvtap": map[string]interface{}{}},
+			},
+			want: "macvtap",
+		},
+		{name: "cluster default binding", networks: podNetwork},
+		{name: "no networks"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vmi := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			if tt.networks != nil {
+				_ = unstructured.SetNestedSlice(vmi.Object, tt.networks, "spec", "networks")
+			}
+			if tt.interfaces != nil {
+				_ = unstructured.SetNestedSlice(vmi.Object, tt.interfaces, "spec", "domain", "devices", "interfaces")
+			}
+			if got := vmiSpecBinding(vmi); got != tt.want {
+				t.Errorf("vmiSpecBinding() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMutateVMIBinding(t *testing.T) {
+	tests := []struct {
+		name        string
+		binding     string
+		annotations map[string]string
+		wantMode    string
+		wantRaw     bool
+	}{
+		{name: "unknown", wantRaw: true},
+		{name: "bridge", binding: "bridge", wantRaw: true},
+		{name: "masquerade keeps the veth", binding: "masquerade", wantRaw: true},
+		{name: "passt", binding: "passt", wantMode: "passt"},
+		{name: "macvtap", binding: "macvtap", wantMode: "macvtap", wantRaw: true},
+		{
+			name:        "annotation wins",
+			binding:     "passt",
+			annotations: map[string]string{AnnotationNetworkMode: "bridge"},
+			wantMode:    "bridge",
+			wantRaw:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutator := NewMutator(Config{
+				IMDSImage: "test-image:latest",
+				VMI: func(namespace, name string) (*VMIInfo, error) {
+					return &VMIInfo{Annotations: map[string]string{AnnotationEnabled: "true"}, Binding: tt.binding}, nil
+				},
+			})
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:       "vms",
+					Annotations:     tt.annotations,
+					OwnerReferences: []metav1.OwnerReference{vmiOwnerReference("kubevirt.io/v1", "VirtualMachineInstance", "vm", true)},
+				},
+			}
+			patches, err := mutator.Mutate(pod)
+			if err != nil {
+				t.Fatalf("Mutate() error = %v", err)
+			}
+			container := patches[1].Value.(corev1.Container)
+			env := make(map[string]string)
+			for _, e := range container.Env {
+				env[e.Name] = e.Value
+			}
+			if env["IMDS_BINDING_MODE"] != tt.binding {
+				t.Errorf("IMDS_BINDING_MODE = %q, want %q", env["IMDS_BINDING_MODE"], tt.binding)
+			}
+			if env["IMDS_NETWORK_MODE"] != tt.wantMode {
+				t.Errorf("IMDS_NETWORK_MODE = %q, want %q", env["IMDS_NETWORK_MODE"], tt.wantMode)
+			}
+			hasRaw := false
+			for _, c := range container.SecurityContext.Capabilities.Add {
+				hasRaw = hasRaw || c == "NET_RAW"
+			}
+			if hasRaw != tt.wantRaw {
+				t.Errorf("NET_RAW added = %v, want %v", hasRaw, tt.wantRaw)
+			}
+		})
+	}
+}
+
+func TestVMILookup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vmi := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "kubevirt.io/v1",
+		"kind":       "VirtualMachineInstance",
+		"metadata": map[string]interface{}{
+			"name":        "vm",
+			"namespace":   "vms",
+			"annotations": map[string]interface{}{AnnotationEnabled: "true"},
+		},
+		"spec": map[string]interface{}{
+			"networks": []interface{}{map[string]interface{}{"name": "default", "pod": map[string]interface{}{}}},
+			"domain": map[string]interface{}{"devices": map[string]interface{}{
+				"interfaces": []interface{}{map[string]interface{}{"name": "default", "masquerade": map[string]interface{}{}}},
+			}},
+		},
+	}}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{kube.VMIResource: "VirtualMachineInstanceList"}, vmi)
+
+	lookup := VMILookup(ctx, client)
+
+	var info *VMIInfo
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if info, err = lookup("vms", "vm"); err != errVMICacheNotSynced {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("lookup(vms/vm) error = %v", err)
+	}
+	if info.Annotations[AnnotationEnabled] != "true" {
+		t.Errorf("lookup(vms/vm) annotations = %v, want %s=true", info.Annotations, AnnotationEnabled)
+	}
+	if info.Binding != "masquerade" {
+		t.Errorf("lookup(vms/vm) binding = %q, want masquerade", info.Binding)
+	}
+
+	if _, err := lookup("vms", "missing"); !apierrors.IsNotFound(err) {
+		t.Errorf("lookup(vms/missing) error = %v, want NotFound", err)
+	}
+}
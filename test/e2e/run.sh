@@ -77,6 +77,7 @@ cleanup() {
     kctl delete vm testvm-imds -n ${TEST_NAMESPACE} --ignore-not-found=true || true
     kctl delete vm testvm-imds-a -n ${TEST_NAMESPACE} --ignore-not-found=true || true
     kctl delete vm testvm-imds-b -n ${TEST_NAMESPACE} --ignore-not-found=true || true
+    kctl delete vm testvm-imds-ipv6 -n ${TEST_NAMESPACE} --ignore-not-found=true || true
     kctl delete pod network-sniffer -n ${TEST_NAMESPACE} --ignore-not-found=true || true
 }
 
@@ -89,9 +90,10 @@ wait_for_vm_pod() {
 
     local end_time=$((SECONDS + timeout))
     while [ $SECONDS -lt $end_time ]; do
-        # Get container ready status and count
+        # Get container ready status and count, including imds-server when
+        # it runs as a native sidecar
         local status_output
-        status_output=$(kctl get pod -n ${TEST_NAMESPACE} -l kubevirt.io/domain=${vm_name} -o jsonpath='{.items[0].status.containerStatuses[*].ready}' 2>/dev/null) || status_output=""
+        status_output=$(kctl get pod -n ${TEST_NAMESPACE} -l kubevirt.io/domain=${vm_name} -o jsonpath='{.items[0].status.initContainerStatuses[?(@.name=="imds-server")].ready} {.items[0].status.containerStatuses[*].ready}' 2>/dev/null) || status_output=""
 
         local ready=0
         local total=0
@@ -190,9 +192,9 @@ test_basic_imds() {
     pod_name=$(get_pod_name "${vm_name}")
     log_info "Pod name: ${pod_name}"
 
-    # Verify IMDS sidecar is injected
+    # Verify IMDS sidecar is injected, as a regular or native sidecar
     local containers
-    containers=$(kctl get pod -n ${TEST_NAMESPACE} ${pod_name} -o jsonpath='{.spec.containers[*].name}')
+    containers=$(kctl get pod -n ${TEST_NAMESPACE} ${pod_name} -o jsonpath='{.spec.initContainers[*].name} {.spec.containers[*].name}')
 
     if echo "$containers" | grep -q "imds-server"; then
         log_info "IMDS sidecar found: ${containers}"
@@ -383,6 +385,42 @@ test_no_traffic_leak() {
     return $failed
 }
 
+# Test 4: IMDS over IPv6
+test_ipv6_imds() {
+    log_step "Test 4: IMDS over IPv6"
+
+    local vm_name="testvm-imds-ipv6"
+
+    log_info "Creating test VM: ${vm_name}"
+    kctl apply -f deploy/test/vm-with-imds-ipv6.yaml
+
+    wait_for_vm_pod "${vm_name}" 3 ${TIMEOUT_SECONDS}
+
+    local pod_name
+    pod_name=$(get_pod_name "${vm_name}")
+    log_info "Pod name: ${pod_name}"
+
+    # Give IMDS server time to set up veth and start
+    sleep 5
+
+    local failed=0
+
+    for endpoint in /healthz /v1/identity /v1/token; do
+        log_info "Testing ${endpoint} over IPv6..."
+        local response
+        response=$(kctl exec -n ${TEST_NAMESPACE} ${pod_name} -c compute -- curl -sf -6 "http://[fd00:ec2::254]${endpoint}" 2>/dev/null) || {
+            log_error "Failed to reach ${endpoint} over IPv6"
+            ((failed++))
+            continue
+        }
+        log_info "  Response: ${response:0:100}..."
+    done
+
+    kctl delete vm ${vm_name} -n ${TEST_NAMESPACE} --wait=false
+
+    return $failed
+}
+
 # Main test flow
 main() {
     log_step "E2E Test Suite: kubevirt-imds"
@@ -404,7 +442,9 @@ main() {
     CA_BUNDLE=$(echo "$CERT_OUTPUT" | grep -A1 "CA Bundle (base64):" | tail -1)
 
     kctl apply -f deploy/webhook/namespace.yaml
+    kctl apply -f deploy/webhook/crd.yaml
     kctl apply -f deploy/webhook/rbac.yaml
+    kctl apply -f deploy/webhook/configmap.yaml
     kctl apply -f deploy/webhook/deployment.yaml
     kctl apply -f deploy/webhook/service.yaml
     kctl apply -f deploy/webhook/webhook.yaml
@@ -412,7 +452,7 @@ main() {
     # Patch webhook with CA bundle
     log_info "Patching webhook with CA bundle..."
     kctl patch mutatingwebhookconfiguration imds-webhook --type='json' \
-        -p="[{\"op\": \"add\", \"path\": \"/webhooks/0/clientConfig/caBundle\", \"value\":\"${CA_BUNDLE}\"}]"
+        -p="[{\"op\": \"add\", \"path\": \"/webhooks/0/clientConfig/caBundle\", \"value\":\"${CA_BUNDLE}\"}, {\"op\": \"add\", \"path\": \"/webhooks/1/clientConfig/caBundle\", \"value\":\"${CA_BUNDLE}\"}]"
 
     # Restart webhook to pick up new TLS certificate
     log_info "Restarting webhook to pick up new certificate..."
@@ -436,6 +476,11 @@ main() {
 
     test_no_traffic_leak || ((total_failed++))
 
+    # Wait for cleanup before starting IPv6 test
+    sleep 10
+
+    test_ipv6_imds || ((total_failed++))
+
     # Summary
     log_step "Test Summary"
     if [ $total_failed -eq 0 ]; then
@@ -0,0 +1,220 @@
+// Package integration runs the webhook against a real API server started by
+// envtest. The API server sends AdmissionReviews to the server.go handler over
+// TLS and applies its JSON patches, covering what the unit tests fake.
+//
+// The tests need the kube-apiserver and etcd binaries; run them with
+// make test-integration, or point KUBEBUILDER_ASSETS at the binaries.
+package integration
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	"github.com/kubevirt/kubevirt-imds/internal/webhook"
+)
+
+const testImage = "imds-server:test"
+
+var client kubernetes.Interface
+
+func TestMain(m *testing.M) {
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		log.Println("KUBEBUILDER_ASSETS is not set, skipping integration tests (see make test-integration)")
+		os.Exit(0)
+	}
+	os.Exit(run(m))
+}
+
+// run starts the API server with the deployed MutatingWebhookConfiguration,
+// pointed at a webhook server in this process, and runs the tests.
+func run(m *testing.M) int {
+	env := &envtest.Environment{
+		WebhookInstallOptions: envtest.WebhookInstallOptions{
+			Paths: []string{filepath.Join("..", "..", "deploy", "webhook", "webhook.yaml")},
+		},
+	}
+	cfg, err := env.Start()
+	if err != nil {
+		log.Printf("Failed to start envtest: %v", err)
+		return 1
+	}
+	defer env.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := env.WebhookInstallOptions
+	addr := net.JoinHostPort(opts.LocalServingHost, strconv.Itoa(opts.LocalServingPort))
+	mutator := webhook.NewMutator(webhook.Config{
+		IMDSImage:       testImage,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Resources:       webhook.DefaultResources(),
+	})
+	server := webhook.NewServer(mutator, addr,
+		filepath.Join(opts.LocalServingCertDir, "tls.crt"),
+		filepath.Join(opts.LocalServingCertDir, "tls.key"))
+	go func() {
+		if err := server.Run(ctx); err != nil {
+			log.Printf("Webhook server failed: %v", err)
+		}
+	}()
+	if err := waitForServer(addr); err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	if client, err = kubernetes.NewForConfig(cfg); err != nil {
+		log.Printf("Failed to create client: %v", err)
+		return 1
+	}
+	return m.Run()
+}
+
+// waitForServer waits until the webhook accepts TLS connections.
+func waitForServer(addr string) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("webhook server not listening on %s: %w", addr, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// testNamespace creates a namespace for one test. envtest runs no namespace
+// controller, so it is never cleaned up.
+func testNamespace(t *testing.T) string {
+	t.Helper()
+	ns, err := client.CoreV1().Namespaces().Create(context.Background(), &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "imds-test-"},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create namespace: %v", err)
+	}
+	return ns.Name
+}
+
+// launcherPod returns a virt-launcher-like pod for the VM.
+func launcherPod(vm string, labels, annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "virt-launcher-" + vm + "-",
+			Labels:       labels,
+			Annotations:  annotations,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "compute", Image: "virt-launcher:test"}},
+		},
+	}
+}
+
+// sidecar returns the injected IMDS container, or nil.
+func sidecar(pod *corev1.Pod) *corev1.Container {
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == webhook.ContainerName {
+			return &pod.Spec.Containers[i]
+		}
+	}
+	return nil
+}
+
+func TestCreate(t *testing.T) {
+	launcher := map[string]string{"kubevirt.io": "virt-launcher", webhook.DomainLabel: "test-vm"}
+	enabled := map[string]string{webhook.AnnotationEnabled: "true"}
+
+	tests := []struct {
+		name         string
+		labels       map[string]string
+		annotations  map[string]string
+		dryRun       bool
+		wantInjected bool
+	}{
+		{name: "opted-in launcher pod", labels: launcher, annotations: enabled, wantInjected: true},
+		{name: "dry-run create", labels: launcher, annotations: enabled, dryRun: true, wantInjected: true},
+		{name: "launcher pod not opted in", labels: launcher},
+		{name: "not a launcher pod", labels: map[string]string{webhook.DomainLabel: "test-vm"}, annotations: enabled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			ns := testNamespace(t)
+
+			opts := metav1.CreateOptions{}
+			if tt.dryRun {
+				opts.DryRun = []string{metav1.DryRunAll}
+			}
+			pod, err := client.CoreV1().Pods(ns).Create(ctx, launcherPod("test-vm", tt.labels, tt.annotations), opts)
+			if err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+
+			container := sidecar(pod)
+			if !tt.wantInjected {
+				if container != nil || pod.Annotations[webhook.AnnotationInjected] != "" {
+					t.Errorf("pod was injected: containers %d, annotations %v", len(pod.Spec.Containers), pod.Annotations)
+				}
+				return
+			}
+			if container == nil {
+				t.Fatalf("no %s container in %+v", webhook.ContainerName, pod.Spec.Containers)
+			}
+			if container.Image != testImage {
+				t.Errorf("image = %q, want %q", container.Image, testImage)
+			}
+			if pod.Annotations[webhook.AnnotationInjected] != "true" || pod.Annotations[webhook.AnnotationConfigHash] == "" {
+				t.Errorf("annotations = %v, want injected and a config hash", pod.Annotations)
+			}
+			volumes := make(map[string]bool)
+			for _, v := range pod.Spec.Volumes {
+				volumes[v.Name] = true
+			}
+			if !volumes[webhook.TokenVolumeName] {
+				t.Errorf("volumes = %v, want %s", volumes, webhook.TokenVolumeName)
+			}
+		})
+	}
+}
+
+func TestUpdateRestoresInjectedAnnotation(t *testing.T) {
+	ctx := context.Background()
+	ns := testNamespace(t)
+	pods := client.CoreV1().Pods(ns)
+
+	pod, err := pods.Create(ctx, launcherPod("test-vm",
+		map[string]string{"kubevirt.io": "virt-launcher", webhook.DomainLabel: "test-vm"},
+		map[string]string{webhook.AnnotationEnabled: "true"}), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if sidecar(pod) == nil {
+		t.Fatalf("pod was not injected")
+	}
+
+	delete(pod.Annotations, webhook.AnnotationInjected)
+	pod, err = pods.Update(ctx, pod, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if pod.Annotations[webhook.AnnotationInjected] != "true" {
+		t.Errorf("annotations = %v, want %s restored", pod.Annotations, webhook.AnnotationInjected)
+	}
+}